@@ -0,0 +1,146 @@
+// Package main provides a read-through block cache serving the storage
+// protocol, deployed near its readers to absorb their reads.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"invariant/internal/discovery"
+	"invariant/internal/finder"
+	"invariant/internal/identity"
+	"invariant/internal/notify"
+	"invariant/internal/storage"
+)
+
+func main() {
+	var discoveryURL string
+	flag.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
+	var dir string
+	flag.StringVar(&dir, "dir", "", "Directory storing the cached blocks (in memory if not set)")
+	var sizeMB int
+	flag.IntVar(&sizeMB, "size", 1024, "Size of the cache in MB; the least recently used blocks are evicted beyond 80% of it")
+	var noVerify bool
+	flag.BoolVar(&noVerify, "no-verify", false, "Skip checking cached blocks against their address when they are read")
+	var advertiseAddr string
+	flag.StringVar(&advertiseAddr, "advertise", "", "Address to advertise to the discovery service, or a comma separated list of [label=]addresses")
+	var notifyIDs string
+	flag.StringVar(&notifyIDs, "notify", "", "Comma-separated list of IDs implementing the Notify protocol, such as finders, told of the cached blocks")
+	var port int
+	flag.IntVar(&port, "port", 0, "Port to listen on (0 for random available port)")
+	var name string
+	flag.StringVar(&name, "name", "", "Name to register with the names service")
+	var keyPath string
+	flag.StringVar(&keyPath, "key", "", "Ed25519 private key file, created if missing, identifying the cache. The cache ID becomes the hash of its public key.")
+	flag.Parse()
+
+	if discoveryURL == "" {
+		log.Fatalf("Discovery URL is required")
+	}
+	if sizeMB <= 0 {
+		log.Fatalf("The cache size must be positive")
+	}
+	dClient := discovery.NewClient(discoveryURL, nil)
+	ctx := context.Background()
+
+	// Blocks missing from the cache are read from the storage services, never
+	// from other caches
+	var blockFinder finder.Finder
+	if addr, err := discovery.FindAddress(ctx, dClient, "finder-v1"); err == nil {
+		blockFinder = finder.NewClient(addr, nil)
+	}
+	config := storage.DefaultAggregateConfig()
+	config.IgnoreCaches = true
+	upstream := storage.NewAggregateClient(blockFinder, dClient, config)
+
+	var local storage.ControlledStorage = storage.NewInMemoryStorage()
+	if dir != "" {
+		local = storage.NewFileSystemStorage(dir)
+	}
+	maxSize := int64(sizeMB) * 1024 * 1024
+	cache := storage.NewCachingStorage(local, upstream, maxSize, maxSize*8/10, false)
+	cache.SetVerify(!noVerify)
+
+	id := local.(identity.Identity).ID()
+	server := storage.NewStorageServer(identifiedCache{cache, id})
+	var signingKey *identity.KeyPair
+	if keyPath != "" {
+		key, err := identity.LoadOrCreateKeyPair(keyPath)
+		if err != nil {
+			log.Fatalf("Failed to load key pair: %v", err)
+		}
+		signingKey = key
+		id = key.ID()
+		server.WithKeyPair(key)
+	}
+
+	addr := fmt.Sprintf(":%d", port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", addr, err)
+	}
+	actualPort := listener.Addr().(*net.TCPAddr).Port
+
+	if err := discovery.AdvertiseAndRegister(ctx, dClient, id, advertiseAddr, actualPort, []string{finder.CacheProtocol}); err != nil {
+		log.Fatalf("Failed to register with discovery service: %v", err)
+	}
+	log.Printf("Registered with discovery service %s as %s", discoveryURL, id)
+	if name != "" {
+		go func() {
+			if err := discovery.RegisterName(ctx, dClient, name, id, []string{finder.CacheProtocol}); err != nil {
+				log.Printf("Failed to register name %q: %v", name, err)
+			} else {
+				log.Printf("Registered name %q for ID %s", name, id)
+			}
+		}()
+	}
+
+	// Finders are told the cached blocks are served by a cache, so readers
+	// prefer it to the storage services while it has them
+	var notifyClients []storage.NotifyClient
+	for hid := range strings.SplitSeq(notifyIDs, ",") {
+		hid = strings.TrimSpace(hid)
+		if hid == "" {
+			continue
+		}
+		desc, err := discovery.ResolveWithRetry(ctx, dClient, hid, 5, 2*time.Second)
+		if err != nil {
+			log.Fatalf("Could not resolve notify name/id %s: %v", hid, err)
+		}
+		notifyClients = append(notifyClients, notify.NewClient(desc.Address, nil).WithSigningKey(signingKey).WithProtocol(finder.CacheProtocol))
+	}
+	if len(notifyClients) > 0 {
+		server.StartNotification(ctx, notifyClients, 10000, time.Second)
+	}
+
+	log.Printf("Caching up to %d MB, listening on :%d...", sizeMB, actualPort)
+	log.Fatal(http.Serve(listener, readOnly(server)))
+}
+
+// identifiedCache identifies the cache by the ID of its local storage.
+type identifiedCache struct {
+	*storage.CachingStorage
+	id string
+}
+
+func (c identifiedCache) ID() string {
+	return c.id
+}
+
+// readOnly rejects requests that would store blocks, so the cache only holds
+// the blocks read through it.
+func readOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "cache is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
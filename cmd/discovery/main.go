@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"time"
 
+	"invariant/internal/cap"
 	"invariant/internal/discovery"
 )
 
@@ -23,6 +26,14 @@ func main() {
 	flag.DurationVar(&healthInterval, "health-interval", 30*time.Second, "Interval for active health checks")
 	var healthTimeout time.Duration
 	flag.DurationVar(&healthTimeout, "health-timeout", 5*time.Minute, "Time before a continuously unhealthy node is evicted")
+	var expiryInterval time.Duration
+	flag.DurationVar(&expiryInterval, "expiry-interval", 30*time.Second, "Interval for removing the registrations whose TTL has passed, which are never found even before they are removed")
+	var id string
+	flag.StringVar(&id, "id", "", "ID of the discovery service (32-byte hex). Randomly generated if not provided.")
+	var advertiseAddr string
+	flag.StringVar(&advertiseAddr, "advertise", "", "Address to advertise when registering the discovery service with itself (and its upstream)")
+	var capKeyPath string
+	flag.StringVar(&capKeyPath, "cap-key", "", "File with the root key, created if missing, verifying capability tokens. Requests without a token allowing them are rejected.")
 	flag.Parse()
 
 	var localD discovery.Discovery
@@ -31,6 +42,9 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to initialize file system discovery: %v", err)
 		}
+		if expiryInterval > 0 {
+			fsd = fsd.WithExpiry(expiryInterval)
+		}
 		if healthInterval > 0 {
 			fsd = fsd.WithHealthTracking(healthInterval, healthTimeout)
 		}
@@ -38,6 +52,9 @@ func main() {
 		localD = fsd
 	} else {
 		imd := discovery.NewInMemoryDiscovery()
+		if expiryInterval > 0 {
+			imd = imd.WithExpiry(expiryInterval)
+		}
 		if healthInterval > 0 {
 			imd = imd.WithHealthTracking(healthInterval, healthTimeout)
 		}
@@ -45,8 +62,9 @@ func main() {
 	}
 
 	var d discovery.Discovery
+	var parent *discovery.Client
 	if upstreamURL != "" {
-		parent := discovery.NewClient(upstreamURL, nil)
+		parent = discovery.NewClient(upstreamURL, nil)
 		d = discovery.NewUpstreamDiscovery(localD, parent)
 		log.Printf("Using Upstream discovery delegation pointing to %s", upstreamURL)
 	} else {
@@ -59,9 +77,40 @@ func main() {
 	}
 
 	server := discovery.NewDiscoveryServer(d)
+	if id != "" {
+		server = server.WithID(id)
+	}
 
 	addr := fmt.Sprintf(":%d", port)
-	log.Printf("Discovery service listening on %s...", addr)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", addr, err)
+	}
+	actualPort := listener.Addr().(*net.TCPAddr).Port
+
+	if advertiseAddr != "" {
+		protocols := []string{"discovery-v1"}
+		if err := discovery.AdvertiseAndRegister(context.Background(), d, server.ID(), advertiseAddr, actualPort, protocols); err != nil {
+			log.Fatalf("Failed to register the discovery service with itself: %v", err)
+		}
+		if parent != nil {
+			if err := discovery.AdvertiseAndRegister(context.Background(), parent, server.ID(), advertiseAddr, actualPort, protocols); err != nil {
+				log.Printf("Failed to register with upstream discovery service %s: %v", upstreamURL, err)
+			}
+		}
+		log.Printf("Registered discovery service as %s", server.ID())
+	}
+
+	log.Printf("Discovery service listening on :%d...", actualPort)
 
-	log.Fatal(http.ListenAndServe(addr, server))
+	var handler http.Handler = server
+	if capKeyPath != "" {
+		capKey, err := cap.LoadOrCreateKey(capKeyPath)
+		if err != nil {
+			log.Fatalf("Failed to load capability key: %v", err)
+		}
+		handler = cap.NewVerifier(capKey).Require(server, cap.DiscoveryRequest)
+		log.Printf("Requiring capability tokens verified by %s", capKeyPath)
+	}
+	log.Fatal(http.Serve(listener, handler))
 }
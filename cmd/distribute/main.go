@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"time"
 
+	"invariant/internal/cap"
 	"invariant/internal/discovery"
 	"invariant/internal/distribute"
 )
@@ -19,7 +20,7 @@ func main() {
 	var discoveryURL string
 	flag.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
 	var advertiseAddr string
-	flag.StringVar(&advertiseAddr, "advertise", "", "Address to advertise to the discovery service")
+	flag.StringVar(&advertiseAddr, "advertise", "", "Address to advertise to the discovery service, or a comma separated list of [label=]addresses")
 	var repFactor int
 	flag.IntVar(&repFactor, "N", 3, "Replication factor for blocks")
 	var destination string
@@ -30,6 +31,16 @@ func main() {
 	flag.IntVar(&port, "port", 0, "Port to listen on (0 for random available port)")
 	var name string
 	flag.StringVar(&name, "name", "", "Name to register with the names service")
+	var wantLists bool
+	flag.BoolVar(&wantLists, "want-lists", false, "Replicate blocks through the want lists of storage services, which push wanted blocks to each other, instead of asking them to fetch each block")
+	var eventLogPath string
+	flag.StringVar(&eventLogPath, "event-log", "", "File to append the replication decisions to, queried with GET /events (disabled if not set)")
+	var eventLogMaxSize int64
+	flag.Int64Var(&eventLogMaxSize, "event-log-max-size", distribute.DefaultEventLogMaxSize, "Size in bytes the event log grows to before it is moved to <file>.1, replacing the previous one (0 to never rotate it)")
+	var configPath string
+	flag.StringVar(&configPath, "config", "", "File to save the configuration changed with PUT /config to; once saved, it replaces -N, -backup-rate and -want-lists on restart (not saved if not set)")
+	var capKeyPath string
+	flag.StringVar(&capKeyPath, "cap-key", "", "File with the root key, created if missing, verifying capability tokens. Requests without a token allowing them are rejected.")
 	flag.Parse()
 
 	var disc discovery.Discovery
@@ -48,7 +59,21 @@ func main() {
 		}
 	}
 
-	d := distribute.NewInMemoryDistribute(disc, repFactor, 3, destination, backupRate)
+	d := distribute.NewInMemoryDistribute(disc, repFactor, 3, destination, backupRate).WithWantLists(wantLists)
+	if configPath != "" {
+		if _, err := d.WithConfigFile(configPath); err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
+		}
+	}
+	if eventLogPath != "" {
+		events, err := distribute.OpenEventLog(eventLogPath)
+		if err != nil {
+			log.Fatalf("Failed to open event log: %v", err)
+		}
+		defer events.Close()
+		d.WithEventLog(events.WithMaxSize(eventLogMaxSize))
+		log.Printf("Recording replication events in %s", eventLogPath)
+	}
 	if disc != nil {
 		d.StartSync(10 * time.Second)
 	}
@@ -85,5 +110,14 @@ func main() {
 	log.Printf("Distribute service (ID %s) listening on :%d...", server.ID(), actualPort)
 	log.Printf("Using In-Memory distribute storage")
 
-	log.Fatal(http.Serve(listener, server))
+	var handler http.Handler = server
+	if capKeyPath != "" {
+		capKey, err := cap.LoadOrCreateKey(capKeyPath)
+		if err != nil {
+			log.Fatalf("Failed to load capability key: %v", err)
+		}
+		handler = cap.NewVerifier(capKey).Require(server, cap.DistributeRequest)
+		log.Printf("Requiring capability tokens verified by %s", capKeyPath)
+	}
+	log.Fatal(http.Serve(listener, handler))
 }
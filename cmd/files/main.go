@@ -1,18 +1,27 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"invariant/internal/cap"
 	"invariant/internal/content"
 	"invariant/internal/discovery"
+	"invariant/internal/distribute"
 	"invariant/internal/files"
+	"invariant/internal/filetree"
 	"invariant/internal/finder"
+	"invariant/internal/identity"
 	"invariant/internal/slots"
 	"invariant/internal/storage"
 )
@@ -24,10 +33,74 @@ func main() {
 	flag.StringVar(&rootAddr, "root", "", "Root block or slot address")
 	var slot string
 	flag.StringVar(&slot, "slot", "", "Whether the root address refers to a slot")
+	var createRoot bool
+	flag.BoolVar(&createRoot, "create-root", false, "Create the root slot, initialized to an empty directory, if it does not exist")
+	var readOnly bool
+	flag.BoolVar(&readOnly, "read-only", false, "Allow the service to start read-only when the root cannot be written")
+	var compress bool
+	flag.BoolVar(&compress, "compress", false, "Compress the written content")
+	var encrypt bool
+	flag.BoolVar(&encrypt, "encrypt", false, "Encrypt the written content")
+	var keyPolicyStr string
+	flag.StringVar(&keyPolicyStr, "key-policy", "Deterministic", "Encryption key policy (RandomPerBlock, RandomAllKey, Deterministic, SuppliedAllKey)")
+	var keyFile string
+	flag.StringVar(&keyFile, "key-file", "", "File containing the 32-byte key used by SuppliedAllKey (defaults to the "+content.KeyEnvVar+" environment variable)")
+	var inlineMax int
+	flag.IntVar(&inlineMax, "inline-max", 0, "Largest file, in bytes, held in its directory entry instead of a block (0 to disable)")
+	var policyKeyList string
+	flag.StringVar(&policyKeyList, "policy-keys", "", "Comma separated name=file pairs of the keys that directory storage policies name with keyName")
+	var maxSize uint64
+	flag.Uint64Var(&maxSize, "max-size", 0, "Maximum logical size in bytes of the files under the root (0 for unlimited)")
+	var maxNodes int
+	flag.IntVar(&maxNodes, "max-nodes", 0, "Maximum number of nodes kept in memory per root before clean directories are unloaded (0 for unlimited)")
+	var multiRoot bool
+	flag.BoolVar(&multiRoot, "multi-root", false, "Serve any slot on demand under /fs/{slot}/ instead of a single root")
+	var maxRoots int
+	flag.IntVar(&maxRoots, "max-roots", 100, "Maximum number of roots kept open in -multi-root mode (0 for unlimited)")
+	var idleTimeout time.Duration
+	flag.DurationVar(&idleTimeout, "idle-timeout", 10*time.Minute, "Close roots unused for this long in -multi-root mode (0 to only close roots to honor -max-roots)")
+	var journalDir string
+	flag.StringVar(&journalDir, "journal-dir", "", "Directory where changes are journaled until they are synced, so they survive a crash (one sub-directory per slot in -multi-root mode)")
+	var commitSlot string
+	flag.StringVar(&commitSlot, "commit-slot", "", "Slot holding a log of commits, one appended each time the root slot is published")
+	var author string
+	flag.StringVar(&author, "author", "", "Author recorded in the commits appended to -commit-slot")
+	var signer string
+	flag.StringVar(&signer, "signer", "", "Identity ID that must have signed the root before it is served or a remote update of it is merged")
+	var rootSignature string
+	flag.StringVar(&rootSignature, "root-signature", "", "Address of the signature of a -root block checked against -signer")
+	var signatureSlot string
+	flag.StringVar(&signatureSlot, "signature-slot", "", "Slot holding the address of the signature of the root the root slot holds")
+	var signingKeyPath string
+	flag.StringVar(&signingKeyPath, "signing-key", "", "Ed25519 private key file, created if missing, signing each published root into -signature-slot")
+	var verifyInterval time.Duration
+	flag.DurationVar(&verifyInterval, "verify-interval", 0, "Read back the content synced since the last verification this often, reporting content that does not match its hash (0 to disable)")
+	var requireIfMatch bool
+	flag.BoolVar(&requireIfMatch, "require-if-match", false, "Reject requests that modify or remove an existing entry without an If-Match header")
+	var maxStagedSize int64
+	flag.Int64Var(&maxStagedSize, "max-staged-size", files.DefaultMaxStagedSize, "Maximum size in bytes of the body of a write with an If-Match or If-None-Match header, which is received in full before the precondition is evaluated (0 for unlimited)")
 	var port int
 	flag.IntVar(&port, "port", 0, "Port to listen on (0 for random available port)")
+	storageCfg := storage.DefaultAggregateConfig()
+	flag.IntVar(&storageCfg.MaxBlocks, "storage-max-blocks", storageCfg.MaxBlocks, "Maximum number of block locations cached by the storage client (0 for unlimited)")
+	flag.IntVar(&storageCfg.Replicas, "storage-replicas", storageCfg.Replicas, "Number of storage servers each written block is stored on")
+	flag.DurationVar(&storageCfg.Timeout, "storage-timeout", storageCfg.Timeout, "Timeout of each request to a storage server (0 for none)")
+	flag.DurationVar(&storageCfg.Hedge, "storage-hedge", storageCfg.Hedge, "Also read a block from another storage server when one has not answered within this delay (0 to disable)")
+	flag.BoolVar(&storageCfg.ReadRepair, "storage-read-repair", storageCfg.ReadRepair, "Write a block read from one storage server back to the servers expected to have it that are missing it")
+	var capKeyPath string
+	flag.StringVar(&capKeyPath, "cap-key", "", "File with the root key, created if missing, verifying capability tokens. Requests without a token allowing them are rejected.")
 	flag.Parse()
 
+	var verifier *cap.Verifier
+	if capKeyPath != "" {
+		capKey, err := cap.LoadOrCreateKey(capKeyPath)
+		if err != nil {
+			log.Fatalf("Failed to load capability key: %v", err)
+		}
+		verifier = cap.NewVerifier(capKey)
+		log.Printf("Requiring capability tokens verified by %s", capKeyPath)
+	}
+
 	var dClient discovery.Discovery
 	if discoveryURL != "" {
 		dClient = discovery.NewClient(discoveryURL, nil)
@@ -35,28 +108,62 @@ func main() {
 		log.Fatalf("Discovery URL is required")
 	}
 
+	writerOpts, err := writerOptions(compress, encrypt, keyPolicyStr, keyFile)
+	if err != nil {
+		log.Fatalf("Invalid writer options: %v", err)
+	}
+	writerOpts.InlineMax = inlineMax
+	keys, err := policyKeys(policyKeyList)
+	if err != nil {
+		log.Fatalf("Invalid policy keys: %v", err)
+	}
+
+	var signingKey *identity.KeyPair
+	if signingKeyPath != "" {
+		signingKey, err = identity.LoadOrCreateKeyPair(signingKeyPath)
+		if err != nil {
+			log.Fatalf("Failed to load signing key: %v", err)
+		}
+		log.Printf("Signing published roots as %s", signingKey.ID())
+	}
+
+	if multiRoot {
+		serveMultiRoot(dClient, storageCfg, writerOpts, keys, createRoot, maxSize, maxNodes, journalDir, verifyInterval, maxRoots, idleTimeout, requireIfMatch, maxStagedSize, port, verifier)
+		return
+	}
+
 	rootIsSlot := false
 	if slot != "" {
 		rootAddr = slot
 		rootIsSlot = true
+	} else if rootAddr == "" && createRoot {
+		rootAddr = generateID()
+		rootIsSlot = true
 	}
 
-	findService := func(kind string) string {
-		id, err := dClient.Find(context.Background(), kind, 1)
-		if err != nil {
-			log.Fatalf("Could not find %s service: %v", kind, err)
-		}
-		if len(id) == 0 {
-			log.Fatalf("Could not find %s service", kind)
+	if rootAddr == "" {
+		log.Fatalf("Either -root or -slot is required (or -create-root to allocate a new slot)")
+	}
+
+	storageClient, slotsClient := connectServices(dClient, storageCfg)
+
+	if !readOnly {
+		switch {
+		case !rootIsSlot:
+			log.Fatalf("The files service would be read-only: -root refers to a block, use -slot to serve a writable root or -read-only to serve it read-only")
+		case slotsClient == nil:
+			log.Fatalf("The files service would be read-only: no slots-v1 service was found in discovery, use -read-only to serve the root read-only")
 		}
-		return id[0].Address
 	}
 
-	finderAddr := findService("finder-v1")
-	finderClient := finder.NewClient(finderAddr, nil)
-	storageClient := storage.NewAggregateClient(finderClient, dClient, 3, 1000)
-	slotsAddr := findService("slots-v1")
-	slotsClient := slots.NewClient(slotsAddr, nil)
+	if rootIsSlot {
+		if slotsClient == nil {
+			log.Fatalf("Could not find slots-v1 service to resolve slot %s", rootAddr)
+		}
+		if err := ensureRootSlot(slotsClient, storageClient, rootAddr, createRoot); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
 
 	opts := files.Options{
 		Storage: storageClient,
@@ -67,6 +174,19 @@ func main() {
 		},
 		AutoSyncTimeout:  time.Minute,
 		SlotPollInterval: 5 * time.Minute,
+		WriterOptions:    writerOpts,
+		MaxSize:          maxSize,
+		MaxNodes:         maxNodes,
+		JournalDir:       journalDir,
+		CommitSlot:       commitSlot,
+		CommitAuthor:     author,
+		Signer:           signer,
+		RootSignature:    rootSignature,
+		SignatureSlot:    signatureSlot,
+		SigningKey:       signingKey,
+		PolicyKeys:       keys,
+		Replication:      findReplication(dClient),
+		VerifyInterval:   verifyInterval,
 	}
 
 	f, err := files.NewInMemoryFiles(opts)
@@ -75,7 +195,72 @@ func main() {
 	}
 	defer f.Close()
 
-	server := files.NewServer(f)
+	server := files.NewServer(f).WithRequireIfMatch(requireIfMatch).WithMaxStagedSize(maxStagedSize)
+	if verifier != nil {
+		server.WithSharing(verifier, rootAddr)
+	}
+
+	addr := fmt.Sprintf(":%d", port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", addr, err)
+	}
+
+	actualPort := listener.Addr().(*net.TCPAddr).Port
+	if rootIsSlot {
+		log.Printf("Serving slot %s", rootAddr)
+	} else {
+		log.Printf("Serving block %s read-only", rootAddr)
+	}
+	log.Printf("Listening on :%d...", actualPort)
+	log.Fatal(http.Serve(listener, protect(server.Handler(), verifier, cap.FilesRequest(rootAddr))))
+}
+
+// serveMultiRoot serves the root of any slot on demand under /fs/{slot}/.
+func serveMultiRoot(dClient discovery.Discovery, storageCfg storage.AggregateConfig, writerOpts content.WriterOptions, keys map[string][]byte, createRoot bool, maxSize uint64, maxNodes int, journalDir string, verifyInterval time.Duration, maxRoots int, idleTimeout time.Duration, requireIfMatch bool, maxStagedSize int64, port int, verifier *cap.Verifier) {
+	storageClient, slotsClient := connectServices(dClient, storageCfg)
+	if slotsClient == nil {
+		log.Fatalf("Could not find slots-v1 service required by -multi-root")
+	}
+
+	replication := findReplication(dClient)
+	if maxStagedSize == 0 {
+		maxStagedSize = -1
+	}
+	host := files.NewHost(files.HostOptions{
+		Open: func(slotID string) (*files.InMemoryFiles, error) {
+			if err := ensureRootSlot(slotsClient, storageClient, slotID, createRoot); err != nil {
+				return nil, err
+			}
+			var slotJournalDir string
+			if journalDir != "" {
+				slotJournalDir = filepath.Join(journalDir, slotID)
+			}
+			return files.NewInMemoryFiles(files.Options{
+				Storage: storageClient,
+				Slots:   slotsClient,
+				RootLink: content.ContentLink{
+					Address: slotID,
+					Slot:    true,
+				},
+				AutoSyncTimeout:  time.Minute,
+				SlotPollInterval: 5 * time.Minute,
+				WriterOptions:    writerOpts,
+				MaxSize:          maxSize,
+				MaxNodes:         maxNodes,
+				JournalDir:       slotJournalDir,
+				PolicyKeys:       keys,
+				Replication:      replication,
+				VerifyInterval:   verifyInterval,
+			})
+		},
+		MaxRoots:       maxRoots,
+		IdleTimeout:    idleTimeout,
+		RequireIfMatch: requireIfMatch,
+		MaxStagedSize:  maxStagedSize,
+		Sharing:        verifier,
+	})
+	defer host.Close()
 
 	addr := fmt.Sprintf(":%d", port)
 	listener, err := net.Listen("tcp", addr)
@@ -84,6 +269,147 @@ func main() {
 	}
 
 	actualPort := listener.Addr().(*net.TCPAddr).Port
+	log.Printf("Serving slots on demand under /fs/{slot}/")
 	log.Printf("Listening on :%d...", actualPort)
-	log.Fatal(http.Serve(listener, server.Handler()))
+	log.Fatal(http.Serve(listener, protect(host.Handler(), verifier, cap.FilesRequest(""))))
+}
+
+// protect requires the requests to handler to carry a capability token
+// verified by verifier, if it is not nil.
+func protect(handler http.Handler, verifier *cap.Verifier, classify cap.Classifier) http.Handler {
+	if verifier == nil {
+		return handler
+	}
+	return verifier.Require(handler, classify)
+}
+
+// connectServices locates the storage and slots services through discovery.
+// The slots client is nil if no slots service is found.
+func connectServices(dClient discovery.Discovery, storageCfg storage.AggregateConfig) (storage.Storage, slots.Slots) {
+	findService := func(kind string) (string, bool) {
+		addr, err := discovery.FindAddress(context.Background(), dClient, kind)
+		return addr, err == nil
+	}
+
+	// The aggregate client falls back to asking every live storage server
+	// when no finder is available, so a missing finder is not fatal.
+	var blockFinder finder.Finder
+	if finderAddr, ok := findService("finder-v1"); ok {
+		blockFinder = finder.NewClient(finderAddr, nil)
+	} else {
+		log.Printf("No finder-v1 service found, locating blocks through the storage servers directly")
+	}
+	storageClient := storage.NewAggregateClient(blockFinder, dClient, storageCfg)
+
+	var slotsClient slots.Slots
+	if slotsAddr, ok := findService("slots-v1"); ok {
+		slotsClient = slots.NewClient(slotsAddr, nil)
+	}
+	return storageClient, slotsClient
+}
+
+// findReplication returns the distribute service asked to replicate the
+// files of directories whose policy sets replicas, or nil if there is none.
+func findReplication(dClient discovery.Discovery) distribute.ReplicationPolicies {
+	addr, err := discovery.FindAddress(context.Background(), dClient, "distribute-v1")
+	if err != nil {
+		return nil
+	}
+	return distribute.NewClient(addr, nil)
+}
+
+func generateID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// writerOptions maps the content writing flags to content.WriterOptions.
+func writerOptions(compress, encrypt bool, keyPolicyStr, keyFile string) (content.WriterOptions, error) {
+	var opts content.WriterOptions
+	if compress {
+		opts.CompressAlgorithm = "gzip"
+	}
+	if encrypt {
+		opts.EncryptAlgorithm = "aes-256-cbc"
+
+		policy, err := content.ParseKeyPolicy(keyPolicyStr)
+		if err != nil {
+			return opts, err
+		}
+		opts.KeyPolicy = policy
+
+		if policy == content.SuppliedAllKey {
+			key, err := content.LoadSuppliedKey(keyFile)
+			if err != nil {
+				return opts, err
+			}
+			if key == nil {
+				return opts, content.ErrKeyRequired
+			}
+			opts.SuppliedKey = key
+		}
+	}
+	opts.Splitters = []content.Splitter{
+		&content.ZipSplitter{},
+		&content.RepMaxSplitter{},
+	}
+	return opts, nil
+}
+
+// policyKeys loads the keys named by directory policies from a comma
+// separated list of name=file pairs.
+func policyKeys(list string) (map[string][]byte, error) {
+	if list == "" {
+		return nil, nil
+	}
+	keys := make(map[string][]byte)
+	for _, pair := range strings.Split(list, ",") {
+		name, file, ok := strings.Cut(pair, "=")
+		if !ok || name == "" || file == "" {
+			return nil, fmt.Errorf("expected name=file, got %q", pair)
+		}
+		key, err := content.LoadSuppliedKey(file)
+		if err != nil {
+			return nil, err
+		}
+		keys[name] = key
+	}
+	return keys, nil
+}
+
+// ensureRootSlot verifies the root slot exists, creating it pointing at an
+// empty directory when create is set.
+func ensureRootSlot(slotsClient slots.Slots, store storage.Storage, slotID string, create bool) error {
+	ctx := context.Background()
+	_, err := slotsClient.Get(ctx, slotID)
+	if err == nil {
+		return nil
+	}
+	if err != slots.ErrSlotNotFound {
+		return fmt.Errorf("could not read root slot %s: %w", slotID, err)
+	}
+	if !create {
+		return fmt.Errorf("root %w: %s, use -create-root to create it", slots.ErrSlotNotFound, slotID)
+	}
+
+	data, err := filetree.Directory{}.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	link, err := content.Write(bytes.NewReader(data), store, content.WriterOptions{})
+	if err != nil {
+		return fmt.Errorf("could not write empty root directory: %w", err)
+	}
+	if syncer, ok := store.(storage.SyncStorage); ok {
+		if err := syncer.Sync(ctx); err != nil {
+			return fmt.Errorf("could not sync empty root directory: %w", err)
+		}
+	}
+
+	if err := slotsClient.Create(ctx, slotID, link.Address, ""); err != nil && err != slots.ErrSlotExists {
+		return fmt.Errorf("could not create root slot %s: %w", slotID, err)
+	}
+	log.Printf("Created root slot %s", slotID)
+	return nil
 }
@@ -9,8 +9,10 @@ import (
 	"log"
 	"net/http"
 
+	"invariant/internal/cap"
 	"invariant/internal/discovery"
 	"invariant/internal/finder"
+	"invariant/internal/identity"
 )
 
 func generateID() string {
@@ -25,13 +27,31 @@ func main() {
 	var discoveryURL string
 	flag.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
 	var advertiseAddr string
-	flag.StringVar(&advertiseAddr, "advertise", "", "Address to advertise to the discovery service")
+	flag.StringVar(&advertiseAddr, "advertise", "", "Address to advertise to the discovery service, or a comma separated list of [label=]addresses")
 	var port int
 	flag.IntVar(&port, "port", 3004, "Port to listen on (using 3004 to not conflict with storage/discovery)")
 	var name string
 	flag.StringVar(&name, "name", "", "Name to register with the names service")
+	var keyPath string
+	flag.StringVar(&keyPath, "key", "", "Ed25519 private key file, created if missing, identifying the finder. The finder ID becomes the hash of its public key.")
+	var requireSigned bool
+	flag.BoolVar(&requireSigned, "require-signed", false, "Reject block notifications that are not signed by the notifying storage service")
+	var capKeyPath string
+	flag.StringVar(&capKeyPath, "cap-key", "", "File with the root key, created if missing, verifying capability tokens. Requests without a token allowing them are rejected.")
 	flag.Parse()
 
+	var key *identity.KeyPair
+	if keyPath != "" {
+		if id != "" {
+			log.Fatalf("-id and -key cannot both be given")
+		}
+		var err error
+		key, err = identity.LoadOrCreateKeyPair(keyPath)
+		if err != nil {
+			log.Fatalf("Failed to load key pair: %v", err)
+		}
+		id = key.ID()
+	}
 	if id == "" {
 		id = generateID()
 	}
@@ -65,10 +85,22 @@ func main() {
 		}()
 	}
 
-	server := finder.NewFinderServer(f, disc)
+	server := finder.NewFinderServer(f, disc).WithRequireSigned(requireSigned)
+	if key != nil {
+		server.WithKeyPair(key)
+	}
 
 	log.Printf("Finder service (ID %s) listening on %s...", id, addr)
 	log.Printf("Using In-Memory routing and storage mapping")
 
-	log.Fatal(http.ListenAndServe(addr, server))
+	var handler http.Handler = server
+	if capKeyPath != "" {
+		capKey, err := cap.LoadOrCreateKey(capKeyPath)
+		if err != nil {
+			log.Fatalf("Failed to load capability key: %v", err)
+		}
+		handler = cap.NewVerifier(capKey).Require(server, cap.FinderRequest)
+		log.Printf("Requiring capability tokens verified by %s", capKeyPath)
+	}
+	log.Fatal(http.ListenAndServe(addr, handler))
 }
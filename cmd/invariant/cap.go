@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"invariant/internal/cap"
+	"invariant/internal/config"
+)
+
+func runCap(globalCfg *config.InvariantConfig, args []string) {
+	if len(args) < 1 || (args[0] != "issue" && args[0] != "attenuate") {
+		fmt.Fprintf(os.Stderr, "Usage: invariant cap <issue|attenuate> [options]\n")
+		os.Exit(1)
+	}
+	command := args[0]
+
+	fs := flag.NewFlagSet("cap "+command, flag.ExitOnError)
+	var keyPath string
+	if command == "issue" {
+		fs.StringVar(&keyPath, "key", "", "File with the root key of the services verifying the token")
+	}
+	var ops string
+	fs.StringVar(&ops, "op", "", "Comma-separated operations the token allows (read, write, store)")
+	var resources string
+	fs.StringVar(&resources, "resource", "", "Comma-separated slot IDs or block addresses the token allows")
+	var maxBytes int64
+	fs.Int64Var(&maxBytes, "max-bytes", 0, "Maximum size in bytes of each block stored with the token (0 for no limit)")
+	var expires time.Duration
+	fs.DurationVar(&expires, "expires", 0, "Duration after which the token expires (0 for no expiry)")
+
+	fs.Usage = func() {
+		if command == "issue" {
+			fmt.Fprintf(os.Stderr, "Usage: invariant cap issue -key <file> [options]\n")
+			fmt.Fprintf(os.Stderr, "Issues a capability token restricted by the given options and prints it to stdout.\n\n")
+		} else {
+			fmt.Fprintf(os.Stderr, "Usage: invariant cap attenuate [options] <token>\n")
+			fmt.Fprintf(os.Stderr, "Restricts a capability token further by the given options and prints the result to stdout.\n\n")
+		}
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+
+	var caveats []string
+	if ops != "" {
+		caveats = append(caveats, cap.AllowOps(strings.Split(ops, ",")...))
+	}
+	if resources != "" {
+		caveats = append(caveats, cap.ForResources(strings.Split(resources, ",")...))
+	}
+	if maxBytes > 0 {
+		caveats = append(caveats, cap.MaxBytes(maxBytes))
+	}
+	if expires > 0 {
+		caveats = append(caveats, cap.ExpiresAt(time.Now().Add(expires)))
+	}
+
+	var token *cap.Token
+	if command == "issue" {
+		if keyPath == "" {
+			fmt.Fprintf(os.Stderr, "Error: -key is required\n")
+			fs.Usage()
+			os.Exit(1)
+		}
+		key, err := cap.LoadOrCreateKey(keyPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load key: %v\n", err)
+			os.Exit(1)
+		}
+		token = cap.NewVerifier(key).Issue(caveats...)
+	} else {
+		if fs.NArg() < 1 {
+			fmt.Fprintf(os.Stderr, "Error: missing token to attenuate\n")
+			fs.Usage()
+			os.Exit(1)
+		}
+		parent, err := cap.Decode(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to decode token: %v\n", err)
+			os.Exit(1)
+		}
+		token = parent.Attenuate(caveats...)
+	}
+
+	fmt.Println(token.Encode())
+}
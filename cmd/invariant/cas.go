@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"invariant/internal/config"
+	"invariant/internal/content"
+	"invariant/internal/storage"
+)
+
+// casEntry is the content stored for a key of the build cache. Each entry is
+// a file of the index directory named by its key, whose modification time is
+// the last time the entry was used.
+type casEntry struct {
+	Link   content.ContentLink `json:"link"`
+	Size   int64               `json:"size"`
+	Stored time.Time           `json:"stored"`
+}
+
+var errCacheMiss = errors.New("cache miss")
+
+// casKeyPattern restricts keys to names that are safe as file names, such
+// as the hex digests build systems use for actions and outputs.
+var casKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]{0,127}$`)
+
+// casCache maps the keys of a build system to content in the storage
+// network, keeping the index in a local directory so lookups need no service.
+type casCache struct {
+	dir   string
+	store storage.Storage
+	opts  content.WriterOptions
+	now   func() time.Time
+}
+
+func (c *casCache) entryPath(key string) (string, error) {
+	if !casKeyPattern.MatchString(key) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(c.dir, key+".json"), nil
+}
+
+// Put stores the content of r and records it under key, replacing any
+// previous entry.
+func (c *casCache) Put(key string, r io.Reader) (casEntry, error) {
+	path, err := c.entryPath(key)
+	if err != nil {
+		return casEntry{}, err
+	}
+	counter := &countingReader{r: r}
+	link, err := content.Write(counter, c.store, c.opts)
+	if err != nil {
+		return casEntry{}, err
+	}
+	entry := casEntry{Link: link, Size: counter.n, Stored: c.now()}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return casEntry{}, err
+	}
+
+	// Entries are replaced atomically so concurrent builds never read a
+	// partial entry
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return casEntry{}, err
+	}
+	tmp, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		return casEntry{}, err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return casEntry{}, err
+	}
+	return entry, nil
+}
+
+// lookup returns the entry of key, or errCacheMiss if there is none.
+func (c *casCache) lookup(key string) (casEntry, string, error) {
+	path, err := c.entryPath(key)
+	if err != nil {
+		return casEntry{}, "", err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return casEntry{}, path, errCacheMiss
+	}
+	if err != nil {
+		return casEntry{}, path, err
+	}
+	var entry casEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return casEntry{}, path, fmt.Errorf("corrupt entry %s: %w", key, err)
+	}
+	return entry, path, nil
+}
+
+// Get returns a reader of the content recorded under key, or errCacheMiss
+// if there is none. An entry whose content is no longer in storage is
+// removed.
+func (c *casCache) Get(key string) (io.ReadCloser, error) {
+	entry, path, err := c.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := content.Read(entry.Link, c.store, nil)
+	if errors.Is(err, content.ErrBlockNotFound) {
+		os.Remove(path)
+		return nil, errCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := c.now()
+	os.Chtimes(path, now, now)
+	return rc, nil
+}
+
+// Has returns the keys that have an entry, in the order given. With remote
+// the root block of each entry must also be in storage, checked several at
+// a time.
+func (c *casCache) Has(ctx context.Context, keys []string, remote bool) []string {
+	const concurrency = 8
+
+	present := make([]bool, len(keys))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i, key := range keys {
+		entry, _, err := c.lookup(key)
+		if err != nil {
+			continue
+		}
+		if !remote || entry.Link.Inline != nil {
+			present[i] = true
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			present[i] = c.store.Has(ctx, entry.Link.Address)
+			<-sem
+		}()
+	}
+	wg.Wait()
+
+	var result []string
+	for i, key := range keys {
+		if present[i] {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// Prune removes the entries not used for ttl, calling hook, if set, with
+// each before it is removed. An entry is kept if its hook fails. The
+// removed keys are returned. With dryRun the keys that would be removed are
+// returned and nothing is changed.
+func (c *casCache) Prune(ttl time.Duration, dryRun bool, hook func(key string, entry casEntry) error) ([]string, error) {
+	files, err := os.ReadDir(c.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := c.now().Add(-ttl)
+	var pruned []string
+	for _, file := range files {
+		key, ok := strings.CutSuffix(file.Name(), ".json")
+		if !ok || file.IsDir() {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		entry, path, err := c.lookup(key)
+		if err != nil {
+			continue
+		}
+		if dryRun {
+			pruned = append(pruned, key)
+			continue
+		}
+		if hook != nil {
+			if err := hook(key, entry); err != nil {
+				fmt.Fprintf(os.Stderr, "Keeping %s: %v\n", key, err)
+				continue
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, key)
+	}
+	return pruned, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func runCas(globalCfg *config.InvariantConfig, args []string) {
+	if len(args) < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: invariant cas <put|get|has|prune> ...\n")
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  put       Store a file under a key\n")
+		fmt.Fprintf(os.Stderr, "  get       Read the file stored under a key\n")
+		fmt.Fprintf(os.Stderr, "  has       Print the keys that are stored\n")
+		fmt.Fprintf(os.Stderr, "  prune     Remove the keys not used recently\n")
+		os.Exit(1)
+	}
+
+	command := args[0]
+	fs := flag.NewFlagSet("cas "+command, flag.ExitOnError)
+	var discoveryURL string
+	fs.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
+	var indexDir string
+	fs.StringVar(&indexDir, "index", "", "Directory of the local index (default: ~/.cache/invariant/cas)")
+	var key, output, hookCmd string
+	var compress, remote, dryRun bool
+	var inlineMax int
+	var ttl time.Duration
+
+	switch command {
+	case "put":
+		fs.StringVar(&key, "key", "", "Key to store the file under, such as the hash of a build action")
+		fs.BoolVar(&compress, "compress", false, "Compress the stored content")
+		fs.IntVar(&inlineMax, "inline-max", 0, "Largest file, in bytes, held in the index instead of a block (0 to disable)")
+		fs.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: invariant cas put -key <key> [options] [file]\n")
+			fmt.Fprintf(os.Stderr, "Stores a file, or standard input, under a key and prints its address.\n\n")
+			fs.PrintDefaults()
+		}
+	case "get":
+		fs.StringVar(&key, "key", "", "Key the file is stored under")
+		fs.StringVar(&output, "o", "", "File to write the content to (standard output if not set)")
+		fs.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: invariant cas get -key <key> [options]\n")
+			fmt.Fprintf(os.Stderr, "Writes the file stored under a key. Exits with status 2 on a cache miss.\n\n")
+			fs.PrintDefaults()
+		}
+	case "has":
+		fs.BoolVar(&remote, "remote", true, "Also check that the content of each key is in storage")
+		fs.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: invariant cas has [options] [key...]\n")
+			fmt.Fprintf(os.Stderr, "Prints the keys, given as arguments or one per line on standard input, that are stored.\n\n")
+			fs.PrintDefaults()
+		}
+	case "prune":
+		fs.DurationVar(&ttl, "ttl", 7*24*time.Hour, "Remove the keys not used for this long")
+		fs.StringVar(&hookCmd, "exec", "", "Command run with the key and address of each key before it is removed; the key is kept if it fails")
+		fs.BoolVar(&dryRun, "dry-run", false, "Only print the keys that would be removed")
+		fs.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: invariant cas prune [options]\n")
+			fmt.Fprintf(os.Stderr, "Removes the keys not used within -ttl from the local index and prints them.\n\n")
+			fs.PrintDefaults()
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown cas command: %s\n", command)
+		os.Exit(1)
+	}
+	fs.Parse(args[1:])
+
+	if indexDir == "" {
+		cacheDir, err := config.CacheDir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to locate cache directory: %v\n", err)
+			os.Exit(1)
+		}
+		indexDir = filepath.Join(cacheDir, "cas")
+	}
+	cache := &casCache{dir: indexDir, now: time.Now}
+	if command == "put" || command == "get" || (command == "has" && remote) {
+		_, cache.store, _ = treeServices(globalCfg, discoveryURL, false)
+	}
+
+	ctx := context.Background()
+	switch command {
+	case "put":
+		if key == "" {
+			fs.Usage()
+			os.Exit(1)
+		}
+		var r io.Reader = os.Stdin
+		if fs.NArg() > 0 {
+			f, err := os.Open(fs.Arg(0))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to open %s: %v\n", fs.Arg(0), err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			r = f
+		}
+		if compress {
+			cache.opts.CompressAlgorithm = "gzip"
+		}
+		cache.opts.InlineMax = inlineMax
+		entry, err := cache.Put(key, r)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to store %s: %v\n", key, err)
+			os.Exit(1)
+		}
+		fmt.Println(entry.Link.Address)
+
+	case "get":
+		if key == "" {
+			fs.Usage()
+			os.Exit(1)
+		}
+		rc, err := cache.Get(key)
+		if errors.Is(err, errCacheMiss) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", key, err)
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", key, err)
+			os.Exit(1)
+		}
+		defer rc.Close()
+		var w io.Writer = os.Stdout
+		if output != "" {
+			f, err := os.Create(output)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", output, err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			w = f
+		}
+		if _, err := io.Copy(w, rc); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", key, err)
+			os.Exit(1)
+		}
+
+	case "has":
+		keys := fs.Args()
+		if len(keys) == 0 {
+			scanner := bufio.NewScanner(os.Stdin)
+			for scanner.Scan() {
+				if line := strings.TrimSpace(scanner.Text()); line != "" {
+					keys = append(keys, line)
+				}
+			}
+		}
+		for _, key := range cache.Has(ctx, keys, remote) {
+			fmt.Println(key)
+		}
+
+	case "prune":
+		var hook func(key string, entry casEntry) error
+		if hookCmd != "" {
+			hook = func(key string, entry casEntry) error {
+				cmd := exec.Command(hookCmd, key, entry.Link.Address)
+				cmd.Stdout = os.Stderr
+				cmd.Stderr = os.Stderr
+				return cmd.Run()
+			}
+		}
+		pruned, err := cache.Prune(ttl, dryRun, hook)
+		for _, key := range pruned {
+			fmt.Println(key)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to prune: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
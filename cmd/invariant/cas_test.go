@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"invariant/internal/content"
+	"invariant/internal/storage"
+)
+
+func TestCasCache(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewInMemoryStorage()
+	now := time.Now()
+	cache := &casCache{dir: t.TempDir(), store: store, now: func() time.Time { return now }}
+
+	get := func(key string) (string, error) {
+		rc, err := cache.Get(key)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		return string(data), err
+	}
+
+	entry, err := cache.Put("action-1", strings.NewReader("output one"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if entry.Size != int64(len("output one")) {
+		t.Errorf("expected size %d, got %d", len("output one"), entry.Size)
+	}
+	if _, err := cache.Put("action-2", strings.NewReader("output two")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := cache.Put("../escape", strings.NewReader("x")); err == nil {
+		t.Errorf("expected an invalid key to be rejected")
+	}
+
+	if data, err := get("action-1"); err != nil || data != "output one" {
+		t.Errorf("expected %q, got %q, %v", "output one", data, err)
+	}
+	if _, err := get("missing"); !errors.Is(err, errCacheMiss) {
+		t.Errorf("expected errCacheMiss, got %v", err)
+	}
+
+	// Keys whose content left storage are not reported by a remote check
+	lost, _ := cache.Put("action-3", strings.NewReader("output three"))
+	store.Remove(ctx, lost.Link.Address)
+	if got := cache.Has(ctx, []string{"action-1", "missing", "action-3", "action-2"}, false); !slices.Equal(got, []string{"action-1", "action-3", "action-2"}) {
+		t.Errorf("unexpected local keys %v", got)
+	}
+	if got := cache.Has(ctx, []string{"action-1", "missing", "action-3", "action-2"}, true); !slices.Equal(got, []string{"action-1", "action-2"}) {
+		t.Errorf("unexpected remote keys %v", got)
+	}
+	if _, err := get("action-3"); !errors.Is(err, errCacheMiss) {
+		t.Errorf("expected errCacheMiss for lost content, got %v", err)
+	}
+
+	// Reading action-1 keeps it from being pruned
+	old := now.Add(-2 * time.Hour)
+	for _, key := range []string{"action-1", "action-2"} {
+		os.Chtimes(filepath.Join(cache.dir, key+".json"), old, old)
+	}
+	get("action-1")
+
+	pruned, err := cache.Prune(time.Hour, true, nil)
+	if err != nil || !slices.Equal(pruned, []string{"action-2"}) {
+		t.Fatalf("expected a dry run to report action-2, got %v, %v", pruned, err)
+	}
+	var hooked []string
+	failing := func(key string, entry casEntry) error { return errors.New("in use") }
+	if pruned, _ := cache.Prune(time.Hour, false, failing); len(pruned) != 0 {
+		t.Errorf("expected a failing hook to keep entries, got %v", pruned)
+	}
+	pruned, err = cache.Prune(time.Hour, false, func(key string, entry casEntry) error {
+		hooked = append(hooked, key+" "+entry.Link.Address)
+		return nil
+	})
+	if err != nil || !slices.Equal(pruned, []string{"action-2"}) || len(hooked) != 1 {
+		t.Fatalf("expected action-2 to be pruned through the hook, got %v %v, %v", pruned, hooked, err)
+	}
+	if _, err := get("action-2"); !errors.Is(err, errCacheMiss) {
+		t.Errorf("expected errCacheMiss after pruning, got %v", err)
+	}
+
+	// Inline entries need no storage
+	cache.opts = content.WriterOptions{InlineMax: 64}
+	if _, err := cache.Put("small", strings.NewReader("tiny")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if got := cache.Has(ctx, []string{"small"}, true); !slices.Equal(got, []string{"small"}) {
+		t.Errorf("expected inline entry to be present, got %v", got)
+	}
+}
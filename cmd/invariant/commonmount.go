@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"io"
@@ -23,30 +22,42 @@ import (
 
 type CommonMountFlags struct {
 	DiscoveryURL    string
+	FilesURL        string
 	RootAddr        string
 	Slot            string
 	CacheSizeMB     int
 	DiskCacheSizeMB int
 	CacheDir        string
 	OverflowDir     string
+	NoVerifyCache   bool
 	Compress        bool
 	Encrypt         bool
 	KeyPolicyStr    string
 	KeyStr          string
+	KeyFile         string
+	InlineMax       int
+	CommitSlot      string
+	Author          string
 }
 
 func (f *CommonMountFlags) Register(fsFlags *flag.FlagSet) {
 	fsFlags.StringVar(&f.DiscoveryURL, "discovery", "", "URL of the discovery service")
+	fsFlags.StringVar(&f.FilesURL, "files", "", "URL of a files service to serve instead of opening the root in this process")
 	fsFlags.StringVar(&f.RootAddr, "root", "", "Root block or slot address")
 	fsFlags.StringVar(&f.Slot, "slot", "", "Whether the root address refers to a slot")
 	fsFlags.IntVar(&f.CacheSizeMB, "cache", 128, "In-memory caching size in MB for storage backend (0 to disable)")
 	fsFlags.IntVar(&f.DiskCacheSizeMB, "disk-cache", 1024, "Disk caching size in MB for storage backend (0 to disable)")
 	fsFlags.StringVar(&f.CacheDir, "cache-dir", "", "Directory to use for the disk cache (default: ~/.cache/invariant)")
 	fsFlags.StringVar(&f.OverflowDir, "overflow-dir", "", "Directory to use for the overflow cache (default: ~/.cache/invariant/overflow)")
+	fsFlags.BoolVar(&f.NoVerifyCache, "no-verify-cache", false, "Skip checking blocks read from the disk cache against their address")
 	fsFlags.BoolVar(&f.Compress, "compress", false, "Compress the written content")
 	fsFlags.BoolVar(&f.Encrypt, "encrypt", false, "Encrypt the written content")
 	fsFlags.StringVar(&f.KeyPolicyStr, "key-policy", "Deterministic", "Encryption key policy (RandomPerBlock, RandomAllKey, Deterministic, SuppliedAllKey)")
-	fsFlags.StringVar(&f.KeyStr, "key", "", "32-byte hex-encoded key (required if key-policy is SuppliedAllKey)")
+	fsFlags.StringVar(&f.KeyStr, "key", "", "32-byte hex-encoded key (prefer --key-file or "+content.KeyEnvVar+" to keep the key off the command line)")
+	fsFlags.StringVar(&f.KeyFile, "key-file", "", "File containing the 32-byte key used by SuppliedAllKey (defaults to the "+content.KeyEnvVar+" environment variable)")
+	fsFlags.IntVar(&f.InlineMax, "inline-max", 0, "Largest file, in bytes, held in its directory entry instead of a block (0 to disable)")
+	fsFlags.StringVar(&f.CommitSlot, "commit-slot", "", "Slot holding a log of commits, one appended each time the root slot is published")
+	fsFlags.StringVar(&f.Author, "author", "", "Author recorded in the commits appended to --commit-slot")
 }
 
 func SetupCacheStorage(f *CommonMountFlags, baseStorage storage.Storage) (storage.Storage, storage.Storage) {
@@ -71,10 +82,13 @@ func SetupCacheStorage(f *CommonMountFlags, baseStorage storage.Storage) (storag
 		maxSizeBytes := int64(f.DiskCacheSizeMB) * 1024 * 1024
 		desiredSizeBytes := maxSizeBytes * 8 / 10
 		cs := storage.NewCachingStorage(l2Store, finalStorage, maxSizeBytes, desiredSizeBytes, true)
+		cs.SetVerify(!f.NoVerifyCache)
 		directWrapper = cs
 		finalStorage = cs
 
-		localStore = storage.NewCachingStorage(l2Store, nil, maxSizeBytes, desiredSizeBytes, true)
+		local := storage.NewCachingStorage(l2Store, nil, maxSizeBytes, desiredSizeBytes, true)
+		local.SetVerify(!f.NoVerifyCache)
+		localStore = local
 	}
 
 	if f.CacheSizeMB > 0 {
@@ -114,7 +128,26 @@ func SetupCacheStorage(f *CommonMountFlags, baseStorage storage.Storage) (storag
 	return finalStorage, localStore
 }
 
-func SetupFileSystem(globalCfg *config.InvariantConfig, f *CommonMountFlags) *files.InMemoryFiles {
+// FileSystem is the file system served by mount, nfs and local, either a
+// files service running in this process or a client of a remote one.
+type FileSystem interface {
+	files.Files
+	Close()
+}
+
+// remoteFiles is a FileSystem served by a remote files service, which
+// outlives the client.
+type remoteFiles struct {
+	*files.Client
+}
+
+func (remoteFiles) Close() {}
+
+func SetupFileSystem(globalCfg *config.InvariantConfig, f *CommonMountFlags) FileSystem {
+	if f.FilesURL != "" {
+		return remoteFiles{files.NewClient(f.FilesURL, nil)}
+	}
+
 	if f.DiscoveryURL == "" && globalCfg != nil {
 		f.DiscoveryURL = globalCfg.Discovery
 	}
@@ -126,7 +159,7 @@ func SetupFileSystem(globalCfg *config.InvariantConfig, f *CommonMountFlags) *fi
 	dClient = discovery.NewClient(f.DiscoveryURL, nil)
 
 	if f.RootAddr == "" && f.Slot == "" {
-		log.Fatalf("Either --root or --slot is required")
+		log.Fatalf("Either --root, --slot or --files is required")
 	}
 
 	rootIsSlot := false
@@ -146,54 +179,40 @@ func SetupFileSystem(globalCfg *config.InvariantConfig, f *CommonMountFlags) *fi
 	}
 
 	findService := func(kind string) string {
-		id, err := dClient.Find(context.Background(), kind, 1)
+		addr, err := discovery.FindAddress(context.Background(), dClient, kind)
 		if err != nil {
-			log.Fatalf("Could not find %s service: %v", kind, err)
-		}
-		if len(id) == 0 {
-			log.Fatalf("Could not find %s service", kind)
+			log.Fatalf("%v", err)
 		}
-		return id[0].Address
+		return addr
 	}
 
 	finderAddr := findService("finder-v1")
 	finderClient := finder.NewClient(finderAddr, nil)
-	storageClient := storage.NewAggregateClient(finderClient, dClient, 3, 1000)
+	storageClient := storage.NewAggregateClient(finderClient, dClient, storage.DefaultAggregateConfig())
 	slotsAddr := findService("slots-v1")
 	slotsClient := slots.NewClient(slotsAddr, nil)
 
 	finalStorage, localStore := SetupCacheStorage(f, storageClient)
 
-	var writerOpts content.WriterOptions
+	writerOpts := content.WriterOptions{InlineMax: f.InlineMax}
 	if f.Compress {
 		writerOpts.CompressAlgorithm = "gzip"
 	}
 	if f.Encrypt {
 		writerOpts.EncryptAlgorithm = "aes-256-cbc"
 
-		switch f.KeyPolicyStr {
-		case "RandomPerBlock":
-			writerOpts.KeyPolicy = content.RandomPerBlock
-		case "RandomAllKey":
-			writerOpts.KeyPolicy = content.RandomAllKey
-		case "Deterministic":
-			writerOpts.KeyPolicy = content.Deterministic
-		case "SuppliedAllKey":
-			writerOpts.KeyPolicy = content.SuppliedAllKey
-			if f.KeyStr == "" {
-				log.Fatalf("Error: --key is required when --key-policy is SuppliedAllKey")
-			}
+		policy, err := content.ParseKeyPolicy(f.KeyPolicyStr)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		writerOpts.KeyPolicy = policy
 
-			importHex, err := hex.DecodeString(f.KeyStr)
+		if policy == content.SuppliedAllKey {
+			key, err := loadKey(f.KeyStr, f.KeyFile)
 			if err != nil {
-				log.Fatalf("Error parsing --key: %v", err)
-			}
-			if len(importHex) != 32 {
-				log.Fatalf("Error: --key must be a 32-byte hex-encoded string (got %d bytes)", len(importHex))
+				log.Fatalf("Error loading key: %v", err)
 			}
-			writerOpts.SuppliedKey = importHex
-		default:
-			log.Fatalf("Error: unsupported key-policy '%s'", f.KeyPolicyStr)
+			writerOpts.SuppliedKey = key
 		}
 	}
 	writerOpts.Splitters = []content.Splitter{
@@ -210,6 +229,8 @@ func SetupFileSystem(globalCfg *config.InvariantConfig, f *CommonMountFlags) *fi
 		AutoSyncTimeout:  time.Minute,
 		SlotPollInterval: 5 * time.Minute,
 		WriterOptions:    writerOpts,
+		CommitSlot:       f.CommitSlot,
+		CommitAuthor:     f.Author,
 	}
 
 	rc, err := content.Read(opts.RootLink, finalStorage, slotsClient)
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"invariant/internal/config"
+	"invariant/internal/filetree"
+)
+
+func runExport(globalCfg *config.InvariantConfig, args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var discoveryURL string
+	fs.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
+	var output string
+	fs.StringVar(&output, "o", "", "File to write the archive to (standard output if not set)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: invariant export [options] <slot|root-link>\n")
+		fmt.Fprintf(os.Stderr, "Writes every block of a file tree to a tar archive, read back with 'invariant import archive'.\n")
+		fmt.Fprintf(os.Stderr, "The root is a slot ID or name, or a JSON content link.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	dClient, store, slotsClient := treeServices(globalCfg, discoveryURL, true)
+	root := resolveRootLink(ctx, dClient, fs.Arg(0))
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create archive: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	count, err := filetree.WriteArchive(ctx, w, root, store, slotsClient)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Export failed after %d blocks: %v\n", count, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d blocks\n", count)
+}
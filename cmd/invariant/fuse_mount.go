@@ -0,0 +1,38 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os/user"
+	"strconv"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"invariant/internal/files"
+	"invariant/internal/fuse"
+)
+
+// mountFUSE mounts the tree of filesrv at mountpoint as the current user and
+// returns a function waiting for it to be unmounted.
+func mountFUSE(mountpoint string, filesrv files.Files) (func(), error) {
+	rootNode := fuse.NewNode(filesrv, 1) // 1 is the root node ID in InMemoryFiles
+
+	var uid, gid uint32
+	if currentUser, err := user.Current(); err == nil {
+		if parsedUID, err := strconv.ParseUint(currentUser.Uid, 10, 32); err == nil {
+			uid = uint32(parsedUID)
+		}
+		if parsedGID, err := strconv.ParseUint(currentUser.Gid, 10, 32); err == nil {
+			gid = uint32(parsedGID)
+		}
+	}
+
+	server, err := fs.Mount(mountpoint, rootNode, &fs.Options{
+		UID: uid,
+		GID: gid,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return server.Wait, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+
+	"invariant/internal/files"
+)
+
+// mountFUSE fails as FUSE is not available on this platform.
+func mountFUSE(mountpoint string, filesrv files.Files) (func(), error) {
+	return nil, errors.New("FUSE is not supported on this platform, use 'invariant local' or 'invariant nfs' instead")
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"invariant/internal/config"
+	"invariant/internal/content"
+	"invariant/internal/discovery"
+	"invariant/internal/refcount"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+func runGC(globalCfg *config.InvariantConfig, args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	var discoveryURL string
+	fs.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
+	var storageID string
+	fs.StringVar(&storageID, "storage", "", "ID or name of the storage service to collect, or a comma separated list of them (required)")
+	var dryRun bool
+	fs.BoolVar(&dryRun, "dry-run", false, "Count the unreachable blocks without removing them")
+	var refcountID string
+	fs.StringVar(&refcountID, "refcount", "", "ID or name of a refcount service whose collectable blocks are removed, instead of every block not reachable from the roots")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: invariant gc [options] <root>...\n")
+		fmt.Fprintf(os.Stderr, "Removes every block of a storage service that is not reachable from the roots.\n")
+		fmt.Fprintf(os.Stderr, "With -refcount, only the blocks the refcount service reports as collectable are removed,\n")
+		fmt.Fprintf(os.Stderr, "from every storage service given, and the roots are optional.\n")
+		fmt.Fprintf(os.Stderr, "Each root is a JSON content link or the ID or name of a slot, whose current root is kept.\n")
+		fmt.Fprintf(os.Stderr, "The previous roots the slots service retains for their readers are kept too, as are the\n")
+		fmt.Fprintf(os.Stderr, "blocks stored within the grace period of the storage service.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if (fs.NArg() == 0 && refcountID == "") || storageID == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if discoveryURL == "" && globalCfg != nil {
+		discoveryURL = globalCfg.Discovery
+	}
+	if discoveryURL == "" {
+		fmt.Fprintf(os.Stderr, "Discovery URL is required\n")
+		os.Exit(1)
+	}
+	ctx := context.Background()
+	dClient := discovery.NewClient(discoveryURL, nil)
+
+	var storageClients []*storage.Client
+	for name := range strings.SplitSeq(storageID, ",") {
+		id, err := discovery.ResolveName(ctx, dClient, strings.TrimSpace(name))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not resolve storage service: %v\n", err)
+			os.Exit(1)
+		}
+		desc, ok := dClient.Get(ctx, id)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Storage service %s not found\n", id)
+			os.Exit(1)
+		}
+		storageClients = append(storageClients, storage.NewClient(desc.Address, nil))
+	}
+
+	var slotsClient *slots.Client
+	if addr, err := discovery.FindAddress(ctx, dClient, "slots-v1"); err == nil {
+		slotsClient = slots.NewClient(addr, nil)
+	}
+	var roots, retainedRoots []json.RawMessage
+	seen := make(map[string]bool)
+	add := func(list *[]json.RawMessage, root content.ContentLink) {
+		data, err := json.Marshal(root)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to marshal root: %v\n", err)
+			os.Exit(1)
+		}
+		if !seen[string(data)] {
+			seen[string(data)] = true
+			*list = append(*list, data)
+		}
+	}
+	addRoot := func(root content.ContentLink) { add(&roots, root) }
+	addRetained := func(root content.ContentLink) { add(&retainedRoots, root) }
+	for _, target := range fs.Args() {
+		root := resolveRootLink(ctx, dClient, target)
+		if root.Slot {
+			if slotsClient == nil {
+				fmt.Fprintf(os.Stderr, "No slots service found to read slot %s\n", root.Address)
+				os.Exit(1)
+			}
+			address, err := slotsClient.Get(ctx, root.Address)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to read slot %s: %v\n", root.Address, err)
+				os.Exit(1)
+			}
+			root.Address, root.Slot = address, false
+		}
+		addRoot(root)
+	}
+
+	// Readers that resolved a slot before its last update may still be
+	// reading the blocks of its previous root
+	if slotsClient != nil {
+		retained, err := slotsClient.Retained(ctx, "")
+		if err != nil && !errors.Is(err, slots.ErrNotRetained) {
+			fmt.Fprintf(os.Stderr, "Failed to read the retained roots of slots: %v\n", err)
+			os.Exit(1)
+		}
+		for _, r := range retained {
+			addRetained(content.ContentLink{Address: r.Address})
+		}
+	}
+
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	if refcountID != "" {
+		collectUnreferenced(ctx, dClient, refcountID, storageClients, roots, retainedRoots, dryRun, verb)
+		return
+	}
+	for _, client := range storageClients {
+		resp, err := client.Collect(ctx, roots, retainedRoots, dryRun)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Collection failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s %d of %d blocks (%d bytes); %d reachable, %d recent\n", verb, resp.Removed, resp.Blocks, resp.Bytes, resp.Reachable, resp.Recent)
+	}
+}
+
+// collectUnreferenced removes the blocks the refcount service refcountID
+// reports as collectable from each storage service, sparing those reachable
+// from the roots and the recent ones. Once every storage service removed or
+// does not hold a block, the refcount service forgets it.
+func collectUnreferenced(ctx context.Context, dClient discovery.Discovery, refcountID string, storageClients []*storage.Client, roots, retainedRoots []json.RawMessage, dryRun bool, verb string) {
+	id, err := discovery.ResolveName(ctx, dClient, refcountID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not resolve refcount service: %v\n", err)
+		os.Exit(1)
+	}
+	desc, ok := dClient.Get(ctx, id)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Refcount service %s not found\n", id)
+		os.Exit(1)
+	}
+	refs := refcount.NewClient(desc.Address, nil)
+
+	var total storage.StorageCollectResponse
+	forgotten := 0
+	for chunk := range refs.Collectable(ctx, 1000) {
+		kept := make(map[string]bool)
+		for _, client := range storageClients {
+			resp, err := client.CollectRequest(ctx, storage.StorageCollectRequest{Roots: roots, Retained: retainedRoots, Unreferenced: chunk, DryRun: dryRun})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Collection failed: %v\n", err)
+				os.Exit(1)
+			}
+			for _, address := range resp.Kept {
+				kept[address] = true
+			}
+			total.Blocks += resp.Blocks
+			total.Reachable += resp.Reachable
+			total.Recent += resp.Recent
+			total.Removed += resp.Removed
+			total.Bytes += resp.Bytes
+		}
+		if dryRun {
+			continue
+		}
+		for _, address := range chunk {
+			if kept[address] {
+				continue
+			}
+			// A block referenced again since it was listed is not forgotten
+			if err := refs.Forget(ctx, address); err == nil {
+				forgotten++
+			}
+		}
+	}
+	fmt.Printf("%s %d of %d unreferenced blocks (%d bytes); %d reachable, %d recent; %d forgotten\n", verb, total.Removed, total.Blocks, total.Bytes, total.Reachable, total.Recent, forgotten)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+
+	"invariant/internal/config"
+	"invariant/internal/content"
+	"invariant/internal/files"
+	"invariant/internal/filetree"
+)
+
+func runGraft(globalCfg *config.InvariantConfig, args []string) {
+	fs := flag.NewFlagSet("graft", flag.ExitOnError)
+	var filesURL string
+	fs.StringVar(&filesURL, "files", "", "URL of the files service to graft into (required)")
+	var discoveryURL string
+	fs.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service, used with -from")
+	var from string
+	fs.StringVar(&from, "from", "", "JSON content link of a root; <source> is then a path of an entry in its tree")
+	var kind string
+	fs.StringVar(&kind, "kind", string(filetree.FileKind), "Kind of the entry when <source> is a content link: File or Directory")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: invariant graft [options] <path> <source>\n")
+		fmt.Fprintf(os.Stderr, "Creates the entry <path> of a files service referring to content already in storage, without uploading it again.\n")
+		fmt.Fprintf(os.Stderr, "<source> is a JSON content link, or with -from the path of an entry in another tree.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 || filesURL == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	dest, source := path.Clean("/"+fs.Arg(0)), fs.Arg(1)
+	if dest == "/" {
+		fmt.Fprintf(os.Stderr, "Error: cannot graft onto the root\n")
+		os.Exit(1)
+	}
+	ctx := context.Background()
+
+	entryKind := filetree.EntryKind(kind)
+	var link content.ContentLink
+	var target string
+	if from != "" {
+		var root content.ContentLink
+		if err := json.Unmarshal([]byte(from), &root); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to parse -from link: %v\n", err)
+			os.Exit(1)
+		}
+		_, store, slotsClient := treeServices(globalCfg, discoveryURL, root.Slot)
+		entry, err := filetree.Lookup(ctx, root, source, store, slotsClient)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to look up %s: %v\n", source, err)
+			os.Exit(1)
+		}
+		switch e := entry.(type) {
+		case *filetree.FileEntry:
+			link = e.Content
+		case *filetree.DirectoryEntry:
+			link = e.Content
+		case *filetree.SymbolicLinkEntry:
+			target = e.Target
+		default:
+			fmt.Fprintf(os.Stderr, "Error: %s not found\n", source)
+			os.Exit(1)
+		}
+		entryKind = entry.GetKind()
+	} else {
+		if entryKind != filetree.FileKind && entryKind != filetree.DirectoryKind {
+			fmt.Fprintf(os.Stderr, "Error: -kind must be File or Directory\n")
+			os.Exit(1)
+		}
+		if err := json.Unmarshal([]byte(source), &link); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to parse content link: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	client := files.NewClient(filesURL, nil)
+	dir, name := path.Split(dest)
+	parent, err := client.Resolve(ctx, 1, dir, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to resolve %s: %v\n", dir, err)
+		os.Exit(1)
+	}
+	var contentLink *content.ContentLink
+	if entryKind != filetree.SymbolicLinkKind {
+		contentLink = &link
+	}
+	if err := client.CreateEntry(ctx, parent.Node, name, entryKind, target, contentLink, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to graft %s: %v\n", dest, err)
+		os.Exit(1)
+	}
+}
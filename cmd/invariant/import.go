@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"invariant/internal/blockimport"
+	"invariant/internal/config"
+	"invariant/internal/discovery"
+	"invariant/internal/refcount"
+	"invariant/internal/storage"
+)
+
+func runImport(globalCfg *config.InvariantConfig, args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var discoveryURL string
+	fs.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
+	var storageID string
+	fs.StringVar(&storageID, "storage", "", "ID or name of the storage service to import into (any storage service if not set)")
+	var manifestPath string
+	fs.StringVar(&manifestPath, "manifest", "", "File to write the address of each imported block to, one per line")
+	var pin bool
+	fs.BoolVar(&pin, "pin", false, "Pin each imported block with the refcount service")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: invariant import [options] <dir|git|ipfs|archive> <path>\n")
+		fmt.Fprintf(os.Stderr, "Imports the blocks of another content-addressed store into a storage service under their sha256 addresses.\n")
+		fmt.Fprintf(os.Stderr, "  dir   every file below <path> is a block\n")
+		fmt.Fprintf(os.Stderr, "  git   every object of the git repository at <path>, verified against its ID\n")
+		fmt.Fprintf(os.Stderr, "  ipfs  every block of the IPFS flatfs blockstore at <path>, verified against its multihash\n")
+		fmt.Fprintf(os.Stderr, "  archive  every block of the archive at <path> written by 'invariant export', printing its root\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	var src blockimport.Source
+	var archive *blockimport.ArchiveSource
+	switch kind, path := fs.Arg(0), fs.Arg(1); kind {
+	case "dir":
+		src = blockimport.NewDirectorySource(path)
+	case "git":
+		src = blockimport.NewGitSource(path)
+	case "ipfs":
+		src = blockimport.NewIPFSSource(path)
+	case "archive":
+		archive = blockimport.NewArchiveSource(path)
+		src = archive
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown source kind %q\n", kind)
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if discoveryURL == "" && globalCfg != nil {
+		discoveryURL = globalCfg.Discovery
+	}
+	if discoveryURL == "" {
+		fmt.Fprintf(os.Stderr, "Discovery URL is required\n")
+		os.Exit(1)
+	}
+	ctx := context.Background()
+	dClient := discovery.NewClient(discoveryURL, nil)
+
+	var storageAddr string
+	if storageID != "" {
+		id, err := discovery.ResolveName(ctx, dClient, storageID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not resolve storage service: %v\n", err)
+			os.Exit(1)
+		}
+		desc, ok := dClient.Get(ctx, id)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Storage service %s not found\n", id)
+			os.Exit(1)
+		}
+		storageAddr = desc.Address
+	} else {
+		addr, err := discovery.FindAddress(ctx, dClient, "storage-v1")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		storageAddr = addr
+	}
+	store := storage.NewClient(storageAddr, nil)
+
+	var manifest *bufio.Writer
+	if manifestPath != "" {
+		f, err := os.Create(manifestPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create manifest: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		manifest = bufio.NewWriter(f)
+	}
+	var refs *refcount.Client
+	if pin {
+		addr, err := discovery.FindAddress(ctx, dClient, "refcount-v1")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		refs = refcount.NewClient(addr, nil)
+	}
+	record := func(address string) error {
+		if refs != nil {
+			if _, err := refs.Pin(ctx, address); err != nil {
+				return fmt.Errorf("failed to pin %s: %w", address, err)
+			}
+		}
+		if manifest != nil {
+			_, err := fmt.Fprintln(manifest, address)
+			return err
+		}
+		return nil
+	}
+
+	stats, err := blockimport.Import(ctx, src, store, record)
+	if manifest != nil {
+		if ferr := manifest.Flush(); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	fmt.Printf("Imported %d blocks (%d bytes), %d already present, %d unverified, %d skipped as corrupt\n",
+		stats.Imported, stats.Bytes, stats.Existing, stats.Unverified, stats.Mismatched)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Import failed: %v\n", err)
+		os.Exit(1)
+	}
+	if archive != nil {
+		data, _ := json.Marshal(archive.Root())
+		fmt.Printf("Root: %s\n", data)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "invariant/internal/content"
+
+// loadKey returns the encryption key supplied by --key, --key-file or the
+// environment, in that order of precedence.
+func loadKey(keyStr, keyFile string) ([]byte, error) {
+	if keyStr != "" {
+		return content.ParseKey(keyStr)
+	}
+	key, err := content.LoadSuppliedKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, content.ErrKeyRequired
+	}
+	return key, nil
+}
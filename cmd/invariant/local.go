@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"invariant/internal/config"
+	"invariant/internal/localdir"
+)
+
+func runLocal(globalCfg *config.InvariantConfig, args []string) {
+	fsFlags := flag.NewFlagSet("local", flag.ExitOnError)
+	var dir string
+	fsFlags.StringVar(&dir, "dir", "", "Local directory the file tree is written to and watched for changes")
+	var settle time.Duration
+	fsFlags.DurationVar(&settle, "settle", 500*time.Millisecond, "How long a path must go unchanged before its change is applied")
+	var poll time.Duration
+	fsFlags.DurationVar(&poll, "poll", 0, "Poll the directory for changes at this interval instead of watching it, such as for a network file system (0 watches it)")
+
+	var commonFlags CommonMountFlags
+	commonFlags.Register(fsFlags)
+
+	fsFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: invariant local [options]\n")
+		fmt.Fprintf(os.Stderr, "Writes a file tree to a local directory, then applies the changes made to the directory to the tree, for platforms without FUSE.\n\n")
+		fsFlags.PrintDefaults()
+	}
+	fsFlags.Parse(args)
+
+	if dir == "" {
+		log.Fatalf("Local directory is required (--dir)")
+	}
+
+	filesrv := SetupFileSystem(globalCfg, &commonFlags)
+	defer filesrv.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	m := localdir.New(filesrv, 1, dir) // 1 is the root node ID in InMemoryFiles
+	err := m.Populate(ctx)
+	if err != nil {
+		log.Fatalf("Failed to populate %s: %v", dir, err)
+	}
+	log.Printf("Populated %s, watching for changes", dir)
+
+	if poll > 0 {
+		err = m.Poll(ctx, poll, settle)
+	} else {
+		err = m.Watch(ctx, settle)
+	}
+	if err != nil {
+		log.Printf("Watching %s failed: %v", dir, err)
+	}
+
+	log.Println("Syncing changes...")
+	if err := filesrv.Sync(context.Background(), 1, true); err != nil {
+		log.Fatalf("Failed to sync: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"invariant/internal/config"
+	"invariant/internal/content"
+	"invariant/internal/discovery"
+	"invariant/internal/filetree"
+	"invariant/internal/finder"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+func runLog(globalCfg *config.InvariantConfig, args []string) {
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	var discoveryURL string
+	fs.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
+	var limit int
+	fs.IntVar(&limit, "n", 0, "Maximum number of commits to print (0 for all)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: invariant log [options] <commit-slot>\n")
+		fmt.Fprintf(os.Stderr, "Prints the commits in the log held by <commit-slot>, given by ID or name, newest first.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	dClient, store, slotsClient := treeServices(globalCfg, discoveryURL, true)
+	logSlot, err := discovery.ResolveName(ctx, dClient, fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not resolve slot: %v\n", err)
+		os.Exit(1)
+	}
+	address, err := slotsClient.Get(ctx, logSlot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read commit slot %s: %v\n", logSlot, err)
+		os.Exit(1)
+	}
+
+	for count := 0; address != "" && (limit <= 0 || count < limit); count++ {
+		commit, err := filetree.ReadCommit(address, store)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if count > 0 {
+			fmt.Println()
+		}
+		printCommit(address, commit)
+		address = commit.Parent
+	}
+}
+
+func runShow(globalCfg *config.InvariantConfig, args []string) {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	var discoveryURL string
+	fs.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: invariant show [options] <commit-address>\n")
+		fmt.Fprintf(os.Stderr, "Prints a commit and the entries it added, removed or modified.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	address := fs.Arg(0)
+	_, store, _ := treeServices(globalCfg, discoveryURL, false)
+	commit, err := filetree.ReadCommit(address, store)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	printCommit(address, commit)
+
+	parent := content.ContentLink{Address: commit.ParentRoot}
+	changes, err := filetree.Diff(context.Background(), parent, content.ContentLink{Address: commit.Root}, store, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to compare the roots: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println()
+	for _, c := range changes {
+		fmt.Printf("%-8s %s\n", c.Kind, c.Path)
+	}
+}
+
+// printCommit prints commit in the style of git log.
+func printCommit(address string, commit filetree.Commit) {
+	fmt.Printf("commit %s\n", address)
+	if commit.Author != "" {
+		fmt.Printf("Author: %s\n", commit.Author)
+	}
+	fmt.Printf("Date:   %s\n", time.Unix(commit.Timestamp, 0).Format(time.RFC1123Z))
+	fmt.Printf("Root:   %s\n", commit.Root)
+	if commit.Message != "" {
+		fmt.Printf("\n    %s\n", commit.Message)
+	}
+}
+
+// treeServices connects to the storage and, if needSlots, slots services.
+func treeServices(globalCfg *config.InvariantConfig, discoveryURL string, needSlots bool) (discovery.Discovery, storage.Storage, slots.Slots) {
+	if discoveryURL == "" && globalCfg != nil {
+		discoveryURL = globalCfg.Discovery
+	}
+	if discoveryURL == "" {
+		fmt.Fprintf(os.Stderr, "Discovery URL is required\n")
+		os.Exit(1)
+	}
+	dClient := discovery.NewClient(discoveryURL, nil)
+	findService := func(kind string) string {
+		addr, err := discovery.FindAddress(context.Background(), dClient, kind)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return addr
+	}
+
+	finderClient := finder.NewClient(findService("finder-v1"), nil)
+	store := storage.NewAggregateClient(finderClient, dClient, storage.DefaultAggregateConfig())
+	var slotsClient slots.Slots
+	if needSlots {
+		slotsClient = slots.NewClient(findService("slots-v1"), nil)
+	}
+	return dClient, store, slotsClient
+}
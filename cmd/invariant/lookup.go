@@ -4,20 +4,27 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"maps"
 	"os"
+	"slices"
 
 	"invariant/internal/config"
 	"invariant/internal/discovery"
+	"invariant/internal/names"
 )
 
 func runLookup(globalCfg *config.InvariantConfig, args []string) {
 	fs := flag.NewFlagSet("lookup", flag.ExitOnError)
 	var discoveryURL string
 	fs.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
+	var reverse bool
+	fs.BoolVar(&reverse, "reverse", false, "Print the names whose value is the given ID or address instead")
 
 	fs.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: invariant lookup [options] <name>\n")
-		fmt.Fprintf(os.Stderr, "Looks up a name in the names service and prints the resolved address or ID to stdout.\n\n")
+		fmt.Fprintf(os.Stderr, "       invariant lookup -reverse [options] <value>\n")
+		fmt.Fprintf(os.Stderr, "Looks up a name in the names service and prints the resolved address or ID to stdout.\n")
+		fmt.Fprintf(os.Stderr, "With -reverse, prints the names of every names service holding the ID or address, one per line.\n\n")
 		fs.PrintDefaults()
 	}
 	fs.Parse(args)
@@ -41,6 +48,11 @@ func runLookup(globalCfg *config.InvariantConfig, args []string) {
 
 	dClient := discovery.NewClient(discoveryURL, nil)
 
+	if reverse {
+		printNamesOf(dClient, name)
+		return
+	}
+
 	resolved, err := discovery.ResolveName(context.Background(), dClient, name)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to resolve name %q: %v\n", name, err)
@@ -49,3 +61,28 @@ func runLookup(globalCfg *config.InvariantConfig, args []string) {
 
 	fmt.Println(resolved)
 }
+
+// printNamesOf prints the names that every names service found with dClient
+// holds for value, once each and in order.
+func printNamesOf(dClient discovery.Discovery, value string) {
+	ctx := context.Background()
+	servers, err := dClient.Find(ctx, "names-v1", 100)
+	if err != nil || len(servers) == 0 {
+		fmt.Fprintf(os.Stderr, "Could not find a names-v1 service\n")
+		os.Exit(1)
+	}
+	found := make(map[string]bool)
+	for _, server := range servers {
+		list, err := names.NewClient(discovery.NormalizeAddress(server.Address), nil).Lookup(ctx, value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to look up %s in names service %s: %v\n", value, server.ID, err)
+			continue
+		}
+		for _, name := range list {
+			found[name] = true
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(found)) {
+		fmt.Println(name)
+	}
+}
@@ -15,12 +15,27 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "  name      Register a name to a 32-byte hex value\n")
 	fmt.Fprintf(os.Stderr, "  lookup    Lookup a name and print the resolved address\n")
 	fmt.Fprintf(os.Stderr, "  mount     Mount the invariant file system using FUSE\n")
+	fmt.Fprintf(os.Stderr, "  local     Mirror the invariant file system to a local directory and apply its changes\n")
 	fmt.Fprintf(os.Stderr, "  nfs       Start the invariant file system as an NFS Server\n")
 	fmt.Fprintf(os.Stderr, "  upload    Upload a local directory as a file tree\n")
+	fmt.Fprintf(os.Stderr, "  sync      Synchronize a local directory with a file tree\n")
+	fmt.Fprintf(os.Stderr, "  log       Print the commit log of a file tree\n")
+	fmt.Fprintf(os.Stderr, "  show      Print a commit and its changes\n")
+	fmt.Fprintf(os.Stderr, "  sign      Sign the root of a file tree\n")
+	fmt.Fprintf(os.Stderr, "  verify    Verify the signature of the root of a file tree\n")
 	fmt.Fprintf(os.Stderr, "  print     Print a block's contents to standard output\n")
+	fmt.Fprintf(os.Stderr, "  import    Import blocks from a directory, git repository, IPFS blockstore or archive\n")
+	fmt.Fprintf(os.Stderr, "  export    Export every block of a file tree to an archive\n")
+	fmt.Fprintf(os.Stderr, "  oci       Ingest the layers of a container image as a file tree\n")
+	fmt.Fprintf(os.Stderr, "  graft     Graft content already in storage into a files service\n")
+	fmt.Fprintf(os.Stderr, "  dedup     Report the blocks and bytes shared between file trees\n")
+	fmt.Fprintf(os.Stderr, "  gc        Remove the blocks of a storage service not reachable from a set of roots\n")
+	fmt.Fprintf(os.Stderr, "  rekey     Re-encrypt a file tree with a new key and republish its slot\n")
 	fmt.Fprintf(os.Stderr, "  systemd   Manage invariant services using systemd\n")
 	fmt.Fprintf(os.Stderr, "  status    Query the discovery service and verify node health directly\n")
 	fmt.Fprintf(os.Stderr, "  workspace Manage layered workspaces\n")
+	fmt.Fprintf(os.Stderr, "  cap       Issue or attenuate capability tokens\n")
+	fmt.Fprintf(os.Stderr, "  cas       Use the storage network as a build cache of keyed files\n")
 	os.Exit(1)
 }
 
@@ -46,18 +61,48 @@ func main() {
 		runLookup(cfg, os.Args[2:])
 	case "mount":
 		runMount(cfg, os.Args[2:])
+	case "local":
+		runLocal(cfg, os.Args[2:])
 	case "nfs":
 		runNfs(cfg, os.Args[2:])
 	case "upload":
 		runUpload(cfg, os.Args[2:])
+	case "sync":
+		runSync(cfg, os.Args[2:])
+	case "log":
+		runLog(cfg, os.Args[2:])
+	case "show":
+		runShow(cfg, os.Args[2:])
+	case "sign":
+		runSign(cfg, os.Args[2:])
+	case "verify":
+		runVerify(cfg, os.Args[2:])
 	case "print":
 		runPrint(cfg, os.Args[2:])
+	case "import":
+		runImport(cfg, os.Args[2:])
+	case "export":
+		runExport(cfg, os.Args[2:])
+	case "oci":
+		runOCI(cfg, os.Args[2:])
+	case "graft":
+		runGraft(cfg, os.Args[2:])
+	case "dedup":
+		runDedup(cfg, os.Args[2:])
+	case "gc":
+		runGC(cfg, os.Args[2:])
+	case "rekey":
+		runRekey(cfg, os.Args[2:])
 	case "systemd":
 		runSystemd(cfg, os.Args[2:])
 	case "status":
 		runStatus(cfg, os.Args[2:])
 	case "workspace":
 		runWorkspace(cfg, os.Args[2:])
+	case "cap":
+		runCap(cfg, os.Args[2:])
+	case "cas":
+		runCas(cfg, os.Args[2:])
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command %q\n", os.Args[1])
 		usage()
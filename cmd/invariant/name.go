@@ -51,17 +51,13 @@ func runName(globalCfg *config.InvariantConfig, args []string) {
 	dClient := discovery.NewClient(globalCfg.Discovery, nil)
 
 	// find names service
-	id, err := dClient.Find(context.Background(), "names-v1", 1)
+	namesAddr, err := discovery.FindAddress(context.Background(), dClient, "names-v1")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not query discovery service for names-v1: %v\n", err)
-		os.Exit(1)
-	}
-	if len(id) == 0 {
-		fmt.Fprintf(os.Stderr, "Could not find any names-v1 service\n")
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
 
-	namesClient := names.NewClient(id[0].Address, nil)
+	namesClient := names.NewClient(namesAddr, nil)
 
 	var tokens []string
 	if tokensStr != "" {
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"invariant/internal/config"
+	"invariant/internal/content"
+	"invariant/internal/oci"
+)
+
+func runOCI(globalCfg *config.InvariantConfig, args []string) {
+	fs := flag.NewFlagSet("oci", flag.ExitOnError)
+	var discoveryURL string
+	fs.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
+	var ref string
+	fs.StringVar(&ref, "ref", "", "Name of the image to ingest, such as latest or docker.io/library/alpine:latest (required if the layout has several)")
+	var platform string
+	fs.StringVar(&platform, "platform", "", "Platform of a multi-platform image to ingest, such as linux/arm64 (default: linux and the architecture of this machine)")
+	var compress bool
+	fs.BoolVar(&compress, "compress", false, "Compress the written content")
+	var inlineMax int
+	fs.IntVar(&inlineMax, "inline-max", 0, "Largest file, in bytes, held in its directory entry instead of a block (0 to disable)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: invariant oci [options] <layout>\n")
+		fmt.Fprintf(os.Stderr, "Ingests the layers of a container image into storage and prints the root of its merged root file system.\n")
+		fmt.Fprintf(os.Stderr, "The layout is an OCI image layout directory or a tar file of one, such as written by 'docker save'.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	im, err := oci.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open image: %v\n", err)
+		os.Exit(1)
+	}
+	defer im.Close()
+	m, err := im.Manifest(ref, platform)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read manifest: %v\n", err)
+		os.Exit(1)
+	}
+
+	_, store, _ := treeServices(globalCfg, discoveryURL, false)
+	opts := content.WriterOptions{InlineMax: inlineMax}
+	if compress {
+		opts.CompressAlgorithm = "gzip"
+	}
+	root, stats, err := im.Ingest(context.Background(), m, store, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ingest failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Ingested %d layers: %d files (%d bytes), %d whiteouts, %d skipped; stored %d blocks, %d already present\n",
+		stats.Layers, stats.Files, stats.Bytes, stats.Whiteouts, stats.Skipped, stats.Blocks, stats.Existing)
+
+	out, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to marshal output: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s\n", out)
+}
@@ -28,6 +28,7 @@ func runPrint(globalCfg *config.InvariantConfig, args []string) {
 	fsFlags.IntVar(&cmFlags.DiskCacheSizeMB, "disk-cache", 1024, "Disk caching size in MB for storage backend (0 to disable)")
 	fsFlags.StringVar(&cmFlags.CacheDir, "cache-dir", "", "Directory to use for the disk cache (default: ~/.cache/invariant)")
 	fsFlags.StringVar(&cmFlags.OverflowDir, "overflow-dir", "", "Directory to use for the overflow cache (default: ~/.cache/invariant/overflow)")
+	fsFlags.BoolVar(&cmFlags.NoVerifyCache, "no-verify-cache", false, "Skip checking blocks read from the disk cache against their address")
 
 	fsFlags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: invariant print [options] <id-or-name>\n\n")
@@ -83,7 +84,7 @@ func runPrint(globalCfg *config.InvariantConfig, args []string) {
 		os.Exit(1)
 	}
 	finderClient := finder.NewClient(finderAddr, nil)
-	baseStorageClient := storage.NewAggregateClient(finderClient, dClient, 3, 1000)
+	baseStorageClient := storage.NewAggregateClient(finderClient, dClient, storage.DefaultAggregateConfig())
 	storageClient, _ := SetupCacheStorage(&cmFlags, baseStorageClient)
 
 	var link content.ContentLink
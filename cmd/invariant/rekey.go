@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"invariant/internal/config"
+	"invariant/internal/content"
+	"invariant/internal/discovery"
+	"invariant/internal/filetree"
+	"invariant/internal/finder"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+func runRekey(globalCfg *config.InvariantConfig, args []string) {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	var discoveryURL string
+	fs.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
+	var compress bool
+	var keyPolicyStr string
+	var keyStr string
+	var keyFile string
+	fs.BoolVar(&compress, "compress", false, "Compress the re-written content")
+	fs.StringVar(&keyPolicyStr, "key-policy", "SuppliedAllKey", "Encryption key policy of the re-written content (RandomAllKey, Deterministic, SuppliedAllKey)")
+	fs.StringVar(&keyStr, "key", "", "New 32-byte hex-encoded key (prefer --key-file or "+content.KeyEnvVar+" to keep the key off the command line)")
+	fs.StringVar(&keyFile, "key-file", "", "File containing the new 32-byte key used by SuppliedAllKey (defaults to the "+content.KeyEnvVar+" environment variable)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: invariant rekey [options] <root-link>\n")
+		fmt.Fprintf(os.Stderr, "Re-encrypts the file tree at the JSON content link <root-link> with a new key or policy.\n")
+		fmt.Fprintf(os.Stderr, "If the link is a slot link, the slot is updated to the re-encrypted tree.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Error: missing root link\n")
+		fs.Usage()
+		os.Exit(1)
+	}
+	var root content.ContentLink
+	if err := json.Unmarshal([]byte(fs.Arg(0)), &root); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to parse root link: %v\n", err)
+		os.Exit(1)
+	}
+
+	opts := content.WriterOptions{EncryptAlgorithm: "aes-256-cbc"}
+	if compress {
+		opts.CompressAlgorithm = "gzip"
+	}
+	switch keyPolicyStr {
+	case "RandomAllKey":
+		opts.KeyPolicy = content.SuppliedAllKey
+		k := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, k); err != nil {
+			fmt.Fprintf(os.Stderr, "Error generating RandomAllKey: %v\n", err)
+			os.Exit(1)
+		}
+		opts.SuppliedKey = k
+	case "Deterministic":
+		opts.KeyPolicy = content.Deterministic
+	case "SuppliedAllKey":
+		opts.KeyPolicy = content.SuppliedAllKey
+		key, err := loadKey(keyStr, keyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading key: %v\n", err)
+			os.Exit(1)
+		}
+		opts.SuppliedKey = key
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unsupported key-policy '%s'\n", keyPolicyStr)
+		os.Exit(1)
+	}
+
+	if discoveryURL == "" && globalCfg != nil {
+		discoveryURL = globalCfg.Discovery
+	}
+	if discoveryURL == "" {
+		fmt.Fprintf(os.Stderr, "Discovery URL is required\n")
+		os.Exit(1)
+	}
+	dClient := discovery.NewClient(discoveryURL, nil)
+	findService := func(kind string) string {
+		addr, err := discovery.FindAddress(context.Background(), dClient, kind)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return addr
+	}
+
+	finderClient := finder.NewClient(findService("finder-v1"), nil)
+	storageClient := storage.NewAggregateClient(finderClient, dClient, storage.DefaultAggregateConfig())
+	var slotsClient slots.Slots
+	if root.Slot {
+		slotsClient = slots.NewClient(findService("slots-v1"), nil)
+	}
+
+	// Read the tree from the address the slot holds now so the update can
+	// detect a concurrent publish
+	ctx := context.Background()
+	treeRoot := root
+	if root.Slot {
+		address, err := slotsClient.Get(ctx, root.Address)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read slot %s: %v\n", root.Address, err)
+			os.Exit(1)
+		}
+		treeRoot.Address = address
+		treeRoot.Slot = false
+	}
+
+	newRoot, stats, err := filetree.Reencrypt(ctx, treeRoot, storageClient, slotsClient, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Re-encryption failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Re-encrypted %d files in %d directories\n", stats.Files, stats.Directories)
+
+	if root.Slot {
+		var auth []byte
+		if keysDir, err := config.KeysDir(); err == nil {
+			if data, err := os.ReadFile(filepath.Join(keysDir, fmt.Sprintf("%s.key", root.Address))); err == nil {
+				auth = data
+			}
+		}
+		err := filetree.RepublishSlot(ctx, slotsClient, root.Address, treeRoot.Address, newRoot.Address, auth)
+		if errors.Is(err, slots.ErrConflict) {
+			fmt.Fprintf(os.Stderr, "Slot %s was updated during re-encryption; run rekey again to rotate the new tree\n", root.Address)
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Updated slot %s from %s to %s\n", root.Address, treeRoot.Address, newRoot.Address)
+
+		newRoot.Address = root.Address
+		newRoot.Slot = true
+	}
+
+	out, err := json.MarshalIndent(newRoot, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to marshal output: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s\n", out)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"invariant/internal/config"
+	"invariant/internal/content"
+	"invariant/internal/discovery"
+	"invariant/internal/filetree"
+	"invariant/internal/identity"
+	"invariant/internal/slots"
+)
+
+func runSign(globalCfg *config.InvariantConfig, args []string) {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	var discoveryURL string
+	fs.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
+	var keyPath string
+	fs.StringVar(&keyPath, "key", "", "Ed25519 private key file, created if missing, signing the root (default: identity.key in the keys directory)")
+	var signatureSlot string
+	fs.StringVar(&signatureSlot, "signature-slot", "", "Slot, given by ID or name, to point at the signature")
+	var sequence uint64
+	fs.Uint64Var(&sequence, "sequence", 0, "Sequence number of the signature (default: one more than the signature the signature slot points at)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: invariant sign [options] <slot|root-link>\n")
+		fmt.Fprintf(os.Stderr, "Signs the root held by a slot, given by ID or name, or at a JSON content link, and prints the address of the signature.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if keyPath == "" {
+		keysDir, err := config.KeysDir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to find the keys directory: %v\n", err)
+			os.Exit(1)
+		}
+		keyPath = filepath.Join(keysDir, "identity.key")
+	}
+	key, err := identity.LoadOrCreateKeyPair(keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load signing key: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	dClient, store, slotsClient := treeServices(globalCfg, discoveryURL, true)
+	slot, root := resolveRootAddress(ctx, dClient, slotsClient, fs.Arg(0))
+
+	var signatureSlotID string
+	if signatureSlot != "" {
+		id, err := discovery.ResolveName(ctx, dClient, signatureSlot)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not resolve signature slot: %v\n", err)
+			os.Exit(1)
+		}
+		signatureSlotID = id
+	}
+	if sequence == 0 {
+		sequence = filetree.NextSequence(ctx, slotsClient, signatureSlotID, store)
+	}
+
+	signature, err := filetree.SignRoot(slot, root, sequence, key, store)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to store signature: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Signed root %s as %s with sequence %d\n", root, key.ID(), sequence)
+
+	if signatureSlotID != "" {
+		var auth []byte
+		if keysDir, err := config.KeysDir(); err == nil {
+			if data, err := os.ReadFile(filepath.Join(keysDir, fmt.Sprintf("%s.key", signatureSlotID))); err == nil {
+				auth = data
+			}
+		}
+		if err := filetree.PublishSignature(ctx, slotsClient, signatureSlotID, signature, auth); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Println(signature)
+}
+
+func runVerify(globalCfg *config.InvariantConfig, args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var discoveryURL string
+	fs.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
+	var signer string
+	fs.StringVar(&signer, "signer", "", "Identity ID that must have signed the root")
+	var signature string
+	fs.StringVar(&signature, "signature", "", "Address of the signature")
+	var signatureSlot string
+	fs.StringVar(&signatureSlot, "signature-slot", "", "Slot, given by ID or name, holding the address of the signature")
+	var minSequence uint64
+	fs.Uint64Var(&minSequence, "min-sequence", 0, "Sequence of the last signature accepted; older signatures are refused as a rollback")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: invariant verify -signer <id> [options] <slot|root-link>\n")
+		fmt.Fprintf(os.Stderr, "Checks that the root held by a slot, given by ID or name, or at a JSON content link is signed by <id>.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || signer == "" || (signature == "") == (signatureSlot == "") {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	dClient, store, slotsClient := treeServices(globalCfg, discoveryURL, true)
+	slot, root := resolveRootAddress(ctx, dClient, slotsClient, fs.Arg(0))
+	if signatureSlot != "" {
+		id, err := discovery.ResolveName(ctx, dClient, signatureSlot)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not resolve signature slot: %v\n", err)
+			os.Exit(1)
+		}
+		signature, err = slotsClient.Get(ctx, id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read signature slot %s: %v\n", id, err)
+			os.Exit(1)
+		}
+	}
+
+	sig, err := filetree.VerifyRoot(signature, slot, root, signer, minSequence, store)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Root %s is not signed by %s: %v\n", root, signer, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Root %s signed by %s at %s with sequence %d\n", root, signer, time.Unix(sig.Timestamp, 0).Format(time.RFC1123Z), sig.Sequence)
+}
+
+// resolveRootAddress returns the slot and the address of the root at target,
+// a JSON content link or a slot given by ID or name. The slot is empty for a
+// link to a block.
+func resolveRootAddress(ctx context.Context, dClient discovery.Discovery, slotsClient slots.Slots, target string) (string, string) {
+	root := resolveRootLink(ctx, dClient, target)
+	if !root.Slot {
+		return "", root.Address
+	}
+	address, err := slotsClient.Get(ctx, root.Address)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read slot %s: %v\n", root.Address, err)
+		os.Exit(1)
+	}
+	return root.Address, address
+}
+
+// resolveRootLink parses target as a JSON content link or, otherwise, as the
+// ID or name of a slot, returning a slot link.
+func resolveRootLink(ctx context.Context, dClient discovery.Discovery, target string) content.ContentLink {
+	var root content.ContentLink
+	if strings.HasPrefix(strings.TrimSpace(target), "{") {
+		if err := json.Unmarshal([]byte(target), &root); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to parse root link: %v\n", err)
+			os.Exit(1)
+		}
+		return root
+	}
+	resolved, err := discovery.ResolveName(ctx, dClient, target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not resolve slot: %v\n", err)
+		os.Exit(1)
+	}
+	return content.ContentLink{Address: resolved, Slot: true}
+}
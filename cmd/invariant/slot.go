@@ -53,26 +53,21 @@ func runSlot(globalCfg *config.InvariantConfig, args []string) {
 
 	dClient := discovery.NewClient(globalCfg.Discovery, nil)
 
-	finderID, err := dClient.Find(context.Background(), "finder-v1", 1)
-	if err == nil && len(finderID) > 0 {
-		fClient := finder.NewClient(finderID[0].Address, nil)
+	if finderAddr, err := discovery.FindAddress(context.Background(), dClient, "finder-v1"); err == nil {
+		fClient := finder.NewClient(finderAddr, nil)
 		res, err := fClient.Find(context.Background(), blockAddress)
 		if err != nil || len(res) == 0 {
 			fmt.Fprintf(os.Stderr, "Warning: Block address %s could not be found via finder service.\n", blockAddress)
 		}
 	}
 
-	id, err := dClient.Find(context.Background(), "slots-v1", 1)
+	slotsAddr, err := discovery.FindAddress(context.Background(), dClient, "slots-v1")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not query discovery service: %v\n", err)
-		os.Exit(1)
-	}
-	if len(id) == 0 {
-		fmt.Fprintf(os.Stderr, "Could not find any slots-v1 service\n")
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
 
-	slotsClient := slots.NewClient(id[0].Address, nil)
+	slotsClient := slots.NewClient(slotsAddr, nil)
 
 	var slotID string
 	var privKey ed25519.PrivateKey
@@ -120,15 +115,11 @@ func runSlot(globalCfg *config.InvariantConfig, args []string) {
 	}
 
 	if *nameFlag != "" {
-		namesID, err := dClient.Find(context.Background(), "names-v1", 1)
+		namesAddr, err := discovery.FindAddress(context.Background(), dClient, "names-v1")
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Could not query discovery service for names-v1: %v\n", err)
-			os.Exit(1)
-		}
-		if len(namesID) == 0 {
-			fmt.Fprintf(os.Stderr, "Warning: Could not find any names-v1 service to register name.\n")
+			fmt.Fprintf(os.Stderr, "Warning: %v, the name was not registered.\n", err)
 		} else {
-			namesClient := names.NewClient(namesID[0].Address, nil)
+			namesClient := names.NewClient(namesAddr, nil)
 			err = namesClient.Put(context.Background(), *nameFlag, slotID, []string{"slot-v1"})
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Failed to register name: %v\n", err)
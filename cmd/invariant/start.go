@@ -5,8 +5,11 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -22,6 +25,18 @@ func runStart(globalCfg *config.InvariantConfig, args []string) {
 	fs.DurationVar(&maxBackoff, "max-backoff", 5*time.Minute, "Configurable amount of time to try exponential back-off before waiting the retry-interval")
 	var retryInterval time.Duration
 	fs.DurationVar(&retryInterval, "retry-interval", 10*time.Minute, "Time to wait before retrying to start a process that has failed beyond the max backoff")
+	var logOpts start.LogOptions
+	fs.BoolVar(&logOpts.Timestamps, "timestamps", false, "Prefix each line of service output with the time it was printed")
+	fs.BoolVar(&logOpts.Color, "color", isTerminal(os.Stdout), "Print the prefix of each service's output in its own color (default when printing to a terminal)")
+	fs.BoolVar(&logOpts.Quiet, "quiet", false, "Discard the output of the services, only printing when they start and exit")
+	var only string
+	fs.StringVar(&only, "only", "", "Comma-separated names or commands of the services whose output is printed")
+	var crashDir string
+	fs.StringVar(&crashDir, "crash-dir", "", "Directory crash reports of services exiting abnormally are written to (default \"crashes\" next to the configuration file)")
+	var crashLines int
+	fs.IntVar(&crashLines, "crash-lines", start.DefaultCrashLines, "Number of lines of a service's output kept in its crash report")
+	var adminAddr string
+	fs.StringVar(&adminAddr, "admin", "", "Address to serve the state and last crash of each service at GET /status (disabled if not set)")
 
 	fs.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: invariant start [options]\n\n")
@@ -29,6 +44,12 @@ func runStart(globalCfg *config.InvariantConfig, args []string) {
 	}
 	fs.Parse(args)
 
+	for name := range strings.SplitSeq(only, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			logOpts.Only = append(logOpts.Only, name)
+		}
+	}
+
 	cfg, err := start.LoadConfig(configPath, "")
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
@@ -38,6 +59,12 @@ func runStart(globalCfg *config.InvariantConfig, args []string) {
 		MaxBackoffDuration: maxBackoff,
 		RetryInterval:      retryInterval,
 		Config:             cfg,
+		Log:                logOpts,
+		CrashLines:         crashLines,
+		CrashDir:           crashDir,
+	}
+	if rc.CrashDir == "" {
+		rc.CrashDir = filepath.Join(filepath.Dir(configPath), "crashes")
 	}
 
 	runner, err := start.NewRunner(rc)
@@ -58,7 +85,22 @@ func runStart(globalCfg *config.InvariantConfig, args []string) {
 		cancel()
 	}()
 
+	if adminAddr != "" {
+		go func() {
+			log.Printf("Serving service status on %s", adminAddr)
+			if err := http.ListenAndServe(adminAddr, runner.Handler()); err != nil {
+				log.Printf("Admin server failed: %v", err)
+			}
+		}()
+	}
+
 	log.Printf("Starting services from %s...", configPath)
 	runner.Start(ctx)
 	log.Println("All services stopped. Exiting.")
 }
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"invariant/internal/config"
+	"invariant/internal/content"
+	"invariant/internal/discovery"
+	"invariant/internal/filetree"
+	"invariant/internal/finder"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+// syncStateFile is the file within the .invariant directory of a synced
+// directory that records the state of its last sync.
+const syncStateFile = "sync.json"
+
+// syncState is the state of a local directory as of its last sync. Root is
+// the tree both sides matched, the base against which the changes of each
+// side are found.
+type syncState struct {
+	Target string                   `json:"target"`
+	Root   content.ContentLink      `json:"root"`
+	Files  map[string]syncFileState `json:"files"`
+}
+
+// syncFileState identifies the content of a local file by its modification
+// time and size, so unchanged files are not read again.
+type syncFileState struct {
+	ModifyTime int64               `json:"modifyTime"` // nanoseconds since the epoch
+	Size       int64               `json:"size"`
+	Content    content.ContentLink `json:"content"`
+}
+
+// syncAction is a change made by a sync, to the remote tree (push) or to the
+// local directory (pull).
+type syncAction struct {
+	Push     bool
+	Change   filetree.Change
+	Conflict bool
+}
+
+func (a syncAction) String() string {
+	dir := "<"
+	if a.Push {
+		dir = ">"
+	}
+	s := fmt.Sprintf("%s %-8s %s", dir, a.Change.Kind, a.Change.Path)
+	if a.Conflict {
+		s += " (conflict)"
+	}
+	return s
+}
+
+// dirSyncer synchronizes a local directory with a file tree in both
+// directions.
+type dirSyncer struct {
+	store       storage.Storage // reads the trees and stores directories
+	fileStore   storage.Storage // stores the content of local files
+	slotService slots.Slots
+	opts        content.WriterOptions
+	rules       *filetree.IgnoreMatcher
+	prefer      string // "newer", "local" or "remote"
+
+	state    syncState
+	newFiles map[string]syncFileState
+}
+
+func runSync(globalCfg *config.InvariantConfig, args []string) {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	var discoveryURL string
+	fs.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
+	var excludes, includes string
+	fs.StringVar(&excludes, "exclude", "", "Comma-separated gitignore patterns of paths not to sync")
+	fs.StringVar(&includes, "include", "", "Comma-separated gitignore patterns of paths to sync even if excluded")
+	var prefer string
+	fs.StringVar(&prefer, "prefer", "newer", "Side kept when both changed the same path (newer, local, remote)")
+	var dryRun bool
+	fs.BoolVar(&dryRun, "dry-run", false, "Report the changes without making them")
+	var compress, encrypt bool
+	var keyPolicyStr, keyStr, keyFile string
+	fs.BoolVar(&compress, "compress", false, "Compress the pushed content")
+	fs.BoolVar(&encrypt, "encrypt", false, "Encrypt the pushed content")
+	fs.StringVar(&keyPolicyStr, "key-policy", "Deterministic", "Encryption key policy (Deterministic, SuppliedAllKey)")
+	fs.StringVar(&keyStr, "key", "", "32-byte hex-encoded key (prefer --key-file or "+content.KeyEnvVar+" to keep the key off the command line)")
+	fs.StringVar(&keyFile, "key-file", "", "File containing the 32-byte key used by SuppliedAllKey (defaults to the "+content.KeyEnvVar+" environment variable)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: invariant sync [options] <localdir> <slot|root-link>\n")
+		fmt.Fprintf(os.Stderr, "Synchronizes a local directory with the file tree in a slot, given by ID or name, or at a JSON content link.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if prefer != "newer" && prefer != "local" && prefer != "remote" {
+		fmt.Fprintf(os.Stderr, "Error: unsupported -prefer %q\n", prefer)
+		os.Exit(1)
+	}
+	localDir, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid directory path: %v\n", err)
+		os.Exit(1)
+	}
+	if info, err := os.Stat(localDir); err != nil || !info.IsDir() {
+		fmt.Fprintf(os.Stderr, "Target is not a directory: %v\n", localDir)
+		os.Exit(1)
+	}
+
+	var opts content.WriterOptions
+	if compress {
+		opts.CompressAlgorithm = "gzip"
+	}
+	if encrypt {
+		opts.EncryptAlgorithm = "aes-256-cbc"
+		switch keyPolicyStr {
+		case "Deterministic":
+			opts.KeyPolicy = content.Deterministic
+		case "SuppliedAllKey":
+			opts.KeyPolicy = content.SuppliedAllKey
+			key, err := loadKey(keyStr, keyFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error loading key: %v\n", err)
+				os.Exit(1)
+			}
+			opts.SuppliedKey = key
+		default:
+			fmt.Fprintf(os.Stderr, "Error: unsupported key-policy '%s'\n", keyPolicyStr)
+			os.Exit(1)
+		}
+	}
+	opts.Splitters = []content.Splitter{
+		&content.ZipSplitter{},
+		&content.RepMaxSplitter{},
+	}
+
+	var rules []string
+	if excludes != "" {
+		rules = append(rules, strings.Split(excludes, ",")...)
+	}
+	if includes != "" {
+		for pattern := range strings.SplitSeq(includes, ",") {
+			rules = append(rules, "!"+pattern)
+		}
+	}
+
+	if discoveryURL == "" && globalCfg != nil {
+		discoveryURL = globalCfg.Discovery
+	}
+	if discoveryURL == "" {
+		fmt.Fprintf(os.Stderr, "Discovery URL is required\n")
+		os.Exit(1)
+	}
+	dClient := discovery.NewClient(discoveryURL, nil)
+	findService := func(kind string) string {
+		addr, err := discovery.FindAddress(context.Background(), dClient, kind)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return addr
+	}
+
+	ctx := context.Background()
+	target := fs.Arg(1)
+	var root content.ContentLink
+	if strings.HasPrefix(strings.TrimSpace(target), "{") {
+		if err := json.Unmarshal([]byte(target), &root); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to parse root link: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		resolved, err := discovery.ResolveName(ctx, dClient, target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not resolve slot: %v\n", err)
+			os.Exit(1)
+		}
+		root = content.ContentLink{Address: resolved, Slot: true}
+	}
+
+	finderClient := finder.NewClient(findService("finder-v1"), nil)
+	var store storage.Storage = storage.NewAggregateClient(finderClient, dClient, storage.DefaultAggregateConfig())
+	var slotsClient slots.Slots
+	if root.Slot {
+		slotsClient = slots.NewClient(findService("slots-v1"), nil)
+	}
+
+	// Read the tree from the address the slot holds now so the update can
+	// detect a concurrent publish
+	remote := root
+	if root.Slot {
+		address, err := slotsClient.Get(ctx, root.Address)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read slot %s: %v\n", root.Address, err)
+			os.Exit(1)
+		}
+		remote.Address = address
+		remote.Slot = false
+	}
+
+	s := &dirSyncer{
+		store:       store,
+		fileStore:   store,
+		slotService: slotsClient,
+		opts:        opts,
+		rules:       filetree.CompileIgnore(rules),
+		prefer:      prefer,
+	}
+	if dryRun {
+		// Keep the blocks written to find the changes in memory, except file
+		// content which is only needed for its address
+		s.store = storage.NewJoinedStorage(storage.NewInMemoryStorage(), store)
+		s.fileStore = storage.NewHashingStorage()
+	}
+	if err := s.loadState(localDir, stateTarget(root)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read sync state: %v\n", err)
+		os.Exit(1)
+	}
+
+	merged, actions, err := s.plan(ctx, localDir, remote)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Sync failed: %v\n", err)
+		os.Exit(1)
+	}
+	for _, a := range actions {
+		fmt.Println(a)
+	}
+	if dryRun {
+		return
+	}
+
+	if root.Slot && merged.Address != remote.Address {
+		var auth []byte
+		if keysDir, err := config.KeysDir(); err == nil {
+			if data, err := os.ReadFile(filepath.Join(keysDir, fmt.Sprintf("%s.key", root.Address))); err == nil {
+				auth = data
+			}
+		}
+		err := slotsClient.Update(ctx, root.Address, merged.Address, remote.Address, auth)
+		if errors.Is(err, slots.ErrConflict) {
+			fmt.Fprintf(os.Stderr, "Slot %s was updated during the sync; run sync again\n", root.Address)
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to update slot: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := s.apply(ctx, localDir, merged, actions); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to apply remote changes: %v\n", err)
+		os.Exit(1)
+	}
+
+	if !root.Slot {
+		out, err := json.MarshalIndent(merged, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to marshal output: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s\n", out)
+	}
+}
+
+// stateTarget identifies the target of a sync in its state, so a directory
+// synced with a different tree starts from an empty base.
+func stateTarget(root content.ContentLink) string {
+	if root.Slot {
+		return "slot:" + root.Address
+	}
+	return "root"
+}
+
+func (s *dirSyncer) loadState(localDir, target string) error {
+	data, err := os.ReadFile(filepath.Join(localDir, ".invariant", syncStateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			return err
+		}
+	}
+	if s.state.Target != target {
+		// The recorded file contents are still valid, but not the base
+		s.state.Root = content.ContentLink{}
+	}
+	s.state.Target = target
+	if s.state.Files == nil {
+		s.state.Files = make(map[string]syncFileState)
+	}
+	return nil
+}
+
+func (s *dirSyncer) saveState(localDir string) error {
+	dir := filepath.Join(localDir, ".invariant")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	// The links in the state carry the keys of the content
+	tmp := filepath.Join(dir, syncStateFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, syncStateFile))
+}
+
+// plan finds the changes made locally and remotely since the last sync and
+// returns the root of the remote tree with the local changes applied, along
+// with the actions that get both sides to it.
+func (s *dirSyncer) plan(ctx context.Context, localDir string, remote content.ContentLink) (content.ContentLink, []syncAction, error) {
+	s.newFiles = make(map[string]syncFileState)
+	local, _, err := s.writeLocalDirectory(ctx, localDir, "")
+	if err != nil {
+		return content.ContentLink{}, nil, err
+	}
+
+	base := s.state.Root
+	localChanges, err := filetree.Diff(ctx, base, local, s.store, s.slotService)
+	if err != nil {
+		return content.ContentLink{}, nil, fmt.Errorf("failed to compare local changes: %w", err)
+	}
+	remoteChanges, err := filetree.Diff(ctx, base, remote, s.store, s.slotService)
+	if err != nil {
+		return content.ContentLink{}, nil, fmt.Errorf("failed to compare remote changes: %w", err)
+	}
+
+	// A remote change is not pulled if a local change to a related path is
+	// kept instead or makes the same change
+	skipRemote := make([]bool, len(remoteChanges))
+	conflicted := make([]bool, len(remoteChanges))
+	var actions []syncAction
+	merged := remote
+	for _, lc := range localChanges {
+		keep, conflict, covered := true, false, false
+		var related []int
+		for j, rc := range remoteChanges {
+			if !relatedPaths(lc.Path, rc.Path) {
+				continue
+			}
+			if lc.Path == rc.Path && sameChange(lc, rc) {
+				skipRemote[j] = true
+				keep = false
+				covered = true
+				continue
+			}
+			conflict = true
+			conflicted[j] = true
+			related = append(related, j)
+			if !s.localWins(lc, rc) {
+				keep = false
+			}
+			if !strings.HasPrefix(rc.Path, lc.Path+"/") {
+				covered = true
+			}
+		}
+		if !keep {
+			if !covered {
+				// Only changes below the path were pulled, so restore the
+				// remote entry at the path itself in their place
+				entry, err := filetree.Lookup(ctx, remote, lc.Path, s.store, s.slotService)
+				if err != nil {
+					return content.ContentLink{}, nil, err
+				}
+				for _, j := range related {
+					skipRemote[j] = true
+				}
+				actions = append(actions, syncAction{Change: restoreChange(lc, entry), Conflict: true})
+			}
+			continue
+		}
+		for _, j := range related {
+			skipRemote[j] = true
+		}
+		merged, err = filetree.Put(ctx, merged, lc.Path, lc.New, s.store, s.slotService, s.opts)
+		if err != nil {
+			return content.ContentLink{}, nil, fmt.Errorf("failed to push %s: %w", lc.Path, err)
+		}
+		actions = append(actions, syncAction{Push: true, Change: lc, Conflict: conflict})
+	}
+	for j, rc := range remoteChanges {
+		if !skipRemote[j] {
+			actions = append(actions, syncAction{Change: rc, Conflict: conflicted[j]})
+		}
+	}
+	return merged, actions, nil
+}
+
+// restoreChange is the change that turns the local entry changed by lc back
+// into the remote entry.
+func restoreChange(lc filetree.Change, remote filetree.Entry) filetree.Change {
+	c := filetree.Change{Path: lc.Path, Kind: filetree.Modified, Old: lc.New, New: remote}
+	switch {
+	case lc.New == nil:
+		c.Kind = filetree.Added
+	case remote == nil:
+		c.Kind = filetree.Removed
+	}
+	return c
+}
+
+// relatedPaths reports whether the paths are the same or one is within the
+// other.
+func relatedPaths(a, b string) bool {
+	return a == b || strings.HasPrefix(b, a+"/") || strings.HasPrefix(a, b+"/")
+}
+
+// sameChange reports whether two changes to the same path leave it with the
+// same entry.
+func sameChange(a, b filetree.Change) bool {
+	if a.New == nil || b.New == nil {
+		return a.New == nil && b.New == nil
+	}
+	aDir, aIsDir := a.New.(*filetree.DirectoryEntry)
+	bDir, bIsDir := b.New.(*filetree.DirectoryEntry)
+	if aIsDir || bIsDir {
+		return aIsDir && bIsDir && aDir.Content.Address == bDir.Content.Address
+	}
+	return entryEqual(a.New, b.New)
+}
+
+// entryEqual reports whether two entries that are not directories have the
+// same kind and content.
+func entryEqual(a, b filetree.Entry) bool {
+	switch a := a.(type) {
+	case *filetree.FileEntry:
+		b, ok := b.(*filetree.FileEntry)
+		return ok && a.Content.Address == b.Content.Address
+	case *filetree.SymbolicLinkEntry:
+		b, ok := b.(*filetree.SymbolicLinkEntry)
+		return ok && a.Target == b.Target
+	}
+	return false
+}
+
+// localWins reports whether the local change is kept over a conflicting
+// remote change. When preferring the newer change a modification is kept over
+// a removal, and the remote change is kept if the times are equal.
+func (s *dirSyncer) localWins(local, remote filetree.Change) bool {
+	switch s.prefer {
+	case "local":
+		return true
+	case "remote":
+		return false
+	}
+	if local.New == nil || remote.New == nil {
+		return remote.New == nil && local.New != nil
+	}
+	return modifyTime(local.New) > modifyTime(remote.New)
+}
+
+func modifyTime(e filetree.Entry) uint64 {
+	var t *uint64
+	switch e := e.(type) {
+	case *filetree.FileEntry:
+		t = e.ModifyTime
+	case *filetree.DirectoryEntry:
+		t = e.ModifyTime
+	case *filetree.SymbolicLinkEntry:
+		t = e.ModifyTime
+	}
+	if t == nil {
+		return 0
+	}
+	return *t
+}
+
+// writeLocalDirectory writes the directory at rel below localDir as a tree,
+// storing the content of the files changed since the last sync, and returns
+// the link to it and its entry.
+func (s *dirSyncer) writeLocalDirectory(ctx context.Context, localDir, rel string) (content.ContentLink, *filetree.DirectoryEntry, error) {
+	dirPath := filepath.Join(localDir, filepath.FromSlash(rel))
+	infos, err := os.ReadDir(dirPath)
+	if err != nil {
+		return content.ContentLink{}, nil, err
+	}
+
+	var dir filetree.Directory
+	for _, de := range infos {
+		childRel := path.Join(rel, de.Name())
+		if s.rules.Matches(childRel, de.IsDir()) {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(dirPath, de.Name()))
+		if err != nil {
+			return content.ContentLink{}, nil, err
+		}
+		ctime, mtime := getEntryTimes(info)
+		mode := fmt.Sprintf("%04o", info.Mode().Perm())
+		base := filetree.BaseEntry{Name: de.Name(), CreateTime: ctime, ModifyTime: mtime, Mode: &mode}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(filepath.Join(dirPath, de.Name()))
+			if err != nil {
+				return content.ContentLink{}, nil, err
+			}
+			base.Kind = filetree.SymbolicLinkKind
+			dir = append(dir, &filetree.SymbolicLinkEntry{BaseEntry: base, Target: target})
+		case info.IsDir():
+			_, entry, err := s.writeLocalDirectory(ctx, localDir, childRel)
+			if err != nil {
+				return content.ContentLink{}, nil, err
+			}
+			entry.BaseEntry = base
+			entry.Kind = filetree.DirectoryKind
+			dir = append(dir, entry)
+		case info.Mode().IsRegular():
+			link, err := s.writeLocalFile(filepath.Join(dirPath, de.Name()), childRel, info)
+			if err != nil {
+				return content.ContentLink{}, nil, err
+			}
+			base.Kind = filetree.FileKind
+			dir = append(dir, &filetree.FileEntry{BaseEntry: base, Content: link, Size: uint64(info.Size())})
+		}
+	}
+
+	data, err := json.Marshal(dir)
+	if err != nil {
+		return content.ContentLink{}, nil, err
+	}
+	link, err := content.Write(strings.NewReader(string(data)), s.store, s.opts)
+	if err != nil {
+		return content.ContentLink{}, nil, err
+	}
+	totalSize, totalEntries := dir.Totals()
+	return link, &filetree.DirectoryEntry{Content: link, Size: uint64(len(data)), TotalSize: totalSize, TotalEntries: totalEntries}, nil
+}
+
+// writeLocalFile returns the link to the content of the file at rel, which is
+// only read if its modification time or size changed since the last sync.
+func (s *dirSyncer) writeLocalFile(filePath, rel string, info os.FileInfo) (content.ContentLink, error) {
+	if fs, ok := s.state.Files[rel]; ok && fs.ModifyTime == info.ModTime().UnixNano() && fs.Size == info.Size() {
+		s.newFiles[rel] = fs
+		return fs.Content, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return content.ContentLink{}, err
+	}
+	defer file.Close()
+	opts := s.opts
+	opts.Filename = info.Name()
+	link, err := content.Write(file, s.fileStore, opts)
+	if err != nil {
+		return content.ContentLink{}, fmt.Errorf("failed to store %s: %w", rel, err)
+	}
+	s.newFiles[rel] = syncFileState{ModifyTime: info.ModTime().UnixNano(), Size: info.Size(), Content: link}
+	return link, nil
+}
+
+// apply makes the pulled changes to the local directory and records merged
+// as the base of the next sync. The changes are made through an os.Root of
+// localDir, and their paths are checked, so names in the pulled tree such as
+// ".." or symbolic links in it cannot write outside of localDir.
+func (s *dirSyncer) apply(ctx context.Context, localDir string, merged content.ContentLink, actions []syncAction) error {
+	root, err := os.OpenRoot(localDir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	for _, a := range actions {
+		if a.Push {
+			continue
+		}
+		rel := a.Change.Path
+		if err := checkPulledPath(root, rel); err != nil {
+			return err
+		}
+		target := filepath.FromSlash(rel)
+		if err := root.RemoveAll(target); err != nil {
+			return err
+		}
+		s.forgetFiles(rel)
+		if a.Change.New == nil {
+			continue
+		}
+		if err := root.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := s.materialize(ctx, root, rel, a.Change.New); err != nil {
+			return fmt.Errorf("failed to pull %s: %w", rel, err)
+		}
+	}
+
+	s.state.Root = merged
+	s.state.Files = s.newFiles
+	return s.saveState(localDir)
+}
+
+// checkPulledPath reports an error if rel, the path of a pulled change, has
+// an element that is not a valid entry name or passes through a symbolic
+// link in root.
+func checkPulledPath(root *os.Root, rel string) error {
+	elements := strings.Split(rel, "/")
+	for i, name := range elements {
+		if !filetree.IsValidName(name) {
+			return fmt.Errorf("invalid path %q in the pulled tree", rel)
+		}
+		if i == len(elements)-1 {
+			break
+		}
+		info, err := root.Lstat(filepath.Join(elements[:i+1]...))
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to pull %s through the symbolic link %s", rel, path.Join(elements[:i+1]...))
+		}
+	}
+	return nil
+}
+
+// forgetFiles removes the recorded state of the files at or below rel.
+func (s *dirSyncer) forgetFiles(rel string) {
+	for p := range s.newFiles {
+		if p == rel || strings.HasPrefix(p, rel+"/") {
+			delete(s.newFiles, p)
+		}
+	}
+}
+
+// materialize writes entry at rel in root.
+func (s *dirSyncer) materialize(ctx context.Context, root *os.Root, rel string, entry filetree.Entry) error {
+	target := filepath.FromSlash(rel)
+	switch e := entry.(type) {
+	case *filetree.SymbolicLinkEntry:
+		return root.Symlink(e.Target, target)
+	case *filetree.DirectoryEntry:
+		if err := root.Mkdir(target, entryMode(e.Mode, 0755)); err != nil {
+			return err
+		}
+		dir, err := filetree.ReadDirectory(e.Content, s.store, s.slotService)
+		if err != nil {
+			return err
+		}
+		for _, child := range dir {
+			if !filetree.IsValidName(child.GetName()) {
+				return fmt.Errorf("invalid name %q in %s", child.GetName(), rel)
+			}
+			if err := s.materialize(ctx, root, path.Join(rel, child.GetName()), child); err != nil {
+				return err
+			}
+		}
+		return setModifyTime(root, target, e.ModifyTime)
+	case *filetree.FileEntry:
+		rc, err := content.Read(e.Content, s.store, s.slotService)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		file, err := root.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, entryMode(e.Mode, 0644))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, rc); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		if err := setModifyTime(root, target, e.ModifyTime); err != nil {
+			return err
+		}
+		info, err := root.Stat(target)
+		if err != nil {
+			return err
+		}
+		s.newFiles[rel] = syncFileState{ModifyTime: info.ModTime().UnixNano(), Size: info.Size(), Content: e.Content}
+	}
+	return nil
+}
+
+func entryMode(mode *string, def os.FileMode) os.FileMode {
+	if mode != nil {
+		if m, err := strconv.ParseUint(*mode, 8, 32); err == nil {
+			return os.FileMode(m)
+		}
+	}
+	return def
+}
+
+func setModifyTime(root *os.Root, target string, t *uint64) error {
+	if t == nil {
+		return nil
+	}
+	mtime := time.Unix(int64(*t), 0)
+	return root.Chtimes(target, mtime, mtime)
+}
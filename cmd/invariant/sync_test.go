@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+	"invariant/internal/storage"
+)
+
+func TestDirSyncer(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewInMemoryStorage()
+	localDir := t.TempDir()
+	newSyncer := func(prefer string) *dirSyncer {
+		s := &dirSyncer{store: store, fileStore: store, rules: filetree.CompileIgnore(nil), prefer: prefer}
+		if err := s.loadState(localDir, "root"); err != nil {
+			t.Fatalf("loadState failed: %v", err)
+		}
+		return s
+	}
+	writeLocal := func(rel, data string) {
+		p := filepath.Join(localDir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readLocal := func(rel string) string {
+		data, err := os.ReadFile(filepath.Join(localDir, filepath.FromSlash(rel)))
+		if err != nil {
+			t.Fatalf("ReadFile(%s) failed: %v", rel, err)
+		}
+		return string(data)
+	}
+	putRemote := func(root content.ContentLink, rel, data string) content.ContentLink {
+		link, err := content.Write(strings.NewReader(data), store, content.WriterOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := &filetree.FileEntry{BaseEntry: filetree.BaseEntry{Kind: filetree.FileKind, Name: filepath.Base(rel)}, Content: link, Size: uint64(len(data))}
+		root, err = filetree.Put(ctx, root, rel, entry, store, nil, content.WriterOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return root
+	}
+	sync := func(s *dirSyncer, remote content.ContentLink) (content.ContentLink, []syncAction) {
+		merged, actions, err := s.plan(ctx, localDir, remote)
+		if err != nil {
+			t.Fatalf("plan failed: %v", err)
+		}
+		if err := s.apply(ctx, localDir, merged, actions); err != nil {
+			t.Fatalf("apply failed: %v", err)
+		}
+		return merged, actions
+	}
+
+	// The first sync pushes the local files to an empty tree
+	writeLocal("a.txt", "a")
+	writeLocal("dir/b.txt", "b")
+	remote, actions := sync(newSyncer("newer"), content.ContentLink{})
+	if len(actions) != 2 || !actions[0].Push || !actions[1].Push {
+		t.Fatalf("first sync actions = %v, want two pushes", actions)
+	}
+	if entry, _ := filetree.Lookup(ctx, remote, "dir/b.txt", store, nil); entry == nil {
+		t.Fatalf("dir/b.txt was not pushed")
+	}
+
+	// Changes on each side are exchanged
+	writeLocal("a.txt", "a2")
+	remote = putRemote(remote, "dir/c.txt", "c")
+	remote, actions = sync(newSyncer("newer"), remote)
+	if len(actions) != 2 || !actions[0].Push || actions[1].Push {
+		t.Fatalf("second sync actions = %v, want a push and a pull", actions)
+	}
+	if got := readLocal("dir/c.txt"); got != "c" {
+		t.Errorf("pulled dir/c.txt = %q, want c", got)
+	}
+	entry, err := filetree.Lookup(ctx, remote, "a.txt", store, nil)
+	if err != nil || entry == nil {
+		t.Fatalf("Lookup(a.txt) = %v, %v", entry, err)
+	}
+	rc, err := content.Read(entry.(*filetree.FileEntry).Content, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pushed) != "a2" {
+		t.Errorf("pushed a.txt = %q, want a2", pushed)
+	}
+
+	// An unchanged directory syncs nothing
+	if _, actions := sync(newSyncer("newer"), remote); len(actions) != 0 {
+		t.Errorf("idle sync actions = %v, want none", actions)
+	}
+
+	// Both sides change the same file and the remote change is preferred
+	writeLocal("a.txt", "local")
+	remote = putRemote(remote, "a.txt", "remote")
+	merged, actions := sync(newSyncer("remote"), remote)
+	if len(actions) != 1 || actions[0].Push || !actions[0].Conflict {
+		t.Fatalf("conflict actions = %v, want a conflicting pull", actions)
+	}
+	if merged.Address != remote.Address {
+		t.Errorf("merged tree differs from the remote tree")
+	}
+	if got := readLocal("a.txt"); got != "remote" {
+		t.Errorf("a.txt = %q, want remote", got)
+	}
+}
+
+func TestDirSyncerApplyStaysInDirectory(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewInMemoryStorage()
+	parent := t.TempDir()
+	localDir := filepath.Join(parent, "local")
+	if err := os.Mkdir(localDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := &dirSyncer{store: store, fileStore: store, rules: filetree.CompileIgnore(nil), newFiles: map[string]syncFileState{}}
+	if err := s.loadState(localDir, "root"); err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+	link, err := content.Write(strings.NewReader("escaped"), store, content.WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := func(name string) filetree.Entry {
+		return &filetree.FileEntry{BaseEntry: filetree.BaseEntry{Kind: filetree.FileKind, Name: name}, Content: link, Size: 7}
+	}
+	pull := func(rel string, entry filetree.Entry) error {
+		return s.apply(ctx, localDir, content.ContentLink{}, []syncAction{{Change: filetree.Change{Path: rel, Kind: filetree.Added, New: entry}}})
+	}
+
+	// Names that leave the directory are rejected
+	if err := pull("../escaped.txt", file("..")); err == nil {
+		t.Errorf("expected a path with .. to be rejected")
+	}
+
+	// A pulled symbolic link cannot be followed by a later change
+	symlink := &filetree.SymbolicLinkEntry{BaseEntry: filetree.BaseEntry{Kind: filetree.SymbolicLinkKind, Name: "out"}, Target: parent}
+	if err := pull("out", symlink); err != nil {
+		t.Fatalf("pulling a symbolic link failed: %v", err)
+	}
+	if err := pull("out/escaped.txt", file("escaped.txt")); err == nil {
+		t.Errorf("expected a path through a symbolic link to be rejected")
+	}
+
+	// Invalid names in a pulled directory are rejected
+	dir, _ := json.Marshal(filetree.Directory{file("..")})
+	dirLink, err := content.Write(bytes.NewReader(dir), store, content.WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &filetree.DirectoryEntry{BaseEntry: filetree.BaseEntry{Kind: filetree.DirectoryKind, Name: "dir"}, Content: dirLink}
+	if err := pull("dir", entry); err == nil {
+		t.Errorf("expected a directory with an invalid name to be rejected")
+	}
+
+	if _, err := os.Stat(filepath.Join(parent, "escaped.txt")); !os.IsNotExist(err) {
+		t.Errorf("a pulled file was written outside of the directory")
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -92,6 +91,7 @@ func runUpload(globalCfg *config.InvariantConfig, args []string) {
 	var disableCache bool
 	var keyPolicyStr string
 	var keyStr string
+	var keyFile string
 	fsFlags.BoolVar(&compress, "compress", false, "Compress the uploaded content")
 	fsFlags.BoolVar(&encrypt, "encrypt", false, "Encrypt the uploaded content")
 	fsFlags.BoolVar(&disableCache, "no-cache", false, "Disable mtime caching")
@@ -100,7 +100,8 @@ func runUpload(globalCfg *config.InvariantConfig, args []string) {
 	fsFlags.BoolVar(&stats, "stats", false, "Emit total bytes to upload, number of blocks uploaded, number of directories created")
 	fsFlags.BoolVar(&dryRun, "dry-run", false, "Compute stats but upload to a storage that reports having all blocks (dry-run)")
 	fsFlags.StringVar(&keyPolicyStr, "key-policy", "Deterministic", "Encryption key policy (RandomPerBlock, RandomAllKey, Deterministic, SuppliedAllKey)")
-	fsFlags.StringVar(&keyStr, "key", "", "32-byte hex-encoded key (required if key-policy is SuppliedAllKey)")
+	fsFlags.StringVar(&keyStr, "key", "", "32-byte hex-encoded key (prefer --key-file or "+content.KeyEnvVar+" to keep the key off the command line)")
+	fsFlags.StringVar(&keyFile, "key-file", "", "File containing the 32-byte key used by SuppliedAllKey (defaults to the "+content.KeyEnvVar+" environment variable)")
 
 	fsFlags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: invariant upload [options] [directory]\n\n")
@@ -125,22 +126,18 @@ func runUpload(globalCfg *config.InvariantConfig, args []string) {
 	dClient = discovery.NewClient(discoveryURL, nil)
 
 	findService := func(kind string) string {
-		id, err := dClient.Find(context.Background(), kind, 1)
+		addr, err := discovery.FindAddress(context.Background(), dClient, kind)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Could not find %s service: %v\n", kind, err)
+			fmt.Fprintf(os.Stderr, "%v\n", err)
 			os.Exit(1)
 		}
-		if len(id) == 0 {
-			fmt.Fprintf(os.Stderr, "Could not find %s service\n", kind)
-			os.Exit(1)
-		}
-		return id[0].Address
+		return addr
 	}
 
 	finderAddr := findService("finder-v1")
 	finderClient := finder.NewClient(finderAddr, nil)
 	var storageClient storage.Storage
-	storageClient = storage.NewAggregateClient(finderClient, dClient, 3, 1000)
+	storageClient = storage.NewAggregateClient(finderClient, dClient, storage.DefaultAggregateConfig())
 
 	if dryRun {
 		storageClient = storage.NewDryRunStorage()
@@ -213,11 +210,20 @@ func runUpload(globalCfg *config.InvariantConfig, args []string) {
 	if encrypt {
 		opts.EncryptAlgorithm = "aes-256-cbc"
 
-		switch keyPolicyStr {
-		case "RandomPerBlock":
+		policy, err := content.ParseKeyPolicy(keyPolicyStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		opts.KeyPolicy = policy
+
+		switch policy {
+		case content.RandomPerBlock:
 			fmt.Fprintf(os.Stderr, "Error: RandomPerBlock is unsupported for file tree uploads because it incompatible with two-pass hashing.\n")
 			os.Exit(1)
-		case "RandomAllKey":
+		case content.RandomAllKey:
+			// Every block is encrypted with the same random key, supplied to
+			// the writer so both passes of hashing agree on it
 			opts.KeyPolicy = content.SuppliedAllKey
 			k := make([]byte, 32)
 			if _, err := io.ReadFull(rand.Reader, k); err != nil {
@@ -225,28 +231,13 @@ func runUpload(globalCfg *config.InvariantConfig, args []string) {
 				os.Exit(1)
 			}
 			opts.SuppliedKey = k
-		case "Deterministic":
-			opts.KeyPolicy = content.Deterministic
-		case "SuppliedAllKey":
-			opts.KeyPolicy = content.SuppliedAllKey
-			if keyStr == "" {
-				fmt.Fprintf(os.Stderr, "Error: --key is required when --key-policy is SuppliedAllKey\n")
-				os.Exit(1)
-			}
-
-			importHex, err := hex.DecodeString(keyStr)
+		case content.SuppliedAllKey:
+			key, err := loadKey(keyStr, keyFile)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error parsing --key: %v\n", err)
+				fmt.Fprintf(os.Stderr, "Error loading key: %v\n", err)
 				os.Exit(1)
 			}
-			if len(importHex) != 32 {
-				fmt.Fprintf(os.Stderr, "Error: --key must be a 32-byte hex-encoded string (got %d bytes)\n", len(importHex))
-				os.Exit(1)
-			}
-			opts.SuppliedKey = importHex
-		default:
-			fmt.Fprintf(os.Stderr, "Error: unsupported key-policy '%s'\n", keyPolicyStr)
-			os.Exit(1)
+			opts.SuppliedKey = key
 		}
 	}
 
@@ -454,6 +445,7 @@ func (u *uploader) processDirectory(ctx context.Context, rootPath, currentPath s
 	atomic.AddUint64(&u.DirsChecked, 1)
 
 	modeStr := fmt.Sprintf("%04o", info.Mode().Perm())
+	totalSize, totalEntries := dir.Totals()
 
 	return &filetree.DirectoryEntry{
 		BaseEntry: filetree.BaseEntry{
@@ -463,8 +455,10 @@ func (u *uploader) processDirectory(ctx context.Context, rootPath, currentPath s
 			CreateTime: ctime,
 			ModifyTime: mtime,
 		},
-		Content: memLink,
-		Size:    uint64(len(data)),
+		Content:      memLink,
+		Size:         uint64(len(data)),
+		TotalSize:    totalSize,
+		TotalEntries: totalEntries,
 	}, nil
 }
 
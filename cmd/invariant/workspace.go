@@ -14,21 +14,17 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/hanwen/go-fuse/v2/fs"
-
 	"invariant/internal/config"
 	"invariant/internal/content"
 	"invariant/internal/discovery"
 	"invariant/internal/files"
 	"invariant/internal/finder"
-	"invariant/internal/fuse"
 	"invariant/internal/slots"
 	"invariant/internal/storage"
 	"invariant/internal/workspace"
@@ -101,7 +97,7 @@ func runWorkspaceCreate(globalCfg *config.InvariantConfig, args []string) {
 
 	// simple heuristic: if it's 64 chars, we assume it's a raw block address.
 	var hash string
-	if len(contentArg) == 64 {
+	if discovery.IsID(contentArg) {
 		hash = contentArg
 	} else if len(contentArg) > 0 {
 		// might be a namespace name
@@ -352,22 +348,7 @@ func runWorkspaceMount(globalCfg *config.InvariantConfig, args []string) {
 		log.Fatalf("Failed to start file system: %v", err)
 	}
 
-	rootNode := fuse.NewNode(filesrv, 1)
-
-	var uid, gid uint32
-	if currentUser, err := user.Current(); err == nil {
-		if parsedUID, err := strconv.ParseUint(currentUser.Uid, 10, 32); err == nil {
-			uid = uint32(parsedUID)
-		}
-		if parsedGID, err := strconv.ParseUint(currentUser.Gid, 10, 32); err == nil {
-			gid = uint32(parsedGID)
-		}
-	}
-
-	server, err := fs.Mount(absDir, rootNode, &fs.Options{
-		UID: uid,
-		GID: gid,
-	})
+	wait, err := mountFUSE(absDir, filesrv)
 	if err != nil {
 		log.Fatalf("Mount fail: %v\n", err)
 	}
@@ -389,7 +370,7 @@ func runWorkspaceMount(globalCfg *config.InvariantConfig, args []string) {
 		readyPipe.Close()
 	}
 
-	server.Wait()
+	wait()
 }
 
 func runWorkspaceUnmount(globalCfg *config.InvariantConfig, args []string) {
@@ -463,19 +444,16 @@ func initClients(globalCfg *config.InvariantConfig) (discovery.Discovery, finder
 	dClient := discovery.NewClient(discoveryURL, nil)
 
 	findService := func(kind string) string {
-		id, err := dClient.Find(context.Background(), kind, 1)
+		addr, err := discovery.FindAddress(context.Background(), dClient, kind)
 		if err != nil {
-			log.Fatalf("Could not find %s service: %v", kind, err)
-		}
-		if len(id) == 0 {
-			log.Fatalf("Could not find %s service", kind)
+			log.Fatalf("%v", err)
 		}
-		return id[0].Address
+		return addr
 	}
 
 	finderAddr := findService("finder-v1")
 	finderClient := finder.NewClient(finderAddr, nil)
-	storageClient := storage.NewAggregateClient(finderClient, dClient, 3, 1000)
+	storageClient := storage.NewAggregateClient(finderClient, dClient, storage.DefaultAggregateConfig())
 
 	slotsAddr := findService("slots-v1")
 	slotsClient := slots.NewClient(slotsAddr, nil)
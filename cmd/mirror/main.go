@@ -0,0 +1,159 @@
+// Package main provides a read-only mirror of the file tree held by a slot.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"invariant/internal/content"
+	"invariant/internal/discovery"
+	"invariant/internal/finder"
+	"invariant/internal/identity"
+	"invariant/internal/mirror"
+	"invariant/internal/notify"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+func main() {
+	var discoveryURL string
+	flag.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
+	var slot string
+	flag.StringVar(&slot, "slot", "", "ID or name of the slot holding the root to mirror")
+	var rootLink string
+	flag.StringVar(&rootLink, "root", "", "JSON content link of the root to mirror, used instead of -slot for roots whose directories need transforms to read")
+	var dir string
+	flag.StringVar(&dir, "dir", "", "Directory storing the mirrored blocks (in memory if not set)")
+	var interval time.Duration
+	flag.DurationVar(&interval, "interval", 30*time.Second, "How often the slot is checked for a new root")
+	var advertiseAddr string
+	flag.StringVar(&advertiseAddr, "advertise", "", "Address to advertise to the discovery service, or a comma separated list of [label=]addresses")
+	var notifyIDs string
+	flag.StringVar(&notifyIDs, "notify", "", "Comma-separated list of IDs implementing the Notify protocol, such as finders, told of the mirrored blocks")
+	var port int
+	flag.IntVar(&port, "port", 0, "Port to listen on (0 for random available port)")
+	var name string
+	flag.StringVar(&name, "name", "", "Name to register with the names service")
+	var keyPath string
+	flag.StringVar(&keyPath, "key", "", "Ed25519 private key file, created if missing, identifying the mirror. The mirror ID becomes the hash of its public key.")
+	flag.Parse()
+
+	if discoveryURL == "" {
+		log.Fatalf("Discovery URL is required")
+	}
+	dClient := discovery.NewClient(discoveryURL, nil)
+	ctx := context.Background()
+
+	var root content.ContentLink
+	switch {
+	case rootLink != "":
+		if err := json.Unmarshal([]byte(rootLink), &root); err != nil {
+			log.Fatalf("Invalid -root: %v", err)
+		}
+	case slot != "":
+		id, err := discovery.ResolveName(ctx, dClient, slot)
+		if err != nil {
+			log.Fatalf("Could not resolve slot %q: %v", slot, err)
+		}
+		root = content.ContentLink{Address: id, Slot: true}
+	default:
+		log.Fatalf("Either -slot or -root is required")
+	}
+
+	findService := func(kind string) string {
+		addr, err := discovery.FindAddress(ctx, dClient, kind)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		return addr
+	}
+	var slotsClient slots.Slots
+	if root.Slot {
+		slotsClient = slots.NewClient(findService("slots-v1"), nil)
+	}
+	var blockFinder finder.Finder
+	if addr, err := discovery.FindAddress(ctx, dClient, "finder-v1"); err == nil {
+		blockFinder = finder.NewClient(addr, nil)
+	}
+	source := storage.NewAggregateClient(blockFinder, dClient, storage.DefaultAggregateConfig())
+
+	var local storage.Storage = storage.NewInMemoryStorage()
+	if dir != "" {
+		local = storage.NewFileSystemStorage(dir)
+	}
+
+	server := storage.NewStorageServer(local)
+	id := local.(identity.Identity).ID()
+	var signingKey *identity.KeyPair
+	if keyPath != "" {
+		key, err := identity.LoadOrCreateKeyPair(keyPath)
+		if err != nil {
+			log.Fatalf("Failed to load key pair: %v", err)
+		}
+		signingKey = key
+		id = key.ID()
+		server.WithKeyPair(key)
+	}
+
+	addr := fmt.Sprintf(":%d", port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", addr, err)
+	}
+	actualPort := listener.Addr().(*net.TCPAddr).Port
+
+	if err := discovery.AdvertiseAndRegister(ctx, dClient, id, advertiseAddr, actualPort, []string{"storage-v1"}); err != nil {
+		log.Fatalf("Failed to register with discovery service: %v", err)
+	}
+	log.Printf("Registered with discovery service %s as %s", discoveryURL, id)
+	if name != "" {
+		go func() {
+			if err := discovery.RegisterName(ctx, dClient, name, id, []string{"storage-v1"}); err != nil {
+				log.Printf("Failed to register name %q: %v", name, err)
+			} else {
+				log.Printf("Registered name %q for ID %s", name, id)
+			}
+		}()
+	}
+
+	var notifyClients []storage.NotifyClient
+	for hid := range strings.SplitSeq(notifyIDs, ",") {
+		hid = strings.TrimSpace(hid)
+		if hid == "" {
+			continue
+		}
+		desc, err := discovery.ResolveWithRetry(ctx, dClient, hid, 5, 2*time.Second)
+		if err != nil {
+			log.Fatalf("Could not resolve notify name/id %s: %v", hid, err)
+		}
+		notifyClients = append(notifyClients, notify.NewClient(desc.Address, nil).WithSigningKey(signingKey))
+	}
+	if len(notifyClients) > 0 {
+		server.StartNotification(ctx, notifyClients, 10000, time.Second)
+	}
+
+	m := mirror.New(root, source, local, slotsClient)
+	go m.Run(ctx, interval)
+
+	log.Printf("Mirroring %s, listening on :%d...", root.Address, actualPort)
+	log.Fatal(http.Serve(listener, readOnly(server)))
+}
+
+// readOnly rejects requests that would store blocks, so the mirror only holds
+// the blocks of the tree it mirrors.
+func readOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "mirror is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
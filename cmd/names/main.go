@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"time"
 
+	"invariant/internal/cap"
 	"invariant/internal/discovery"
 	"invariant/internal/identity"
 	"invariant/internal/names"
@@ -20,13 +21,19 @@ func main() {
 	var discoveryURL string
 	flag.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
 	var advertiseAddr string
-	flag.StringVar(&advertiseAddr, "advertise", "", "Address to advertise to the discovery service")
+	flag.StringVar(&advertiseAddr, "advertise", "", "Address to advertise to the discovery service, or a comma separated list of [label=]addresses")
 	var port int
 	flag.IntVar(&port, "port", 0, "Port to listen on (0 for random available port)")
 	var upstreamURL string
 	flag.StringVar(&upstreamURL, "upstream", "", "Upstream name service URL to delegate queries to")
 	var snapshotInterval time.Duration
 	flag.DurationVar(&snapshotInterval, "snapshot-interval", 1*time.Hour, "Interval between snapshots for file system storage")
+	var tombstoneTTL time.Duration
+	flag.DurationVar(&tombstoneTTL, "tombstone-ttl", names.DefaultTombstoneTTL, "How long the tombstones of deleted names are kept for replicas to merge")
+	var keyPath string
+	flag.StringVar(&keyPath, "key", "", "Ed25519 private key file, created if missing, identifying the service, which proves it by answering challenges to GET /id. The service ID becomes the hash of its public key.")
+	var capKeyPath string
+	flag.StringVar(&capKeyPath, "cap-key", "", "File with the root key, created if missing, verifying capability tokens. Requests without a token allowing them are rejected.")
 	flag.Parse()
 
 	var n names.Names
@@ -36,9 +43,9 @@ func main() {
 			log.Fatalf("Failed to initialize file system names: %v", err)
 		}
 		defer fsnd.Close()
-		n = fsnd
+		n = fsnd.WithTombstoneTTL(tombstoneTTL)
 	} else {
-		n = names.NewInMemoryNames()
+		n = names.NewInMemoryNames().WithTombstoneTTL(tombstoneTTL)
 	}
 
 	if upstreamURL != "" {
@@ -48,6 +55,15 @@ func main() {
 	}
 
 	server := names.NewNamesServer(n)
+	var key *identity.KeyPair
+	if keyPath != "" {
+		var err error
+		key, err = identity.LoadOrCreateKeyPair(keyPath)
+		if err != nil {
+			log.Fatalf("Failed to load key pair: %v", err)
+		}
+		server.WithKeyPair(key)
+	}
 
 	addr := fmt.Sprintf(":%d", port)
 	listener, err := net.Listen("tcp", addr)
@@ -58,7 +74,11 @@ func main() {
 	actualPort := listener.Addr().(*net.TCPAddr).Port
 
 	if discoveryURL != "" {
+		// A service with a key pair is identified by it instead of the names ID
 		id := n.(identity.Identity).ID()
+		if key != nil {
+			id = key.ID()
+		}
 		err := discovery.AdvertiseAndRegister(context.Background(), discovery.NewClient(discoveryURL, nil), id, advertiseAddr, actualPort, []string{"names-v1"})
 		if err != nil {
 			log.Fatalf("Failed to register with discovery service: %v", err)
@@ -72,5 +92,14 @@ func main() {
 	} else {
 		log.Printf("Using In-Memory Names storage")
 	}
-	log.Fatal(http.Serve(listener, server))
+	var handler http.Handler = server
+	if capKeyPath != "" {
+		capKey, err := cap.LoadOrCreateKey(capKeyPath)
+		if err != nil {
+			log.Fatalf("Failed to load capability key: %v", err)
+		}
+		handler = cap.NewVerifier(capKey).Require(server, cap.NamesRequest)
+		log.Printf("Requiring capability tokens verified by %s", capKeyPath)
+	}
+	log.Fatal(http.Serve(listener, handler))
 }
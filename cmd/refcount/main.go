@@ -0,0 +1,115 @@
+// Package main provides the command-line utility for the reference counting service.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"invariant/internal/discovery"
+	"invariant/internal/refcount"
+)
+
+func generateID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// loadOrCreateID returns the ID saved at path, saving a new one if there is
+// none, so the service keeps its ID across restarts.
+func loadOrCreateID(path string) string {
+	if data, err := os.ReadFile(path); err == nil && len(data) == 64 {
+		return string(data)
+	}
+	id := generateID()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Fatalf("Failed to create %s: %v", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, []byte(id), 0644); err != nil {
+		log.Fatalf("Failed to save the ID: %v", err)
+	}
+	return id
+}
+
+func main() {
+	var id string
+	flag.StringVar(&id, "id", "", "ID of the refcount service (32-byte hex). Randomly generated if not provided.")
+	var discoveryURL string
+	flag.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
+	var advertiseAddr string
+	flag.StringVar(&advertiseAddr, "advertise", "", "Address to advertise to the discovery service, or a comma separated list of [label=]addresses")
+	var port int
+	flag.IntVar(&port, "port", 0, "Port to listen on (0 for random available port)")
+	var name string
+	flag.StringVar(&name, "name", "", "Name to register with the names service")
+	var dir string
+	flag.StringVar(&dir, "dir", "", "Directory where the counts are journaled so they survive a restart (in memory if not set)")
+	var snapshotInterval time.Duration
+	flag.DurationVar(&snapshotInterval, "snapshot-interval", 1*time.Hour, "Interval between snapshots of the journaled counts")
+	flag.Parse()
+
+	var refs refcount.RefCount
+	if dir != "" {
+		if id == "" {
+			id = loadOrCreateID(filepath.Join(dir, "id"))
+		}
+		fsRefs, err := refcount.NewFileSystemRefCount(id, dir, snapshotInterval)
+		if err != nil {
+			log.Fatalf("Failed to initialize file system refcount: %v", err)
+		}
+		defer fsRefs.Close()
+		refs = fsRefs
+	} else {
+		if id == "" {
+			id = generateID()
+		}
+		refs = refcount.NewMemoryRefCount(id)
+	}
+
+	addr := fmt.Sprintf(":%d", port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", addr, err)
+	}
+
+	actualPort := listener.Addr().(*net.TCPAddr).Port
+
+	var disc discovery.Discovery
+	if discoveryURL != "" {
+		disc = discovery.NewClient(discoveryURL, nil)
+
+		err := discovery.AdvertiseAndRegister(context.Background(), disc, id, advertiseAddr, actualPort, []string{"refcount-v1"})
+		if err != nil {
+			log.Fatalf("Failed to register with discovery service: %v", err)
+		}
+		log.Printf("Registered with discovery service %s as %s", discoveryURL, id)
+	}
+
+	if name != "" {
+		if disc == nil {
+			log.Fatalf("Cannot register name without a valid discovery service")
+		}
+		go func() {
+			err := discovery.RegisterName(context.Background(), disc, name, id, []string{"refcount-v1"})
+			if err != nil {
+				log.Printf("Failed to register name %q: %v", name, err)
+			} else {
+				log.Printf("Registered name %q for ID %s", name, id)
+			}
+		}()
+	}
+
+	server := refcount.NewServer(refs)
+
+	log.Printf("Refcount service (ID %s) listening on :%d...", id, actualPort)
+	log.Fatal(http.Serve(listener, server))
+}
@@ -13,9 +13,15 @@ import (
 	"strings"
 	"time"
 
+	"invariant/internal/cap"
 	"invariant/internal/discovery"
+	"invariant/internal/filetree"
+	"invariant/internal/finder"
+	"invariant/internal/identity"
 	"invariant/internal/notify"
+	"invariant/internal/refcount"
 	"invariant/internal/slots"
+	"invariant/internal/storage"
 )
 
 func generateID() string {
@@ -32,7 +38,7 @@ func main() {
 	var discoveryURL string
 	flag.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
 	var advertiseAddr string
-	flag.StringVar(&advertiseAddr, "advertise", "", "Address to advertise to the discovery service")
+	flag.StringVar(&advertiseAddr, "advertise", "", "Address to advertise to the discovery service, or a comma separated list of [label=]addresses")
 	var port int
 	flag.IntVar(&port, "port", 0, "Port to listen on (0 for random available port)")
 	var snapshotInterval time.Duration
@@ -45,8 +51,30 @@ func main() {
 	flag.DurationVar(&notifyBatchDuration, "notify-duration", 1*time.Second, "Maximum duration to wait before sending a batch of new slot notifications")
 	var name string
 	flag.StringVar(&name, "name", "", "Name to register with the names service")
+	var keyPath string
+	flag.StringVar(&keyPath, "key", "", "Ed25519 private key file, created if missing, identifying the service, which proves it by answering challenges to GET /id. The service ID becomes the hash of its public key.")
+	var capKeyPath string
+	flag.StringVar(&capKeyPath, "cap-key", "", "File with the root key, created if missing, verifying capability tokens. Requests without a token allowing them are rejected.")
+	var idFormatFlag string
+	flag.StringVar(&idFormatFlag, "id-format", string(slots.IDFormatHex), "Format required of new slot IDs: hex (32-byte hex) or any")
+	var retention time.Duration
+	flag.DurationVar(&retention, "retention", slots.DefaultRetention, "How long the previous address of an updated slot is reported as retained, for garbage collection to spare readers of the old root (0 to disable)")
+	var validateRoots string
+	flag.StringVar(&validateRoots, "validate-roots", string(slots.RootValidationNone), "Addresses accepted in slot updates: none (any address), exists (blocks in storage) or directory (blocks holding an unencrypted file tree directory). An empty address, clearing a slot, is always accepted. Requires -discovery.")
+	var refcountID string
+	flag.StringVar(&refcountID, "refcount", "", "ID or name of a refcount service told of the root of each slot created or updated, keeping its blocks from being collected. Requires -discovery.")
 	flag.Parse()
 
+	rootValidation, err := slots.ParseRootValidation(validateRoots)
+	if err != nil {
+		log.Fatalf("Invalid -validate-roots: %v", err)
+	}
+
+	idFormat, err := slots.ParseIDFormat(idFormatFlag)
+	if err != nil {
+		log.Fatalf("Invalid -id-format: %v", err)
+	}
+
 	if id == "" {
 		id = generateID()
 	}
@@ -63,6 +91,17 @@ func main() {
 		s = slots.NewMemorySlots(id)
 	}
 
+	// A service with a key pair is identified by it instead of the slots ID
+	serviceID := s.ID()
+	var key *identity.KeyPair
+	if keyPath != "" {
+		key, err = identity.LoadOrCreateKeyPair(keyPath)
+		if err != nil {
+			log.Fatalf("Failed to load key pair: %v", err)
+		}
+		serviceID = key.ID()
+	}
+
 	addr := fmt.Sprintf(":%d", port)
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -75,11 +114,11 @@ func main() {
 	if discoveryURL != "" {
 		disc = discovery.NewClient(discoveryURL, nil)
 
-		err := discovery.AdvertiseAndRegister(context.Background(), disc, s.ID(), advertiseAddr, actualPort, []string{"slots-v1"})
+		err := discovery.AdvertiseAndRegister(context.Background(), disc, serviceID, advertiseAddr, actualPort, []string{"slots-v1"})
 		if err != nil {
 			log.Fatalf("Failed to register with discovery service: %v", err)
 		}
-		log.Printf("Registered with discovery service %s as %s", discoveryURL, s.ID())
+		log.Printf("Registered with discovery service %s as %s", discoveryURL, serviceID)
 	}
 
 	if name != "" {
@@ -87,16 +126,59 @@ func main() {
 			log.Fatalf("Cannot register name without a valid discovery service")
 		}
 		go func() {
-			err := discovery.RegisterName(context.Background(), disc, name, s.ID(), []string{"slots-v1"})
+			err := discovery.RegisterName(context.Background(), disc, name, serviceID, []string{"slots-v1"})
 			if err != nil {
 				log.Printf("Failed to register name %q: %v", name, err)
 			} else {
-				log.Printf("Registered name %q for ID %s", name, s.ID())
+				log.Printf("Registered name %q for ID %s", name, serviceID)
 			}
 		}()
 	}
 
-	server := slots.NewServer(s)
+	server := slots.NewServer(s).WithIDFormat(idFormat).WithRetention(retention)
+	if key != nil {
+		server.WithKeyPair(key)
+	}
+
+	// blockStore reads the blocks of the roots slots are updated to
+	var blockStore storage.Storage
+	newBlockStore := func() storage.Storage {
+		if blockStore != nil {
+			return blockStore
+		}
+		var blockFinder finder.Finder
+		if addr, err := discovery.FindAddress(context.Background(), disc, "finder-v1"); err == nil {
+			blockFinder = finder.NewClient(addr, nil)
+		}
+		// The blocks of a root are often written just before the slot is
+		// updated, so they are looked for on every storage server when the
+		// finder does not know them yet, and a miss is not remembered
+		cfg := storage.DefaultAggregateConfig()
+		cfg.DiscoverOnMiss = true
+		cfg.MissingTTL = 0
+		blockStore = storage.NewAggregateClient(blockFinder, disc, cfg)
+		return blockStore
+	}
+
+	if rootValidation != slots.RootValidationNone {
+		if disc == nil {
+			log.Fatalf("a discovery service is required to use the -validate-roots flag")
+		}
+		server.WithRootValidator(filetree.NewRootValidator(newBlockStore(), rootValidation))
+		log.Printf("Validating slot roots: %s", rootValidation)
+	}
+
+	if refcountID != "" {
+		if disc == nil {
+			log.Fatalf("a discovery service is required to use the -refcount flag")
+		}
+		desc, err := discovery.ResolveWithRetry(context.Background(), disc, refcountID, 5, 2*time.Second)
+		if err != nil {
+			log.Fatalf("Could not resolve refcount service %s: %v", refcountID, err)
+		}
+		server.WithRootPublisher(refcount.NewTreePublisher(refcount.NewClient(desc.Address, nil), newBlockStore()))
+		log.Printf("Publishing slot roots to refcount service %s", desc.ID)
+	}
 
 	var notifyClients []slots.NotifyClient
 	if disc != nil {
@@ -106,17 +188,9 @@ func main() {
 				continue
 			}
 
-			// Resolve name to ID if it's not a hex ID
-			resolvedID, err := discovery.ResolveName(context.Background(), disc, nid)
+			desc, err := discovery.ResolveWithRetry(context.Background(), disc, nid, 5, 2*time.Second)
 			if err != nil {
 				log.Fatalf("Could not resolve notify name/id %s: %v", nid, err)
-				continue
-			}
-
-			desc, ok := disc.Get(context.Background(), resolvedID)
-			if !ok {
-				log.Fatalf("Could not find address for Notify service %s", resolvedID)
-				continue
 			}
 
 			notifyClients = append(notifyClients, notify.NewClient(desc.Address, nil))
@@ -129,12 +203,21 @@ func main() {
 		server.StartNotification(context.Background(), notifyClients, notifyBatchSize, notifyBatchDuration)
 	}
 
-	log.Printf("Slots service (ID %s) listening on :%d...", s.ID(), actualPort)
+	log.Printf("Slots service (ID %s) listening on :%d...", serviceID, actualPort)
 	if dir != "" {
 		log.Printf("Using File System Slots storage at %s", dir)
 	} else {
 		log.Printf("Using In-Memory Slots storage")
 	}
 
-	log.Fatal(http.Serve(listener, server))
+	var handler http.Handler = server
+	if capKeyPath != "" {
+		capKey, err := cap.LoadOrCreateKey(capKeyPath)
+		if err != nil {
+			log.Fatalf("Failed to load capability key: %v", err)
+		}
+		handler = cap.NewVerifier(capKey).Require(server, cap.SlotsRequest)
+		log.Printf("Requiring capability tokens verified by %s", capKeyPath)
+	}
+	log.Fatal(http.Serve(listener, handler))
 }
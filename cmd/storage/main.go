@@ -2,39 +2,42 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"invariant/internal/cap"
+	"invariant/internal/content"
 	"invariant/internal/discovery"
 	"invariant/internal/distribute"
+	"invariant/internal/filetree"
 	"invariant/internal/identity"
 	"invariant/internal/notify"
+	"invariant/internal/slots"
 	"invariant/internal/storage"
 )
 
-func resolveWithRetry(dClient *discovery.Client, name string, retries int, delay time.Duration) (string, error) {
-	var id string
-	var err error
-	for i := range retries {
-		id, err = discovery.ResolveName(context.Background(), dClient, name)
-		if err == nil {
-			return id, nil
-		}
-		if i < retries-1 {
-			time.Sleep(delay)
-		}
-	}
-	return "", err
-}
-
 func main() {
 	var dir string
-	flag.StringVar(&dir, "dir", "", "Base directory for file system storage")
+	flag.StringVar(&dir, "dir", "", "Base directory for file system storage, or a comma-separated list of directories, each optionally followed by =capacity (such as /disk1=4T,/disk2=2T), to spread blocks over by capacity")
+	var smallBlockThreshold int64
+	flag.Int64Var(&smallBlockThreshold, "small-block-threshold", storage.DefaultSmallBlockThreshold, "Blocks up to this size in bytes are buffered in memory and written directly instead of through a temporary file")
+	var durabilityStr string
+	flag.StringVar(&durabilityStr, "durability", string(storage.DurabilityNone), "How stored blocks are flushed to disk before they are acknowledged (none, data, full)")
+	var compressAtRest bool
+	flag.BoolVar(&compressAtRest, "compress-at-rest", false, "Store blocks gzip compressed on disk when that makes them smaller")
+	var memoryLimit int64
+	flag.Int64Var(&memoryLimit, "memory-limit", 0, "Maximum bytes held by in-memory storage (0 for unlimited)")
+	var spill bool
+	flag.BoolVar(&spill, "spill", false, "Spill blocks beyond -memory-limit to a temporary directory instead of rejecting them")
 	var s3Bucket string
 	flag.StringVar(&s3Bucket, "s3-bucket", "", "AWS S3 bucket name for storage")
 	var s3Prefix string
@@ -42,7 +45,7 @@ func main() {
 	var discoveryURL string
 	flag.StringVar(&discoveryURL, "discovery", "", "URL of the discovery service")
 	var advertiseAddr string
-	flag.StringVar(&advertiseAddr, "advertise", "", "Address to advertise to the discovery service")
+	flag.StringVar(&advertiseAddr, "advertise", "", "Address to advertise to the discovery service, or a comma separated list of [label=]addresses")
 	var distributeArg string
 	flag.StringVar(&distributeArg, "distribute", "", "ID or Name of the distribute service to register with")
 	var notifyIDs string
@@ -55,6 +58,24 @@ func main() {
 	flag.IntVar(&port, "port", 0, "Port to listen on (0 for random available port)")
 	var name string
 	flag.StringVar(&name, "name", "", "Name to register with the names service")
+	var keyPath string
+	flag.StringVar(&keyPath, "key", "", "Ed25519 private key file, created if missing, identifying the service and signing its block notifications. The service ID becomes the hash of its public key.")
+	var peerRate float64
+	flag.Float64Var(&peerRate, "peer-rate", 0, "Maximum bandwidth in MB/s served to and received from each peer (0 for unlimited)")
+	var backgroundLimit int
+	flag.IntVar(&backgroundLimit, "background-transfers", storage.DefaultBackgroundLimit, "Maximum number of background transfers, such as repairs, served at a time (0 for unlimited)")
+	var transferCompression bool
+	flag.BoolVar(&transferCompression, "transfer-compression", true, "Compress compressible blocks in transit for clients that accept gzip; disable for stores holding only encrypted blocks")
+	var exchangeInterval time.Duration
+	flag.DurationVar(&exchangeInterval, "exchange-interval", 30*time.Second, "How often the want lists of peers are read to push them wanted blocks (0 to disable)")
+	var maxBlockSize int64
+	flag.Int64Var(&maxBlockSize, "max-block-size", storage.DefaultMaxBlockSize, "Largest block in bytes, once decompressed, that is accepted (0 for unlimited)")
+	var collect bool
+	flag.BoolVar(&collect, "enable-collect", false, "Serve POST /collect, removing the blocks no listed root reaches; pair with -cap-key so only holders of a write token can collect")
+	var collectGrace time.Duration
+	flag.DurationVar(&collectGrace, "collect-grace", storage.DefaultCollectGrace, "How recently a block must have been stored for garbage collection to keep it although no root reaches it, sparing trees whose roots are not yet published")
+	var capKeyPath string
+	flag.StringVar(&capKeyPath, "cap-key", "", "File with the root key, created if missing, verifying capability tokens. Requests without a token allowing them are rejected.")
 	flag.Parse()
 
 	var s storage.Storage
@@ -65,12 +86,68 @@ func main() {
 			log.Fatalf("Failed to initialize S3 storage: %v", err)
 		}
 	} else if dir != "" {
-		s = storage.NewFileSystemStorage(dir)
+		durability, err := storage.ParseDurability(durabilityStr)
+		if err != nil {
+			log.Fatalf("Invalid -durability: %v", err)
+		}
+		paths, capacities, err := parseDirectories(dir)
+		if err != nil {
+			log.Fatalf("Invalid -dir: %v", err)
+		}
+		var dirs []*storage.FileSystemStorage
+		for _, path := range paths {
+			dirs = append(dirs, storage.NewFileSystemStorage(path).
+				WithSmallBlockThreshold(smallBlockThreshold).
+				WithDurability(durability).
+				WithCompression(compressAtRest))
+		}
+		if len(dirs) == 1 && capacities[0] == 0 {
+			s = dirs[0]
+		} else {
+			s = storage.NewMultiDirectoryStorage(dirs, capacities)
+		}
 	} else {
-		s = storage.NewInMemoryStorage()
+		mem := storage.NewInMemoryStorage()
+		if memoryLimit > 0 {
+			var spillStorage storage.ControlledStorage
+			if spill {
+				spillDir, err := os.MkdirTemp("", "invariant-spill-*")
+				if err != nil {
+					log.Fatalf("Failed to create spill directory: %v", err)
+				}
+				defer os.RemoveAll(spillDir)
+				spillStorage = storage.NewFileSystemStorage(spillDir)
+				log.Printf("Spilling blocks beyond %d bytes to %s", memoryLimit, spillDir)
+			}
+			mem.WithMemoryLimit(memoryLimit, spillStorage)
+		}
+		s = mem
 	}
 
+	// A service with a key pair is identified by it instead of the storage ID
 	server := storage.NewStorageServer(s)
+	if peerRate > 0 {
+		server.WithBandwidthLimit(int64(peerRate * 1024 * 1024))
+	}
+	server.WithBackgroundLimit(backgroundLimit)
+	server.WithTransferCompression(transferCompression)
+	server.WithMaxBlockSize(maxBlockSize)
+	server.WithCollect(collect)
+	server.WithCollectGrace(collectGrace)
+	id := s.(identity.Identity).ID()
+	var signingKey *identity.KeyPair
+	if keyPath != "" {
+		key, err := identity.LoadOrCreateKeyPair(keyPath)
+		if err != nil {
+			log.Fatalf("Failed to load key pair: %v", err)
+		}
+		signingKey = key
+		id = key.ID()
+		server.WithKeyPair(key)
+	}
+	newNotifyClient := func(address string) *notify.Client {
+		return notify.NewClient(address, nil).WithSigningKey(signingKey)
+	}
 
 	addr := fmt.Sprintf(":%d", port)
 	listener, err := net.Listen("tcp", addr)
@@ -82,16 +159,24 @@ func main() {
 
 	var dClient *discovery.Client
 	if discoveryURL != "" {
-		id := s.(identity.Identity).ID()
 		dClient = discovery.NewClient(discoveryURL, nil)
 
 		// Configure the storage server to use discovery for fetching
-		server.WithDiscovery(dClient)
+		server.WithDiscovery(dClient).WithClosureWalker(walkTree)
+		server.WithRetainedRoots(func(ctx context.Context) ([]json.RawMessage, error) {
+			return retainedRoots(ctx, dClient)
+		})
 
-		err := discovery.AdvertiseAndRegister(context.Background(), dClient, id, advertiseAddr, actualPort, []string{"storage-v1"})
+		reg, err := discovery.AdvertiseRegistration(id, advertiseAddr, actualPort, []string{"storage-v1"})
 		if err != nil {
 			log.Fatalf("Failed to register with discovery service: %v", err)
 		}
+		if c, ok := s.(interface{ Capacity() int64 }); ok {
+			reg.Metadata = map[string]string{discovery.MetadataCapacity: strconv.FormatInt(c.Capacity(), 10)}
+		}
+		if err := discovery.KeepRegistered(context.Background(), dClient, reg); err != nil {
+			log.Fatalf("Failed to register with discovery service: %v", err)
+		}
 		log.Printf("Registered with discovery service %s as %s", discoveryURL, id)
 
 		if name != "" {
@@ -116,49 +201,37 @@ func main() {
 				continue
 			}
 
-			hid, err = resolveWithRetry(dClient, hid, 5, 2*time.Second)
+			desc, err := discovery.ResolveWithRetry(context.Background(), dClient, hid, 5, 2*time.Second)
 			if err != nil {
 				log.Fatalf("Could not resolve notify name/id %s: %v", hid, err)
-				continue
 			}
 
-			desc, ok := dClient.Get(context.Background(), hid)
-			if !ok {
-				log.Fatalf("Could not find address for Notify service ID %s", hid)
-				continue
-			}
-
-			notifyClients = append(notifyClients, notify.NewClient(desc.Address, nil))
+			notifyClients = append(notifyClients, newNotifyClient(desc.Address))
 		}
 	}
 
 	if distributeArg != "" {
-		if discoveryURL == "" {
+		if dClient == nil {
 			log.Fatalf("Discovery service is required to use the -distribute flag")
 		}
 
-		dClient := discovery.NewClient(discoveryURL, nil)
-		var distID string
-
-		// If it's a 64-character hex string, it's an ID. Otherwise, resolve it via names service.
-		distID, err = resolveWithRetry(dClient, distributeArg, 5, 2*time.Second)
+		desc, err := discovery.ResolveWithRetry(context.Background(), dClient, distributeArg, 5, 2*time.Second)
 		if err != nil {
-			log.Fatalf("Warning: Could not resolve distribute name %v", err)
-		}
-
-		desc, ok := dClient.Get(context.Background(), distID)
-		if !ok {
-			log.Fatalf("Could not find distribute service %s in discovery", distID)
+			log.Fatalf("Could not resolve distribute service %s: %v", distributeArg, err)
 		}
+		distID := desc.ID
 
 		distClient := distribute.NewClient(desc.Address, nil)
-		id := s.(identity.Identity).ID()
 		if err := distClient.Register(id); err != nil {
 			log.Fatalf("Failed to register with distribute service %s: %v", distID, err)
 		}
 		log.Printf("Registered with distribute service %s at %s", distID, desc.Address)
 
-		notifyClients = append(notifyClients, notify.NewClient(desc.Address, nil))
+		notifyClients = append(notifyClients, newNotifyClient(desc.Address))
+	}
+
+	if dClient != nil && exchangeInterval > 0 {
+		server.StartExchange(context.Background(), exchangeInterval)
 	}
 
 	if len(notifyClients) > 0 {
@@ -173,5 +246,96 @@ func main() {
 	} else {
 		log.Printf("Using In-Memory storage")
 	}
-	log.Fatal(http.Serve(listener, server))
+	var handler http.Handler = server
+	if capKeyPath != "" {
+		capKey, err := cap.LoadOrCreateKey(capKeyPath)
+		if err != nil {
+			log.Fatalf("Failed to load capability key: %v", err)
+		}
+		handler = cap.NewVerifier(capKey).Require(server, cap.StorageRequest)
+		log.Printf("Requiring capability tokens verified by %s", capKeyPath)
+	}
+	log.Fatal(http.Serve(listener, handler))
+}
+
+// parseDirectories parses the -dir flag into directories and their
+// capacities, 0 where not given.
+func parseDirectories(spec string) ([]string, []int64, error) {
+	var paths []string
+	var capacities []int64
+	for entry := range strings.SplitSeq(spec, ",") {
+		path, size, hasSize := strings.Cut(strings.TrimSpace(entry), "=")
+		if path == "" {
+			continue
+		}
+		var capacity int64
+		if hasSize {
+			var err error
+			if capacity, err = parseSize(size); err != nil {
+				return nil, nil, fmt.Errorf("capacity of %s: %w", path, err)
+			}
+		}
+		paths = append(paths, path)
+		capacities = append(capacities, capacity)
+	}
+	if len(paths) == 0 {
+		return nil, nil, fmt.Errorf("no directories in %q", spec)
+	}
+	return paths, capacities, nil
+}
+
+// parseSize parses a byte count with an optional K, M, G or T (binary)
+// suffix.
+func parseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(size), "B"))
+	multiplier := int64(1)
+	if n := len(size); n > 0 {
+		if shift := strings.IndexByte("KMGT", size[n-1]); shift >= 0 {
+			multiplier = 1 << (10 * (shift + 1))
+			size = size[:n-1]
+		}
+	}
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// walkTree calls fn with every block of the file tree at root for closure
+// fetches. Roots held by slots must be resolved by the caller.
+func walkTree(ctx context.Context, root json.RawMessage, store storage.Storage, fn func(address string) error) error {
+	var link content.ContentLink
+	if err := json.Unmarshal(root, &link); err != nil {
+		return fmt.Errorf("invalid root: %w", err)
+	}
+	return filetree.WalkBlocks(ctx, link, store, nil, fn)
+}
+
+// retainedRoots returns the previous roots retained by every slots server
+// in discovery, as content links, so a collection keeps the blocks of trees
+// that readers may still be reading.
+func retainedRoots(ctx context.Context, d discovery.Discovery) ([]json.RawMessage, error) {
+	services, err := d.Find(ctx, "slots-v1", 0)
+	if err != nil {
+		return nil, err
+	}
+	var roots []json.RawMessage
+	for _, service := range services {
+		retained, err := slots.NewClient(service.Address, nil).Retained(ctx, "")
+		if errors.Is(err, slots.ErrNotRetained) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("slots service %s: %w", service.ID, err)
+		}
+		for _, r := range retained {
+			data, err := json.Marshal(content.ContentLink{Address: r.Address})
+			if err != nil {
+				return nil, err
+			}
+			roots = append(roots, data)
+		}
+	}
+	return roots, nil
 }
@@ -0,0 +1,50 @@
+package blockimport
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+)
+
+// ArchiveSource reads the blocks of an archive written by
+// filetree.WriteArchive.
+type ArchiveSource struct {
+	path string
+	root content.ContentLink
+}
+
+// NewArchiveSource returns a source of the blocks of the archive at path,
+// each verified against its sha256 address.
+func NewArchiveSource(path string) *ArchiveSource {
+	return &ArchiveSource{path: path}
+}
+
+// Root returns the root link of the archive, once its blocks were read.
+func (s *ArchiveSource) Root() content.ContentLink {
+	return s.root
+}
+
+func (s *ArchiveSource) Blocks(ctx context.Context, fn func(Block, error) error) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	root, err := filetree.ReadArchive(f, func(address string, data []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != address {
+			return fn(Block{Key: address}, fmt.Errorf("%w: %s", ErrHashMismatch, address))
+		}
+		return fn(Block{Key: address, Data: data, Verified: true}, nil)
+	})
+	s.root = root
+	return err
+}
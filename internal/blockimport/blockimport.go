@@ -0,0 +1,86 @@
+// Package blockimport copies the blocks of other content-addressed stores,
+// such as a git object store or an IPFS blockstore, into invariant storage
+// under their sha256 addresses.
+package blockimport
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"invariant/internal/storage"
+)
+
+// ErrHashMismatch is reported for a block whose content does not match the
+// hash it is stored under in the source.
+var ErrHashMismatch = errors.New("block does not match its key")
+
+// Block is a block read from a source store.
+type Block struct {
+	Key  string // the name of the block in the source
+	Data []byte
+	// Verified is set when Key was checked to be a hash of Data. Blocks of a
+	// source without hashes, or with an unsupported hash function, are not
+	// verified.
+	Verified bool
+}
+
+// Source reads the blocks of a store.
+type Source interface {
+	// Blocks calls fn with each block, or with ErrHashMismatch and the key
+	// of a block that failed verification. Blocks stops at the first error
+	// returned by fn.
+	Blocks(ctx context.Context, fn func(Block, error) error) error
+}
+
+// Stats counts the blocks of an import.
+type Stats struct {
+	Imported   int   // blocks stored
+	Existing   int   // blocks the storage already had
+	Unverified int   // blocks imported without verifying their key
+	Mismatched int   // blocks skipped because they did not match their key
+	Bytes      int64 // bytes stored
+}
+
+// Import stores the blocks of src in store, re-hashed into sha256 addresses.
+// The address of each block imported or already present is passed to fn, if
+// not nil, to record it in a manifest or pin it.
+func Import(ctx context.Context, src Source, store storage.Storage, fn func(address string) error) (Stats, error) {
+	var stats Stats
+	err := src.Blocks(ctx, func(b Block, err error) error {
+		if errors.Is(err, ErrHashMismatch) {
+			stats.Mismatched++
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(b.Data)
+		address := hex.EncodeToString(sum[:])
+		if store.Has(ctx, address) {
+			stats.Existing++
+		} else {
+			ok, err := store.StoreAt(ctx, address, bytes.NewReader(b.Data))
+			if err != nil {
+				return fmt.Errorf("failed to store %s: %w", b.Key, err)
+			}
+			if !ok {
+				return fmt.Errorf("failed to store %s", b.Key)
+			}
+			stats.Imported++
+			stats.Bytes += int64(len(b.Data))
+		}
+		if !b.Verified {
+			stats.Unverified++
+		}
+		if fn != nil {
+			return fn(address)
+		}
+		return nil
+	})
+	return stats, err
+}
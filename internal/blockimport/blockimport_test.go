@@ -0,0 +1,94 @@
+package blockimport
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"invariant/internal/storage"
+)
+
+func TestImportDirectory(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "ab"), 0755)
+	os.WriteFile(filepath.Join(dir, "ab", "one"), []byte("one"), 0644)
+	os.WriteFile(filepath.Join(dir, "two"), []byte("two"), 0644)
+
+	store := storage.NewInMemoryStorage()
+	store.Store(ctx, strings.NewReader("two"))
+	var manifest []string
+	stats, err := Import(ctx, NewDirectorySource(dir), store, func(address string) error {
+		manifest = append(manifest, address)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if stats.Imported != 1 || stats.Existing != 1 || stats.Unverified != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if len(manifest) != 2 {
+		t.Errorf("expected 2 addresses in the manifest, got %v", manifest)
+	}
+}
+
+func TestImportIPFS(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	writeBlock := func(data, hashed string) {
+		sum := sha256.Sum256([]byte(hashed))
+		key := encoding.EncodeToString(append([]byte{multihashSHA256, sha256.Size}, sum[:]...))
+		shard := filepath.Join(dir, key[len(key)-3:len(key)-1])
+		os.MkdirAll(shard, 0755)
+		os.WriteFile(filepath.Join(shard, key+".data"), []byte(data), 0644)
+	}
+	writeBlock("good block", "good block")
+	writeBlock("corrupted block", "original block")
+
+	store := storage.NewInMemoryStorage()
+	stats, err := Import(ctx, NewIPFSSource(dir), store, nil)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if stats.Imported != 1 || stats.Mismatched != 1 || stats.Unverified != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestImportGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	ctx := context.Background()
+	repo := t.TempDir()
+	cmd := exec.Command("git", "init", "-q", repo)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git init failed: %v: %s", err, out)
+	}
+	cmd = exec.Command("git", "-C", repo, "hash-object", "-w", "--stdin")
+	cmd.Stdin = strings.NewReader("git content")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git hash-object failed: %v: %s", err, out)
+	}
+
+	store := storage.NewInMemoryStorage()
+	stats, err := Import(ctx, NewGitSource(repo), store, nil)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if stats.Imported != 1 || stats.Unverified != 0 || stats.Mismatched != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	sum := sha256.Sum256([]byte("git content"))
+	if _, ok := store.Size(ctx, hex.EncodeToString(sum[:])); !ok {
+		t.Errorf("the object content was not stored under its sha256 address")
+	}
+}
@@ -0,0 +1,41 @@
+package blockimport
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+type directorySource struct {
+	dir string
+}
+
+// NewDirectorySource returns a source of the regular files below dir, each a
+// block keyed by its path relative to dir. The blocks are not verified.
+func NewDirectorySource(dir string) Source {
+	return &directorySource{dir: dir}
+}
+
+func (s *directorySource) Blocks(ctx context.Context, fn func(Block, error) error) error {
+	return filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		key, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		return fn(Block{Key: filepath.ToSlash(key), Data: data}, nil)
+	})
+}
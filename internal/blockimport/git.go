@@ -0,0 +1,94 @@
+package blockimport
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+type gitSource struct {
+	repo string
+}
+
+// NewGitSource returns a source of every object of the git repository at
+// repo, loose or packed, read with git cat-file. Each block is the content of
+// an object, without its git header, verified against the object ID.
+func NewGitSource(repo string) Source {
+	return &gitSource{repo: repo}
+}
+
+func (s *gitSource) Blocks(ctx context.Context, fn func(Block, error) error) error {
+	cmd := exec.CommandContext(ctx, "git", "-C", s.repo, "cat-file", "--batch-all-objects", "--batch")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run git: %w", err)
+	}
+
+	err = readGitObjects(bufio.NewReader(out), fn)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("git cat-file failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// readGitObjects reads the output of git cat-file --batch: a header line of
+// "<id> <type> <size>" followed by the content and a newline for each object.
+func readGitObjects(r *bufio.Reader, fn func(Block, error) error) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("unexpected git object header %q", strings.TrimSpace(line))
+		}
+		id, kind := fields[0], fields[1]
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("unexpected git object header %q", strings.TrimSpace(line))
+		}
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		data = data[:size]
+
+		// The ID is the hash of the object with its header
+		var h hash.Hash = sha1.New()
+		if len(id) == 2*sha256.Size {
+			h = sha256.New()
+		}
+		fmt.Fprintf(h, "%s %d\x00", kind, size)
+		h.Write(data)
+		if hex.EncodeToString(h.Sum(nil)) != id {
+			err = fn(Block{Key: id}, ErrHashMismatch)
+		} else {
+			err = fn(Block{Key: id, Data: data, Verified: true}, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
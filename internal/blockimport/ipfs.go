@@ -0,0 +1,102 @@
+package blockimport
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Multihash function codes of the hashes that can be verified
+const (
+	multihashSHA1   = 0x11
+	multihashSHA256 = 0x12
+	multihashSHA512 = 0x13
+)
+
+type ipfsSource struct {
+	dir string
+}
+
+// NewIPFSSource returns a source of the blocks of the IPFS flatfs blockstore
+// at dir, typically the blocks directory of an IPFS repository. Each block is
+// a .data file named by the base32 encoded multihash, or CID, of the block.
+// Blocks hashed with SHA-1, SHA-256 or SHA-512 are verified.
+func NewIPFSSource(dir string) Source {
+	return &ipfsSource{dir: dir}
+}
+
+func (s *ipfsSource) Blocks(ctx context.Context, fn func(Block, error) error) error {
+	return filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key, ok := strings.CutSuffix(entry.Name(), ".data")
+		if !ok || !entry.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		verified, ok := verifyMultihash(key, data)
+		if !ok {
+			return fn(Block{Key: key}, ErrHashMismatch)
+		}
+		return fn(Block{Key: key, Data: data, Verified: verified}, nil)
+	})
+}
+
+// verifyMultihash checks data against the multihash in key. It reports
+// whether the hash was checked and, if so, whether it matched.
+func verifyMultihash(key string, data []byte) (verified bool, ok bool) {
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(key)
+	if err != nil {
+		return false, true
+	}
+	// A CIDv1 prefixes the multihash with its version and codec
+	if len(raw) > 0 && raw[0] == 1 {
+		raw = raw[1:]
+		_, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return false, true
+		}
+		raw = raw[n:]
+	}
+	code, n := binary.Uvarint(raw)
+	if n <= 0 {
+		return false, true
+	}
+	raw = raw[n:]
+	length, n := binary.Uvarint(raw)
+	if n <= 0 || uint64(len(raw[n:])) != length {
+		return false, true
+	}
+	digest := raw[n:]
+
+	var sum []byte
+	switch code {
+	case multihashSHA1:
+		s := sha1.Sum(data)
+		sum = s[:]
+	case multihashSHA256:
+		s := sha256.Sum256(data)
+		sum = s[:]
+	case multihashSHA512:
+		s := sha512.Sum512(data)
+		sum = s[:]
+	default:
+		return false, true
+	}
+	return true, bytes.Equal(sum, digest)
+}
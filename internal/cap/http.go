@@ -0,0 +1,254 @@
+package cap
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Header is the HTTP request header carrying an encoded token.
+const Header = "Capability"
+
+// QueryParam is the query parameter carrying an encoded token in requests
+// without a Header, such as those of a link shared with a browser.
+const QueryParam = "token"
+
+// Classifier describes the request r for verification. It returns false for
+// requests that need no capability, such as GET /id.
+type Classifier func(r *http.Request) (Request, bool)
+
+type storeLimitKey struct{}
+
+type tokenIDKey struct{}
+
+// TokenID returns the ID of the token that allowed a request passed by
+// Require, and false if the request carried none. The ID is shared by the
+// tokens attenuated from the same issued token, so it names whoever the
+// token was issued to.
+func TokenID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(tokenIDKey{}).(string)
+	return id, ok
+}
+
+// StoreLimit returns the size of the largest block the token of a request
+// passed by Require allows it to store, and false if it is not limited. The
+// max-bytes caveat is checked against the Content-Length of a request, which
+// is the encoded size of a compressed body, so the service storing it must
+// check the decoded size against the limit.
+func StoreLimit(ctx context.Context) (int64, bool) {
+	limit, ok := ctx.Value(storeLimitKey{}).(int64)
+	return limit, ok
+}
+
+// Require returns a handler that serves requests with next only if they carry
+// a token, in the Header or else the QueryParam, allowing them, as described
+// by classify. Requests without a valid token are rejected with 401
+// Unauthorized, and those the token does not allow with 403 Forbidden. The
+// ID of the token and the block size limit of the token of a store request
+// are passed to next, see TokenID and StoreLimit.
+func (v *Verifier) Require(next http.Handler, classify Classifier) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, ok := classify(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		err := ErrMissingToken
+		encoded := r.Header.Get(Header)
+		if encoded == "" {
+			encoded = r.URL.Query().Get(QueryParam)
+		}
+		if encoded != "" {
+			var t *Token
+			if t, err = Decode(encoded); err == nil {
+				if err = v.Verify(t, req); err == nil {
+					ctx := context.WithValue(r.Context(), tokenIDKey{}, t.ID)
+					if limit, ok := t.StoreLimit(); ok && req.Op == OpStore {
+						ctx = context.WithValue(ctx, storeLimitKey{}, limit)
+					}
+					r = r.WithContext(ctx)
+				}
+			}
+		}
+		if errors.Is(err, ErrDenied) {
+			http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Transport is an http.RoundTripper adding a token to each request, so that
+// the clients of the services can be given one with an http.Client.
+type Transport struct {
+	Token *Token
+	// Base is the transport making the requests, http.DefaultTransport if nil
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set(Header, t.Token.Encode())
+	return base.RoundTrip(r)
+}
+
+// StorageRequest classifies requests to the storage protocol. Blocks are the
+// resources; reading one requires read, storing one store, and removing one
+// write.
+func StorageRequest(r *http.Request) (Request, bool) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == "id" {
+		return Request{}, false
+	}
+	switch {
+	case path == "subscribe":
+		return Request{Op: OpRead}, true
+	case path == "" || path == "fetch":
+		return Request{Op: OpStore, Bytes: r.ContentLength}, true
+	case path == "collect":
+		// A collection may remove any block, so it is not limited to a resource
+		return Request{Op: OpWrite}, true
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return Request{Op: OpRead, Resource: path}, true
+	case r.Method == http.MethodPut:
+		return Request{Op: OpStore, Resource: path, Bytes: r.ContentLength}, true
+	}
+	return Request{Op: OpWrite, Resource: path}, true
+}
+
+// SlotsRequest classifies requests to the slots protocol. Slots are the
+// resources; reading one requires read, and creating or updating one write.
+func SlotsRequest(r *http.Request) (Request, bool) {
+	id := strings.TrimPrefix(r.URL.Path, "/")
+	if id == "id" {
+		return Request{}, false
+	}
+	if id == "retained" {
+		// Listing the retained addresses of every slot is not limited to a resource
+		return Request{Op: OpRead, Resource: r.URL.Query().Get("slot")}, true
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return Request{Op: OpRead, Resource: id}, true
+	}
+	return Request{Op: OpWrite, Resource: id}, true
+}
+
+// FilesRequest returns a classifier of requests to the files protocol for a
+// file system rooted at the slot root. The root is the resource; reading
+// requires read and every change write. Reads of /shared/{path} are given
+// the Path they read. If root is empty the root is taken from the
+// /fs/{slot}/ prefix of the path, as served by a multi-root host.
+func FilesRequest(root string) Classifier {
+	return func(r *http.Request) (Request, bool) {
+		resource := root
+		rest := r.URL.Path
+		if resource == "" {
+			var ok bool
+			rest, ok = strings.CutPrefix(r.URL.Path, "/fs/")
+			if !ok {
+				// Nothing else is served, so only a token unrestricted
+				// to resources is allowed anything outside /fs/
+				return Request{Op: OpWrite}, true
+			}
+			resource, rest, _ = strings.Cut(rest, "/")
+			rest = "/" + rest
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			req := Request{Op: OpRead, Resource: resource}
+			if shared, ok := strings.CutPrefix(rest, "/shared/"); ok {
+				req.Path = path.Clean("/" + shared)
+			}
+			return req, true
+		}
+		return Request{Op: OpWrite, Resource: resource}, true
+	}
+}
+
+// NamesRequest classifies requests to the names protocol. Names are the
+// resources; reading one requires read, and setting or deleting one write.
+// Requests not addressed to a single name, such as lookups by ID, exports
+// and bulk loads, are not limited to a resource.
+func NamesRequest(r *http.Request) (Request, bool) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case name == "id":
+		return Request{}, false
+	case name == "":
+		// Getting many names at once
+		return Request{Op: OpRead}, true
+	case name == "export" || strings.HasPrefix(name, "lookup/"):
+		return Request{Op: OpRead}, true
+	case name == "bulk" || name == "merge":
+		return Request{Op: OpWrite}, true
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return Request{Op: OpRead, Resource: name}, true
+	}
+	return Request{Op: OpWrite, Resource: name}, true
+}
+
+// DistributeRequest classifies requests to the distribute protocol. Reading
+// its state requires read; registering, notifying and configuring it write.
+// Blocks, for their locations and policies, and storage services, for their
+// registration, are the resources.
+func DistributeRequest(r *http.Request) (Request, bool) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == "id" {
+		return Request{}, false
+	}
+	var resource string
+	kind, rest, _ := strings.Cut(path, "/")
+	switch kind {
+	case "register", "notify", "forget", "decommission", "blocks", "policy":
+		resource = rest
+	case "nodes":
+		resource, _, _ = strings.Cut(rest, "/")
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return Request{Op: OpRead, Resource: resource}, true
+	}
+	return Request{Op: OpWrite, Resource: resource}, true
+}
+
+// FinderRequest classifies requests to the finder protocol. Finding a block
+// requires read, with the block as the resource, and notifications of blocks
+// and peers write, with the notifying service as the resource.
+func FinderRequest(r *http.Request) (Request, bool) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == "id" {
+		return Request{}, false
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		if path == "stats" || path == "routing" {
+			path = ""
+		}
+		return Request{Op: OpRead, Resource: path}, true
+	}
+	_, id, _ := strings.Cut(path, "/")
+	return Request{Op: OpWrite, Resource: id}, true
+}
+
+// DiscoveryRequest classifies requests to the discovery protocol. Services
+// are the resources; finding them requires read, and registering or renewing
+// one write.
+func DiscoveryRequest(r *http.Request) (Request, bool) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == "id" {
+		return Request{}, false
+	}
+	id, _, _ := strings.Cut(path, "/")
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return Request{Op: OpRead, Resource: id}, true
+	}
+	return Request{Op: OpWrite, Resource: id}, true
+}
@@ -0,0 +1,245 @@
+// Package cap issues and verifies capability tokens granting delegated,
+// attenuable access to invariant services.
+//
+// Tokens are macaroon-style: a token is an ID and a list of caveats chained
+// with HMAC-SHA256 under a root key held by the services that verify them.
+// Anyone holding a token can attenuate it by appending caveats, which only
+// narrow what it grants, but no caveat can be removed without the root key.
+package cap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeySize is the size of the root key in bytes.
+const KeySize = 32
+
+// Operations granted by the op caveat.
+const (
+	OpRead  = "read"  // read blocks, slots, or files
+	OpWrite = "write" // update slots or files, or remove blocks
+	OpStore = "store" // store blocks
+)
+
+var (
+	// ErrMissingToken is returned when a request has no capability token.
+	ErrMissingToken = errors.New("missing capability token")
+	// ErrInvalidToken is returned for tokens that cannot be decoded or were
+	// not issued with the root key.
+	ErrInvalidToken = errors.New("invalid capability token")
+	// ErrDenied is returned when a caveat of a token does not allow a request.
+	ErrDenied = errors.New("capability denied")
+)
+
+// Token is a capability token. Each caveat is a condition of the form
+// name=value that every request made with the token must satisfy.
+type Token struct {
+	ID        string   `json:"id"`
+	Caveats   []string `json:"caveats,omitempty"`
+	Signature []byte   `json:"signature"`
+}
+
+// AllowOps is a caveat limiting a token to the operations ops.
+func AllowOps(ops ...string) string {
+	return "op=" + strings.Join(ops, ",")
+}
+
+// ForResources is a caveat limiting a token to the resources ids, such as the
+// slot ID of a file system root, a slot ID, or a block address.
+func ForResources(ids ...string) string {
+	return "resource=" + strings.Join(ids, ",")
+}
+
+// UnderPath is a caveat limiting a token to the files at or beneath the
+// slash separated path p of a file system, such as a shared directory.
+func UnderPath(p string) string {
+	return "path=" + path.Clean("/"+p)
+}
+
+// MaxBytes is a caveat limiting the blocks stored with a token to n bytes each.
+func MaxBytes(n int64) string {
+	return "max-bytes=" + strconv.FormatInt(n, 10)
+}
+
+// StoreLimit returns the size of the largest block the max-bytes caveats of t
+// allow storing, and false if it has none.
+func (t *Token) StoreLimit() (int64, bool) {
+	limit, found := int64(0), false
+	for _, caveat := range t.Caveats {
+		value, ok := strings.CutPrefix(caveat, "max-bytes=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		if !found || n < limit {
+			limit, found = n, true
+		}
+	}
+	return limit, found
+}
+
+// ExpiresAt is a caveat limiting a token to requests made before t.
+func ExpiresAt(t time.Time) string {
+	return "expires=" + t.UTC().Format(time.RFC3339)
+}
+
+// Attenuate returns a copy of t restricted by the additional caveats.
+func (t *Token) Attenuate(caveats ...string) *Token {
+	result := &Token{
+		ID:        t.ID,
+		Caveats:   slices.Clone(t.Caveats),
+		Signature: t.Signature,
+	}
+	for _, caveat := range caveats {
+		result.Caveats = append(result.Caveats, caveat)
+		result.Signature = chain(result.Signature, caveat)
+	}
+	return result
+}
+
+// Encode returns the token as a URL safe string.
+func (t *Token) Encode() string {
+	data, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decode parses a token returned by Encode.
+func Decode(s string) (*Token, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var t Token
+	if err := json.Unmarshal(data, &t); err != nil || t.ID == "" {
+		return nil, ErrInvalidToken
+	}
+	return &t, nil
+}
+
+func chain(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Request describes what a request made with a token does.
+type Request struct {
+	Op       string
+	Resource string
+	// Bytes is the size of the block stored, or -1 if it is not known
+	Bytes int64
+	// Path is the cleaned path of the file read within the resource, or
+	// empty if the request is not addressed by path
+	Path string
+}
+
+// Verifier issues tokens and verifies them with a root key.
+type Verifier struct {
+	key []byte
+	now func() time.Time
+}
+
+// NewVerifier returns a verifier for tokens issued with key.
+func NewVerifier(key []byte) *Verifier {
+	return &Verifier{key: key, now: time.Now}
+}
+
+// LoadOrCreateKey reads the root key stored at path, generating and saving a
+// new key, readable only by the owner, if the file does not exist.
+func LoadOrCreateKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("%s is not a %d-byte hex encoded key", path, KeySize)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key)), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Issue returns a new token restricted by caveats. A token without caveats
+// grants every operation on every resource.
+func (v *Verifier) Issue(caveats ...string) *Token {
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+	id := hex.EncodeToString(idBytes)
+
+	root := &Token{ID: id, Signature: chain(v.key, id)}
+	return root.Attenuate(caveats...)
+}
+
+// Verify checks that t was issued with the root key of v and that each of its
+// caveats allows req.
+func (v *Verifier) Verify(t *Token, req Request) error {
+	signature := chain(v.key, t.ID)
+	for _, caveat := range t.Caveats {
+		signature = chain(signature, caveat)
+	}
+	if !hmac.Equal(signature, t.Signature) {
+		return ErrInvalidToken
+	}
+
+	for _, caveat := range t.Caveats {
+		if err := v.check(caveat, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check returns ErrDenied unless caveat allows req. Unknown caveats deny every
+// request as what they restrict cannot be checked.
+func (v *Verifier) check(caveat string, req Request) error {
+	name, value, _ := strings.Cut(caveat, "=")
+	switch name {
+	case "op":
+		if slices.Contains(strings.Split(value, ","), req.Op) {
+			return nil
+		}
+	case "resource":
+		if req.Resource != "" && slices.Contains(strings.Split(value, ","), req.Resource) {
+			return nil
+		}
+	case "path":
+		if req.Path != "" && (value == "/" || req.Path == value || strings.HasPrefix(req.Path, value+"/")) {
+			return nil
+		}
+	case "max-bytes":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err == nil && (req.Op != OpStore || (req.Bytes >= 0 && req.Bytes <= n)) {
+			return nil
+		}
+	case "expires":
+		expires, err := time.Parse(time.RFC3339, value)
+		if err == nil && v.now().Before(expires) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrDenied, caveat)
+}
@@ -0,0 +1,186 @@
+package cap_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"invariant/internal/cap"
+)
+
+func TestToken_Attenuate(t *testing.T) {
+	verifier := cap.NewVerifier(bytes.Repeat([]byte{1}, cap.KeySize))
+	root := verifier.Issue(cap.ForResources("slot-a", "slot-b"))
+
+	read := cap.Request{Op: cap.OpRead, Resource: "slot-a"}
+	write := cap.Request{Op: cap.OpWrite, Resource: "slot-b"}
+	if err := verifier.Verify(root, write); err != nil {
+		t.Fatalf("expected root token to allow write: %v", err)
+	}
+	if err := verifier.Verify(root, cap.Request{Op: cap.OpRead, Resource: "slot-c"}); !errors.Is(err, cap.ErrDenied) {
+		t.Fatalf("expected ErrDenied for another resource, got %v", err)
+	}
+
+	// Attenuating through encoding narrows the token without the key
+	decoded, err := cap.Decode(root.Encode())
+	if err != nil {
+		t.Fatalf("failed to decode token: %v", err)
+	}
+	readOnly := decoded.Attenuate(cap.AllowOps(cap.OpRead), cap.ExpiresAt(time.Now().Add(time.Hour)))
+	if err := verifier.Verify(readOnly, read); err != nil {
+		t.Fatalf("expected attenuated token to allow read: %v", err)
+	}
+	if err := verifier.Verify(readOnly, write); !errors.Is(err, cap.ErrDenied) {
+		t.Fatalf("expected ErrDenied for write, got %v", err)
+	}
+
+	// Removing a caveat invalidates the signature
+	stripped := *readOnly
+	stripped.Caveats = stripped.Caveats[:1]
+	if err := verifier.Verify(&stripped, write); err != cap.ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+	other := cap.NewVerifier(bytes.Repeat([]byte{2}, cap.KeySize))
+	if err := other.Verify(root, write); err != cap.ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for another key, got %v", err)
+	}
+
+	expired := root.Attenuate(cap.ExpiresAt(time.Now().Add(-time.Minute)))
+	if err := verifier.Verify(expired, read); !errors.Is(err, cap.ErrDenied) {
+		t.Fatalf("expected ErrDenied for expired token, got %v", err)
+	}
+	unknown := root.Attenuate("ip=127.0.0.1")
+	if err := verifier.Verify(unknown, read); !errors.Is(err, cap.ErrDenied) {
+		t.Fatalf("expected ErrDenied for unknown caveat, got %v", err)
+	}
+}
+
+func TestVerifier_RequireStorage(t *testing.T) {
+	verifier := cap.NewVerifier(bytes.Repeat([]byte{1}, cap.KeySize))
+	handler := verifier.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), cap.StorageRequest)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	allowance := verifier.Issue(cap.AllowOps(cap.OpStore), cap.MaxBytes(4))
+	client := &http.Client{Transport: &cap.Transport{Token: allowance}}
+	for _, tc := range []struct {
+		client *http.Client
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.DefaultClient, http.MethodGet, "/id", "", http.StatusOK},
+		{http.DefaultClient, http.MethodPost, "/", "data", http.StatusUnauthorized},
+		{client, http.MethodPost, "/", "data", http.StatusOK},
+		{client, http.MethodPost, "/", "too large", http.StatusForbidden},
+		{client, http.MethodGet, "/abcd", "", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(tc.method, ts.URL+tc.path, bytes.NewReader([]byte(tc.body)))
+		resp, err := tc.client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tc.method, tc.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %s %q: expected %d, got %d", tc.method, tc.path, tc.body, tc.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestVerifier_UnderPath(t *testing.T) {
+	verifier := cap.NewVerifier(bytes.Repeat([]byte{1}, cap.KeySize))
+	shared := verifier.Issue(cap.ForResources("slot-a"), cap.UnderPath("docs/"))
+
+	for _, tc := range []struct {
+		path    string
+		allowed bool
+	}{
+		{"/docs", true},
+		{"/docs/a.txt", true},
+		{"/docs2/a.txt", false},
+		{"/", false},
+		{"", false},
+	} {
+		err := verifier.Verify(shared, cap.Request{Op: cap.OpRead, Resource: "slot-a", Path: tc.path})
+		if tc.allowed && err != nil {
+			t.Errorf("expected %q to be allowed: %v", tc.path, err)
+		}
+		if !tc.allowed && !errors.Is(err, cap.ErrDenied) {
+			t.Errorf("expected ErrDenied for %q, got %v", tc.path, err)
+		}
+	}
+
+	// A token in the query is accepted without the header
+	handler := verifier.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), cap.FilesRequest("slot-a"))
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	for path, status := range map[string]int{
+		"/shared/docs/a.txt?token=" + shared.Encode(): http.StatusOK,
+		"/shared/other?token=" + shared.Encode():      http.StatusForbidden,
+		"/directory/1?token=" + shared.Encode():       http.StatusForbidden,
+		"/shared/docs/a.txt":                          http.StatusUnauthorized,
+	} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("GET %s: expected %d, got %d", path, status, resp.StatusCode)
+		}
+	}
+}
+
+func TestClassifiers(t *testing.T) {
+	verifier := cap.NewVerifier(bytes.Repeat([]byte{1}, cap.KeySize))
+	readName := verifier.Issue(cap.AllowOps(cap.OpRead), cap.ForResources("home"))
+	unrestricted := verifier.Issue()
+
+	for _, tc := range []struct {
+		name     string
+		classify cap.Classifier
+		token    *cap.Token
+		method   string
+		path     string
+		status   int
+	}{
+		{"names id", cap.NamesRequest, nil, http.MethodGet, "/id", http.StatusOK},
+		{"names get", cap.NamesRequest, readName, http.MethodGet, "/home", http.StatusOK},
+		{"names get without token", cap.NamesRequest, nil, http.MethodGet, "/home", http.StatusUnauthorized},
+		{"names put", cap.NamesRequest, readName, http.MethodPut, "/home", http.StatusForbidden},
+		{"names export", cap.NamesRequest, readName, http.MethodGet, "/export", http.StatusForbidden},
+		{"distribute id", cap.DistributeRequest, nil, http.MethodGet, "/id", http.StatusOK},
+		{"distribute config", cap.DistributeRequest, nil, http.MethodPut, "/config", http.StatusUnauthorized},
+		{"distribute register", cap.DistributeRequest, unrestricted, http.MethodPut, "/register/abcd", http.StatusOK},
+		{"finder find", cap.FinderRequest, nil, http.MethodGet, "/abcd", http.StatusUnauthorized},
+		{"finder notify", cap.FinderRequest, readName, http.MethodPut, "/notify/abcd", http.StatusForbidden},
+		{"discovery find", cap.DiscoveryRequest, nil, http.MethodGet, "/", http.StatusUnauthorized},
+		{"discovery put", cap.DiscoveryRequest, unrestricted, http.MethodPut, "/abcd", http.StatusOK},
+		{"storage collect without token", cap.StorageRequest, nil, http.MethodPost, "/collect", http.StatusUnauthorized},
+		{"storage collect by a restricted token", cap.StorageRequest, verifier.Issue(cap.ForResources("collect")), http.MethodPost, "/collect", http.StatusForbidden},
+		{"storage collect", cap.StorageRequest, unrestricted, http.MethodPost, "/collect", http.StatusOK},
+		{"files host outside /fs/", cap.FilesRequest(""), nil, http.MethodGet, "/other", http.StatusUnauthorized},
+		{"files host outside /fs/ by a restricted token", cap.FilesRequest(""), readName, http.MethodGet, "/other", http.StatusForbidden},
+	} {
+		handler := verifier.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}), tc.classify)
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.token != nil {
+			req.Header.Set(cap.Header, tc.token.Encode())
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.status, rec.Code)
+		}
+	}
+}
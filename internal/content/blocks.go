@@ -0,0 +1,102 @@
+package content
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+// Blocks calls fn with the address of each block holding the content at
+// link: the block at its address and, if the content is split, the blocks
+// of its block list in order. Block lists are read from store, so fn can
+// make a block available there before it is read. Inline content has no
+// blocks.
+func Blocks(link ContentLink, store storage.Storage, slotService slots.Slots, fn func(address string) error) error {
+	if link.Inline != nil {
+		return nil
+	}
+	if link.Slot {
+		if slotService == nil {
+			return ErrSlotServiceMissing
+		}
+		address, err := slotService.Get(context.Background(), link.Address)
+		if err != nil {
+			return fmt.Errorf("failed to lookup slot %s: %w", link.Address, err)
+		}
+		link.Address = address
+		link.Slot = false
+	}
+	if err := fn(link.Address); err != nil {
+		return err
+	}
+
+	// The block list is the content of the block after the transforms that
+	// precede the Blocks transform
+	for i, t := range link.Transforms {
+		if t.Kind != "Blocks" {
+			continue
+		}
+		listLink := ContentLink{Address: link.Address, Transforms: link.Transforms[:i]}
+		rc, err := Read(listLink, store, slotService)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		var bl BlockList
+		if err := json.Unmarshal(data, &bl); err != nil {
+			return fmt.Errorf("failed to parse block list: %w", err)
+		}
+		for _, item := range bl.Blocks {
+			if err := Blocks(item.Content, store, slotService, fn); err != nil {
+				return err
+			}
+		}
+		break
+	}
+	return nil
+}
+
+// Size returns the size of the content at link. The size of split content is
+// the sum of the sizes its block list records, so only the list is read;
+// other content is read to its end.
+func Size(link ContentLink, store storage.Storage, slotService slots.Slots) (uint64, error) {
+	if link.Inline != nil {
+		return uint64(len(link.Inline)), nil
+	}
+	if n := len(link.Transforms); n > 0 && link.Transforms[n-1].Kind == "Blocks" {
+		listLink := link
+		listLink.Transforms = link.Transforms[:n-1]
+		listLink.Expected = ""
+		rc, err := Read(listLink, store, slotService)
+		if err != nil {
+			return 0, err
+		}
+		var bl BlockList
+		err = json.NewDecoder(rc).Decode(&bl)
+		rc.Close()
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse block list: %w", err)
+		}
+		var size uint64
+		for _, item := range bl.Blocks {
+			size += item.Size
+		}
+		return size, nil
+	}
+
+	rc, err := Read(link, store, slotService)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	n, err := io.Copy(io.Discard, rc)
+	return uint64(n), err
+}
@@ -0,0 +1,91 @@
+package content
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/bits"
+)
+
+// buzHashWindowSize is the number of bytes the BuzHash rolls over.
+const buzHashWindowSize = 64
+
+// BuzHashChunker finds the boundaries of content defined chunks in a stream
+// using a BuzHash rolling hash. A boundary is placed after a byte whose hash
+// matches the target mask once the chunk is at least half the target size, or
+// when the chunk reaches the maximum size. The hash is reset at each boundary,
+// so boundaries depend only on the content of the stream.
+type BuzHashChunker struct {
+	r       *bufio.Reader
+	hash    *BuzHash
+	mask    uint32
+	minSize int
+	maxSize int
+	offset  int64
+	started bool
+}
+
+var _ ContentDefinedChunker = (*BuzHashChunker)(nil)
+
+// NewBuzHashChunker returns a chunker of r producing chunks of about
+// targetSize bytes, rounded up to a power of two, and at most maxSize bytes.
+func NewBuzHashChunker(r io.Reader, targetSize, maxSize int) *BuzHashChunker {
+	target := 1 << bits.Len(uint(max(targetSize, 2)-1))
+	return &BuzHashChunker{
+		r:       bufio.NewReader(r),
+		hash:    NewBuzHash(buzHashWindowSize),
+		mask:    uint32(target - 1),
+		minSize: target / 2,
+		maxSize: maxSize,
+	}
+}
+
+// NextBoundary consumes the next chunk of the stream and returns the offset of
+// its end. The last chunk ends at the end of the stream, after which io.EOF
+// is returned.
+func (c *BuzHashChunker) NextBoundary() (int64, error) {
+	if err := c.next(nil); err != nil {
+		return 0, err
+	}
+	return c.offset, nil
+}
+
+// ReadNextChunk returns the data of the next chunk of the stream, or io.EOF
+// when the stream is exhausted. An empty stream is a single empty chunk.
+func (c *BuzHashChunker) ReadNextChunk() ([]byte, error) {
+	var chunk bytes.Buffer
+	if err := c.next(&chunk); err != nil {
+		return nil, err
+	}
+	return chunk.Bytes(), nil
+}
+
+// next consumes the next chunk, writing it to chunk if it is not nil.
+func (c *BuzHashChunker) next(chunk *bytes.Buffer) error {
+	size := 0
+	for {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			if size == 0 && c.started {
+				return io.EOF
+			}
+			c.started = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.started = true
+		if chunk != nil {
+			chunk.WriteByte(b)
+		}
+		size++
+		c.offset++
+
+		h := c.hash.WriteB(b)
+		if (h&c.mask == 0 && size >= c.minSize) || size == c.maxSize {
+			c.hash = NewBuzHash(buzHashWindowSize)
+			return nil
+		}
+	}
+}
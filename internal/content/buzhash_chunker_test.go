@@ -0,0 +1,84 @@
+package content_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"testing"
+
+	"invariant/internal/content"
+)
+
+func boundaries(t *testing.T, data []byte) []int64 {
+	t.Helper()
+	chunker := content.NewBuzHashChunker(bytes.NewReader(data), 4096, 16384)
+	var result []int64
+	for {
+		offset, err := chunker.NextBoundary()
+		if err == io.EOF {
+			return result
+		}
+		if err != nil {
+			t.Fatalf("NextBoundary failed: %v", err)
+		}
+		result = append(result, offset)
+	}
+}
+
+func TestBuzHashChunker(t *testing.T) {
+	data := make([]byte, 256*1024)
+	rng := rand.NewChaCha8([32]byte{1})
+	rng.Read(data)
+
+	ends := boundaries(t, data)
+	if len(ends) < 2 || ends[len(ends)-1] != int64(len(data)) {
+		t.Fatalf("Expected several boundaries ending at %d, got %v", len(data), ends)
+	}
+
+	// ReadNextChunk produces the chunks between the boundaries
+	chunker := content.NewBuzHashChunker(bytes.NewReader(data), 4096, 16384)
+	var offset int64
+	for i := 0; ; i++ {
+		chunk, err := chunker.ReadNextChunk()
+		if err == io.EOF {
+			if i != len(ends) {
+				t.Fatalf("Expected %d chunks, got %d", len(ends), i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadNextChunk failed: %v", err)
+		}
+		if len(chunk) > 16384 {
+			t.Errorf("Chunk %d of %d bytes exceeds the maximum size", i, len(chunk))
+		}
+		if !bytes.Equal(chunk, data[offset:offset+int64(len(chunk))]) {
+			t.Fatalf("Chunk %d does not match the data", i)
+		}
+		offset += int64(len(chunk))
+		if offset != ends[i] {
+			t.Fatalf("Expected chunk %d to end at %d, got %d", i, ends[i], offset)
+		}
+	}
+
+	// The hash is reset at each boundary so chunking resumed from a boundary
+	// finds the same boundaries
+	resumed := boundaries(t, data[ends[0]:])
+	if len(resumed) != len(ends)-1 {
+		t.Fatalf("Expected %d boundaries when resumed, got %d", len(ends)-1, len(resumed))
+	}
+	for i, end := range resumed {
+		if end+ends[0] != ends[i+1] {
+			t.Errorf("Expected resumed boundary %d at %d, got %d", i, ends[i+1]-ends[0], end)
+		}
+	}
+
+	// An empty stream is a single empty chunk
+	empty := content.NewBuzHashChunker(bytes.NewReader(nil), 4096, 16384)
+	if chunk, err := empty.ReadNextChunk(); err != nil || len(chunk) != 0 {
+		t.Errorf("Expected an empty chunk, got %d bytes, %v", len(chunk), err)
+	}
+	if _, err := empty.ReadNextChunk(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
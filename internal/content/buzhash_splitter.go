@@ -1,7 +1,6 @@
 package content
 
 import (
-	"bytes"
 	"io"
 )
 
@@ -13,58 +12,24 @@ func (s *BuzHashSplitter) Match(head []byte, filename, contentType string) bool
 }
 
 func (s *BuzHashSplitter) Split(r io.Reader, opts WriterOptions, writeChunk func([]byte) (ContentLink, error), writeStream func(io.Reader, WriterOptions) (ContentLink, error)) ([]BlockListItem, error) {
-	bh := NewBuzHash(64)
-	mask := uint32((1 << 20) - 1) // 1MB avg target
+	chunker := NewBuzHashChunker(r, targetBlockSize, maxBlockSize)
 
 	var blocks []BlockListItem
-	var currentChunk bytes.Buffer
-	buf := make([]byte, 32*1024) // 32KB read buffer
-
 	for {
-		n, err := r.Read(buf)
-		if n > 0 {
-			for i := range n {
-				b := buf[i]
-				h := bh.WriteB(b)
-				currentChunk.WriteByte(b)
-				size := currentChunk.Len()
-
-				if (h&mask == 0 && size >= targetBlockSize/2) || size == maxBlockSize {
-					chunkData := make([]byte, currentChunk.Len())
-					copy(chunkData, currentChunk.Bytes())
-					link, wErr := writeChunk(chunkData)
-					if wErr != nil {
-						return nil, wErr
-					}
-					blocks = append(blocks, BlockListItem{
-						Content: link,
-						Size:    uint64(size),
-					})
-					currentChunk.Reset()
-					bh = NewBuzHash(64)
-				}
-			}
-		}
+		chunk, err := chunker.ReadNextChunk()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
-	}
-
-	if currentChunk.Len() > 0 || len(blocks) == 0 {
-		size := currentChunk.Len()
-		chunkData := make([]byte, currentChunk.Len())
-		copy(chunkData, currentChunk.Bytes())
-		link, err := writeChunk(chunkData)
+		link, err := writeChunk(chunk)
 		if err != nil {
 			return nil, err
 		}
-
 		blocks = append(blocks, BlockListItem{
 			Content: link,
-			Size:    uint64(size),
+			Size:    uint64(len(chunk)),
 		})
 	}
 
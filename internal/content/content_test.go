@@ -2,9 +2,17 @@ package content_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"io"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"invariant/internal/content"
 	"invariant/internal/storage"
@@ -35,6 +43,78 @@ func TestReadWriteBasic(t *testing.T) {
 	}
 }
 
+func TestReadWriteInline(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	opts := content.WriterOptions{InlineMax: 16}
+
+	small := []byte("hello world")
+	link, err := content.Write(bytes.NewReader(small), store, opts)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if !bytes.Equal(link.Inline, small) || len(link.Transforms) != 0 {
+		t.Fatalf("Expected inline content, got %+v", link)
+	}
+	if store.Has(context.Background(), link.Address) {
+		t.Errorf("Expected no block to be stored for inline content")
+	}
+	stored, _ := content.Write(bytes.NewReader(small), storage.NewInMemoryStorage(), content.WriterOptions{})
+	if link.Address != stored.Address {
+		t.Errorf("Expected the address of the content as a block %s, got %s", stored.Address, link.Address)
+	}
+
+	// The link survives encoding as part of a directory entry
+	encoded, _ := json.Marshal(link)
+	var decoded content.ContentLink
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	rc, err := content.Read(decoded, store, nil)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	readData, _ := io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(small, readData) {
+		t.Errorf("Expected %q, got %q", small, readData)
+	}
+	var blocks []string
+	content.Blocks(decoded, store, nil, func(address string) error {
+		blocks = append(blocks, address)
+		return nil
+	})
+	if len(blocks) != 0 {
+		t.Errorf("Expected inline content to have no blocks, got %v", blocks)
+	}
+
+	// Larger, empty and encrypted content is stored as blocks
+	for name, tc := range map[string]struct {
+		data []byte
+		opts content.WriterOptions
+	}{
+		"large":     {bytes.Repeat([]byte("x"), 17), opts},
+		"empty":     {nil, opts},
+		"encrypted": {small, content.WriterOptions{InlineMax: 16, EncryptAlgorithm: "aes-256-cbc", KeyPolicy: content.Deterministic}},
+	} {
+		link, err := content.Write(bytes.NewReader(tc.data), store, tc.opts)
+		if err != nil {
+			t.Fatalf("%s: Write failed: %v", name, err)
+		}
+		if link.Inline != nil || !store.Has(context.Background(), link.Address) {
+			t.Errorf("%s: expected a stored block, got %+v", name, link)
+		}
+		rc, err := content.Read(link, store, nil)
+		if err != nil {
+			t.Fatalf("%s: Read failed: %v", name, err)
+		}
+		readData, _ := io.ReadAll(rc)
+		rc.Close()
+		if !bytes.Equal(tc.data, readData) {
+			t.Errorf("%s: expected %q, got %q", name, tc.data, readData)
+		}
+	}
+}
+
 func TestReadWriteEncryptedCompressed(t *testing.T) {
 	store := storage.NewInMemoryStorage()
 
@@ -105,6 +185,10 @@ func TestReadWriteLarge(t *testing.T) {
 		t.Errorf("Expected last transform to be Blocks, got %v", link.Transforms)
 	}
 
+	if size, err := content.Size(link, store, nil); err != nil || size != uint64(len(data)) {
+		t.Errorf("Expected the size of the content to be %d, got %d (%v)", len(data), size, err)
+	}
+
 	rc, err := content.Read(link, store, nil)
 	if err != nil {
 		t.Fatalf("Read failed: %v", err)
@@ -161,3 +245,333 @@ func TestReadWriteSuppliedKey(t *testing.T) {
 		t.Errorf("Expected %q, got %q", data, readData)
 	}
 }
+
+func TestLoadSuppliedKey(t *testing.T) {
+	keyHex := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+	t.Setenv(content.KeyEnvVar, "")
+	key, err := content.LoadSuppliedKey("")
+	if err != nil || key != nil {
+		t.Fatalf("expected no key without a file or environment, got %x (err: %v)", key, err)
+	}
+
+	t.Setenv(content.KeyEnvVar, keyHex)
+	key, err = content.LoadSuppliedKey("")
+	if err != nil || len(key) != 32 || key[31] != 0x1f {
+		t.Fatalf("expected key from environment, got %x (err: %v)", key, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(keyHex+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err = content.LoadSuppliedKey(path)
+	if err != nil || len(key) != 32 || key[1] != 0x01 {
+		t.Fatalf("expected key from hex file, got %x (err: %v)", key, err)
+	}
+
+	raw := bytes.Repeat([]byte{0xab}, 32)
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err = content.LoadSuppliedKey(path)
+	if err != nil || !bytes.Equal(key, raw) {
+		t.Fatalf("expected raw key from file, got %x (err: %v)", key, err)
+	}
+
+	if err := os.WriteFile(path, []byte("abcd"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := content.LoadSuppliedKey(path); err == nil {
+		t.Fatal("expected short key to be rejected")
+	}
+}
+
+func TestReadEncryptedStreaming(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	opts := content.WriterOptions{
+		EncryptAlgorithm: "aes-256-cbc",
+		KeyPolicy:        content.RandomPerBlock,
+	}
+
+	// Sizes around the padding and decryption buffer boundaries
+	for _, size := range []int{1, 15, 16, 32*1024 - 16, 32 * 1024, 32*1024 + 1, 100003} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		link, err := content.Write(bytes.NewReader(data), store, opts)
+		if err != nil {
+			t.Fatalf("Write of %d bytes failed: %v", size, err)
+		}
+
+		rc, err := content.Read(link, store, nil)
+		if err != nil {
+			t.Fatalf("Read of %d bytes failed: %v", size, err)
+		}
+		readData, err := io.ReadAll(iotest.OneByteReader(rc))
+		rc.Close()
+		if err != nil {
+			t.Fatalf("ReadAll of %d bytes failed: %v", size, err)
+		}
+		if !bytes.Equal(data, readData) {
+			t.Errorf("Read data of %d bytes does not match original", size)
+		}
+	}
+}
+
+// failingStorage fails the stores after the first succeed, and every
+// failEvery-th store after that if failEvery is positive.
+type failingStorage struct {
+	storage.Storage
+	succeed   int
+	failEvery int
+	calls     int
+}
+
+func (s *failingStorage) Store(ctx context.Context, r io.Reader) (string, error) {
+	s.calls++
+	if s.calls > s.succeed && (s.failEvery <= 0 || s.calls%s.failEvery == 0) {
+		return "", errors.New("store unavailable")
+	}
+	return s.Storage.Store(ctx, r)
+}
+
+func TestWriteRetryAndPartialFailure(t *testing.T) {
+	data := make([]byte, 5*1024*1024)
+	rand.Read(data)
+
+	// Intermittent failures are retried
+	flaky := &failingStorage{Storage: storage.NewInMemoryStorage(), failEvery: 2}
+	opts := content.WriterOptions{RetryDelay: time.Millisecond}
+	link, err := content.Write(bytes.NewReader(data), flaky, opts)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	rc, err := content.Read(link, flaky, nil)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	readData, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(data, readData) {
+		t.Fatalf("Read data does not match original: %v", err)
+	}
+
+	// A store that stops working reports the blocks already written
+	inner := storage.NewInMemoryStorage()
+	broken := &failingStorage{Storage: inner, succeed: 2}
+	_, err = content.Write(bytes.NewReader(data), broken, opts)
+	var partial *content.PartialWriteError
+	if !errors.As(err, &partial) {
+		t.Fatalf("Expected a PartialWriteError, got %v", err)
+	}
+	if len(partial.Blocks) != 2 {
+		t.Fatalf("Expected 2 written blocks, got %v", partial.Blocks)
+	}
+	for _, address := range partial.Blocks {
+		if !inner.Has(context.Background(), address) {
+			t.Errorf("Expected block %s to be stored", address)
+		}
+	}
+	if broken.calls != 2+4 {
+		t.Errorf("Expected the failed block to be tried 4 times, got %d", broken.calls-2)
+	}
+
+	// The backoff ends when the context of the write is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	down := &failingStorage{Storage: storage.NewInMemoryStorage()}
+	start := time.Now()
+	_, err = content.WriteContext(ctx, bytes.NewReader(data), down, content.WriterOptions{Retries: 10, RetryDelay: time.Second})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the write to end with its context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Write kept retrying for %v after its context was done", elapsed)
+	}
+}
+
+// recordingStorage records the addresses read from it.
+type recordingStorage struct {
+	storage.Storage
+	mu   sync.Mutex
+	read map[string]bool
+}
+
+func (s *recordingStorage) Get(ctx context.Context, address string) (io.ReadCloser, bool) {
+	s.mu.Lock()
+	s.read[address] = true
+	s.mu.Unlock()
+	return s.Storage.Get(ctx, address)
+}
+
+func (s *recordingStorage) wasRead(address string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read[address]
+}
+
+func TestReadaheadFollowsReads(t *testing.T) {
+	store := &recordingStorage{Storage: storage.NewInMemoryStorage(), read: make(map[string]bool)}
+
+	var list content.BlockList
+	for i := range 40 {
+		link, err := content.Write(bytes.NewReader([]byte{byte(i)}), store, content.WriterOptions{})
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		list.Blocks = append(list.Blocks, content.BlockListItem{Content: link, Size: 1})
+	}
+	data, _ := json.Marshal(list)
+	listAddr, err := store.Store(context.Background(), bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+
+	rc, err := content.Read(content.ContentLink{Address: listAddr, Transforms: []content.ContentTransform{{Kind: "Blocks"}}}, store, nil)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	defer rc.Close()
+
+	// Reading through block 20 fetches the blocks that follow it
+	if _, err := io.ReadFull(rc, make([]byte, 21)); err != nil {
+		t.Fatalf("ReadFull failed: %v", err)
+	}
+	want := list.Blocks[35].Content.Address
+	deadline := time.Now().Add(2 * time.Second)
+	for !store.wasRead(want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("block 35 was not read ahead")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if store.wasRead(list.Blocks[39].Content.Address) {
+		t.Errorf("block 39 was read before it was within the readahead window")
+	}
+}
+
+func TestReadSeeks(t *testing.T) {
+	store := &recordingStorage{Storage: storage.NewInMemoryStorage(), read: make(map[string]bool)}
+
+	var list content.BlockList
+	for i := range 40 {
+		link, err := content.Write(bytes.NewReader([]byte{byte(i), byte(i)}), store, content.WriterOptions{})
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		list.Blocks = append(list.Blocks, content.BlockListItem{Content: link, Size: 2})
+	}
+	data, _ := json.Marshal(list)
+	listAddr, err := store.Store(context.Background(), bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+
+	rc, err := content.Read(content.ContentLink{Address: listAddr, Transforms: []content.ContentTransform{{Kind: "Blocks"}}}, store, nil)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	defer rc.Close()
+
+	// ReadAt only reads the blocks containing the range
+	readerAt, ok := rc.(io.ReaderAt)
+	if !ok {
+		t.Fatalf("expected the reader of a block list to implement io.ReaderAt")
+	}
+	p := make([]byte, 3)
+	if n, err := readerAt.ReadAt(p, 61); err != nil || !bytes.Equal(p[:n], []byte{30, 31, 31}) {
+		t.Errorf("ReadAt: got %v %v", p[:n], err)
+	}
+	if store.wasRead(list.Blocks[20].Content.Address) {
+		t.Errorf("block 20 was read to read blocks 30 and 31")
+	}
+	if n, err := readerAt.ReadAt(p, 78); err != io.EOF || !bytes.Equal(p[:n], []byte{39, 39}) {
+		t.Errorf("ReadAt at the end: got %v %v", p[:n], err)
+	}
+
+	// Seeking is relative to the start, the position and the end
+	if err := content.Seek(rc, 10); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	seeker := rc.(io.Seeker)
+	if pos, err := seeker.Seek(-3, io.SeekEnd); err != nil || pos != 77 {
+		t.Fatalf("Seek from the end: got %d %v", pos, err)
+	}
+	rest, err := io.ReadAll(rc)
+	if err != nil || !bytes.Equal(rest, []byte{38, 39, 39}) {
+		t.Errorf("reading after Seek: got %v %v", rest, err)
+	}
+	if pos, _ := seeker.Seek(0, io.SeekCurrent); pos != 80 {
+		t.Errorf("expected to be at the end, got %d", pos)
+	}
+
+	// Inline content seeks too
+	inline, _ := content.Read(content.Inline([]byte("inline content")), nil, nil)
+	if err := content.Seek(inline, 7); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	if rest, _ := io.ReadAll(inline); string(rest) != "content" {
+		t.Errorf("reading inline content after Seek: got %q", rest)
+	}
+}
+
+// consumedReader counts the bytes read from r.
+type consumedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *consumedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// streamCheckingStorage records how far the source of a write had been read
+// when each block was stored.
+type streamCheckingStorage struct {
+	storage.Storage
+	source    *consumedReader
+	stored    int64
+	readAhead int64 // most bytes read from the source but not yet stored
+}
+
+func (s *streamCheckingStorage) Store(ctx context.Context, r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	s.stored += int64(len(data))
+	s.readAhead = max(s.readAhead, s.source.n-s.stored)
+	return s.Storage.Store(ctx, bytes.NewReader(data))
+}
+
+func TestWriteStreams(t *testing.T) {
+	const size = 32 * 1024 * 1024
+	source := &consumedReader{r: io.LimitReader(rand.Reader, size)}
+	store := &streamCheckingStorage{Storage: storage.NewInMemoryStorage(), source: source}
+
+	link, err := content.Write(source, store, content.WriterOptions{})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if source.n != size {
+		t.Fatalf("read %d bytes, want %d", source.n, size)
+	}
+	// Each block is stored as soon as it is read, so the writer never holds
+	// more than the block it is reading
+	if store.readAhead > 64*1024 {
+		t.Errorf("read %d bytes ahead of the blocks stored", store.readAhead)
+	}
+
+	rc, err := content.Read(link, store, nil)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	defer rc.Close()
+	n, err := io.Copy(io.Discard, rc)
+	if err != nil || n != size {
+		t.Errorf("read back %d bytes, %v", n, err)
+	}
+}
@@ -0,0 +1,100 @@
+package content
+
+import (
+	"crypto/cipher"
+	"errors"
+	"io"
+)
+
+// decipherBufferSize bounds the ciphertext decrypted at a time. It is a
+// multiple of the AES block size.
+const decipherBufferSize = 32 * 1024
+
+var (
+	ErrInvalidPadding    = errors.New("invalid padding")
+	ErrInvalidCiphertext = errors.New("ciphertext is not a multiple of the block size")
+)
+
+// cbcReader decrypts a CBC ciphertext stream with PKCS#7 padding as it is
+// read. The last block is held back until the end of the ciphertext is
+// reached so its padding can be removed.
+type cbcReader struct {
+	src       io.ReadCloser
+	mode      cipher.BlockMode
+	blockSize int
+
+	buf       []byte // ciphertext read but not yet decrypted
+	plaintext []byte // decrypted plaintext not yet returned
+	done      bool
+	err       error
+}
+
+func newCBCReader(src io.ReadCloser, block cipher.Block, iv []byte) *cbcReader {
+	return &cbcReader{
+		src:       src,
+		mode:      cipher.NewCBCDecrypter(block, iv),
+		blockSize: block.BlockSize(),
+		buf:       make([]byte, 0, decipherBufferSize+block.BlockSize()),
+	}
+}
+
+func (r *cbcReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.fill()
+	}
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+// fill reads the next chunk of ciphertext and decrypts every complete block
+// except the last, which may be the padding block.
+func (r *cbcReader) fill() {
+	n, err := io.ReadFull(r.src, r.buf[len(r.buf):cap(r.buf)])
+	r.buf = r.buf[:len(r.buf)+n]
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		r.done = true
+	default:
+		r.err = err
+		return
+	}
+
+	if r.done {
+		if len(r.buf) == 0 || len(r.buf)%r.blockSize != 0 {
+			r.err = ErrInvalidCiphertext
+			return
+		}
+		r.mode.CryptBlocks(r.buf, r.buf)
+		padLen := int(r.buf[len(r.buf)-1])
+		if padLen > r.blockSize || padLen == 0 {
+			r.err = ErrInvalidPadding
+			return
+		}
+		for _, b := range r.buf[len(r.buf)-padLen:] {
+			if b != byte(padLen) {
+				r.err = ErrInvalidPadding
+				return
+			}
+		}
+		r.plaintext = r.buf[:len(r.buf)-padLen]
+		return
+	}
+
+	// The buffer is full so it is block aligned; keep the last block back
+	ready := len(r.buf) - r.blockSize
+	r.mode.CryptBlocks(r.buf[:ready], r.buf[:ready])
+	r.plaintext = append(r.plaintext[:0], r.buf[:ready]...)
+	r.buf = append(r.buf[:0], r.buf[ready:]...)
+}
+
+func (r *cbcReader) Close() error {
+	return r.src.Close()
+}
@@ -0,0 +1,59 @@
+package content
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyEnvVar is the environment variable consulted for a supplied encryption key
+// when no key file is given. The value is a 32-byte hex-encoded key.
+const KeyEnvVar = "INVARIANT_KEY"
+
+// ErrKeyRequired is returned when the SuppliedAllKey policy is used without key material.
+var ErrKeyRequired = errors.New("a key is required when key-policy is SuppliedAllKey")
+
+// ParseKeyPolicy converts the name of a key policy into a KeyPolicy.
+func ParseKeyPolicy(name string) (KeyPolicy, error) {
+	switch KeyPolicy(name) {
+	case RandomPerBlock, RandomAllKey, Deterministic, SuppliedAllKey:
+		return KeyPolicy(name), nil
+	}
+	return "", fmt.Errorf("unsupported key-policy '%s'", name)
+}
+
+// ParseKey decodes a 32-byte hex-encoded key.
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be a 32-byte hex-encoded string (got %d bytes)", len(key))
+	}
+	return key, nil
+}
+
+// LoadSuppliedKey loads key material from the file at path or, if path is
+// empty, from the KeyEnvVar environment variable. The file may contain either
+// the raw 32 key bytes or the hex-encoded key. A nil key is returned if neither
+// source is configured.
+func LoadSuppliedKey(path string) ([]byte, error) {
+	if path == "" {
+		if value := os.Getenv(KeyEnvVar); value != "" {
+			return ParseKey(value)
+		}
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	return ParseKey(string(data))
+}
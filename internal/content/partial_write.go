@@ -0,0 +1,104 @@
+package content
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"invariant/internal/storage"
+)
+
+const (
+	defaultBlockRetries    = 3
+	defaultBlockRetryDelay = 100 * time.Millisecond
+)
+
+// PartialWriteError is returned by Write when the content could not be
+// completely written. Blocks lists the addresses of the blocks that were
+// stored before the failure so the caller can resume the write, as storing a
+// block again is harmless, or schedule the blocks for cleanup.
+type PartialWriteError struct {
+	Blocks []string
+	Err    error
+}
+
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("write failed after storing %d blocks: %v", len(e.Blocks), e.Err)
+}
+
+func (e *PartialWriteError) Unwrap() error {
+	return e.Err
+}
+
+// retryingStorage retries failed stores with exponential backoff and records
+// the addresses of the blocks stored. Blocks are stored with the context of
+// the write, as the writer does not pass one down to each block, and the
+// backoff ends when it is done.
+type retryingStorage struct {
+	storage.Storage
+	ctx     context.Context
+	retries int
+	delay   time.Duration
+
+	mu     sync.Mutex
+	stored []string
+}
+
+func newRetryingStorage(ctx context.Context, store storage.Storage, opts WriterOptions) *retryingStorage {
+	retries := opts.Retries
+	if retries == 0 {
+		retries = defaultBlockRetries
+	}
+	delay := opts.RetryDelay
+	if delay == 0 {
+		delay = defaultBlockRetryDelay
+	}
+	return &retryingStorage{Storage: store, ctx: ctx, retries: max(retries, 0), delay: delay}
+}
+
+func (s *retryingStorage) Store(_ context.Context, r io.Reader) (string, error) {
+	seeker, ok := r.(io.ReadSeeker)
+	if !ok {
+		return s.record(s.Storage.Store(s.ctx, r))
+	}
+
+	delay := s.delay
+	for attempt := 0; ; attempt++ {
+		address, err := s.Storage.Store(s.ctx, seeker)
+		if err == nil || attempt >= s.retries {
+			return s.record(address, err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return "", fmt.Errorf("%w: %v", s.ctx.Err(), err)
+		case <-timer.C:
+		}
+		delay *= 2
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+}
+
+func (s *retryingStorage) record(address string, err error) (string, error) {
+	if err == nil {
+		s.mu.Lock()
+		s.stored = append(s.stored, address)
+		s.mu.Unlock()
+	}
+	return address, err
+}
+
+// blocks returns the distinct addresses of the blocks stored.
+func (s *retryingStorage) blocks() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := slices.Clone(s.stored)
+	slices.Sort(result)
+	return slices.Compact(result)
+}
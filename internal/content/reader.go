@@ -6,7 +6,6 @@ import (
 	"compress/gzip"
 	"context"
 	"crypto/aes"
-	"crypto/cipher"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -14,6 +13,7 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"sort"
 	"sync"
 
 	"invariant/internal/slots"
@@ -29,8 +29,15 @@ var (
 )
 
 // Read returns an io.ReadCloser for the given ContentLink.
-// The caller is responsible for closing the reader.
+// The caller is responsible for closing the reader. The readers of inline
+// content and of block lists also implement io.Seeker and io.ReaderAt; block
+// lists use the sizes of their blocks to read only the blocks containing the
+// requested offsets.
 func Read(link ContentLink, store storage.Storage, slotService slots.Slots) (io.ReadCloser, error) {
+	if link.Inline != nil {
+		return inlineReader{bytes.NewReader(link.Inline)}, nil
+	}
+
 	address := link.Address
 	if link.Slot {
 		if slotService == nil {
@@ -48,13 +55,13 @@ func Read(link ContentLink, store storage.Storage, slotService slots.Slots) (io.
 		return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, address)
 	}
 
-	var err error
 	for _, t := range link.Transforms {
-		rc, err = applyTransform(rc, t, link.Expected, store, slotService)
+		next, err := applyTransform(rc, t, link.Expected, store, slotService)
 		if err != nil {
 			rc.Close()
 			return nil, fmt.Errorf("failed to apply transform %s: %w", t.Kind, err)
 		}
+		rc = next
 	}
 
 	if link.Expected != "" {
@@ -107,34 +114,12 @@ func applyTransform(rc io.ReadCloser, t ContentTransform, expected string, store
 			return nil, err
 		}
 
-		// Since blocks are typically small (<= 2MB), we can read the entire ciphertext to unpad cleanly.
-		defer rc.Close()
-		ciphertext, err := io.ReadAll(rc)
-		if err != nil {
-			return nil, err
+		if len(iv) != block.BlockSize() {
+			return nil, errors.New("invalid iv length")
 		}
 
-		if len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
-			return nil, errors.New("ciphertext is not a multiple of the block size")
-		}
-
-		mode := cipher.NewCBCDecrypter(block, iv)
-		plaintext := make([]byte, len(ciphertext))
-		mode.CryptBlocks(plaintext, ciphertext)
-
-		// PKCS#7 Unpadding
-		padLen := int(plaintext[len(plaintext)-1])
-		if padLen > block.BlockSize() || padLen == 0 {
-			return nil, errors.New("invalid padding")
-		}
-		for i := len(plaintext) - padLen; i < len(plaintext); i++ {
-			if plaintext[i] != byte(padLen) {
-				return nil, errors.New("invalid padding")
-			}
-		}
-		plaintext = plaintext[:len(plaintext)-padLen]
-
-		return io.NopCloser(bytes.NewReader(plaintext)), nil
+		// Decrypt as the ciphertext is read to bound memory use
+		return newCBCReader(rc, block, iv), nil
 	case "Blocks":
 		defer rc.Close()
 		data, err := io.ReadAll(rc)
@@ -147,18 +132,46 @@ func applyTransform(rc io.ReadCloser, t ContentTransform, expected string, store
 		}
 		br := &blockListReader{
 			blocks:      bl.Blocks,
+			offsets:     make([]int64, len(bl.Blocks)),
 			store:       store,
 			slotService: slotService,
 			cache:       make(map[int][]byte),
 			inFlight:    make(map[int]chan struct{}),
 		}
-		br.startPrefetch()
+		for i, b := range bl.Blocks {
+			br.offsets[i] = br.size
+			br.size += int64(b.Size)
+		}
+		br.prefetch(0)
 		return br, nil
 	default:
 		return nil, fmt.Errorf("%w: %s", ErrUnsupportedKind, t.Kind)
 	}
 }
 
+// Seek positions r, a reader returned by Read, at offset from the start of its
+// content. Readers that can seek jump directly to offset; the content of
+// others is read and discarded up to it.
+func Seek(r io.Reader, offset int64) error {
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(offset, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, offset)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+type inlineReader struct {
+	*bytes.Reader
+}
+
+func (inlineReader) Close() error {
+	return nil
+}
+
 type wrappedReadCloser struct {
 	io.Reader
 	underlying io.Closer
@@ -180,6 +193,8 @@ func (w *wrappedReadCloser) Close() error {
 
 type blockListReader struct {
 	blocks      []BlockListItem
+	offsets     []int64 // the offset of each block in the content
+	size        int64
 	store       storage.Storage
 	slotService slots.Slots
 
@@ -189,11 +204,25 @@ type blockListReader struct {
 	cacheKeys []int // LRU queue tracking oldest used chunks
 
 	currentPos int64
+	prefetched int // index past the last block requested by prefetch
 }
 
-func (r *blockListReader) startPrefetch() {
-	maxPrefetch := min(len(r.blocks), 16)
-	for i := range maxPrefetch {
+// readaheadBlocks is the number of blocks fetched ahead of the block being
+// read.
+const readaheadBlocks = 16
+
+// prefetch starts loading the blocks within readaheadBlocks of idx that have
+// not been requested yet, so sequential reads find their blocks loaded.
+func (r *blockListReader) prefetch(idx int) {
+	r.mu.Lock()
+	start := max(r.prefetched, idx)
+	end := min(len(r.blocks), idx+readaheadBlocks)
+	if start < end {
+		r.prefetched = end
+	}
+	r.mu.Unlock()
+
+	for i := start; i < end; i++ {
 		go func(idx int) {
 			_ = r.loadBlock(idx)
 		}(i)
@@ -211,16 +240,82 @@ func (r *blockListReader) updateLRU(targetIdx int) {
 }
 
 func (r *blockListReader) Seek(offset int64, whence int) (int64, error) {
-	if whence != io.SeekStart {
-		return 0, errors.New("only SeekStart is supported")
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.currentPos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
 	}
 
 	// Because we perfectly buffer block execution natively into RAM, FUSE leaps
 	// forwards, backwards, or inside active block indices are completely zero-latency!
 	r.currentPos = offset
+	r.mu.Lock()
+	r.prefetched = 0
+	r.mu.Unlock()
 	return offset, nil
 }
 
+// blockAt returns the index of the block containing pos, or len(r.blocks) if
+// pos is at or past the end of the content.
+func (r *blockListReader) blockAt(pos int64) int {
+	return sort.Search(len(r.blocks), func(i int) bool {
+		return r.offsets[i]+int64(r.blocks[i].Size) > pos
+	})
+}
+
+// block loads and returns the data of the block at idx.
+func (r *blockListReader) block(idx int) ([]byte, error) {
+	for {
+		if err := r.loadBlock(idx); err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		if r.cache == nil {
+			r.mu.Unlock()
+			return nil, io.ErrClosedPipe
+		}
+		data, ok := r.cache[idx]
+		r.mu.Unlock()
+		if ok {
+			return data, nil
+		}
+		// Evicted by the loads of concurrent reads, load it again
+	}
+}
+
+// ReadAt reads len(p) bytes at off without moving the position of Read,
+// loading only the blocks that contain them.
+func (r *blockListReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		idx := r.blockAt(pos)
+		if idx == len(r.blocks) {
+			return n, io.EOF
+		}
+		data, err := r.block(idx)
+		if err != nil {
+			return n, err
+		}
+		within := pos - r.offsets[idx]
+		if within >= int64(len(data)) {
+			return n, fmt.Errorf("%w: block %d is shorter than its size", io.ErrUnexpectedEOF, idx)
+		}
+		n += copy(p[n:], data[within:])
+	}
+	return n, nil
+}
+
 func (r *blockListReader) loadBlock(targetIdx int) error {
 	r.mu.Lock()
 	if r.cache == nil {
@@ -296,32 +391,21 @@ func (r *blockListReader) Read(p []byte) (int, error) {
 	}
 
 	for {
-		var currentOffset int64 = 0
-		var targetIdx int = len(r.blocks)
-
-		for i, b := range r.blocks {
-			if currentOffset+int64(b.Size) > r.currentPos {
-				targetIdx = i
-				break
-			}
-			currentOffset += int64(b.Size)
-		}
-
+		targetIdx := r.blockAt(r.currentPos)
 		if targetIdx == len(r.blocks) {
 			return 0, io.EOF
 		}
+		currentOffset := r.offsets[targetIdx]
 
-		if err := r.loadBlock(targetIdx); err != nil {
+		r.prefetch(targetIdx)
+		activeBlockData, err := r.block(targetIdx)
+		if err != nil {
 			return 0, err
 		}
 
 		// Calculate mapping offset directly within active RAM slice natively
 		intraBlockOffset := r.currentPos - currentOffset
 
-		r.mu.Lock()
-		activeBlockData := r.cache[targetIdx]
-		r.mu.Unlock()
-
 		// Handle corrupted chunk mapping avoiding invalid slice panics seamlessly
 		if intraBlockOffset >= int64(len(activeBlockData)) {
 			r.currentPos = currentOffset + int64(r.blocks[targetIdx].Size)
@@ -364,6 +448,16 @@ func (r *hashCheckerReader) Seek(offset int64, whence int) (int64, error) {
 	return seeker.Seek(offset, whence)
 }
 
+// ReadAt reads from the underlying reader without affecting the hash check of
+// sequential reads.
+func (r *hashCheckerReader) ReadAt(p []byte, off int64) (int, error) {
+	readerAt, ok := r.ReadCloser.(io.ReaderAt)
+	if !ok {
+		return 0, errors.New("underlying reader does not support ReadAt")
+	}
+	return readerAt.ReadAt(p, off)
+}
+
 func (r *hashCheckerReader) Read(p []byte) (int, error) {
 	if r.err != nil {
 		return 0, r.err
@@ -0,0 +1,306 @@
+package content
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+// ErrInvalidRange is returned by Rewrite for ranges that are negative, out of
+// order, or overlapping.
+var ErrInvalidRange = errors.New("invalid range")
+
+// Range is a span of bytes of content.
+type Range struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// End returns the offset following the range.
+func (r Range) End() int64 {
+	return r.Offset + r.Length
+}
+
+// Rewrite returns a link to the content of existing with each range of
+// changes overwritten by the next Length bytes of newData. Ranges must be in
+// order and not overlap; ranges past the end of the content extend it, with
+// any gap filled with zeros.
+//
+// Only the blocks overlapping a change are read and re-chunked. The entries of
+// the block list of existing for unchanged spans are reused as-is, so no
+// unchanged data is read or written. The returned link has no Expected hash
+// of the whole content as computing one would require reading it all.
+func Rewrite(existing ContentLink, changes []Range, newData io.Reader, store storage.Storage, slotService slots.Slots, opts WriterOptions) (ContentLink, error) {
+	for i, change := range changes {
+		if change.Offset < 0 || change.Length < 0 || (i > 0 && change.Offset < changes[i-1].End()) {
+			return ContentLink{}, fmt.Errorf("%w: %d+%d", ErrInvalidRange, change.Offset, change.Length)
+		}
+	}
+	changes = slices.DeleteFunc(slices.Clone(changes), func(r Range) bool { return r.Length == 0 })
+	if len(changes) == 0 {
+		return existing, nil
+	}
+
+	items, err := leafItems(existing, store, slotService)
+	if err != nil {
+		return ContentLink{}, err
+	}
+
+	rs := newRetryingStorage(context.Background(), store, opts)
+	link, err := rewrite(items, changes, newData, rs, slotService, opts)
+	if err != nil {
+		if blocks := rs.blocks(); len(blocks) > 0 {
+			return ContentLink{}, &PartialWriteError{Blocks: blocks, Err: err}
+		}
+		return ContentLink{}, err
+	}
+	return link, nil
+}
+
+func rewrite(items []BlockListItem, changes []Range, newData io.Reader, store storage.Storage, slotService slots.Slots, opts WriterOptions) (ContentLink, error) {
+	sharedKey, err := sharedKeyFor(opts)
+	if err != nil {
+		return ContentLink{}, err
+	}
+
+	// Find the items overlapped by a change. The last item is rewritten with
+	// changes past the end so appends do not accumulate small blocks.
+	starts := make([]int64, len(items)+1)
+	for i, item := range items {
+		starts[i+1] = starts[i] + int64(item.Size)
+	}
+	size := starts[len(items)]
+	end := max(size, changes[len(changes)-1].End())
+	affected := make([]bool, len(items))
+	for i := range items {
+		for _, change := range changes {
+			if change.Offset < starts[i+1] && change.End() > starts[i] {
+				affected[i] = true
+			}
+		}
+	}
+	if end > size && len(items) > 0 {
+		affected[len(items)-1] = true
+	}
+
+	// Rewrite each run of affected items, or the whole content if it is empty
+	var result []BlockListItem
+	rewriteRegion := func(items []BlockListItem, start, end int64) error {
+		old := &itemsReader{items: items, store: store, slotService: slotService}
+		defer old.Close()
+		written, err := split(&overlayReader{old: old, new: newData, changes: changes, pos: start, end: end}, store, opts, sharedKey)
+		if err != nil {
+			return err
+		}
+		for _, item := range written {
+			if item.Size > 0 {
+				result = append(result, item)
+			}
+		}
+		return nil
+	}
+	if len(items) == 0 {
+		if err := rewriteRegion(nil, 0, end); err != nil {
+			return ContentLink{}, err
+		}
+	}
+	for i := 0; i < len(items); {
+		if !affected[i] {
+			result = append(result, items[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(items) && affected[j] {
+			j++
+		}
+		regionEnd := starts[j]
+		if j == len(items) {
+			regionEnd = end
+		}
+		if err := rewriteRegion(items[i:j], starts[i], regionEnd); err != nil {
+			return ContentLink{}, err
+		}
+		i = j
+	}
+
+	switch len(result) {
+	case 0:
+		return writeBlock([]byte{}, store, opts, sharedKey)
+	case 1:
+		return result[0].Content, nil
+	}
+	return writeBlockList(result, store, opts, sharedKey, "")
+}
+
+// leafItems returns the blocks of link, following nested block lists. Content
+// without a block list is a single item.
+func leafItems(link ContentLink, store storage.Storage, slotService slots.Slots) ([]BlockListItem, error) {
+	if link.Address == "" {
+		return nil, nil
+	}
+	if len(link.Transforms) == 0 || link.Transforms[len(link.Transforms)-1].Kind != "Blocks" {
+		rc, err := Read(link, store, slotService)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		n, err := io.Copy(io.Discard, rc)
+		if err != nil {
+			return nil, err
+		}
+		return []BlockListItem{{Content: link, Size: uint64(n)}}, nil
+	}
+
+	listLink := link
+	listLink.Transforms = link.Transforms[:len(link.Transforms)-1]
+	listLink.Expected = ""
+	rc, err := Read(listLink, store, slotService)
+	if err != nil {
+		return nil, err
+	}
+	var list BlockList
+	err = json.NewDecoder(rc).Decode(&list)
+	rc.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse block list: %w", err)
+	}
+
+	var result []BlockListItem
+	for _, item := range list.Blocks {
+		if n := len(item.Content.Transforms); n > 0 && item.Content.Transforms[n-1].Kind == "Blocks" {
+			nested, err := leafItems(item.Content, store, slotService)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, nested...)
+			continue
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+// itemsReader reads the content of items in order, opening each as it is
+// reached.
+type itemsReader struct {
+	items       []BlockListItem
+	store       storage.Storage
+	slotService slots.Slots
+	current     io.ReadCloser
+}
+
+func (r *itemsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.items) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := Read(r.items[0].Content, r.store, r.slotService)
+			if err != nil {
+				return 0, err
+			}
+			r.current = rc
+			r.items = r.items[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *itemsReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// overlayReader reads the span from pos to end of the old content with the
+// changes in the span read from new instead. The old content is read past the
+// changes to stay aligned and is extended with zeros.
+type overlayReader struct {
+	old     io.ReadCloser
+	new     io.Reader
+	changes []Range
+	pos     int64
+	end     int64
+	oldEOF  bool
+}
+
+func (r *overlayReader) Read(p []byte) (int, error) {
+	if r.pos >= r.end {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), r.end-r.pos)]
+
+	// Skip the changes that have been read
+	for len(r.changes) > 0 && r.changes[0].End() <= r.pos {
+		r.changes = r.changes[1:]
+	}
+
+	if len(r.changes) > 0 && r.changes[0].Offset <= r.pos {
+		change := r.changes[0]
+		p = p[:min(int64(len(p)), change.End()-r.pos)]
+		n, err := io.ReadFull(r.new, p)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, fmt.Errorf("new data ended before the range %d+%d: %w", change.Offset, change.Length, io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := r.discardOld(int64(n)); err != nil {
+			return n, err
+		}
+		r.pos += int64(n)
+		return n, nil
+	}
+
+	if len(r.changes) > 0 {
+		p = p[:min(int64(len(p)), r.changes[0].Offset-r.pos)]
+	}
+	n, err := r.readOld(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+// readOld fills p from the old content, or with zeros past its end.
+func (r *overlayReader) readOld(p []byte) (int, error) {
+	if !r.oldEOF {
+		n, err := r.old.Read(p)
+		if err == io.EOF {
+			r.oldEOF = true
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	clear(p)
+	return len(p), nil
+}
+
+func (r *overlayReader) discardOld(n int64) error {
+	if r.oldEOF {
+		return nil
+	}
+	_, err := io.CopyN(io.Discard, r.old, n)
+	if err == io.EOF {
+		r.oldEOF = true
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package content_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"invariant/internal/content"
+	"invariant/internal/storage"
+)
+
+// countingStorage counts the blocks stored.
+type countingStorage struct {
+	storage.Storage
+	stored int
+}
+
+func (s *countingStorage) Store(ctx context.Context, r io.Reader) (string, error) {
+	s.stored++
+	return s.Storage.Store(ctx, r)
+}
+
+func readAll(t *testing.T, link content.ContentLink, store storage.Storage) []byte {
+	t.Helper()
+	rc, err := content.Read(link, store, nil)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	return data
+}
+
+func TestRewrite(t *testing.T) {
+	store := &countingStorage{Storage: storage.NewInMemoryStorage()}
+	data := make([]byte, 8*1024*1024)
+	rand.Read(data)
+
+	link, err := content.Write(bytes.NewReader(data), store, content.WriterOptions{})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	written := store.stored
+
+	// Overwrite two small spans in the middle
+	changes := []content.Range{{Offset: 3000000, Length: 5}, {Offset: 3000010, Length: 3}}
+	expected := bytes.Clone(data)
+	copy(expected[3000000:], "hello")
+	copy(expected[3000010:], "abc")
+	store.stored = 0
+	rewritten, err := content.Rewrite(link, changes, bytes.NewReader([]byte("helloabc")), store, nil, content.WriterOptions{})
+	if err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	if !bytes.Equal(readAll(t, rewritten, store), expected) {
+		t.Fatalf("Rewritten content does not match")
+	}
+	if store.stored >= written {
+		t.Errorf("Expected fewer than %d blocks to be stored, got %d", written, store.stored)
+	}
+
+	// Extend past the end with a gap of zeros
+	expected = append(expected, make([]byte, 100)...)
+	expected = append(expected, "tail"...)
+	rewritten, err = content.Rewrite(rewritten, []content.Range{{Offset: int64(len(data)) + 100, Length: 4}}, bytes.NewReader([]byte("tail")), store, nil, content.WriterOptions{})
+	if err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	if !bytes.Equal(readAll(t, rewritten, store), expected) {
+		t.Fatalf("Extended content does not match")
+	}
+
+	// Rewriting empty content writes the new data
+	rewritten, err = content.Rewrite(content.ContentLink{}, []content.Range{{Offset: 2, Length: 3}}, bytes.NewReader([]byte("abc")), store, nil, content.WriterOptions{})
+	if err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	if got := readAll(t, rewritten, store); !bytes.Equal(got, []byte("\x00\x00abc")) {
+		t.Fatalf("Expected %q, got %q", "\x00\x00abc", got)
+	}
+
+	// Overlapping ranges are rejected
+	_, err = content.Rewrite(link, []content.Range{{Offset: 10, Length: 5}, {Offset: 12, Length: 1}}, bytes.NewReader(nil), store, nil, content.WriterOptions{})
+	if !errors.Is(err, content.ErrInvalidRange) {
+		t.Errorf("Expected ErrInvalidRange, got %v", err)
+	}
+
+	// Encrypted content keeps its keys
+	opts := content.WriterOptions{EncryptAlgorithm: "aes-256-cbc", KeyPolicy: content.Deterministic}
+	link, err = content.Write(bytes.NewReader(data), store, opts)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	rewritten, err = content.Rewrite(link, []content.Range{{Offset: 0, Length: 4}}, bytes.NewReader([]byte("head")), store, nil, opts)
+	if err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	expected = bytes.Clone(data)
+	copy(expected, "head")
+	if !bytes.Equal(readAll(t, rewritten, store), expected) {
+		t.Fatalf("Rewritten encrypted content does not match")
+	}
+}
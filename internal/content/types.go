@@ -9,6 +9,11 @@ type ContentLink struct {
 	Transforms []ContentTransform `json:"transforms,omitempty"`
 	Expected   string             `json:"expected,omitempty"`
 	Primary    string             `json:"primary,omitempty"`
+
+	// Inline is the content itself, held in the link in place of a block.
+	// The address of an inline link is the address the content would have
+	// as a block, and it has no transforms.
+	Inline []byte `json:"inline,omitempty"`
 }
 
 // ContentTransform defines a transformation to apply to content during retrieval.
@@ -13,6 +13,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"time"
 
 	"invariant/internal/storage"
 )
@@ -35,6 +36,17 @@ type WriterOptions struct {
 	Filename          string     // Optional original filename for splitter detection
 	ContentType       string     // Optional content type for splitter detection
 	Splitters         []Splitter // Configurable stream splitters
+
+	// Retries is the number of times storing a block is retried, with the
+	// delay doubling from RetryDelay between attempts. Zero uses the defaults
+	// of 3 retries from 100ms; a negative value disables retries.
+	Retries    int
+	RetryDelay time.Duration
+
+	// InlineMax is the largest content, in bytes, held in the link returned
+	// by Write instead of a block. Empty and encrypted content is never
+	// inlined. Zero disables inlining.
+	InlineMax int
 }
 
 const (
@@ -45,48 +57,53 @@ const (
 // Write reads from r, splits it into ~1MB blocks using a rolling hash,
 // applies compression and encryption according to opts,
 // writes the blocks to store, and returns a ContentLink to the root block (or block list).
+// r is streamed: each block is stored as soon as it has been read, so only
+// the block being read is held in memory however large the content is.
+// Failed block stores are retried; if the write still fails after some blocks
+// were stored, a *PartialWriteError listing them is returned.
 func Write(r io.Reader, store storage.Storage, opts WriterOptions) (ContentLink, error) {
-	var sharedKey []byte
-	switch opts.KeyPolicy {
-	case RandomAllKey:
-		sharedKey = make([]byte, 32)
-		if _, err := io.ReadFull(rand.Reader, sharedKey); err != nil {
+	return WriteContext(context.Background(), r, store, opts)
+}
+
+// WriteContext is Write storing the blocks with ctx. Once ctx is done, a
+// failed block store is no longer retried.
+func WriteContext(ctx context.Context, r io.Reader, store storage.Storage, opts WriterOptions) (ContentLink, error) {
+	if opts.InlineMax > 0 && opts.EncryptAlgorithm == "" {
+		head, err := io.ReadAll(io.LimitReader(r, int64(opts.InlineMax)+1))
+		if err != nil {
 			return ContentLink{}, err
 		}
-	case SuppliedAllKey:
-		if len(opts.SuppliedKey) != 32 {
-			return ContentLink{}, fmt.Errorf("SuppliedKey must be 32 bytes for aes-256-cbc")
+		if len(head) > 0 && len(head) <= opts.InlineMax {
+			return Inline(head), nil
 		}
-		sharedKey = opts.SuppliedKey
+		r = io.MultiReader(bytes.NewReader(head), r)
 	}
 
-	head := make([]byte, 1024)
-	n, err := io.ReadFull(r, head)
-	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-		return ContentLink{}, err
-	}
-	head = head[:n]
-
-	var selectedSplitter Splitter = &BuzHashSplitter{}
-	for _, s := range opts.Splitters {
-		if s.Match(head, opts.Filename, opts.ContentType) {
-			selectedSplitter = s
-			break
+	rs := newRetryingStorage(ctx, store, opts)
+	link, err := write(r, rs, opts)
+	if err != nil {
+		if blocks := rs.blocks(); len(blocks) > 0 {
+			return ContentLink{}, &PartialWriteError{Blocks: blocks, Err: err}
 		}
+		return ContentLink{}, err
 	}
+	return link, nil
+}
 
-	overallHasher := sha256.New()
-	teeReader := io.TeeReader(io.MultiReader(bytes.NewReader(head), r), overallHasher)
-
-	writeChunk := func(chunk []byte) (ContentLink, error) {
-		return writeBlock(chunk, store, opts, sharedKey)
-	}
+// Inline returns a link holding data itself.
+func Inline(data []byte) ContentLink {
+	hash := sha256.Sum256(data)
+	return ContentLink{Address: hex.EncodeToString(hash[:]), Inline: data}
+}
 
-	writeStream := func(inner io.Reader, innerOpts WriterOptions) (ContentLink, error) {
-		return Write(inner, store, innerOpts)
+func write(r io.Reader, store storage.Storage, opts WriterOptions) (ContentLink, error) {
+	sharedKey, err := sharedKeyFor(opts)
+	if err != nil {
+		return ContentLink{}, err
 	}
 
-	blocks, err := selectedSplitter.Split(teeReader, opts, writeChunk, writeStream)
+	overallHasher := sha256.New()
+	blocks, err := split(io.TeeReader(r, overallHasher), store, opts, sharedKey)
 	if err != nil {
 		return ContentLink{}, err
 	}
@@ -115,6 +132,54 @@ func Write(r io.Reader, store storage.Storage, opts WriterOptions) (ContentLink,
 	return writeBlockList(blocks, store, opts, sharedKey, hex.EncodeToString(overallHasher.Sum(nil)))
 }
 
+// sharedKeyFor returns the key shared by every block for the key policy of
+// opts, or nil if each block has its own key.
+func sharedKeyFor(opts WriterOptions) ([]byte, error) {
+	switch opts.KeyPolicy {
+	case RandomAllKey:
+		sharedKey := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, sharedKey); err != nil {
+			return nil, err
+		}
+		return sharedKey, nil
+	case SuppliedAllKey:
+		if len(opts.SuppliedKey) != 32 {
+			return nil, fmt.Errorf("SuppliedKey must be 32 bytes for aes-256-cbc")
+		}
+		return opts.SuppliedKey, nil
+	}
+	return nil, nil
+}
+
+// split splits r into blocks with the splitter selected by opts and writes
+// them to store.
+func split(r io.Reader, store storage.Storage, opts WriterOptions, sharedKey []byte) ([]BlockListItem, error) {
+	head := make([]byte, 1024)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	var selectedSplitter Splitter = &BuzHashSplitter{}
+	for _, s := range opts.Splitters {
+		if s.Match(head, opts.Filename, opts.ContentType) {
+			selectedSplitter = s
+			break
+		}
+	}
+
+	writeChunk := func(chunk []byte) (ContentLink, error) {
+		return writeBlock(chunk, store, opts, sharedKey)
+	}
+
+	writeStream := func(inner io.Reader, innerOpts WriterOptions) (ContentLink, error) {
+		return write(inner, store, innerOpts)
+	}
+
+	return selectedSplitter.Split(io.MultiReader(bytes.NewReader(head), r), opts, writeChunk, writeStream)
+}
+
 func writeBlockList(items []BlockListItem, store storage.Storage, opts WriterOptions, sharedKey []byte, overallExpectedHash string) (ContentLink, error) {
 	// A JSON block list might exceed 1MB if there are many items.
 	// We'll recursively split if it's too large.
@@ -129,6 +194,14 @@ func writeBlockList(items []BlockListItem, store storage.Storage, opts WriterOpt
 		if err != nil {
 			return ContentLink{}, err
 		}
+		// A deterministic key equal to the hash of the list is omitted by
+		// writeBlock. Keep it as Expected is replaced by the hash of the content.
+		for i, t := range link.Transforms {
+			if t.Kind == "Decipher" && t.Key == "" {
+				link.Transforms[i].Key = link.Expected
+			}
+		}
+
 		// Append 'Blocks' transform so it runs last
 		link.Transforms = append(link.Transforms, ContentTransform{Kind: "Blocks"})
 
@@ -0,0 +1,148 @@
+package discovery
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// AddressLabelsEnvVar names the environment variable listing the labels of
+// the addresses a Client prefers, most preferred first and comma separated,
+// such as "lan,overlay".
+const AddressLabelsEnvVar = "INVARIANT_ADDRESS_LABELS"
+
+// AddressPreference selects the address a client uses to reach a service
+// registered with several. An address on the same subnet as this host is
+// preferred, then the addresses labeled with Labels in order, then the
+// addresses in the order they were registered.
+type AddressPreference struct {
+	// Labels are the preferred labels, most preferred first.
+	Labels []string
+	// Local are the networks of this host. Addresses whose host is in one
+	// of them, or is a loopback address, are preferred over any other.
+	Local []*net.IPNet
+}
+
+// DefaultAddressPreference prefers the subnets of the interfaces of this
+// host and the labels listed by the AddressLabelsEnvVar environment
+// variable.
+func DefaultAddressPreference() AddressPreference {
+	var p AddressPreference
+	for label := range strings.SplitSeq(os.Getenv(AddressLabelsEnvVar), ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			p.Labels = append(p.Labels, label)
+		}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+				p.Local = append(p.Local, ipNet)
+			}
+		}
+	}
+	return p
+}
+
+// Select returns desc with Address set to its preferred address. A
+// description without Addresses is returned unchanged.
+func (p AddressPreference) Select(desc ServiceDescription) ServiceDescription {
+	best, bestRank := "", -1
+	for i, a := range desc.Addresses {
+		if rank := p.rank(a, len(desc.Addresses)-i); rank > bestRank {
+			best, bestRank = a.Address, rank
+		}
+	}
+	if best != "" {
+		desc.Address = best
+	}
+	return desc
+}
+
+// rank orders a: local addresses first, then by label, then by order, which
+// is given as the number of addresses from a to the last.
+func (p AddressPreference) rank(a ServiceAddress, order int) int {
+	rank := order
+	for i, label := range p.Labels {
+		if a.Label == label {
+			rank += (len(p.Labels) - i) * 1000
+			break
+		}
+	}
+	if p.isLocal(a.Address) {
+		rank += 1000000
+	}
+	return rank
+}
+
+func (p AddressPreference) isLocal(address string) bool {
+	u, err := url.Parse(address)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, n := range p.Local {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAdvertiseAddresses parses a comma separated list of addresses, each
+// optionally prefixed with its label as in "lan=http://10.0.0.5", completing
+// each with port as AdvertiseAddress does. The first address is the primary
+// address of the service.
+func ParseAdvertiseAddresses(advertise string, port int) ([]ServiceAddress, error) {
+	var addresses []ServiceAddress
+	for item := range strings.SplitSeq(advertise, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		var label string
+		if l, rest, ok := strings.Cut(item, "="); ok && !strings.Contains(l, "/") {
+			label, item = l, rest
+		}
+		address, err := AdvertiseAddress(item, port)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, ServiceAddress{Address: address, Label: label})
+	}
+	if len(addresses) == 0 {
+		address, err := AdvertiseAddress("", port)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, ServiceAddress{Address: address})
+	}
+	return addresses, nil
+}
+
+// AdvertiseRegistration returns the registration of a service advertising
+// the addresses parsed by ParseAdvertiseAddresses, with a TTL of
+// RegistrationTTL. Addresses is only set if there are several, or the
+// address is labeled.
+func AdvertiseRegistration(id, advertise string, port int, protocols []string) (ServiceRegistration, error) {
+	addresses, err := ParseAdvertiseAddresses(advertise, port)
+	if err != nil {
+		return ServiceRegistration{}, err
+	}
+	reg := ServiceRegistration{ID: id, Address: addresses[0].Address, Protocols: protocols, TTL: int(RegistrationTTL / time.Second)}
+	if len(addresses) > 1 || addresses[0].Label != "" {
+		reg.Addresses = addresses
+	}
+	return reg, nil
+}
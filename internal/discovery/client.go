@@ -4,40 +4,99 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"invariant/internal/httputil"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
 // Client implements the Discovery interface by forwarding requests to a remote HTTP server.
 type Client struct {
-	baseURL    string
+	baseURLs   []string
+	current    atomic.Int64 // index of the last base URL that responded
 	httpClient *http.Client
+	preference AddressPreference
 }
 
-// NewClient creates a new HTTP discovery client.
+// NewClient creates a new HTTP discovery client. baseURL may be a comma
+// separated list of the URLs of discovery services; if one of them cannot be
+// reached, or fails with a server error, the request is retried with the next.
+// The last URL that responded is tried first by later requests.
 func NewClient(baseURL string, httpClient *http.Client) *Client {
 	if httpClient == nil {
 		httpClient = http.DefaultClient
 	}
 	httpClient = httputil.NewDiagnosticClient(httpClient)
+
+	var baseURLs []string
+	for u := range strings.SplitSeq(baseURL, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			baseURLs = append(baseURLs, strings.TrimSuffix(u, "/"))
+		}
+	}
+	if len(baseURLs) == 0 {
+		baseURLs = []string{baseURL}
+	}
+
 	return &Client{
-		baseURL:    baseURL,
+		baseURLs:   baseURLs,
 		httpClient: httpClient,
+		preference: DefaultAddressPreference(),
 	}
 }
 
-// Get retrieves the service description for the given ID.
-func (c *Client) Get(ctx context.Context, id string) (ServiceDescription, bool) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s", c.baseURL, id), nil)
-	if err != nil {
-		return ServiceDescription{}, false
+// WithAddressPreference sets how the address of a service registered with
+// several is selected. By default the addresses on a subnet of this host are
+// preferred, then those with the labels listed by AddressLabelsEnvVar.
+func (c *Client) WithAddressPreference(p AddressPreference) *Client {
+	c.preference = p
+	return c
+}
+
+// do sends the request created by newRequest to each discovery service in
+// turn, starting with the last one that responded, until one is reached that
+// does not fail with a server error.
+func (c *Client) do(ctx context.Context, newRequest func(baseURL string) (*http.Request, error)) (*http.Response, error) {
+	start := int(c.current.Load())
+	var lastErr error
+	for i := range c.baseURLs {
+		index := (start + i) % len(c.baseURLs)
+		req, err := newRequest(c.baseURLs[index])
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if resp.StatusCode >= http.StatusInternalServerError && i < len(c.baseURLs)-1 {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+			continue
+		}
+
+		c.current.Store(int64(index))
+		return resp, nil
 	}
+	return nil, lastErr
+}
 
-	resp, err := c.httpClient.Do(req)
+// Get retrieves the service description for the given ID, with its Address
+// set to the preferred of its addresses.
+func (c *Client) Get(ctx context.Context, id string) (ServiceDescription, bool) {
+	resp, err := c.do(ctx, func(baseURL string) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s", baseURL, id), nil)
+	})
 	if err != nil || resp.StatusCode != http.StatusOK {
 		if resp != nil {
 			resp.Body.Close()
@@ -51,27 +110,24 @@ func (c *Client) Get(ctx context.Context, id string) (ServiceDescription, bool)
 		return ServiceDescription{}, false
 	}
 
-	return desc, true
+	return c.preference.Select(desc), true
 }
 
 // Find searches for services by protocol up to a certain count.
 func (c *Client) Find(ctx context.Context, protocol string, count int) ([]ServiceDescription, error) {
-	u, err := url.Parse(fmt.Sprintf("%s/", c.baseURL))
-	if err != nil {
-		return nil, err
-	}
-
-	q := u.Query()
-	q.Set("protocol", protocol)
-	q.Set("count", strconv.Itoa(count))
-	u.RawQuery = q.Encode()
+	resp, err := c.do(ctx, func(baseURL string) (*http.Request, error) {
+		u, err := url.Parse(fmt.Sprintf("%s/", baseURL))
+		if err != nil {
+			return nil, err
+		}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
+		q := u.Query()
+		q.Set("protocol", protocol)
+		q.Set("count", strconv.Itoa(count))
+		u.RawQuery = q.Encode()
 
-	resp, err := c.httpClient.Do(req)
+		return http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -85,18 +141,39 @@ func (c *Client) Find(ctx context.Context, protocol string, count int) ([]Servic
 	if err := json.NewDecoder(resp.Body).Decode(&descs); err != nil {
 		return nil, err
 	}
+	for i := range descs {
+		descs[i] = c.preference.Select(descs[i])
+	}
 
 	return descs, nil
 }
 
-// Register registers a new service.
+// Register registers a new service with every discovery service so that it
+// can still be found if one of them is lost. It succeeds if at least one of
+// them accepted the registration.
 func (c *Client) Register(ctx context.Context, reg ServiceRegistration) error {
 	data, err := json.Marshal(reg)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s/%s", c.baseURL, reg.ID), bytes.NewReader(data))
+	var errs []error
+	for _, baseURL := range c.baseURLs {
+		if err := c.register(ctx, baseURL, reg.ID, data); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", baseURL, err))
+		}
+	}
+	if len(errs) == len(c.baseURLs) {
+		if len(errs) == 1 {
+			return errors.Unwrap(errs[0])
+		}
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+func (c *Client) register(ctx context.Context, baseURL, id string, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s/%s", baseURL, id), bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
@@ -116,5 +193,40 @@ func (c *Client) Register(ctx context.Context, reg ServiceRegistration) error {
 	return nil
 }
 
-// Assert that Client implements the Discovery interface
-var _ Discovery = (*Client)(nil)
+// Renew renews the registration of the service with id with every discovery
+// service. It reports false if one of them no longer has the registration, so
+// the service should register again.
+func (c *Client) Renew(ctx context.Context, id string) (bool, error) {
+	renewed := false
+	var errs []error
+	for _, baseURL := range c.baseURLs {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s/%s/renew", baseURL, id), nil)
+		if err != nil {
+			return false, err
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", baseURL, err))
+			continue
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			renewed = true
+		case http.StatusNotFound:
+			return false, nil
+		default:
+			errs = append(errs, fmt.Errorf("%s: unexpected status code: %d", baseURL, resp.StatusCode))
+		}
+	}
+	if !renewed {
+		return false, errors.Join(errs...)
+	}
+	return true, nil
+}
+
+// Assert that Client implements the Discovery and Renewer interfaces
+var (
+	_ Discovery = (*Client)(nil)
+	_ Renewer   = (*Client)(nil)
+)
@@ -2,6 +2,8 @@ package discovery
 
 import (
 	"context"
+	"net"
+	"net/http"
 	"net/http/httptest"
 	"testing"
 )
@@ -60,3 +62,79 @@ func TestClient(t *testing.T) {
 		t.Fatal("Expected Get to return false for non-existent service")
 	}
 }
+
+func TestClient_Failover(t *testing.T) {
+	ctx := context.Background()
+
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	live := NewInMemoryDiscovery()
+	ts := httptest.NewServer(NewDiscoveryServer(live).Handler())
+	defer ts.Close()
+
+	client := NewClient(dead.URL+","+failing.URL+", "+ts.URL+"/", nil)
+
+	reg := ServiceRegistration{ID: "failover-id", Address: "http://failover:8081", Protocols: []string{"failover-v1"}}
+	if err := client.Register(ctx, reg); err != nil {
+		t.Fatalf("Expected Register to succeed with one live discovery service: %v", err)
+	}
+	if _, ok := live.Get(ctx, reg.ID); !ok {
+		t.Fatal("Expected the live discovery service to have the registration")
+	}
+
+	if desc, ok := client.Get(ctx, reg.ID); !ok || desc.Address != reg.Address {
+		t.Fatalf("Expected Get to fail over to the live discovery service, got %v (ok: %t)", desc, ok)
+	}
+	results, err := client.Find(ctx, "failover-v1", 1)
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Expected Find to fail over to the live discovery service, got %v (err: %v)", results, err)
+	}
+
+	// Every discovery service unavailable
+	if err := NewClient(dead.URL, nil).Register(ctx, reg); err == nil {
+		t.Fatal("Expected Register to fail without a live discovery service")
+	}
+}
+
+func TestClient_AddressPreference(t *testing.T) {
+	server := NewDiscoveryServer(NewInMemoryDiscovery())
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	reg, err := AdvertiseRegistration("multi-id", "wan=http://203.0.113.7,lan=http://10.1.2.3,overlay=http://100.64.0.9:9000", 3000, []string{"multi-protocol"})
+	if err != nil {
+		t.Fatalf("AdvertiseRegistration error: %v", err)
+	}
+	if reg.Address != "http://203.0.113.7:3000" || len(reg.Addresses) != 3 || reg.Addresses[2].Address != "http://100.64.0.9:9000" {
+		t.Fatalf("Unexpected registration %+v", reg)
+	}
+	client := NewClient(ts.URL, ts.Client()).WithAddressPreference(AddressPreference{})
+	if err := client.Register(context.Background(), reg); err != nil {
+		t.Fatalf("Register error: %v", err)
+	}
+
+	// Without a preference the first address is used
+	desc, ok := client.Get(context.Background(), "multi-id")
+	if !ok || desc.Address != "http://203.0.113.7:3000" || len(desc.Addresses) != 3 {
+		t.Fatalf("Unexpected description %+v", desc)
+	}
+
+	// A preferred label is used over the order of the addresses
+	client.WithAddressPreference(AddressPreference{Labels: []string{"missing", "overlay", "lan"}})
+	results, err := client.Find(context.Background(), "multi-protocol", 1)
+	if err != nil || len(results) != 1 || results[0].Address != "http://100.64.0.9:9000" {
+		t.Fatalf("Expected the overlay address, got %+v %v", results, err)
+	}
+
+	// An address on a local subnet is used over any label
+	_, local, _ := net.ParseCIDR("10.1.0.0/16")
+	client.WithAddressPreference(AddressPreference{Labels: []string{"overlay"}, Local: []*net.IPNet{local}})
+	desc, ok = client.Get(context.Background(), "multi-id")
+	if !ok || desc.Address != "http://10.1.2.3:3000" {
+		t.Fatalf("Expected the lan address, got %+v", desc)
+	}
+}
@@ -2,23 +2,53 @@ package discovery
 
 import "context"
 
-// ServiceDescription describes a registered service.
+// ServiceDescription describes a registered service. A service reachable on
+// several networks lists all of its addresses in Addresses; Address is the
+// first of them, or the one a Client preferred (see AddressPreference).
 type ServiceDescription struct {
-	ID        string   `json:"id"`
-	Address   string   `json:"address"`
-	Protocols []string `json:"protocols"`
+	ID        string            `json:"id"`
+	Address   string            `json:"address"`
+	Addresses []ServiceAddress  `json:"addresses,omitempty"`
+	Protocols []string          `json:"protocols"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// ServiceAddress is one of the addresses of a service, labeled with the
+// network it is reached on, such as "lan", "wan" or "overlay".
+type ServiceAddress struct {
+	Address string `json:"address"`
+	Label   string `json:"label,omitempty"`
 }
 
 // ServiceRegistration is the payload used to register a service.
+// Metadata holds optional properties of the service, such as the capacity of
+// a storage service (see MetadataCapacity). TTL is the number of seconds the
+// registration lasts unless it is renewed, by Renew or by registering again,
+// so services that die are no longer found; zero never expires.
 type ServiceRegistration struct {
-	ID        string   `json:"id"`
-	Address   string   `json:"address"`
-	Protocols []string `json:"protocols"`
+	ID        string            `json:"id"`
+	Address   string            `json:"address"`
+	Addresses []ServiceAddress  `json:"addresses,omitempty"`
+	Protocols []string          `json:"protocols"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	TTL       int               `json:"ttl,omitempty"`
 }
 
+// MetadataCapacity is the metadata key of the capacity, in bytes, of a
+// storage service.
+const MetadataCapacity = "capacity"
+
 // Discovery dictates the necessary requirements for the discovery service.
 type Discovery interface {
 	Get(ctx context.Context, id string) (ServiceDescription, bool)
 	Find(ctx context.Context, protocol string, count int) ([]ServiceDescription, error)
 	Register(ctx context.Context, reg ServiceRegistration) error
 }
+
+// Renewer is implemented by discovery services whose registrations expire.
+type Renewer interface {
+	// Renew extends the registration of the service with id by its TTL. It
+	// reports false if the service is not registered, such as after its
+	// registration expired, in which case it must register again.
+	Renew(ctx context.Context, id string) (bool, error)
+}
@@ -2,19 +2,36 @@ package discovery
 
 import (
 	"context"
+	"maps"
 	"os"
 	"slices"
+	"sync"
 	"time"
 
 	"invariant/internal/journal"
 )
 
-// Assert that FileSystemDiscovery implements the Discovery interface
-var _ Discovery = (*FileSystemDiscovery)(nil)
+// Assert that FileSystemDiscovery implements the Discovery and Renewer interfaces
+var (
+	_ Discovery = (*FileSystemDiscovery)(nil)
+	_ Renewer   = (*FileSystemDiscovery)(nil)
+)
 
 type FileSystemDiscovery struct {
-	store   *journal.Store[string, ServiceRegistration]
+	store   *journal.Store[string, storedRegistration]
 	tracker *HealthTracker
+	now     func() time.Time
+	stop    chan struct{} // closed to stop removing expired registrations
+
+	mu    sync.Mutex // guards index
+	index *protocolIndex
+}
+
+// storedRegistration is a registration as it is journaled, with the time its
+// TTL passes so a restarted service does not extend it.
+type storedRegistration struct {
+	ServiceRegistration
+	Expires time.Time `json:"expires,omitzero"`
 }
 
 func NewFileSystemDiscovery(baseDir string, snapshotInterval time.Duration) (*FileSystemDiscovery, error) {
@@ -22,14 +39,21 @@ func NewFileSystemDiscovery(baseDir string, snapshotInterval time.Duration) (*Fi
 		return nil, err
 	}
 
-	store, err := journal.NewStore[string, ServiceRegistration](baseDir, snapshotInterval)
+	store, err := journal.NewStore[string, storedRegistration](baseDir, snapshotInterval)
 	if err != nil {
 		return nil, err
 	}
 
 	d := &FileSystemDiscovery{
 		store: store,
+		index: newProtocolIndex(),
+		now:   time.Now,
 	}
+	store.Read(func(m map[string]storedRegistration) {
+		for _, reg := range m {
+			d.index.add(reg.ServiceRegistration)
+		}
+	})
 
 	return d, nil
 }
@@ -41,32 +65,95 @@ func (d *FileSystemDiscovery) WithHealthTracking(interval, timeout time.Duration
 
 	listFn := func() []ServiceRegistration {
 		var res []ServiceRegistration
-		d.store.Read(func(m map[string]ServiceRegistration) {
+		d.store.Read(func(m map[string]storedRegistration) {
 			for _, r := range m {
-				res = append(res, r)
+				res = append(res, r.ServiceRegistration)
 			}
 		})
 		return res
 	}
 
 	removeFn := func(id string) {
-		d.store.Delete(id, nil)
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.removeLocked(id)
 	}
 
 	d.tracker = NewHealthTracker(interval, timeout, listFn, removeFn)
 	return d
 }
 
+// WithExpiry removes the registrations whose TTL has passed every interval,
+// as InMemoryDiscovery.WithExpiry does. Expired registrations are never
+// returned by Get or Find, even before they are removed.
+func (d *FileSystemDiscovery) WithExpiry(interval time.Duration) *FileSystemDiscovery {
+	if d.stop != nil {
+		close(d.stop)
+	}
+	d.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				d.removeExpired()
+			}
+		}
+	}(d.stop)
+	return d
+}
+
 func (d *FileSystemDiscovery) Close() error {
 	if d.tracker != nil {
 		d.tracker.Close()
 	}
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
 	return d.store.Close()
 }
 
+// removeExpired removes the registrations whose TTL has passed.
+func (d *FileSystemDiscovery) removeExpired() {
+	var expired []string
+	d.store.Read(func(m map[string]storedRegistration) {
+		for id, reg := range m {
+			if d.expired(reg) {
+				expired = append(expired, id)
+			}
+		}
+	})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, id := range expired {
+		// The service may have registered again since
+		if reg, ok := d.store.Get(id); ok && d.expired(reg) {
+			d.removeLocked(id)
+		}
+	}
+}
+
+// expired reports whether the TTL of reg has passed.
+func (d *FileSystemDiscovery) expired(reg storedRegistration) bool {
+	return !reg.Expires.IsZero() && !d.now().Before(reg.Expires)
+}
+
+// removeLocked removes the registration of id. d.mu must be held.
+func (d *FileSystemDiscovery) removeLocked(id string) {
+	if reg, ok := d.store.Get(id); ok {
+		d.index.remove(reg.ServiceRegistration)
+	}
+	d.store.Delete(id, nil)
+}
+
 func (d *FileSystemDiscovery) Get(ctx context.Context, id string) (ServiceDescription, bool) {
 	reg, ok := d.store.Get(id)
-	if !ok {
+	if !ok || d.expired(reg) {
 		return ServiceDescription{}, false
 	}
 
@@ -76,32 +163,43 @@ func (d *FileSystemDiscovery) Get(ctx context.Context, id string) (ServiceDescri
 	return ServiceDescription{
 		ID:        reg.ID,
 		Address:   reg.Address,
+		Addresses: slices.Clone(reg.Addresses),
 		Protocols: protocolsCopy,
+		Metadata:  maps.Clone(reg.Metadata),
 	}, true
 }
 
+// Find returns up to count services supporting protocol, or all of them if
+// count is not positive. Services are selected round-robin as described by
+// InMemoryDiscovery.Find, and services whose registration expired are never
+// returned.
 func (d *FileSystemDiscovery) Find(ctx context.Context, protocol string, count int) ([]ServiceDescription, error) {
-	var results []ServiceDescription
-	d.store.Read(func(store map[string]ServiceRegistration) {
-		for _, reg := range store {
-			if protocol == "" || slices.Contains(reg.Protocols, protocol) {
-				protocolsCopy := make([]string, len(reg.Protocols))
-				copy(protocolsCopy, reg.Protocols)
-				results = append(results, ServiceDescription{
-					ID:        reg.ID,
-					Address:   reg.Address,
-					Protocols: protocolsCopy,
-				})
-				if count > 0 && len(results) >= count {
-					break
-				}
-			}
+	d.mu.Lock()
+	var healthy, unhealthy []ServiceDescription
+	d.index.next(protocol, func(id string) bool {
+		reg, ok := d.store.Get(id)
+		if !ok || d.expired(reg) {
+			return true
 		}
+		protocolsCopy := make([]string, len(reg.Protocols))
+		copy(protocolsCopy, reg.Protocols)
+		desc := ServiceDescription{
+			ID:        reg.ID,
+			Address:   reg.Address,
+			Addresses: slices.Clone(reg.Addresses),
+			Protocols: protocolsCopy,
+			Metadata:  maps.Clone(reg.Metadata),
+		}
+		if d.tracker == nil || d.tracker.Healthy(id) {
+			healthy = append(healthy, desc)
+		} else {
+			unhealthy = append(unhealthy, desc)
+		}
+		return count <= 0 || len(healthy) < count
 	})
+	d.mu.Unlock()
 
-	if d.tracker != nil {
-		d.tracker.Sort(results)
-	}
+	results := append(healthy, unhealthy...)
 	if count > 0 && len(results) > count {
 		results = results[:count]
 	}
@@ -112,15 +210,59 @@ func (d *FileSystemDiscovery) Find(ctx context.Context, protocol string, count i
 func (d *FileSystemDiscovery) Register(ctx context.Context, reg ServiceRegistration) error {
 	protocolsCopy := make([]string, len(reg.Protocols))
 	copy(protocolsCopy, reg.Protocols)
-	regCopy := ServiceRegistration{
-		ID:        reg.ID,
-		Address:   reg.Address,
-		Protocols: protocolsCopy,
+	stored := storedRegistration{
+		ServiceRegistration: ServiceRegistration{
+			ID:        reg.ID,
+			Address:   reg.Address,
+			Addresses: slices.Clone(reg.Addresses),
+			Protocols: protocolsCopy,
+			Metadata:  maps.Clone(reg.Metadata),
+			TTL:       reg.TTL,
+		},
+	}
+	if reg.TTL > 0 {
+		stored.Expires = d.now().Add(time.Duration(reg.TTL) * time.Second)
+	}
+
+	d.mu.Lock()
+	old, existed := d.store.Get(reg.ID)
+	err := d.store.Put(reg.ID, stored, nil)
+	if err == nil {
+		if existed {
+			d.index.remove(old.ServiceRegistration)
+		}
+		d.index.add(stored.ServiceRegistration)
 	}
+	d.mu.Unlock()
 
-	err := d.store.Put(reg.ID, regCopy, nil)
 	if err == nil && d.tracker != nil {
 		d.tracker.MarkHealthy(reg.ID)
 	}
 	return err
 }
+
+// Renew extends the registration of the service with id by its TTL,
+// journaling the new expiry. It reports false if the service is not
+// registered or its registration expired.
+func (d *FileSystemDiscovery) Renew(ctx context.Context, id string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	reg, ok := d.store.Get(id)
+	if !ok {
+		return false, nil
+	}
+	if d.expired(reg) {
+		d.removeLocked(id)
+		return false, nil
+	}
+	if reg.TTL > 0 {
+		reg.Expires = d.now().Add(time.Duration(reg.TTL) * time.Second)
+		if err := d.store.Put(id, reg, nil); err != nil {
+			return false, err
+		}
+	}
+	if d.tracker != nil {
+		d.tracker.MarkHealthy(id)
+	}
+	return true, nil
+}
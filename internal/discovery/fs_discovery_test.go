@@ -77,3 +77,53 @@ func TestFileSystemDiscovery(t *testing.T) {
 		t.Errorf("expected address %s, got %s", reg1.Address, desc2.Address)
 	}
 }
+
+func TestFileSystemDiscovery_Expiry(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	now := time.Now()
+	d, err := NewFileSystemDiscovery(tmpDir, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create FileSystemDiscovery: %v", err)
+	}
+	d.now = func() time.Time { return now }
+
+	d.Register(ctx, ServiceRegistration{ID: "leased", Address: "http://localhost:1", Protocols: []string{"storage-v1"}, TTL: 60})
+	d.Register(ctx, ServiceRegistration{ID: "permanent", Address: "http://localhost:2", Protocols: []string{"storage-v1"}})
+
+	// Renewing extends the lease from the time of the renewal
+	now = now.Add(50 * time.Second)
+	if renewed, err := d.Renew(ctx, "leased"); err != nil || !renewed {
+		t.Fatalf("Renew: got %v %v", renewed, err)
+	}
+	d.Close()
+
+	// The expiry is kept across a restart rather than starting over
+	d, err = NewFileSystemDiscovery(tmpDir, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to reopen FileSystemDiscovery: %v", err)
+	}
+	defer d.Close()
+	d.now = func() time.Time { return now }
+	now = now.Add(50 * time.Second)
+	if _, ok := d.Get(ctx, "leased"); !ok {
+		t.Errorf("expected the renewed registration to be found")
+	}
+
+	// An expired registration is never found, even before it is removed
+	now = now.Add(11 * time.Second)
+	if _, ok := d.Get(ctx, "leased"); ok {
+		t.Errorf("expected the expired registration not to be found")
+	}
+	results, _ := d.Find(ctx, "storage-v1", 0)
+	if len(results) != 1 || results[0].ID != "permanent" {
+		t.Errorf("expected only the permanent registration, got %+v", results)
+	}
+	d.removeExpired()
+	if _, ok := d.store.Get("leased"); ok {
+		t.Errorf("expected the expired registration to be removed")
+	}
+	if renewed, _ := d.Renew(ctx, "leased"); renewed {
+		t.Errorf("expected an expired registration not to be renewed")
+	}
+}
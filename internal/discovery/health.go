@@ -58,6 +58,18 @@ func (t *HealthTracker) MarkHealthy(id string) {
 	}
 }
 
+// Healthy reports whether the service with id is considered healthy. Services
+// that have not been checked yet are considered healthy.
+func (t *HealthTracker) Healthy(id string) bool {
+	if t.interval == 0 {
+		return true
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	st, ok := t.statuses[id]
+	return !ok || st.healthy
+}
+
 func (t *HealthTracker) Sort(descs []ServiceDescription) {
 	if t.interval == 0 || len(descs) <= 1 {
 		return
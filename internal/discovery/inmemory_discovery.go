@@ -7,18 +7,28 @@ import (
 	"time"
 )
 
-// Assert that InMemoryDiscovery implements the Discovery interface
-var _ Discovery = (*InMemoryDiscovery)(nil)
+// Assert that InMemoryDiscovery implements the Discovery and Renewer interfaces
+var (
+	_ Discovery = (*InMemoryDiscovery)(nil)
+	_ Renewer   = (*InMemoryDiscovery)(nil)
+)
 
 type InMemoryDiscovery struct {
 	mu       sync.RWMutex
 	services map[string]ServiceRegistration
+	expires  map[string]time.Time // the expiry of registrations with a TTL
+	index    *protocolIndex
 	tracker  *HealthTracker
+	now      func() time.Time
+	stop     chan struct{} // closed to stop removing expired registrations
 }
 
 func NewInMemoryDiscovery() *InMemoryDiscovery {
 	d := &InMemoryDiscovery{
 		services: make(map[string]ServiceRegistration),
+		expires:  make(map[string]time.Time),
+		index:    newProtocolIndex(),
+		now:      time.Now,
 	}
 	return d
 }
@@ -31,13 +41,58 @@ func (d *InMemoryDiscovery) WithHealthTracking(interval, timeout time.Duration)
 	return d
 }
 
+// WithExpiry removes the registrations whose TTL has passed every interval.
+// Expired registrations are never returned by Get or Find, even before they
+// are removed.
+func (d *InMemoryDiscovery) WithExpiry(interval time.Duration) *InMemoryDiscovery {
+	if d.stop != nil {
+		close(d.stop)
+	}
+	d.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				d.removeExpired()
+			}
+		}
+	}(d.stop)
+	return d
+}
+
 func (d *InMemoryDiscovery) Close() error {
 	if d.tracker != nil {
 		d.tracker.Close()
 	}
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
 	return nil
 }
 
+// removeExpired removes the registrations whose TTL has passed.
+func (d *InMemoryDiscovery) removeExpired() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id := range d.expires {
+		if d.expiredLocked(id) {
+			d.removeLocked(id)
+		}
+	}
+}
+
+// expiredLocked reports whether the TTL of the registration of id has
+// passed. d.mu must be held.
+func (d *InMemoryDiscovery) expiredLocked(id string) bool {
+	expires, ok := d.expires[id]
+	return ok && !d.now().Before(expires)
+}
+
 func (d *InMemoryDiscovery) listAll() []ServiceRegistration {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
@@ -51,44 +106,64 @@ func (d *InMemoryDiscovery) listAll() []ServiceRegistration {
 func (d *InMemoryDiscovery) remove(id string) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	delete(d.services, id)
+	d.removeLocked(id)
+}
+
+func (d *InMemoryDiscovery) removeLocked(id string) {
+	if reg, ok := d.services[id]; ok {
+		d.index.remove(reg)
+		delete(d.services, id)
+	}
+	delete(d.expires, id)
 }
 
 func (d *InMemoryDiscovery) Get(ctx context.Context, id string) (ServiceDescription, bool) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 	reg, ok := d.services[id]
-	if !ok {
+	if !ok || d.expiredLocked(id) {
 		return ServiceDescription{}, false
 	}
 	return ServiceDescription{
 		ID:        reg.ID,
 		Address:   reg.Address,
+		Addresses: slices.Clone(reg.Addresses),
 		Protocols: reg.Protocols,
+		Metadata:  reg.Metadata,
 	}, true
 }
 
+// Find returns up to count services supporting protocol, or all of them if
+// count is not positive. Services are selected round-robin from an index of
+// each protocol, so repeated calls asking for a few services spread across all
+// of them. Healthy services are preferred when health tracking is enabled and
+// services whose registration expired are never returned.
 func (d *InMemoryDiscovery) Find(ctx context.Context, protocol string, count int) ([]ServiceDescription, error) {
-	d.mu.RLock()
-	var results []ServiceDescription
-	for _, reg := range d.services {
-		hasProtocol := protocol == "" || slices.Contains(reg.Protocols, protocol)
-
-		if hasProtocol {
-			results = append(results, ServiceDescription{
-				ID:        reg.ID,
-				Address:   reg.Address,
-				Protocols: reg.Protocols,
-			})
+	// The index is locked exclusively as selecting services advances its cursor
+	d.mu.Lock()
+	var healthy, unhealthy []ServiceDescription
+	d.index.next(protocol, func(id string) bool {
+		if d.expiredLocked(id) {
+			return true
 		}
-	}
-	d.mu.RUnlock()
-
-	// Sort healthy services first
-	if d.tracker != nil {
-		d.tracker.Sort(results)
-	}
+		reg := d.services[id]
+		desc := ServiceDescription{
+			ID:        reg.ID,
+			Address:   reg.Address,
+			Addresses: slices.Clone(reg.Addresses),
+			Protocols: reg.Protocols,
+			Metadata:  reg.Metadata,
+		}
+		if d.tracker == nil || d.tracker.Healthy(id) {
+			healthy = append(healthy, desc)
+		} else {
+			unhealthy = append(unhealthy, desc)
+		}
+		return count <= 0 || len(healthy) < count
+	})
+	d.mu.Unlock()
 
+	results := append(healthy, unhealthy...)
 	if count > 0 && len(results) > count {
 		results = results[:count]
 	}
@@ -99,9 +174,40 @@ func (d *InMemoryDiscovery) Find(ctx context.Context, protocol string, count int
 func (d *InMemoryDiscovery) Register(ctx context.Context, reg ServiceRegistration) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	if old, ok := d.services[reg.ID]; ok {
+		d.index.remove(old)
+	}
 	d.services[reg.ID] = reg
+	d.index.add(reg)
+	if reg.TTL > 0 {
+		d.expires[reg.ID] = d.now().Add(time.Duration(reg.TTL) * time.Second)
+	} else {
+		delete(d.expires, reg.ID)
+	}
 	if d.tracker != nil {
 		d.tracker.MarkHealthy(reg.ID)
 	}
 	return nil
 }
+
+// Renew extends the registration of the service with id by its TTL. It
+// reports false if the service is not registered or its registration expired.
+func (d *InMemoryDiscovery) Renew(ctx context.Context, id string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	reg, ok := d.services[id]
+	if !ok {
+		return false, nil
+	}
+	if d.expiredLocked(id) {
+		d.removeLocked(id)
+		return false, nil
+	}
+	if reg.TTL > 0 {
+		d.expires[id] = d.now().Add(time.Duration(reg.TTL) * time.Second)
+	}
+	if d.tracker != nil {
+		d.tracker.MarkHealthy(id)
+	}
+	return true, nil
+}
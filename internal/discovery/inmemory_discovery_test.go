@@ -0,0 +1,128 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestInMemoryDiscovery_FindRoundRobin(t *testing.T) {
+	ctx := context.Background()
+	d := NewInMemoryDiscovery()
+
+	for i := range 6 {
+		protocols := []string{"storage-v1"}
+		if i%2 == 1 {
+			protocols = []string{"names-v1"}
+		}
+		d.Register(ctx, ServiceRegistration{ID: fmt.Sprintf("service-%d", i), Address: "http://localhost", Protocols: protocols})
+	}
+
+	// Repeated finds of a few services visit every storage service in turn
+	seen := make(map[string]int)
+	for range 3 {
+		results, err := d.Find(ctx, "storage-v1", 1)
+		if err != nil || len(results) != 1 {
+			t.Fatalf("Expected 1 result, got %v (err: %v)", results, err)
+		}
+		if !slices.Contains(results[0].Protocols, "storage-v1") {
+			t.Fatalf("Expected a storage service, got %v", results[0])
+		}
+		seen[results[0].ID]++
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected each storage service to be returned once, got %v", seen)
+	}
+
+	all, _ := d.Find(ctx, "", 0)
+	if len(all) != 6 {
+		t.Errorf("Expected all 6 services, got %d", len(all))
+	}
+
+	// Re-registering with different protocols and removing update the index
+	d.Register(ctx, ServiceRegistration{ID: "service-0", Address: "http://localhost", Protocols: []string{"names-v1"}})
+	d.remove("service-2")
+	results, _ := d.Find(ctx, "storage-v1", 0)
+	if len(results) != 1 || results[0].ID != "service-4" {
+		t.Errorf("Expected only service-4 to support storage-v1, got %v", results)
+	}
+	results, _ = d.Find(ctx, "names-v1", 0)
+	if len(results) != 4 {
+		t.Errorf("Expected 4 names services, got %v", results)
+	}
+	if results, _ := d.Find(ctx, "unknown-v1", 0); len(results) != 0 {
+		t.Errorf("Expected no services for an unknown protocol, got %v", results)
+	}
+}
+
+func TestInMemoryDiscovery_Expiry(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	d := NewInMemoryDiscovery()
+	d.now = func() time.Time { return now }
+
+	d.Register(ctx, ServiceRegistration{ID: "leased", Address: "http://localhost:1", Protocols: []string{"storage-v1"}, TTL: 60})
+	d.Register(ctx, ServiceRegistration{ID: "permanent", Address: "http://localhost:2", Protocols: []string{"storage-v1"}})
+
+	// Renewing extends the lease from the time of the renewal
+	now = now.Add(50 * time.Second)
+	if renewed, err := d.Renew(ctx, "leased"); err != nil || !renewed {
+		t.Fatalf("Renew: got %v %v", renewed, err)
+	}
+	now = now.Add(50 * time.Second)
+	if _, ok := d.Get(ctx, "leased"); !ok {
+		t.Errorf("expected the renewed registration to be found")
+	}
+
+	// An expired registration is never found, even before it is removed
+	now = now.Add(11 * time.Second)
+	if _, ok := d.Get(ctx, "leased"); ok {
+		t.Errorf("expected the expired registration not to be found")
+	}
+	results, _ := d.Find(ctx, "storage-v1", 0)
+	if len(results) != 1 || results[0].ID != "permanent" {
+		t.Errorf("expected only the permanent registration, got %+v", results)
+	}
+	d.removeExpired()
+	if _, ok := d.services["leased"]; ok {
+		t.Errorf("expected the expired registration to be removed")
+	}
+	if renewed, _ := d.Renew(ctx, "leased"); renewed {
+		t.Errorf("expected an expired registration not to be renewed")
+	}
+}
+
+func TestKeepRegistered(t *testing.T) {
+	d := NewInMemoryDiscovery()
+	ts := httptest.NewServer(NewDiscoveryServer(d))
+	defer ts.Close()
+	client := NewClient(ts.URL, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := KeepRegistered(ctx, client, ServiceRegistration{ID: "kept", Address: "http://localhost:1", Protocols: []string{"storage-v1"}, TTL: 1}); err != nil {
+		t.Fatalf("KeepRegistered failed: %v", err)
+	}
+
+	// A lost registration is made again
+	d.remove("kept")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := d.Get(ctx, "kept"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the registration was not made again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if renewed, err := client.Renew(ctx, "kept"); err != nil || !renewed {
+		t.Errorf("Renew: got %v %v", renewed, err)
+	}
+	if renewed, err := client.Renew(ctx, "missing"); err != nil || renewed {
+		t.Errorf("Renew of a missing registration: got %v %v", renewed, err)
+	}
+}
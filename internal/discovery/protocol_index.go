@@ -0,0 +1,96 @@
+package discovery
+
+// protocolIndex maps each protocol to the IDs of the services supporting it so
+// that Find does not have to scan every registration. The empty protocol
+// indexes every service.
+//
+// Services are selected round-robin: each selection for a protocol starts
+// where the previous one left off, spreading callers that ask for a few
+// services across all of them.
+type protocolIndex struct {
+	protocols map[string]*protocolEntry
+}
+
+type protocolEntry struct {
+	ids    []string
+	pos    map[string]int // id -> index in ids
+	cursor int
+}
+
+func newProtocolIndex() *protocolIndex {
+	return &protocolIndex{protocols: make(map[string]*protocolEntry)}
+}
+
+func (x *protocolIndex) add(reg ServiceRegistration) {
+	x.addTo("", reg.ID)
+	for _, protocol := range reg.Protocols {
+		if protocol != "" {
+			x.addTo(protocol, reg.ID)
+		}
+	}
+}
+
+func (x *protocolIndex) remove(reg ServiceRegistration) {
+	x.removeFrom("", reg.ID)
+	for _, protocol := range reg.Protocols {
+		if protocol != "" {
+			x.removeFrom(protocol, reg.ID)
+		}
+	}
+}
+
+func (x *protocolIndex) addTo(protocol, id string) {
+	entry, ok := x.protocols[protocol]
+	if !ok {
+		entry = &protocolEntry{pos: make(map[string]int)}
+		x.protocols[protocol] = entry
+	}
+	if _, ok := entry.pos[id]; ok {
+		return
+	}
+	entry.pos[id] = len(entry.ids)
+	entry.ids = append(entry.ids, id)
+}
+
+func (x *protocolIndex) removeFrom(protocol, id string) {
+	entry, ok := x.protocols[protocol]
+	if !ok {
+		return
+	}
+	i, ok := entry.pos[id]
+	if !ok {
+		return
+	}
+
+	// Move the last ID into the hole
+	last := len(entry.ids) - 1
+	entry.ids[i] = entry.ids[last]
+	entry.pos[entry.ids[i]] = i
+	entry.ids = entry.ids[:last]
+	delete(entry.pos, id)
+
+	if len(entry.ids) == 0 {
+		delete(x.protocols, protocol)
+	}
+}
+
+// next calls yield with the IDs of the services supporting protocol in
+// round-robin order until it returns false or every ID has been visited. The
+// next call for protocol starts after the last ID visited.
+func (x *protocolIndex) next(protocol string, yield func(id string) bool) {
+	entry, ok := x.protocols[protocol]
+	if !ok {
+		return
+	}
+
+	n := len(entry.ids)
+	j := entry.cursor % n
+	for range n {
+		id := entry.ids[j]
+		j = (j + 1) % n
+		if !yield(id) {
+			break
+		}
+	}
+	entry.cursor = j
+}
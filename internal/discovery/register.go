@@ -3,34 +3,77 @@ package discovery
 import (
 	"context"
 	"fmt"
+	"log"
 	"net/url"
 	"time"
 
 	"invariant/internal/names"
 )
 
+// RegistrationTTL is the TTL of the registrations made by
+// AdvertiseRegistration, renewed by KeepRegistered.
+const RegistrationTTL = time.Minute
+
 // AdvertiseAndRegister forms the complete advertise URL and registers the service
 // with the discovery service. If the advertise address is empty, it uses localhost.
-// If it lacks a port, the port is appended.
+// If it lacks a port, the port is appended. The advertise address may list
+// several labeled addresses as described by ParseAdvertiseAddresses. The
+// registration is renewed until ctx is done, as described by KeepRegistered.
 func AdvertiseAndRegister(ctx context.Context, disc Discovery, id, advertiseAddr string, port int, protocols []string) error {
-	if advertiseAddr == "" {
-		advertiseAddr = fmt.Sprintf("http://localhost:%d", port)
-	} else {
-		u, err := url.Parse(advertiseAddr)
-		if err != nil {
-			return fmt.Errorf("invalid advertise address: %v", err)
-		}
-		if u.Port() == "" {
-			u.Host = fmt.Sprintf("%s:%d", u.Hostname(), port)
-			advertiseAddr = u.String()
-		}
+	reg, err := AdvertiseRegistration(id, advertiseAddr, port, protocols)
+	if err != nil {
+		return err
 	}
+	return KeepRegistered(ctx, disc, reg)
+}
+
+// KeepRegistered registers reg with disc and, if it has a TTL, renews it
+// every third of its TTL until ctx is done. The service registers again
+// whenever disc no longer has the registration, such as after disc restarted
+// or the registration expired while disc was unreachable.
+func KeepRegistered(ctx context.Context, disc Discovery, reg ServiceRegistration) error {
+	if err := disc.Register(ctx, reg); err != nil {
+		return err
+	}
+	if reg.TTL <= 0 {
+		return nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(reg.TTL) * time.Second / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if renewed, err := renew(ctx, disc, reg.ID); err == nil && renewed {
+				continue
+			}
+			if err := disc.Register(ctx, reg); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to renew the registration of %s: %v", reg.ID, err)
+			}
+		}
+	}()
+	return nil
+}
 
-	return disc.Register(ctx, ServiceRegistration{
-		ID:        id,
-		Address:   advertiseAddr,
-		Protocols: protocols,
-	})
+// AdvertiseAddress forms the complete advertise URL of a service listening on
+// port as described by AdvertiseAndRegister.
+func AdvertiseAddress(advertiseAddr string, port int) (string, error) {
+	if advertiseAddr == "" {
+		return fmt.Sprintf("http://localhost:%d", port), nil
+	}
+	u, err := url.Parse(advertiseAddr)
+	if err != nil {
+		return "", fmt.Errorf("invalid advertise address: %v", err)
+	}
+	if u.Port() == "" {
+		u.Host = fmt.Sprintf("%s:%d", u.Hostname(), port)
+		return u.String(), nil
+	}
+	return advertiseAddr, nil
 }
 
 // RegisterName uses the discovery service to find a "names-v1" service
@@ -2,22 +2,54 @@ package discovery
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
+	"strings"
+	"time"
 
 	"invariant/internal/names"
 )
 
+// maxNamesServers bounds the number of names services consulted to resolve a name.
+const maxNamesServers = 100
+
+// dnsNames is shared so DNS records are cached across resolutions.
+var dnsNames = names.NewDNSClient(nil)
+
+// IsID reports whether s is a service ID, a 32-byte hex encoded value, rather
+// than a name.
+func IsID(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// NormalizeAddress returns addr as a URL that can be used as the base URL of
+// a client, adding the http:// scheme if addr has none and removing any
+// trailing slash.
+func NormalizeAddress(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if addr != "" && !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/")
+}
+
 // ResolveName takes an idOrName string and uses the discovery client to find "names-v1" services
-// to resolve it if it's not a 64-character ID. It returns the 64-character ID.
+// to resolve it if it's not a 64-character ID. Every names service found is
+// consulted before falling back to DNS. It returns the 64-character ID.
 func ResolveName(ctx context.Context, dClient Discovery, idOrName string) (string, error) {
-	if len(idOrName) == 64 {
+	idOrName = strings.TrimSpace(idOrName)
+	if IsID(idOrName) {
 		return idOrName, nil
 	}
 
-	namesServers, err := dClient.Find(ctx, "names-v1", 100)
+	namesServers, err := dClient.Find(ctx, "names-v1", maxNamesServers)
 	if err == nil && len(namesServers) > 0 {
 		for _, ns := range namesServers {
-			nClient := names.NewClient(ns.Address, nil)
+			nClient := names.NewClient(NormalizeAddress(ns.Address), nil)
 			entry, err := nClient.Get(ctx, idOrName)
 			if err == nil {
 				return entry.Value, nil
@@ -26,8 +58,7 @@ func ResolveName(ctx context.Context, dClient Discovery, idOrName string) (strin
 	}
 
 	// Fallback to DNS
-	dnsClient := names.NewDNSClient(nil)
-	entry, err := dnsClient.Get(ctx, idOrName)
+	entry, err := dnsNames.Get(ctx, idOrName)
 	if err == nil {
 		return entry.Value, nil
 	}
@@ -35,7 +66,8 @@ func ResolveName(ctx context.Context, dClient Discovery, idOrName string) (strin
 	return "", fmt.Errorf("could not resolve name %s using names servers or DNS", idOrName)
 }
 
-// Resolve uses ResolveName to find the ID and then looks up the service.
+// Resolve uses ResolveName to find the ID and then looks up the service. The
+// address of the returned description is normalized with NormalizeAddress.
 func Resolve(ctx context.Context, dClient Discovery, idOrName string) (ServiceDescription, error) {
 	id, err := ResolveName(ctx, dClient, idOrName)
 	if err != nil {
@@ -45,5 +77,56 @@ func Resolve(ctx context.Context, dClient Discovery, idOrName string) (ServiceDe
 	if !ok {
 		return ServiceDescription{}, fmt.Errorf("service %s not found", id)
 	}
+	desc.Address = NormalizeAddress(desc.Address)
 	return desc, nil
 }
+
+// ResolveAddress returns the normalized address of the service idOrName that
+// supports protocol. Names with SRV records for protocol are resolved directly
+// from DNS without consulting discovery; otherwise Resolve is used.
+func ResolveAddress(ctx context.Context, dClient Discovery, idOrName string, protocol string) (string, error) {
+	idOrName = strings.TrimSpace(idOrName)
+	if !IsID(idOrName) {
+		if addr, err := dnsNames.LookupAddress(ctx, idOrName, protocol); err == nil {
+			return NormalizeAddress(addr), nil
+		}
+	}
+	desc, err := Resolve(ctx, dClient, idOrName)
+	if err != nil {
+		return "", err
+	}
+	return desc.Address, nil
+}
+
+// ResolveWithRetry calls Resolve up to attempts times, waiting delay between
+// attempts, to allow for services that are still starting.
+func ResolveWithRetry(ctx context.Context, dClient Discovery, idOrName string, attempts int, delay time.Duration) (ServiceDescription, error) {
+	var err error
+	for i := range max(attempts, 1) {
+		var desc ServiceDescription
+		desc, err = Resolve(ctx, dClient, idOrName)
+		if err == nil {
+			return desc, nil
+		}
+		if i < attempts-1 {
+			select {
+			case <-ctx.Done():
+				return ServiceDescription{}, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+	}
+	return ServiceDescription{}, err
+}
+
+// FindAddress returns the normalized address of a service supporting protocol.
+func FindAddress(ctx context.Context, dClient Discovery, protocol string) (string, error) {
+	descs, err := dClient.Find(ctx, protocol, 1)
+	if err != nil {
+		return "", fmt.Errorf("could not find %s service: %w", protocol, err)
+	}
+	if len(descs) == 0 {
+		return "", fmt.Errorf("could not find %s service", protocol)
+	}
+	return NormalizeAddress(descs[0].Address), nil
+}
@@ -0,0 +1,64 @@
+package discovery
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"invariant/internal/names"
+)
+
+func TestIsIDAndNormalizeAddress(t *testing.T) {
+	if !IsID(strings.Repeat("ab", 32)) {
+		t.Error("Expected a 64 character hex string to be an ID")
+	}
+	if IsID(strings.Repeat("xy", 32)) || IsID("storage-1") {
+		t.Error("Expected names to not be IDs")
+	}
+
+	for addr, expected := range map[string]string{
+		"localhost:3000":         "http://localhost:3000",
+		"http://localhost:3000/": "http://localhost:3000",
+		"https://example.com":    "https://example.com",
+	} {
+		if got := NormalizeAddress(addr); got != expected {
+			t.Errorf("NormalizeAddress(%q) = %q, expected %q", addr, got, expected)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+	d := NewInMemoryDiscovery()
+	id := strings.Repeat("12", 32)
+	d.Register(ctx, ServiceRegistration{ID: id, Address: "localhost:3000", Protocols: []string{"storage-v1"}})
+
+	// The name is only known to the second names service
+	for i := range 2 {
+		n := names.NewInMemoryNames()
+		if i == 1 {
+			n.Put(ctx, "storage-1", id, []string{"storage-v1"})
+		}
+		ts := httptest.NewServer(names.NewNamesServer(n))
+		defer ts.Close()
+		d.Register(ctx, ServiceRegistration{ID: strings.Repeat("0", 63) + string(rune('a'+i)), Address: ts.URL, Protocols: []string{"names-v1"}})
+	}
+
+	for _, idOrName := range []string{id, "storage-1"} {
+		desc, err := ResolveWithRetry(ctx, d, idOrName, 1, 0)
+		if err != nil {
+			t.Fatalf("Failed to resolve %s: %v", idOrName, err)
+		}
+		if desc.ID != id || desc.Address != "http://localhost:3000" {
+			t.Errorf("Unexpected description for %s: %v", idOrName, desc)
+		}
+	}
+
+	if addr, err := FindAddress(ctx, d, "storage-v1"); err != nil || addr != "http://localhost:3000" {
+		t.Errorf("Expected FindAddress to return the normalized address, got %q (err: %v)", addr, err)
+	}
+	if _, err := FindAddress(ctx, d, "missing-v1"); err == nil {
+		t.Error("Expected FindAddress to fail for a missing protocol")
+	}
+}
@@ -1,6 +1,7 @@
 package discovery
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
@@ -24,6 +25,18 @@ func NewDiscoveryServer(discovery Discovery) *DiscoveryServer {
 	}
 }
 
+// WithID sets the ID the server reports, allowing it to register itself with
+// a stable ID.
+func (s *DiscoveryServer) WithID(id string) *DiscoveryServer {
+	s.id = id
+	return s
+}
+
+// ID returns the ID of the server.
+func (s *DiscoveryServer) ID() string {
+	return s.id
+}
+
 func (s *DiscoveryServer) Handler() http.Handler {
 	mux := http.NewServeMux()
 
@@ -31,6 +44,7 @@ func (s *DiscoveryServer) Handler() http.Handler {
 	mux.HandleFunc("GET /{id}", s.handleGet)
 	mux.HandleFunc("GET /", s.handleFind)
 	mux.HandleFunc("PUT /{id}", s.handlePut)
+	mux.HandleFunc("PUT /{id}/renew", s.handleRenew)
 
 	return mux
 }
@@ -100,3 +114,28 @@ func (s *DiscoveryServer) handlePut(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 }
+
+func (s *DiscoveryServer) handleRenew(w http.ResponseWriter, r *http.Request) {
+	renewed, err := renew(r.Context(), s.discovery, r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !renewed {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// renew renews the registration of id with disc. Registrations with
+// discovery services that are not a Renewer never expire, so they are
+// renewed as long as they exist.
+func renew(ctx context.Context, disc Discovery, id string) (bool, error) {
+	if renewer, ok := disc.(Renewer); ok {
+		return renewer.Renew(ctx, id)
+	}
+	_, ok := disc.Get(ctx, id)
+	return ok, nil
+}
@@ -2,10 +2,14 @@ package discovery
 
 import (
 	"context"
+	"slices"
 )
 
-// Assert that UpstreamDiscovery implements the Discovery interface.
-var _ Discovery = (*UpstreamDiscovery)(nil)
+// Assert that UpstreamDiscovery implements the Discovery and Renewer interfaces.
+var (
+	_ Discovery = (*UpstreamDiscovery)(nil)
+	_ Renewer   = (*UpstreamDiscovery)(nil)
+)
 
 // UpstreamDiscovery delegates queries to a parent discovery service
 // if they are not found in the local cache/registry.
@@ -38,7 +42,9 @@ func (u *UpstreamDiscovery) Get(ctx context.Context, id string) (ServiceDescript
 			_ = u.local.Register(ctx, ServiceRegistration{
 				ID:        desc.ID,
 				Address:   desc.Address,
+				Addresses: slices.Clone(desc.Addresses),
 				Protocols: desc.Protocols,
+				Metadata:  desc.Metadata,
 			})
 			return desc, true
 		}
@@ -84,7 +90,9 @@ func (u *UpstreamDiscovery) Find(ctx context.Context, protocol string, count int
 			_ = u.local.Register(ctx, ServiceRegistration{
 				ID:        pDesc.ID,
 				Address:   pDesc.Address,
+				Addresses: slices.Clone(pDesc.Addresses),
 				Protocols: pDesc.Protocols,
+				Metadata:  pDesc.Metadata,
 			})
 		}
 	}
@@ -97,3 +105,8 @@ func (u *UpstreamDiscovery) Find(ctx context.Context, protocol string, count int
 func (u *UpstreamDiscovery) Register(ctx context.Context, reg ServiceRegistration) error {
 	return u.local.Register(ctx, reg)
 }
+
+// Renew renews the registration in the local registry, where it was made.
+func (u *UpstreamDiscovery) Renew(ctx context.Context, id string) (bool, error) {
+	return renew(ctx, u.local, id)
+}
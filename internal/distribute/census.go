@@ -0,0 +1,264 @@
+package distribute
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+	"invariant/internal/storage"
+)
+
+// ErrSlotLink is returned when a census encounters a slot link it cannot follow.
+var ErrSlotLink = errors.New("census cannot follow slot links")
+
+// CensusRequest identifies the blocks a census checks. Either Root, Addresses,
+// or both may be given.
+type CensusRequest struct {
+	// Root is the content whose blocks are required. Block lists are followed
+	// to find every block of the content.
+	Root *content.ContentLink `json:"root,omitempty"`
+
+	// Directory indicates Root is a directory and the content of its files and
+	// sub-directories is required as well.
+	Directory bool `json:"directory,omitempty"`
+
+	// Addresses is a manifest of additional required blocks.
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// CensusReport is the result of cross-referencing the required blocks against
+// the known block locations.
+type CensusReport struct {
+	// Required is the number of distinct blocks required.
+	Required int `json:"required"`
+
+	// Missing are the required blocks with no known replica.
+	Missing []string `json:"missing"`
+
+	// UnderReplicated are the required blocks with fewer known replicas than
+	// their replication factor.
+	UnderReplicated []string `json:"underReplicated"`
+
+	// Unreadable are the blocks that could not be read to find the blocks
+	// they refer to. The census of their content is incomplete.
+	Unreadable []string `json:"unreadable,omitempty"`
+}
+
+// CensusTaker is implemented by distribute services that can report on the
+// replication of a set of blocks.
+type CensusTaker interface {
+	Census(ctx context.Context, req CensusRequest) (CensusReport, error)
+}
+
+var _ CensusTaker = (*InMemoryDistribute)(nil)
+
+// Census reports which of the blocks required by req have no known replica or
+// fewer replicas than the replication factor. Blocks backed up to the
+// destination are not missing but do not count towards replication.
+func (d *InMemoryDistribute) Census(ctx context.Context, req CensusRequest) (CensusReport, error) {
+	c := &census{
+		store:    &locatedStorage{d: d},
+		required: make(map[string]struct{}),
+	}
+	for _, address := range req.Addresses {
+		c.require(address)
+	}
+	if req.Root != nil {
+		if err := c.visit(ctx, *req.Root, req.Directory); err != nil {
+			return CensusReport{}, err
+		}
+	}
+
+	report := CensusReport{
+		Required:        len(c.required),
+		Missing:         []string{},
+		UnderReplicated: []string{},
+		Unreadable:      c.unreadable,
+	}
+
+	d.mu.RLock()
+	for address := range c.required {
+		replicas := 0
+		for _, state := range d.services {
+			if state.isDestination {
+				continue
+			}
+			if _, ok := state.blocks[address]; ok {
+				replicas++
+			}
+		}
+		_, backedUp := d.destinationBlocks[address]
+		switch {
+		case replicas == 0 && !backedUp:
+			report.Missing = append(report.Missing, address)
+		case replicas < d.replicasLocked(address):
+			report.UnderReplicated = append(report.UnderReplicated, address)
+		}
+	}
+	d.mu.RUnlock()
+
+	slices.Sort(report.Missing)
+	slices.Sort(report.UnderReplicated)
+	slices.Sort(report.Unreadable)
+	return report, nil
+}
+
+// locations returns the IDs of the services known to have address, including
+// the destination.
+func (d *InMemoryDistribute) locations(address string) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var result []string
+	for id, state := range d.services {
+		if _, ok := state.blocks[address]; ok {
+			result = append(result, id)
+		}
+	}
+	if _, ok := d.destinationBlocks[address]; ok {
+		result = append(result, d.destination)
+	}
+	return result
+}
+
+type census struct {
+	store      storage.Storage
+	required   map[string]struct{}
+	unreadable []string
+}
+
+// require records address as required, reporting whether it was new.
+func (c *census) require(address string) bool {
+	if _, ok := c.required[address]; ok {
+		return false
+	}
+	c.required[address] = struct{}{}
+	return true
+}
+
+func (c *census) visit(ctx context.Context, link content.ContentLink, directory bool) error {
+	if link.Slot {
+		return ErrSlotLink
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Inline content has no block of its own to require
+	if link.Inline == nil && !c.require(link.Address) {
+		return nil
+	}
+
+	if i := slices.IndexFunc(link.Transforms, func(t content.ContentTransform) bool { return t.Kind == "Blocks" }); i >= 0 {
+		// Read the block list itself by stopping before the Blocks transform
+		listLink := content.ContentLink{Address: link.Address, Transforms: link.Transforms[:i]}
+		var list content.BlockList
+		if !c.read(listLink, &list) {
+			return nil
+		}
+		for _, item := range list.Blocks {
+			if err := c.visit(ctx, item.Content, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !directory {
+		return nil
+	}
+	var dir filetree.Directory
+	if !c.read(link, &dir) {
+		return nil
+	}
+	for _, entry := range dir {
+		switch e := entry.(type) {
+		case *filetree.FileEntry:
+			if err := c.visit(ctx, e.Content, false); err != nil {
+				return err
+			}
+		case *filetree.DirectoryEntry:
+			if err := c.visit(ctx, e.Content, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// read decodes the JSON content of link into v. Content that cannot be read is
+// recorded as unreadable.
+func (c *census) read(link content.ContentLink, v any) bool {
+	rc, err := content.Read(link, c.store, nil)
+	if err == nil {
+		err = json.NewDecoder(rc).Decode(v)
+		rc.Close()
+	}
+	if err != nil {
+		c.unreadable = append(c.unreadable, link.Address)
+		return false
+	}
+	return true
+}
+
+// locatedStorage reads blocks from the services known to have them. Its
+// requests have background priority.
+type locatedStorage struct {
+	d *InMemoryDistribute
+}
+
+var errCensusReadOnly = errors.New("census storage is read-only")
+
+// clients returns clients for the services known to have address.
+func (s *locatedStorage) clients(address string) []*storage.Client {
+	if s.d.discovery == nil {
+		return nil
+	}
+	var result []*storage.Client
+	for _, id := range s.d.locations(address) {
+		if serviceAddr, ok := s.d.getServiceAddress(id, false); ok {
+			result = append(result, storage.NewClient(serviceAddr, nil))
+		}
+	}
+	return result
+}
+
+func (s *locatedStorage) Has(ctx context.Context, address string) bool {
+	ctx = storage.WithPriority(ctx, storage.PriorityBackground)
+	for _, c := range s.clients(address) {
+		if c.Has(ctx, address) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *locatedStorage) Get(ctx context.Context, address string) (io.ReadCloser, bool) {
+	ctx = storage.WithPriority(ctx, storage.PriorityBackground)
+	for _, c := range s.clients(address) {
+		if rc, ok := c.Get(ctx, address); ok {
+			return rc, true
+		}
+	}
+	return nil, false
+}
+
+func (s *locatedStorage) Store(ctx context.Context, r io.Reader) (string, error) {
+	return "", errCensusReadOnly
+}
+
+func (s *locatedStorage) StoreAt(ctx context.Context, address string, r io.Reader) (bool, error) {
+	return false, errCensusReadOnly
+}
+
+func (s *locatedStorage) Size(ctx context.Context, address string) (int64, bool) {
+	ctx = storage.WithPriority(ctx, storage.PriorityBackground)
+	for _, c := range s.clients(address) {
+		if size, ok := c.Size(ctx, address); ok {
+			return size, true
+		}
+	}
+	return 0, false
+}
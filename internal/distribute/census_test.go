@@ -0,0 +1,99 @@
+package distribute_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"invariant/internal/content"
+	"invariant/internal/discovery"
+	"invariant/internal/distribute"
+	"invariant/internal/filetree"
+	"invariant/internal/storage"
+)
+
+func TestInMemoryDistribute_Census(t *testing.T) {
+	ctx := context.Background()
+	store1 := storage.NewInMemoryStorage()
+	store2 := storage.NewInMemoryStorage()
+	srv1 := httptest.NewServer(storage.NewStorageServer(store1))
+	defer srv1.Close()
+	srv2 := httptest.NewServer(storage.NewStorageServer(store2))
+	defer srv2.Close()
+
+	id1 := "0000000000000000000000000000000100000000000000000000000000000000"
+	id2 := "0000000000000000000000000000000200000000000000000000000000000000"
+	disc := &mockDiscovery{
+		services: []discovery.ServiceDescription{
+			{ID: id1, Address: srv1.URL, Protocols: []string{"storage-v1"}},
+			{ID: id2, Address: srv2.URL, Protocols: []string{"storage-v1"}},
+		},
+	}
+
+	store := func(data []byte) string {
+		address, err := store1.Store(ctx, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to store block: %v", err)
+		}
+		return address
+	}
+
+	// A file split into two chunks, one of which has been lost
+	chunk1 := store([]byte("first chunk"))
+	chunk2 := store([]byte("second chunk"))
+	listData, _ := json.Marshal(content.BlockList{Blocks: []content.BlockListItem{
+		{Content: content.ContentLink{Address: chunk1}, Size: 11},
+		{Content: content.ContentLink{Address: chunk2}, Size: 12},
+	}})
+	list := store(listData)
+	file := content.ContentLink{Address: list, Transforms: []content.ContentTransform{{Kind: "Blocks"}}}
+
+	lostFile := "1111111111111111111111111111111111111111111111111111111111111111"
+	dirData, _ := json.Marshal(filetree.Directory{
+		&filetree.FileEntry{BaseEntry: filetree.BaseEntry{Kind: filetree.FileKind, Name: "a"}, Content: file, Size: 23},
+		&filetree.FileEntry{BaseEntry: filetree.BaseEntry{Kind: filetree.FileKind, Name: "b"}, Content: content.ContentLink{Address: lostFile}},
+	})
+	root := store(dirData)
+
+	dist := distribute.NewInMemoryDistribute(disc, 2, 3, "", 0)
+	dist.Notify(ctx, id1, []string{root, list, chunk1})
+	dist.Notify(ctx, id2, []string{root})
+
+	ts := httptest.NewServer(distribute.NewDistributeServer("", dist))
+	defer ts.Close()
+	client := distribute.NewClient(ts.URL, ts.Client())
+
+	report, err := client.Census(ctx, distribute.CensusRequest{
+		Root:      &content.ContentLink{Address: root},
+		Directory: true,
+		Addresses: []string{chunk1},
+	})
+	if err != nil {
+		t.Fatalf("Census failed: %v", err)
+	}
+
+	if report.Required != 5 {
+		t.Errorf("Expected 5 required blocks, got %d", report.Required)
+	}
+	missing := []string{chunk2, lostFile}
+	slices.Sort(missing)
+	if !slices.Equal(report.Missing, missing) {
+		t.Errorf("Expected missing blocks %v, got %v", missing, report.Missing)
+	}
+	underReplicated := []string{chunk1, list}
+	slices.Sort(underReplicated)
+	if !slices.Equal(report.UnderReplicated, underReplicated) {
+		t.Errorf("Expected under-replicated blocks %v, got %v", underReplicated, report.UnderReplicated)
+	}
+	if len(report.Unreadable) != 0 {
+		t.Errorf("Expected no unreadable blocks, got %v", report.Unreadable)
+	}
+
+	// Slot links cannot be followed
+	if _, err := client.Census(ctx, distribute.CensusRequest{Root: &content.ContentLink{Address: root, Slot: true}}); err == nil {
+		t.Errorf("Expected a census of a slot link to fail")
+	}
+}
@@ -1,9 +1,18 @@
 package distribute
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"invariant/internal/container"
 	"invariant/internal/httputil"
+	"invariant/internal/notify"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 )
 
 // Client implements a client for interacting with a remote distribute service.
@@ -44,3 +53,388 @@ func (c *Client) Register(id string) error {
 
 	return nil
 }
+
+// ID returns the ID of the distribute service.
+func (c *Client) ID(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/id", c.baseURL), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// Notify notifies the distribute service that the storage service with id
+// has the specified data blocks.
+func (c *Client) Notify(ctx context.Context, id string, addresses []string) error {
+	return c.putAddresses(ctx, "notify", id, addresses)
+}
+
+// Forget notifies the distribute service that the storage service with id no
+// longer has the specified data blocks.
+func (c *Client) Forget(ctx context.Context, id string, addresses []string) error {
+	return c.putAddresses(ctx, "forget", id, addresses)
+}
+
+func (c *Client) putAddresses(ctx context.Context, endpoint, id string, addresses []string) error {
+	body, err := json.Marshal(notify.NotifyRequest{Addresses: addresses})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s/%s/%s", c.baseURL, endpoint, id), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Decommission asks the distribute service to move the blocks of the storage
+// service with id to the other services. It reports false if the service is
+// unknown.
+func (c *Client) Decommission(ctx context.Context, id string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s/decommission/%s", c.baseURL, id), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return true, nil
+}
+
+// Status reports the replication settings and the known storage services.
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/status", c.baseURL), nil)
+	if err != nil {
+		return Status{}, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return Status{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Status{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var status Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return Status{}, err
+	}
+	return status, nil
+}
+
+// Census reports the replication of the blocks required by req.
+func (c *Client) Census(ctx context.Context, req CensusRequest) (CensusReport, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return CensusReport{}, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/census", c.baseURL), bytes.NewReader(body))
+	if err != nil {
+		return CensusReport{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return CensusReport{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return CensusReport{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var report CensusReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return CensusReport{}, err
+	}
+	return report, nil
+}
+
+// Plan reports what the next Sync would do if the changes of req were made,
+// without doing it.
+func (c *Client) Plan(ctx context.Context, req PlanRequest) (Plan, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/plan", c.baseURL), bytes.NewReader(body))
+	if err != nil {
+		return Plan{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return Plan{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Plan{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var plan Plan
+	if err := json.NewDecoder(resp.Body).Decode(&plan); err != nil {
+		return Plan{}, err
+	}
+	return plan, nil
+}
+
+// Config returns the configuration of the distribute service.
+func (c *Client) Config(ctx context.Context) (Config, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/config", c.baseURL), nil)
+	if err != nil {
+		return Config{}, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return Config{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Config{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var config Config
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// SetConfig replaces the configuration of the distribute service and returns
+// the plan of its next Sync under it.
+func (c *Client) SetConfig(ctx context.Context, config Config) (Plan, error) {
+	body, err := json.Marshal(config)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s/config", c.baseURL), bytes.NewReader(body))
+	if err != nil {
+		return Plan{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return Plan{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusBadRequest {
+		return Plan{}, ErrInvalidConfig
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Plan{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var change ConfigChange
+	if err := json.NewDecoder(resp.Body).Decode(&change); err != nil {
+		return Plan{}, err
+	}
+	return change.Plan, nil
+}
+
+// SetReplication overrides the replication factor of address. A policy of zero
+// replicas restores the default.
+func (c *Client) SetReplication(ctx context.Context, address string, policy ReplicationPolicy) error {
+	body, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s/policy/%s", c.baseURL, address), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Replication returns the effective replication policy of address.
+func (c *Client) Replication(ctx context.Context, address string) (ReplicationPolicy, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/policy/%s", c.baseURL, address), nil)
+	if err != nil {
+		return ReplicationPolicy{}, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return ReplicationPolicy{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ReplicationPolicy{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var policy ReplicationPolicy
+	if err := json.NewDecoder(resp.Body).Decode(&policy); err != nil {
+		return ReplicationPolicy{}, err
+	}
+	return policy, nil
+}
+
+// Locations returns the IDs of the services known to have address.
+func (c *Client) Locations(ctx context.Context, address string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/blocks/%s", c.baseURL, address), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var ids []string
+	if err := json.NewDecoder(resp.Body).Decode(&ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Blocks returns a page of the addresses of the blocks known to be held by the
+// service with id. It reports false if the service is unknown.
+func (c *Client) Blocks(ctx context.Context, id string, offset, length int) ([]string, bool, error) {
+	url := fmt.Sprintf("%s/nodes/%s/blocks?offset=%d&length=%d", c.baseURL, id, offset, length)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var addresses []string
+	if err := json.NewDecoder(resp.Body).Decode(&addresses); err != nil {
+		return nil, false, err
+	}
+	return addresses, true, nil
+}
+
+// Events returns the replication events selected by q, oldest first. It
+// returns ErrNoEventLog if the service keeps no event log.
+func (c *Client) Events(ctx context.Context, q EventQuery) ([]Event, error) {
+	params := url.Values{}
+	if !q.Since.IsZero() {
+		params.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		params.Set("until", q.Until.Format(time.RFC3339))
+	}
+	if q.Block != "" {
+		params.Set("block", q.Block)
+	}
+	if q.Node != "" {
+		params.Set("node", q.Node)
+	}
+	if q.Limit > 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/events?%s", c.baseURL, params.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotImplemented {
+		return nil, ErrNoEventLog
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var events []Event
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+var (
+	_ container.Container = (*Client)(nil)
+	_ CensusTaker         = (*Client)(nil)
+	_ ReplicationPolicies = (*Client)(nil)
+	_ BlockQuery          = (*Client)(nil)
+	_ EventReporter       = (*Client)(nil)
+	_ StatusReporter      = (*Client)(nil)
+	_ Decommissioner      = (*Client)(nil)
+	_ Forgetter           = (*Client)(nil)
+)
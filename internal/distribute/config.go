@@ -0,0 +1,144 @@
+package distribute
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrInvalidConfig is returned by SetConfig for a configuration with a
+// negative replication factor or backup rate.
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// Config holds the settings of a distribute service that can be changed
+// while it runs.
+type Config struct {
+	// ReplicationFactor is the default number of storage services that
+	// should hold each block.
+	ReplicationFactor int `json:"replicationFactor"`
+
+	// BackupRate limits the backups to the destination, in MB per hour. Zero
+	// is unlimited.
+	BackupRate float64 `json:"backupRate"`
+
+	// WantLists replicates blocks through the want lists of storage services
+	// instead of asking them to fetch each block.
+	WantLists bool `json:"wantLists"`
+}
+
+// ConfigChange is the response of PUT /config: the configuration in effect
+// and the plan of the next Sync under it.
+type ConfigChange struct {
+	Config Config `json:"config"`
+	Plan   Plan   `json:"plan"`
+}
+
+// Configurable is implemented by distribute services whose settings can be
+// changed while they run.
+type Configurable interface {
+	Config(ctx context.Context) (Config, error)
+
+	// SetConfig replaces the configuration and returns the plan of the next
+	// Sync under it.
+	SetConfig(ctx context.Context, config Config) (Plan, error)
+}
+
+var _ Configurable = (*InMemoryDistribute)(nil)
+
+// WithConfigFile persists the configuration to the JSON file at path. If the
+// file exists, the configuration it holds replaces the one the service was
+// created with, so changes made with SetConfig survive a restart.
+func (d *InMemoryDistribute) WithConfigFile(path string) (*InMemoryDistribute, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.configPath = path
+	if err == nil {
+		config := d.configLocked()
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		if err := validateConfig(config); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		d.applyConfigLocked(config)
+	}
+	return d, nil
+}
+
+// Config returns the configuration in effect.
+func (d *InMemoryDistribute) Config(ctx context.Context) (Config, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.configLocked(), nil
+}
+
+// SetConfig replaces the configuration, saving it to the configuration file
+// if there is one, and returns the plan of the next Sync under it. A change
+// of the replication factor also hands blocks off to, or trims them from,
+// the services closest to them on the next Sync.
+func (d *InMemoryDistribute) SetConfig(ctx context.Context, config Config) (Plan, error) {
+	if err := validateConfig(config); err != nil {
+		return Plan{}, err
+	}
+
+	d.mu.Lock()
+	if d.configPath != "" {
+		if err := saveConfig(d.configPath, config); err != nil {
+			d.mu.Unlock()
+			return Plan{}, err
+		}
+	}
+	if config.ReplicationFactor != d.repFactor {
+		d.rebalancePending = true
+	}
+	d.applyConfigLocked(config)
+	d.mu.Unlock()
+
+	return d.Plan(ctx, PlanRequest{})
+}
+
+// configLocked returns the configuration in effect. d.mu must be held.
+func (d *InMemoryDistribute) configLocked() Config {
+	return Config{
+		ReplicationFactor: d.repFactor,
+		BackupRate:        d.backupRateMBPerHour,
+		WantLists:         d.wantLists,
+	}
+}
+
+// applyConfigLocked puts config in effect. d.mu must be held.
+func (d *InMemoryDistribute) applyConfigLocked(config Config) {
+	d.repFactor = config.ReplicationFactor
+	d.backupRateMBPerHour = config.BackupRate
+	d.wantLists = config.WantLists
+}
+
+func validateConfig(config Config) error {
+	if config.ReplicationFactor < 0 {
+		return fmt.Errorf("%w: replication factor must not be negative", ErrInvalidConfig)
+	}
+	if config.BackupRate < 0 {
+		return fmt.Errorf("%w: backup rate must not be negative", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// saveConfig replaces the file at path with config.
+func saveConfig(path string, config Config) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,84 @@
+package distribute_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"invariant/internal/distribute"
+)
+
+func TestDistributeServer_Config(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "config.json")
+	ids := []string{
+		"0000000000000000000000000000000100000000000000000000000000000000",
+		"0000000000000000000000000000000200000000000000000000000000000000",
+		"0000000000000000000000000000000300000000000000000000000000000000",
+	}
+	block := "0000000000000000000000000000000100000000000000000000000000000001"
+
+	d, err := distribute.NewInMemoryDistribute(&mockDiscovery{}, 3, 3, "", 0).WithConfigFile(path)
+	if err != nil {
+		t.Fatalf("WithConfigFile failed: %v", err)
+	}
+	for _, id := range ids {
+		d.Register(ctx, id)
+		d.Notify(ctx, id, []string{block})
+	}
+	d.Sync()
+
+	ts := httptest.NewServer(distribute.NewDistributeServer("", d))
+	defer ts.Close()
+	client := distribute.NewClient(ts.URL, nil)
+
+	config, err := client.Config(ctx)
+	if err != nil {
+		t.Fatalf("Config failed: %v", err)
+	}
+	if config != (distribute.Config{ReplicationFactor: 3}) {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	// Lowering the replication factor plans to trim the farthest replica
+	config.ReplicationFactor = 2
+	plan, err := client.SetConfig(ctx, config)
+	if err != nil {
+		t.Fatalf("SetConfig failed: %v", err)
+	}
+	if plan.ReplicationFactor != 2 || len(plan.Trims) != 1 || plan.Trims[0].Block != block {
+		t.Errorf("expected a replica to be trimmed, got %+v", plan)
+	}
+
+	// The settings missing from a request are unchanged
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/config", strings.NewReader(`{"backupRate": 10}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT /config failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+	if config, _ := d.Config(ctx); config != (distribute.Config{ReplicationFactor: 2, BackupRate: 10}) {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	if _, err := client.SetConfig(ctx, distribute.Config{ReplicationFactor: -1}); !errors.Is(err, distribute.ErrInvalidConfig) {
+		t.Errorf("expected ErrInvalidConfig, got %v", err)
+	}
+
+	// The saved configuration replaces the one a restarted service is
+	// created with
+	restarted, err := distribute.NewInMemoryDistribute(&mockDiscovery{}, 3, 3, "", 0).WithConfigFile(path)
+	if err != nil {
+		t.Fatalf("WithConfigFile failed: %v", err)
+	}
+	if config, _ := restarted.Config(ctx); config != (distribute.Config{ReplicationFactor: 2, BackupRate: 10}) {
+		t.Errorf("unexpected config after a restart %+v", config)
+	}
+}
@@ -0,0 +1,284 @@
+package distribute
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNoEventLog is returned by Events when the service keeps no event log.
+var ErrNoEventLog = errors.New("no event log")
+
+// EventKind is the decision an Event records.
+type EventKind string
+
+const (
+	// EventReplicate is a copy of a block made to reach its replication factor.
+	EventReplicate EventKind = "replicate"
+	// EventWant is a block added to the want list of a destination, for the
+	// services holding it to push it.
+	EventWant EventKind = "want"
+	// EventRebalance is a copy of a block made to a service that became one
+	// of the closest to it.
+	EventRebalance EventKind = "rebalance"
+	// EventTrim is a surplus replica removed from a service no longer among
+	// the closest to the block.
+	EventTrim EventKind = "trim"
+	// EventBackup is a copy of a block made to the backup destination.
+	EventBackup EventKind = "backup"
+)
+
+// Results of an Event.
+const (
+	ResultSucceeded    = "succeeded"
+	ResultRefused      = "refused"       // the destination was reached but the transfer failed
+	ResultSourceFailed = "source-failed" // the source could not provide the block
+	ResultUnresolved   = "unresolved"    // the address of a service could not be resolved
+	ResultFailed       = "failed"
+)
+
+// Event records a replication decision of the distribute service and its
+// outcome.
+type Event struct {
+	Time        time.Time     `json:"time"`
+	Kind        EventKind     `json:"kind"`
+	Block       string        `json:"block"`
+	Source      string        `json:"source,omitempty"`
+	Destination string        `json:"destination"`
+	Result      string        `json:"result"`
+	Error       string        `json:"error,omitempty"`
+	Duration    time.Duration `json:"duration"`
+}
+
+// EventQuery selects events. Zero fields don't filter.
+type EventQuery struct {
+	Since time.Time // events at or after Since
+	Until time.Time // events before Until
+	Block string
+	Node  string // the source or the destination
+	Limit int    // the most recent Limit events
+}
+
+func (q EventQuery) matches(e Event) bool {
+	return (q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until)) &&
+		(q.Block == "" || e.Block == q.Block) &&
+		(q.Node == "" || e.Source == q.Node || e.Destination == q.Node)
+}
+
+// EventReporter is implemented by distribute services that keep a log of
+// their replication decisions, so operators can find out why a service
+// holds a block or what a replication storm did.
+type EventReporter interface {
+	// Events returns the events selected by q, oldest first.
+	Events(ctx context.Context, q EventQuery) ([]Event, error)
+}
+
+// DefaultEventLogMaxSize is the size an EventLog grows to before it is
+// rotated unless configured otherwise.
+const DefaultEventLogMaxSize = 64 * 1024 * 1024
+
+// EventLog is an append-only log of events kept in a file, one JSON object
+// per line. Once the file grows beyond its maximum size it is renamed with a
+// ".1" suffix, replacing the previous one, and a new file is started, so the
+// log holds at most about twice its maximum size. It is safe for concurrent
+// use.
+type EventLog struct {
+	mu      sync.Mutex // guards the fields below, held while appending
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+}
+
+// OpenEventLog opens the event log at path, creating it if it doesn't exist.
+func OpenEventLog(path string) (*EventLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &EventLog{path: path, file: f, size: info.Size(), maxSize: DefaultEventLogMaxSize}, nil
+}
+
+// WithMaxSize sets the size the log grows to before it is rotated. Zero
+// never rotates it.
+func (l *EventLog) WithMaxSize(maxSize int64) *EventLog {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxSize = maxSize
+	return l
+}
+
+// Append adds e to the log.
+func (l *EventLog) Append(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(data))+1 > l.maxSize {
+		if err := l.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(append(data, '\n'))
+	l.size += int64(n)
+	return err
+}
+
+// rotateLocked moves the log aside, replacing the previous one, and starts a
+// new file. The file is closed first, as some platforms cannot rename an
+// open file; if the rename fails the log is reopened to append to as before.
+// l.mu must be held.
+func (l *EventLog) rotateLocked() error {
+	l.file.Close()
+	renameErr := os.Rename(l.path, l.path+".1")
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = f
+	if renameErr != nil {
+		log.Printf("Failed to rotate event log %s: %v", l.path, renameErr)
+		return nil
+	}
+	l.size = 0
+	return nil
+}
+
+// Query returns the events of the log selected by q, oldest first. Lines
+// that can't be parsed, such as one cut short by a crash, are skipped. The
+// files are opened and the length of the current one noted under the lock,
+// then scanned without it, so appending is not held up by a long query.
+func (l *EventLog) Query(q EventQuery) ([]Event, error) {
+	l.mu.Lock()
+	previous, err := os.Open(l.path + ".1")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		l.mu.Unlock()
+		return nil, err
+	}
+	current, err := os.Open(l.path)
+	size := l.size
+	l.mu.Unlock()
+	if previous != nil {
+		defer previous.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer current.Close()
+
+	var events []Event
+	scan := func(r io.Reader) error {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			var e Event
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				continue
+			}
+			if !q.matches(e) {
+				continue
+			}
+			events = append(events, e)
+			if q.Limit > 0 && len(events) > 2*q.Limit {
+				// Keep the memory bounded while scanning a large log
+				events = append(events[:0], events[len(events)-q.Limit:]...)
+			}
+		}
+		return scanner.Err()
+	}
+	if previous != nil {
+		if err := scan(previous); err != nil {
+			return nil, err
+		}
+	}
+	if err := scan(io.LimitReader(current, size)); err != nil {
+		return nil, err
+	}
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[len(events)-q.Limit:]
+	}
+	return events, nil
+}
+
+// Close closes the log.
+func (l *EventLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+var _ EventReporter = (*InMemoryDistribute)(nil)
+
+// WithEventLog records the replication decisions of the service in log.
+func (d *InMemoryDistribute) WithEventLog(log *EventLog) *InMemoryDistribute {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.events = log
+	return d
+}
+
+// Events returns the events of the event log selected by q. It returns
+// ErrNoEventLog if the service keeps no log.
+func (d *InMemoryDistribute) Events(ctx context.Context, q EventQuery) ([]Event, error) {
+	d.mu.RLock()
+	events := d.events
+	d.mu.RUnlock()
+	if events == nil {
+		return nil, ErrNoEventLog
+	}
+	return events.Query(q)
+}
+
+// record appends an event for a decision started at start to the event log,
+// if there is one.
+func (d *InMemoryDistribute) record(kind EventKind, block, source, dest, result string, err error, start time.Time) {
+	d.mu.RLock()
+	events := d.events
+	d.mu.RUnlock()
+	if events == nil {
+		return
+	}
+	e := Event{
+		Time:        start,
+		Kind:        kind,
+		Block:       block,
+		Source:      source,
+		Destination: dest,
+		Result:      result,
+		Duration:    time.Since(start),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if err := events.Append(e); err != nil {
+		log.Printf("Failed to record a %s event: %v", kind, err)
+	}
+}
+
+// String returns the event result of a transfer.
+func (r transferResult) String() string {
+	switch r {
+	case transferSucceeded:
+		return ResultSucceeded
+	case transferRefused:
+		return ResultRefused
+	case transferSourceFailed:
+		return ResultSourceFailed
+	case transferUnresolved:
+		return ResultUnresolved
+	}
+	return ResultFailed
+}
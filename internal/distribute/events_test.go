@@ -0,0 +1,161 @@
+package distribute_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"invariant/internal/discovery"
+	"invariant/internal/distribute"
+	"invariant/internal/storage"
+)
+
+func TestInMemoryDistribute_Events(t *testing.T) {
+	ctx := context.Background()
+
+	// The destination fails to fetch one block of a batch, then fetches it
+	// on its own
+	unavailable := "3333333333333333333333333333333333333333333333333333333333333333"
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req storage.StorageFetchRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if len(req.Addresses) > 0 {
+			json.NewEncoder(w).Encode(storage.StorageFetchResponse{Failed: []string{unavailable}})
+		}
+	}))
+	defer dest.Close()
+	source := httptest.NewServer(http.NotFoundHandler())
+	defer source.Close()
+
+	id1 := "0000000000000000000000000000000100000000000000000000000000000000"
+	id2 := "0000000000000000000000000000000200000000000000000000000000000000"
+	disc := &mockDiscovery{
+		services: []discovery.ServiceDescription{
+			{ID: id1, Address: source.URL, Protocols: []string{"storage-v1"}},
+			{ID: id2, Address: dest.URL, Protocols: []string{"storage-v1"}},
+		},
+	}
+
+	events, err := distribute.OpenEventLog(filepath.Join(t.TempDir(), "events.log"))
+	if err != nil {
+		t.Fatalf("OpenEventLog failed: %v", err)
+	}
+	defer events.Close()
+	d := distribute.NewInMemoryDistribute(disc, 2, 3, "", 0).WithEventLog(events)
+	d.Register(ctx, id1)
+	d.Register(ctx, id2)
+	d.Notify(ctx, id1, []string{
+		"1111111111111111111111111111111111111111111111111111111111111111",
+		"2222222222222222222222222222222222222222222222222222222222222222",
+		unavailable,
+	})
+	d.Sync()
+
+	server := httptest.NewServer(distribute.NewDistributeServer("", d))
+	defer server.Close()
+	client := distribute.NewClient(server.URL, nil)
+
+	all, err := client.Events(ctx, distribute.EventQuery{})
+	if err != nil {
+		t.Fatalf("Events failed: %v", err)
+	}
+	if len(all) != 4 {
+		t.Fatalf("Expected 4 events, got %+v", all)
+	}
+
+	history, err := client.Events(ctx, distribute.EventQuery{Block: unavailable})
+	if err != nil {
+		t.Fatalf("Events failed: %v", err)
+	}
+	if len(history) != 2 || history[0].Result != distribute.ResultRefused || history[1].Result != distribute.ResultSucceeded {
+		t.Fatalf("Unexpected history of %s: %+v", unavailable, history)
+	}
+	last := history[1]
+	if last.Kind != distribute.EventReplicate || last.Source != id1 || last.Destination != id2 {
+		t.Errorf("Unexpected event %+v", last)
+	}
+
+	latest, err := client.Events(ctx, distribute.EventQuery{Node: id2, Limit: 1})
+	if err != nil {
+		t.Fatalf("Events failed: %v", err)
+	}
+	if len(latest) != 1 || latest[0].Block != unavailable {
+		t.Errorf("Expected the last event to be the retry of %s, got %+v", unavailable, latest)
+	}
+
+	future, err := client.Events(ctx, distribute.EventQuery{Since: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Events failed: %v", err)
+	}
+	if len(future) != 0 {
+		t.Errorf("Expected no events in the future, got %+v", future)
+	}
+}
+
+func TestInMemoryDistribute_NoEventLog(t *testing.T) {
+	d := distribute.NewInMemoryDistribute(nil, 2, 3, "", 0)
+	server := httptest.NewServer(distribute.NewDistributeServer("", d))
+	defer server.Close()
+
+	_, err := distribute.NewClient(server.URL, nil).Events(context.Background(), distribute.EventQuery{})
+	if !errors.Is(err, distribute.ErrNoEventLog) {
+		t.Errorf("Expected ErrNoEventLog, got %v", err)
+	}
+}
+
+func TestEventLog_Rotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	events, err := distribute.OpenEventLog(path)
+	if err != nil {
+		t.Fatalf("OpenEventLog failed: %v", err)
+	}
+	defer events.Close()
+	events.WithMaxSize(1024)
+
+	start := time.Now()
+	block := func(i int) string { return fmt.Sprintf("%064d", i) }
+	for i := range 40 {
+		err := events.Append(distribute.Event{Time: start.Add(time.Duration(i) * time.Second), Kind: distribute.EventReplicate, Block: block(i), Result: distribute.ResultSucceeded})
+		if err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+
+	for _, p := range []string{path, path + ".1"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("Stat(%s) failed: %v", p, err)
+		}
+		if info.Size() > 1024 {
+			t.Errorf("%s is %d bytes, beyond the maximum size", p, info.Size())
+		}
+	}
+
+	// The events of the current and the previous file are returned in order
+	all, err := events.Query(distribute.EventQuery{})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(all) == 0 || len(all) >= 40 || all[len(all)-1].Block != block(39) {
+		t.Fatalf("Expected the most recent events, got %d ending with %+v", len(all), all[len(all)-1])
+	}
+	for i := 1; i < len(all); i++ {
+		if !all[i-1].Time.Before(all[i].Time) {
+			t.Fatalf("Events out of order at %d: %+v", i, all)
+		}
+	}
+	latest, err := events.Query(distribute.EventQuery{Limit: 2})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(latest) != 2 || latest[0].Block != block(38) || latest[1].Block != block(39) {
+		t.Errorf("Expected the last 2 events, got %+v", latest)
+	}
+}
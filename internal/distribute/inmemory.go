@@ -2,43 +2,57 @@ package distribute
 
 import (
 	"context"
-	"encoding/hex"
 	"log"
 	"slices"
-	"sort"
 	"sync"
 	"time"
 
 	"invariant/internal/discovery"
+	"invariant/internal/ring"
 	"invariant/internal/storage"
 )
 
+// backgroundContext is the context of the transfers made to repair and trim
+// replicas, which storage services run behind interactive requests.
+var backgroundContext = storage.WithPriority(context.Background(), storage.PriorityBackground)
+
 type nodeState struct {
 	blocks        map[string]struct{}
 	desc          *discovery.ServiceDescription
 	failures      int
 	isDestination bool
+
+	// decommissioning services are no longer given blocks
+	decommissioning bool
 }
 
 // InMemoryDistribute is an in-memory implementation of the Distribute interface.
 type InMemoryDistribute struct {
 	mu                  sync.RWMutex
 	services            map[string]*nodeState // storage service ID -> state
+	removed             map[string]*nodeState // services removed after repeated failures
 	discovery           discovery.Discovery
 	repFactor           int
+	policies            map[string]int // block address -> replication factor override
 	maxAttempts         int
 	destination         string
 	backupRateMBPerHour float64
 	destinationBlocks   map[string]struct{}
 	backupWindowStart   time.Time
 	backupBytesUploaded int64
+	rebalancePending    bool // a service joined since the last rebalancing pass
+	wantLists           bool // replicate through the want lists of storage services
+	events              *EventLog
+	configPath          string // the file the configuration is saved to
 }
 
 func NewInMemoryDistribute(disc discovery.Discovery, repFactor int, maxAttempts int, destination string, backupRate float64) *InMemoryDistribute {
 	d := &InMemoryDistribute{
 		services:            make(map[string]*nodeState),
+		removed:             make(map[string]*nodeState),
 		discovery:           disc,
 		repFactor:           repFactor,
+		policies:            make(map[string]int),
 		maxAttempts:         maxAttempts,
 		destination:         destination,
 		backupRateMBPerHour: backupRate,
@@ -54,12 +68,24 @@ func NewInMemoryDistribute(disc discovery.Discovery, repFactor int, maxAttempts
 	return d
 }
 
-// Register registers a storage service with the distribute service.
+// Register registers a storage service with the distribute service. A service
+// removed after repeated failures is re-admitted with the blocks it was known
+// to have.
 func (d *InMemoryDistribute) Register(ctx context.Context, id string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
+	if state, removed := d.removed[id]; removed {
+		log.Printf("Re-admitting node %s", id)
+		delete(d.removed, id)
+		state.failures = 0
+		d.services[id] = state
+		d.rebalancePending = true
+		return nil
+	}
+
 	if _, exists := d.services[id]; !exists {
+		d.rebalancePending = true
 		d.services[id] = &nodeState{
 			blocks: make(map[string]struct{}),
 		}
@@ -81,6 +107,10 @@ func (d *InMemoryDistribute) Notify(ctx context.Context, id string, addresses []
 	}
 
 	state, exists := d.services[id]
+	if !exists {
+		// A removed service is only re-admitted when it registers again
+		state, exists = d.removed[id]
+	}
 	if !exists {
 		state = &nodeState{
 			blocks: make(map[string]struct{}),
@@ -149,6 +179,18 @@ func (d *InMemoryDistribute) getServiceAddress(id string, forceRefresh bool) (st
 	return desc.Address, true
 }
 
+// WithWantLists sets whether blocks missing replicas are added to the want
+// lists of the services that should hold them, for the storage services
+// holding the blocks to push, instead of asking each service to fetch them.
+// This takes the transfers themselves off the distribute service in very
+// large clusters. Services without want lists are still asked to fetch.
+func (d *InMemoryDistribute) WithWantLists(enabled bool) *InMemoryDistribute {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.wantLists = enabled
+	return d
+}
+
 // StartSync starts the background synchronization loop.
 func (d *InMemoryDistribute) StartSync(interval time.Duration) {
 	go func() {
@@ -162,137 +204,436 @@ func (d *InMemoryDistribute) StartSync(interval time.Duration) {
 
 // Sync performs a single synchronization pass, ensuring all blocks are replicated to N nodes.
 func (d *InMemoryDistribute) Sync() {
-	if d.discovery == nil || d.repFactor <= 0 {
+	d.mu.RLock()
+	replicated := d.repFactor > 0 || len(d.policies) > 0
+	wantLists := d.wantLists
+	d.mu.RUnlock()
+	if d.discovery == nil || !replicated {
 		return
 	}
 
-	// Build map block -> list of service IDs that contain it
+	// Build map block -> list of service IDs that contain it. The replicas
+	// held by decommissioning services are not counted.
 	blockLocations := make(map[string][]string)
+	retiring := make(map[string][]string)
+	required := make(map[string]int)
 	d.mu.RLock()
 	for srvID, state := range d.services {
 		if state.isDestination {
 			continue
 		}
 		for block := range state.blocks {
-			blockLocations[block] = append(blockLocations[block], srvID)
+			if state.decommissioning {
+				retiring[block] = append(retiring[block], srvID)
+			} else {
+				blockLocations[block] = append(blockLocations[block], srvID)
+			}
 		}
 	}
+	for block := range blockLocations {
+		required[block] = d.replicasLocked(block)
+	}
+	for block := range retiring {
+		required[block] = d.replicasLocked(block)
+	}
 	d.mu.RUnlock()
 
+	d.drain(blockLocations, retiring, required)
+
+	plan := planTransfers(blockLocations, required, d.closest)
+	var delivered map[string][]string
+	if wantLists {
+		delivered = d.advertiseWants(plan)
+	} else {
+		delivered = d.replicateBatches(plan)
+	}
 	for block, locations := range blockLocations {
-		if len(locations) >= d.repFactor {
+		locations = slices.Concat(locations, delivered[block])
+		if len(locations) >= required[block] {
 			continue // Already replicated enough
 		}
 
 		// Need to replicate this block
-		blockBytes, err := hex.DecodeString(block)
-		if err != nil || len(blockBytes) != 32 {
+		nodes, ok := d.closest(block)
+		if !ok {
 			continue // Invalid block ID
 		}
 
-		// Find distance to all registered services
-		type nodeDist struct {
-			id   string
-			dist []byte
+		sourceSrvID := locations[0]
+		sourceAddr, ok := d.getServiceAddress(sourceSrvID, false)
+		if !ok {
+			log.Printf("Failed to resolve address for source node %s", sourceSrvID)
+			continue
 		}
-		var nodes []nodeDist
-		d.mu.RLock()
-		for srvID, state := range d.services {
-			if state.isDestination {
-				continue
+
+		// Copy it to the closest nodes that don't have it, trying the
+		// further ones in turn when a transfer fails
+		targets, spare := replicaTargets(nodes, locations, required[block])
+		needed := len(targets)
+		for _, destSrvID := range slices.Concat(targets, spare) {
+			if needed <= 0 {
+				break
+			}
+			start := time.Now()
+			result := d.replicate(block, sourceSrvID, &sourceAddr, destSrvID)
+			d.record(EventReplicate, block, sourceSrvID, destSrvID, result.String(), nil, start)
+			d.recordTransfer(sourceSrvID, destSrvID, result)
+			if result == transferSucceeded {
+				needed--
 			}
-			srvBytes, err := hex.DecodeString(srvID)
-			if err != nil || len(srvBytes) != 32 {
-				continue // Invalid service ID
+			if result == transferSourceFailed {
+				// The other destinations would fetch from the same source
+				break
 			}
-			nodes = append(nodes, nodeDist{
-				id:   srvID,
-				dist: Distance(blockBytes, srvBytes),
-			})
 		}
-		d.mu.RUnlock()
+	}
 
-		// Sort by distance (closest first)
-		sort.Slice(nodes, func(i, j int) bool {
-			return CmpDistance(nodes[i].dist, nodes[j].dist) < 0
-		})
+	d.mu.Lock()
+	rebalance := d.rebalancePending
+	d.rebalancePending = false
+	d.mu.Unlock()
+	if rebalance {
+		d.rebalance(blockLocations, required)
+	}
 
-		// Pick destination nodes that don't have the block
-		hasBlock := func(id string) bool {
-			return slices.Contains(locations, id)
+	if d.destination != "" {
+		d.syncToDestination(blockLocations)
+	}
+}
+
+// transferRoute is a source and a destination of blocks.
+type transferRoute struct {
+	source, dest string
+}
+
+// The decisions of Sync are made by the functions below, which only decide
+// and never transfer, so that Plan reports what Sync would do by making the
+// same decisions.
+
+// replicaTargets decides which of nodes, the services eligible to hold a
+// block ordered by their distance from it, should be given a copy of a block
+// held by locations so it has required replicas: the closest of them without
+// it. The further services without it are returned as spare, to try in turn
+// when a transfer to a target fails.
+func replicaTargets(nodes, locations []string, required int) (targets, spare []string) {
+	needed := required - len(locations)
+	for _, srvID := range nodes {
+		if slices.Contains(locations, srvID) {
+			continue
+		}
+		if len(targets) < needed {
+			targets = append(targets, srvID)
+		} else {
+			spare = append(spare, srvID)
 		}
+	}
+	return targets, spare
+}
 
-		sourceSrvID := locations[0]
-		sourceAddr, ok := d.getServiceAddress(sourceSrvID, false)
+// rebalanceTargets decides how a block held by locations, which has the
+// replicas it requires, is handed off to the required services closest to it
+// among nodes, ordered by their distance from it: destinations are the
+// closest services without it, and trims the services no longer among the
+// closest whose surplus replicas are removed once the destinations have it,
+// furthest first. The further holders are returned as spareTrims, to trim in
+// turn when removing a replica fails.
+func rebalanceTargets(nodes, locations []string, required int) (destinations, trims, spareTrims []string) {
+	closest := nodes[:min(required, len(nodes))]
+	for _, srvID := range closest {
+		if !slices.Contains(locations, srvID) {
+			destinations = append(destinations, srvID)
+		}
+	}
+	surplus := len(locations) + len(destinations) - len(closest)
+	for i := len(nodes) - 1; i >= 0; i-- {
+		srvID := nodes[i]
+		if slices.Contains(closest, srvID) || !slices.Contains(locations, srvID) {
+			continue
+		}
+		if len(trims) < surplus {
+			trims = append(trims, srvID)
+		} else {
+			spareTrims = append(spareTrims, srvID)
+		}
+	}
+	return destinations, trims, spareTrims
+}
+
+// planTransfers picks, for each block with fewer replicas than required, the
+// closest services without it to copy it to from its first location. closest
+// orders the services eligible to hold a block by their distance from it.
+func planTransfers(blockLocations map[string][]string, required map[string]int, closest func(block string) ([]string, bool)) map[transferRoute][]string {
+	plan := make(map[transferRoute][]string)
+	for block, locations := range blockLocations {
+		if len(locations) >= required[block] {
+			continue
+		}
+		nodes, ok := closest(block)
 		if !ok {
-			log.Printf("Failed to resolve address for source node %s", sourceSrvID)
 			continue
 		}
+		targets, _ := replicaTargets(nodes, locations, required[block])
+		for _, destSrvID := range targets {
+			r := transferRoute{source: locations[0], dest: destSrvID}
+			plan[r] = append(plan[r], block)
+		}
+	}
+	return plan
+}
 
-		needed := d.repFactor - len(locations)
-		for _, node := range nodes {
-			if needed <= 0 {
+// replicateBatches asks each destination of plan to fetch the blocks it is
+// missing from the same source in batches, saving a request per block during
+// large repairs. Only sources with several blocks for a destination are
+// batched. It returns the destinations each block was delivered to; the
+// remaining transfers, including those of destinations that don't support
+// batches, are left to the replication pass of Sync.
+func (d *InMemoryDistribute) replicateBatches(plan map[transferRoute][]string) map[string][]string {
+	delivered := make(map[string][]string)
+	for r, blocks := range plan {
+		if len(blocks) < 2 {
+			continue
+		}
+		destAddr, ok := d.getServiceAddress(r.dest, false)
+		if !ok {
+			continue
+		}
+		c := storage.NewClient(destAddr, nil)
+		for batch := range slices.Chunk(blocks, storage.MaxFetchBatch) {
+			start := time.Now()
+			failed, err := c.FetchBatch(backgroundContext, batch, r.source)
+			if err != nil {
+				log.Printf("Failed to sync a batch of %d blocks to %s: %v", len(batch), r.dest, err)
+				for _, block := range batch {
+					d.record(EventReplicate, block, r.source, r.dest, ResultFailed, err, start)
+				}
 				break
 			}
-			if !hasBlock(node.id) {
-				destSrvID := node.id
-
-				// Try to replicate to this node, with retries on failure
-				success := false
-				for attempt := range 2 {
-					forceRefresh := attempt > 0 // Force refresh on retry
-					destAddr, ok := d.getServiceAddress(destSrvID, forceRefresh)
-					if !ok {
-						log.Printf("Failed to resolve address for destination node %s", destSrvID)
-						break // Can't resolve, give up on this node for now
-					}
-
-					if attempt > 0 {
-						// On retry, we also want to be sure our source address is still good
-						newSourceAddr, ok := d.getServiceAddress(sourceSrvID, true)
-						if ok {
-							sourceAddr = newSourceAddr
-						} else {
-							break // Source vanished
-						}
-					}
-
-					// Create store client from destSrv URL
-					// And tell dest to fetch from source via its ID so dest looks it up in discovery
-					c := storage.NewClient(destAddr, nil)
-					err := c.Fetch(context.Background(), block, sourceSrvID, sourceAddr)
-					if err == nil {
-						success = true
-						break // success
-					}
-					log.Printf("Attempt %d failed to sync block %s to %s", attempt+1, block, destAddr)
+			d.recordTransfer(r.source, r.dest, transferSucceeded)
+			for _, block := range batch {
+				if slices.Contains(failed, block) {
+					d.record(EventReplicate, block, r.source, r.dest, ResultRefused, nil, start)
+				} else {
+					d.record(EventReplicate, block, r.source, r.dest, ResultSucceeded, nil, start)
+					delivered[block] = append(delivered[block], r.dest)
 				}
+			}
+		}
+	}
+	return delivered
+}
 
-				if success {
-					needed--
-					d.mu.Lock()
-					if state, ok := d.services[destSrvID]; ok {
-						state.failures = 0
-					}
-					d.mu.Unlock()
-				} else {
-					d.mu.Lock()
-					if state, ok := d.services[destSrvID]; ok {
-						state.failures++
-						if state.failures >= d.maxAttempts {
-							log.Printf("Removing node %s due to max failures (%d)", destSrvID, state.failures)
-							delete(d.services, destSrvID)
-						}
-					}
-					d.mu.Unlock()
+// wantBatch is the most blocks added to a want list in a single request.
+const wantBatch = 1000
+
+// advertiseWants adds the blocks planned for each destination to its want
+// list, leaving the storage services holding them to push them. It returns
+// the destinations each block was advertised to; the transfers to
+// destinations without want lists are left to the replication pass of Sync.
+// Blocks that never arrive are advertised again by a later Sync.
+func (d *InMemoryDistribute) advertiseWants(plan map[transferRoute][]string) map[string][]string {
+	wants := make(map[string][]string)
+	for r, blocks := range plan {
+		wants[r.dest] = append(wants[r.dest], blocks...)
+	}
+
+	advertised := make(map[string][]string)
+	for destSrvID, blocks := range wants {
+		destAddr, ok := d.getServiceAddress(destSrvID, false)
+		if !ok {
+			continue
+		}
+		c := storage.NewClient(destAddr, nil)
+		for batch := range slices.Chunk(blocks, wantBatch) {
+			start := time.Now()
+			if err := c.Want(backgroundContext, batch); err != nil {
+				log.Printf("Failed to advertise %d wanted blocks for %s: %v", len(batch), destSrvID, err)
+				for _, block := range batch {
+					d.record(EventWant, block, "", destSrvID, ResultFailed, err, start)
 				}
+				break
+			}
+			for _, block := range batch {
+				d.record(EventWant, block, "", destSrvID, ResultSucceeded, nil, start)
+				advertised[block] = append(advertised[block], destSrvID)
 			}
 		}
 	}
+	return advertised
+}
 
-	if d.destination != "" {
-		d.syncToDestination(blockLocations)
+// closest returns the registered services, other than those being
+// decommissioned, ordered by their distance from block, closest first. It
+// reports false if block is not a valid address.
+func (d *InMemoryDistribute) closest(block string) ([]string, bool) {
+	var ids []string
+	d.mu.RLock()
+	for srvID, state := range d.services {
+		if !state.isDestination && !state.decommissioning {
+			ids = append(ids, srvID)
+		}
 	}
+	d.mu.RUnlock()
+	return ring.Closest(block, ids)
+}
+
+// rebalance moves replicas to the services that are now among the closest to
+// a block, typically because they recently joined, and trims the surplus
+// replicas held by services that are no longer among the closest. Only blocks
+// that were already sufficiently replicated are considered; the others are
+// handled by the replication pass of Sync.
+func (d *InMemoryDistribute) rebalance(blockLocations map[string][]string, required map[string]int) {
+	for block, locations := range blockLocations {
+		if len(locations) < required[block] {
+			continue
+		}
+		nodes, ok := d.closest(block)
+		if !ok {
+			continue
+		}
+		destinations, trims, spareTrims := rebalanceTargets(nodes, locations, required[block])
+
+		// Hand the block off to the closest services that don't have it
+		complete := true
+		for _, destSrvID := range destinations {
+			sourceSrvID := locations[0]
+			sourceAddr, ok := d.getServiceAddress(sourceSrvID, false)
+			if !ok {
+				complete = false
+				break
+			}
+			start := time.Now()
+			result := d.replicate(block, sourceSrvID, &sourceAddr, destSrvID)
+			d.record(EventRebalance, block, sourceSrvID, destSrvID, result.String(), nil, start)
+			d.recordTransfer(sourceSrvID, destSrvID, result)
+			if result != transferSucceeded {
+				complete = false
+				break
+			}
+			d.mu.Lock()
+			if state, ok := d.services[destSrvID]; ok {
+				state.blocks[block] = struct{}{}
+			}
+			d.mu.Unlock()
+		}
+
+		// Only trim once every closest service is known to have the block
+		if !complete {
+			continue
+		}
+		surplus := len(trims)
+		for _, srvID := range slices.Concat(trims, spareTrims) {
+			if surplus <= 0 {
+				break
+			}
+			addr, ok := d.getServiceAddress(srvID, false)
+			if !ok {
+				continue
+			}
+			start := time.Now()
+			if _, err := storage.NewClient(addr, nil).Remove(backgroundContext, block); err != nil {
+				log.Printf("Failed to trim block %s from %s: %v", block, srvID, err)
+				d.record(EventTrim, block, "", srvID, ResultFailed, err, start)
+				continue
+			}
+			d.record(EventTrim, block, "", srvID, ResultSucceeded, nil, start)
+			d.mu.Lock()
+			if state, ok := d.services[srvID]; ok {
+				delete(state.blocks, block)
+			}
+			d.mu.Unlock()
+			surplus--
+		}
+	}
+}
+
+// recordTransfer updates the failure counts of the services of a transfer of
+// a block from sourceSrvID to destSrvID with its result: a refused transfer
+// counts against the destination and a failed source against the source. A
+// service is removed once it has failed too many transfers.
+func (d *InMemoryDistribute) recordTransfer(sourceSrvID, destSrvID string, result transferResult) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch result {
+	case transferSucceeded:
+		for _, srvID := range []string{sourceSrvID, destSrvID} {
+			if state, ok := d.services[srvID]; ok {
+				state.failures = 0
+			}
+		}
+	case transferRefused:
+		d.failTransferLocked(destSrvID)
+	case transferSourceFailed:
+		d.failTransferLocked(sourceSrvID)
+	case transferUnresolved:
+		// Discovery may be unavailable; this says nothing about the health of
+		// the node so it is not counted as a failure.
+	}
+}
+
+// failTransferLocked counts a failed transfer against srvID, removing it once
+// it has failed too many. d.mu must be held.
+func (d *InMemoryDistribute) failTransferLocked(srvID string) {
+	state, ok := d.services[srvID]
+	if !ok {
+		return
+	}
+	state.failures++
+	if state.failures >= d.maxAttempts {
+		log.Printf("Removing node %s due to max failures (%d)", srvID, state.failures)
+		delete(d.services, srvID)
+		d.removed[srvID] = state
+	}
+}
+
+type transferResult int
+
+const (
+	transferSucceeded    transferResult = iota
+	transferRefused                     // the destination was reached but the transfer failed
+	transferSourceFailed                // the source could not provide the block
+	transferUnresolved                  // the address of the source or destination could not be resolved
+)
+
+// replicate asks destSrvID to fetch block from sourceSrvID, retrying once with
+// freshly resolved addresses. sourceAddr is updated if the source is resolved
+// again.
+func (d *InMemoryDistribute) replicate(block, sourceSrvID string, sourceAddr *string, destSrvID string) transferResult {
+	for attempt := range 2 {
+		forceRefresh := attempt > 0 // Force refresh on retry
+		destAddr, ok := d.getServiceAddress(destSrvID, forceRefresh)
+		if !ok {
+			log.Printf("Failed to resolve address for destination node %s", destSrvID)
+			return transferUnresolved
+		}
+
+		if attempt > 0 {
+			// On retry, we also want to be sure our source address is still good
+			newSourceAddr, ok := d.getServiceAddress(sourceSrvID, true)
+			if !ok {
+				return transferUnresolved
+			}
+			*sourceAddr = newSourceAddr
+		}
+
+		// Create store client from destSrv URL
+		// And tell dest to fetch from source via its ID so dest looks it up in discovery
+		c := storage.NewClient(destAddr, nil)
+		err := c.Fetch(backgroundContext, block, sourceSrvID, *sourceAddr)
+		if err == nil {
+			return transferSucceeded
+		}
+		log.Printf("Attempt %d failed to sync block %s to %s", attempt+1, block, destAddr)
+	}
+
+	// The destination fetches the block from the source, so a source that
+	// no longer has the block, or cannot be reached, fails the transfer
+	// however healthy the destination is
+	if !storage.NewClient(*sourceAddr, nil).Has(backgroundContext, block) {
+		log.Printf("Source node %s could not provide block %s", sourceSrvID, block)
+		return transferSourceFailed
+	}
+	return transferRefused
 }
 
 func (d *InMemoryDistribute) syncToDestination(blockLocations map[string][]string) {
@@ -311,9 +652,10 @@ func (d *InMemoryDistribute) syncToDestination(blockLocations map[string][]strin
 		d.backupBytesUploaded = 0
 	}
 	bytesUploaded := d.backupBytesUploaded
+	backupRate := d.backupRateMBPerHour
 	d.mu.Unlock()
 
-	maxBytesPerHour := int64(d.backupRateMBPerHour * 1024 * 1024)
+	maxBytesPerHour := int64(backupRate * 1024 * 1024)
 
 	var newlyUploadedBytes int64
 
@@ -338,17 +680,21 @@ func (d *InMemoryDistribute) syncToDestination(blockLocations map[string][]strin
 		}
 
 		sourceClient := storage.NewClient(sourceAddr, nil)
-		size, ok := sourceClient.Size(context.Background(), block)
+		size, ok := sourceClient.Size(backgroundContext, block)
 		if !ok {
 			continue
 		}
 
-		if d.backupRateMBPerHour > 0 && bytesUploaded+newlyUploadedBytes+size > maxBytesPerHour {
+		if backupRate > 0 && bytesUploaded+newlyUploadedBytes+size > maxBytesPerHour {
 			continue // Rate limit exceeded, we can't upload this block right now
 		}
 
-		err := destClient.Fetch(context.Background(), block, sourceSrvID, sourceAddr)
-		if err == nil {
+		start := time.Now()
+		err := destClient.Fetch(backgroundContext, block, sourceSrvID, sourceAddr)
+		if err != nil {
+			d.record(EventBackup, block, sourceSrvID, d.destination, ResultFailed, err, start)
+		} else {
+			d.record(EventBackup, block, sourceSrvID, d.destination, ResultSucceeded, nil, start)
 			newlyUploadedBytes += size
 			d.mu.Lock()
 			d.destinationBlocks[block] = struct{}{}
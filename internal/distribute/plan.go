@@ -0,0 +1,272 @@
+package distribute
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"invariant/internal/ring"
+	"invariant/internal/storage"
+)
+
+// ErrUnknownService is returned by Plan when asked to decommission a storage
+// service the distribute service does not know.
+var ErrUnknownService = errors.New("unknown storage service")
+
+// PlanRequest describes the changes to plan the next Sync against. The zero
+// request plans it for the current services and replication factor.
+type PlanRequest struct {
+	// ReplicationFactor replaces the default replication factor when it is
+	// positive. The replication policies of single blocks still apply.
+	ReplicationFactor int `json:"replicationFactor,omitempty"`
+
+	// Add are the IDs of storage services to plan as if they had registered
+	// without any blocks.
+	Add []string `json:"add,omitempty"`
+
+	// Decommission are the IDs of storage services to plan as if they were
+	// being decommissioned.
+	Decommission []string `json:"decommission,omitempty"`
+}
+
+// PlannedTransfer is a block Sync would copy from one storage service to
+// others.
+type PlannedTransfer struct {
+	Kind         EventKind `json:"kind"` // EventReplicate, EventRebalance or EventBackup
+	Block        string    `json:"block"`
+	Source       string    `json:"source"`
+	Destinations []string  `json:"destinations"`
+
+	// Size is the size of the block in bytes, or -1 if the source could not
+	// report it.
+	Size int64 `json:"size"`
+}
+
+// PlannedTrim is a surplus replica Sync would remove from a storage service
+// that is no longer among the closest to the block.
+type PlannedTrim struct {
+	Block string `json:"block"`
+	Node  string `json:"node"`
+}
+
+// Plan is what the next Sync would do, returned by POST /plan.
+type Plan struct {
+	ReplicationFactor int `json:"replicationFactor"`
+
+	// Nodes is the number of storage services that would be given blocks.
+	Nodes int `json:"nodes"`
+
+	Transfers []PlannedTransfer `json:"transfers"`
+	Trims     []PlannedTrim     `json:"trims"`
+
+	// Copies is the number of replicas the transfers make and Bytes is their
+	// total size. Transfers of blocks of unknown size are counted by Unsized
+	// instead.
+	Copies  int   `json:"copies"`
+	Bytes   int64 `json:"bytes"`
+	Unsized int   `json:"unsized,omitempty"`
+
+	// Unplaced is the number of blocks that would still have fewer replicas
+	// than required, as there are too few storage services to hold them.
+	Unplaced int `json:"unplaced,omitempty"`
+}
+
+// Planner is implemented by distribute services that can report what a Sync
+// would do without doing it.
+type Planner interface {
+	// Plan computes the transfers and trims of the next Sync as if the
+	// changes of req were made.
+	Plan(ctx context.Context, req PlanRequest) (Plan, error)
+}
+
+var _ Planner = (*InMemoryDistribute)(nil)
+
+// Plan computes the transfers and trims the next Sync would make if the
+// changes of req were made, making the same decisions as Sync with
+// replicaTargets and rebalanceTargets: blocks of
+// decommissioning services are drained first, blocks with too few replicas
+// are copied to the closest services without them, and, once a service
+// joins, sufficiently replicated blocks are handed off to the services now
+// closest to them. Backups are planned regardless of the backup rate, which
+// may spread them over several passes. Nothing is transferred; the sources
+// are only asked for the sizes of the blocks.
+func (d *InMemoryDistribute) Plan(ctx context.Context, req PlanRequest) (Plan, error) {
+	if req.ReplicationFactor < 0 {
+		return Plan{}, ErrInvalidReplicas
+	}
+
+	d.mu.RLock()
+	for _, id := range req.Decommission {
+		if state, ok := d.services[id]; !ok || state.isDestination {
+			d.mu.RUnlock()
+			return Plan{}, fmt.Errorf("%w: %s", ErrUnknownService, id)
+		}
+	}
+	repFactor := d.repFactor
+	if req.ReplicationFactor > 0 {
+		repFactor = req.ReplicationFactor
+	}
+	replicas := func(address string) int {
+		if replicas, ok := d.policies[address]; ok {
+			return replicas
+		}
+		return repFactor
+	}
+
+	// Take the same snapshot as Sync with the changes of req applied
+	var active []string
+	blockLocations := make(map[string][]string)
+	retiring := make(map[string][]string)
+	required := make(map[string]int)
+	for srvID, state := range d.services {
+		if state.isDestination {
+			continue
+		}
+		decommissioning := state.decommissioning || slices.Contains(req.Decommission, srvID)
+		if !decommissioning {
+			active = append(active, srvID)
+		}
+		for block := range state.blocks {
+			if decommissioning {
+				retiring[block] = append(retiring[block], srvID)
+			} else {
+				blockLocations[block] = append(blockLocations[block], srvID)
+			}
+		}
+	}
+	rebalance := d.rebalancePending
+	for _, id := range req.Add {
+		if _, known := d.services[id]; !known && !slices.Contains(active, id) {
+			active = append(active, id)
+			rebalance = true
+		}
+	}
+	for block := range blockLocations {
+		required[block] = replicas(block)
+	}
+	for block := range retiring {
+		required[block] = replicas(block)
+	}
+	replicated := repFactor > 0 || len(d.policies) > 0
+	backedUp := make(map[string]bool)
+	for block := range d.destinationBlocks {
+		backedUp[block] = true
+	}
+	d.mu.RUnlock()
+
+	plan := Plan{
+		ReplicationFactor: repFactor,
+		Nodes:             len(active),
+		Transfers:         []PlannedTransfer{},
+		Trims:             []PlannedTrim{},
+	}
+	if d.discovery == nil || !replicated {
+		return plan, nil
+	}
+	closest := func(block string) ([]string, bool) {
+		return ring.Closest(block, active)
+	}
+	transfer := func(kind EventKind, block, source string, destinations []string) {
+		if len(destinations) > 0 {
+			plan.Transfers = append(plan.Transfers, PlannedTransfer{Kind: kind, Block: block, Source: source, Destinations: destinations})
+		}
+	}
+
+	// Drain the decommissioning services
+	for block, sources := range retiring {
+		if len(blockLocations[block]) >= required[block] {
+			continue
+		}
+		nodes, ok := closest(block)
+		if !ok {
+			continue
+		}
+		destinations, _ := replicaTargets(nodes, blockLocations[block], required[block])
+		transfer(EventReplicate, block, sources[0], destinations)
+		blockLocations[block] = append(blockLocations[block], destinations...)
+	}
+
+	// Replicate the blocks with too few replicas
+	copies := make(map[string]map[string][]string) // block -> source -> destinations
+	for r, blocks := range planTransfers(blockLocations, required, closest) {
+		for _, block := range blocks {
+			if copies[block] == nil {
+				copies[block] = make(map[string][]string)
+			}
+			copies[block][r.source] = append(copies[block][r.source], r.dest)
+		}
+	}
+	for block, locations := range blockLocations {
+		planned := 0
+		for source, destinations := range copies[block] {
+			transfer(EventReplicate, block, source, destinations)
+			planned += len(destinations)
+		}
+		if len(locations)+planned < required[block] {
+			plan.Unplaced++
+		}
+	}
+
+	// Hand sufficiently replicated blocks off to the closest services
+	if rebalance {
+		for block, locations := range blockLocations {
+			if len(locations) < required[block] {
+				continue
+			}
+			nodes, ok := closest(block)
+			if !ok {
+				continue
+			}
+			destinations, trims, _ := rebalanceTargets(nodes, locations, required[block])
+			transfer(EventRebalance, block, locations[0], destinations)
+			for _, srvID := range trims {
+				plan.Trims = append(plan.Trims, PlannedTrim{Block: block, Node: srvID})
+			}
+		}
+	}
+
+	if d.destination != "" {
+		for block, locations := range blockLocations {
+			if len(locations) > 0 && !backedUp[block] {
+				transfer(EventBackup, block, locations[0], []string{d.destination})
+			}
+		}
+	}
+
+	d.sizeTransfers(ctx, &plan)
+	slices.SortFunc(plan.Transfers, func(a, b PlannedTransfer) int {
+		return cmp.Or(cmp.Compare(a.Block, b.Block), cmp.Compare(a.Kind, b.Kind), cmp.Compare(a.Source, b.Source))
+	})
+	slices.SortFunc(plan.Trims, func(a, b PlannedTrim) int {
+		return cmp.Or(cmp.Compare(a.Block, b.Block), cmp.Compare(a.Node, b.Node))
+	})
+	return plan, nil
+}
+
+// sizeTransfers asks the sources of the transfers of plan for the sizes of
+// their blocks and totals the bytes the transfers would copy.
+func (d *InMemoryDistribute) sizeTransfers(ctx context.Context, plan *Plan) {
+	sizes := make(map[string]int64)
+	for i := range plan.Transfers {
+		t := &plan.Transfers[i]
+		size, ok := sizes[t.Block]
+		if !ok {
+			size = -1
+			if addr, ok := d.getServiceAddress(t.Source, false); ok {
+				if s, ok := storage.NewClient(addr, nil).Size(ctx, t.Block); ok {
+					size = s
+				}
+			}
+			sizes[t.Block] = size
+		}
+		t.Size = size
+		plan.Copies += len(t.Destinations)
+		if size < 0 {
+			plan.Unsized++
+		} else {
+			plan.Bytes += size * int64(len(t.Destinations))
+		}
+	}
+}
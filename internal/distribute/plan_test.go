@@ -0,0 +1,126 @@
+package distribute_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"invariant/internal/discovery"
+	"invariant/internal/distribute"
+	"invariant/internal/storage"
+)
+
+func TestDistributeServer_Plan(t *testing.T) {
+	ctx := context.Background()
+	stores := []*storage.InMemoryStorage{storage.NewInMemoryStorage(), storage.NewInMemoryStorage()}
+
+	blockData := []byte("block planned for a closer node")
+	block, err := stores[0].Store(ctx, bytes.NewReader(blockData))
+	if err != nil {
+		t.Fatalf("Failed to store block: %v", err)
+	}
+	stores[1].Store(ctx, bytes.NewReader(blockData))
+
+	// Node 0 is close to the block, node 1 is far from it and node 2, which
+	// is only planned, would be the closest
+	blockBytes, _ := hex.DecodeString(block)
+	idFor := func(flip int) string {
+		id := slices.Clone(blockBytes)
+		if flip >= 0 {
+			id[flip] ^= 0xff
+		}
+		return hex.EncodeToString(id)
+	}
+	ids := []string{idFor(31), idFor(0), idFor(-1)}
+
+	disc := &mockDiscovery{}
+	for i, store := range stores {
+		srv := httptest.NewServer(storage.NewStorageServer(store))
+		defer srv.Close()
+		disc.services = append(disc.services, discovery.ServiceDescription{ID: ids[i], Address: srv.URL, Protocols: []string{"storage-v1"}})
+	}
+
+	d := distribute.NewInMemoryDistribute(disc, 2, 3, "", 0)
+	d.Register(ctx, ids[0])
+	d.Register(ctx, ids[1])
+	d.Notify(ctx, ids[0], []string{block})
+	d.Notify(ctx, ids[1], []string{block})
+	d.Sync()
+
+	ts := httptest.NewServer(distribute.NewDistributeServer("", d))
+	defer ts.Close()
+	client := distribute.NewClient(ts.URL, nil)
+
+	// Nothing to do as things are
+	plan, err := client.Plan(ctx, distribute.PlanRequest{})
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if plan.ReplicationFactor != 2 || plan.Nodes != 2 || len(plan.Transfers) != 0 || len(plan.Trims) != 0 {
+		t.Errorf("Expected an empty plan, got %+v", plan)
+	}
+
+	// A request without a body is the empty request
+	res, err := http.Post(ts.URL+"/plan", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Post failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected an empty body to be accepted, got %d", res.StatusCode)
+	}
+
+	// Adding the closest node hands the block off to it and trims the farthest
+	plan, err = client.Plan(ctx, distribute.PlanRequest{Add: []string{ids[2]}})
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if len(plan.Transfers) != 1 || plan.Transfers[0].Kind != distribute.EventRebalance || plan.Transfers[0].Block != block ||
+		!slices.Equal(plan.Transfers[0].Destinations, []string{ids[2]}) || plan.Transfers[0].Size != int64(len(blockData)) {
+		t.Errorf("Expected a rebalance to the new node, got %+v", plan.Transfers)
+	}
+	if len(plan.Trims) != 1 || plan.Trims[0] != (distribute.PlannedTrim{Block: block, Node: ids[1]}) {
+		t.Errorf("Expected the farthest replica to be trimmed, got %+v", plan.Trims)
+	}
+	if plan.Copies != 1 || plan.Bytes != int64(len(blockData)) {
+		t.Errorf("Expected a copy of %d bytes, got %d copies of %d bytes", len(blockData), plan.Copies, plan.Bytes)
+	}
+
+	// Raising the replication factor keeps the replicas and adds one
+	plan, err = client.Plan(ctx, distribute.PlanRequest{ReplicationFactor: 3, Add: []string{ids[2]}})
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if len(plan.Transfers) != 1 || plan.Transfers[0].Kind != distribute.EventReplicate || len(plan.Trims) != 0 {
+		t.Errorf("Expected a single replication, got %+v", plan)
+	}
+
+	// Decommissioning a node leaves too few nodes for the block
+	plan, err = client.Plan(ctx, distribute.PlanRequest{Decommission: []string{ids[1]}})
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if plan.Nodes != 1 || plan.Unplaced != 1 {
+		t.Errorf("Expected the block to be unplaced, got %+v", plan)
+	}
+
+	// Planning changes nothing
+	if status, _ := d.Status(ctx); len(status.Nodes) != 2 || status.Nodes[0].Decommissioning || status.Nodes[1].Decommissioning {
+		t.Errorf("Expected the nodes to be unchanged, got %+v", status.Nodes)
+	}
+	if locations, _ := d.Locations(ctx, block); len(locations) != 2 {
+		t.Errorf("Expected the block to keep its locations, got %v", locations)
+	}
+
+	if _, err := d.Plan(ctx, distribute.PlanRequest{Decommission: []string{ids[2]}}); !errors.Is(err, distribute.ErrUnknownService) {
+		t.Errorf("Expected ErrUnknownService, got %v", err)
+	}
+	if _, err := client.Plan(ctx, distribute.PlanRequest{ReplicationFactor: -1}); err == nil {
+		t.Errorf("Expected a negative replication factor to be rejected")
+	}
+}
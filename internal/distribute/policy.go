@@ -0,0 +1,63 @@
+package distribute
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrInvalidReplicas is returned when a replication policy requests a negative
+// number of replicas.
+var ErrInvalidReplicas = errors.New("replicas must not be negative")
+
+// ReplicationPolicy is the replication requested for a single block.
+type ReplicationPolicy struct {
+	// Replicas is the number of storage services that should hold the block.
+	// Zero means the default replication factor applies.
+	Replicas int `json:"replicas"`
+}
+
+// ReplicationPolicies is implemented by distribute services that allow the
+// replication factor to be overridden per block. Callers use it to keep more
+// copies of critical blocks, such as slot roots and directories, than of bulk
+// file data.
+type ReplicationPolicies interface {
+	SetReplication(ctx context.Context, address string, policy ReplicationPolicy) error
+	Replication(ctx context.Context, address string) (ReplicationPolicy, error)
+}
+
+var _ ReplicationPolicies = (*InMemoryDistribute)(nil)
+
+// SetReplication overrides the replication factor of address. A policy of
+// zero replicas restores the default.
+func (d *InMemoryDistribute) SetReplication(ctx context.Context, address string, policy ReplicationPolicy) error {
+	if policy.Replicas < 0 {
+		return ErrInvalidReplicas
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if policy.Replicas == 0 {
+		delete(d.policies, address)
+	} else {
+		d.policies[address] = policy.Replicas
+	}
+	return nil
+}
+
+// Replication returns the effective replication policy of address.
+func (d *InMemoryDistribute) Replication(ctx context.Context, address string) (ReplicationPolicy, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return ReplicationPolicy{Replicas: d.replicasLocked(address)}, nil
+}
+
+// replicasLocked returns the number of replicas required for address. d.mu
+// must be held.
+func (d *InMemoryDistribute) replicasLocked(address string) int {
+	if replicas, ok := d.policies[address]; ok {
+		return replicas
+	}
+	return d.repFactor
+}
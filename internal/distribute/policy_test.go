@@ -0,0 +1,85 @@
+package distribute_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"invariant/internal/discovery"
+	"invariant/internal/distribute"
+	"invariant/internal/storage"
+)
+
+func TestInMemoryDistribute_ReplicationPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	fetches := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /fetch", func(w http.ResponseWriter, r *http.Request) {
+		var req storage.StorageFetchRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		fetches += max(len(req.Addresses), 1)
+		mu.Unlock()
+		if len(req.Addresses) > 0 {
+			json.NewEncoder(w).Encode(storage.StorageFetchResponse{})
+		}
+	})
+
+	disc := &mockDiscovery{}
+	d := distribute.NewInMemoryDistribute(disc, 2, 3, "", 0)
+	for _, id := range []string{
+		"0000000000000000000000000000000100000000000000000000000000000000",
+		"0000000000000000000000000000000200000000000000000000000000000000",
+		"0000000000000000000000000000000300000000000000000000000000000000",
+		"0000000000000000000000000000000400000000000000000000000000000000",
+	} {
+		srv := httptest.NewServer(mux)
+		defer srv.Close()
+		disc.services = append(disc.services, discovery.ServiceDescription{ID: id, Address: srv.URL, Protocols: []string{"storage-v1"}})
+		d.Register(ctx, id)
+	}
+
+	ts := httptest.NewServer(distribute.NewDistributeServer("", d))
+	defer ts.Close()
+	client := distribute.NewClient(ts.URL, ts.Client())
+
+	critical := "1111111111111111111111111111111111111111111111111111111111111111"
+	bulk := "2222222222222222222222222222222222222222222222222222222222222222"
+
+	if err := client.SetReplication(ctx, critical, distribute.ReplicationPolicy{Replicas: 4}); err != nil {
+		t.Fatalf("SetReplication failed: %v", err)
+	}
+	if err := client.SetReplication(ctx, bulk, distribute.ReplicationPolicy{Replicas: -1}); err == nil {
+		t.Fatalf("Expected a negative replica count to be rejected")
+	}
+
+	if policy, err := client.Replication(ctx, critical); err != nil || policy.Replicas != 4 {
+		t.Fatalf("Expected 4 replicas for the critical block, got %d (err: %v)", policy.Replicas, err)
+	}
+	if policy, err := client.Replication(ctx, bulk); err != nil || policy.Replicas != 2 {
+		t.Fatalf("Expected the default 2 replicas for the bulk block, got %d (err: %v)", policy.Replicas, err)
+	}
+
+	d.Notify(ctx, disc.services[0].ID, []string{critical, bulk})
+	d.Sync()
+
+	// The critical block is copied to the 3 other nodes, the bulk block to 1
+	mu.Lock()
+	if fetches != 4 {
+		t.Errorf("Expected 4 fetches, got %d", fetches)
+	}
+	mu.Unlock()
+
+	// Removing the policy restores the default
+	if err := client.SetReplication(ctx, critical, distribute.ReplicationPolicy{}); err != nil {
+		t.Fatalf("SetReplication failed: %v", err)
+	}
+	if policy, err := client.Replication(ctx, critical); err != nil || policy.Replicas != 2 {
+		t.Fatalf("Expected the default 2 replicas after clearing the policy, got %d (err: %v)", policy.Replicas, err)
+	}
+}
@@ -0,0 +1,58 @@
+package distribute
+
+import (
+	"context"
+	"slices"
+)
+
+// BlockQuery is implemented by distribute services that can report where
+// blocks are located. It is used by tooling such as the doctor and garbage
+// collector.
+type BlockQuery interface {
+	// Locations returns the IDs of the services known to have address.
+	Locations(ctx context.Context, address string) ([]string, error)
+
+	// Blocks returns the addresses of the blocks known to be held by the
+	// service with id, in ascending order, skipping the first offset blocks
+	// and returning at most length blocks if length is positive. It reports
+	// false if the service is unknown.
+	Blocks(ctx context.Context, id string, offset, length int) ([]string, bool, error)
+}
+
+var _ BlockQuery = (*InMemoryDistribute)(nil)
+
+// Locations returns the IDs of the services known to have address, in
+// ascending order, including the backup destination.
+func (d *InMemoryDistribute) Locations(ctx context.Context, address string) ([]string, error) {
+	result := d.locations(address)
+	slices.Sort(result)
+	return result, nil
+}
+
+// Blocks returns a page of the addresses of the blocks known to be held by the
+// service with id.
+func (d *InMemoryDistribute) Blocks(ctx context.Context, id string, offset, length int) ([]string, bool, error) {
+	d.mu.RLock()
+	var blocks map[string]struct{}
+	if d.destination != "" && id == d.destination {
+		blocks = d.destinationBlocks
+	} else if state, ok := d.services[id]; ok {
+		blocks = state.blocks
+	} else {
+		d.mu.RUnlock()
+		return nil, false, nil
+	}
+	addresses := make([]string, 0, len(blocks))
+	for address := range blocks {
+		addresses = append(addresses, address)
+	}
+	d.mu.RUnlock()
+
+	slices.Sort(addresses)
+	offset = min(max(offset, 0), len(addresses))
+	addresses = addresses[offset:]
+	if length > 0 && length < len(addresses) {
+		addresses = addresses[:length]
+	}
+	return addresses, true, nil
+}
@@ -4,7 +4,11 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"invariant/internal/notify"
 )
@@ -33,6 +37,19 @@ func NewDistributeServer(id string, distribute Distribute) *DistributeServer {
 	mux.HandleFunc("GET /id", s.handleGetID)
 	mux.HandleFunc("PUT /register/{id}", s.handleRegister)
 	mux.HandleFunc("PUT /notify/{id}", s.handleNotify)
+	mux.HandleFunc("PUT /forget/{id}", s.handleForget)
+	mux.HandleFunc("PUT /decommission/{id}", s.handleDecommission)
+	mux.HandleFunc("GET /status", s.handleStatus)
+	mux.HandleFunc("POST /census", s.handleCensus)
+	mux.HandleFunc("POST /plan", s.handlePlan)
+	mux.HandleFunc("GET /config", s.handleGetConfig)
+	mux.HandleFunc("PUT /config", s.handlePutConfig)
+	mux.HandleFunc("GET /policy/{address}", s.handleGetPolicy)
+	mux.HandleFunc("PUT /policy/{address}", s.handlePutPolicy)
+	mux.HandleFunc("DELETE /policy/{address}", s.handleDeletePolicy)
+	mux.HandleFunc("GET /blocks/{address}", s.handleGetLocations)
+	mux.HandleFunc("GET /nodes/{id}/blocks", s.handleGetNodeBlocks)
+	mux.HandleFunc("GET /events", s.handleGetEvents)
 
 	s.handler = mux
 	return s
@@ -89,3 +106,345 @@ func (s *DistributeServer) handleNotify(w http.ResponseWriter, r *http.Request)
 
 	w.WriteHeader(http.StatusOK)
 }
+
+func (s *DistributeServer) handleForget(w http.ResponseWriter, r *http.Request) {
+	forgetter, ok := s.distribute.(Forgetter)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	var req notify.NotifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad Request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := forgetter.Forget(r.Context(), r.PathValue("id"), req.Addresses); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *DistributeServer) handleDecommission(w http.ResponseWriter, r *http.Request) {
+	decommissioner, ok := s.distribute.(Decommissioner)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	found, err := decommissioner.Decommission(r.Context(), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *DistributeServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	reporter, ok := s.distribute.(StatusReporter)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	status, err := reporter.Status(r.Context())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (s *DistributeServer) handleCensus(w http.ResponseWriter, r *http.Request) {
+	taker, ok := s.distribute.(CensusTaker)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	var req CensusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad Request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if req.Root == nil && len(req.Addresses) == 0 {
+		http.Error(w, "Bad Request: missing root or addresses", http.StatusBadRequest)
+		return
+	}
+
+	report, err := taker.Census(r.Context(), req)
+	if err != nil {
+		if errors.Is(err, ErrSlotLink) {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (s *DistributeServer) handlePlan(w http.ResponseWriter, r *http.Request) {
+	planner, ok := s.distribute.(Planner)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	// An empty body plans for the current services and replication factor
+	var req PlanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Bad Request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	plan, err := planner.Plan(r.Context(), req)
+	if err != nil {
+		if errors.Is(err, ErrInvalidReplicas) || errors.Is(err, ErrUnknownService) {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+func (s *DistributeServer) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	configurable, ok := s.distribute.(Configurable)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	config, err := configurable.Config(r.Context())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+func (s *DistributeServer) handlePutConfig(w http.ResponseWriter, r *http.Request) {
+	configurable, ok := s.distribute.(Configurable)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	// The settings missing from the request keep their current values
+	config, err := configurable.Config(r.Context())
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		http.Error(w, "Bad Request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	plan, err := configurable.SetConfig(r.Context(), config)
+	if err != nil {
+		if errors.Is(err, ErrInvalidConfig) {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ConfigChange{Config: config, Plan: plan})
+}
+
+func (s *DistributeServer) policies(w http.ResponseWriter) (ReplicationPolicies, bool) {
+	policies, ok := s.distribute.(ReplicationPolicies)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+	}
+	return policies, ok
+}
+
+func (s *DistributeServer) handleGetPolicy(w http.ResponseWriter, r *http.Request) {
+	policies, ok := s.policies(w)
+	if !ok {
+		return
+	}
+
+	policy, err := policies.Replication(r.Context(), r.PathValue("address"))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+func (s *DistributeServer) handlePutPolicy(w http.ResponseWriter, r *http.Request) {
+	policies, ok := s.policies(w)
+	if !ok {
+		return
+	}
+
+	var policy ReplicationPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "Bad Request: invalid JSON", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	s.setPolicy(w, r, policies, policy)
+}
+
+func (s *DistributeServer) handleDeletePolicy(w http.ResponseWriter, r *http.Request) {
+	policies, ok := s.policies(w)
+	if !ok {
+		return
+	}
+	s.setPolicy(w, r, policies, ReplicationPolicy{})
+}
+
+func (s *DistributeServer) setPolicy(w http.ResponseWriter, r *http.Request, policies ReplicationPolicies, policy ReplicationPolicy) {
+	if err := policies.SetReplication(r.Context(), r.PathValue("address"), policy); err != nil {
+		if errors.Is(err, ErrInvalidReplicas) {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *DistributeServer) handleGetLocations(w http.ResponseWriter, r *http.Request) {
+	query, ok := s.distribute.(BlockQuery)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	ids, err := query.Locations(r.Context(), r.PathValue("address"))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ids)
+}
+
+func (s *DistributeServer) handleGetNodeBlocks(w http.ResponseWriter, r *http.Request) {
+	query, ok := s.distribute.(BlockQuery)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	offset, err := queryInt(r, "offset")
+	if err != nil {
+		http.Error(w, "Bad Request: invalid offset", http.StatusBadRequest)
+		return
+	}
+	length, err := queryInt(r, "length")
+	if err != nil {
+		http.Error(w, "Bad Request: invalid length", http.StatusBadRequest)
+		return
+	}
+
+	addresses, found, err := query.Blocks(r.Context(), r.PathValue("id"), offset, length)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addresses)
+}
+
+func (s *DistributeServer) handleGetEvents(w http.ResponseWriter, r *http.Request) {
+	reporter, ok := s.distribute.(EventReporter)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	q := EventQuery{
+		Block: r.URL.Query().Get("block"),
+		Node:  r.URL.Query().Get("node"),
+	}
+	var err error
+	if q.Since, err = queryTime(r, "since"); err != nil {
+		http.Error(w, "Bad Request: invalid since", http.StatusBadRequest)
+		return
+	}
+	if q.Until, err = queryTime(r, "until"); err != nil {
+		http.Error(w, "Bad Request: invalid until", http.StatusBadRequest)
+		return
+	}
+	if q.Limit, err = queryInt(r, "limit"); err != nil {
+		http.Error(w, "Bad Request: invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	events, err := reporter.Events(r.Context(), q)
+	if err != nil {
+		if errors.Is(err, ErrNoEventLog) {
+			http.Error(w, "Not Implemented: "+err.Error(), http.StatusNotImplemented)
+		} else {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if events == nil {
+		events = []Event{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// queryTime parses the optional RFC 3339 time query parameter name,
+// defaulting to the zero time.
+func queryTime(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// queryInt parses the optional integer query parameter name, defaulting to 0.
+func queryInt(r *http.Request, name string) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
@@ -2,11 +2,13 @@ package distribute
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"testing"
 
 	"invariant/internal/notify"
@@ -82,3 +84,88 @@ func TestDistributeServer(t *testing.T) {
 		t.Errorf("Missing expected blocks, got %v", blocks)
 	}
 }
+
+func TestDistributeServer_BlockQuery(t *testing.T) {
+	ctx := context.Background()
+	d := NewInMemoryDistribute(nil, 3, 3, "backup", 0)
+	ts := httptest.NewServer(NewDistributeServer("", d))
+	defer ts.Close()
+	client := NewClient(ts.URL, ts.Client())
+
+	d.Notify(ctx, "node-a", []string{"c", "a", "b"})
+	d.Notify(ctx, "node-b", []string{"b"})
+	d.Notify(ctx, "backup", []string{"b"})
+
+	ids, err := client.Locations(ctx, "b")
+	if err != nil {
+		t.Fatalf("Locations failed: %v", err)
+	}
+	if !slices.Equal(ids, []string{"backup", "node-a", "node-b"}) {
+		t.Errorf("Unexpected locations of b: %v", ids)
+	}
+	if ids, err := client.Locations(ctx, "missing"); err != nil || len(ids) != 0 {
+		t.Errorf("Expected no locations for a missing block, got %v (err: %v)", ids, err)
+	}
+
+	blocks, found, err := client.Blocks(ctx, "node-a", 0, 0)
+	if err != nil || !found || !slices.Equal(blocks, []string{"a", "b", "c"}) {
+		t.Errorf("Unexpected blocks of node-a: %v (found: %t, err: %v)", blocks, found, err)
+	}
+	blocks, found, err = client.Blocks(ctx, "node-a", 1, 1)
+	if err != nil || !found || !slices.Equal(blocks, []string{"b"}) {
+		t.Errorf("Unexpected page of node-a: %v (found: %t, err: %v)", blocks, found, err)
+	}
+	blocks, found, err = client.Blocks(ctx, "node-a", 5, 1)
+	if err != nil || !found || len(blocks) != 0 {
+		t.Errorf("Expected an empty page past the end, got %v (found: %t, err: %v)", blocks, found, err)
+	}
+	if _, found, err := client.Blocks(ctx, "unknown", 0, 0); err != nil || found {
+		t.Errorf("Expected an unknown node to not be found (found: %t, err: %v)", found, err)
+	}
+}
+
+func TestDistributeServer_Status(t *testing.T) {
+	ctx := context.Background()
+	d := NewInMemoryDistribute(nil, 2, 3, "backup", 0)
+	ts := httptest.NewServer(NewDistributeServer("distribute-1", d))
+	defer ts.Close()
+	client := NewClient(ts.URL, ts.Client())
+
+	if id, err := client.ID(ctx); err != nil || id != "distribute-1" {
+		t.Fatalf("Unexpected ID %q (err: %v)", id, err)
+	}
+	if err := client.Notify(ctx, "node-a", []string{"a", "b", "c"}); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	client.Notify(ctx, "node-b", []string{"b"})
+	client.Notify(ctx, "backup", []string{"a"})
+
+	// Forgetting blocks, such as after they are collected, removes the locations
+	if err := client.Forget(ctx, "node-a", []string{"c"}); err != nil {
+		t.Fatalf("Forget failed: %v", err)
+	}
+	if ids, _ := client.Locations(ctx, "c"); len(ids) != 0 {
+		t.Errorf("Expected a forgotten block to have no locations, got %v", ids)
+	}
+
+	found, err := client.Decommission(ctx, "node-b")
+	if err != nil || !found {
+		t.Fatalf("Decommission failed (found: %t, err: %v)", found, err)
+	}
+	if found, err := client.Decommission(ctx, "unknown"); err != nil || found {
+		t.Errorf("Expected an unknown node to not be found (found: %t, err: %v)", found, err)
+	}
+
+	status, err := client.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	want := []NodeStatus{
+		{ID: "backup", Blocks: 1, Destination: true},
+		{ID: "node-a", Blocks: 2},
+		{ID: "node-b", Blocks: 1, Decommissioning: true},
+	}
+	if status.ReplicationFactor != 2 || status.Blocks != 2 || !slices.Equal(status.Nodes, want) {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+}
@@ -0,0 +1,231 @@
+package distribute
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// NodeStatus is the state of a storage service known to a distribute service.
+type NodeStatus struct {
+	ID       string `json:"id"`
+	Blocks   int    `json:"blocks"`
+	Failures int    `json:"failures,omitempty"`
+
+	// Removed services were dropped after failing too many transfers, as
+	// the destination refusing them or the source unable to provide them, and
+	// are re-admitted when they register again.
+	Removed bool `json:"removed,omitempty"`
+
+	// Decommissioning services are no longer given blocks and are forgotten
+	// once their blocks are replicated by the other services.
+	Decommissioning bool `json:"decommissioning,omitempty"`
+
+	// Destination is set for the backup destination.
+	Destination bool `json:"destination,omitempty"`
+}
+
+// Status is the state of a distribute service returned by GET /status.
+type Status struct {
+	ReplicationFactor int          `json:"replicationFactor"`
+	Policies          int          `json:"policies"`
+	Blocks            int          `json:"blocks"`
+	WantLists         bool         `json:"wantLists,omitempty"`
+	Nodes             []NodeStatus `json:"nodes"`
+}
+
+// StatusReporter is implemented by distribute services that report their state.
+type StatusReporter interface {
+	// Status reports the replication settings and the known storage services.
+	Status(ctx context.Context) (Status, error)
+}
+
+// Decommissioner is implemented by distribute services that can retire a
+// storage service.
+type Decommissioner interface {
+	// Decommission stops placing blocks on the service with id and copies
+	// the blocks it holds to the other services. The service is forgotten
+	// once each of its blocks is replicated elsewhere. It reports false if
+	// the service is unknown.
+	Decommission(ctx context.Context, id string) (bool, error)
+}
+
+// Forgetter is implemented by distribute services that can be told a storage
+// service no longer has blocks, such as after they are garbage collected.
+type Forgetter interface {
+	// Forget notifies the distribute service that the storage service with
+	// id no longer has the specified data blocks.
+	Forget(ctx context.Context, id string, addresses []string) error
+}
+
+var (
+	_ StatusReporter = (*InMemoryDistribute)(nil)
+	_ Decommissioner = (*InMemoryDistribute)(nil)
+	_ Forgetter      = (*InMemoryDistribute)(nil)
+)
+
+// Status reports the replication settings and the known storage services,
+// ordered by ID.
+func (d *InMemoryDistribute) Status(ctx context.Context) (Status, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	status := Status{
+		ReplicationFactor: d.repFactor,
+		Policies:          len(d.policies),
+		WantLists:         d.wantLists,
+		Nodes:             []NodeStatus{},
+	}
+	blocks := make(map[string]struct{})
+	add := func(id string, state *nodeState, removed bool) {
+		status.Nodes = append(status.Nodes, NodeStatus{
+			ID:              id,
+			Blocks:          len(state.blocks),
+			Failures:        state.failures,
+			Removed:         removed,
+			Decommissioning: state.decommissioning,
+		})
+		for block := range state.blocks {
+			blocks[block] = struct{}{}
+		}
+	}
+	for id, state := range d.services {
+		if !state.isDestination {
+			add(id, state, false)
+		}
+	}
+	for id, state := range d.removed {
+		add(id, state, true)
+	}
+	if d.destination != "" {
+		status.Nodes = append(status.Nodes, NodeStatus{
+			ID:          d.destination,
+			Blocks:      len(d.destinationBlocks),
+			Destination: true,
+		})
+	}
+	status.Blocks = len(blocks)
+	slices.SortFunc(status.Nodes, func(a, b NodeStatus) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return status, nil
+}
+
+// Decommission marks the service with id as decommissioning. Its blocks are
+// copied away by the following syncs.
+func (d *InMemoryDistribute) Decommission(ctx context.Context, id string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.services[id]
+	if !ok {
+		state, ok = d.removed[id]
+	}
+	if !ok || state.isDestination {
+		return false, nil
+	}
+	if !state.decommissioning {
+		log.Printf("Decommissioning node %s holding %d blocks", id, len(state.blocks))
+		state.decommissioning = true
+	}
+	return true, nil
+}
+
+// Forget removes addresses from the blocks known to be held by the service
+// with id.
+func (d *InMemoryDistribute) Forget(ctx context.Context, id string, addresses []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var blocks map[string]struct{}
+	if d.destination != "" && id == d.destination {
+		blocks = d.destinationBlocks
+	} else if state, ok := d.services[id]; ok {
+		blocks = state.blocks
+	} else if state, ok := d.removed[id]; ok {
+		blocks = state.blocks
+	} else {
+		return nil
+	}
+	for _, addr := range addresses {
+		delete(blocks, addr)
+	}
+	return nil
+}
+
+// drain copies the blocks of decommissioning services, given by retiring, to
+// the closest of the other services until each has the replicas it
+// requires, adding the copies to blockLocations. Decommissioning services
+// whose blocks all have enough replicas elsewhere are then forgotten.
+func (d *InMemoryDistribute) drain(blockLocations, retiring map[string][]string, required map[string]int) {
+	if len(retiring) == 0 {
+		return
+	}
+
+	for block, sources := range retiring {
+		if len(blockLocations[block]) >= required[block] {
+			continue
+		}
+		nodes, ok := d.closest(block)
+		if !ok {
+			continue
+		}
+		sourceSrvID := sources[0]
+		sourceAddr, ok := d.getServiceAddress(sourceSrvID, false)
+		if !ok {
+			continue
+		}
+		targets, spare := replicaTargets(nodes, blockLocations[block], required[block])
+		needed := len(targets)
+		for _, destSrvID := range slices.Concat(targets, spare) {
+			if needed <= 0 {
+				break
+			}
+			start := time.Now()
+			result := d.replicate(block, sourceSrvID, &sourceAddr, destSrvID)
+			d.record(EventReplicate, block, sourceSrvID, destSrvID, result.String(), nil, start)
+			d.recordTransfer(sourceSrvID, destSrvID, result)
+			if result == transferSourceFailed {
+				// The other destinations would fetch from the same source
+				break
+			}
+			if result != transferSucceeded {
+				continue
+			}
+			d.mu.Lock()
+			if state, ok := d.services[destSrvID]; ok {
+				state.blocks[block] = struct{}{}
+			}
+			d.mu.Unlock()
+			blockLocations[block] = append(blockLocations[block], destSrvID)
+			needed--
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	active := 0
+	for _, state := range d.services {
+		if !state.isDestination && !state.decommissioning {
+			active++
+		}
+	}
+	for id, state := range d.services {
+		if !state.decommissioning {
+			continue
+		}
+		drained := active > 0
+		for block := range state.blocks {
+			if len(blockLocations[block]) < min(required[block], active) {
+				drained = false
+				break
+			}
+		}
+		if drained {
+			log.Printf("Decommissioned node %s", id)
+			delete(d.services, id)
+		}
+	}
+}
@@ -3,9 +3,13 @@ package distribute_test
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -150,6 +154,10 @@ func TestInMemoryDistribute_Sync_RetryAndDrop(t *testing.T) {
 
 			w.WriteHeader(http.StatusOK)
 		})
+		// The source holds the blocks it was notified of
+		mux.HandleFunc("HEAD /{address}", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
 		return httptest.NewServer(mux)
 	}
 
@@ -219,6 +227,55 @@ func TestInMemoryDistribute_Sync_RetryAndDrop(t *testing.T) {
 	// Let's print out what actually occurred in the map.
 }
 
+func TestInMemoryDistribute_Sync_SourceFailed(t *testing.T) {
+	// The source no longer has the block, so the destination cannot fetch it
+	source := httptest.NewServer(http.NotFoundHandler())
+	defer source.Close()
+	dest := http.NewServeMux()
+	dest.HandleFunc("POST /fetch", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	s2 := httptest.NewServer(dest)
+	defer s2.Close()
+
+	id1 := "0000000000000000000000000000000100000000000000000000000000000000"
+	id2 := "0000000000000000000000000000000200000000000000000000000000000000"
+	disc := &mockDiscovery{
+		services: []discovery.ServiceDescription{
+			{ID: id1, Address: source.URL, Protocols: []string{"storage-v1"}},
+			{ID: id2, Address: s2.URL, Protocols: []string{"storage-v1"}},
+		},
+	}
+
+	// A single failed transfer removes a node
+	d := distribute.NewInMemoryDistribute(disc, 2, 1, "", 0)
+	d.Register(context.Background(), id1)
+	d.Register(context.Background(), id2)
+	d.Notify(context.Background(), id1, []string{"1111111111111111111111111111111111111111111111111111111111111111"})
+	d.Sync()
+
+	// The failure is counted against the source, not the destination
+	status, err := d.Status(context.Background())
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if len(status.Nodes) != 2 {
+		t.Fatalf("Expected both nodes in the status, got %+v", status.Nodes)
+	}
+	for _, node := range status.Nodes {
+		switch node.ID {
+		case id1:
+			if !node.Removed {
+				t.Errorf("Expected the source to be removed, got %+v", node)
+			}
+		case id2:
+			if node.Removed || node.Failures != 0 {
+				t.Errorf("Expected the destination to be kept without failures, got %+v", node)
+			}
+		}
+	}
+}
+
 func TestInMemoryDistribute_Sync_OnlyRegistered(t *testing.T) {
 	// Re-verify that unregistered nodes are ignored in sync
 	var mu sync.Mutex
@@ -328,3 +385,288 @@ func TestInMemoryDistribute_Sync_Integration(t *testing.T) {
 		t.Errorf("store3 did not receive the synchronized block")
 	}
 }
+
+// unreliableDiscovery fails to resolve the services in down
+type unreliableDiscovery struct {
+	mockDiscovery
+	mu   sync.Mutex
+	down map[string]bool
+}
+
+func (u *unreliableDiscovery) Get(ctx context.Context, id string) (discovery.ServiceDescription, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.down[id] {
+		return discovery.ServiceDescription{}, false
+	}
+	return u.mockDiscovery.Get(ctx, id)
+}
+
+func TestInMemoryDistribute_Sync_DiscoveryUnavailable(t *testing.T) {
+	stable := http.NewServeMux()
+	stable.HandleFunc("POST /fetch", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	stable.HandleFunc("HEAD /{address}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	failing := http.NewServeMux()
+	failing.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	s1 := httptest.NewServer(stable)
+	defer s1.Close()
+	s2 := httptest.NewServer(failing)
+	defer s2.Close()
+
+	id1 := "0000000000000000000000000000000100000000000000000000000000000000"
+	id2 := "0000000000000000000000000000000200000000000000000000000000000000"
+	disc := &unreliableDiscovery{
+		mockDiscovery: mockDiscovery{
+			services: []discovery.ServiceDescription{
+				{ID: id1, Address: s1.URL, Protocols: []string{"storage-v1"}},
+				{ID: id2, Address: s2.URL, Protocols: []string{"storage-v1"}},
+			},
+		},
+		down: map[string]bool{id2: true},
+	}
+
+	// A single refused transfer removes a node
+	d := distribute.NewInMemoryDistribute(disc, 2, 1, "", 0)
+	d.Register(context.Background(), id1)
+	d.Register(context.Background(), id2)
+
+	blockA := "1111111111111111111111111111111111111111111111111111111111111111"
+	blockB := "2222222222222222222222222222222222222222222222222222222222222222"
+	d.Notify(context.Background(), id1, []string{blockA})
+	d.Notify(context.Background(), id2, []string{blockB})
+
+	// Node 2 cannot be resolved which is not held against it
+	d.Sync()
+	if blocks := d.GetBlocks(id2); len(blocks) != 1 {
+		t.Fatalf("Expected node 2 to be kept while it cannot be resolved, got %v", blocks)
+	}
+
+	// Once resolved, node 2 refuses the transfer and is removed
+	disc.mu.Lock()
+	disc.down = nil
+	disc.mu.Unlock()
+	d.Sync()
+	if blocks := d.GetBlocks(id2); blocks != nil {
+		t.Fatalf("Expected node 2 to be removed after refusing a transfer, got %v", blocks)
+	}
+
+	// Registering again re-admits it with the blocks it was known to have
+	d.Register(context.Background(), id2)
+	if blocks := d.GetBlocks(id2); len(blocks) != 1 || blocks[0] != blockB {
+		t.Fatalf("Expected node 2 to be re-admitted with %s, got %v", blockB, blocks)
+	}
+}
+
+func TestInMemoryDistribute_Rebalance(t *testing.T) {
+	ctx := context.Background()
+	stores := []*storage.InMemoryStorage{storage.NewInMemoryStorage(), storage.NewInMemoryStorage(), storage.NewInMemoryStorage()}
+
+	blockData := []byte("block handed off to a closer node")
+	block, err := stores[0].Store(ctx, bytes.NewReader(blockData))
+	if err != nil {
+		t.Fatalf("Failed to store block: %v", err)
+	}
+	stores[1].Store(ctx, bytes.NewReader(blockData))
+
+	// Node 0 is close to the block, node 1 is far from it and node 2, which
+	// joins later, is the closest
+	blockBytes, _ := hex.DecodeString(block)
+	idFor := func(flip int) string {
+		id := slices.Clone(blockBytes)
+		if flip >= 0 {
+			id[flip] ^= 0xff
+		}
+		return hex.EncodeToString(id)
+	}
+	ids := []string{idFor(31), idFor(0), idFor(-1)}
+
+	disc := &mockDiscovery{}
+	for i, store := range stores {
+		srv := httptest.NewServer(storage.NewStorageServer(store))
+		defer srv.Close()
+		disc.services = append(disc.services, discovery.ServiceDescription{ID: ids[i], Address: srv.URL, Protocols: []string{"storage-v1"}})
+	}
+
+	d := distribute.NewInMemoryDistribute(disc, 2, 3, "", 0)
+	d.Register(ctx, ids[0])
+	d.Register(ctx, ids[1])
+	d.Notify(ctx, ids[0], []string{block})
+	d.Notify(ctx, ids[1], []string{block})
+	d.Sync()
+
+	d.Register(ctx, ids[2])
+	d.Sync()
+
+	if !stores[2].Has(ctx, block) {
+		t.Errorf("Expected the block to be handed off to the new closer node")
+	}
+	if !stores[0].Has(ctx, block) {
+		t.Errorf("Expected the block to be kept on the close node")
+	}
+	if stores[1].Has(ctx, block) {
+		t.Errorf("Expected the surplus replica on the farthest node to be trimmed")
+	}
+	if blocks := d.GetBlocks(ids[1]); len(blocks) != 0 {
+		t.Errorf("Expected the farthest node to no longer be a location of the block, got %v", blocks)
+	}
+}
+
+func TestInMemoryDistribute_Sync_Batch(t *testing.T) {
+	var mu sync.Mutex
+	var requests []storage.StorageFetchRequest
+
+	// The destination fails to fetch one block of the batch
+	unavailable := "3333333333333333333333333333333333333333333333333333333333333333"
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req storage.StorageFetchRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+		if len(req.Addresses) > 0 {
+			json.NewEncoder(w).Encode(storage.StorageFetchResponse{Failed: []string{unavailable}})
+		}
+	}))
+	defer dest.Close()
+	source := httptest.NewServer(http.NotFoundHandler())
+	defer source.Close()
+
+	id1 := "0000000000000000000000000000000100000000000000000000000000000000"
+	id2 := "0000000000000000000000000000000200000000000000000000000000000000"
+	disc := &mockDiscovery{
+		services: []discovery.ServiceDescription{
+			{ID: id1, Address: source.URL, Protocols: []string{"storage-v1"}},
+			{ID: id2, Address: dest.URL, Protocols: []string{"storage-v1"}},
+		},
+	}
+	d := distribute.NewInMemoryDistribute(disc, 2, 3, "", 0)
+	d.Register(context.Background(), id1)
+	d.Register(context.Background(), id2)
+
+	blocks := []string{
+		"1111111111111111111111111111111111111111111111111111111111111111",
+		"2222222222222222222222222222222222222222222222222222222222222222",
+		unavailable,
+	}
+	d.Notify(context.Background(), id1, blocks)
+	d.Sync()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 2 {
+		t.Fatalf("Expected a batch and a retry of the failed block, got %d requests", len(requests))
+	}
+	batch := requests[0]
+	slices.Sort(batch.Addresses)
+	if !slices.Equal(batch.Addresses, blocks) || batch.Container != id1 {
+		t.Errorf("Unexpected batch %+v", batch)
+	}
+	if retry := requests[1]; retry.Address != unavailable || len(retry.Addresses) != 0 {
+		t.Errorf("Expected the failed block to be fetched on its own, got %+v", retry)
+	}
+}
+
+func TestInMemoryDistribute_Sync_WantLists(t *testing.T) {
+	var mu sync.Mutex
+	var wanted []string
+	fetches := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /wants", func(w http.ResponseWriter, r *http.Request) {
+		var addresses []string
+		json.NewDecoder(r.Body).Decode(&addresses)
+		mu.Lock()
+		wanted = append(wanted, addresses...)
+		mu.Unlock()
+	})
+	mux.HandleFunc("POST /fetch", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+	})
+	dest := httptest.NewServer(mux)
+	defer dest.Close()
+	source := httptest.NewServer(http.NotFoundHandler())
+	defer source.Close()
+
+	id1 := "0000000000000000000000000000000100000000000000000000000000000000"
+	id2 := "0000000000000000000000000000000200000000000000000000000000000000"
+	disc := &mockDiscovery{
+		services: []discovery.ServiceDescription{
+			{ID: id1, Address: source.URL, Protocols: []string{"storage-v1"}},
+			{ID: id2, Address: dest.URL, Protocols: []string{"storage-v1"}},
+		},
+	}
+	d := distribute.NewInMemoryDistribute(disc, 2, 3, "", 0).WithWantLists(true)
+	d.Register(context.Background(), id1)
+	d.Register(context.Background(), id2)
+
+	blocks := []string{
+		"1111111111111111111111111111111111111111111111111111111111111111",
+		"2222222222222222222222222222222222222222222222222222222222222222",
+	}
+	d.Notify(context.Background(), id1, blocks)
+	d.Sync()
+
+	mu.Lock()
+	defer mu.Unlock()
+	slices.Sort(wanted)
+	if !slices.Equal(wanted, blocks) {
+		t.Errorf("Expected the destination to want %v, got %v", blocks, wanted)
+	}
+	if fetches != 0 {
+		t.Errorf("Expected no fetches with want lists, got %d", fetches)
+	}
+}
+
+func TestInMemoryDistribute_Decommission(t *testing.T) {
+	ctx := context.Background()
+	stores := []*storage.InMemoryStorage{storage.NewInMemoryStorage(), storage.NewInMemoryStorage(), storage.NewInMemoryStorage()}
+
+	blockData := []byte("block moved off a decommissioned node")
+	block, err := stores[0].Store(ctx, bytes.NewReader(blockData))
+	if err != nil {
+		t.Fatalf("Failed to store block: %v", err)
+	}
+	stores[1].Store(ctx, bytes.NewReader(blockData))
+
+	disc := &mockDiscovery{}
+	var ids []string
+	for i, store := range stores {
+		srv := httptest.NewServer(storage.NewStorageServer(store))
+		defer srv.Close()
+		id := strings.Repeat("0", 63) + strconv.Itoa(i+1)
+		ids = append(ids, id)
+		disc.services = append(disc.services, discovery.ServiceDescription{ID: id, Address: srv.URL, Protocols: []string{"storage-v1"}})
+	}
+
+	d := distribute.NewInMemoryDistribute(disc, 2, 3, "", 0)
+	for _, id := range ids {
+		d.Register(ctx, id)
+	}
+	d.Notify(ctx, ids[0], []string{block})
+	d.Notify(ctx, ids[1], []string{block})
+
+	if found, err := d.Decommission(ctx, ids[0]); err != nil || !found {
+		t.Fatalf("Decommission failed (found: %t, err: %v)", found, err)
+	}
+	d.Sync()
+
+	if !stores[2].Has(ctx, block) {
+		t.Errorf("Expected the block of the decommissioned node to be copied to the remaining node")
+	}
+	status, _ := d.Status(ctx)
+	for _, node := range status.Nodes {
+		if node.ID == ids[0] {
+			t.Errorf("Expected the drained node to be forgotten, got %+v", node)
+		}
+	}
+	if locations, _ := d.Locations(ctx, block); !slices.Equal(locations, ids[1:]) {
+		t.Errorf("Unexpected locations after decommissioning: %v", locations)
+	}
+}
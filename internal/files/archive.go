@@ -0,0 +1,221 @@
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"invariant/internal/filetree"
+)
+
+// Formats of the archives of GET /archive/:node.
+const (
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+)
+
+// archiveWriter adds the entries of a directory subtree to an archive.
+type archiveWriter interface {
+	addDirectory(name string, mode fs.FileMode, modTime time.Time) error
+	addFile(name string, mode fs.FileMode, modTime time.Time, size int64, r io.Reader) error
+	addSymlink(name, target string, modTime time.Time) error
+	Close() error
+}
+
+type zipArchive struct{ zw *zip.Writer }
+
+func (a *zipArchive) addDirectory(name string, mode fs.FileMode, modTime time.Time) error {
+	hdr := &zip.FileHeader{Name: name + "/", Modified: modTime}
+	hdr.SetMode(fs.ModeDir | mode)
+	_, err := a.zw.CreateHeader(hdr)
+	return err
+}
+
+func (a *zipArchive) addFile(name string, mode fs.FileMode, modTime time.Time, size int64, r io.Reader) error {
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime}
+	hdr.SetMode(mode)
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a *zipArchive) addSymlink(name, target string, modTime time.Time) error {
+	hdr := &zip.FileHeader{Name: name, Modified: modTime}
+	hdr.SetMode(fs.ModeSymlink | 0777)
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, target)
+	return err
+}
+
+func (a *zipArchive) Close() error { return a.zw.Close() }
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarGzArchive) addDirectory(name string, mode fs.FileMode, modTime time.Time) error {
+	return a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: int64(mode), ModTime: modTime})
+}
+
+func (a *tarGzArchive) addFile(name string, mode fs.FileMode, modTime time.Time, size int64, r io.Reader) error {
+	err := a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: int64(mode), ModTime: modTime, Size: size})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(a.tw, r, size)
+	return err
+}
+
+func (a *tarGzArchive) addSymlink(name, target string, modTime time.Time) error {
+	return a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target, Mode: 0777, ModTime: modTime})
+}
+
+func (a *tarGzArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// newArchiveWriter returns a writer of an archive in format to w, with the
+// content type and file extension of the format.
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, string, string, error) {
+	switch format {
+	case "", ArchiveZip:
+		return &zipArchive{zw: zip.NewWriter(w)}, "application/zip", ".zip", nil
+	case ArchiveTarGz:
+		gz := gzip.NewWriter(w)
+		return &tarGzArchive{gz: gz, tw: tar.NewWriter(gz)}, "application/gzip", ".tar.gz", nil
+	}
+	return nil, "", "", fmt.Errorf("%w: unknown archive format %q", ErrInvalidArgument, format)
+}
+
+// handleArchive streams an archive of the directory subtree at a node,
+// reading its files as they are written.
+func (s *Server) handleArchive(w http.ResponseWriter, r *http.Request) {
+	nodeID, err := parseNodeID(r.PathValue("node"))
+	if err != nil {
+		writeError(w, newError(err, 0, ""))
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "archive"
+	}
+	s.serveArchive(w, r, nodeID, name)
+}
+
+// serveArchive streams an archive, in the format of the request, of the
+// directory nodeID as an attachment named name. The entries of the archive
+// are under a directory of the same name.
+func (s *Server) serveArchive(w http.ResponseWriter, r *http.Request, nodeID uint64, name string) {
+	info, err := s.files.GetInfo(r.Context(), nodeID)
+	if err != nil {
+		writeError(w, newError(err, nodeID, ""))
+		return
+	}
+	if filetree.EntryKind(info.Kind) != filetree.DirectoryKind {
+		writeError(w, newError(ErrNotDirectory, nodeID, ""))
+		return
+	}
+	archive, contentType, ext, err := newArchiveWriter(w, r.URL.Query().Get("format"))
+	if err != nil {
+		writeError(w, newError(err, nodeID, ""))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+ext))
+	w.WriteHeader(http.StatusOK)
+
+	// Once the archive is being written the status can no longer change, so
+	// a failure leaves it truncated
+	if err := archive.addDirectory(name, 0755, unixModTime(&info.ModifyTime)); err != nil {
+		return
+	}
+	if err := s.archiveDirectory(r.Context(), archive, nodeID, name); err != nil {
+		return
+	}
+	archive.Close()
+}
+
+// archiveDirectory adds the entries of the directory nodeID, and of its
+// subdirectories, to archive under dir.
+func (s *Server) archiveDirectory(ctx context.Context, archive archiveWriter, nodeID uint64, dir string) error {
+	entries, err := s.files.ReadDirectory(ctx, nodeID, 0, 0)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := path.Join(dir, entry.GetName())
+		switch e := entry.(type) {
+		case *filetree.DirectoryEntry:
+			child, err := s.files.Lookup(ctx, nodeID, e.Name)
+			if err != nil {
+				return err
+			}
+			if err := archive.addDirectory(name, entryMode(e.Mode, 0755), unixModTime(e.ModifyTime)); err != nil {
+				return err
+			}
+			if err := s.archiveDirectory(ctx, archive, child.Node, name); err != nil {
+				return err
+			}
+		case *filetree.FileEntry:
+			child, err := s.files.Lookup(ctx, nodeID, e.Name)
+			if err != nil {
+				return err
+			}
+			reader, err := s.files.ReadFile(ctx, child.Node, 0, 0)
+			if err != nil {
+				return err
+			}
+			err = archive.addFile(name, entryMode(e.Mode, 0644), unixModTime(e.ModifyTime), int64(e.Size), reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+		case *filetree.SymbolicLinkEntry:
+			if err := archive.addSymlink(name, e.Target, unixModTime(e.ModifyTime)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// entryMode parses the octal mode of an entry, or returns def if it has none.
+func entryMode(mode *string, def fs.FileMode) fs.FileMode {
+	if mode == nil {
+		return def
+	}
+	m, err := strconv.ParseUint(*mode, 8, 32)
+	if err != nil {
+		return def
+	}
+	return fs.FileMode(m).Perm()
+}
+
+func unixModTime(t *uint64) time.Time {
+	if t == nil || *t == 0 {
+		return time.Now()
+	}
+	return time.Unix(int64(*t), 0)
+}
@@ -0,0 +1,276 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+	"invariant/internal/httputil"
+	"invariant/internal/storage"
+)
+
+// Client implements the Files interface by forwarding requests to a remote
+// files service. The errors of the service are returned as *Error, which
+// unwrap to the errors of this package, such as ErrNotFound.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewClient creates a new HTTP files client.
+func NewClient(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		baseURL:    baseURL,
+		httpClient: httputil.NewDiagnosticClient(httpClient),
+	}
+}
+
+// do sends a request of the path and query, returning the response if its
+// status is one of want and the error of the response otherwise.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body io.Reader, want ...int) (*http.Response, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if storage.TraceFrom(ctx) != nil {
+		req.Header.Set(TraceHeader, "1")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range want {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	return nil, readError(resp)
+}
+
+// call sends a request and discards the body of its response.
+func (c *Client) call(ctx context.Context, method, path string, query url.Values, body io.Reader, want ...int) error {
+	resp, err := c.do(ctx, method, path, query, body, want...)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// get sends a GET request and decodes the JSON body of its response into v.
+func (c *Client) get(ctx context.Context, path string, query url.Values, v any) error {
+	resp, err := c.do(ctx, http.MethodGet, path, query, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func nodePath(endpoint string, node uint64) string {
+	return fmt.Sprintf("/%s/%d", endpoint, node)
+}
+
+func entryPath(endpoint string, node uint64, name string) string {
+	if endpoint == "" {
+		return fmt.Sprintf("/%d/%s", node, url.PathEscape(name))
+	}
+	return fmt.Sprintf("/%s/%d/%s", endpoint, node, url.PathEscape(name))
+}
+
+func rangeQuery(offset, length int64) url.Values {
+	query := url.Values{}
+	if offset != 0 {
+		query.Set("offset", strconv.FormatInt(offset, 10))
+	}
+	if length != 0 {
+		query.Set("length", strconv.FormatInt(length, 10))
+	}
+	return query
+}
+
+// CreateEntry creates a new file, directory, or symbolic link
+func (c *Client) CreateEntry(ctx context.Context, parentID uint64, name string, kind filetree.EntryKind, target string, contentLink *content.ContentLink, contentReader io.Reader) error {
+	query := url.Values{}
+	if kind != "" {
+		query.Set("kind", string(kind))
+	}
+	if target != "" {
+		query.Set("target", target)
+	}
+	if contentLink != nil {
+		b, err := json.Marshal(contentLink)
+		if err != nil {
+			return err
+		}
+		query.Set("content", string(b))
+	}
+	return c.call(ctx, http.MethodPut, entryPath("", parentID, name), query, contentReader, http.StatusCreated)
+}
+
+// ReadFile reads the content of a file. If ctx has a storage.Trace, the
+// blocks the server read are added to it once the content has been read.
+func (c *Client) ReadFile(ctx context.Context, nodeID uint64, offset, length int64) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, nodePath("file", nodeID), rangeQuery(offset, length), nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	if trace := storage.TraceFrom(ctx); trace != nil {
+		return &tracedBody{ReadCloser: resp.Body, resp: resp, trace: trace}, nil
+	}
+	return resp.Body, nil
+}
+
+// tracedBody adds the reads listed by the trace trailer of resp to trace at
+// the end of its body.
+type tracedBody struct {
+	io.ReadCloser
+	resp  *http.Response
+	trace *storage.Trace
+	done  bool
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && !b.done {
+		b.done = true
+		var reads []storage.BlockRead
+		if json.Unmarshal([]byte(b.resp.Trailer.Get(TraceHeader)), &reads) == nil {
+			b.trace.Add(reads...)
+		}
+	}
+	return n, err
+}
+
+// WriteFile overwrites or appends to a file
+func (c *Client) WriteFile(ctx context.Context, nodeID uint64, offset int64, appendFlag bool, r io.Reader) error {
+	query := rangeQuery(offset, 0)
+	if appendFlag {
+		query.Set("append", "true")
+	}
+	return c.call(ctx, http.MethodPost, nodePath("file", nodeID), query, r, http.StatusOK)
+}
+
+// ReadDirectory reads the directory entries
+func (c *Client) ReadDirectory(ctx context.Context, nodeID uint64, offset, length int64) (filetree.Directory, error) {
+	var entries filetree.Directory
+	if err := c.get(ctx, nodePath("directory", nodeID), rangeQuery(offset, length), &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// GetAttributes gets the attributes of a node
+func (c *Client) GetAttributes(ctx context.Context, nodeID uint64) (EntryAttributes, error) {
+	var attrs EntryAttributes
+	err := c.get(ctx, nodePath("attributes", nodeID), nil, &attrs)
+	return attrs, err
+}
+
+// SetAttributes sets the attributes of a node
+func (c *Client) SetAttributes(ctx context.Context, nodeID uint64, attrs EntryAttributes) (EntryAttributes, error) {
+	b, err := json.Marshal(attrs)
+	if err != nil {
+		return EntryAttributes{}, err
+	}
+	resp, err := c.do(ctx, http.MethodPost, nodePath("attributes", nodeID), nil, bytes.NewReader(b), http.StatusOK)
+	if err != nil {
+		return EntryAttributes{}, err
+	}
+	defer resp.Body.Close()
+
+	var newAttrs EntryAttributes
+	err = json.NewDecoder(resp.Body).Decode(&newAttrs)
+	return newAttrs, err
+}
+
+// GetContent gets the content link of a file
+func (c *Client) GetContent(ctx context.Context, nodeID uint64) (content.ContentLink, error) {
+	var link content.ContentLink
+	err := c.get(ctx, nodePath("content", nodeID), nil, &link)
+	return link, err
+}
+
+// GetInfo gets the content information of a node
+func (c *Client) GetInfo(ctx context.Context, nodeID uint64) (ContentInformationCommon, error) {
+	var info ContentInformationCommon
+	err := c.get(ctx, nodePath("info", nodeID), nil, &info)
+	return info, err
+}
+
+// Lookup looks up a name in a directory
+func (c *Client) Lookup(ctx context.Context, parentID uint64, name string) (ContentInformationCommon, error) {
+	var info ContentInformationCommon
+	err := c.get(ctx, entryPath("lookup", parentID, name), nil, &info)
+	return info, err
+}
+
+// Resolve walks a slash separated path starting at a directory, optionally
+// following symbolic links
+func (c *Client) Resolve(ctx context.Context, nodeID uint64, path string, followSymlinks bool) (ContentInformationCommon, error) {
+	query := url.Values{}
+	query.Set("node", strconv.FormatUint(nodeID, 10))
+	query.Set("path", path)
+	if followSymlinks {
+		query.Set("follow", "true")
+	}
+	var info ContentInformationCommon
+	err := c.get(ctx, "/resolve", query, &info)
+	return info, err
+}
+
+// Remove removes an entry from a directory
+func (c *Client) Remove(ctx context.Context, parentID uint64, name string) error {
+	return c.call(ctx, http.MethodPut, entryPath("remove", parentID, name), nil, nil, http.StatusOK)
+}
+
+// Rename renames an entry
+func (c *Client) Rename(ctx context.Context, parentID uint64, oldName string, newParentID uint64, newName string) error {
+	query := url.Values{}
+	query.Set("name", newName)
+	if newParentID != parentID {
+		query.Set("directory", strconv.FormatUint(newParentID, 10))
+	}
+	return c.call(ctx, http.MethodPost, entryPath("rename", parentID, oldName), query, nil, http.StatusOK)
+}
+
+// Link creates a hard link
+func (c *Client) Link(ctx context.Context, parentID uint64, name string, targetNodeID uint64) error {
+	query := url.Values{}
+	query.Set("node", strconv.FormatUint(targetNodeID, 10))
+	return c.call(ctx, http.MethodPut, entryPath("link", parentID, name), query, nil, http.StatusCreated)
+}
+
+// Sync forces a synchronization
+func (c *Client) Sync(ctx context.Context, nodeID uint64, wait bool) error {
+	query := url.Values{}
+	query.Set("node", strconv.FormatUint(nodeID, 10))
+	query.Set("wait", strconv.FormatBool(wait))
+	return c.call(ctx, http.MethodPut, "/sync", query, nil, http.StatusOK)
+}
+
+// Usage reports the accounted size and entry count of the root
+func (c *Client) Usage(ctx context.Context) (Usage, error) {
+	var usage Usage
+	err := c.get(ctx, "/status", nil, &usage)
+	return usage, err
+}
+
+var _ Files = (*Client)(nil)
+var _ UsageReporter = (*Client)(nil)
@@ -0,0 +1,160 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+func TestClient(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "test-slot", initLink.Address, "")
+
+	filesService, err := NewInMemoryFiles(Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+		MaxSize:          100,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer filesService.Close()
+
+	ts := httptest.NewServer(NewServer(filesService).Handler())
+	defer ts.Close()
+
+	ctx := context.Background()
+	client := NewClient(ts.URL, ts.Client())
+
+	if err := client.CreateEntry(ctx, 1, "dir", filetree.DirectoryKind, "", nil, nil); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	dir, err := client.Lookup(ctx, 1, "dir")
+	if err != nil {
+		t.Fatalf("failed to lookup directory: %v", err)
+	}
+	if err := client.CreateEntry(ctx, dir.Node, "a b.txt", filetree.FileKind, "", nil, bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	info, err := client.Resolve(ctx, 1, "dir/a b.txt", false)
+	if err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	if err := client.WriteFile(ctx, info.Node, 0, true, bytes.NewReader([]byte(", world"))); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	reader, err := client.ReadFile(ctx, info.Node, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(data) != "hello, world" {
+		t.Fatalf("expected %q, got %q", "hello, world", data)
+	}
+
+	if err := client.Rename(ctx, dir.Node, "a b.txt", 1, "b.txt"); err != nil {
+		t.Fatalf("failed to rename: %v", err)
+	}
+	entries, err := client.ReadDirectory(ctx, 1, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	usage, err := client.Usage(ctx)
+	if err != nil {
+		t.Fatalf("failed to get usage: %v", err)
+	}
+	if usage.Size != 12 || usage.MaxSize != 100 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+
+	// Errors carry their code and the entry they failed on
+	_, err = client.Lookup(ctx, dir.Node, "a b.txt")
+	var apiErr *Error
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &apiErr) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if apiErr.Code != CodeNotFound || apiErr.Node != dir.Node || apiErr.Name != "a b.txt" {
+		t.Fatalf("unexpected error: %+v", apiErr)
+	}
+
+	if _, err := client.ReadFile(ctx, dir.Node, 0, 0); !errors.Is(err, ErrNotFile) {
+		t.Fatalf("expected ErrNotFile reading a directory, got %v", err)
+	}
+	if _, err := client.ReadDirectory(ctx, info.Node, 0, 0); !errors.Is(err, ErrNotDirectory) {
+		t.Fatalf("expected ErrNotDirectory, got %v", err)
+	}
+	if err := client.CreateEntry(ctx, 1, "big", filetree.FileKind, "", nil, bytes.NewReader(make([]byte, 200))); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+}
+
+func TestClient_TraceReadFile(t *testing.T) {
+	storageServer := httptest.NewServer(storage.NewStorageServer(storage.NewInMemoryStorage()).Handler())
+	defer storageServer.Close()
+	store := storage.NewClient(storageServer.URL, storageServer.Client())
+
+	data := []byte("traced content")
+	fileLink, _ := content.Write(bytes.NewReader(data), store, content.WriterOptions{})
+	dirData, _ := json.Marshal(filetree.Directory{&filetree.FileEntry{
+		BaseEntry: filetree.BaseEntry{Kind: filetree.FileKind, Name: "a.txt"},
+		Content:   fileLink,
+		Size:      uint64(len(data)),
+	}})
+	rootLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+
+	filesService, err := NewInMemoryFiles(Options{Storage: store, RootLink: rootLink})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer filesService.Close()
+
+	ts := httptest.NewServer(NewServer(filesService).Handler())
+	defer ts.Close()
+	client := NewClient(ts.URL, ts.Client())
+
+	info, err := client.Lookup(context.Background(), 1, "a.txt")
+	if err != nil {
+		t.Fatalf("failed to lookup file: %v", err)
+	}
+
+	trace := &storage.Trace{}
+	r, err := client.ReadFile(storage.WithTrace(context.Background(), trace), info.Node, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	got, _ := io.ReadAll(r)
+	r.Close()
+	if string(got) != string(data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+
+	reads := trace.Reads()
+	if len(reads) != 1 {
+		t.Fatalf("expected 1 traced read, got %+v", reads)
+	}
+	if reads[0].Address != fileLink.Address || reads[0].Server != storageServer.URL || !reads[0].Found || reads[0].Latency <= 0 {
+		t.Errorf("unexpected read %+v", reads[0])
+	}
+}
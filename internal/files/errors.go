@@ -0,0 +1,162 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"invariant/internal/slots"
+)
+
+// Codes of the errors of the files HTTP API.
+const (
+	CodeBadRequest           = "bad_request"
+	CodeNotFound             = "not_found"
+	CodeNotDirectory         = "not_directory"
+	CodeNotFile              = "not_file"
+	CodeReadOnly             = "read_only"
+	CodeUnsignedRoot         = "unsigned_root"
+	CodeQuotaExceeded        = "quota_exceeded"
+	CodeTooLarge             = "too_large"
+	CodePreconditionFailed   = "precondition_failed"
+	CodePreconditionRequired = "precondition_required"
+	CodeTooManySymlinks      = "too_many_symlinks"
+	CodeRangeNotSatisfiable  = "range_not_satisfiable"
+	CodeNotImplemented       = "not_implemented"
+	CodeInternal             = "internal"
+)
+
+// ErrPreconditionFailed is returned by the client when an If-Match or
+// If-None-Match precondition of a request does not hold.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ErrPreconditionRequired is returned by the client when the server
+// requires an If-Match header for a change.
+var ErrPreconditionRequired = errors.New("precondition required")
+
+// ErrTooLarge is returned by the client when the body of a conditional
+// write exceeds the limit of the server.
+var ErrTooLarge = errors.New("request too large")
+
+// ErrRangeNotSatisfiable is returned when the Range requested of a file
+// lies outside of it.
+var ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// ErrNotImplemented is returned by the client when the server does not
+// implement a request.
+var ErrNotImplemented = errors.New("not implemented")
+
+// errorCode is the status of an error code and the error it stands for.
+type errorCode struct {
+	code   string
+	status int
+	err    error
+}
+
+// errorCodes lists the codes, the most general code of a status first.
+var errorCodes = []errorCode{
+	{CodeBadRequest, http.StatusBadRequest, ErrInvalidArgument},
+	{CodeNotFound, http.StatusNotFound, ErrNotFound},
+	{CodeNotDirectory, http.StatusNotFound, ErrNotDirectory},
+	{CodeNotFile, http.StatusNotFound, ErrNotFile},
+	{CodeReadOnly, http.StatusForbidden, ErrReadOnly},
+	{CodeUnsignedRoot, http.StatusForbidden, ErrUnsignedRoot},
+	{CodeQuotaExceeded, http.StatusInsufficientStorage, ErrQuotaExceeded},
+	{CodeTooLarge, http.StatusRequestEntityTooLarge, ErrTooLarge},
+	{CodePreconditionFailed, http.StatusPreconditionFailed, ErrPreconditionFailed},
+	{CodePreconditionRequired, http.StatusPreconditionRequired, ErrPreconditionRequired},
+	{CodeTooManySymlinks, http.StatusLoopDetected, ErrTooManySymlinks},
+	{CodeRangeNotSatisfiable, http.StatusRequestedRangeNotSatisfiable, ErrRangeNotSatisfiable},
+	{CodeNotImplemented, http.StatusNotImplemented, ErrNotImplemented},
+	{CodeInternal, http.StatusInternalServerError, nil},
+}
+
+func lookupCode(code string) (errorCode, bool) {
+	for _, c := range errorCodes {
+		if c.code == code {
+			return c, true
+		}
+	}
+	return errorCode{}, false
+}
+
+// Error is the body of every error response of the files HTTP API. Node and
+// Name identify the node or the entry the request failed on, if any.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Node    uint64 `json:"node,omitempty"`
+	Name    string `json:"name,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the error of the package Code stands for, so errors.Is
+// works the same on the errors of the client as on those of the service.
+func (e *Error) Unwrap() error {
+	c, _ := lookupCode(e.Code)
+	return c.err
+}
+
+// Status returns the HTTP status of the error.
+func (e *Error) Status() int {
+	if c, ok := lookupCode(e.Code); ok {
+		return c.status
+	}
+	return http.StatusInternalServerError
+}
+
+// newError returns the Error of a request on node, or on the entry name of
+// node, that failed with err.
+func newError(err error, node uint64, name string) *Error {
+	e := &Error{Code: CodeInternal, Message: err.Error(), Node: node, Name: name}
+	var apiErr *Error
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.Is(err, slots.ErrSlotNotFound):
+		e.Code = CodeNotFound
+	default:
+		for _, c := range errorCodes {
+			if c.err != nil && errors.Is(err, c.err) {
+				e.Code = c.code
+				break
+			}
+		}
+	}
+	return e
+}
+
+// badRequest returns the Error of a malformed request.
+func badRequest(format string, args ...any) *Error {
+	return &Error{Code: CodeBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+// writeError writes e as the response.
+func writeError(w http.ResponseWriter, e *Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status())
+	json.NewEncoder(w).Encode(e)
+}
+
+// readError returns the error of a response with an error status, decoding
+// its Error body. Responses without one, such as those of a proxy, are
+// given the code of their status.
+func readError(resp *http.Response) error {
+	var e Error
+	if err := json.NewDecoder(resp.Body).Decode(&e); err == nil && e.Code != "" {
+		return &e
+	}
+	e = Error{Code: CodeInternal, Message: fmt.Sprintf("unexpected status code: %d", resp.StatusCode)}
+	for _, c := range errorCodes {
+		if c.status == resp.StatusCode {
+			e.Code = c.code
+			break
+		}
+	}
+	return &e
+}
@@ -3,19 +3,25 @@ package files
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"time"
 
 	"invariant/internal/content"
 	"invariant/internal/discovery"
+	"invariant/internal/distribute"
 	"invariant/internal/filetree"
+	"invariant/internal/identity"
 	"invariant/internal/slots"
 	"invariant/internal/storage"
 )
 
 // Files defines the interface for the files protocol
 type Files interface {
-	// CreateEntry creates a new file, directory, or symbolic link
+	// CreateEntry creates a new file, directory, or symbolic link. A file or
+	// directory given a contentLink grafts content already in storage without
+	// writing it again; the link must resolve, or ErrInvalidArgument is
+	// returned, and contentReader is ignored.
 	CreateEntry(ctx context.Context, parentID uint64, name string, kind filetree.EntryKind, target string, contentLink *content.ContentLink, contentReader io.Reader) error
 
 	// ReadFile reads the content of a file
@@ -42,6 +48,10 @@ type Files interface {
 	// Lookup looks up a name in a directory
 	Lookup(ctx context.Context, parentID uint64, name string) (ContentInformationCommon, error)
 
+	// Resolve walks a slash separated path starting at a directory, optionally
+	// following symbolic links
+	Resolve(ctx context.Context, nodeID uint64, path string, followSymlinks bool) (ContentInformationCommon, error)
+
 	// Remove removes an entry from a directory
 	Remove(ctx context.Context, parentID uint64, name string) error
 
@@ -128,6 +138,124 @@ type Options struct {
 	AutoSyncTimeout  time.Duration
 	SlotPollInterval time.Duration
 	WriterOptions    content.WriterOptions
+
+	// MaxSize is the maximum logical size, in bytes, of the files under the
+	// root. Zero means the size is not limited.
+	MaxSize uint64
+
+	// MaxNodes bounds the number of nodes kept in memory. When it is exceeded
+	// the least recently used clean directories are unloaded and reloaded
+	// from their content on demand, invalidating the node numbers of their
+	// descendants. Zero means nodes are never evicted.
+	MaxNodes int
+
+	// JournalDir, if set, is a directory where mutations are journaled before
+	// they are applied. Mutations made since the root was last synced are
+	// replayed when the service is created, so they survive a crash.
+	JournalDir string
+
+	// UploadConcurrency bounds the number of directories uploaded at once
+	// while syncing. Zero uses a default of 4.
+	UploadConcurrency int
+
+	// CommitSlot, if set, is a slot holding a log of the revisions of the
+	// root. Each time a sync publishes the slot of the root, or of the first
+	// layer, a filetree.Commit recording CommitAuthor and the message given
+	// to SetCommitMessage is appended to the log.
+	CommitSlot   string
+	CommitAuthor string
+
+	// Signer, if set, is the identity ID whose key must have signed the
+	// root, or the root of the first layer, before it is served or a remote
+	// update of it is merged. The signature of a root block is the block at
+	// RootSignature, and the signature of the root a slot holds is the block
+	// held by SignatureSlot.
+	Signer        string
+	RootSignature string
+	SignatureSlot string
+
+	// SigningKey, if set, signs each root the service publishes, pointing
+	// SignatureSlot at the signature.
+	SigningKey *identity.KeyPair
+
+	// PolicyKeys are the keys, by name, that the storage policies of
+	// directories select with KeyName.
+	PolicyKeys map[string][]byte
+
+	// Replication, if set, is asked to keep the blocks of files written
+	// under a policy with Replicas on that many storage services.
+	Replication distribute.ReplicationPolicies
+
+	// VerifyInterval, if set, is how often the content synced since the last
+	// verification is read back and checked against the hashes of its links,
+	// so corruption introduced by a storage service is reported, in the log
+	// and by Usage, before a reader finds it.
+	VerifyInterval time.Duration
+}
+
+var (
+	// ErrNotFound is returned when a node or an entry does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrNotDirectory is returned when a directory operation is applied to
+	// a node that is not a directory.
+	ErrNotDirectory = errors.New("not a directory")
+
+	// ErrNotFile is returned when a file operation is applied to a node that
+	// is not a file.
+	ErrNotFile = errors.New("not a file")
+
+	// ErrReadOnly is returned when a change is made to a read-only root.
+	ErrReadOnly = errors.New("file system is read-only")
+
+	// ErrInvalidArgument is returned when a request is malformed.
+	ErrInvalidArgument = errors.New("invalid argument")
+)
+
+// ErrTooManySymlinks is returned when resolving a path follows more than
+// MaxSymlinkHops symbolic links, which usually indicates a cycle.
+var ErrTooManySymlinks = errors.New("too many levels of symbolic links")
+
+// MaxSymlinkHops is the number of symbolic links followed while resolving a path.
+const MaxSymlinkHops = 40
+
+// ErrQuotaExceeded is returned when a change would grow the root beyond its MaxSize.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Usage represents the accounting of a root returned by GET /status
+type Usage struct {
+	Size    uint64 `json:"size"`
+	Entries uint64 `json:"entries"`
+	MaxSize uint64 `json:"maxSize,omitempty"`
+
+	// PendingUploads is the number of directories queued or being uploaded
+	// by a sync.
+	PendingUploads int64 `json:"pendingUploads,omitempty"`
+
+	// PendingPublishes is the number of slots whose synced root is queued to
+	// be published, such as while the slots service is unreachable.
+	PendingPublishes int `json:"pendingPublishes,omitempty"`
+
+	// Storage counts the requests of the storage client, if it reports them.
+	Storage *storage.AggregateStats `json:"storage,omitempty"`
+
+	// Verify reports the background verification of synced content, if
+	// VerifyInterval is set.
+	Verify *VerifyStats `json:"verify,omitempty"`
+}
+
+// UsageReporter is implemented by Files services that account for the size of their root.
+type UsageReporter interface {
+	// Usage reports the accounted size and entry count of the root
+	Usage(ctx context.Context) (Usage, error)
+}
+
+// CommitMessageSetter is implemented by Files services that record a commit
+// log of their root.
+type CommitMessageSetter interface {
+	// SetCommitMessage sets the message of the commit recorded by the next
+	// publish of the root
+	SetCommitMessage(message string)
 }
 
 // ContentInformationCommon represents the info returned by GET /info/:node
@@ -139,6 +267,10 @@ type ContentInformationCommon struct {
 	Executable bool   `json:"executable"`
 	Writable   bool   `json:"writable"`
 	Etag       string `json:"etag"`
+
+	// TotalSize and TotalEntries are only reported for directories.
+	TotalSize    uint64 `json:"totalSize,omitempty"`
+	TotalEntries uint64 `json:"totalEntries,omitempty"`
 }
 
 // EntryAttributes represents the attributes returned by GET /attributes/:node
@@ -149,4 +281,12 @@ type EntryAttributes struct {
 	Mode       *string `json:"mode,omitempty"`
 	Size       *uint64 `json:"size,omitempty"`
 	Type       *string `json:"type,omitempty"`
+
+	// TotalSize and TotalEntries are read-only and only reported for directories.
+	TotalSize    *uint64 `json:"totalSize,omitempty"`
+	TotalEntries *uint64 `json:"totalEntries,omitempty"`
+
+	// Policy is the storage policy of a directory, if it has one. Setting an
+	// empty policy removes it.
+	Policy *filetree.Policy `json:"policy,omitempty"`
 }
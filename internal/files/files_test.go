@@ -1,15 +1,25 @@
 package files
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"invariant/internal/content"
@@ -310,6 +320,30 @@ func TestFilesService_WriteFile_AppendAndOffset(t *testing.T) {
 	if string(data) != expected {
 		t.Errorf("expected %q, got %q", expected, string(data))
 	}
+
+	// Overwrite the middle of a file of several blocks
+	large := make([]byte, 6*1024*1024)
+	rand.Read(large)
+	if err := filesService.CreateEntry(ctx, 1, "large.bin", filetree.FileKind, "", nil, bytes.NewReader(large)); err != nil {
+		t.Fatalf("failed to create entry: %v", err)
+	}
+	filesService.mu.RLock()
+	largeID := filesService.nodes[1].Children["large.bin"]
+	filesService.mu.RUnlock()
+
+	if err := filesService.WriteFile(ctx, largeID, 3*1024*1024, false, strings.NewReader("patch")); err != nil {
+		t.Fatalf("failed to overwrite: %v", err)
+	}
+	copy(large[3*1024*1024:], "patch")
+	rc, err = filesService.ReadFile(ctx, largeID, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	data, _ = io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(data, large) {
+		t.Errorf("overwritten large file does not match")
+	}
 }
 
 // mockDiscovery is a simple mock discovery service for testing
@@ -414,3 +448,1253 @@ func TestFilesService_StorageDestination(t *testing.T) {
 		t.Errorf("Expected content to be in destStore")
 	}
 }
+
+func TestFilesService_ContentTypeDetection(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "test-slot", initLink.Address, "")
+
+	filesService, err := NewInMemoryFiles(Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer filesService.Close()
+
+	ctx := context.Background()
+
+	// Created with content
+	err = filesService.CreateEntry(ctx, 1, "page", filetree.FileKind, "", nil, strings.NewReader("<html><body>hi</body></html>"))
+	if err != nil {
+		t.Fatalf("failed to create entry: %v", err)
+	}
+	page, err := filesService.Lookup(ctx, 1, "page")
+	if err != nil {
+		t.Fatalf("failed to lookup page: %v", err)
+	}
+	attrs, err := filesService.GetAttributes(ctx, page.Node)
+	if err != nil {
+		t.Fatalf("failed to get attributes: %v", err)
+	}
+	if attrs.Type == nil || *attrs.Type != "text/html; charset=utf-8" {
+		t.Fatalf("expected html content type, got %v", attrs.Type)
+	}
+
+	// Created empty and written afterwards
+	err = filesService.CreateEntry(ctx, 1, "image", filetree.FileKind, "", nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create entry: %v", err)
+	}
+	image, _ := filesService.Lookup(ctx, 1, "image")
+	imageID := image.Node
+	if err := filesService.WriteFile(ctx, imageID, 0, false, bytes.NewReader([]byte("\x89PNG\r\n\x1a\n0000"))); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	attrs, _ = filesService.GetAttributes(ctx, imageID)
+	if attrs.Type == nil || *attrs.Type != "image/png" {
+		t.Fatalf("expected image/png content type, got %v", attrs.Type)
+	}
+
+	// Appending does not reclassify the file
+	if err := filesService.WriteFile(ctx, imageID, 0, true, strings.NewReader("<html>")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	attrs, _ = filesService.GetAttributes(ctx, imageID)
+	if attrs.Type == nil || *attrs.Type != "image/png" {
+		t.Fatalf("expected image/png content type after append, got %v", attrs.Type)
+	}
+}
+
+func TestServer_Preconditions(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "test-slot", initLink.Address, "")
+
+	filesService, err := NewInMemoryFiles(Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer filesService.Close()
+
+	handler := NewServer(filesService).WithRequireIfMatch(true).Handler()
+
+	do := func(method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Creating a new entry does not require If-Match
+	rr := do(http.MethodPut, "/1/test.txt", "hello", nil)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 Created, got %v: %v", rr.Code, rr.Body.String())
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an ETag on create")
+	}
+
+	// If-None-Match: * refuses to replace the existing entry
+	rr = do(http.MethodPut, "/1/test.txt", "replaced", map[string]string{"If-None-Match": "*"})
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412, got %v", rr.Code)
+	}
+
+	// Writes to an existing file require If-Match
+	rr = do(http.MethodPost, "/file/2", "hello world", nil)
+	if rr.Code != http.StatusPreconditionRequired {
+		t.Fatalf("expected 428, got %v", rr.Code)
+	}
+
+	rr = do(http.MethodPost, "/file/2", "hello world", map[string]string{"If-Match": `"` + etag + `"`})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %v: %v", rr.Code, rr.Body.String())
+	}
+	newEtag := rr.Header().Get("ETag")
+	if newEtag == "" || newEtag == etag {
+		t.Fatalf("expected a new ETag after write, got %q", newEtag)
+	}
+
+	// A second client still holding the old etag conflicts
+	rr = do(http.MethodPost, "/file/2", "conflict", map[string]string{"If-Match": etag})
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412, got %v", rr.Code)
+	}
+	rr = do(http.MethodPost, "/rename/1/test.txt?name=other.txt", "", map[string]string{"If-Match": etag})
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 on rename, got %v", rr.Code)
+	}
+	rr = do(http.MethodPut, "/remove/1/test.txt", "", map[string]string{"If-Match": etag})
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 on remove, got %v", rr.Code)
+	}
+
+	// The current etag succeeds
+	rr = do(http.MethodPut, "/remove/1/test.txt", "", map[string]string{"If-Match": newEtag})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK on remove, got %v: %v", rr.Code, rr.Body.String())
+	}
+
+	// A client slow to send its body does not hold up the requests of others
+	pr, pw := io.Pipe()
+	slow := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		req := httptest.NewRequest(http.MethodPut, "/1/slow.txt", pr)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		slow <- rr
+	}()
+	pw.Write([]byte("partial"))
+	fast := make(chan *httptest.ResponseRecorder, 1)
+	go func() { fast <- do(http.MethodPut, "/1/fast.txt", "fast", nil) }()
+	select {
+	case rr = <-fast:
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected 201 Created, got %v: %v", rr.Code, rr.Body.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a request waited for the body of another")
+	}
+	pw.Write([]byte(" body"))
+	pw.Close()
+	if rr = <-slow; rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 Created, got %v: %v", rr.Code, rr.Body.String())
+	}
+	info, err := filesService.Lookup(context.Background(), 1, "slow.txt")
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	rc, err := filesService.ReadFile(context.Background(), info.Node, 0, 0)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "partial body" {
+		t.Errorf("slow.txt = %q", data)
+	}
+
+	// The staged body of a conditional write is limited
+	limited := NewServer(filesService).WithMaxStagedSize(4).Handler()
+	req := httptest.NewRequest(http.MethodPut, "/1/large.txt", strings.NewReader("too large"))
+	req.Header.Set("If-None-Match", "*")
+	rr = httptest.NewRecorder()
+	limited.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %v: %v", rr.Code, rr.Body.String())
+	}
+	req = httptest.NewRequest(http.MethodPut, "/1/small.txt", strings.NewReader("tiny"))
+	req.Header.Set("If-None-Match", "*")
+	rr = httptest.NewRecorder()
+	limited.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 Created, got %v: %v", rr.Code, rr.Body.String())
+	}
+}
+
+func TestFilesService_SubtreeTotals(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "test-slot", initLink.Address, "")
+
+	opts := Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+	}
+	filesService, err := NewInMemoryFiles(opts)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer filesService.Close()
+
+	ctx := context.Background()
+	if err := filesService.CreateEntry(ctx, 1, "dir", filetree.DirectoryKind, "", nil, nil); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	dir, _ := filesService.Lookup(ctx, 1, "dir")
+	if err := filesService.CreateEntry(ctx, dir.Node, "a.txt", filetree.FileKind, "", nil, strings.NewReader("12345")); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if err := filesService.CreateEntry(ctx, dir.Node, "link", filetree.SymbolicLinkKind, "a.txt", nil, nil); err != nil {
+		t.Fatalf("failed to create link: %v", err)
+	}
+	if err := filesService.CreateEntry(ctx, 1, "b.txt", filetree.FileKind, "", nil, strings.NewReader("123")); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	expectTotals := func(f *InMemoryFiles, node uint64, size, entries uint64) {
+		t.Helper()
+		attrs, err := f.GetAttributes(ctx, node)
+		if err != nil {
+			t.Fatalf("failed to get attributes: %v", err)
+		}
+		if attrs.TotalSize == nil || *attrs.TotalSize != size || attrs.TotalEntries == nil || *attrs.TotalEntries != entries {
+			t.Fatalf("expected totals %d/%d for node %d, got %v/%v", size, entries, node, attrs.TotalSize, attrs.TotalEntries)
+		}
+	}
+
+	expectTotals(filesService, 1, 8, 4)
+	expectTotals(filesService, dir.Node, 5, 2)
+
+	a, _ := filesService.Lookup(ctx, dir.Node, "a.txt")
+	if err := filesService.WriteFile(ctx, a.Node, 0, true, strings.NewReader("678")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	expectTotals(filesService, 1, 11, 4)
+
+	if err := filesService.Remove(ctx, 1, "b.txt"); err != nil {
+		t.Fatalf("failed to remove: %v", err)
+	}
+	expectTotals(filesService, 1, 8, 3)
+
+	// The totals are persisted with the directory entries so a fresh instance
+	// knows them without loading the subdirectory.
+	if err := filesService.Sync(ctx, 1, true); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	reloaded, err := NewInMemoryFiles(opts)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer reloaded.Close()
+
+	info, err := reloaded.Lookup(ctx, 1, "dir")
+	if err != nil {
+		t.Fatalf("failed to lookup: %v", err)
+	}
+	if info.TotalSize != 8 || info.TotalEntries != 2 {
+		t.Fatalf("expected persisted totals 8/2, got %d/%d", info.TotalSize, info.TotalEntries)
+	}
+	expectTotals(reloaded, 1, 8, 3)
+}
+
+func TestServer_Quota(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "test-slot", initLink.Address, "")
+
+	filesService, err := NewInMemoryFiles(Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+		MaxSize:          10,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer filesService.Close()
+
+	handler := NewServer(filesService).Handler()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do("PUT", "/1/a.txt", "123456"); rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := do("PUT", "/1/b.txt", "123456"); rr.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507 when exceeding the quota, got %d", rr.Code)
+	}
+
+	// A file is not read past the quota
+	beyond := io.MultiReader(strings.NewReader("12345"), iotest.ErrReader(errors.New("read past the quota")))
+	if err := filesService.CreateEntry(context.Background(), 1, "big.txt", filetree.FileKind, "", nil, beyond); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected creating a file beyond the quota to fail with ErrQuotaExceeded, got %v", err)
+	}
+
+	// Grafted directories count towards the quota with their totals
+	fileLink, _ := content.Write(strings.NewReader("123456"), store, content.WriterOptions{})
+	subData, _ := json.Marshal(filetree.Directory{
+		&filetree.FileEntry{BaseEntry: filetree.BaseEntry{Kind: filetree.FileKind, Name: "c.txt"}, Content: fileLink, Size: 6},
+	})
+	subLink, _ := content.Write(bytes.NewReader(subData), store, content.WriterOptions{})
+	if err := filesService.CreateEntry(context.Background(), 1, "sub", filetree.DirectoryKind, "", &subLink, nil); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected grafting a directory beyond the quota to fail with ErrQuotaExceeded, got %v", err)
+	}
+	if err := filesService.CreateEntry(context.Background(), 1, "c.txt", filetree.FileKind, "", &fileLink, nil); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected grafting a file beyond the quota to fail with ErrQuotaExceeded, got %v", err)
+	}
+
+	info, err := filesService.Lookup(context.Background(), 1, "a.txt")
+	if err != nil {
+		t.Fatalf("failed to lookup: %v", err)
+	}
+	node := strconv.FormatUint(info.Node, 10)
+	if rr := do("POST", "/file/"+node+"?append=true", "12345"); rr.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507 when appending beyond the quota, got %d", rr.Code)
+	}
+	if rr := do("POST", "/file/"+node, "1234567890"); rr.Code != http.StatusOK {
+		t.Fatalf("expected overwrite within the quota to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr := do("GET", "/status", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var usage Usage
+	if err := json.NewDecoder(rr.Body).Decode(&usage); err != nil {
+		t.Fatalf("failed to decode usage: %v", err)
+	}
+	if usage.Size != 10 || usage.Entries != 1 || usage.MaxSize != 10 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+}
+
+func TestFilesService_NodeEviction(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "test-slot", initLink.Address, "")
+
+	opts := Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+	}
+
+	ctx := context.Background()
+	writer, err := NewInMemoryFiles(opts)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	for i := range 10 {
+		name := fmt.Sprintf("dir%d", i)
+		if err := writer.CreateEntry(ctx, 1, name, filetree.DirectoryKind, "", nil, nil); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		dir, _ := writer.Lookup(ctx, 1, name)
+		for j := range 5 {
+			if err := writer.CreateEntry(ctx, dir.Node, fmt.Sprintf("file%d", j), filetree.FileKind, "", nil, strings.NewReader(name)); err != nil {
+				t.Fatalf("failed to create file: %v", err)
+			}
+		}
+	}
+	if err := writer.Sync(ctx, 1, true); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	writer.Close()
+
+	opts.MaxNodes = 20
+	reader, err := NewInMemoryFiles(opts)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer reader.Close()
+
+	crawl := func() {
+		t.Helper()
+		for i := range 10 {
+			name := fmt.Sprintf("dir%d", i)
+			dir, err := reader.Lookup(ctx, 1, name)
+			if err != nil {
+				t.Fatalf("failed to lookup %s: %v", name, err)
+			}
+			entries, err := reader.ReadDirectory(ctx, dir.Node, 0, 0)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", name, err)
+			}
+			if len(entries) != 5 {
+				t.Fatalf("expected 5 entries in %s, got %d", name, len(entries))
+			}
+
+			reader.mu.RLock()
+			count := len(reader.nodes)
+			reader.mu.RUnlock()
+			// The limit is enforced before each operation, so a single
+			// directory load may temporarily exceed it.
+			if count > opts.MaxNodes+5 {
+				t.Fatalf("expected at most %d nodes, got %d", opts.MaxNodes+5, count)
+			}
+		}
+	}
+	crawl()
+
+	// Pending changes keep their subtree in memory until they are synced.
+	dir0, _ := reader.Lookup(ctx, 1, "dir0")
+	file0, _ := reader.Lookup(ctx, dir0.Node, "file0")
+	if err := reader.WriteFile(ctx, file0.Node, 0, false, strings.NewReader("changed")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	crawl()
+
+	rc, err := reader.ReadFile(ctx, file0.Node, 0, 0)
+	if err != nil {
+		t.Fatalf("expected dirty file to remain loaded: %v", err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "changed" {
+		t.Fatalf("expected %q, got %q", "changed", data)
+	}
+}
+
+func TestServer_Resolve(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "test-slot", initLink.Address, "")
+
+	filesService, err := NewInMemoryFiles(Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer filesService.Close()
+
+	ctx := context.Background()
+	filesService.CreateEntry(ctx, 1, "a", filetree.DirectoryKind, "", nil, nil)
+	a, _ := filesService.Lookup(ctx, 1, "a")
+	filesService.CreateEntry(ctx, a.Node, "b", filetree.DirectoryKind, "", nil, nil)
+	b, _ := filesService.Lookup(ctx, a.Node, "b")
+	filesService.CreateEntry(ctx, b.Node, "c.txt", filetree.FileKind, "", nil, strings.NewReader("hello"))
+	c, _ := filesService.Lookup(ctx, b.Node, "c.txt")
+
+	handler := NewServer(filesService).Handler()
+
+	resolve := func(query string) (ContentInformationCommon, int) {
+		req := httptest.NewRequest("GET", "/resolve?"+query, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var info ContentInformationCommon
+		if rr.Code == http.StatusOK {
+			json.NewDecoder(rr.Body).Decode(&info)
+		}
+		return info, rr.Code
+	}
+
+	if info, code := resolve("path=/a/b/c.txt"); code != http.StatusOK || info.Node != c.Node {
+		t.Fatalf("expected node %d, got %d (status %d)", c.Node, info.Node, code)
+	}
+	if info, code := resolve("path=/a/./b/../b/c.txt"); code != http.StatusOK || info.Node != c.Node {
+		t.Fatalf("expected node %d, got %d (status %d)", c.Node, info.Node, code)
+	}
+	if info, code := resolve(fmt.Sprintf("node=%d&path=b", a.Node)); code != http.StatusOK || info.Node != b.Node {
+		t.Fatalf("expected node %d, got %d (status %d)", b.Node, info.Node, code)
+	}
+	if info, code := resolve("path=/"); code != http.StatusOK || info.Node != 1 {
+		t.Fatalf("expected root, got %d (status %d)", info.Node, code)
+	}
+	if _, code := resolve("path=/a/missing"); code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", code)
+	}
+	if _, code := resolve("path=/a/b/c.txt/d"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 walking through a file, got %d", code)
+	}
+}
+
+func TestServer_FollowSymlinks(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "test-slot", initLink.Address, "")
+
+	filesService, err := NewInMemoryFiles(Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer filesService.Close()
+
+	// /a/b/c.txt, /a/rel -> b/c.txt, /abs -> /a/b, /up -> a/../a/rel, /loop1 <-> /loop2
+	ctx := context.Background()
+	filesService.CreateEntry(ctx, 1, "a", filetree.DirectoryKind, "", nil, nil)
+	a, _ := filesService.Lookup(ctx, 1, "a")
+	filesService.CreateEntry(ctx, a.Node, "b", filetree.DirectoryKind, "", nil, nil)
+	b, _ := filesService.Lookup(ctx, a.Node, "b")
+	filesService.CreateEntry(ctx, b.Node, "c.txt", filetree.FileKind, "", nil, strings.NewReader("hello"))
+	c, _ := filesService.Lookup(ctx, b.Node, "c.txt")
+	filesService.CreateEntry(ctx, a.Node, "rel", filetree.SymbolicLinkKind, "b/c.txt", nil, nil)
+	rel, _ := filesService.Lookup(ctx, a.Node, "rel")
+	filesService.CreateEntry(ctx, 1, "abs", filetree.SymbolicLinkKind, "/a/b", nil, nil)
+	filesService.CreateEntry(ctx, 1, "up", filetree.SymbolicLinkKind, "a/../a/rel", nil, nil)
+	filesService.CreateEntry(ctx, 1, "loop1", filetree.SymbolicLinkKind, "loop2", nil, nil)
+	filesService.CreateEntry(ctx, 1, "loop2", filetree.SymbolicLinkKind, "/loop1", nil, nil)
+
+	handler := NewServer(filesService).Handler()
+
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	resolve := func(query string) (uint64, int) {
+		rr := get("/resolve?" + query)
+		var info ContentInformationCommon
+		if rr.Code == http.StatusOK {
+			json.NewDecoder(rr.Body).Decode(&info)
+		}
+		return info.Node, rr.Code
+	}
+
+	if node, code := resolve("path=/a/rel"); code != http.StatusOK || node != rel.Node {
+		t.Fatalf("expected the link itself without follow, got %d (status %d)", node, code)
+	}
+	for _, path := range []string{"/a/rel", "/abs/c.txt", "/up"} {
+		if node, code := resolve("follow=true&path=" + path); code != http.StatusOK || node != c.Node {
+			t.Fatalf("expected %s to resolve to %d, got %d (status %d)", path, c.Node, node, code)
+		}
+	}
+	if _, code := resolve("follow=true&path=/loop1"); code != http.StatusLoopDetected {
+		t.Fatalf("expected 508 for a symlink cycle, got %d", code)
+	}
+
+	if rr := get(fmt.Sprintf("/file/%d", rel.Node)); rr.Body.String() != "b/c.txt" {
+		t.Fatalf("expected the link target without follow, got %q", rr.Body.String())
+	}
+	if rr := get(fmt.Sprintf("/file/%d?follow=true", rel.Node)); rr.Code != http.StatusOK || rr.Body.String() != "hello" {
+		t.Fatalf("expected the linked content, got %q (status %d)", rr.Body.String(), rr.Code)
+	}
+}
+
+// gatedStorage fails stores while failing is set and holds them while gate is
+// set until it is closed.
+type gatedStorage struct {
+	storage.Storage
+	mu      sync.Mutex
+	failing bool
+	gate    chan struct{}
+}
+
+func (s *gatedStorage) Store(ctx context.Context, r io.Reader) (string, error) {
+	s.mu.Lock()
+	failing, gate := s.failing, s.gate
+	s.mu.Unlock()
+	if failing {
+		return "", errors.New("store unavailable")
+	}
+	if gate != nil {
+		<-gate
+	}
+	return s.Storage.Store(ctx, r)
+}
+
+func TestFilesService_SyncUploads(t *testing.T) {
+	ctx := context.Background()
+	store := &gatedStorage{Storage: storage.NewInMemoryStorage()}
+	memSlots := slots.NewMemorySlots("test-slot-id")
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(ctx, "test-slot", initLink.Address, "")
+
+	filesService, err := NewInMemoryFiles(Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+		WriterOptions:    content.WriterOptions{Retries: -1},
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer filesService.Close()
+
+	for _, name := range []string{"a", "b"} {
+		if err := filesService.CreateEntry(ctx, 1, name, filetree.DirectoryKind, "", nil, nil); err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+	}
+	aID := filesService.nodes[1].Children["a"]
+	if err := filesService.CreateEntry(ctx, aID, "link", filetree.SymbolicLinkKind, "target", nil, nil); err != nil {
+		t.Fatalf("failed to create link: %v", err)
+	}
+
+	// Nothing is committed if an upload fails
+	store.failing = true
+	if err := filesService.Sync(ctx, 1, true); err == nil {
+		t.Fatalf("expected the sync to fail")
+	}
+	if !filesService.nodes[1].IsDirty || !filesService.nodes[aID].IsDirty {
+		t.Errorf("expected the nodes to stay dirty after a failed sync")
+	}
+	store.failing = false
+	if err := filesService.Sync(ctx, 1, true); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	if filesService.nodes[1].IsDirty || filesService.nodes[aID].IsDirty {
+		t.Errorf("expected the nodes to be clean after a sync")
+	}
+
+	// Changes made while uploading stay dirty for the next sync
+	if err := filesService.CreateEntry(ctx, aID, "second", filetree.SymbolicLinkKind, "target", nil, nil); err != nil {
+		t.Fatalf("failed to create link: %v", err)
+	}
+	gate := make(chan struct{})
+	store.mu.Lock()
+	store.gate = gate
+	store.mu.Unlock()
+	done := make(chan error)
+	go func() { done <- filesService.Sync(ctx, 1, true) }()
+
+	for {
+		usage, err := filesService.Usage(ctx)
+		if err != nil {
+			t.Fatalf("failed to get usage: %v", err)
+		}
+		if usage.PendingUploads > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	bID := filesService.nodes[1].Children["b"]
+	if err := filesService.CreateEntry(ctx, bID, "during", filetree.SymbolicLinkKind, "target", nil, nil); err != nil {
+		t.Fatalf("failed to create link while uploading: %v", err)
+	}
+	store.mu.Lock()
+	store.gate = nil
+	store.mu.Unlock()
+	close(gate)
+	if err := <-done; err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+
+	filesService.mu.RLock()
+	rootDirty, aDirty := filesService.nodes[1].IsDirty, filesService.nodes[aID].IsDirty
+	filesService.mu.RUnlock()
+	if !rootDirty {
+		t.Errorf("expected the root changed during the upload to stay dirty")
+	}
+	if aDirty {
+		t.Errorf("expected the uploaded directory to be clean")
+	}
+	if usage, _ := filesService.Usage(ctx); usage.PendingUploads != 0 {
+		t.Errorf("expected no pending uploads, got %d", usage.PendingUploads)
+	}
+}
+
+func TestFilesService_Journal(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(ctx, "test-slot", initLink.Address, "")
+
+	journalDir := t.TempDir()
+	open := func() *InMemoryFiles {
+		filesService, err := NewInMemoryFiles(Options{
+			Storage:          store,
+			Slots:            memSlots,
+			RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+			AutoSyncTimeout:  time.Hour,
+			SlotPollInterval: time.Hour,
+			JournalDir:       journalDir,
+		})
+		if err != nil {
+			t.Fatalf("failed to create service: %v", err)
+		}
+		return filesService
+	}
+
+	// Make changes and stop without syncing, as if the process crashed
+	filesService := open()
+	if err := filesService.CreateEntry(ctx, 1, "docs", filetree.DirectoryKind, "", nil, nil); err != nil {
+		t.Fatalf("failed to create docs: %v", err)
+	}
+	docs, _ := filesService.Lookup(ctx, 1, "docs")
+	if err := filesService.CreateEntry(ctx, docs.Node, "a.txt", filetree.FileKind, "", nil, strings.NewReader("hello")); err != nil {
+		t.Fatalf("failed to create a.txt: %v", err)
+	}
+	a, _ := filesService.Lookup(ctx, docs.Node, "a.txt")
+	if err := filesService.WriteFile(ctx, a.Node, 0, true, strings.NewReader(" world")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	if err := filesService.Rename(ctx, docs.Node, "a.txt", 1, "b.txt"); err != nil {
+		t.Fatalf("failed to rename: %v", err)
+	}
+	mode := "0600"
+	if _, err := filesService.SetAttributes(ctx, a.Node, EntryAttributes{Mode: &mode}); err != nil {
+		t.Fatalf("failed to set attributes: %v", err)
+	}
+	if err := filesService.Remove(ctx, 1, "docs"); err != nil {
+		t.Fatalf("failed to remove docs: %v", err)
+	}
+	filesService.Close()
+
+	// A torn final entry is ignored
+	f, _ := os.OpenFile(filepath.Join(journalDir, walFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"op":"remove","pa`)
+	f.Close()
+
+	filesService = open()
+	if _, err := filesService.Lookup(ctx, 1, "docs"); err == nil {
+		t.Errorf("expected docs to stay removed")
+	}
+	b, err := filesService.Lookup(ctx, 1, "b.txt")
+	if err != nil {
+		t.Fatalf("expected b.txt to be replayed: %v", err)
+	}
+	rc, err := filesService.ReadFile(ctx, b.Node, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to read b.txt: %v", err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "hello world" {
+		t.Errorf("expected %q, got %q", "hello world", data)
+	}
+	attrs, _ := filesService.GetAttributes(ctx, b.Node)
+	if attrs.Mode == nil || *attrs.Mode != mode {
+		t.Errorf("expected mode %s, got %v", mode, attrs.Mode)
+	}
+
+	// Syncing the root empties the journal
+	if err := filesService.Sync(ctx, 1, true); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	filesService.Close()
+	info, err := os.Stat(filepath.Join(journalDir, walFileName))
+	if err != nil || info.Size() != 0 {
+		t.Errorf("expected an empty journal after syncing, got %v, %v", info, err)
+	}
+}
+
+func TestFilesService_InlineFiles(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "test-slot", initLink.Address, "")
+
+	opts := Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+		WriterOptions:    content.WriterOptions{InlineMax: 1024},
+	}
+	filesService, err := NewInMemoryFiles(opts)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer filesService.Close()
+
+	ctx := context.Background()
+	filesService.CreateEntry(ctx, 1, "src", filetree.DirectoryKind, "", nil, nil)
+	src, _ := filesService.Lookup(ctx, 1, "src")
+	filesService.CreateEntry(ctx, src.Node, "main.go", filetree.FileKind, "", nil, bytes.NewReader([]byte("package main")))
+	main, _ := filesService.Lookup(ctx, src.Node, "main.go")
+	if err := filesService.WriteFile(ctx, main.Node, 0, true, bytes.NewReader([]byte("\n"))); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	if err := filesService.Sync(ctx, 1, true); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+
+	// The root and src directories are the only new blocks
+	rootAddress, _ := memSlots.Get(ctx, "test-slot")
+	var blocks []string
+	err = filetree.WalkBlocks(ctx, content.ContentLink{Address: rootAddress}, store, nil, func(address string) error {
+		blocks = append(blocks, address)
+		return nil
+	})
+	if err != nil || len(blocks) != 2 {
+		t.Fatalf("expected the blocks of two directories, got %v, %v", blocks, err)
+	}
+
+	reopened, err := NewInMemoryFiles(opts)
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer reopened.Close()
+	info, err := reopened.Resolve(ctx, 1, "src/main.go", false)
+	if err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	link, _ := reopened.GetContent(ctx, info.Node)
+	if string(link.Inline) != "package main\n" {
+		t.Errorf("expected inline content, got %+v", link)
+	}
+	rc, err := reopened.ReadFile(ctx, info.Node, 8, 0)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "main\n" {
+		t.Errorf("expected %q, got %q", "main\n", data)
+	}
+}
+
+func TestServer_Graft(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "test-slot", initLink.Address, "")
+
+	// Content already in storage, as written by another tree
+	fileLink, _ := content.Write(strings.NewReader("grafted"), store, content.WriterOptions{})
+	subData, _ := json.Marshal(filetree.Directory{
+		&filetree.FileEntry{BaseEntry: filetree.BaseEntry{Kind: filetree.FileKind, Name: "c.txt"}, Content: fileLink, Size: 7},
+	})
+	subLink, _ := content.Write(bytes.NewReader(subData), store, content.WriterOptions{})
+
+	opts := Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+	}
+	filesService, err := NewInMemoryFiles(opts)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer filesService.Close()
+
+	ts := httptest.NewServer(NewServer(filesService).Handler())
+	defer ts.Close()
+	client := NewClient(ts.URL, ts.Client())
+	ctx := context.Background()
+
+	if err := client.CreateEntry(ctx, 1, "a.txt", filetree.FileKind, "", &fileLink, nil); err != nil {
+		t.Fatalf("failed to graft file: %v", err)
+	}
+	if err := client.CreateEntry(ctx, 1, "sub", filetree.DirectoryKind, "", &subLink, nil); err != nil {
+		t.Fatalf("failed to graft directory: %v", err)
+	}
+	missing := content.ContentLink{Address: strings.Repeat("00", 32)}
+	if err := client.CreateEntry(ctx, 1, "missing", filetree.FileKind, "", &missing, nil); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected grafting a missing block to fail with ErrInvalidArgument, got %v", err)
+	}
+	if err := client.CreateEntry(ctx, 1, "garbage", filetree.DirectoryKind, "", &fileLink, nil); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected grafting a file as a directory to fail with ErrInvalidArgument, got %v", err)
+	}
+
+	attrs, err := filesService.GetAttributes(ctx, 1)
+	if err != nil {
+		t.Fatalf("failed to get attributes: %v", err)
+	}
+	if *attrs.TotalSize != 14 || *attrs.TotalEntries != 3 {
+		t.Fatalf("expected totals 14/3, got %d/%d", *attrs.TotalSize, *attrs.TotalEntries)
+	}
+
+	countBlocks := func() int {
+		n := 0
+		for chunk := range store.List(ctx, 100) {
+			n += len(chunk)
+		}
+		return n
+	}
+	blocks := countBlocks()
+	if err := filesService.Sync(ctx, 1, true); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	if added := countBlocks() - blocks; added != 1 {
+		t.Errorf("expected only the root directory to be written, got %d blocks", added)
+	}
+
+	reloaded, err := NewInMemoryFiles(opts)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer reloaded.Close()
+	info, err := reloaded.Resolve(ctx, 1, "sub/c.txt", false)
+	if err != nil {
+		t.Fatalf("failed to resolve grafted file: %v", err)
+	}
+	r, err := reloaded.ReadFile(ctx, info.Node, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to read grafted file: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "grafted" {
+		t.Errorf("expected grafted content, got %q", data)
+	}
+}
+
+// corruptingStorage flips a byte of the blocks in corrupt as they are read.
+type corruptingStorage struct {
+	storage.Storage
+	corrupt map[string]bool
+}
+
+func (s *corruptingStorage) Get(ctx context.Context, address string) (io.ReadCloser, bool) {
+	rc, ok := s.Storage.Get(ctx, address)
+	if !ok || !s.corrupt[address] {
+		return rc, ok
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	data[0] ^= 0xff
+	return io.NopCloser(bytes.NewReader(data)), true
+}
+
+func TestFilesService_Verify(t *testing.T) {
+	store := &corruptingStorage{Storage: storage.NewInMemoryStorage(), corrupt: make(map[string]bool)}
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "test-slot", initLink.Address, "")
+
+	filesService, err := NewInMemoryFiles(Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+		VerifyInterval:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer filesService.Close()
+
+	ctx := context.Background()
+	filesService.CreateEntry(ctx, 1, "good.txt", filetree.FileKind, "", nil, strings.NewReader("good"))
+	filesService.CreateEntry(ctx, 1, "bad.txt", filetree.FileKind, "", nil, strings.NewReader("bad"))
+	if err := filesService.Sync(ctx, 1, true); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	bad, _ := filesService.Lookup(ctx, 1, "bad.txt")
+	link, _ := filesService.GetContent(ctx, bad.Node)
+	store.corrupt[link.Address] = true
+
+	usage, _ := filesService.Usage(ctx)
+	if usage.Verify == nil || usage.Verify.Pending != 3 {
+		t.Fatalf("expected the root and two files pending verification, got %+v", usage.Verify)
+	}
+
+	filesService.verifier.verifyPending(ctx)
+	usage, _ = filesService.Usage(ctx)
+	stats := usage.Verify
+	if stats.Verified != 2 || stats.Mismatched != 1 || stats.Pending != 0 {
+		t.Fatalf("unexpected verify stats %+v", stats)
+	}
+	if len(stats.Mismatches) != 1 || stats.Mismatches[0].Path != "/bad.txt" || stats.Mismatches[0].Address != link.Address {
+		t.Errorf("unexpected mismatches %+v", stats.Mismatches)
+	}
+}
+
+func TestServer_Range(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "test-slot", initLink.Address, "")
+
+	filesService, err := NewInMemoryFiles(Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer filesService.Close()
+
+	ts := httptest.NewServer(NewServer(filesService).Handler())
+	defer ts.Close()
+	client := NewClient(ts.URL, ts.Client())
+	ctx := context.Background()
+
+	data := make([]byte, 300*1024)
+	for i := range data {
+		data[i] = byte(i * 7 / 5)
+	}
+	if err := client.CreateEntry(ctx, 1, "video.bin", filetree.FileKind, "", nil, bytes.NewReader(data)); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if err := client.Sync(ctx, 1, true); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	info, err := client.Lookup(ctx, 1, "video.bin")
+	if err != nil {
+		t.Fatalf("failed to lookup file: %v", err)
+	}
+
+	get := func(rangeHeader, ifRange string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/file/%d", ts.URL, info.Node), nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	size := len(data)
+	tests := []struct {
+		rangeHeader, ifRange string
+		status               int
+		contentRange         string
+		want                 []byte
+	}{
+		{"", "", http.StatusOK, "", data},
+		{"bytes=100-199", "", http.StatusPartialContent, fmt.Sprintf("bytes 100-199/%d", size), data[100:200]},
+		{"bytes=200000-", "", http.StatusPartialContent, fmt.Sprintf("bytes 200000-%d/%d", size-1, size), data[200000:]},
+		{"bytes=-10", "", http.StatusPartialContent, fmt.Sprintf("bytes %d-%d/%d", size-10, size-1, size), data[size-10:]},
+		{"bytes=100-999999999", "", http.StatusPartialContent, fmt.Sprintf("bytes 100-%d/%d", size-1, size), data[100:]},
+		{fmt.Sprintf("bytes=%d-", size), "", http.StatusRequestedRangeNotSatisfiable, fmt.Sprintf("bytes */%d", size), nil},
+		{"bytes=0-1,5-6", "", http.StatusOK, "", data},
+		{"bytes=10-19", `"stale"`, http.StatusOK, "", data},
+		{"bytes=10-19", `"` + info.Etag + `"`, http.StatusPartialContent, fmt.Sprintf("bytes 10-19/%d", size), data[10:20]},
+	}
+	for _, tt := range tests {
+		resp, body := get(tt.rangeHeader, tt.ifRange)
+		if resp.StatusCode != tt.status {
+			t.Errorf("Range %q: expected status %d, got %d", tt.rangeHeader, tt.status, resp.StatusCode)
+			continue
+		}
+		if resp.Header.Get("Accept-Ranges") != "bytes" {
+			t.Errorf("Range %q: expected Accept-Ranges bytes, got %q", tt.rangeHeader, resp.Header.Get("Accept-Ranges"))
+		}
+		if got := resp.Header.Get("Content-Range"); got != tt.contentRange {
+			t.Errorf("Range %q: expected Content-Range %q, got %q", tt.rangeHeader, tt.contentRange, got)
+		}
+		if tt.want != nil && !bytes.Equal(body, tt.want) {
+			t.Errorf("Range %q: got %d bytes, expected %d", tt.rangeHeader, len(body), len(tt.want))
+		}
+	}
+}
+
+func TestServer_Archive(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "test-slot", initLink.Address, "")
+
+	filesService, err := NewInMemoryFiles(Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer filesService.Close()
+
+	ts := httptest.NewServer(NewServer(filesService).Handler())
+	defer ts.Close()
+	client := NewClient(ts.URL, ts.Client())
+	ctx := context.Background()
+
+	mkdir := func(parent uint64, name string) uint64 {
+		t.Helper()
+		if err := client.CreateEntry(ctx, parent, name, filetree.DirectoryKind, "", nil, nil); err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+		info, err := client.Lookup(ctx, parent, name)
+		if err != nil {
+			t.Fatalf("failed to lookup %s: %v", name, err)
+		}
+		return info.Node
+	}
+	dir := mkdir(1, "photos")
+	sub := mkdir(dir, "2024")
+	large := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	client.CreateEntry(ctx, dir, "a.txt", filetree.FileKind, "", nil, strings.NewReader("first"))
+	client.CreateEntry(ctx, sub, "b.bin", filetree.FileKind, "", nil, bytes.NewReader(large))
+	client.CreateEntry(ctx, dir, "latest", filetree.SymbolicLinkKind, "2024/b.bin", nil, nil)
+	if err := client.Sync(ctx, 1, true); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+
+	get := func(query string) *http.Response {
+		t.Helper()
+		resp, err := http.Get(fmt.Sprintf("%s/archive/%d?%s", ts.URL, dir, query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	want := map[string]string{
+		"photos/":           "",
+		"photos/a.txt":      "first",
+		"photos/2024/":      "",
+		"photos/2024/b.bin": string(large),
+		"photos/latest":     "2024/b.bin",
+	}
+
+	resp := get("name=photos")
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("expected a zip archive, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename="photos.zip"` {
+		t.Errorf("unexpected Content-Disposition %q", got)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("invalid zip: %v", err)
+	}
+	got := make(map[string]string)
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		body, _ := io.ReadAll(rc)
+		rc.Close()
+		got[f.Name] = string(body)
+		if f.Name == "photos/latest" && f.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("expected photos/latest to be a symbolic link, got mode %v", f.Mode())
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("expected %d zip entries, got %d", len(want), len(got))
+	}
+	for name, body := range want {
+		if got[name] != body {
+			t.Errorf("zip entry %s: expected %d bytes, got %d", name, len(body), len(got[name]))
+		}
+	}
+
+	resp = get("name=photos&format=tar.gz")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/gzip" {
+		t.Fatalf("expected a tar.gz archive, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("invalid gzip: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	got = make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid tar: %v", err)
+		}
+		body, _ := io.ReadAll(tr)
+		if hdr.Typeflag == tar.TypeSymlink {
+			body = []byte(hdr.Linkname)
+		}
+		got[hdr.Name] = string(body)
+	}
+	for name, body := range want {
+		if got[name] != body {
+			t.Errorf("tar entry %s: expected %d bytes, got %d", name, len(body), len(got[name]))
+		}
+	}
+
+	resp = get("format=rar")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown format, got %d", resp.StatusCode)
+	}
+	info, _ := client.Lookup(ctx, dir, "a.txt")
+	resp, err = http.Get(fmt.Sprintf("%s/archive/%d", ts.URL, info.Node))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 archiving a file, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,312 @@
+package files
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"invariant/internal/cap"
+	"invariant/internal/content"
+)
+
+// HostOptions configures a Host.
+type HostOptions struct {
+	// Options is the template used to open each root. Its RootLink and Layers
+	// are replaced by the slot being opened.
+	Options Options
+
+	// Open, if set, opens the root of a slot instead of using Options.
+	Open func(slotID string) (*InMemoryFiles, error)
+
+	// MaxRoots is the number of roots kept open at once. The least recently
+	// used idle root is closed to make room for a new one. Zero means no limit.
+	MaxRoots int
+
+	// IdleTimeout closes roots that have not been used for the given duration.
+	// Zero means idle roots are only closed to honor MaxRoots.
+	IdleTimeout time.Duration
+
+	// RequireIfMatch is applied to the server of every root.
+	RequireIfMatch bool
+
+	// MaxStagedSize is applied to the server of every root. Zero uses
+	// DefaultMaxStagedSize and a negative size means no limit.
+	MaxStagedSize int64
+
+	// Sharing, if set, enables POST /share on every root, minting tokens
+	// with the verifier that name the slot of the root.
+	Sharing *cap.Verifier
+}
+
+// Host serves the file trees of many slots from a single server. Each root is
+// opened on demand under /fs/{slot}/ with its own node table and sync loops.
+type Host struct {
+	opts HostOptions
+
+	mu    sync.Mutex
+	roots map[string]*hostedRoot
+	lru   *list.List
+	// closing holds the roots, by slot, removed from roots but still being
+	// synced and closed. A slot is not opened again until its root is
+	// closed, so it cannot load the state the sync is replacing.
+	closing map[string]*hostedRoot
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type hostedRoot struct {
+	slotID   string
+	files    *InMemoryFiles
+	handler  http.Handler
+	err      error
+	ready    chan struct{}
+	active   int
+	lastUsed time.Time
+	elem     *list.Element
+	// closed is closed once the root is removed from the host and closed
+	closed chan struct{}
+}
+
+// NewHost creates a new Host.
+func NewHost(opts HostOptions) *Host {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &Host{
+		opts:    opts,
+		roots:   make(map[string]*hostedRoot),
+		lru:     list.New(),
+		closing: make(map[string]*hostedRoot),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	if opts.IdleTimeout > 0 {
+		go h.idleLoop()
+	}
+	return h
+}
+
+// Handler returns the http.Handler serving the hosted roots
+func (h *Host) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fs/{slot}/", h.handleRoot)
+	return mux
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *Host) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Handler().ServeHTTP(w, r)
+}
+
+// Roots returns the slots of the currently open roots, most recently used first.
+func (h *Host) Roots() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var result []string
+	for e := h.lru.Front(); e != nil; e = e.Next() {
+		result = append(result, e.Value.(*hostedRoot).slotID)
+	}
+	return result
+}
+
+// Close syncs and closes all open roots.
+func (h *Host) Close() {
+	h.cancel()
+
+	h.mu.Lock()
+	var evicted []*hostedRoot
+	for _, root := range h.roots {
+		h.startClosing(root)
+		evicted = append(evicted, root)
+	}
+	h.roots = make(map[string]*hostedRoot)
+	h.lru.Init()
+	h.mu.Unlock()
+
+	for _, root := range evicted {
+		<-root.ready
+		h.closeRoot(root)
+	}
+}
+
+func (h *Host) handleRoot(w http.ResponseWriter, r *http.Request) {
+	slotID := r.PathValue("slot")
+
+	root, err := h.acquire(slotID)
+	if err != nil {
+		writeError(w, newError(err, 0, ""))
+		return
+	}
+	defer h.release(root)
+
+	http.StripPrefix("/fs/"+slotID, root.handler).ServeHTTP(w, r)
+}
+
+// acquire returns the open root of slotID, opening it if necessary. The root
+// is not closed until it is released.
+func (h *Host) acquire(slotID string) (*hostedRoot, error) {
+	h.mu.Lock()
+	for {
+		closing, ok := h.closing[slotID]
+		if !ok {
+			break
+		}
+		h.mu.Unlock()
+		<-closing.closed
+		h.mu.Lock()
+	}
+	root, ok := h.roots[slotID]
+	if ok {
+		root.active++
+		root.lastUsed = time.Now()
+		h.lru.MoveToFront(root.elem)
+		h.mu.Unlock()
+
+		<-root.ready
+		if root.err != nil {
+			h.release(root)
+			return nil, root.err
+		}
+		return root, nil
+	}
+
+	root = &hostedRoot{
+		slotID:   slotID,
+		ready:    make(chan struct{}),
+		active:   1,
+		lastUsed: time.Now(),
+	}
+	root.elem = h.lru.PushFront(root)
+	h.roots[slotID] = root
+	h.mu.Unlock()
+
+	root.files, root.err = h.open(slotID)
+	if root.err == nil {
+		server := NewServer(root.files).WithRequireIfMatch(h.opts.RequireIfMatch)
+		if h.opts.MaxStagedSize != 0 {
+			server.WithMaxStagedSize(h.opts.MaxStagedSize)
+		}
+		if h.opts.Sharing != nil {
+			server.WithSharing(h.opts.Sharing, slotID)
+		}
+		root.handler = server.Handler()
+	}
+	close(root.ready)
+
+	if root.err != nil {
+		h.mu.Lock()
+		h.remove(root)
+		h.mu.Unlock()
+		return nil, root.err
+	}
+
+	h.evict(func(*hostedRoot) bool {
+		return h.opts.MaxRoots > 0 && len(h.roots) > h.opts.MaxRoots
+	})
+	return root, nil
+}
+
+func (h *Host) release(root *hostedRoot) {
+	h.mu.Lock()
+	root.active--
+	root.lastUsed = time.Now()
+	h.lru.MoveToFront(root.elem)
+	h.mu.Unlock()
+}
+
+func (h *Host) open(slotID string) (*InMemoryFiles, error) {
+	if h.opts.Open != nil {
+		return h.opts.Open(slotID)
+	}
+	opts := h.opts.Options
+	if opts.Slots != nil {
+		if _, err := opts.Slots.Get(h.ctx, slotID); err != nil {
+			return nil, err
+		}
+	}
+	opts.RootLink = content.ContentLink{Address: slotID, Slot: true}
+	opts.Layers = nil
+	return NewInMemoryFiles(opts)
+}
+
+// remove drops root from the host. h.mu must be held.
+func (h *Host) remove(root *hostedRoot) {
+	if h.roots[root.slotID] == root {
+		delete(h.roots, root.slotID)
+	}
+	h.lru.Remove(root.elem)
+}
+
+// evict closes the least recently used roots that are not in use for as long
+// as shouldEvict reports true.
+func (h *Host) evict(shouldEvict func(*hostedRoot) bool) {
+	h.mu.Lock()
+	var evicted []*hostedRoot
+	for e := h.lru.Back(); e != nil; {
+		root := e.Value.(*hostedRoot)
+		e = e.Prev()
+		if root.active > 0 {
+			continue
+		}
+		if !shouldEvict(root) {
+			break
+		}
+		h.remove(root)
+		h.startClosing(root)
+		evicted = append(evicted, root)
+	}
+	h.mu.Unlock()
+
+	for _, root := range evicted {
+		h.closeRoot(root)
+	}
+}
+
+// startClosing records that root, removed from the host, is being closed, so
+// its slot is not opened again until closeRoot finishes. h.mu must be held.
+func (h *Host) startClosing(root *hostedRoot) {
+	root.closed = make(chan struct{})
+	h.closing[root.slotID] = root
+}
+
+// closeRoot syncs and closes root, then lets its slot be opened again.
+func (h *Host) closeRoot(root *hostedRoot) {
+	defer func() {
+		h.mu.Lock()
+		if h.closing[root.slotID] == root {
+			delete(h.closing, root.slotID)
+		}
+		h.mu.Unlock()
+		close(root.closed)
+	}()
+
+	if root.files == nil {
+		return
+	}
+	if root.files.isWritable() {
+		if err := root.files.Sync(context.Background(), root.files.root, true); err != nil {
+			log.Printf("Failed to sync root %s before closing it: %v", root.slotID, err)
+		}
+	}
+	root.files.Close()
+}
+
+func (h *Host) idleLoop() {
+	ticker := time.NewTicker(h.opts.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+			deadline := time.Now().Add(-h.opts.IdleTimeout)
+			h.evict(func(root *hostedRoot) bool {
+				return root.lastUsed.Before(deadline)
+			})
+		}
+	}
+}
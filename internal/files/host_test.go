@@ -0,0 +1,195 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+func TestHost_OpensAndEvictsRoots(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	for _, slotID := range []string{"alice", "bob", "carol"} {
+		memSlots.Create(context.Background(), slotID, initLink.Address, "")
+	}
+
+	host := NewHost(HostOptions{
+		Options: Options{
+			Storage:          store,
+			Slots:            memSlots,
+			AutoSyncTimeout:  time.Hour,
+			SlotPollInterval: time.Hour,
+		},
+		MaxRoots: 2,
+	})
+	defer host.Close()
+
+	ts := httptest.NewServer(host)
+	defer ts.Close()
+
+	do := func(method, target, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+target, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return resp
+	}
+
+	for _, slotID := range []string{"alice", "bob"} {
+		resp := do("PUT", "/fs/"+slotID+"/1/owner.txt", slotID)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected 201 creating file in %s, got %d", slotID, resp.StatusCode)
+		}
+	}
+
+	// Opening a third root evicts the least recently used one, syncing it first.
+	resp := do("GET", "/fs/carol/directory/1", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if roots := host.Roots(); !slices.Equal(roots, []string{"carol", "bob"}) {
+		t.Fatalf("unexpected open roots: %v", roots)
+	}
+
+	address, err := memSlots.Get(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("failed to get slot: %v", err)
+	}
+	if address == initLink.Address {
+		t.Fatalf("expected evicted root to be synced to its slot")
+	}
+
+	// Reopening the evicted root sees its own tree only.
+	resp = do("GET", "/fs/alice/lookup/1/owner.txt", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	resp = do("GET", "/fs/carol/lookup/1/owner.txt", "")
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatalf("expected carol not to see alice's file")
+	}
+
+	resp = do("GET", "/fs/missing/directory/1", "")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing slot, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestHost_IdleTimeout(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "alice", initLink.Address, "")
+
+	host := NewHost(HostOptions{
+		Options: Options{
+			Storage:          store,
+			Slots:            memSlots,
+			AutoSyncTimeout:  time.Hour,
+			SlotPollInterval: time.Hour,
+		},
+		IdleTimeout: 50 * time.Millisecond,
+	})
+	defer host.Close()
+
+	req := httptest.NewRequest("GET", "/fs/alice/directory/1", nil)
+	rr := httptest.NewRecorder()
+	host.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if len(host.Roots()) != 1 {
+		t.Fatalf("expected the root to be open")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(host.Roots()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the idle root to be closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHost_ReopenWaitsForClose(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "alice", initLink.Address, "")
+
+	opts := Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "alice", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+	}
+	opened := make(chan struct{}, 1)
+	host := NewHost(HostOptions{
+		Open: func(slotID string) (*InMemoryFiles, error) {
+			opened <- struct{}{}
+			return NewInMemoryFiles(opts)
+		},
+	})
+	defer host.Close()
+
+	// An evicted root of the slot is still being synced and closed
+	evicted := &hostedRoot{slotID: "alice"}
+	host.mu.Lock()
+	host.startClosing(evicted)
+	host.mu.Unlock()
+
+	acquired := make(chan error, 1)
+	go func() {
+		root, err := host.acquire("alice")
+		if err == nil {
+			host.release(root)
+		}
+		acquired <- err
+	}()
+
+	select {
+	case <-opened:
+		t.Fatal("expected the slot not to be opened while its evicted root is closing")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	host.closeRoot(evicted)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("acquire failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the slot to be opened once its evicted root is closed")
+	}
+	if len(opened) != 1 {
+		t.Fatal("expected the slot to be opened once")
+	}
+}
@@ -1,16 +1,20 @@
 package files
 
 import (
+	"bufio"
 	"bytes"
+	"container/list"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"invariant/internal/content"
@@ -29,10 +33,45 @@ type InMemoryFiles struct {
 	next  uint64
 
 	dirtyNodes map[uint64]bool
+	dirtyGen   uint64
+
+	// syncMu serializes syncs, which upload directories without holding mu.
+	syncMu         sync.Mutex
+	uploadSlots    chan struct{}
+	pendingUploads atomic.Int64
+
+	// wal journals mutations before they are applied. replaying is set while
+	// the journal is replayed so its entries are not journaled again.
+	wal       *wal
+	replaying bool
+
+	// loadedDirs orders loaded directories from most to least recently used
+	// so that clean subtrees can be evicted when MaxNodes is exceeded.
+	loadedDirs  *list.List
+	loadedElems map[uint64]*list.Element
 
 	layerDependencies map[string]bool
 	lastSlotAddresses map[int]string
 
+	// pendingSlots are the layers whose committed root is not yet published
+	// to their slot, such as while the slots service is unreachable.
+	pendingSlots map[int]bool
+	// unpublished are the nodes committed since the roots were last
+	// published, which are local changes when merging a remote root.
+	unpublished map[uint64]bool
+	// commitMessage is the message of the next commit appended to the
+	// commit log.
+	commitMessage string
+	// acceptedSignature is the sequence of the last root signature accepted,
+	// so a root rolled back along with its signature is refused.
+	// signedSequence is the sequence of the last root signed, guarded by
+	// syncMu.
+	acceptedSignature uint64
+	signedSequence    uint64
+
+	// verifier re-reads synced content when VerifyInterval is set.
+	verifier verifier
+
 	destClientsMu sync.RWMutex
 	destClients   map[string]storage.Storage
 
@@ -53,6 +92,15 @@ type Node struct {
 	Size       uint64
 	Type       string
 
+	// TotalSize and TotalEntries account for the subtree of a directory: the
+	// cumulative size of its files and the number of entries it contains.
+	TotalSize    uint64
+	TotalEntries uint64
+
+	// Policy is the storage policy of a directory inherited by the files
+	// written beneath it.
+	Policy *filetree.Policy
+
 	Content content.ContentLink
 
 	LayerContents   map[int]content.ContentLink
@@ -63,6 +111,9 @@ type Node struct {
 
 	IsDirty  bool
 	IsLoaded bool
+
+	// dirtyGen is the generation at which the node was last marked dirty.
+	dirtyGen uint64
 }
 
 // NewInMemoryFiles creates a new InMemoryFiles.
@@ -77,6 +128,9 @@ func NewInMemoryFiles(opts Options) (*InMemoryFiles, error) {
 	if opts.SlotPollInterval == 0 {
 		opts.SlotPollInterval = 5 * time.Minute
 	}
+	if opts.UploadConcurrency <= 0 {
+		opts.UploadConcurrency = defaultUploadConcurrency
+	}
 
 	// Migrate singular root into first layer
 	if len(opts.Layers) == 0 && opts.RootLink.Address != "" {
@@ -93,9 +147,14 @@ func NewInMemoryFiles(opts Options) (*InMemoryFiles, error) {
 		root:              1,
 		next:              2,
 		dirtyNodes:        make(map[uint64]bool),
+		loadedDirs:        list.New(),
+		loadedElems:       make(map[uint64]*list.Element),
 		layerDependencies: make(map[string]bool),
 		lastSlotAddresses: make(map[int]string),
+		pendingSlots:      make(map[int]bool),
+		unpublished:       make(map[uint64]bool),
 		destClients:       make(map[string]storage.Storage),
+		uploadSlots:       make(chan struct{}, opts.UploadConcurrency),
 		ctx:               ctx,
 		cancel:            cancel,
 	}
@@ -135,6 +194,9 @@ func NewInMemoryFiles(opts Options) (*InMemoryFiles, error) {
 	s.nodes[1] = rootNode
 
 	go s.autoSyncLoop()
+	if opts.VerifyInterval > 0 {
+		go s.verifyLoop()
+	}
 	if opts.Slots != nil {
 		pollSlots := false
 		for _, l := range opts.Layers {
@@ -157,7 +219,20 @@ func NewInMemoryFiles(opts Options) (*InMemoryFiles, error) {
 		initialLayers = nil
 	}
 
-	s.applyNewLayers(initialLayers)
+	if err := s.applyNewLayers(initialLayers); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	if opts.JournalDir != "" {
+		w, entries, err := openWAL(opts.JournalDir)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to open journal: %w", err)
+		}
+		s.wal = w
+		s.replay(entries)
+	}
 
 	return s, nil
 }
@@ -165,6 +240,9 @@ func NewInMemoryFiles(opts Options) (*InMemoryFiles, error) {
 // Close stops the background tasks.
 func (s *InMemoryFiles) Close() {
 	s.cancel()
+	if s.wal != nil {
+		s.wal.close()
+	}
 }
 
 func (s *InMemoryFiles) getNextID() uint64 {
@@ -176,9 +254,12 @@ func (s *InMemoryFiles) getNextID() uint64 {
 func (s *InMemoryFiles) markDirty(id uint64) {
 	s.dirtyNodes[id] = true
 	if node, ok := s.nodes[id]; ok {
+		s.dirtyGen++
 		node.IsDirty = true
+		node.dirtyGen = s.dirtyGen
 		now := uint64(time.Now().Unix())
 		node.ModifyTime = &now
+		s.computeTotals(node)
 		for parentID := range node.Parents {
 			if parentID != 0 {
 				s.markDirty(parentID)
@@ -199,17 +280,83 @@ func (s *InMemoryFiles) isWritable() bool {
 	return false
 }
 
+// computeTotals recalculates the subtree accounting of a loaded directory from
+// its children. Unloaded directories keep the totals recorded in their entry.
+func (s *InMemoryFiles) computeTotals(node *Node) {
+	if node.Kind != filetree.DirectoryKind || !node.IsLoaded {
+		return
+	}
+
+	var size, entries uint64
+	for _, childID := range node.Children {
+		child, ok := s.nodes[childID]
+		if !ok {
+			continue
+		}
+		entries++
+		switch child.Kind {
+		case filetree.FileKind:
+			size += child.Size
+		case filetree.DirectoryKind:
+			size += child.TotalSize
+			entries += child.TotalEntries
+		}
+	}
+	node.TotalSize = size
+	node.TotalEntries = entries
+}
+
+// updateTotals recalculates the subtree accounting of a directory and its
+// ancestors without marking them dirty.
+func (s *InMemoryFiles) updateTotals(id uint64) {
+	visited := make(map[uint64]bool)
+	pending := []uint64{id}
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+
+		node, ok := s.nodes[current]
+		if !ok {
+			continue
+		}
+		s.computeTotals(node)
+		for parentID := range node.Parents {
+			if parentID != 0 {
+				pending = append(pending, parentID)
+			}
+		}
+	}
+}
+
+// checkQuota reports ErrQuotaExceeded if replacing oldSize bytes of the tree
+// with newSize bytes would grow the root beyond MaxSize.
+func (s *InMemoryFiles) checkQuota(oldSize, newSize uint64) error {
+	if s.opts.MaxSize == 0 || newSize <= oldSize {
+		return nil
+	}
+	used := s.nodes[s.root].TotalSize
+	if used-min(used, oldSize)+newSize > s.opts.MaxSize {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
 func (s *InMemoryFiles) ensureLoaded(id uint64) error {
 	node, ok := s.nodes[id]
 	if !ok {
-		return fmt.Errorf("node %d not found", id)
+		return fmt.Errorf("%w: node %d", ErrNotFound, id)
 	}
 
 	if node.Kind != filetree.DirectoryKind {
-		return fmt.Errorf("node %d is not a directory", id)
+		return fmt.Errorf("%w: node %d", ErrNotDirectory, id)
 	}
 
 	if node.IsLoaded {
+		s.touchLoaded(id)
 		return nil
 	}
 
@@ -226,6 +373,15 @@ func (s *InMemoryFiles) ensureLoaded(id uint64) error {
 			continue // This layer might not have this directory instantiated remotely yet
 		}
 
+		// Read the root as of the slot address last seen, so the tree can be
+		// loaded while the slots service is unreachable
+		if id == 1 && contentLink.Slot {
+			if address := s.lastSlotAddresses[layerIdx]; address != "" {
+				contentLink.Address = address
+				contentLink.Slot = false
+			}
+		}
+
 		reader, err := content.Read(contentLink, s.getStorageForLayer(layerIdx), s.opts.Slots)
 		if err != nil {
 			return fmt.Errorf("failed to create reader for directory %d layer %d: %w", id, layerIdx, err)
@@ -237,9 +393,12 @@ func (s *InMemoryFiles) ensureLoaded(id uint64) error {
 			return fmt.Errorf("failed to read directory %d content layer %d: %w", id, layerIdx, err)
 		}
 
+		// A directory created empty has an empty block until it is synced
 		var d filetree.Directory
-		if err := json.Unmarshal(data, &d); err != nil {
-			return fmt.Errorf("failed to unmarshal directory %d content layer %d: %w", id, layerIdx, err)
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &d); err != nil {
+				return fmt.Errorf("failed to unmarshal directory %d content layer %d: %w", id, layerIdx, err)
+			}
 		}
 
 		for _, entry := range d {
@@ -292,6 +451,9 @@ func (s *InMemoryFiles) ensureLoaded(id uint64) error {
 				childNode.Mode = e.Mode
 				childNode.Content = e.Content // Legacy compat fallback
 				childNode.Size = e.Size
+				childNode.TotalSize = e.TotalSize
+				childNode.TotalEntries = e.TotalEntries
+				childNode.Policy = e.Policy
 				childNode.Children = make(map[string]uint64)
 			case *filetree.SymbolicLinkEntry:
 				childNode.CreateTime = e.CreateTime
@@ -306,9 +468,134 @@ func (s *InMemoryFiles) ensureLoaded(id uint64) error {
 	}
 
 	node.IsLoaded = true
+	s.updateTotals(id)
+	s.touchLoaded(id)
 	return nil
 }
 
+// ancestors returns id and all of its ancestors.
+func (s *InMemoryFiles) ancestors(id uint64) map[uint64]bool {
+	result := make(map[uint64]bool)
+	pending := []uint64{id}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if result[current] {
+			continue
+		}
+		result[current] = true
+		if node, ok := s.nodes[current]; ok {
+			for parentID := range node.Parents {
+				if parentID != 0 {
+					pending = append(pending, parentID)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// touchLoaded marks a loaded directory and its ancestors as recently used.
+func (s *InMemoryFiles) touchLoaded(id uint64) {
+	if s.opts.MaxNodes == 0 {
+		return
+	}
+	for current := range s.ancestors(id) {
+		if elem, ok := s.loadedElems[current]; ok {
+			s.loadedDirs.MoveToFront(elem)
+		} else {
+			s.loadedElems[current] = s.loadedDirs.PushFront(current)
+		}
+	}
+}
+
+// evictNodes unloads the least recently used clean directories, dropping their
+// subtrees back to their content links, until no more than MaxNodes nodes
+// remain. The nodes in protect and their ancestors are kept.
+func (s *InMemoryFiles) evictNodes(protect ...uint64) {
+	if s.opts.MaxNodes == 0 || len(s.nodes) <= s.opts.MaxNodes {
+		return
+	}
+
+	protected := make(map[uint64]bool)
+	for _, id := range protect {
+		for ancestor := range s.ancestors(id) {
+			protected[ancestor] = true
+		}
+	}
+
+	for e := s.loadedDirs.Back(); e != nil && len(s.nodes) > s.opts.MaxNodes; {
+		id := e.Value.(uint64)
+		e = e.Prev()
+		if id == s.root || protected[id] {
+			continue
+		}
+		s.unloadDirectory(id)
+	}
+}
+
+// unloadDirectory drops the children of a clean, loaded directory so they are
+// reloaded from its content link when next needed. Directories with pending
+// changes, or whose subtree is reachable through a hard link from outside of
+// it, are kept.
+func (s *InMemoryFiles) unloadDirectory(id uint64) bool {
+	node, ok := s.nodes[id]
+	if !ok || node.Kind != filetree.DirectoryKind || !node.IsLoaded {
+		s.forgetLoaded(id)
+		return false
+	}
+	if node.IsDirty || len(node.LayerContents) == 0 {
+		return false
+	}
+
+	subtree := make(map[uint64]bool)
+	pending := make([]uint64, 0, len(node.Children))
+	for _, childID := range node.Children {
+		pending = append(pending, childID)
+	}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if subtree[current] {
+			continue
+		}
+		child, ok := s.nodes[current]
+		if !ok {
+			continue
+		}
+		if child.IsDirty {
+			return false
+		}
+		subtree[current] = true
+		for _, grandchildID := range child.Children {
+			pending = append(pending, grandchildID)
+		}
+	}
+	for childID := range subtree {
+		for parentID := range s.nodes[childID].Parents {
+			if parentID != id && !subtree[parentID] {
+				return false
+			}
+		}
+	}
+
+	for childID := range subtree {
+		delete(s.nodes, childID)
+		s.forgetLoaded(childID)
+	}
+	node.Children = make(map[string]uint64)
+	node.IsLoaded = false
+	s.forgetLoaded(id)
+	return true
+}
+
+func (s *InMemoryFiles) forgetLoaded(id uint64) {
+	if elem, ok := s.loadedElems[id]; ok {
+		s.loadedDirs.Remove(elem)
+		delete(s.loadedElems, id)
+	}
+}
+
 func (s *InMemoryFiles) getFullPath(id uint64) string {
 	if id == 1 {
 		return "" // Root
@@ -352,16 +639,35 @@ func (s *InMemoryFiles) deleteNodeRecursively(id uint64, parentID uint64) {
 	}
 	delete(s.nodes, id)
 	delete(s.dirtyNodes, id)
+	s.forgetLoaded(id)
 }
 
 func (s *InMemoryFiles) CreateEntry(ctx context.Context, parentID uint64, name string, kind filetree.EntryKind, target string, contentLink *content.ContentLink, contentReader io.Reader) error {
 	if !s.isWritable() {
-		return errors.New("file system is read-only")
+		return ErrReadOnly
+	}
+
+	// The content is written, or the content of a graft read, before the
+	// lock is taken as its blocks may have to be sent or fetched
+	var graft graftInfo
+	var written writtenContent
+	if kind == filetree.FileKind || kind == filetree.DirectoryKind {
+		var err error
+		if contentLink != nil {
+			graft, err = s.inspectGraft(parentID, name, kind, *contentLink)
+		} else {
+			written, err = s.writeContent(ctx, parentID, name, kind, contentReader)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.evictNodes(parentID)
+
 	if err := s.ensureLoaded(parentID); err != nil {
 		return err
 	}
@@ -370,56 +676,20 @@ func (s *InMemoryFiles) CreateEntry(ctx context.Context, parentID uint64, name s
 	childID := s.getNextID()
 	now := uint64(time.Now().Unix())
 
-	layerMembership := make(map[int]bool)
-	childPath := s.getFullPath(parentID)
-	if childPath == "" || childPath == "/" {
-		childPath = "/" + name
-	} else {
-		childPath = childPath + "/" + name
-	}
-
-	alreadyIncluded := false
-	for i, layer := range s.opts.Layers {
-		if layer.ReadOnly {
-			continue
-		}
-
-		isDir := kind == filetree.DirectoryKind
-
-		included := len(layer.Includes) == 0
-		if !included && layer.includesMatcher != nil {
-			included = layer.includesMatcher.Matches(childPath, isDir)
-		}
-
-		if included && len(layer.Excludes) > 0 && layer.excludesMatcher != nil {
-			if layer.excludesMatcher.Matches(childPath, isDir) {
-				included = false
-			}
-		}
-
-		if alreadyIncluded {
-			included = false
-		}
-
-		if included {
-			layerMembership[i] = true
-			if i > 0 {
-				alreadyIncluded = true
-			}
-
-			// Implicitly include parent directories
-			currParent := parentNode
-			currID := parentID
-			for currID != 1 && !currParent.LayerMembership[i] {
-				currParent.LayerMembership[i] = true
-				s.markDirty(currID)
-
-				// Grab first parent
-				for pID := range currParent.Parents {
-					currID = pID
-					currParent = s.nodes[currID]
-					break
-				}
+	layerMembership := s.layerMembership(joinPath(s.getFullPath(parentID), name), kind == filetree.DirectoryKind)
+	for i := range layerMembership {
+		// Implicitly include parent directories
+		currParent := parentNode
+		currID := parentID
+		for currID != 1 && !currParent.LayerMembership[i] {
+			currParent.LayerMembership[i] = true
+			s.markDirty(currID)
+
+			// Grab first parent
+			for pID := range currParent.Parents {
+				currID = pID
+				currParent = s.nodes[currID]
+				break
 			}
 		}
 	}
@@ -439,39 +709,41 @@ func (s *InMemoryFiles) CreateEntry(ctx context.Context, parentID uint64, name s
 	switch kind {
 	case filetree.FileKind, filetree.DirectoryKind:
 		if contentLink != nil {
-			childNode.Content = *contentLink
-		} else {
-			if contentReader == nil {
-				contentReader = io.LimitReader(nil, 0)
-			}
-			data, err := io.ReadAll(contentReader)
-			if err != nil {
-				return fmt.Errorf("failed to read content: %v", err)
+			if err := s.graftLocked(childNode, *contentLink, graft); err != nil {
+				return err
 			}
+		} else {
 			if kind == filetree.FileKind {
-				childNode.Size = uint64(len(data))
-			}
-			opts := s.opts.WriterOptions
-			opts.Filename = name
-			link, err := content.Write(bytes.NewReader(data), s.getStorageForNode(childNode), opts)
-			if err != nil {
-				return fmt.Errorf("failed to save file: %v", err)
+				if err := s.checkQuota(0, written.size); err != nil {
+					return err
+				}
+				childNode.Size = written.size
+				childNode.Type = written.contentType
 			}
-			childNode.Content = link
+			childNode.Content = written.link
+			s.replicate(written.link, written.store, written.policy)
 		}
 
 		if kind == filetree.DirectoryKind {
 			childNode.Children = make(map[string]uint64)
-			childNode.IsLoaded = true
+			childNode.IsLoaded = contentLink == nil
 		}
 
 	case filetree.SymbolicLinkKind:
 		if target == "" {
-			return errors.New("target is required for SymbolicLink")
+			return fmt.Errorf("%w: target is required for SymbolicLink", ErrInvalidArgument)
 		}
 		childNode.Target = target
 	}
 
+	e := walEntry{Op: "create", Path: s.getFullPath(parentID), Name: name, Kind: kind, Target: target, Size: childNode.Size, Type: childNode.Type}
+	if kind != filetree.SymbolicLinkKind {
+		e.Content = &childNode.Content
+	}
+	if err := s.journalLocked(e); err != nil {
+		return err
+	}
+
 	s.nodes[childID] = childNode
 	parentNode.Children[name] = childID
 	s.markDirty(parentID)
@@ -481,12 +753,212 @@ func (s *InMemoryFiles) CreateEntry(ctx context.Context, parentID uint64, name s
 	return nil
 }
 
+// layerMembership returns the writable layers a new entry at path belongs
+// to: the first layer, if it includes the entry, and the first of the other
+// layers that includes it.
+func (s *InMemoryFiles) layerMembership(path string, isDir bool) map[int]bool {
+	membership := make(map[int]bool)
+	for i, layer := range s.opts.Layers {
+		if layer.ReadOnly {
+			continue
+		}
+
+		included := len(layer.Includes) == 0
+		if !included && layer.includesMatcher != nil {
+			included = layer.includesMatcher.Matches(path, isDir)
+		}
+
+		if included && len(layer.Excludes) > 0 && layer.excludesMatcher != nil {
+			if layer.excludesMatcher.Matches(path, isDir) {
+				included = false
+			}
+		}
+
+		if included {
+			membership[i] = true
+			if i > 0 {
+				break
+			}
+		}
+	}
+	return membership
+}
+
+// storageForEntryLocked returns the storage of a new entry name of kind in
+// the directory parentID, which is that of the layer it would belong to.
+// s.mu must be held.
+func (s *InMemoryFiles) storageForEntryLocked(parentID uint64, name string, kind filetree.EntryKind) storage.Storage {
+	if _, ok := s.nodes[parentID]; !ok {
+		return s.opts.Storage
+	}
+	path := joinPath(s.getFullPath(parentID), name)
+	return s.getStorageForNode(&Node{LayerMembership: s.layerMembership(path, kind == filetree.DirectoryKind)})
+}
+
+// writtenContent is the content of a new file or directory written by
+// writeContent.
+type writtenContent struct {
+	link        content.ContentLink
+	size        uint64
+	contentType string
+	store       storage.Storage
+	policy      *filetree.Policy
+}
+
+// writeContent streams the content read from r, which may be nil for no
+// content, to the storage of the new entry name of kind in the directory
+// parentID. Only the head of the content is read ahead to learn its type.
+// Writing a file stops with ErrQuotaExceeded as soon as it would grow the
+// root beyond its quota. s.mu must not be held.
+func (s *InMemoryFiles) writeContent(ctx context.Context, parentID uint64, name string, kind filetree.EntryKind, r io.Reader) (writtenContent, error) {
+	var written writtenContent
+	s.mu.Lock()
+	s.evictNodes(parentID)
+	if err := s.ensureLoaded(parentID); err != nil {
+		s.mu.Unlock()
+		return written, err
+	}
+	opts, policy, err := s.writerOptionsLocked(parentID)
+	if err != nil {
+		s.mu.Unlock()
+		return written, err
+	}
+	written.store = s.storageForEntryLocked(parentID, name, kind)
+	written.policy = policy
+	remaining := int64(-1)
+	if s.opts.MaxSize != 0 {
+		maxSize := s.opts.MaxSize
+		remaining = int64(maxSize - min(maxSize, s.nodes[s.root].TotalSize))
+	}
+	s.mu.Unlock()
+
+	if r == nil {
+		r = io.LimitReader(nil, 0)
+	}
+	if kind == filetree.FileKind && remaining >= 0 {
+		// Read one byte past the quota to learn that it is exceeded
+		r = io.LimitReader(r, remaining+1)
+	}
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return written, fmt.Errorf("failed to read content: %v", err)
+	}
+	if kind == filetree.FileKind && len(head) > 0 {
+		written.contentType = http.DetectContentType(head)
+	}
+	opts.Filename = name
+	opts.ContentType = written.contentType
+	if kind == filetree.DirectoryKind {
+		opts.InlineMax = 0
+	}
+	cr := &countReader{r: br}
+	link, err := content.WriteContext(ctx, cr, written.store, opts)
+	if err != nil {
+		return written, fmt.Errorf("failed to save file: %v", err)
+	}
+	if kind == filetree.FileKind && remaining >= 0 && cr.n > remaining {
+		return written, ErrQuotaExceeded
+	}
+	written.link = link
+	written.size = uint64(cr.n)
+	return written, nil
+}
+
+// graftInfo is what a grafted node learns of the content it refers to.
+type graftInfo struct {
+	size         uint64 // of a file
+	contentType  string // of a file
+	totalSize    uint64 // of a directory
+	totalEntries uint64 // of a directory
+}
+
+// inspectGraft checks that link, grafted as the entry name of kind in the
+// directory parentID, resolves, and reads the size and type of a file or the
+// totals of a directory. The size of a split file is taken from its block
+// list, so only the list and the head of the file are read. s.mu must not be
+// held.
+func (s *InMemoryFiles) inspectGraft(parentID uint64, name string, kind filetree.EntryKind, link content.ContentLink) (graftInfo, error) {
+	s.mu.RLock()
+	if s.replaying {
+		s.mu.RUnlock()
+		return graftInfo{}, nil
+	}
+	store := s.storageForEntryLocked(parentID, name, kind)
+	s.mu.RUnlock()
+
+	var info graftInfo
+	if kind == filetree.DirectoryKind {
+		dir, err := filetree.ReadDirectory(link, store, s.opts.Slots)
+		if err != nil {
+			return info, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+		}
+		if err := dir.Validate(); err != nil {
+			return info, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+		}
+		info.totalSize, info.totalEntries = dir.Totals()
+		return info, nil
+	}
+
+	size, err := content.Size(link, store, s.opts.Slots)
+	if err != nil {
+		return info, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+	}
+	info.size = size
+	if size > 0 {
+		r, err := content.Read(link, store, s.opts.Slots)
+		if err != nil {
+			return info, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+		}
+		defer r.Close()
+		head, err := io.ReadAll(io.LimitReader(r, sniffLen))
+		if err != nil {
+			return info, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+		}
+		info.contentType = http.DetectContentType(head)
+	}
+	return info, nil
+}
+
+// graftLocked makes node, a new file or directory, refer to the content at
+// link, as read by inspectGraft, in place of writing content of its own. No
+// block is written. A grafted directory is loaded from link when it is first
+// read. s.mu must be held.
+func (s *InMemoryFiles) graftLocked(node *Node, link content.ContentLink, info graftInfo) error {
+	node.Content = link
+	if node.Kind == filetree.DirectoryKind {
+		// The directory is clean until it changes, so the parent refers to
+		// link rather than writing the unloaded directory
+		node.IsDirty = false
+		for i := range node.LayerMembership {
+			node.LayerContents[i] = link
+		}
+	}
+	if s.replaying {
+		return nil
+	}
+
+	if node.Kind == filetree.DirectoryKind {
+		if err := s.checkQuota(0, info.totalSize); err != nil {
+			return err
+		}
+		node.TotalSize, node.TotalEntries = info.totalSize, info.totalEntries
+		return nil
+	}
+	if err := s.checkQuota(0, info.size); err != nil {
+		return err
+	}
+	node.Size = info.size
+	node.Type = info.contentType
+	return nil
+}
+
 func (s *InMemoryFiles) ReadFile(ctx context.Context, nodeID uint64, offset, length int64) (io.ReadCloser, error) {
 	s.mu.RLock()
 	node, ok := s.nodes[nodeID]
 	if !ok || node.Kind == filetree.DirectoryKind {
 		s.mu.RUnlock()
-		return nil, errors.New("invalid file node")
+		return nil, ErrNotFile
 	}
 
 	var link content.ContentLink
@@ -498,24 +970,19 @@ func (s *InMemoryFiles) ReadFile(ctx context.Context, nodeID uint64, offset, len
 	}
 	s.mu.RUnlock()
 
-	reader, err := content.Read(link, s.getStorageForNode(node), s.opts.Slots)
+	store := s.getStorageForNode(node)
+	if trace := storage.TraceFrom(ctx); trace != nil {
+		store = storage.NewTracingStorage(store, trace)
+	}
+	reader, err := content.Read(link, store, s.opts.Slots)
 	if err != nil {
 		return nil, err
 	}
 
 	if offset > 0 {
-		if seeker, ok := reader.(io.Seeker); ok {
-			_, err := seeker.Seek(offset, io.SeekStart)
-			if err != nil {
-				reader.Close()
-				return nil, err
-			}
-		} else {
-			_, err := io.CopyN(io.Discard, reader, offset)
-			if err != nil && err != io.EOF {
-				reader.Close()
-				return nil, err
-			}
+		if err := content.Seek(reader, offset); err != nil {
+			reader.Close()
+			return nil, err
 		}
 	}
 
@@ -549,6 +1016,72 @@ func (c *countReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// sniffLen is the number of leading bytes considered by http.DetectContentType.
+const sniffLen = 512
+
+// maxRewriteSize is the largest write that is buffered to rewrite only the
+// blocks of a file it overlaps.
+const maxRewriteSize = 4 * 1024 * 1024
+
+func isBlockList(link content.ContentLink) bool {
+	n := len(link.Transforms)
+	return n > 0 && link.Transforms[n-1].Kind == "Blocks"
+}
+
+// rewriteFileLocked writes data at offset of the file node, reusing the blocks
+// of the file that are unchanged. s.mu must be held.
+func (s *InMemoryFiles) rewriteFileLocked(nodeID uint64, node *Node, offset int64, data []byte) error {
+	newSize := uint64(max(int64(node.Size), offset+int64(len(data))))
+	if err := s.checkQuota(node.Size, newSize); err != nil {
+		return err
+	}
+
+	opts, policy, err := s.writerOptionsLocked(firstParent(node))
+	if err != nil {
+		return err
+	}
+	opts.Filename = node.Name
+	opts.ContentType = node.Type
+	changes := []content.Range{{Offset: offset, Length: int64(len(data))}}
+	store := s.getStorageForNode(node)
+	link, err := content.Rewrite(node.Content, changes, bytes.NewReader(data), store, s.opts.Slots, opts)
+	if err != nil {
+		return err
+	}
+	if err := s.journalLocked(walEntry{Op: "content", Path: s.getFullPath(nodeID), Content: &link, Size: newSize, Type: node.Type}); err != nil {
+		return err
+	}
+
+	node.Content = link
+	if node.LayerContents != nil {
+		for i := range node.LayerContents {
+			node.LayerContents[i] = link
+		}
+	}
+	node.Size = newSize
+	s.markDirty(nodeID)
+	s.replicate(link, store, policy)
+
+	go s.checkAndReloadNode(nodeID)
+
+	return nil
+}
+
+// sniffReader records the leading bytes read through it so the content type
+// can be detected without buffering the whole stream.
+type sniffReader struct {
+	r    io.Reader
+	head []byte
+}
+
+func (s *sniffReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if remaining := sniffLen - len(s.head); remaining > 0 && n > 0 {
+		s.head = append(s.head, p[:min(n, remaining)]...)
+	}
+	return n, err
+}
+
 type dynamicSkipReader struct {
 	r      io.Reader
 	skipFn func() int64
@@ -575,7 +1108,7 @@ func (s *dynamicSkipReader) Read(p []byte) (int, error) {
 
 func (s *InMemoryFiles) WriteFile(ctx context.Context, nodeID uint64, offset int64, appendFlag bool, r io.Reader) error {
 	if !s.isWritable() {
-		return errors.New("file system is read-only")
+		return ErrReadOnly
 	}
 
 	s.mu.Lock()
@@ -583,7 +1116,7 @@ func (s *InMemoryFiles) WriteFile(ctx context.Context, nodeID uint64, offset int
 
 	node, ok := s.nodes[nodeID]
 	if !ok || node.Kind != filetree.FileKind {
-		return errors.New("invalid file node")
+		return ErrNotFile
 	}
 
 	var startOffset int64
@@ -595,6 +1128,19 @@ func (s *InMemoryFiles) WriteFile(ctx context.Context, nodeID uint64, offset int
 		startOffset = 0
 	}
 
+	// Writes into the middle or end of a file of several blocks only rewrite
+	// the blocks they overlap if the written data is small enough to buffer.
+	if startOffset > 0 && isBlockList(node.Content) {
+		data, err := io.ReadAll(io.LimitReader(r, maxRewriteSize+1))
+		if err != nil {
+			return err
+		}
+		if len(data) <= maxRewriteSize {
+			return s.rewriteFileLocked(nodeID, node, startOffset, data)
+		}
+		r = io.MultiReader(bytes.NewReader(data), r)
+	}
+
 	var existingReader io.ReadCloser
 	if node.Content.Address != "" {
 		var err error
@@ -630,21 +1176,50 @@ func (s *InMemoryFiles) WriteFile(ctx context.Context, nodeID uint64, offset int
 		})
 	}
 
-	opts := s.opts.WriterOptions
+	// Only sniff when the write starts at the beginning of the file, otherwise
+	// the leading bytes are existing content that was already classified.
+	var sniff *sniffReader
+	contentReader := io.MultiReader(parts...)
+	if node.Type == "" && startOffset == 0 {
+		sniff = &sniffReader{r: contentReader}
+		contentReader = sniff
+	}
+
+	opts, policy, err := s.writerOptionsLocked(firstParent(node))
+	if err != nil {
+		return err
+	}
 	opts.Filename = node.Name
-	link, err := content.Write(io.MultiReader(parts...), s.getStorageForNode(node), opts)
+	opts.ContentType = node.Type
+	store := s.getStorageForNode(node)
+	link, err := content.WriteContext(ctx, contentReader, store, opts)
 	if err != nil {
 		return err
 	}
 
+	newSize := uint64(max(int64(node.Size), startOffset+cr.n))
+	if err := s.checkQuota(node.Size, newSize); err != nil {
+		return err
+	}
+
+	contentType := node.Type
+	if sniff != nil && len(sniff.head) > 0 {
+		contentType = http.DetectContentType(sniff.head)
+	}
+	if err := s.journalLocked(walEntry{Op: "content", Path: s.getFullPath(nodeID), Content: &link, Size: newSize, Type: contentType}); err != nil {
+		return err
+	}
+
+	node.Type = contentType
 	node.Content = link
 	if node.LayerContents != nil {
 		for i := range node.LayerContents {
 			node.LayerContents[i] = link
 		}
 	}
-	node.Size = uint64(max(int64(node.Size), startOffset+cr.n))
+	node.Size = newSize
 	s.markDirty(nodeID)
+	s.replicate(link, store, policy)
 
 	go s.checkAndReloadNode(nodeID)
 
@@ -655,6 +1230,8 @@ func (s *InMemoryFiles) ReadDirectory(ctx context.Context, nodeID uint64, offset
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.evictNodes(nodeID)
+
 	if err := s.ensureLoaded(nodeID); err != nil {
 		return nil, err
 	}
@@ -687,8 +1264,11 @@ func (s *InMemoryFiles) ReadDirectory(ctx context.Context, nodeID uint64, offset
 					ModifyTime: child.ModifyTime,
 					Mode:       child.Mode,
 				},
-				Content: child.Content,
-				Size:    child.Size,
+				Content:      child.Content,
+				Size:         child.Size,
+				TotalSize:    child.TotalSize,
+				TotalEntries: child.TotalEntries,
+				Policy:       child.Policy,
 			})
 		case filetree.SymbolicLinkKind:
 			entries = append(entries, &filetree.SymbolicLinkEntry{
@@ -713,7 +1293,7 @@ func (s *InMemoryFiles) GetAttributes(ctx context.Context, nodeID uint64) (Entry
 
 	node, ok := s.nodes[nodeID]
 	if !ok {
-		return EntryAttributes{}, errors.New("node not found")
+		return EntryAttributes{}, ErrNotFound
 	}
 
 	writable := s.isWritable()
@@ -729,12 +1309,20 @@ func (s *InMemoryFiles) GetAttributes(ctx context.Context, nodeID uint64) (Entry
 		attrs.Type = &node.Type
 	}
 
+	if node.Kind == filetree.DirectoryKind {
+		totalSize := node.TotalSize
+		totalEntries := node.TotalEntries
+		attrs.TotalSize = &totalSize
+		attrs.TotalEntries = &totalEntries
+		attrs.Policy = node.Policy
+	}
+
 	return attrs, nil
 }
 
 func (s *InMemoryFiles) SetAttributes(ctx context.Context, nodeID uint64, attrs EntryAttributes) (EntryAttributes, error) {
 	if !s.isWritable() {
-		return EntryAttributes{}, errors.New("file system is read-only")
+		return EntryAttributes{}, ErrReadOnly
 	}
 
 	s.mu.Lock()
@@ -742,7 +1330,21 @@ func (s *InMemoryFiles) SetAttributes(ctx context.Context, nodeID uint64, attrs
 
 	node, ok := s.nodes[nodeID]
 	if !ok {
-		return EntryAttributes{}, errors.New("node not found")
+		return EntryAttributes{}, ErrNotFound
+	}
+	if attrs.Policy != nil {
+		if node.Kind != filetree.DirectoryKind {
+			return EntryAttributes{}, ErrNotDirectory
+		}
+		if nodeID == 1 {
+			return EntryAttributes{}, fmt.Errorf("%w: the root has no policy", ErrInvalidArgument)
+		}
+		if err := attrs.Policy.Validate(); err != nil {
+			return EntryAttributes{}, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+		}
+	}
+	if err := s.journalLocked(walEntry{Op: "attributes", Path: s.getFullPath(nodeID), Attrs: &attrs}); err != nil {
+		return EntryAttributes{}, err
 	}
 
 	if attrs.CreateTime != nil {
@@ -764,6 +1366,14 @@ func (s *InMemoryFiles) SetAttributes(ctx context.Context, nodeID uint64, attrs
 			node.Type = *attrs.Type
 		}
 	}
+	if attrs.Policy != nil {
+		if *attrs.Policy == (filetree.Policy{}) {
+			node.Policy = nil
+		} else {
+			policy := *attrs.Policy
+			node.Policy = &policy
+		}
+	}
 
 	s.markDirty(nodeID)
 	return s.getAttributesLocked(nodeID)
@@ -783,6 +1393,9 @@ func (s *InMemoryFiles) getAttributesLocked(nodeID uint64) (EntryAttributes, err
 		attrs.Size = &node.Size
 		attrs.Type = &node.Type
 	}
+	if node.Kind == filetree.DirectoryKind {
+		attrs.Policy = node.Policy
+	}
 	return attrs, nil
 }
 
@@ -792,7 +1405,7 @@ func (s *InMemoryFiles) GetContent(ctx context.Context, nodeID uint64) (content.
 
 	node, ok := s.nodes[nodeID]
 	if !ok || node.Kind == filetree.SymbolicLinkKind {
-		return content.ContentLink{}, errors.New("invalid node")
+		return content.ContentLink{}, ErrNotFound
 	}
 
 	return node.Content, nil
@@ -804,7 +1417,7 @@ func (s *InMemoryFiles) GetInfo(ctx context.Context, nodeID uint64) (ContentInfo
 
 	node, ok := s.nodes[nodeID]
 	if !ok {
-		return ContentInformationCommon{}, errors.New("node not found")
+		return ContentInformationCommon{}, ErrNotFound
 	}
 
 	return s.getInfoLocked(nodeID, node)
@@ -824,6 +1437,11 @@ func (s *InMemoryFiles) getInfoLocked(nodeID uint64, node *Node) (ContentInforma
 		info.CreateTime = *node.CreateTime
 	}
 
+	if node.Kind == filetree.DirectoryKind {
+		info.TotalSize = node.TotalSize
+		info.TotalEntries = node.TotalEntries
+	}
+
 	if node.Content.Expected != "" {
 		info.Etag = node.Content.Expected
 	} else if node.Content.Address != "" {
@@ -835,22 +1453,52 @@ func (s *InMemoryFiles) getInfoLocked(nodeID uint64, node *Node) (ContentInforma
 	return info, nil
 }
 
+// Usage reports the accounted size and entry count of the root.
+func (s *InMemoryFiles) Usage(ctx context.Context) (Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ensureLoaded(s.root); err != nil {
+		return Usage{}, err
+	}
+
+	root := s.nodes[s.root]
+	usage := Usage{
+		Size:             root.TotalSize,
+		Entries:          root.TotalEntries,
+		MaxSize:          s.opts.MaxSize,
+		PendingUploads:   s.pendingUploads.Load(),
+		PendingPublishes: len(s.pendingSlots),
+	}
+	if reporter, ok := s.opts.Storage.(storage.StatsReporter); ok {
+		stats := reporter.Stats()
+		usage.Storage = &stats
+	}
+	if s.opts.VerifyInterval > 0 {
+		stats := s.verifier.Stats()
+		usage.Verify = &stats
+	}
+	return usage, nil
+}
+
 func (s *InMemoryFiles) Lookup(ctx context.Context, parentID uint64, name string) (ContentInformationCommon, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.evictNodes(parentID)
+
 	if err := s.ensureLoaded(parentID); err != nil {
 		return ContentInformationCommon{}, err
 	}
 
 	parentNode, ok := s.nodes[parentID]
 	if !ok || parentNode.Kind != filetree.DirectoryKind {
-		return ContentInformationCommon{}, fmt.Errorf("parent directory %d not found or invalid", parentID)
+		return ContentInformationCommon{}, fmt.Errorf("%w: parent directory %d", ErrNotFound, parentID)
 	}
 
 	childID, ok := parentNode.Children[name]
 	if !ok {
-		return ContentInformationCommon{}, fmt.Errorf("entry %q not found in directory %d", name, parentID)
+		return ContentInformationCommon{}, fmt.Errorf("%w: entry %q in directory %d", ErrNotFound, name, parentID)
 	}
 
 	childNode, ok := s.nodes[childID]
@@ -861,14 +1509,87 @@ func (s *InMemoryFiles) Lookup(ctx context.Context, parentID uint64, name string
 	return s.getInfoLocked(childNode.ID, childNode)
 }
 
+func (s *InMemoryFiles) Resolve(ctx context.Context, nodeID uint64, path string, followSymlinks bool) (ContentInformationCommon, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.evictNodes(nodeID)
+
+	if _, ok := s.nodes[nodeID]; !ok {
+		return ContentInformationCommon{}, fmt.Errorf("%w: node %d", ErrNotFound, nodeID)
+	}
+
+	// dirID is the directory containing currentID, against which relative
+	// symbolic link targets are resolved.
+	parts := strings.Split(path, "/")
+	currentID := nodeID
+	dirID := s.parentOf(nodeID)
+	hops := 0
+	for {
+		if node := s.nodes[currentID]; followSymlinks && node.Kind == filetree.SymbolicLinkKind {
+			hops++
+			if hops > MaxSymlinkHops {
+				return ContentInformationCommon{}, ErrTooManySymlinks
+			}
+			if strings.HasPrefix(node.Target, "/") {
+				currentID = s.root
+			} else {
+				currentID = dirID
+			}
+			dirID = s.parentOf(currentID)
+			parts = append(strings.Split(node.Target, "/"), parts...)
+			continue
+		}
+
+		if len(parts) == 0 {
+			break
+		}
+		part := parts[0]
+		parts = parts[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			currentID = s.parentOf(currentID)
+			dirID = s.parentOf(currentID)
+			continue
+		}
+
+		if err := s.ensureLoaded(currentID); err != nil {
+			return ContentInformationCommon{}, err
+		}
+		childID, ok := s.nodes[currentID].Children[part]
+		if !ok {
+			return ContentInformationCommon{}, fmt.Errorf("%w: entry %q in directory %d", ErrNotFound, part, currentID)
+		}
+		dirID = currentID
+		currentID = childID
+	}
+
+	return s.getInfoLocked(currentID, s.nodes[currentID])
+}
+
+// parentOf returns a parent directory of id, or id itself for the root.
+func (s *InMemoryFiles) parentOf(id uint64) uint64 {
+	for parentID := range s.nodes[id].Parents {
+		if parentID != 0 {
+			return parentID
+		}
+	}
+	return id
+}
+
 func (s *InMemoryFiles) Remove(ctx context.Context, parentID uint64, name string) error {
 	if !s.isWritable() {
-		return errors.New("file system is read-only")
+		return ErrReadOnly
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.evictNodes(parentID)
+
 	if err := s.ensureLoaded(parentID); err != nil {
 		return err
 	}
@@ -877,7 +1598,10 @@ func (s *InMemoryFiles) Remove(ctx context.Context, parentID uint64, name string
 
 	childID, ok := parentNode.Children[name]
 	if !ok {
-		return fmt.Errorf("entry %q not found", name)
+		return fmt.Errorf("%w: entry %q", ErrNotFound, name)
+	}
+	if err := s.journalLocked(walEntry{Op: "remove", Path: s.getFullPath(parentID), Name: name}); err != nil {
+		return err
 	}
 
 	delete(parentNode.Children, name)
@@ -891,12 +1615,14 @@ func (s *InMemoryFiles) Remove(ctx context.Context, parentID uint64, name string
 
 func (s *InMemoryFiles) Rename(ctx context.Context, parentID uint64, oldName string, newParentID uint64, newName string) error {
 	if !s.isWritable() {
-		return errors.New("file system is read-only")
+		return ErrReadOnly
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.evictNodes(parentID, newParentID)
+
 	if err := s.ensureLoaded(parentID); err != nil {
 		return err
 	}
@@ -909,7 +1635,10 @@ func (s *InMemoryFiles) Rename(ctx context.Context, parentID uint64, oldName str
 
 	childID, ok := parentNode.Children[oldName]
 	if !ok {
-		return fmt.Errorf("entry %q not found", oldName)
+		return fmt.Errorf("%w: entry %q", ErrNotFound, oldName)
+	}
+	if err := s.journalLocked(walEntry{Op: "rename", Path: s.getFullPath(parentID), Name: oldName, NewPath: s.getFullPath(newParentID), NewName: newName}); err != nil {
+		return err
 	}
 
 	if _, exists := newParentNode.Children[newName]; exists {
@@ -944,12 +1673,14 @@ func (s *InMemoryFiles) Rename(ctx context.Context, parentID uint64, oldName str
 
 func (s *InMemoryFiles) Link(ctx context.Context, parentID uint64, name string, targetNodeID uint64) error {
 	if !s.isWritable() {
-		return errors.New("file system is read-only")
+		return ErrReadOnly
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.evictNodes(parentID, targetNodeID)
+
 	if err := s.ensureLoaded(parentID); err != nil {
 		return err
 	}
@@ -957,7 +1688,10 @@ func (s *InMemoryFiles) Link(ctx context.Context, parentID uint64, name string,
 	parentNode := s.nodes[parentID]
 	targetNode, ok := s.nodes[targetNodeID]
 	if !ok {
-		return errors.New("target node not found")
+		return fmt.Errorf("%w: target node %d", ErrNotFound, targetNodeID)
+	}
+	if err := s.journalLocked(walEntry{Op: "link", Path: s.getFullPath(parentID), Name: name, Target: s.getFullPath(targetNodeID)}); err != nil {
+		return err
 	}
 
 	parentNode.Children[name] = targetNodeID
@@ -971,16 +1705,13 @@ func (s *InMemoryFiles) Link(ctx context.Context, parentID uint64, name string,
 }
 
 func (s *InMemoryFiles) Sync(ctx context.Context, nodeID uint64, wait bool) error {
-	s.mu.Lock()
 	if !wait {
 		go func() {
-			defer s.mu.Unlock()
-			_ = s.writeNodeLocked(nodeID)
+			_ = s.sync(nodeID)
 		}()
 		return nil
 	}
-	defer s.mu.Unlock()
-	return s.writeNodeLocked(nodeID)
+	return s.sync(nodeID)
 }
 
 func (s *InMemoryFiles) parseNodeID(nodeStr string) (uint64, error) {
@@ -1032,43 +1763,63 @@ func (s *InMemoryFiles) pollSlot() {
 		if !l.RootLink.Slot {
 			continue
 		}
-
-		address, err := s.opts.Slots.Get(context.Background(), l.RootLink.Address)
-		if err != nil {
-			continue
-		}
-
-		if address == s.lastSlotAddresses[i] || address == s.nodes[1].LayerContents[i].Address {
-			continue
+		if err := s.pullLayerLocked(i); err != nil {
+			log.Printf("Failed to poll slot %s: %v", l.RootLink.Address, err)
 		}
+	}
+}
 
-		newRootLink := l.RootLink
-		newRootLink.Address = address
-		newRootLink.Slot = false
+// pullLayerLocked merges the root the slot of layer i refers to into the local
+// tree if it has changed. s.mu must be held.
+func (s *InMemoryFiles) pullLayerLocked(i int) error {
+	l := s.opts.Layers[i]
+	address, err := s.opts.Slots.Get(context.Background(), l.RootLink.Address)
+	if err != nil {
+		return err
+	}
 
-		reader, err := content.Read(newRootLink, s.opts.Storage, s.opts.Slots)
-		if err != nil {
-			continue
+	if address == s.nodes[1].LayerContents[i].Address {
+		s.lastSlotAddresses[i] = address
+		return nil
+	}
+	if address == s.lastSlotAddresses[i] {
+		return nil
+	}
+	if i == 0 {
+		if err := s.verifyRootLocked(l.RootLink.Address, address); err != nil {
+			return err
 		}
+	}
 
-		data, err := io.ReadAll(reader)
-		if err != nil {
-			continue
-		}
+	newRootLink := l.RootLink
+	newRootLink.Address = address
+	newRootLink.Slot = false
 
-		var d filetree.Directory
-		if err := json.Unmarshal(data, &d); err != nil {
-			continue
-		}
+	reader, err := content.Read(newRootLink, s.opts.Storage, s.opts.Slots)
+	if err != nil {
+		return err
+	}
 
-		remoteEntries := make(map[string]filetree.Entry)
-		for _, entry := range d {
-			remoteEntries[entry.GetName()] = entry
-		}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
 
-		s.mergeRemoteIntoLocal(1, remoteEntries, i)
-		s.lastSlotAddresses[i] = address
+	var d filetree.Directory
+	if err := json.Unmarshal(data, &d); err != nil {
+		return err
+	}
+
+	remoteEntries := make(map[string]filetree.Entry)
+	for _, entry := range d {
+		remoteEntries[entry.GetName()] = entry
 	}
+
+	s.redirtyUnpublishedLocked()
+	s.mergeRemoteIntoLocal(1, remoteEntries, i)
+	s.lastSlotAddresses[i] = address
+	return nil
 }
 
 func (s *InMemoryFiles) mergeRemoteIntoLocal(localID uint64, remoteEntries map[string]filetree.Entry, layerIdx int) {
@@ -1092,6 +1843,9 @@ func (s *InMemoryFiles) mergeRemoteIntoLocal(localID uint64, remoteEntries map[s
 				}
 			} else if childNode.Kind == filetree.DirectoryKind {
 				if dirEntry, ok := remoteEntry.(*filetree.DirectoryEntry); ok {
+					if !childNode.IsDirty {
+						childNode.Policy = dirEntry.Policy
+					}
 					if childNode.LayerContents[layerIdx].Address != dirEntry.Content.Address {
 						childNode.LayerContents[layerIdx] = dirEntry.Content
 						if childNode.IsLoaded {
@@ -1152,6 +1906,7 @@ func (s *InMemoryFiles) mergeRemoteIntoLocal(localID uint64, remoteEntries map[s
 				childNode.Mode = e.Mode
 				childNode.Content = e.Content
 				childNode.Size = e.Size
+				childNode.Policy = e.Policy
 				childNode.Children = make(map[string]uint64)
 			case *filetree.SymbolicLinkEntry:
 				childNode.CreateTime = e.CreateTime
@@ -1167,121 +1922,6 @@ func (s *InMemoryFiles) mergeRemoteIntoLocal(localID uint64, remoteEntries map[s
 	}
 }
 
-func (s *InMemoryFiles) writeNodeLocked(id uint64) error {
-	node, ok := s.nodes[id]
-	if !ok {
-		return fmt.Errorf("node %d not found", id)
-	}
-
-	if !node.IsDirty {
-		return nil
-	}
-
-	if node.Kind == filetree.DirectoryKind {
-		for _, childID := range node.Children {
-			if err := s.writeNodeLocked(childID); err != nil {
-				return err
-			}
-		}
-
-		// Write a variant of the directory for each layer the directory belongs to.
-		for layerIdx := range node.LayerMembership {
-			var entries filetree.Directory
-			for name, childID := range node.Children {
-				child := s.nodes[childID]
-				if !child.LayerMembership[layerIdx] {
-					continue
-				}
-
-				switch child.Kind {
-				case filetree.FileKind:
-					entries = append(entries, &filetree.FileEntry{
-						BaseEntry: filetree.BaseEntry{
-							Kind:       filetree.FileKind,
-							Name:       name,
-							CreateTime: child.CreateTime,
-							ModifyTime: child.ModifyTime,
-							Mode:       child.Mode,
-						},
-						Content: child.LayerContents[layerIdx], // Use layer specific content if exists
-						Size:    child.Size,
-						Type:    child.Type,
-					})
-					// Fallback for flat files without divergence
-					if child.LayerContents[layerIdx].Address == "" && child.Content.Address != "" {
-						last := entries[len(entries)-1].(*filetree.FileEntry)
-						last.Content = child.Content
-					}
-				case filetree.DirectoryKind:
-					entries = append(entries, &filetree.DirectoryEntry{
-						BaseEntry: filetree.BaseEntry{
-							Kind:       filetree.DirectoryKind,
-							Name:       name,
-							CreateTime: child.CreateTime,
-							ModifyTime: child.ModifyTime,
-							Mode:       child.Mode,
-						},
-						Content: child.LayerContents[layerIdx],
-						Size:    child.Size, // Size is basically approximate for directories
-					})
-				case filetree.SymbolicLinkKind:
-					entries = append(entries, &filetree.SymbolicLinkEntry{
-						BaseEntry: filetree.BaseEntry{
-							Kind:       filetree.SymbolicLinkKind,
-							Name:       name,
-							CreateTime: child.CreateTime,
-							ModifyTime: child.ModifyTime,
-							Mode:       child.Mode,
-						},
-						Target: child.Target,
-					})
-				}
-			}
-
-			data, err := entries.MarshalJSON()
-			if err != nil {
-				return err
-			}
-
-			opts := s.opts.WriterOptions
-			if id == 1 {
-				opts = applyTransformsToOptions(s.opts.Layers[layerIdx].RootLink.Transforms, opts)
-			}
-
-			link, err := content.Write(bytes.NewReader(data), s.getStorageForLayer(layerIdx), opts)
-			if err != nil {
-				return err
-			}
-
-			node.LayerContents[layerIdx] = link
-			node.Content = link // Maintain legacy backward compat interface fallback
-		}
-	}
-
-	node.IsDirty = false
-	delete(s.dirtyNodes, id)
-
-	if id == 1 && s.opts.Slots != nil {
-		if syncer, ok := s.opts.Storage.(storage.SyncStorage); ok {
-			if err := syncer.Sync(context.Background()); err != nil {
-				log.Printf("Failed to sync storage before slot update: %v", err)
-			}
-		}
-
-		for layerIdx := range node.LayerMembership {
-			l := s.opts.Layers[layerIdx]
-			if l.RootLink.Slot {
-				err := s.opts.Slots.Update(context.Background(), l.RootLink.Address, node.LayerContents[layerIdx].Address, s.lastSlotAddresses[layerIdx], nil)
-				if err == nil {
-					s.lastSlotAddresses[layerIdx] = node.LayerContents[layerIdx].Address
-				}
-			}
-		}
-	}
-
-	return nil
-}
-
 func applyTransformsToOptions(transforms []content.ContentTransform, base content.WriterOptions) content.WriterOptions {
 	opts := base
 	for _, t := range transforms {
@@ -1351,7 +1991,9 @@ func (s *InMemoryFiles) handleLayerChange() {
 	s.mu.RUnlock()
 
 	if !childOk {
-		s.applyNewLayers(nil)
+		if err := s.applyNewLayers(nil); err != nil {
+			log.Printf("handleLayerChange rejected the layers: %v", err)
+		}
 		return
 	}
 
@@ -1374,10 +2016,16 @@ func (s *InMemoryFiles) handleLayerChange() {
 		return
 	}
 
-	s.applyNewLayers(layers)
+	if err := s.applyNewLayers(layers); err != nil {
+		log.Printf("handleLayerChange rejected the layers: %v", err)
+	}
 }
 
-func (s *InMemoryFiles) applyNewLayers(layers []Layer) {
+// applyNewLayers replaces the layers of the file system with layers, under
+// the layer of the root link. With a required signer the root of the first
+// layer must be signed by it, or the layers are left unchanged and
+// ErrUnsignedRoot is returned.
+func (s *InMemoryFiles) applyNewLayers(layers []Layer) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -1394,6 +2042,7 @@ func (s *InMemoryFiles) applyNewLayers(layers []Layer) {
 		newLayers = append(newLayers, Layer{})
 	}
 
+	previousDependencies := s.layerDependencies
 	s.layerDependencies = make(map[string]bool)
 
 	for i := range newLayers {
@@ -1403,12 +2052,10 @@ func (s *InMemoryFiles) applyNewLayers(layers []Layer) {
 		newLayers[i].excludesMatcher = filetree.CompileIgnore(newLayers[i].Excludes)
 	}
 
-	s.opts.Layers = newLayers
-
 	membership := make(map[int]bool)
 	contents := make(map[int]content.ContentLink)
 	newLastSlotAddresses := make(map[int]string)
-	for i, l := range s.opts.Layers {
+	for i, l := range newLayers {
 		membership[i] = true
 		contents[i] = l.RootLink
 		if l.RootLink.Slot && s.opts.Slots != nil {
@@ -1417,11 +2064,25 @@ func (s *InMemoryFiles) applyNewLayers(layers []Layer) {
 			}
 		}
 	}
+
+	// The root the first layer resolves to is served, so it must be signed
+	// before anything is replaced
+	root, slot := newLayers[0].RootLink.Address, ""
+	if newLayers[0].RootLink.Slot {
+		root, slot = newLastSlotAddresses[0], newLayers[0].RootLink.Address
+	}
+	if err := s.verifyRootLocked(slot, root); err != nil {
+		s.layerDependencies = previousDependencies
+		return err
+	}
+
+	s.opts.Layers = newLayers
 	s.lastSlotAddresses = newLastSlotAddresses
+	s.pendingSlots = make(map[int]bool)
 
 	rootNode, ok := s.nodes[1]
 	if !ok {
-		return
+		return nil
 	}
 
 	rootNode.LayerMembership = membership
@@ -1453,6 +2114,7 @@ func (s *InMemoryFiles) applyNewLayers(layers []Layer) {
 	for _, id := range toDelete {
 		delete(s.nodes, id)
 	}
+	return nil
 }
 
 func (s *InMemoryFiles) resolveLayerRulesLocked(rules []string) []string {
@@ -0,0 +1,67 @@
+package files
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// keyLocks is a set of mutexes created on demand for the keys being locked,
+// such as the entries a request evaluates preconditions on. A mutex is
+// removed once no request holds or waits for it.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// entryKey is the key locked for the entry name in the directory parentID.
+func entryKey(parentID uint64, name string) string {
+	return fmt.Sprintf("entry:%d/%s", parentID, name)
+}
+
+// nodeKey is the key locked for the content of the node nodeID.
+func nodeKey(nodeID uint64) string {
+	return fmt.Sprintf("node:%d", nodeID)
+}
+
+// lock locks keys, in sorted order so that requests locking the same keys
+// cannot deadlock, and returns the function that unlocks them.
+func (l *keyLocks) lock(keys ...string) func() {
+	keys = slices.Clone(keys)
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+
+	held := make([]*keyLock, 0, len(keys))
+	for _, key := range keys {
+		l.mu.Lock()
+		if l.locks == nil {
+			l.locks = make(map[string]*keyLock)
+		}
+		k, ok := l.locks[key]
+		if !ok {
+			k = &keyLock{}
+			l.locks[key] = k
+		}
+		k.refs++
+		l.mu.Unlock()
+
+		k.mu.Lock()
+		held = append(held, k)
+	}
+
+	return func() {
+		for i, k := range held {
+			k.mu.Unlock()
+			l.mu.Lock()
+			if k.refs--; k.refs == 0 {
+				delete(l.locks, keys[i])
+			}
+			l.mu.Unlock()
+		}
+	}
+}
@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"invariant/internal/content"
 	"invariant/internal/filetree"
+	"invariant/internal/identity"
 	"invariant/internal/slots"
 	"invariant/internal/storage"
 )
@@ -163,3 +166,327 @@ func TestFilesService_MergeRemoteIntoLocal_Nested(t *testing.T) {
 		}
 	}
 }
+
+// offlineSlots fails every call while offline is set. If release is set, an
+// update signals entered and waits for release first.
+type offlineSlots struct {
+	slots.Slots
+	offline atomic.Bool
+
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *offlineSlots) Get(ctx context.Context, id string) (string, error) {
+	if s.offline.Load() {
+		return "", errors.New("slots unreachable")
+	}
+	return s.Slots.Get(ctx, id)
+}
+
+func (s *offlineSlots) Update(ctx context.Context, id, address, previousAddress string, auth []byte) error {
+	if s.release != nil {
+		s.entered <- struct{}{}
+		<-s.release
+	}
+	if s.offline.Load() {
+		return errors.New("slots unreachable")
+	}
+	return s.Slots.Update(ctx, id, address, previousAddress, auth)
+}
+
+func TestFilesService_OfflineQueuedPublish(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	if err := memSlots.Create(ctx, "test-slot", initLink.Address, ""); err != nil {
+		t.Fatal(err)
+	}
+	rootLink := content.ContentLink{Address: "test-slot", Slot: true}
+	opts := Options{
+		Storage:          store,
+		Slots:            memSlots,
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+		Layers:           []Layer{{RootLink: rootLink}},
+	}
+
+	flaky := &offlineSlots{Slots: memSlots}
+	localOpts := opts
+	localOpts.Slots = flaky
+	local, err := NewInMemoryFiles(localOpts)
+	if err != nil {
+		t.Fatalf("failed to create local: %v", err)
+	}
+	defer local.Close()
+
+	// Writes made while the slots service is unreachable are queued
+	flaky.offline.Store(true)
+	if err := local.CreateEntry(ctx, 1, "local.txt", filetree.FileKind, "", nil, bytes.NewReader([]byte("local"))); err != nil {
+		t.Fatalf("failed to create local.txt: %v", err)
+	}
+	if err := local.Sync(ctx, 1, true); err != nil {
+		t.Fatalf("offline sync failed: %v", err)
+	}
+	if address, _ := memSlots.Get(ctx, "test-slot"); address != initLink.Address {
+		t.Fatalf("slot was updated while offline")
+	}
+	if len(local.pendingSlots) != 1 {
+		t.Fatalf("expected a queued slot update, got %v", local.pendingSlots)
+	}
+
+	// Another client publishes in the meantime
+	remote, err := NewInMemoryFiles(opts)
+	if err != nil {
+		t.Fatalf("failed to create remote: %v", err)
+	}
+	defer remote.Close()
+	if err := remote.CreateEntry(ctx, 1, "remote.txt", filetree.FileKind, "", nil, bytes.NewReader([]byte("remote"))); err != nil {
+		t.Fatalf("failed to create remote.txt: %v", err)
+	}
+	if err := remote.Sync(ctx, 1, true); err != nil {
+		t.Fatalf("failed to sync remote: %v", err)
+	}
+
+	// Once reachable, the queued update conflicts, is merged and published
+	flaky.offline.Store(false)
+	for range 2 {
+		if err := local.Sync(ctx, 1, true); err != nil {
+			t.Fatalf("sync failed: %v", err)
+		}
+	}
+	if len(local.pendingSlots) != 0 {
+		t.Errorf("expected no queued slot updates, got %v", local.pendingSlots)
+	}
+
+	address, err := memSlots.Get(ctx, "test-slot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := content.Read(content.ContentLink{Address: address}, store, nil)
+	if err != nil {
+		t.Fatalf("failed to read published root: %v", err)
+	}
+	var dir filetree.Directory
+	err = json.NewDecoder(rc).Decode(&dir)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("failed to parse published root: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, entry := range dir {
+		names[entry.GetName()] = true
+	}
+	if !names["local.txt"] || !names["remote.txt"] {
+		t.Errorf("published root has %v, want local.txt and remote.txt", names)
+	}
+
+	// The queued updates are sent without holding up the file system
+	if err := local.CreateEntry(ctx, 1, "stalled.txt", filetree.FileKind, "", nil, bytes.NewReader([]byte("stalled"))); err != nil {
+		t.Fatalf("failed to create stalled.txt: %v", err)
+	}
+	flaky.entered = make(chan struct{})
+	flaky.release = make(chan struct{})
+	synced := make(chan error, 1)
+	go func() { synced <- local.Sync(ctx, 1, true) }()
+	<-flaky.entered
+	looked := make(chan error, 1)
+	go func() {
+		_, err := local.Lookup(ctx, 1, "stalled.txt")
+		looked <- err
+	}()
+	select {
+	case err := <-looked:
+		if err != nil {
+			t.Errorf("Lookup failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Lookup waited for the slot update")
+	}
+	close(flaky.release)
+	if err := <-synced; err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if len(local.pendingSlots) != 0 {
+		t.Errorf("expected no queued slot updates, got %v", local.pendingSlots)
+	}
+}
+
+func TestFilesService_CommitLog(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	if err := memSlots.Create(ctx, "test-slot", initLink.Address, ""); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewInMemoryFiles(Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+		CommitSlot:       "test-log",
+		CommitAuthor:     "tester",
+	})
+	if err != nil {
+		t.Fatalf("failed to create files: %v", err)
+	}
+	defer fs.Close()
+
+	for i, name := range []string{"a.txt", "b.txt"} {
+		if err := fs.CreateEntry(ctx, 1, name, filetree.FileKind, "", nil, bytes.NewReader([]byte(name))); err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+		fs.SetCommitMessage("add " + name)
+		if err := fs.Sync(ctx, 1, true); err != nil {
+			t.Fatalf("sync %d failed: %v", i, err)
+		}
+	}
+
+	head, err := memSlots.Get(ctx, "test-log")
+	if err != nil {
+		t.Fatalf("commit log was not created: %v", err)
+	}
+	latest, err := filetree.ReadCommit(head, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := memSlots.Get(ctx, "test-slot")
+	if latest.Root != root || latest.Author != "tester" || latest.Message != "add b.txt" {
+		t.Errorf("latest commit = %+v, want root %s by tester", latest, root)
+	}
+	first, err := filetree.ReadCommit(latest.Parent, store)
+	if err != nil {
+		t.Fatalf("failed to read parent commit: %v", err)
+	}
+	if first.Parent != "" || first.ParentRoot != initLink.Address || first.Root != latest.ParentRoot || first.Message != "add a.txt" {
+		t.Errorf("first commit = %+v", first)
+	}
+
+	// A sync that publishes nothing records no commit
+	if err := fs.Sync(ctx, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if address, _ := memSlots.Get(ctx, "test-log"); address != head {
+		t.Errorf("commit recorded for an unchanged root")
+	}
+}
+
+func TestFilesService_SignedRoot(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+	key, err := identity.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	if err := memSlots.Create(ctx, "test-slot", initLink.Address, ""); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+		Signer:           key.ID(),
+		SignatureSlot:    "test-signature",
+	}
+
+	// An unsigned root is not served
+	if _, err := NewInMemoryFiles(opts); !errors.Is(err, ErrUnsignedRoot) {
+		t.Fatalf("NewInMemoryFiles of an unsigned root = %v, want ErrUnsignedRoot", err)
+	}
+
+	// A publisher with the key signs what it publishes
+	publisherOpts := opts
+	publisherOpts.Signer = ""
+	publisherOpts.SigningKey = key
+	publisher, err := NewInMemoryFiles(publisherOpts)
+	if err != nil {
+		t.Fatalf("failed to create publisher: %v", err)
+	}
+	defer publisher.Close()
+	if err := publisher.CreateEntry(ctx, 1, "signed.txt", filetree.FileKind, "", nil, bytes.NewReader([]byte("signed"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Sync(ctx, 1, true); err != nil {
+		t.Fatal(err)
+	}
+
+	consumer, err := NewInMemoryFiles(opts)
+	if err != nil {
+		t.Fatalf("NewInMemoryFiles of a signed root failed: %v", err)
+	}
+	defer consumer.Close()
+	if _, err := consumer.Lookup(ctx, 1, "signed.txt"); err != nil {
+		t.Errorf("signed.txt not found: %v", err)
+	}
+
+	// A slot rolled back to an earlier root along with its signature is
+	// refused once a later signature was accepted
+	firstRoot, _ := memSlots.Get(ctx, "test-slot")
+	firstSignature, _ := memSlots.Get(ctx, "test-signature")
+	if err := publisher.CreateEntry(ctx, 1, "later.txt", filetree.FileKind, "", nil, bytes.NewReader([]byte("later"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Sync(ctx, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	consumer.mu.Lock()
+	err = consumer.pullLayerLocked(0)
+	consumer.mu.Unlock()
+	if err != nil {
+		t.Fatalf("pull of a later signed root failed: %v", err)
+	}
+	laterRoot, _ := memSlots.Get(ctx, "test-slot")
+	laterSignature, _ := memSlots.Get(ctx, "test-signature")
+	if err := memSlots.Update(ctx, "test-slot", firstRoot, laterRoot, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := memSlots.Update(ctx, "test-signature", firstSignature, laterSignature, nil); err != nil {
+		t.Fatal(err)
+	}
+	consumer.mu.Lock()
+	err = consumer.pullLayerLocked(0)
+	consumer.mu.Unlock()
+	if !errors.Is(err, ErrUnsignedRoot) {
+		t.Errorf("pull of a rolled back root = %v, want ErrUnsignedRoot", err)
+	}
+	if _, err := consumer.Lookup(ctx, 1, "later.txt"); err != nil {
+		t.Errorf("later.txt removed by a rolled back root: %v", err)
+	}
+
+	// A remote root published without a signature is not merged
+	root, _ := memSlots.Get(ctx, "test-slot")
+	forged, _ := content.Write(bytes.NewReader([]byte("[]")), store, content.WriterOptions{})
+	if err := memSlots.Update(ctx, "test-slot", forged.Address, root, nil); err != nil {
+		t.Fatal(err)
+	}
+	consumer.mu.Lock()
+	err = consumer.pullLayerLocked(0)
+	consumer.mu.Unlock()
+	if !errors.Is(err, ErrUnsignedRoot) {
+		t.Errorf("pull of an unsigned root = %v, want ErrUnsignedRoot", err)
+	}
+	if _, err := consumer.Lookup(ctx, 1, "signed.txt"); err != nil {
+		t.Errorf("signed.txt removed by an unsigned root: %v", err)
+	}
+
+	// Nor are layers whose root now resolves to it applied
+	if err := consumer.applyNewLayers(nil); !errors.Is(err, ErrUnsignedRoot) {
+		t.Errorf("layers with an unsigned root = %v, want ErrUnsignedRoot", err)
+	}
+	if _, err := consumer.Lookup(ctx, 1, "signed.txt"); err != nil {
+		t.Errorf("signed.txt removed by layers with an unsigned root: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package files
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"invariant/internal/content"
+	"invariant/internal/distribute"
+	"invariant/internal/filetree"
+	"invariant/internal/storage"
+)
+
+// policyLocked returns the policy of the directory id or of its nearest
+// ancestor that has one, or nil if none do. s.mu must be held.
+func (s *InMemoryFiles) policyLocked(id uint64) *filetree.Policy {
+	for range maxPolicyDepth {
+		node, ok := s.nodes[id]
+		if !ok {
+			return nil
+		}
+		if node.Policy != nil {
+			return node.Policy
+		}
+		if id == 1 || len(node.Parents) == 0 {
+			return nil
+		}
+		id = firstParent(node)
+	}
+	return nil
+}
+
+// maxPolicyDepth bounds the ancestors searched for a policy.
+const maxPolicyDepth = 4096
+
+// writerOptionsLocked returns the options for writing a file in the
+// directory parentID, the options of the service overridden by the policy
+// inherited by the directory. s.mu must be held.
+func (s *InMemoryFiles) writerOptionsLocked(parentID uint64) (content.WriterOptions, *filetree.Policy, error) {
+	opts := s.opts.WriterOptions
+	policy := s.policyLocked(parentID)
+	if policy == nil {
+		return opts, nil, nil
+	}
+
+	switch policy.Compress {
+	case "":
+	case "none":
+		opts.CompressAlgorithm = ""
+	default:
+		opts.CompressAlgorithm = policy.Compress
+	}
+	switch policy.Encrypt {
+	case "":
+	case "none":
+		opts.EncryptAlgorithm = ""
+	default:
+		opts.EncryptAlgorithm = policy.Encrypt
+	}
+	if policy.KeyName != "" {
+		key, ok := s.opts.PolicyKeys[policy.KeyName]
+		if !ok {
+			return opts, nil, fmt.Errorf("%w: unknown policy key %q", ErrInvalidArgument, policy.KeyName)
+		}
+		opts.KeyPolicy = content.SuppliedAllKey
+		opts.SuppliedKey = key
+	}
+	return opts, policy, nil
+}
+
+// firstParent returns the parent of node, or the first of the parents of a
+// hard linked node as followed for paths, or the root if it has none.
+func firstParent(node *Node) uint64 {
+	for parentID := range node.Parents {
+		return parentID
+	}
+	return 1
+}
+
+// replicate asks the distribute service to keep the blocks of link on the
+// number of storage services requested by policy.
+func (s *InMemoryFiles) replicate(link content.ContentLink, store storage.Storage, policy *filetree.Policy) {
+	if policy == nil || policy.Replicas == 0 || s.opts.Replication == nil {
+		return
+	}
+	go func() {
+		ctx := context.Background()
+		err := content.Blocks(link, store, s.opts.Slots, func(address string) error {
+			return s.opts.Replication.SetReplication(ctx, address, distribute.ReplicationPolicy{Replicas: policy.Replicas})
+		})
+		if err != nil {
+			log.Printf("Failed to set the replication of %s: %v", link.Address, err)
+		}
+	}()
+}
@@ -0,0 +1,153 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"invariant/internal/content"
+	"invariant/internal/distribute"
+	"invariant/internal/filetree"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+type recordingReplication struct {
+	mu       sync.Mutex
+	policies map[string]int
+}
+
+func (r *recordingReplication) SetReplication(ctx context.Context, address string, policy distribute.ReplicationPolicy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.policies[address] = policy.Replicas
+	return nil
+}
+
+func (r *recordingReplication) Replication(ctx context.Context, address string) (distribute.ReplicationPolicy, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return distribute.ReplicationPolicy{Replicas: r.policies[address]}, nil
+}
+
+func hasTransform(link content.ContentLink, kind, algorithm string) bool {
+	for _, t := range link.Transforms {
+		if t.Kind == kind && t.Algorithm == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInMemoryFiles_Policy(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "test-slot", initLink.Address, "")
+
+	key := bytes.Repeat([]byte{7}, 32)
+	replication := &recordingReplication{policies: make(map[string]int)}
+	opts := Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+		PolicyKeys:       map[string][]byte{"team": key},
+		Replication:      replication,
+	}
+	fs, err := NewInMemoryFiles(opts)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer fs.Close()
+
+	ctx := context.Background()
+	fs.CreateEntry(ctx, 1, "plain.txt", filetree.FileKind, "", nil, bytes.NewReader([]byte("plain")))
+	fs.CreateEntry(ctx, 1, "secret", filetree.DirectoryKind, "", nil, nil)
+	secret, _ := fs.Lookup(ctx, 1, "secret")
+
+	policy := &filetree.Policy{Compress: "gzip", Encrypt: "aes-256-cbc", KeyName: "team", Replicas: 3}
+	attrs, err := fs.SetAttributes(ctx, secret.Node, EntryAttributes{Policy: policy})
+	if err != nil {
+		t.Fatalf("failed to set policy: %v", err)
+	}
+	if attrs.Policy == nil || *attrs.Policy != *policy {
+		t.Fatalf("expected policy %+v, got %+v", policy, attrs.Policy)
+	}
+	if _, err := fs.SetAttributes(ctx, 1, EntryAttributes{Policy: policy}); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument setting the policy of the root, got %v", err)
+	}
+	plain, _ := fs.Lookup(ctx, 1, "plain.txt")
+	if _, err := fs.SetAttributes(ctx, plain.Node, EntryAttributes{Policy: policy}); !errors.Is(err, ErrNotDirectory) {
+		t.Errorf("expected ErrNotDirectory setting the policy of a file, got %v", err)
+	}
+
+	// Files in subdirectories inherit the policy
+	fs.CreateEntry(ctx, secret.Node, "sub", filetree.DirectoryKind, "", nil, nil)
+	sub, _ := fs.Lookup(ctx, secret.Node, "sub")
+	if err := fs.CreateEntry(ctx, sub.Node, "a.txt", filetree.FileKind, "", nil, bytes.NewReader([]byte("hidden"))); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file, _ := fs.Lookup(ctx, sub.Node, "a.txt")
+	link, _ := fs.GetContent(ctx, file.Node)
+	if !hasTransform(link, "Decompress", "gzip") || !hasTransform(link, "Decipher", "aes-256-cbc") {
+		t.Errorf("expected compressed and encrypted content, got %+v", link.Transforms)
+	}
+	for _, transform := range link.Transforms {
+		if transform.Kind == "Decipher" && transform.Key != hex.EncodeToString(key) {
+			t.Errorf("expected content encrypted with the team key, got %+v", transform)
+		}
+	}
+	plainLink, _ := fs.GetContent(ctx, plain.Node)
+	if len(plainLink.Transforms) != 0 {
+		t.Errorf("expected plain content outside the directory, got %+v", plainLink.Transforms)
+	}
+	reader, _ := fs.ReadFile(ctx, file.Node, 0, 0)
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(data) != "hidden" {
+		t.Errorf("expected %q, got %q", "hidden", data)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		replicas, _ := replication.Replication(ctx, link.Address)
+		if replicas.Replicas == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 replicas of %s, got %d", link.Address, replicas.Replicas)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The policy is kept in the tree
+	if err := fs.Sync(ctx, 1, true); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	reopened, err := NewInMemoryFiles(opts)
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer reopened.Close()
+	secret, _ = reopened.Lookup(ctx, 1, "secret")
+	attrs, _ = reopened.GetAttributes(ctx, secret.Node)
+	if attrs.Policy == nil || *attrs.Policy != *policy {
+		t.Fatalf("expected policy %+v after reopening, got %+v", policy, attrs.Policy)
+	}
+
+	// An empty policy removes it
+	attrs, err = reopened.SetAttributes(ctx, secret.Node, EntryAttributes{Policy: &filetree.Policy{}})
+	if err != nil || attrs.Policy != nil {
+		t.Fatalf("expected policy to be removed, got %+v, %v", attrs.Policy, err)
+	}
+}
@@ -0,0 +1,88 @@
+package files
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"invariant/internal/filetree"
+)
+
+// parseRange parses a Range header of a single range of bytes, such as
+// "bytes=0-499", "bytes=500-" or "bytes=-500", of a file of size bytes. ok
+// is false if the header cannot be parsed or asks for several ranges, in
+// which case the whole file is served. A range starting past the end of the
+// file fails with ErrRangeNotSatisfiable.
+func parseRange(header string, size int64) (offset, length int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+	if first == "" {
+		// A suffix of the file
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n = min(n, size); n == 0 {
+			return 0, 0, false, ErrRangeNotSatisfiable
+		}
+		return size - n, n, true, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false, nil
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, false, ErrRangeNotSatisfiable
+	}
+	return start, end - start + 1, true, nil
+}
+
+// requestedRange returns the range of the file nodeID requested by the Range
+// header of r, setting the headers of its 206 Partial Content response. ok
+// is false if the whole file is to be served: there is no Range, or it no
+// longer applies as the If-Range etag does not match. An unsatisfiable
+// range fails with ErrRangeNotSatisfiable.
+func (s *Server) requestedRange(w http.ResponseWriter, r *http.Request, nodeID uint64) (offset, length int64, ok bool, err error) {
+	header := r.Header.Get("Range")
+	if header == "" {
+		return 0, 0, false, nil
+	}
+	info, err := s.files.GetInfo(r.Context(), nodeID)
+	if err != nil || filetree.EntryKind(info.Kind) != filetree.FileKind {
+		return 0, 0, false, nil
+	}
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && !etagMatches(ifRange, info.Etag) {
+		return 0, 0, false, nil
+	}
+	attrs, err := s.files.GetAttributes(r.Context(), nodeID)
+	if err != nil || attrs.Size == nil {
+		return 0, 0, false, nil
+	}
+	size := int64(*attrs.Size)
+
+	offset, length, ok, err = parseRange(header, size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return 0, 0, false, err
+	}
+	if ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+		w.Header().Set("ETag", info.Etag)
+	}
+	return offset, length, ok, nil
+}
@@ -6,21 +6,61 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 
+	"invariant/internal/cap"
 	"invariant/internal/content"
 	"invariant/internal/filetree"
+	"invariant/internal/storage"
 )
 
+// TraceHeader is the request header asking for the blocks read by a file
+// read to be traced. The trace is returned in the trailer of the same name
+// as a JSON array of storage.BlockRead.
+const TraceHeader = "X-Invariant-Trace"
+
+// DefaultMaxStagedSize is the default limit of the body of a conditional
+// write, which is received in full before its precondition is evaluated.
+const DefaultMaxStagedSize = 1 << 30
+
 // Server exposes a Files interface over HTTP
 type Server struct {
 	files Files
+
+	// locks makes evaluating the preconditions of a request and applying its
+	// change atomic with respect to the other conditional requests of the
+	// same entry or file. The bodies of conditional writes are staged before
+	// the lock is taken, so a slow client does not hold up others.
+	locks          keyLocks
+	requireIfMatch bool
+	maxStagedSize  int64
+
+	sharing       *cap.Verifier
+	shareResource string
 }
 
 // NewServer creates a new HTTP server wrapper for the Files interface
 func NewServer(files Files) *Server {
-	return &Server{files: files}
+	return &Server{files: files, maxStagedSize: DefaultMaxStagedSize}
+}
+
+// WithRequireIfMatch requires requests that modify or remove an existing entry
+// to supply an If-Match header. Requests without one are rejected with
+// 428 Precondition Required.
+func (s *Server) WithRequireIfMatch(require bool) *Server {
+	s.requireIfMatch = require
+	return s
+}
+
+// WithMaxStagedSize limits the body of a conditional write to size bytes,
+// rejecting larger ones with 413 Request Entity Too Large; zero or a negative
+// size means no limit. The body is also limited to the space left by the
+// quota of the root, if it has one.
+func (s *Server) WithMaxStagedSize(size int64) *Server {
+	s.maxStagedSize = size
+	return s
 }
 
 // Handler returns the http.Handler for the files service
@@ -33,11 +73,13 @@ func (s *Server) Handler() http.Handler {
 
 	mux.HandleFunc("PUT /{node}/{name}", s.handlePutEntry)
 	mux.HandleFunc("GET /lookup/{node}/{name}", s.handleLookup)
+	mux.HandleFunc("GET /resolve", s.handleResolve)
 
 	mux.HandleFunc("GET /file/{node}", s.handleGetFile)
 	mux.HandleFunc("POST /file/{node}", s.handlePostFile)
 
 	mux.HandleFunc("GET /directory/{node}", s.handleGetDirectory)
+	mux.HandleFunc("GET /archive/{node}", s.handleArchive)
 
 	mux.HandleFunc("GET /attributes/{node}", s.handleGetAttributes)
 	mux.HandleFunc("POST /attributes/{node}", s.handleSetAttributes)
@@ -46,6 +88,10 @@ func (s *Server) Handler() http.Handler {
 	mux.HandleFunc("GET /info/{node}", s.handleGetInfo)
 
 	mux.HandleFunc("PUT /sync", s.handleSync)
+	mux.HandleFunc("GET /status", s.handleStatus)
+
+	mux.HandleFunc("POST /share", s.handleShare)
+	mux.HandleFunc("GET /shared/{path...}", s.handleShared)
 
 	return mux
 }
@@ -54,15 +100,137 @@ func parseNodeID(nodeStr string) (uint64, error) {
 	nodeStr = strings.TrimPrefix(nodeStr, "/")
 	nodeID, err := strconv.ParseUint(nodeStr, 10, 64)
 	if err != nil {
-		return 0, fmt.Errorf("invalid node ID: %v", err)
+		return 0, fmt.Errorf("%w: invalid node ID %q", ErrInvalidArgument, nodeStr)
 	}
 	return nodeID, nil
 }
 
+// etagMatches reports whether the If-Match or If-None-Match header value
+// matches etag. Quoted and weak tags are compared by their opaque value.
+func etagMatches(header string, etag string) bool {
+	for candidate := range strings.SplitSeq(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		candidate = strings.TrimPrefix(candidate, "W/")
+		candidate = strings.Trim(candidate, `"`)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions evaluates the If-Match and If-None-Match headers against
+// the current etag of the target. It writes the error response and returns
+// false if the request must not proceed.
+func (s *Server) checkPreconditions(w http.ResponseWriter, r *http.Request, etag string, exists bool) bool {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+
+	if ifMatch == "" && ifNoneMatch == "" && exists && s.requireIfMatch {
+		writeError(w, &Error{Code: CodePreconditionRequired, Message: "If-Match header is required"})
+		return false
+	}
+	if ifMatch != "" && (!exists || !etagMatches(ifMatch, etag)) {
+		writeError(w, &Error{Code: CodePreconditionFailed, Message: "precondition failed"})
+		return false
+	}
+	if ifNoneMatch != "" && exists && etagMatches(ifNoneMatch, etag) {
+		writeError(w, &Error{Code: CodePreconditionFailed, Message: "precondition failed"})
+		return false
+	}
+	return true
+}
+
+// checkEntryPreconditions evaluates the request preconditions against the
+// entry name in the directory parentID.
+func (s *Server) checkEntryPreconditions(w http.ResponseWriter, r *http.Request, parentID uint64, name string) bool {
+	info, err := s.files.Lookup(r.Context(), parentID, name)
+	return s.checkPreconditions(w, r, info.Etag, err == nil)
+}
+
+// conditional reports whether the preconditions of r must be evaluated,
+// either because it has an If-Match or If-None-Match header or because the
+// server requires If-Match for changes to existing entries.
+func (s *Server) conditional(r *http.Request) bool {
+	return s.requireIfMatch || r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+}
+
+// requestBody returns the body of r to apply. The body of a request with a
+// precondition header is staged in a temporary file, so that it can be
+// applied after the precondition is evaluated without waiting on the client;
+// other bodies are streamed as they arrive. The returned function releases
+// the staged body.
+func (s *Server) requestBody(r *http.Request) (io.Reader, func(), *Error) {
+	if r.Body == nil || r.ContentLength == 0 {
+		return http.NoBody, func() {}, nil
+	}
+	if r.Header.Get("If-Match") == "" && r.Header.Get("If-None-Match") == "" {
+		return r.Body, func() {}, nil
+	}
+
+	limit, quota := s.maxStagedSize, false
+	if reporter, ok := s.files.(UsageReporter); ok {
+		if usage, err := reporter.Usage(r.Context()); err == nil && usage.MaxSize > 0 {
+			remaining := int64(0)
+			if usage.MaxSize > usage.Size {
+				remaining = int64(usage.MaxSize - usage.Size)
+			}
+			if limit <= 0 || remaining < limit {
+				limit, quota = remaining, true
+			}
+		}
+	}
+	tooLarge := func() *Error {
+		if quota {
+			return &Error{Code: CodeQuotaExceeded, Message: "body exceeds the remaining quota"}
+		}
+		return &Error{Code: CodeTooLarge, Message: fmt.Sprintf("body exceeds %d bytes", limit)}
+	}
+	if limit > 0 && r.ContentLength > limit {
+		return nil, nil, tooLarge()
+	}
+
+	f, err := os.CreateTemp("", "invariant-files-*")
+	if err != nil {
+		return nil, nil, newError(err, 0, "")
+	}
+	release := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	var body io.Reader = r.Body
+	if limit > 0 {
+		// One byte more than the limit tells a body at the limit from a
+		// larger one
+		body = io.LimitReader(r.Body, limit+1)
+	}
+	n, err := io.Copy(f, body)
+	if err != nil {
+		release()
+		return nil, nil, badRequest("failed to read body: %v", err)
+	}
+	if limit > 0 && n > limit {
+		release()
+		return nil, nil, tooLarge()
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		release()
+		return nil, nil, newError(err, 0, "")
+	}
+	return f, release, nil
+}
+
+// setEntryETag exposes the etag of the entry name in the directory parentID.
+func (s *Server) setEntryETag(w http.ResponseWriter, r *http.Request, parentID uint64, name string) {
+	if info, err := s.files.Lookup(r.Context(), parentID, name); err == nil {
+		w.Header().Set("ETag", info.Etag)
+	}
+}
+
 func (s *Server) handlePutEntry(w http.ResponseWriter, r *http.Request) {
 	parentID, err := parseNodeID(r.PathValue("node"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, newError(err, 0, ""))
 		return
 	}
 
@@ -79,30 +247,46 @@ func (s *Server) handlePutEntry(w http.ResponseWriter, r *http.Request) {
 	if contentParam != "" {
 		link = &content.ContentLink{}
 		if err := json.Unmarshal([]byte(contentParam), link); err != nil {
-			http.Error(w, "invalid content link", http.StatusBadRequest)
+			writeError(w, &Error{Code: CodeBadRequest, Message: "invalid content link", Node: parentID, Name: name})
 			return
 		}
 	}
 
 	target := r.URL.Query().Get("target")
 
-	err = s.files.CreateEntry(r.Context(), parentID, name, kind, target, link, r.Body)
-	if err != nil {
-		if err.Error() == "file system is read-only" {
-			http.Error(w, err.Error(), http.StatusForbidden)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	var body io.Reader = http.NoBody
+	if kind == filetree.FileKind && link == nil {
+		var release func()
+		var e *Error
+		if body, release, e = s.requestBody(r); e != nil {
+			e.Node, e.Name = parentID, name
+			writeError(w, e)
+			return
 		}
+		defer release()
+	}
+
+	if s.conditional(r) {
+		defer s.locks.lock(entryKey(parentID, name))()
+		if !s.checkEntryPreconditions(w, r, parentID, name) {
+			return
+		}
+	}
+
+	err = s.files.CreateEntry(r.Context(), parentID, name, kind, target, link, body)
+	if err != nil {
+		writeError(w, newError(err, parentID, name))
 		return
 	}
 
+	s.setEntryETag(w, r, parentID, name)
 	w.WriteHeader(http.StatusCreated)
 }
 
 func (s *Server) handleGetFile(w http.ResponseWriter, r *http.Request) {
 	nodeID, err := parseNodeID(r.PathValue("node"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, newError(err, 0, ""))
 		return
 	}
 
@@ -118,26 +302,56 @@ func (s *Server) handleGetFile(w http.ResponseWriter, r *http.Request) {
 		length, _ = strconv.ParseInt(lengthStr, 10, 64)
 	}
 
-	reader, err := s.files.ReadFile(r.Context(), nodeID, offset, length)
-	if err != nil {
-		if err.Error() == "invalid file node" {
-			http.Error(w, err.Error(), http.StatusNotFound)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	nodeID, ok := s.followSymlinks(w, r, nodeID)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	var trace *storage.Trace
+	if r.Header.Get(TraceHeader) != "" {
+		trace = &storage.Trace{}
+		ctx = storage.WithTrace(ctx, trace)
+		w.Header().Set("Trailer", TraceHeader)
+	}
+
+	// A Range header applies when the query does not select a range
+	status := http.StatusOK
+	w.Header().Set("Accept-Ranges", "bytes")
+	if offsetStr == "" && lengthStr == "" {
+		rangeOffset, rangeLength, ok, err := s.requestedRange(w, r, nodeID)
+		if err != nil {
+			writeError(w, newError(err, nodeID, ""))
+			return
+		}
+		if ok {
+			offset, length, status = rangeOffset, rangeLength, http.StatusPartialContent
 		}
+	}
+
+	reader, err := s.files.ReadFile(ctx, nodeID, offset, length)
+	if err != nil {
+		writeError(w, newError(err, nodeID, ""))
 		return
 	}
 	defer reader.Close()
+	if attrs, err := s.files.GetAttributes(ctx, nodeID); err == nil && attrs.Type != nil {
+		w.Header().Set("Content-Type", *attrs.Type)
+	}
 
-	if _, err := io.Copy(w, reader); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Once the content is being written the status can no longer change
+	w.WriteHeader(status)
+	io.Copy(w, reader)
+	if trace != nil {
+		data, _ := json.Marshal(trace.Reads())
+		w.Header().Set(TraceHeader, string(data))
 	}
 }
 
 func (s *Server) handlePostFile(w http.ResponseWriter, r *http.Request) {
 	nodeID, err := parseNodeID(r.PathValue("node"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, newError(err, 0, ""))
 		return
 	}
 
@@ -149,25 +363,43 @@ func (s *Server) handlePostFile(w http.ResponseWriter, r *http.Request) {
 
 	appendFlag := r.URL.Query().Get("append") == "true"
 
-	err = s.files.WriteFile(r.Context(), nodeID, offset, appendFlag, r.Body)
-	if err != nil {
-		if err.Error() == "file system is read-only" {
-			http.Error(w, err.Error(), http.StatusForbidden)
-		} else if err.Error() == "invalid file node" {
-			http.Error(w, err.Error(), http.StatusNotFound)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	body, release, e := s.requestBody(r)
+	if e != nil {
+		e.Node = nodeID
+		writeError(w, e)
+		return
+	}
+	defer release()
+
+	nodeID, ok := s.followSymlinks(w, r, nodeID)
+	if !ok {
+		return
+	}
+
+	if s.conditional(r) {
+		defer s.locks.lock(nodeKey(nodeID))()
+		info, err := s.files.GetInfo(r.Context(), nodeID)
+		if !s.checkPreconditions(w, r, info.Etag, err == nil) {
+			return
 		}
+	}
+
+	err = s.files.WriteFile(r.Context(), nodeID, offset, appendFlag, body)
+	if err != nil {
+		writeError(w, newError(err, nodeID, ""))
 		return
 	}
 
+	if info, err := s.files.GetInfo(r.Context(), nodeID); err == nil {
+		w.Header().Set("ETag", info.Etag)
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *Server) handleGetDirectory(w http.ResponseWriter, r *http.Request) {
 	nodeID, err := parseNodeID(r.PathValue("node"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, newError(err, 0, ""))
 		return
 	}
 
@@ -185,7 +417,7 @@ func (s *Server) handleGetDirectory(w http.ResponseWriter, r *http.Request) {
 
 	entries, err := s.files.ReadDirectory(r.Context(), nodeID, offset, length)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, newError(err, nodeID, ""))
 		return
 	}
 
@@ -208,13 +440,13 @@ func (s *Server) handleGetDirectory(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleGetAttributes(w http.ResponseWriter, r *http.Request) {
 	nodeID, err := parseNodeID(r.PathValue("node"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, newError(err, 0, ""))
 		return
 	}
 
 	attrs, err := s.files.GetAttributes(r.Context(), nodeID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, newError(err, nodeID, ""))
 		return
 	}
 
@@ -225,23 +457,19 @@ func (s *Server) handleGetAttributes(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleSetAttributes(w http.ResponseWriter, r *http.Request) {
 	nodeID, err := parseNodeID(r.PathValue("node"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, newError(err, 0, ""))
 		return
 	}
 
 	var attrs EntryAttributes
 	if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, &Error{Code: CodeBadRequest, Message: "invalid attributes: " + err.Error(), Node: nodeID})
 		return
 	}
 
 	newAttrs, err := s.files.SetAttributes(r.Context(), nodeID, attrs)
 	if err != nil {
-		if err.Error() == "file system is read-only" {
-			http.Error(w, err.Error(), http.StatusForbidden)
-		} else {
-			http.Error(w, err.Error(), http.StatusNotFound)
-		}
+		writeError(w, newError(err, nodeID, ""))
 		return
 	}
 
@@ -252,13 +480,13 @@ func (s *Server) handleSetAttributes(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleGetContent(w http.ResponseWriter, r *http.Request) {
 	nodeID, err := parseNodeID(r.PathValue("node"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, newError(err, 0, ""))
 		return
 	}
 
 	link, err := s.files.GetContent(r.Context(), nodeID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, newError(err, nodeID, ""))
 		return
 	}
 
@@ -269,13 +497,13 @@ func (s *Server) handleGetContent(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleGetInfo(w http.ResponseWriter, r *http.Request) {
 	nodeID, err := parseNodeID(r.PathValue("node"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, newError(err, 0, ""))
 		return
 	}
 
 	info, err := s.files.GetInfo(r.Context(), nodeID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, newError(err, nodeID, ""))
 		return
 	}
 
@@ -286,7 +514,7 @@ func (s *Server) handleGetInfo(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleLookup(w http.ResponseWriter, r *http.Request) {
 	parentID, err := parseNodeID(r.PathValue("node"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, newError(err, 0, ""))
 		return
 	}
 
@@ -294,7 +522,7 @@ func (s *Server) handleLookup(w http.ResponseWriter, r *http.Request) {
 
 	info, err := s.files.Lookup(r.Context(), parentID, name)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, newError(err, parentID, name))
 		return
 	}
 
@@ -302,22 +530,62 @@ func (s *Server) handleLookup(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(info)
 }
 
+func (s *Server) handleResolve(w http.ResponseWriter, r *http.Request) {
+	nodeID := uint64(1) // Default to root
+	if nodeStr := r.URL.Query().Get("node"); nodeStr != "" {
+		id, err := parseNodeID(nodeStr)
+		if err != nil {
+			writeError(w, badRequest("invalid node parameter %q", nodeStr))
+			return
+		}
+		nodeID = id
+	}
+
+	follow := r.URL.Query().Get("follow") == "true"
+	info, err := s.files.Resolve(r.Context(), nodeID, r.URL.Query().Get("path"), follow)
+	if err != nil {
+		writeError(w, newError(err, nodeID, ""))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// followSymlinks resolves nodeID to the target of a symbolic link when the
+// request asks for symbolic links to be followed. It reports false after
+// writing an error response if the link cannot be resolved.
+func (s *Server) followSymlinks(w http.ResponseWriter, r *http.Request, nodeID uint64) (uint64, bool) {
+	if r.URL.Query().Get("follow") != "true" {
+		return nodeID, true
+	}
+	info, err := s.files.Resolve(r.Context(), nodeID, "", true)
+	if err != nil {
+		writeError(w, newError(err, nodeID, ""))
+		return 0, false
+	}
+	return info.Node, true
+}
+
 func (s *Server) handleRemove(w http.ResponseWriter, r *http.Request) {
 	parentID, err := parseNodeID(r.PathValue("node"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, newError(err, 0, ""))
 		return
 	}
 
 	name := r.PathValue("name")
 
+	if s.conditional(r) {
+		defer s.locks.lock(entryKey(parentID, name))()
+		if !s.checkEntryPreconditions(w, r, parentID, name) {
+			return
+		}
+	}
+
 	err = s.files.Remove(r.Context(), parentID, name)
 	if err != nil {
-		if err.Error() == "file system is read-only" {
-			http.Error(w, err.Error(), http.StatusForbidden)
-		} else {
-			http.Error(w, err.Error(), http.StatusNotFound)
-		}
+		writeError(w, newError(err, parentID, name))
 		return
 	}
 
@@ -327,14 +595,14 @@ func (s *Server) handleRemove(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleRename(w http.ResponseWriter, r *http.Request) {
 	parentID, err := parseNodeID(r.PathValue("node"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, newError(err, 0, ""))
 		return
 	}
 
 	oldName := r.PathValue("name")
 	newName := r.URL.Query().Get("name")
 	if newName == "" {
-		http.Error(w, "name query parameter is required", http.StatusBadRequest)
+		writeError(w, &Error{Code: CodeBadRequest, Message: "name query parameter is required", Node: parentID, Name: oldName})
 		return
 	}
 
@@ -343,52 +611,52 @@ func (s *Server) handleRename(w http.ResponseWriter, r *http.Request) {
 	if newDirStr != "" {
 		id, err := parseNodeID(newDirStr)
 		if err != nil {
-			http.Error(w, "invalid directory query parameter", http.StatusBadRequest)
+			writeError(w, badRequest("invalid directory query parameter %q", newDirStr))
 			return
 		}
 		newParentID = id
 	}
 
+	if s.conditional(r) {
+		defer s.locks.lock(entryKey(parentID, oldName), entryKey(newParentID, newName))()
+		if !s.checkEntryPreconditions(w, r, parentID, oldName) {
+			return
+		}
+	}
+
 	err = s.files.Rename(r.Context(), parentID, oldName, newParentID, newName)
 	if err != nil {
-		if err.Error() == "file system is read-only" {
-			http.Error(w, err.Error(), http.StatusForbidden)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+		writeError(w, newError(err, parentID, oldName))
 		return
 	}
 
+	s.setEntryETag(w, r, newParentID, newName)
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *Server) handleLink(w http.ResponseWriter, r *http.Request) {
 	parentID, err := parseNodeID(r.PathValue("node"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, newError(err, 0, ""))
 		return
 	}
 
 	name := r.PathValue("name")
 	targetStr := r.URL.Query().Get("node")
 	if targetStr == "" {
-		http.Error(w, "node query parameter is required", http.StatusBadRequest)
+		writeError(w, &Error{Code: CodeBadRequest, Message: "node query parameter is required", Node: parentID, Name: name})
 		return
 	}
 
 	targetID, err := parseNodeID(targetStr)
 	if err != nil {
-		http.Error(w, "invalid node parameter", http.StatusBadRequest)
+		writeError(w, badRequest("invalid node parameter %q", targetStr))
 		return
 	}
 
 	err = s.files.Link(r.Context(), parentID, name, targetID)
 	if err != nil {
-		if err.Error() == "file system is read-only" {
-			http.Error(w, err.Error(), http.StatusForbidden)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+		writeError(w, newError(err, parentID, name))
 		return
 	}
 
@@ -401,7 +669,7 @@ func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) {
 	if nodeStr != "" {
 		id, err := parseNodeID(nodeStr)
 		if err != nil {
-			http.Error(w, "invalid node parameter", http.StatusBadRequest)
+			writeError(w, badRequest("invalid node parameter %q", nodeStr))
 			return
 		}
 		nodeID = id
@@ -409,11 +677,34 @@ func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) {
 
 	wait := r.URL.Query().Get("wait") != "false"
 
+	if message := r.URL.Query().Get("message"); message != "" {
+		if setter, ok := s.files.(CommitMessageSetter); ok {
+			setter.SetCommitMessage(message)
+		}
+	}
+
 	err := s.files.Sync(context.Background(), nodeID, wait)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, newError(err, nodeID, ""))
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	reporter, ok := s.files.(UsageReporter)
+	if !ok {
+		writeError(w, &Error{Code: CodeNotImplemented, Message: "the service does not account for the size of its root"})
+		return
+	}
+
+	usage, err := reporter.Usage(r.Context())
+	if err != nil {
+		writeError(w, newError(err, 0, ""))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,131 @@
+package files
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"invariant/internal/cap"
+	"invariant/internal/filetree"
+)
+
+// DefaultShareExpiry is how long a share is valid if POST /share does not
+// give an expiry.
+const DefaultShareExpiry = 24 * time.Hour
+
+// Share is a read-only link to a subtree of a root returned by POST /share.
+// The subtree is served from GET /shared/{path} to requests carrying Token in
+// the token query parameter or the capability header.
+type Share struct {
+	Path    string    `json:"path"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// WithSharing enables minting shares of the root with the capability
+// verifier, whose tokens name the root resource. The requests of the server
+// must be verified by the same verifier, such as with cap.FilesRequest.
+func (s *Server) WithSharing(verifier *cap.Verifier, resource string) *Server {
+	s.sharing = verifier
+	s.shareResource = resource
+	return s
+}
+
+func (s *Server) handleShare(w http.ResponseWriter, r *http.Request) {
+	if s.sharing == nil {
+		writeError(w, &Error{Code: CodeNotImplemented, Message: "sharing is not enabled"})
+		return
+	}
+
+	p := path.Clean("/" + r.URL.Query().Get("path"))
+	expiry := DefaultShareExpiry
+	if expiresStr := r.URL.Query().Get("expires"); expiresStr != "" {
+		d, err := time.ParseDuration(expiresStr)
+		if err != nil || d <= 0 {
+			writeError(w, badRequest("invalid expires %q", expiresStr))
+			return
+		}
+		expiry = d
+	}
+
+	// Only existing directories and files can be shared
+	if _, err := s.files.Resolve(r.Context(), 1, p, false); err != nil {
+		writeError(w, newError(err, 1, p))
+		return
+	}
+
+	expires := time.Now().Add(expiry).Truncate(time.Second)
+	token := s.sharing.Issue(
+		cap.AllowOps(cap.OpRead),
+		cap.ForResources(s.shareResource),
+		cap.UnderPath(p),
+		cap.ExpiresAt(expires),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Share{Path: p, Token: token.Encode(), Expires: expires})
+}
+
+// handleShared serves the directory or file at a path read-only. A directory
+// is listed as JSON like GET /directory/:node, or with a format is archived
+// like GET /archive/:node, and a file returns its content.
+func (s *Server) handleShared(w http.ResponseWriter, r *http.Request) {
+	if s.sharing == nil {
+		writeError(w, &Error{Code: CodeNotImplemented, Message: "sharing is not enabled"})
+		return
+	}
+
+	// The path is cleaned as it was for the verification of the token
+	p := path.Clean("/" + r.PathValue("path"))
+	info, err := s.files.Resolve(r.Context(), 1, p, false)
+	if err != nil {
+		writeError(w, newError(err, 1, p))
+		return
+	}
+
+	switch filetree.EntryKind(info.Kind) {
+	case filetree.DirectoryKind:
+		if r.URL.Query().Has("format") {
+			name := path.Base(p)
+			if name == "/" {
+				name = "shared"
+			}
+			s.serveArchive(w, r, info.Node, name)
+			return
+		}
+		entries, err := s.files.ReadDirectory(r.Context(), info.Node, 0, 0)
+		if err != nil {
+			writeError(w, newError(err, info.Node, ""))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	case filetree.FileKind:
+		w.Header().Set("Accept-Ranges", "bytes")
+		offset, length, partial, err := s.requestedRange(w, r, info.Node)
+		if err != nil {
+			writeError(w, newError(err, info.Node, ""))
+			return
+		}
+		reader, err := s.files.ReadFile(r.Context(), info.Node, offset, length)
+		if err != nil {
+			writeError(w, newError(err, info.Node, ""))
+			return
+		}
+		defer reader.Close()
+		if attrs, err := s.files.GetAttributes(r.Context(), info.Node); err == nil && attrs.Type != nil {
+			w.Header().Set("Content-Type", *attrs.Type)
+		}
+		w.Header().Set("ETag", info.Etag)
+		if partial {
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		io.Copy(w, reader)
+	default:
+		// Symbolic links are not followed as they may lead out of the share
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	}
+}
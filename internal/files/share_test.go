@@ -0,0 +1,104 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"invariant/internal/cap"
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+func TestServer_Share(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slot-id")
+
+	dirData, _ := json.Marshal(filetree.Directory{})
+	initLink, _ := content.Write(bytes.NewReader(dirData), store, content.WriterOptions{})
+	memSlots.Create(context.Background(), "test-slot", initLink.Address, "")
+
+	filesService, err := NewInMemoryFiles(Options{
+		Storage:          store,
+		Slots:            memSlots,
+		RootLink:         content.ContentLink{Address: "test-slot", Slot: true},
+		AutoSyncTimeout:  time.Hour,
+		SlotPollInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	defer filesService.Close()
+
+	ctx := context.Background()
+	filesService.CreateEntry(ctx, 1, "public", filetree.DirectoryKind, "", nil, nil)
+	filesService.CreateEntry(ctx, 1, "private.txt", filetree.FileKind, "", nil, bytes.NewReader([]byte("secret")))
+	public, _ := filesService.Lookup(ctx, 1, "public")
+	filesService.CreateEntry(ctx, public.Node, "a.txt", filetree.FileKind, "", nil, bytes.NewReader([]byte("hello")))
+
+	verifier := cap.NewVerifier(bytes.Repeat([]byte{1}, cap.KeySize))
+	server := NewServer(filesService).WithSharing(verifier, "test-slot")
+	ts := httptest.NewServer(verifier.Require(server.Handler(), cap.FilesRequest("test-slot")))
+	defer ts.Close()
+
+	// The owner mints a share of the public directory
+	owner := &http.Client{Transport: &cap.Transport{Token: verifier.Issue(cap.ForResources("test-slot"))}}
+	resp, err := owner.Post(ts.URL+"/share?path=public&expires=1h", "", nil)
+	if err != nil {
+		t.Fatalf("failed to share: %v", err)
+	}
+	var share Share
+	json.NewDecoder(resp.Body).Decode(&share)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || share.Path != "/public" || share.Token == "" {
+		t.Fatalf("unexpected share %d %+v", resp.StatusCode, share)
+	}
+	if time.Until(share.Expires) > time.Hour {
+		t.Errorf("expected expiry within an hour, got %v", share.Expires)
+	}
+
+	resp, _ = owner.Post(ts.URL+"/share?path=missing", "", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 sharing a missing path, got %d", resp.StatusCode)
+	}
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(ts.URL + path + "?token=" + url.QueryEscape(share.Token))
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := get("/shared/public/a.txt"); status != http.StatusOK || body != "hello" {
+		t.Errorf("expected shared file, got %d %q", status, body)
+	}
+	status, body := get("/shared/public")
+	var entries filetree.Directory
+	if status != http.StatusOK || json.Unmarshal([]byte(body), &entries) != nil || len(entries) != 1 {
+		t.Errorf("expected shared directory listing, got %d %q", status, body)
+	}
+	for _, path := range []string{"/shared/private.txt", "/shared/public/../private.txt", "/file/2"} {
+		if status, _ := get(path); status != http.StatusForbidden {
+			t.Errorf("GET %s: expected 403, got %d", path, status)
+		}
+	}
+
+	// The share cannot mint further shares
+	resp, _ = http.Post(ts.URL+"/share?path=public&token="+url.QueryEscape(share.Token), "", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 sharing with a share, got %d", resp.StatusCode)
+	}
+}
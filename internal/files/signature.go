@@ -0,0 +1,66 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"invariant/internal/filetree"
+	"invariant/internal/storage"
+)
+
+// ErrUnsignedRoot is returned when the root is not signed by the required
+// signer.
+var ErrUnsignedRoot = errors.New("root is not signed by the required signer")
+
+// verifyRootLocked checks that the root directory at address, held by slot,
+// is signed by the configured signer with a signature no older than the last
+// one accepted. slot is empty for a root not held by a slot. s.mu must be
+// held.
+func (s *InMemoryFiles) verifyRootLocked(slot, address string) error {
+	if s.opts.Signer == "" {
+		return nil
+	}
+	signature := s.opts.RootSignature
+	if s.opts.SignatureSlot != "" {
+		if s.opts.Slots == nil {
+			return fmt.Errorf("%w: no slots service to read signature slot %s", ErrUnsignedRoot, s.opts.SignatureSlot)
+		}
+		current, err := s.opts.Slots.Get(context.Background(), s.opts.SignatureSlot)
+		if err != nil {
+			return fmt.Errorf("%w: failed to read signature slot %s: %v", ErrUnsignedRoot, s.opts.SignatureSlot, err)
+		}
+		signature = current
+	}
+	if signature == "" {
+		return fmt.Errorf("%w: no signature of %s", ErrUnsignedRoot, address)
+	}
+	sig, err := filetree.VerifyRoot(signature, slot, address, s.opts.Signer, s.acceptedSignature, s.opts.Storage)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrUnsignedRoot, address, err)
+	}
+	s.acceptedSignature = sig.Sequence
+	return nil
+}
+
+// signRoot signs the root at address published to slot and publishes the
+// signature to the signature slot. The root is already published, so a
+// failure is only logged. s.syncMu must be held.
+func (s *InMemoryFiles) signRoot(slot, address string) {
+	sequence := filetree.NextSequence(context.Background(), s.opts.Slots, s.opts.SignatureSlot, s.opts.Storage)
+	sequence = max(sequence, s.signedSequence+1)
+	signature, err := filetree.SignRoot(slot, address, sequence, s.opts.SigningKey, s.opts.Storage)
+	if err == nil {
+		s.signedSequence = sequence
+		if syncer, ok := s.opts.Storage.(storage.SyncStorage); ok {
+			err = syncer.Sync(context.Background())
+		}
+	}
+	if err == nil && s.opts.SignatureSlot != "" {
+		err = filetree.PublishSignature(context.Background(), s.opts.Slots, s.opts.SignatureSlot, signature, nil)
+	}
+	if err != nil {
+		log.Printf("Failed to sign root %s: %v", address, err)
+	}
+}
@@ -0,0 +1,400 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+const defaultUploadConcurrency = 4
+
+// dirUpload is the variant of a directory to upload for a layer. The entries
+// of dirty sub-directories are filled in once their own uploads complete.
+type dirUpload struct {
+	entries  filetree.Directory
+	children map[*filetree.DirectoryEntry]*dirUpload
+	store    storage.Storage
+	opts     content.WriterOptions
+
+	once sync.Once
+	link content.ContentLink
+	err  error
+}
+
+type nodeSnapshot struct {
+	node     *Node
+	dirtyGen uint64
+	uploads  map[int]*dirUpload
+}
+
+// syncSnapshot is the state of the dirty nodes of a subtree at the start of a sync.
+type syncSnapshot struct {
+	nodes map[uint64]*nodeSnapshot
+}
+
+// sync uploads the dirty directories under id and commits their new content.
+// Directories are uploaded concurrently without holding s.mu, and nothing is
+// committed unless every upload succeeds. Nodes changed during the upload stay
+// dirty for the next sync.
+func (s *InMemoryFiles) sync(id uint64) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	snap := &syncSnapshot{nodes: make(map[uint64]*nodeSnapshot)}
+	s.mu.Lock()
+	_, err := s.snapshotLocked(id, snap)
+	var mark int64
+	if s.wal != nil {
+		mark = s.wal.mark()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, ns := range snap.nodes {
+		for _, up := range ns.uploads {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.uploadDir(up)
+			}()
+		}
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, ns := range snap.nodes {
+		for _, up := range ns.uploads {
+			errs = append(errs, up.err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.commitLocked(snap)
+	publish := false
+	if id == 1 && s.opts.Slots != nil && (snap.nodes[id] != nil || len(s.pendingSlots) > 0) {
+		if snap.nodes[id] != nil {
+			for layerIdx := range s.nodes[id].LayerMembership {
+				if s.opts.Layers[layerIdx].RootLink.Slot {
+					s.pendingSlots[layerIdx] = true
+				}
+			}
+		}
+		publish = true
+	}
+	s.mu.Unlock()
+
+	if publish {
+		s.publish(mark)
+	}
+	return nil
+}
+
+// slotUpdate is a queued update of the slot of a layer to its committed root.
+type slotUpdate struct {
+	layer    int
+	slot     string
+	address  string
+	previous string
+	err      error
+}
+
+// publish updates the slots of the layers whose committed root has not been
+// published. The queue is copied under s.mu and sent without it, so reads
+// and writes are not held up by unreachable services. While storage or the
+// slots service is unreachable the updates stay queued, along with the
+// journal, and are retried by the next sync. If a slot was changed elsewhere
+// the remote root is merged into the local tree, which is then published by
+// the next sync. s.syncMu must be held, so the roots are not committed again
+// meanwhile.
+func (s *InMemoryFiles) publish(mark int64) {
+	s.mu.Lock()
+	root := s.nodes[1]
+	updates := make([]*slotUpdate, 0, len(s.pendingSlots))
+	for layerIdx := range s.pendingSlots {
+		updates = append(updates, &slotUpdate{
+			layer:    layerIdx,
+			slot:     s.opts.Layers[layerIdx].RootLink.Address,
+			address:  root.LayerContents[layerIdx].Address,
+			previous: s.lastSlotAddresses[layerIdx],
+		})
+	}
+	message := s.commitMessage
+	s.mu.Unlock()
+
+	// The blocks of the new roots must reach storage before the slots refer
+	// to them
+	if syncer, ok := s.opts.Storage.(storage.SyncStorage); ok {
+		if err := syncer.Sync(context.Background()); err != nil {
+			log.Printf("Storage unreachable, queueing slot updates: %v", err)
+			return
+		}
+	}
+
+	committed := false
+	for _, u := range updates {
+		u.err = s.opts.Slots.Update(context.Background(), u.slot, u.address, u.previous, nil)
+		switch {
+		case u.err == nil:
+			if s.opts.SigningKey != nil && u.layer == 0 {
+				s.signRoot(u.slot, u.address)
+			}
+			if s.opts.CommitSlot != "" && u.layer == 0 {
+				committed = s.recordCommit(u.previous, u.address, message)
+			}
+		case errors.Is(u.err, slots.ErrConflict):
+		default:
+			log.Printf("Slots unreachable, queueing update of slot %s: %v", u.slot, u.err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if committed && s.commitMessage == message {
+		s.commitMessage = ""
+	}
+	for _, u := range updates {
+		// The layers may have been replaced while the update was sent
+		if u.layer >= len(s.opts.Layers) || s.opts.Layers[u.layer].RootLink.Address != u.slot || !s.pendingSlots[u.layer] {
+			continue
+		}
+		switch {
+		case u.err == nil:
+			s.lastSlotAddresses[u.layer] = u.address
+			delete(s.pendingSlots, u.layer)
+		case errors.Is(u.err, slots.ErrConflict):
+			log.Printf("Slot %s changed remotely, merging before publishing", u.slot)
+			if err := s.pullLayerLocked(u.layer); err != nil {
+				log.Printf("Failed to merge slot %s: %v", u.slot, err)
+			}
+		}
+	}
+
+	if len(s.pendingSlots) > 0 {
+		return
+	}
+	clear(s.unpublished)
+
+	// The journaled mutations up to the snapshot are now in the published roots
+	if s.wal != nil {
+		if err := s.wal.discard(mark); err != nil {
+			log.Printf("Failed to discard synced journal entries: %v", err)
+		}
+	}
+}
+
+// recordCommit appends a commit of the published root to the commit log,
+// reporting whether it was recorded. The root is already published, so a
+// failure is only logged.
+func (s *InMemoryFiles) recordCommit(previous, address, message string) bool {
+	commit := filetree.Commit{
+		Root:       address,
+		ParentRoot: previous,
+		Author:     s.opts.CommitAuthor,
+		Message:    message,
+		Timestamp:  time.Now().Unix(),
+	}
+	if _, err := filetree.AppendCommit(context.Background(), commit, s.opts.Storage, s.opts.Slots, s.opts.CommitSlot, nil); err != nil {
+		log.Printf("Failed to record commit of %s: %v", address, err)
+		return false
+	}
+	return true
+}
+
+// SetCommitMessage sets the message of the commit recorded by the next
+// publish of the root.
+func (s *InMemoryFiles) SetCommitMessage(message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commitMessage = message
+}
+
+// snapshotLocked records the dirty nodes under id, preparing the directory
+// entries to upload for each layer of each dirty directory. s.mu must be held.
+func (s *InMemoryFiles) snapshotLocked(id uint64, snap *syncSnapshot) (map[int]*dirUpload, error) {
+	node, ok := s.nodes[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: node %d", ErrNotFound, id)
+	}
+	if !node.IsDirty {
+		return nil, nil
+	}
+	if ns, ok := snap.nodes[id]; ok {
+		return ns.uploads, nil
+	}
+	ns := &nodeSnapshot{node: node, dirtyGen: node.dirtyGen}
+	snap.nodes[id] = ns
+
+	if node.Kind != filetree.DirectoryKind {
+		return nil, nil
+	}
+
+	childUploads := make(map[uint64]map[int]*dirUpload)
+	for _, childID := range node.Children {
+		uploads, err := s.snapshotLocked(childID, snap)
+		if err != nil {
+			return nil, err
+		}
+		childUploads[childID] = uploads
+	}
+
+	// Prepare a variant of the directory for each layer the directory belongs to.
+	ns.uploads = make(map[int]*dirUpload)
+	for layerIdx := range node.LayerMembership {
+		up := &dirUpload{
+			children: make(map[*filetree.DirectoryEntry]*dirUpload),
+			store:    s.getStorageForLayer(layerIdx),
+			opts:     s.opts.WriterOptions,
+		}
+		// Directories are always blocks so a slot can hold them
+		up.opts.InlineMax = 0
+		if id == 1 {
+			up.opts = applyTransformsToOptions(s.opts.Layers[layerIdx].RootLink.Transforms, up.opts)
+		}
+
+		for name, childID := range node.Children {
+			child := s.nodes[childID]
+			if !child.LayerMembership[layerIdx] {
+				continue
+			}
+
+			switch child.Kind {
+			case filetree.FileKind:
+				entry := &filetree.FileEntry{
+					BaseEntry: filetree.BaseEntry{
+						Kind:       filetree.FileKind,
+						Name:       name,
+						CreateTime: child.CreateTime,
+						ModifyTime: child.ModifyTime,
+						Mode:       child.Mode,
+					},
+					Content: child.LayerContents[layerIdx], // Use layer specific content if exists
+					Size:    child.Size,
+					Type:    child.Type,
+				}
+				// Fallback for flat files without divergence
+				if entry.Content.Address == "" && child.Content.Address != "" {
+					entry.Content = child.Content
+				}
+				up.entries = append(up.entries, entry)
+			case filetree.DirectoryKind:
+				entry := &filetree.DirectoryEntry{
+					BaseEntry: filetree.BaseEntry{
+						Kind:       filetree.DirectoryKind,
+						Name:       name,
+						CreateTime: child.CreateTime,
+						ModifyTime: child.ModifyTime,
+						Mode:       child.Mode,
+					},
+					Content:      child.LayerContents[layerIdx],
+					Size:         child.Size, // Size is basically approximate for directories
+					TotalSize:    child.TotalSize,
+					TotalEntries: child.TotalEntries,
+					Policy:       child.Policy,
+				}
+				if childUpload := childUploads[childID][layerIdx]; childUpload != nil {
+					up.children[entry] = childUpload
+				}
+				up.entries = append(up.entries, entry)
+			case filetree.SymbolicLinkKind:
+				up.entries = append(up.entries, &filetree.SymbolicLinkEntry{
+					BaseEntry: filetree.BaseEntry{
+						Kind:       filetree.SymbolicLinkKind,
+						Name:       name,
+						CreateTime: child.CreateTime,
+						ModifyTime: child.ModifyTime,
+						Mode:       child.Mode,
+					},
+					Target: child.Target,
+				})
+			}
+		}
+
+		ns.uploads[layerIdx] = up
+		s.pendingUploads.Add(1)
+	}
+
+	return ns.uploads, nil
+}
+
+// uploadDir uploads up once its sub-directories are uploaded, holding an
+// upload slot only while writing.
+func (s *InMemoryFiles) uploadDir(up *dirUpload) error {
+	up.once.Do(func() {
+		defer s.pendingUploads.Add(-1)
+
+		// The children are uploaded concurrently by sync; wait for them
+		for entry, child := range up.children {
+			if err := s.uploadDir(child); err != nil {
+				up.err = err
+				return
+			}
+			entry.Content = child.link
+		}
+
+		data, err := up.entries.MarshalJSON()
+		if err != nil {
+			up.err = err
+			return
+		}
+
+		s.uploadSlots <- struct{}{}
+		up.link, up.err = content.Write(bytes.NewReader(data), up.store, up.opts)
+		<-s.uploadSlots
+	})
+	return up.err
+}
+
+// commitLocked records the uploaded content of the snapshot and marks the
+// nodes that have not changed since the snapshot clean. s.mu must be held.
+func (s *InMemoryFiles) commitLocked(snap *syncSnapshot) {
+	for id, ns := range snap.nodes {
+		node, ok := s.nodes[id]
+		if !ok || node != ns.node {
+			continue
+		}
+		for layerIdx, up := range ns.uploads {
+			node.LayerContents[layerIdx] = up.link
+			node.Content = up.link // Maintain legacy backward compat interface fallback
+		}
+		if s.opts.VerifyInterval > 0 {
+			s.queueVerifyLocked(id, ns)
+		}
+		if node.dirtyGen == ns.dirtyGen {
+			node.IsDirty = false
+			delete(s.dirtyNodes, id)
+		}
+		if s.opts.Slots != nil {
+			s.unpublished[id] = true
+		}
+	}
+}
+
+// redirtyUnpublishedLocked marks the nodes committed since the roots were last
+// published dirty again, so merging a remote root keeps them as local changes
+// and the next sync uploads them on top of it. s.mu must be held.
+func (s *InMemoryFiles) redirtyUnpublishedLocked() {
+	for id := range s.unpublished {
+		if node, ok := s.nodes[id]; ok {
+			s.dirtyGen++
+			node.IsDirty = true
+			node.dirtyGen = s.dirtyGen
+			s.dirtyNodes[id] = true
+		}
+	}
+	clear(s.unpublished)
+}
@@ -0,0 +1,182 @@
+package files
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+	"invariant/internal/storage"
+)
+
+const (
+	// maxVerifyQueue bounds the synced content waiting to be verified. When
+	// it is full the oldest is dropped, favoring what was synced recently.
+	maxVerifyQueue = 1024
+	// maxMismatches is the number of recent mismatches kept for the status.
+	maxMismatches = 16
+)
+
+// VerifyStats reports the background verification of synced content.
+type VerifyStats struct {
+	// Verified counts the links read back and found to match their hash.
+	Verified uint64 `json:"verified"`
+	// Mismatched counts the links whose content did not match its hash.
+	Mismatched uint64 `json:"mismatched"`
+	// Unreadable counts the links that could not be read back.
+	Unreadable uint64 `json:"unreadable"`
+	// Pending is the number of links waiting to be verified.
+	Pending int `json:"pending"`
+	// Mismatches are the most recent mismatches, oldest first.
+	Mismatches []VerifyMismatch `json:"mismatches,omitempty"`
+}
+
+// VerifyMismatch is synced content that did not match its hash.
+type VerifyMismatch struct {
+	Path    string `json:"path"`
+	Address string `json:"address"`
+	Time    int64  `json:"time"`
+	Error   string `json:"error"`
+}
+
+// verifyItem is a link synced for the entry at path.
+type verifyItem struct {
+	path  string
+	link  content.ContentLink
+	store storage.Storage
+}
+
+// verifier re-reads the content of synced entries, checking it against the
+// hashes of their links.
+type verifier struct {
+	mu      sync.Mutex
+	pending []verifyItem
+	stats   VerifyStats
+}
+
+// add queues the link synced for path to be verified.
+func (v *verifier) add(path string, link content.ContentLink, store storage.Storage) {
+	if link.Inline != nil || link.Slot || link.Address == "" {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.pending) >= maxVerifyQueue {
+		v.pending = v.pending[1:]
+	}
+	v.pending = append(v.pending, verifyItem{path: path, link: link, store: store})
+}
+
+// Stats returns a copy of the statistics of the verifier.
+func (v *verifier) Stats() VerifyStats {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	stats := v.stats
+	stats.Pending = len(v.pending)
+	stats.Mismatches = append([]VerifyMismatch(nil), v.stats.Mismatches...)
+	return stats
+}
+
+// verifyPending verifies the queued links, logging each mismatch.
+func (v *verifier) verifyPending(ctx context.Context) {
+	v.mu.Lock()
+	items := v.pending
+	v.pending = nil
+	v.mu.Unlock()
+
+	for i, item := range items {
+		if ctx.Err() != nil {
+			// Verify the rest on the next round
+			v.mu.Lock()
+			v.pending = append(items[i:], v.pending...)
+			v.mu.Unlock()
+			return
+		}
+		err := verifyLink(item.link, item.store)
+		v.mu.Lock()
+		switch {
+		case err == nil:
+			v.stats.Verified++
+		case errors.Is(err, content.ErrHashMismatch):
+			v.stats.Mismatched++
+			v.stats.Mismatches = append(v.stats.Mismatches, VerifyMismatch{
+				Path:    item.path,
+				Address: item.link.Address,
+				Time:    time.Now().Unix(),
+				Error:   err.Error(),
+			})
+			if len(v.stats.Mismatches) > maxMismatches {
+				v.stats.Mismatches = v.stats.Mismatches[1:]
+			}
+			log.Printf("Content of %s (%s) is corrupt: %v", item.path, item.link.Address, err)
+		default:
+			v.stats.Unreadable++
+			log.Printf("Failed to verify content of %s (%s): %v", item.path, item.link.Address, err)
+		}
+		v.mu.Unlock()
+	}
+}
+
+// verifyLink reads the content of link, which fails with
+// content.ErrHashMismatch if it does not match the Expected hash of the link.
+// A link of a single untransformed block has no Expected hash, as its address
+// is the hash of its content, so the address is checked instead.
+func verifyLink(link content.ContentLink, store storage.Storage) error {
+	r, err := content.Read(link, store, nil)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var h hash.Hash
+	var w io.Writer = io.Discard
+	if link.Expected == "" && len(link.Transforms) == 0 {
+		h = sha256.New()
+		w = h
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	if h != nil {
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != link.Address {
+			return fmt.Errorf("%w: expected %s, got %s", content.ErrHashMismatch, link.Address, sum)
+		}
+	}
+	return nil
+}
+
+// verifyLoop verifies the content queued by syncs every VerifyInterval.
+func (s *InMemoryFiles) verifyLoop() {
+	ticker := time.NewTicker(s.opts.VerifyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.verifier.verifyPending(s.ctx)
+		}
+	}
+}
+
+// queueVerifyLocked queues the content of node id committed by a sync to be
+// verified: the directories uploaded for each of its layers, or the content
+// of a file. s.mu must be held.
+func (s *InMemoryFiles) queueVerifyLocked(id uint64, ns *nodeSnapshot) {
+	path := s.getFullPath(id)
+	for _, up := range ns.uploads {
+		s.verifier.add(path, up.link, up.store)
+	}
+	if ns.node.Kind == filetree.FileKind {
+		s.verifier.add(path, ns.node.Content, s.getStorageForNode(ns.node))
+	}
+}
@@ -0,0 +1,279 @@
+package files
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+)
+
+const walFileName = "journal.jsonl"
+
+// walEntry is a mutation recorded in the write-ahead journal. Nodes are
+// identified by path as node numbers are not stable across restarts.
+type walEntry struct {
+	Op      string               `json:"op"` // "create", "content", "rename", "remove", "link", or "attributes"
+	Path    string               `json:"path"`
+	Name    string               `json:"name,omitempty"`
+	Kind    filetree.EntryKind   `json:"kind,omitempty"`
+	Target  string               `json:"target,omitempty"`
+	Content *content.ContentLink `json:"content,omitempty"`
+	Size    uint64               `json:"size,omitempty"`
+	Type    string               `json:"type,omitempty"`
+	NewPath string               `json:"newPath,omitempty"`
+	NewName string               `json:"newName,omitempty"`
+	Attrs   *EntryAttributes     `json:"attrs,omitempty"`
+}
+
+// wal is an append-only journal of the mutations made since the root was
+// last synced.
+type wal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+// openWAL opens the journal in dir, returning the entries it already holds.
+func openWAL(dir string) (*wal, []walEntry, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	path := filepath.Join(dir, walFileName)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A torn final line from a crash while appending is ignored and truncated
+	var entries []walEntry
+	var size int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err != io.EOF {
+				file.Close()
+				return nil, nil, err
+			}
+			break
+		}
+		var e walEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			break
+		}
+		entries = append(entries, e)
+		size += int64(len(line))
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return &wal{path: path, file: file, size: size}, entries, nil
+}
+
+// append durably records e.
+func (w *wal) append(e walEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return errors.New("journal is closed")
+	}
+	if _, err := w.file.Write(data); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.size += int64(len(data))
+	return nil
+}
+
+// mark returns the position of the end of the journal.
+func (w *wal) mark() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// discard removes the entries before mark, which are covered by a sync,
+// keeping the entries recorded since.
+func (w *wal) discard(mark int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil || mark == 0 {
+		return nil
+	}
+
+	tmpPath := w.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, io.NewSectionReader(w.file, mark, w.size-mark)); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, w.path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	w.file.Close()
+	w.file = tmp
+	w.size -= mark
+	return nil
+}
+
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// journalLocked records e before it is applied. s.mu must be held.
+func (s *InMemoryFiles) journalLocked(e walEntry) error {
+	if s.wal == nil || s.replaying {
+		return nil
+	}
+	if err := s.wal.append(e); err != nil {
+		return fmt.Errorf("failed to journal %s: %w", e.Op, err)
+	}
+	return nil
+}
+
+// replay applies the journaled mutations that were not synced before the
+// service last stopped. Mutations that no longer apply are skipped.
+func (s *InMemoryFiles) replay(entries []walEntry) {
+	s.replaying = true
+	defer func() { s.replaying = false }()
+
+	ctx := context.Background()
+	for _, e := range entries {
+		if err := s.replayEntry(ctx, e); err != nil {
+			log.Printf("Failed to replay journaled %s of %s: %v", e.Op, e.Path, err)
+		}
+	}
+}
+
+func (s *InMemoryFiles) replayEntry(ctx context.Context, e walEntry) error {
+	id, err := s.nodeAtPath(e.Path)
+	if err != nil {
+		return err
+	}
+
+	switch e.Op {
+	case "create":
+		if err := s.CreateEntry(ctx, id, e.Name, e.Kind, e.Target, e.Content, nil); err != nil {
+			return err
+		}
+		if e.Kind != filetree.FileKind {
+			return nil
+		}
+		childID, err := s.nodeAtPath(joinPath(e.Path, e.Name))
+		if err != nil {
+			return err
+		}
+		return s.setContent(childID, *e.Content, e.Size, e.Type)
+	case "content":
+		return s.setContent(id, *e.Content, e.Size, e.Type)
+	case "rename":
+		newParentID, err := s.nodeAtPath(e.NewPath)
+		if err != nil {
+			return err
+		}
+		return s.Rename(ctx, id, e.Name, newParentID, e.NewName)
+	case "remove":
+		return s.Remove(ctx, id, e.Name)
+	case "link":
+		targetID, err := s.nodeAtPath(e.Target)
+		if err != nil {
+			return err
+		}
+		return s.Link(ctx, id, e.Name, targetID)
+	case "attributes":
+		_, err := s.SetAttributes(ctx, id, *e.Attrs)
+		return err
+	}
+	return fmt.Errorf("unknown journal operation %q", e.Op)
+}
+
+// setContent replaces the content of the file id as recorded by a journal.
+func (s *InMemoryFiles) setContent(id uint64, link content.ContentLink, size uint64, contentType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, ok := s.nodes[id]
+	if !ok || node.Kind != filetree.FileKind {
+		return fmt.Errorf("%w: node %d", ErrNotFile, id)
+	}
+	node.Content = link
+	for i := range node.LayerContents {
+		node.LayerContents[i] = link
+	}
+	node.Size = size
+	node.Type = contentType
+	s.markDirty(id)
+	return nil
+}
+
+// nodeAtPath returns the node at the slash separated path from the root.
+func (s *InMemoryFiles) nodeAtPath(path string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.root
+	for name := range strings.SplitSeq(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if err := s.ensureLoaded(id); err != nil {
+			return 0, err
+		}
+		childID, ok := s.nodes[id].Children[name]
+		if !ok {
+			return 0, fmt.Errorf("entry %q not found", path)
+		}
+		id = childID
+	}
+	return id, nil
+}
+
+func joinPath(dir, name string) string {
+	if dir == "" || dir == "/" {
+		return "/" + name
+	}
+	return dir + "/" + name
+}
@@ -0,0 +1,130 @@
+package filetree
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"invariant/internal/content"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+// An archive is a tar file holding the root link of a tree, as JSON, in
+// ArchiveRootName followed by every block of the tree under
+// ArchiveBlocksDir, named by address.
+const (
+	ArchiveRootName  = "root.json"
+	ArchiveBlocksDir = "blocks"
+)
+
+// ErrInvalidArchive is returned when reading a file that is not an archive.
+var ErrInvalidArchive = errors.New("not an archive of a tree")
+
+// WriteArchive writes an archive of the tree at the directory root to w and
+// returns the number of blocks written. A slot link is resolved to the root
+// it holds, which becomes the root of the archive.
+func WriteArchive(ctx context.Context, w io.Writer, root content.ContentLink, store storage.Storage, slotService slots.Slots) (int, error) {
+	if root.Slot {
+		if slotService == nil {
+			return 0, content.ErrSlotServiceMissing
+		}
+		address, err := slotService.Get(ctx, root.Address)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read slot %s: %w", root.Address, err)
+		}
+		root.Address = address
+		root.Slot = false
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	rootData, err := json.Marshal(root)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeArchiveEntry(tw, ArchiveRootName, rootData, now); err != nil {
+		return 0, err
+	}
+
+	written := make(map[string]bool)
+	err = WalkBlocks(ctx, root, store, slotService, func(address string) error {
+		if written[address] {
+			return nil
+		}
+		rc, ok := store.Get(ctx, address)
+		if !ok {
+			return fmt.Errorf("%w: %s", content.ErrBlockNotFound, address)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		written[address] = true
+		return writeArchiveEntry(tw, path.Join(ArchiveBlocksDir, address), data, now)
+	})
+	if err != nil {
+		return len(written), err
+	}
+	return len(written), tw.Close()
+}
+
+func writeArchiveEntry(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// ReadArchive reads an archive from r, calling fn with the address and
+// content of each block, and returns its root link. The blocks are not
+// verified against their addresses.
+func ReadArchive(r io.Reader, fn func(address string, data []byte) error) (content.ContentLink, error) {
+	var root content.ContentLink
+	var hasRoot bool
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return root, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return root, err
+		}
+		switch dir, name := path.Split(header.Name); {
+		case header.Name == ArchiveRootName:
+			if err := json.Unmarshal(data, &root); err != nil {
+				return root, fmt.Errorf("%w: invalid root: %v", ErrInvalidArchive, err)
+			}
+			hasRoot = true
+		case path.Clean(dir) == ArchiveBlocksDir:
+			if err := fn(name, data); err != nil {
+				return root, err
+			}
+		}
+	}
+	if !hasRoot {
+		return root, fmt.Errorf("%w: missing %s", ErrInvalidArchive, ArchiveRootName)
+	}
+	return root, nil
+}
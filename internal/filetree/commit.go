@@ -0,0 +1,92 @@
+package filetree
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"invariant/internal/content"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+// Commit records a revision of a tree published to a slot. Commits are
+// chained by Parent into a log whose head is held by a commit slot. Only the
+// addresses of the roots are recorded, so a commit never carries the keys of
+// the tree and is stored unencrypted.
+type Commit struct {
+	Root       string `json:"root"`                 // address of the root directory
+	ParentRoot string `json:"parentRoot,omitempty"` // address the slot held before
+	Parent     string `json:"parent,omitempty"`     // address of the previous commit
+	Author     string `json:"author,omitempty"`
+	Message    string `json:"message,omitempty"`
+	Timestamp  int64  `json:"timestamp"` // seconds since the epoch
+}
+
+// WriteCommit stores c and returns its address.
+func WriteCommit(c Commit, store storage.Storage) (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	link, err := content.Write(bytes.NewReader(data), store, content.WriterOptions{})
+	if err != nil {
+		return "", err
+	}
+	return link.Address, nil
+}
+
+// ReadCommit reads the commit at address.
+func ReadCommit(address string, store storage.Storage) (Commit, error) {
+	rc, err := content.Read(content.ContentLink{Address: address}, store, nil)
+	if err != nil {
+		return Commit{}, err
+	}
+	defer rc.Close()
+	var c Commit
+	if err := json.NewDecoder(rc).Decode(&c); err != nil {
+		return Commit{}, fmt.Errorf("failed to parse commit %s: %w", address, err)
+	}
+	return c, nil
+}
+
+// AppendCommit adds c to the log held by the slot logSlot, creating the slot
+// if it does not exist, and returns the address of the commit. The parent of
+// c is set to the head of the log, which is read again if another commit is
+// appended concurrently.
+func AppendCommit(ctx context.Context, c Commit, store storage.Storage, slotService slots.Slots, logSlot string, auth []byte) (string, error) {
+	for attempt := 1; ; attempt++ {
+		head, err := slotService.Get(ctx, logSlot)
+		if err != nil && !errors.Is(err, slots.ErrSlotNotFound) {
+			return "", fmt.Errorf("failed to read commit slot %s: %w", logSlot, err)
+		}
+		c.Parent = head
+
+		address, err := WriteCommit(c, store)
+		if err != nil {
+			return "", fmt.Errorf("failed to write commit: %w", err)
+		}
+		if syncer, ok := store.(storage.SyncStorage); ok {
+			if err := syncer.Sync(ctx); err != nil {
+				return "", fmt.Errorf("failed to write commit: %w", err)
+			}
+		}
+
+		if head == "" {
+			err = slotService.Create(ctx, logSlot, address, "")
+			if errors.Is(err, slots.ErrSlotExists) {
+				err = slots.ErrConflict
+			}
+		} else {
+			err = slotService.Update(ctx, logSlot, address, head, auth)
+		}
+		if err == nil {
+			return address, nil
+		}
+		if !errors.Is(err, slots.ErrConflict) || attempt >= slots.DefaultUpdateAttempts {
+			return "", fmt.Errorf("failed to update commit slot %s: %w", logSlot, err)
+		}
+	}
+}
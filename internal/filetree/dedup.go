@@ -0,0 +1,79 @@
+package filetree
+
+import (
+	"context"
+	"fmt"
+
+	"invariant/internal/content"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+// RootDedup is the share of the blocks of one root of a DedupReport.
+type RootDedup struct {
+	Blocks      int   `json:"blocks"` // distinct blocks of the root
+	Bytes       int64 `json:"bytes"`
+	Unique      int   `json:"unique"` // blocks no other root has
+	UniqueBytes int64 `json:"uniqueBytes"`
+	Shared      int   `json:"shared"` // blocks at least one other root has
+	SharedBytes int64 `json:"sharedBytes"`
+}
+
+// DedupReport compares the blocks of several roots.
+type DedupReport struct {
+	Roots []RootDedup `json:"roots"`
+
+	Blocks       int   `json:"blocks"` // distinct blocks of every root
+	Bytes        int64 `json:"bytes"`  // storage used by the roots together
+	SharedBlocks int   `json:"sharedBlocks"`
+	SharedBytes  int64 `json:"sharedBytes"`
+	TotalBytes   int64 `json:"totalBytes"` // storage the roots would use apart
+}
+
+// AnalyzeDedup walks the trees at roots and reports, for each root, how many
+// of its blocks and bytes it shares with the others and how many are its
+// own. A block used several times in one root is counted once. The size of
+// a block missing from store is taken as zero.
+func AnalyzeDedup(ctx context.Context, roots []content.ContentLink, store storage.Storage, slotService slots.Slots) (DedupReport, error) {
+	report := DedupReport{Roots: make([]RootDedup, len(roots))}
+	blockRoots := make(map[string][]int)
+	for i, root := range roots {
+		err := WalkBlocks(ctx, root, store, slotService, func(address string) error {
+			owners := blockRoots[address]
+			if len(owners) == 0 || owners[len(owners)-1] != i {
+				blockRoots[address] = append(owners, i)
+			}
+			return nil
+		})
+		if err != nil {
+			return DedupReport{}, fmt.Errorf("root %d: %w", i, err)
+		}
+	}
+
+	for address, owners := range blockRoots {
+		if err := ctx.Err(); err != nil {
+			return DedupReport{}, err
+		}
+		size, _ := store.Size(ctx, address)
+		report.Blocks++
+		report.Bytes += size
+		report.TotalBytes += size * int64(len(owners))
+		if len(owners) > 1 {
+			report.SharedBlocks++
+			report.SharedBytes += size
+		}
+		for _, i := range owners {
+			r := &report.Roots[i]
+			r.Blocks++
+			r.Bytes += size
+			if len(owners) > 1 {
+				r.Shared++
+				r.SharedBytes += size
+			} else {
+				r.Unique++
+				r.UniqueBytes += size
+			}
+		}
+	}
+	return report, nil
+}
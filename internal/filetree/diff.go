@@ -0,0 +1,250 @@
+package filetree
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"invariant/internal/content"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+// ErrNotDirectory is returned when a path passes through an entry that is
+// not a directory.
+var ErrNotDirectory = errors.New("not a directory")
+
+// ChangeKind is the kind of a difference between two trees.
+type ChangeKind string
+
+const (
+	Added    ChangeKind = "added"
+	Removed  ChangeKind = "removed"
+	Modified ChangeKind = "modified"
+)
+
+// Change is a difference between two trees at Path, the slash separated path
+// of the entry from the root.
+type Change struct {
+	Path string
+	Kind ChangeKind
+	Old  Entry // nil if the entry was added
+	New  Entry // nil if the entry was removed
+}
+
+// ReadDirectory reads the directory at link. A link without an address is an
+// empty directory.
+func ReadDirectory(link content.ContentLink, store storage.Storage, slotService slots.Slots) (Directory, error) {
+	if link.Address == "" {
+		return Directory{}, nil
+	}
+	rc, err := content.Read(link, store, slotService)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var dir Directory
+	if err := json.NewDecoder(rc).Decode(&dir); err != nil {
+		return nil, fmt.Errorf("failed to parse directory %s: %w", link.Address, err)
+	}
+	return dir, nil
+}
+
+// Diff returns the changes that turn the tree rooted at the directory a into
+// the tree rooted at b, ordered by path. Directories with the same content in
+// both trees are not read. A directory that is added or removed, or replaced
+// by an entry of another kind, is a single change rather than a change for
+// each entry below it.
+func Diff(ctx context.Context, a, b content.ContentLink, store storage.Storage, slotService slots.Slots) ([]Change, error) {
+	var changes []Change
+	err := diffDirectory(ctx, "", a, b, store, slotService, &changes)
+	return changes, err
+}
+
+func diffDirectory(ctx context.Context, prefix string, a, b content.ContentLink, store storage.Storage, slotService slots.Slots, changes *[]Change) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	aDir, err := ReadDirectory(a, store, slotService)
+	if err != nil {
+		return err
+	}
+	bDir, err := ReadDirectory(b, store, slotService)
+	if err != nil {
+		return err
+	}
+	aEntries := aDir.byName()
+	bEntries := bDir.byName()
+
+	var names []string
+	for name := range aEntries {
+		names = append(names, name)
+	}
+	for name := range bEntries {
+		if _, ok := aEntries[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		path := prefix + name
+		oldEntry, newEntry := aEntries[name], bEntries[name]
+		switch {
+		case oldEntry == nil:
+			*changes = append(*changes, Change{Path: path, Kind: Added, New: newEntry})
+		case newEntry == nil:
+			*changes = append(*changes, Change{Path: path, Kind: Removed, Old: oldEntry})
+		default:
+			oldDir, oldIsDir := oldEntry.(*DirectoryEntry)
+			newDir, newIsDir := newEntry.(*DirectoryEntry)
+			if oldIsDir && newIsDir {
+				if oldDir.Content.Address != newDir.Content.Address {
+					if err := diffDirectory(ctx, path+"/", oldDir.Content, newDir.Content, store, slotService, changes); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if !sameEntry(oldEntry, newEntry) {
+				*changes = append(*changes, Change{Path: path, Kind: Modified, Old: oldEntry, New: newEntry})
+			}
+		}
+	}
+	return nil
+}
+
+// sameEntry reports whether two entries that are not both directories have
+// the same kind, content and mode. A missing mode matches any mode.
+func sameEntry(a, b Entry) bool {
+	if a.GetKind() != b.GetKind() {
+		return false
+	}
+	var aMode, bMode *string
+	switch a := a.(type) {
+	case *FileEntry:
+		b := b.(*FileEntry)
+		if a.Content.Address != b.Content.Address {
+			return false
+		}
+		aMode, bMode = a.Mode, b.Mode
+	case *SymbolicLinkEntry:
+		b := b.(*SymbolicLinkEntry)
+		if a.Target != b.Target {
+			return false
+		}
+		aMode, bMode = a.Mode, b.Mode
+	}
+	return aMode == nil || bMode == nil || *aMode == *bMode
+}
+
+func (d Directory) byName() map[string]Entry {
+	entries := make(map[string]Entry, len(d))
+	for _, entry := range d {
+		entries[entry.GetName()] = entry
+	}
+	return entries
+}
+
+// Lookup returns the entry at path in the tree at root, or nil if there is
+// none.
+func Lookup(ctx context.Context, root content.ContentLink, path string, store storage.Storage, slotService slots.Slots) (Entry, error) {
+	link := root
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, name := range parts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		dir, err := ReadDirectory(link, store, slotService)
+		if err != nil {
+			return nil, err
+		}
+		entry := dir.byName()[name]
+		if entry == nil || i == len(parts)-1 {
+			return entry, nil
+		}
+		sub, ok := entry.(*DirectoryEntry)
+		if !ok {
+			return nil, nil
+		}
+		link = sub.Content
+	}
+	return nil, nil
+}
+
+// Put returns the root of a copy of the tree at root with entry placed at
+// path, replacing any entry already there, or with the entry at path removed
+// if entry is nil. The entry must be named as the last element of path.
+// Missing directories along the path are created, and each directory along
+// the path is written again with opts.
+func Put(ctx context.Context, root content.ContentLink, path string, entry Entry, store storage.Storage, slotService slots.Slots, opts content.WriterOptions) (content.ContentLink, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if slices.Contains(parts, "") {
+		return content.ContentLink{}, fmt.Errorf("invalid path %q", path)
+	}
+	link, _, err := putEntry(ctx, root, parts, entry, store, slotService, opts)
+	return link, err
+}
+
+// putEntry places entry at parts below the directory link, returning the new
+// link to the directory and its directory entry size.
+func putEntry(ctx context.Context, link content.ContentLink, parts []string, entry Entry, store storage.Storage, slotService slots.Slots, opts content.WriterOptions) (content.ContentLink, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return content.ContentLink{}, 0, err
+	}
+	dir, err := ReadDirectory(link, store, slotService)
+	if err != nil {
+		return content.ContentLink{}, 0, err
+	}
+
+	name := parts[0]
+	i := slices.IndexFunc(dir, func(e Entry) bool { return e.GetName() == name })
+	if len(parts) == 1 {
+		if i >= 0 {
+			dir = slices.Delete(dir, i, i+1)
+		}
+		if entry != nil {
+			dir = append(dir, entry)
+		}
+	} else {
+		sub := &DirectoryEntry{BaseEntry: BaseEntry{Kind: DirectoryKind, Name: name}}
+		if i >= 0 {
+			existing, ok := dir[i].(*DirectoryEntry)
+			if !ok {
+				return content.ContentLink{}, 0, fmt.Errorf("%w: %s", ErrNotDirectory, name)
+			}
+			copied := *existing
+			sub = &copied
+		}
+		subLink, size, err := putEntry(ctx, sub.Content, parts[1:], entry, store, slotService, opts)
+		if err != nil {
+			return content.ContentLink{}, 0, err
+		}
+		subDir, err := ReadDirectory(subLink, store, slotService)
+		if err != nil {
+			return content.ContentLink{}, 0, err
+		}
+		sub.Content = subLink
+		sub.Size = size
+		sub.TotalSize, sub.TotalEntries = subDir.Totals()
+		if i >= 0 {
+			dir[i] = sub
+		} else {
+			dir = append(dir, sub)
+		}
+	}
+
+	data, err := json.Marshal(dir)
+	if err != nil {
+		return content.ContentLink{}, 0, err
+	}
+	newLink, err := content.Write(bytes.NewReader(data), store, opts)
+	if err != nil {
+		return content.ContentLink{}, 0, err
+	}
+	return newLink, uint64(len(data)), nil
+}
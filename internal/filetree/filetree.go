@@ -47,8 +47,39 @@ type FileEntry struct {
 // DirectoryEntry represents a directory in the directory tree.
 type DirectoryEntry struct {
 	BaseEntry
-	Content content.ContentLink `json:"content"`
-	Size    uint64              `json:"size"`
+	Content      content.ContentLink `json:"content"`
+	Size         uint64              `json:"size"`
+	TotalSize    uint64              `json:"totalSize,omitempty"`    // cumulative size of the files in the subtree
+	TotalEntries uint64              `json:"totalEntries,omitempty"` // cumulative number of entries in the subtree
+	Policy       *Policy             `json:"policy,omitempty"`
+}
+
+// Policy is the storage policy of a directory. Files written beneath the
+// directory use the policy of their nearest ancestor that has one in place
+// of the defaults of the writer.
+type Policy struct {
+	Compress string `json:"compress,omitempty"` // "inflate", "gzip", or "none"
+	Encrypt  string `json:"encrypt,omitempty"`  // "aes-256-cbc" or "none"
+	KeyName  string `json:"keyName,omitempty"`  // name of a key supplied to the writer
+	Replicas int    `json:"replicas,omitempty"` // storage services holding each block, 0 for the default
+}
+
+// Validate checks the algorithms and replicas of the policy.
+func (p *Policy) Validate() error {
+	switch p.Compress {
+	case "", "none", "inflate", "gzip":
+	default:
+		return fmt.Errorf("invalid compression: %q", p.Compress)
+	}
+	switch p.Encrypt {
+	case "", "none", "aes-256-cbc":
+	default:
+		return fmt.Errorf("invalid encryption: %q", p.Encrypt)
+	}
+	if p.Replicas < 0 {
+		return fmt.Errorf("invalid replicas: %d", p.Replicas)
+	}
+	return nil
 }
 
 // SymbolicLinkEntry represents a symbolic link in the directory tree.
@@ -76,7 +107,10 @@ var (
 	mimeRegex  = regexp.MustCompile(`^[^/]+/[^/]+$`)
 )
 
-func isValidName(name string) bool {
+// IsValidName reports whether name may name an entry of a directory. It
+// rejects names that are empty, "." or "..", contain a "/", or are reserved
+// device names on Windows.
+func IsValidName(name string) bool {
 	if name == "" || name == "." || name == ".." {
 		return false
 	}
@@ -94,7 +128,7 @@ func isValidName(name string) bool {
 }
 
 func (b *BaseEntry) validateBase() error {
-	if !isValidName(b.Name) {
+	if !IsValidName(b.Name) {
 		return fmt.Errorf("invalid name: %q", b.Name)
 	}
 	if b.Mode != nil && !octalRegex.MatchString(*b.Mode) {
@@ -131,6 +165,9 @@ func (e *DirectoryEntry) Validate() error {
 	if e.Content.Address == "" {
 		return errors.New("directory content address is empty")
 	}
+	if e.Policy != nil {
+		return e.Policy.Validate()
+	}
 	return nil
 }
 
@@ -203,6 +240,23 @@ func (d Directory) MarshalJSON() ([]byte, error) {
 	return json.Marshal(sortedEntries)
 }
 
+// Totals returns the cumulative size of the files and the number of entries
+// in the subtree rooted at the directory, using the totals recorded in the
+// entries of nested directories.
+func (d Directory) Totals() (size uint64, entries uint64) {
+	for _, entry := range d {
+		entries++
+		switch e := entry.(type) {
+		case *FileEntry:
+			size += e.Size
+		case *DirectoryEntry:
+			size += e.TotalSize
+			entries += e.TotalEntries
+		}
+	}
+	return size, entries
+}
+
 // Validate traverses the directory and validates all entries.
 func (d Directory) Validate() error {
 	for i, entry := range d {
@@ -1,10 +1,21 @@
 package filetree
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"invariant/internal/content"
+	"invariant/internal/identity"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
 )
 
 func ptr[T any](v T) *T {
@@ -186,3 +197,395 @@ func TestDirectoryMarshalUnmarshal(t *testing.T) {
 		}
 	}
 }
+
+func TestReencrypt(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewInMemoryStorage()
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	oldOpts := content.WriterOptions{EncryptAlgorithm: "aes-256-cbc", KeyPolicy: content.SuppliedAllKey, SuppliedKey: oldKey}
+	newOpts := content.WriterOptions{EncryptAlgorithm: "aes-256-cbc", KeyPolicy: content.SuppliedAllKey, SuppliedKey: newKey}
+
+	writeDir := func(dir Directory) (content.ContentLink, uint64) {
+		data, err := json.Marshal(dir)
+		if err != nil {
+			t.Fatalf("Failed to marshal directory: %v", err)
+		}
+		link, err := content.Write(bytes.NewReader(data), store, oldOpts)
+		if err != nil {
+			t.Fatalf("Failed to write directory: %v", err)
+		}
+		return link, uint64(len(data))
+	}
+	fileLink, err := content.Write(strings.NewReader("secret"), store, oldOpts)
+	if err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	subLink, subSize := writeDir(Directory{
+		&FileEntry{BaseEntry: BaseEntry{Kind: FileKind, Name: "file.txt"}, Content: fileLink, Size: 6},
+	})
+	rootLink, _ := writeDir(Directory{
+		&DirectoryEntry{BaseEntry: BaseEntry{Kind: DirectoryKind, Name: "sub"}, Content: subLink, Size: subSize},
+		&SymbolicLinkEntry{BaseEntry: BaseEntry{Kind: SymbolicLinkKind, Name: "link"}, Target: "sub/file.txt"},
+	})
+
+	newRoot, stats, err := Reencrypt(ctx, rootLink, store, nil, newOpts)
+	if err != nil {
+		t.Fatalf("Reencrypt failed: %v", err)
+	}
+	if stats.Files != 1 || stats.Directories != 2 {
+		t.Errorf("stats = %+v, want 1 file and 2 directories", stats)
+	}
+
+	readDir := func(link content.ContentLink) Directory {
+		rc, err := content.Read(link, store, nil)
+		if err != nil {
+			t.Fatalf("Failed to read directory: %v", err)
+		}
+		defer rc.Close()
+		var dir Directory
+		if err := json.NewDecoder(rc).Decode(&dir); err != nil {
+			t.Fatalf("Failed to parse directory: %v", err)
+		}
+		return dir
+	}
+	newKeyHex := hex.EncodeToString(newKey)
+	usesNewKey := func(link content.ContentLink) bool {
+		for _, tr := range link.Transforms {
+			if tr.Kind == "Decipher" && tr.Key != newKeyHex {
+				return false
+			}
+		}
+		return len(link.Transforms) > 0
+	}
+	if !usesNewKey(newRoot) {
+		t.Errorf("root transforms %+v do not use the new key", newRoot.Transforms)
+	}
+
+	root := readDir(newRoot)
+	if len(root) != 2 {
+		t.Fatalf("root has %d entries, want 2", len(root))
+	}
+	sub := root[1].(*DirectoryEntry)
+	if !usesNewKey(sub.Content) {
+		t.Errorf("subdirectory transforms %+v do not use the new key", sub.Content.Transforms)
+	}
+	if target := root[0].(*SymbolicLinkEntry).Target; target != "sub/file.txt" {
+		t.Errorf("symbolic link target = %q", target)
+	}
+	file := readDir(sub.Content)[0].(*FileEntry)
+	if !usesNewKey(file.Content) {
+		t.Errorf("file transforms %+v do not use the new key", file.Content.Transforms)
+	}
+	rc, err := content.Read(file.Content, store, nil)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "secret" {
+		t.Errorf("file content = %q, want %q", data, "secret")
+	}
+
+	// The slot is only republished if it still holds the rotated tree
+	slotID := strings.Repeat("ab", 32)
+	slotService := slots.NewMemorySlots("slots")
+	if err := slotService.Create(ctx, slotID, "other", ""); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := RepublishSlot(ctx, slotService, slotID, rootLink.Address, newRoot.Address, nil); !errors.Is(err, slots.ErrConflict) {
+		t.Errorf("RepublishSlot of a moved slot = %v, want ErrConflict", err)
+	}
+	if err := slotService.Update(ctx, slotID, rootLink.Address, "other", nil); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if err := RepublishSlot(ctx, slotService, slotID, rootLink.Address, newRoot.Address, nil); err != nil {
+		t.Fatalf("RepublishSlot failed: %v", err)
+	}
+	if address, _ := slotService.Get(ctx, slotID); address != newRoot.Address {
+		t.Errorf("slot address = %s, want %s", address, newRoot.Address)
+	}
+}
+
+func TestDiffAndPut(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewInMemoryStorage()
+	var opts content.WriterOptions
+
+	writeFile := func(data string) *FileEntry {
+		link, err := content.Write(strings.NewReader(data), store, opts)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		return &FileEntry{BaseEntry: BaseEntry{Kind: FileKind}, Content: link, Size: uint64(len(data))}
+	}
+	put := func(root content.ContentLink, path string, entry Entry) content.ContentLink {
+		if f, ok := entry.(*FileEntry); ok {
+			f.Name = path[strings.LastIndex(path, "/")+1:]
+		}
+		link, err := Put(ctx, root, path, entry, store, nil, opts)
+		if err != nil {
+			t.Fatalf("Put(%s) failed: %v", path, err)
+		}
+		return link
+	}
+
+	base := put(content.ContentLink{}, "a.txt", writeFile("a"))
+	base = put(base, "dir/b.txt", writeFile("b"))
+	base = put(base, "dir/c.txt", writeFile("c"))
+
+	next := put(base, "a.txt", writeFile("a2"))
+	next = put(next, "dir/c.txt", nil)
+	next = put(next, "new/d.txt", writeFile("d"))
+
+	changes, err := Diff(ctx, base, next, store, nil)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	want := []struct {
+		path string
+		kind ChangeKind
+	}{
+		{"a.txt", Modified},
+		{"dir/c.txt", Removed},
+		{"new", Added},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("Diff = %+v, want %d changes", changes, len(want))
+	}
+	for i, w := range want {
+		if changes[i].Path != w.path || changes[i].Kind != w.kind {
+			t.Errorf("change %d = %s %s, want %s %s", i, changes[i].Kind, changes[i].Path, w.kind, w.path)
+		}
+	}
+
+	entry, err := Lookup(ctx, next, "new/d.txt", store, nil)
+	if err != nil || entry == nil || entry.GetName() != "d.txt" {
+		t.Errorf("Lookup(new/d.txt) = %v, %v", entry, err)
+	}
+	if entry, _ := Lookup(ctx, next, "dir/c.txt", store, nil); entry != nil {
+		t.Errorf("Lookup of a removed entry = %v, want nil", entry)
+	}
+	root, err := ReadDirectory(next, store, nil)
+	if err != nil {
+		t.Fatalf("ReadDirectory failed: %v", err)
+	}
+	if size, entries := root.Totals(); size != 4 || entries != 5 {
+		t.Errorf("Totals = %d, %d, want 4, 5", size, entries)
+	}
+
+	if changes, _ := Diff(ctx, next, next, store, nil); len(changes) != 0 {
+		t.Errorf("Diff of a tree with itself = %+v", changes)
+	}
+}
+
+func TestSignRoot(t *testing.T) {
+	store := storage.NewInMemoryStorage()
+	key, err := identity.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := identity.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := SignRoot("slot-id", "root-address", 2, key, store)
+	if err != nil {
+		t.Fatalf("SignRoot failed: %v", err)
+	}
+	if _, err := VerifyRoot(signature, "slot-id", "root-address", key.ID(), 2, store); err != nil {
+		t.Errorf("VerifyRoot failed: %v", err)
+	}
+	if _, err := VerifyRoot(signature, "slot-id", "other-address", key.ID(), 0, store); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("VerifyRoot of another root = %v, want ErrSignatureMismatch", err)
+	}
+	if _, err := VerifyRoot(signature, "other-slot", "root-address", key.ID(), 0, store); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("VerifyRoot for another slot = %v, want ErrSignatureMismatch", err)
+	}
+	if _, err := VerifyRoot(signature, "slot-id", "root-address", other.ID(), 0, store); !errors.Is(err, identity.ErrIDMismatch) {
+		t.Errorf("VerifyRoot by another signer = %v, want ErrIDMismatch", err)
+	}
+
+	// A signature older than one already accepted is a rollback
+	if _, err := VerifyRoot(signature, "slot-id", "root-address", key.ID(), 3, store); !errors.Is(err, ErrSignatureRollback) {
+		t.Errorf("VerifyRoot of an older signature = %v, want ErrSignatureRollback", err)
+	}
+
+	// The next sequence follows the signature a signature slot points at
+	ctx := context.Background()
+	memSlots := slots.NewMemorySlots("test-slots")
+	if got := NextSequence(ctx, memSlots, "signature-slot", store); got != 1 {
+		t.Errorf("NextSequence without a signature = %d, want 1", got)
+	}
+	if err := PublishSignature(ctx, memSlots, "signature-slot", signature, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := NextSequence(ctx, memSlots, "signature-slot", store); got != 3 {
+		t.Errorf("NextSequence = %d, want 3", got)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewInMemoryStorage()
+	var opts content.WriterOptions
+
+	root := content.ContentLink{}
+	for _, path := range []string{"a.txt", "dir/b.txt", "dir/c.txt"} {
+		data := "same"
+		if path == "a.txt" {
+			data = "different"
+		}
+		link, err := content.Write(strings.NewReader(data), store, opts)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		name := path[strings.LastIndex(path, "/")+1:]
+		entry := &FileEntry{BaseEntry: BaseEntry{Kind: FileKind, Name: name}, Content: link, Size: uint64(len(data))}
+		if root, err = Put(ctx, root, path, entry, store, nil, opts); err != nil {
+			t.Fatalf("Put(%s) failed: %v", path, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	count, err := WriteArchive(ctx, &buf, root, store, nil)
+	if err != nil {
+		t.Fatalf("WriteArchive failed: %v", err)
+	}
+	// Two directories and two distinct files
+	if count != 4 {
+		t.Errorf("WriteArchive wrote %d blocks, want 4", count)
+	}
+
+	copied := storage.NewInMemoryStorage()
+	archived, err := ReadArchive(&buf, func(address string, data []byte) error {
+		_, err := copied.StoreAt(ctx, address, bytes.NewReader(data))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("ReadArchive failed: %v", err)
+	}
+	if archived.Address != root.Address {
+		t.Errorf("archive root = %s, want %s", archived.Address, root.Address)
+	}
+	entry, err := Lookup(ctx, archived, "dir/c.txt", copied, nil)
+	if err != nil || entry == nil {
+		t.Fatalf("Lookup(dir/c.txt) in the copy = %v, %v", entry, err)
+	}
+
+	if _, err := ReadArchive(strings.NewReader(""), nil); !errors.Is(err, ErrInvalidArchive) {
+		t.Errorf("ReadArchive of an empty file = %v, want ErrInvalidArchive", err)
+	}
+}
+
+func TestRootValidator(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewInMemoryStorage()
+	data, _ := json.Marshal(Directory{&SymbolicLinkEntry{BaseEntry: BaseEntry{Kind: SymbolicLinkKind, Name: "a"}, Target: "b"}})
+	dirAddr, _ := store.Store(ctx, bytes.NewReader(data))
+	garbageAddr, _ := store.Store(ctx, strings.NewReader("not a directory"))
+	invalidAddr, _ := store.Store(ctx, strings.NewReader(`[{"kind":"File","name":"../x"}]`))
+	missingAddr := strings.Repeat("00", 32)
+
+	ts := httptest.NewServer(slots.NewServer(slots.NewMemorySlots("")).WithRootValidator(NewRootValidator(store, slots.RootValidationDirectory)))
+	defer ts.Close()
+	client := slots.NewClient(ts.URL, ts.Client())
+	client.Create(ctx, "root", dirAddr, "")
+
+	for _, address := range []string{garbageAddr, invalidAddr, missingAddr} {
+		if err := client.Update(ctx, "root", address, dirAddr, nil); !errors.Is(err, slots.ErrInvalidRoot) {
+			t.Errorf("Update to %s = %v, want ErrInvalidRoot", address, err)
+		}
+	}
+	if err := client.Update(ctx, "root", dirAddr, dirAddr, nil); err != nil {
+		t.Errorf("Update to a directory failed: %v", err)
+	}
+
+	// Compressed roots and roots split into a block list are read as such
+	var large Directory
+	for i := range 50 {
+		large = append(large, &SymbolicLinkEntry{BaseEntry: BaseEntry{Kind: SymbolicLinkKind, Name: fmt.Sprintf("link-%d", i)}, Target: "target"})
+	}
+	largeData, _ := json.Marshal(large)
+	compressed, err := content.Write(bytes.NewReader(largeData), store, content.WriterOptions{CompressAlgorithm: "gzip"})
+	if err != nil || len(compressed.Transforms) == 0 {
+		t.Fatalf("Write failed to compress: %+v, %v", compressed, err)
+	}
+	half := len(data) / 2
+	first, _ := store.Store(ctx, bytes.NewReader(data[:half]))
+	second, _ := store.Store(ctx, bytes.NewReader(data[half:]))
+	list, _ := json.Marshal(content.BlockList{Blocks: []content.BlockListItem{
+		{Content: content.ContentLink{Address: first}, Size: uint64(half)},
+		{Content: content.ContentLink{Address: second}, Size: uint64(len(data) - half)},
+	}})
+	listAddr, _ := store.Store(ctx, bytes.NewReader(list))
+	previous := dirAddr
+	for _, address := range []string{compressed.Address, listAddr} {
+		if err := client.Update(ctx, "root", address, previous, nil); err != nil {
+			t.Errorf("Update to %s failed: %v", address, err)
+		}
+		previous = address
+	}
+
+	// Clearing a slot is allowed
+	exists := NewRootValidator(store, slots.RootValidationExists)
+	if err := exists.ValidateRoot(ctx, "root", ""); err != nil {
+		t.Errorf("exists rejected clearing the slot: %v", err)
+	}
+	if err := exists.ValidateRoot(ctx, "root", garbageAddr); err != nil {
+		t.Errorf("exists rejected a stored block: %v", err)
+	}
+	if err := exists.ValidateRoot(ctx, "root", missingAddr); !errors.Is(err, slots.ErrInvalidRoot) {
+		t.Errorf("exists accepted a missing block: %v", err)
+	}
+}
+
+func TestAnalyzeDedup(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewInMemoryStorage()
+	var opts content.WriterOptions
+
+	snapshot := func(files map[string]string) content.ContentLink {
+		t.Helper()
+		root := content.ContentLink{}
+		for path, data := range files {
+			link, err := content.Write(strings.NewReader(data), store, opts)
+			if err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			name := path[strings.LastIndex(path, "/")+1:]
+			entry := &FileEntry{BaseEntry: BaseEntry{Kind: FileKind, Name: name}, Content: link, Size: uint64(len(data))}
+			if root, err = Put(ctx, root, path, entry, store, nil, opts); err != nil {
+				t.Fatalf("Put(%s) failed: %v", path, err)
+			}
+		}
+		return root
+	}
+	shared := "shared by both snapshots"
+	first := snapshot(map[string]string{"a.txt": shared, "dir/b.txt": "first", "dir/c.txt": "first"})
+	second := snapshot(map[string]string{"a.txt": shared, "dir/b.txt": "second"})
+
+	report, err := AnalyzeDedup(ctx, []content.ContentLink{first, second}, store, nil)
+	if err != nil {
+		t.Fatalf("AnalyzeDedup failed: %v", err)
+	}
+	// Each snapshot has two directories of its own, the shared file, and a
+	// file of its own used once or twice
+	if report.Blocks != 7 || report.SharedBlocks != 1 || report.SharedBytes != int64(len(shared)) {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if report.TotalBytes != report.Bytes+report.SharedBytes {
+		t.Errorf("TotalBytes = %d, want %d", report.TotalBytes, report.Bytes+report.SharedBytes)
+	}
+	for i, r := range report.Roots {
+		if r.Blocks != 4 || r.Shared != 1 || r.Unique != 3 || r.Bytes != r.SharedBytes+r.UniqueBytes {
+			t.Errorf("root %d: unexpected %+v", i, r)
+		}
+	}
+
+	missing := content.ContentLink{Address: strings.Repeat("00", 32)}
+	if _, err := AnalyzeDedup(ctx, []content.ContentLink{first, missing}, store, nil); err == nil {
+		t.Errorf("expected a missing root to fail")
+	}
+}
@@ -0,0 +1,101 @@
+package filetree
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"invariant/internal/content"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+// ReencryptStats counts the entries rewritten by Reencrypt.
+type ReencryptStats struct {
+	Files       int `json:"files"`
+	Directories int `json:"directories"`
+}
+
+// Reencrypt rewrites the tree rooted at the directory root with opts and
+// returns a link to the new root directory. Each file and directory is read
+// with the key embedded in its link, so the tree can be re-keyed from one
+// SuppliedAllKey to another, or moved to a different key policy, without
+// changing its contents. Symbolic links are copied as-is.
+//
+// To rotate the tree published in a slot, resolve the slot and pass the
+// address it holds, then point the slot at the result with RepublishSlot.
+func Reencrypt(ctx context.Context, root content.ContentLink, store storage.Storage, slotService slots.Slots, opts content.WriterOptions) (content.ContentLink, ReencryptStats, error) {
+	var stats ReencryptStats
+	link, _, err := reencryptDirectory(ctx, root, store, slotService, opts, &stats)
+	return link, stats, err
+}
+
+func reencryptDirectory(ctx context.Context, link content.ContentLink, store storage.Storage, slotService slots.Slots, opts content.WriterOptions, stats *ReencryptStats) (content.ContentLink, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return content.ContentLink{}, 0, err
+	}
+	dir, err := ReadDirectory(link, store, slotService)
+	if err != nil {
+		return content.ContentLink{}, 0, err
+	}
+
+	rewritten := make(Directory, 0, len(dir))
+	for _, entry := range dir {
+		switch e := entry.(type) {
+		case *FileEntry:
+			newLink, err := reencryptFile(e, store, slotService, opts)
+			if err != nil {
+				return content.ContentLink{}, 0, fmt.Errorf("failed to re-encrypt %q: %w", e.Name, err)
+			}
+			file := *e
+			file.Content = newLink
+			rewritten = append(rewritten, &file)
+			stats.Files++
+		case *DirectoryEntry:
+			newLink, size, err := reencryptDirectory(ctx, e.Content, store, slotService, opts, stats)
+			if err != nil {
+				return content.ContentLink{}, 0, fmt.Errorf("failed to re-encrypt %q: %w", e.Name, err)
+			}
+			sub := *e
+			sub.Content = newLink
+			sub.Size = size
+			rewritten = append(rewritten, &sub)
+		default:
+			rewritten = append(rewritten, entry)
+		}
+	}
+
+	data, err := json.Marshal(rewritten)
+	if err != nil {
+		return content.ContentLink{}, 0, err
+	}
+	newLink, err := content.Write(bytes.NewReader(data), store, opts)
+	if err != nil {
+		return content.ContentLink{}, 0, err
+	}
+	stats.Directories++
+	return newLink, uint64(len(data)), nil
+}
+
+func reencryptFile(e *FileEntry, store storage.Storage, slotService slots.Slots, opts content.WriterOptions) (content.ContentLink, error) {
+	rc, err := content.Read(e.Content, store, slotService)
+	if err != nil {
+		return content.ContentLink{}, err
+	}
+	defer rc.Close()
+	opts.Filename = e.Name
+	opts.ContentType = e.Type
+	return content.Write(rc, store, opts)
+}
+
+// RepublishSlot points the slot id at newAddress, provided it still holds
+// oldAddress, the address the re-encrypted tree was read from. If the slot
+// was updated in the meantime slots.ErrConflict is returned and the rotation
+// should be repeated from the new address so no update is lost.
+func RepublishSlot(ctx context.Context, slotService slots.Slots, id, oldAddress, newAddress string, auth []byte) error {
+	if err := slotService.Update(ctx, id, newAddress, oldAddress, auth); err != nil {
+		return fmt.Errorf("failed to republish slot %s: %w", id, err)
+	}
+	return nil
+}
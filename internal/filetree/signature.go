@@ -0,0 +1,161 @@
+package filetree
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"invariant/internal/content"
+	"invariant/internal/identity"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+// ErrSignatureMismatch is returned when a signature is for a different root
+// or slot.
+var ErrSignatureMismatch = errors.New("signature is for a different root")
+
+// ErrSignatureRollback is returned when a signature is older than one the
+// verifier already accepted, as when a slot is pointed back at a previous
+// root along with its signature.
+var ErrSignatureRollback = errors.New("signature is older than one already accepted")
+
+// signatureContext prefixes the signed data so a root signature cannot be
+// replayed as any other kind of signature by the same key.
+const signatureContext = "invariant-root-signature-v2:"
+
+// RootSignature is a detached signature of the address of a root directory
+// by an identity key. As it is stored like any other block, a consumer can
+// check that a root fetched from untrusted storage nodes is the root the
+// publisher signed.
+//
+// The signature binds the slot holding the root, so it cannot be presented
+// for another slot, and a sequence number the publisher increases with each
+// root it signs, so a verifier can refuse a signature older than the last
+// one it accepted.
+type RootSignature struct {
+	Slot      string `json:"slot,omitempty"` // empty for a root not held by a slot
+	Root      string `json:"root"`
+	Sequence  uint64 `json:"sequence"`
+	PublicKey string `json:"publicKey"` // hex encoded Ed25519 public key
+	Signature string `json:"signature"` // hex encoded
+	Timestamp int64  `json:"timestamp"` // seconds since the epoch
+}
+
+func rootSignatureData(slot, root string, sequence uint64, timestamp int64) []byte {
+	return []byte(signatureContext + slot + ":" + root + ":" +
+		strconv.FormatUint(sequence, 10) + ":" + strconv.FormatInt(timestamp, 10))
+}
+
+// SignRoot stores a signature by key of the root directory at address root,
+// held by slot, as the sequence-th root signed for it and returns the address
+// of the signature.
+func SignRoot(slot, root string, sequence uint64, key *identity.KeyPair, store storage.Storage) (string, error) {
+	timestamp := time.Now().Unix()
+	sig := RootSignature{
+		Slot:      slot,
+		Root:      root,
+		Sequence:  sequence,
+		PublicKey: hex.EncodeToString(key.PublicKey()),
+		Signature: hex.EncodeToString(key.Sign(rootSignatureData(slot, root, sequence, timestamp))),
+		Timestamp: timestamp,
+	}
+	data, err := json.Marshal(sig)
+	if err != nil {
+		return "", err
+	}
+	link, err := content.Write(bytes.NewReader(data), store, content.WriterOptions{})
+	if err != nil {
+		return "", err
+	}
+	return link.Address, nil
+}
+
+// VerifyRoot checks that the signature at address signature signs root, held
+// by slot, with the key of the identity signer, and that its sequence is not
+// below minSequence, the sequence of the last signature the caller accepted.
+func VerifyRoot(signature, slot, root, signer string, minSequence uint64, store storage.Storage) (RootSignature, error) {
+	sig, err := readRootSignature(signature, store)
+	if err != nil {
+		return sig, err
+	}
+	if sig.Root != root || sig.Slot != slot {
+		return sig, ErrSignatureMismatch
+	}
+	public, err := hex.DecodeString(sig.PublicKey)
+	if err != nil {
+		return sig, identity.ErrInvalidSignature
+	}
+	signed, err := hex.DecodeString(sig.Signature)
+	if err != nil {
+		return sig, identity.ErrInvalidSignature
+	}
+	if err := identity.Verify(signer, ed25519.PublicKey(public), rootSignatureData(sig.Slot, sig.Root, sig.Sequence, sig.Timestamp), signed); err != nil {
+		return sig, err
+	}
+	if sig.Sequence < minSequence {
+		return sig, fmt.Errorf("%w: sequence %d, last accepted %d", ErrSignatureRollback, sig.Sequence, minSequence)
+	}
+	return sig, nil
+}
+
+// NextSequence returns the sequence to sign the next root with: one more
+// than the sequence of the signature the slot signatureSlot points at, or 1
+// if it holds none that can be read.
+func NextSequence(ctx context.Context, slotService slots.Slots, signatureSlot string, store storage.Storage) uint64 {
+	if slotService == nil || signatureSlot == "" {
+		return 1
+	}
+	current, err := slotService.Get(ctx, signatureSlot)
+	if err != nil || current == "" {
+		return 1
+	}
+	sig, err := readRootSignature(current, store)
+	if err != nil {
+		return 1
+	}
+	return sig.Sequence + 1
+}
+
+func readRootSignature(signature string, store storage.Storage) (RootSignature, error) {
+	rc, err := content.Read(content.ContentLink{Address: signature}, store, nil)
+	if err != nil {
+		return RootSignature{}, fmt.Errorf("failed to read signature %s: %w", signature, err)
+	}
+	defer rc.Close()
+	var sig RootSignature
+	if err := json.NewDecoder(rc).Decode(&sig); err != nil {
+		return RootSignature{}, fmt.Errorf("failed to parse signature %s: %w", signature, err)
+	}
+	return sig, nil
+}
+
+// PublishSignature points the slot id at the signature at address, creating
+// the slot if it does not exist, so consumers of a root slot can find the
+// signature of its current root.
+func PublishSignature(ctx context.Context, slotService slots.Slots, id, address string, auth []byte) error {
+	for attempt := 1; ; attempt++ {
+		current, err := slotService.Get(ctx, id)
+		switch {
+		case errors.Is(err, slots.ErrSlotNotFound):
+			err = slotService.Create(ctx, id, address, "")
+			if errors.Is(err, slots.ErrSlotExists) {
+				err = slots.ErrConflict
+			}
+		case err == nil:
+			err = slotService.Update(ctx, id, address, current, auth)
+		}
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, slots.ErrConflict) || attempt >= slots.DefaultUpdateAttempts {
+			return fmt.Errorf("failed to publish signature to slot %s: %w", id, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package filetree
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"invariant/internal/content"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+// RootValidator is a slots.RootValidator checking that the addresses of slot
+// updates are blocks in storage and, for slots.RootValidationDirectory, that
+// they hold a valid directory. A slot only holds the address of its root, so
+// the transforms of the root are inferred from its block: a compressed root,
+// a root split into a block list, or both, are read as such. An encrypted
+// root cannot be read without its key and is rejected. An empty address,
+// which clears a slot, is accepted by every mode.
+type RootValidator struct {
+	store storage.Storage
+	mode  slots.RootValidation
+}
+
+var _ slots.RootValidator = (*RootValidator)(nil)
+
+// NewRootValidator creates a RootValidator reading blocks from store.
+func NewRootValidator(store storage.Storage, mode slots.RootValidation) *RootValidator {
+	return &RootValidator{store: store, mode: mode}
+}
+
+// ValidateRoot checks address according to the mode of the validator.
+func (v *RootValidator) ValidateRoot(ctx context.Context, id, address string) error {
+	if address == "" || v.mode == slots.RootValidationNone {
+		return nil
+	}
+	if !v.store.Has(ctx, address) {
+		return fmt.Errorf("%w: block %s not found", slots.ErrInvalidRoot, address)
+	}
+	if v.mode != slots.RootValidationDirectory {
+		return nil
+	}
+	link, err := v.rootLink(ctx, address)
+	if err != nil {
+		return fmt.Errorf("%w: %v", slots.ErrInvalidRoot, err)
+	}
+	dir, err := ReadDirectory(link, v.store, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", slots.ErrInvalidRoot, err)
+	}
+	if err := dir.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", slots.ErrInvalidRoot, err)
+	}
+	return nil
+}
+
+// rootLink returns the link to the directory at address with the transforms
+// its block needs: Decompress if it is compressed, then Blocks if it holds a
+// block list.
+func (v *RootValidator) rootLink(ctx context.Context, address string) (content.ContentLink, error) {
+	link := content.ContentLink{Address: address}
+	rc, ok := v.store.Get(ctx, address)
+	if !ok {
+		return link, fmt.Errorf("block %s not found", address)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return link, err
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || (trimmed[0] != '[' && trimmed[0] != '{') {
+		if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+			if zr, err := gzip.NewReader(bytes.NewReader(data)); err == nil {
+				if inflated, err := io.ReadAll(zr); err == nil {
+					link.Transforms = append(link.Transforms, content.ContentTransform{Kind: "Decompress", Algorithm: "gzip"})
+					data = inflated
+				}
+			}
+		} else if inflated, err := io.ReadAll(flate.NewReader(bytes.NewReader(data))); err == nil {
+			link.Transforms = append(link.Transforms, content.ContentTransform{Kind: "Decompress", Algorithm: "inflate"})
+			data = inflated
+		}
+	}
+
+	var list content.BlockList
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &list); err == nil && len(list.Blocks) > 0 {
+			link.Transforms = append(link.Transforms, content.ContentTransform{Kind: "Blocks"})
+		}
+	}
+	return link, nil
+}
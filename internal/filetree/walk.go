@@ -0,0 +1,41 @@
+package filetree
+
+import (
+	"context"
+	"fmt"
+
+	"invariant/internal/content"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+// WalkBlocks calls fn with the address of every block of the tree rooted at
+// the directory root: the blocks of each directory, before its entries are
+// read, and the blocks of each file. As with content.Blocks, fn can make a
+// block available in store before it is read. A block shared by several
+// entries is visited for each of them.
+func WalkBlocks(ctx context.Context, root content.ContentLink, store storage.Storage, slotService slots.Slots, fn func(address string) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := content.Blocks(root, store, slotService, fn); err != nil {
+		return err
+	}
+	dir, err := ReadDirectory(root, store, slotService)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dir {
+		switch e := entry.(type) {
+		case *FileEntry:
+			if err := content.Blocks(e.Content, store, slotService, fn); err != nil {
+				return fmt.Errorf("%s: %w", e.Name, err)
+			}
+		case *DirectoryEntry:
+			if err := WalkBlocks(ctx, e.Content, store, slotService, fn); err != nil {
+				return fmt.Errorf("%s: %w", e.Name, err)
+			}
+		}
+	}
+	return nil
+}
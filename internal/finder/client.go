@@ -5,14 +5,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"invariant/internal/httputil"
+	"invariant/internal/identity"
 	"invariant/internal/notify"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 // Client implements the Finder interface by forwarding requests to a remote HTTP server.
 type Client struct {
 	baseURL    string
 	httpClient *http.Client
+	signingKey *identity.KeyPair
 }
 
 // NewClient creates a new HTTP finder client.
@@ -27,6 +31,14 @@ func NewClient(baseURL string, httpClient *http.Client) *Client {
 	}
 }
 
+// WithSigningKey signs the notifications sent by the client with key. The
+// notifications of services other than the one identified by key are
+// relayed by it, as a finder does pushing blocks to a closer finder.
+func (c *Client) WithSigningKey(key *identity.KeyPair) *Client {
+	c.signingKey = key
+	return c
+}
+
 // ID is not implemented on the client side since it usually returns the local ID.
 func (c *Client) ID() string {
 	return ""
@@ -34,7 +46,17 @@ func (c *Client) ID() string {
 
 // Find looks up a block address.
 func (c *Client) Find(ctx context.Context, address string) ([]FindResponse, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s", c.baseURL, address), nil)
+	return c.FindProtocols(ctx, address, nil)
+}
+
+// FindProtocols looks up a block address on the services serving it with
+// one of protocols.
+func (c *Client) FindProtocols(ctx context.Context, address string, protocols []string) ([]FindResponse, error) {
+	u := fmt.Sprintf("%s/%s", c.baseURL, address)
+	if len(protocols) > 0 {
+		u += "?protocol=" + url.QueryEscape(strings.Join(protocols, ","))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -59,7 +81,22 @@ func (c *Client) Find(ctx context.Context, address string) ([]FindResponse, erro
 
 // Has notifies the finder service that a storage node holds the given blocks.
 func (c *Client) Notify(ctx context.Context, storageID string, addresses []string) error {
+	return c.NotifyProtocol(ctx, storageID, StorageProtocol, addresses)
+}
+
+// NotifyProtocol notifies the finder service that a service serves the
+// given blocks with protocol.
+func (c *Client) NotifyProtocol(ctx context.Context, storageID, protocol string, addresses []string) error {
 	hasClient := notify.NewClient(c.baseURL, c.httpClient)
+	if protocol != StorageProtocol {
+		hasClient.WithProtocol(protocol)
+	}
+	if c.signingKey != nil {
+		hasClient.WithSigningKey(c.signingKey)
+		if id := c.signingKey.ID(); id != storageID {
+			hasClient.WithRelay(id)
+		}
+	}
 	return hasClient.Notify(storageID, addresses)
 }
 
@@ -83,4 +120,40 @@ func (c *Client) Peer(ctx context.Context, finderID string) error {
 	return nil
 }
 
-var _ Finder = (*Client)(nil)
+// Stats retrieves the statistics of the remote finder.
+func (c *Client) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	err := c.getJSON(ctx, "stats", &stats)
+	return stats, err
+}
+
+// Routing retrieves the nodes in the routing table of the remote finder.
+func (c *Client) Routing(ctx context.Context) ([]PeerInfo, error) {
+	var peers []PeerInfo
+	err := c.getJSON(ctx, "routing", &peers)
+	return peers, err
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s", c.baseURL, path), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+var (
+	_ Finder         = (*Client)(nil)
+	_ ProtocolFinder = (*Client)(nil)
+)
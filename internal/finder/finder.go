@@ -3,8 +3,12 @@ package finder
 import (
 	"context"
 	"fmt"
+	"maps"
+	"slices"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // FindResponse represents a service holding or knowing about a block.
@@ -13,6 +17,13 @@ type FindResponse struct {
 	Protocol string `json:"protocol"`
 }
 
+// The protocols of the services returned by Find.
+const (
+	StorageProtocol = "storage-v1"
+	CacheProtocol   = "cache-v1"
+	FinderProtocol  = "finder-v1"
+)
+
 // Finder defines the interface for the Kademlia-based finder service.
 type Finder interface {
 	ID() string
@@ -21,12 +32,52 @@ type Finder interface {
 	Peer(ctx context.Context, finderID string) error
 }
 
+// ProtocolFinder is implemented by finders that record the protocol each
+// service serves its blocks with, so blocks can also be found on caches and
+// mirrors that are not storage-v1 services.
+type ProtocolFinder interface {
+	// NotifyProtocol registers that the service storageID serves the given
+	// blocks with protocol. Notify is NotifyProtocol with storage-v1.
+	NotifyProtocol(ctx context.Context, storageID, protocol string, addresses []string) error
+
+	// FindProtocols is Find limited to the services serving the block with
+	// one of protocols, returned in the order of protocols. If no such
+	// service is known the closest finders are returned. Empty protocols
+	// returns the services of every protocol.
+	FindProtocols(ctx context.Context, address string, protocols []string) ([]FindResponse, error)
+}
+
 // FinderTest provides testing and diagnostic methods.
 type FinderTest interface {
 	SnapshotBlocks() map[string][]string
+	SnapshotProtocols() map[string]map[string]string
 	RoutingTable() *RoutingTable
 }
 
+// Stats summarizes the state and activity of a finder. Rates are averaged
+// over the uptime of the finder.
+type Stats struct {
+	KnownBlocks int               `json:"knownBlocks"`
+	Peers       int               `json:"peers"`
+	Buckets     []BucketOccupancy `json:"buckets"`
+	Uptime      float64           `json:"uptimeSeconds"`
+
+	// Finds counts the lookups served, which pull block locations
+	Finds    uint64  `json:"finds"`
+	FindRate float64 `json:"findRate"`
+	// Notified counts the block addresses pushed to the finder
+	Notified   uint64  `json:"notified"`
+	NotifyRate float64 `json:"notifyRate"`
+	// Pushed counts the block addresses pushed to closer finders
+	Pushed   uint64  `json:"pushed"`
+	PushRate float64 `json:"pushRate"`
+}
+
+// StatsProvider is implemented by finders that report their Stats.
+type StatsProvider interface {
+	Stats() Stats
+}
+
 // MemoryFinder provides an in-memory implementation of the Finder interface.
 // It uses Kademlia concepts for discovering and storing knowledge of block locations.
 type MemoryFinder struct {
@@ -36,9 +87,18 @@ type MemoryFinder struct {
 
 	// mu protects the knownBlocks map
 	mu          sync.RWMutex
-	knownBlocks map[string]map[string]struct{} // blockAddress -> set of storage IDs
+	knownBlocks map[string]map[string]string // blockAddress -> storage ID -> protocol
+
+	started  time.Time
+	finds    atomic.Uint64
+	notified atomic.Uint64
 }
 
+var (
+	_ StatsProvider  = (*MemoryFinder)(nil)
+	_ ProtocolFinder = (*MemoryFinder)(nil)
+)
+
 // NewMemoryFinder creates a new MemoryFinder instance.
 func NewMemoryFinder(idStr string) (*MemoryFinder, error) {
 	nodeID, err := ParseNodeID(idStr)
@@ -50,7 +110,8 @@ func NewMemoryFinder(idStr string) (*MemoryFinder, error) {
 		id:           nodeID,
 		idStr:        idStr,
 		routingTable: NewRoutingTable(nodeID),
-		knownBlocks:  make(map[string]map[string]struct{}),
+		knownBlocks:  make(map[string]map[string]string),
+		started:      time.Now(),
 	}, nil
 }
 
@@ -63,27 +124,31 @@ func (f *MemoryFinder) ID() string {
 // nodes have it. If so, it returns them. Otherwise, it returns the k-closest
 // finder nodes to the address from its routing table.
 func (f *MemoryFinder) Find(ctx context.Context, address string) ([]FindResponse, error) {
-	f.mu.RLock()
-	storages, ok := f.knownBlocks[address]
-	f.mu.RUnlock()
+	return f.FindProtocols(ctx, address, nil)
+}
 
+// FindProtocols is Find returning only the services that serve the block
+// with one of protocols, ordered by protocol and then by ID.
+func (f *MemoryFinder) FindProtocols(ctx context.Context, address string, protocols []string) ([]FindResponse, error) {
+	f.finds.Add(1)
 	var responses []FindResponse
-
-	if ok && len(storages) > 0 {
-		// Return the storage services that have the block
-		// Sort the output for stable testing
-		var sorted []string
-		for sID := range storages {
-			sorted = append(sorted, sID)
+	f.mu.RLock()
+	for sID, protocol := range f.knownBlocks[address] {
+		if len(protocols) == 0 || slices.Contains(protocols, protocol) {
+			responses = append(responses, FindResponse{ID: sID, Protocol: protocol})
 		}
-		sort.Strings(sorted)
+	}
+	f.mu.RUnlock()
 
-		for _, sID := range sorted {
-			responses = append(responses, FindResponse{
-				ID:       sID,
-				Protocol: "storage-v1",
-			})
-		}
+	if len(responses) > 0 {
+		// Sort the output for stable testing
+		sort.Slice(responses, func(i, j int) bool {
+			pi, pj := slices.Index(protocols, responses[i].Protocol), slices.Index(protocols, responses[j].Protocol)
+			if pi != pj {
+				return pi < pj
+			}
+			return responses[i].ID < responses[j].ID
+		})
 		return responses, nil
 	}
 
@@ -97,7 +162,7 @@ func (f *MemoryFinder) Find(ctx context.Context, address string) ([]FindResponse
 	for _, n := range closestFinders {
 		responses = append(responses, FindResponse{
 			ID:       n.String(),
-			Protocol: "finder-v1",
+			Protocol: FinderProtocol,
 		})
 	}
 
@@ -106,14 +171,21 @@ func (f *MemoryFinder) Find(ctx context.Context, address string) ([]FindResponse
 
 // Has registers that a storage ID holds the given blocks.
 func (f *MemoryFinder) Notify(ctx context.Context, storageID string, addresses []string) error {
+	return f.NotifyProtocol(ctx, storageID, StorageProtocol, addresses)
+}
+
+// NotifyProtocol registers that a service serves the given blocks with
+// protocol, replacing the protocol it was known to serve them with.
+func (f *MemoryFinder) NotifyProtocol(ctx context.Context, storageID, protocol string, addresses []string) error {
+	f.notified.Add(uint64(len(addresses)))
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	for _, addr := range addresses {
 		if f.knownBlocks[addr] == nil {
-			f.knownBlocks[addr] = make(map[string]struct{})
+			f.knownBlocks[addr] = make(map[string]string)
 		}
-		f.knownBlocks[addr][storageID] = struct{}{}
+		f.knownBlocks[addr][storageID] = protocol
 	}
 
 	return nil
@@ -150,3 +222,50 @@ func (f *MemoryFinder) SnapshotBlocks() map[string][]string {
 	}
 	return snap
 }
+
+// SnapshotProtocols returns a map of all known blocks to the services that
+// have them and the protocols they serve them with.
+func (f *MemoryFinder) SnapshotProtocols() map[string]map[string]string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	snap := make(map[string]map[string]string, len(f.knownBlocks))
+	for addr, storages := range f.knownBlocks {
+		snap[addr] = maps.Clone(storages)
+	}
+	return snap
+}
+
+// Stats returns the known block count, routing table occupancy, and request
+// counts of the finder. Pushes are made by the server so are not counted.
+func (f *MemoryFinder) Stats() Stats {
+	f.mu.RLock()
+	knownBlocks := len(f.knownBlocks)
+	f.mu.RUnlock()
+
+	buckets := f.routingTable.Occupancy()
+	peers := 0
+	for _, b := range buckets {
+		peers += b.Peers
+	}
+	uptime := time.Since(f.started).Seconds()
+	stats := Stats{
+		KnownBlocks: knownBlocks,
+		Peers:       peers,
+		Buckets:     buckets,
+		Uptime:      uptime,
+		Finds:       f.finds.Load(),
+		Notified:    f.notified.Load(),
+	}
+	stats.FindRate = rate(stats.Finds, uptime)
+	stats.NotifyRate = rate(stats.Notified, uptime)
+	return stats
+}
+
+// rate returns count per second over seconds.
+func rate(count uint64, seconds float64) float64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(count) / seconds
+}
@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"encoding/hex"
 	"sort"
+	"sync"
+	"time"
+
+	"invariant/internal/ring"
 )
 
 const (
 	// Kademlia K value (bucket size)
 	BucketSize = 20
 	// Length of Node ID in bytes
-	IDLength = 32
+	IDLength = ring.IDLength
 )
 
 // NodeID represents a Kademlia node ID.
@@ -39,46 +43,51 @@ func (n NodeID) Equals(other NodeID) bool {
 
 // XOR computes the distance between two NodeIDs.
 func (n NodeID) XOR(other NodeID) NodeID {
-	var distance NodeID
-	for i := range IDLength {
-		distance[i] = n[i] ^ other[i]
-	}
-	return distance
+	return NodeID(ring.Distance(n[:], other[:]))
 }
 
 // Less answers if the distance of node n to target is less than node other to target.
 func (n NodeID) Less(other, target NodeID) bool {
 	nDist := n.XOR(target)
 	oDist := other.XOR(target)
-	return bytes.Compare(nDist[:], oDist[:]) < 0
+	return ring.Compare(nDist[:], oDist[:]) < 0
 }
 
 // PrefixLen returns the number of common bits between two NodeIDs.
 func (n NodeID) PrefixLen(other NodeID) int {
-	for i := range IDLength {
-		b := n[i] ^ other[i]
-		if b != 0 {
-			// Find the first set bit from the left
-			for j := range 8 {
-				if (b & (1 << (7 - j))) != 0 {
-					return i*8 + j
-				}
-			}
-		}
-	}
-	return IDLength * 8
+	distance := n.XOR(other)
+	return ring.PrefixLen(distance[:])
 }
 
 // RoutingTable manages Kademlia K-Buckets.
 type RoutingTable struct {
-	self    NodeID
-	buckets [IDLength * 8][]NodeID
+	self NodeID
+
+	// mu protects buckets and lastSeen
+	mu       sync.RWMutex
+	buckets  [IDLength * 8][]NodeID
+	lastSeen map[NodeID]time.Time
+}
+
+// PeerInfo describes a node in the routing table.
+type PeerInfo struct {
+	ID       string    `json:"id"`
+	Bucket   int       `json:"bucket"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// BucketOccupancy is the number of nodes in a non-empty bucket. Bucket i
+// holds the nodes sharing a prefix of exactly i bits with the table's node.
+type BucketOccupancy struct {
+	Bucket int `json:"bucket"`
+	Peers  int `json:"peers"`
 }
 
 // NewRoutingTable creates a new RoutingTable.
 func NewRoutingTable(self NodeID) *RoutingTable {
 	return &RoutingTable{
-		self: self,
+		self:     self,
+		lastSeen: make(map[NodeID]time.Time),
 	}
 }
 
@@ -92,6 +101,10 @@ func (rt *RoutingTable) Add(node NodeID) {
 		return // Should not happen if it's not self
 	}
 
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.lastSeen[node] = time.Now()
+
 	bucket := rt.buckets[bucketIdx]
 
 	// Check if already in bucket
@@ -112,16 +125,14 @@ func (rt *RoutingTable) Add(node NodeID) {
 		// and simple nodes, we'll just not add it for simplicity, to match standard basic docs unless
 		// instructed otherwise. Wait, keeping fresh nodes is better if we assume all are alive.
 		// Let's implement simple LRU for dead-node resistance: drop head, add to tail.
+		delete(rt.lastSeen, bucket[0])
 		rt.buckets[bucketIdx] = append(bucket[1:], node)
 	}
 }
 
 // FindClosest returns the up to `count` closest nodes to the target in the routing table.
 func (rt *RoutingTable) FindClosest(target NodeID, count int) []NodeID {
-	var allNodes []NodeID
-	for _, bucket := range rt.buckets {
-		allNodes = append(allNodes, bucket...)
-	}
+	allNodes := rt.Snapshot()
 
 	sort.Slice(allNodes, func(i, j int) bool {
 		return allNodes[i].Less(allNodes[j], target)
@@ -135,9 +146,41 @@ func (rt *RoutingTable) FindClosest(target NodeID, count int) []NodeID {
 
 // Snapshot returns all nodes in the routing table.
 func (rt *RoutingTable) Snapshot() []NodeID {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
 	var allNodes []NodeID
 	for _, bucket := range rt.buckets {
 		allNodes = append(allNodes, bucket...)
 	}
 	return allNodes
 }
+
+// Peers returns the nodes in the routing table with when each was last seen,
+// ordered by bucket and then from least to most recently seen.
+func (rt *RoutingTable) Peers() []PeerInfo {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	var peers []PeerInfo
+	for i, bucket := range rt.buckets {
+		for _, node := range bucket {
+			peers = append(peers, PeerInfo{ID: node.String(), Bucket: i, LastSeen: rt.lastSeen[node]})
+		}
+	}
+	return peers
+}
+
+// Occupancy returns the number of nodes in each non-empty bucket.
+func (rt *RoutingTable) Occupancy() []BucketOccupancy {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	var occupancy []BucketOccupancy
+	for i, bucket := range rt.buckets {
+		if len(bucket) > 0 {
+			occupancy = append(occupancy, BucketOccupancy{Bucket: i, Peers: len(bucket)})
+		}
+	}
+	return occupancy
+}
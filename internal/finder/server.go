@@ -4,15 +4,24 @@ import (
 	"context"
 	"encoding/json"
 	"invariant/internal/discovery"
+	"invariant/internal/identity"
+	"io"
+	"log"
 	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
 
 	"invariant/internal/notify"
 )
 
 // FinderServer wraps a Finder implementation and provides HTTP endpoints.
 type FinderServer struct {
-	finder    Finder
-	discovery discovery.Discovery
+	finder        Finder
+	key           *identity.KeyPair
+	discovery     discovery.Discovery
+	requireSigned bool
+	pushed        atomic.Uint64 // block addresses pushed to closer finders
 }
 
 // NewFinderServer creates a new Finder HTTP server.
@@ -23,10 +32,26 @@ func NewFinderServer(finder Finder, disc discovery.Discovery) *FinderServer {
 	}
 }
 
+// WithKeyPair sets the key pair of the finder's ID, with which it answers
+// challenges to GET /id. The finder must have been created with its ID.
+func (s *FinderServer) WithKeyPair(key *identity.KeyPair) *FinderServer {
+	s.key = key
+	return s
+}
+
+// WithRequireSigned rejects notifications that are not signed by the key of
+// the notifying storage service. Signed notifications are always verified.
+func (s *FinderServer) WithRequireSigned(require bool) *FinderServer {
+	s.requireSigned = require
+	return s
+}
+
 func (s *FinderServer) Handler() http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("GET /id", s.handleGetID)
+	mux.HandleFunc("GET /stats", s.handleStats)
+	mux.HandleFunc("GET /routing", s.handleRouting)
 	mux.HandleFunc("GET /{address}", s.handleFind)
 	mux.HandleFunc("PUT /notify/{id}", s.handleNotify)
 	mux.HandleFunc("PUT /peer/{id}", s.handlePeer)
@@ -39,8 +64,37 @@ func (s *FinderServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *FinderServer) handleGetID(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(s.finder.ID()))
+	identity.ServeID(w, r, s.finder.ID(), s.key)
+}
+
+func (s *FinderServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	provider, ok := s.finder.(StatsProvider)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	stats := provider.Stats()
+	stats.Pushed = s.pushed.Load()
+	stats.PushRate = rate(stats.Pushed, stats.Uptime)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (s *FinderServer) handleRouting(w http.ResponseWriter, r *http.Request) {
+	ft, ok := s.finder.(FinderTest)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	peers := ft.RoutingTable().Peers()
+	if peers == nil {
+		peers = []PeerInfo{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peers)
 }
 
 func (s *FinderServer) handleFind(w http.ResponseWriter, r *http.Request) {
@@ -50,7 +104,18 @@ func (s *FinderServer) handleFind(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	responses, err := s.finder.Find(r.Context(), address)
+	var responses []FindResponse
+	var err error
+	if protocols := r.URL.Query().Get("protocol"); protocols != "" {
+		pf, ok := s.finder.(ProtocolFinder)
+		if !ok {
+			http.Error(w, "Not Implemented", http.StatusNotImplemented)
+			return
+		}
+		responses, err = pf.FindProtocols(r.Context(), address, strings.Split(protocols, ","))
+	} else {
+		responses, err = s.finder.Find(r.Context(), address)
+	}
 	if err != nil {
 		// Differentiate between bad address formats and internal errors
 		if err.Error() == "invalid block address format: encoding/hex: invalid byte: U+007A 'z'" {
@@ -72,14 +137,48 @@ func (s *FinderServer) handleNotify(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	data, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, "Bad Request: failed to read body", http.StatusBadRequest)
+		return
+	}
+
 	var reqBody notify.NotifyRequest
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+	if err := json.Unmarshal(data, &reqBody); err != nil {
 		http.Error(w, "Bad Request: valid JSON expected", http.StatusBadRequest)
 		return
 	}
-	defer r.Body.Close()
 
-	if err := s.finder.Notify(r.Context(), storageID, reqBody.Addresses); err != nil {
+	// Only the storage service itself can sign for its ID, so verified
+	// notifications cannot claim blocks on behalf of another service. The
+	// blocks pushed by a finder are signed by the finder instead, which must
+	// be one this finder knows.
+	signer := storageID
+	if reqBody.Relay != "" {
+		signer = reqBody.Relay
+	}
+	err = notify.Verify(signer, storageID, reqBody.Protocol, data, r.Header.Get("Authorization"))
+	if err == nil && reqBody.Relay != "" && !s.knownFinder(r.Context(), reqBody.Relay) {
+		http.Error(w, "Unauthorized: unknown relay "+reqBody.Relay, http.StatusUnauthorized)
+		return
+	}
+	if err == notify.ErrInvalidSignature || (err == notify.ErrUnsigned && s.requireSigned) {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if reqBody.Protocol != "" && reqBody.Protocol != StorageProtocol {
+		pf, ok := s.finder.(ProtocolFinder)
+		if !ok {
+			http.Error(w, "Not Implemented", http.StatusNotImplemented)
+			return
+		}
+		err = pf.NotifyProtocol(r.Context(), storageID, reqBody.Protocol, reqBody.Addresses)
+	} else {
+		err = s.finder.Notify(r.Context(), storageID, reqBody.Addresses)
+	}
+	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
@@ -87,6 +186,21 @@ func (s *FinderServer) handleNotify(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// knownFinder reports whether id is a finder in the routing table or
+// registered with discovery, which may push blocks to this finder.
+func (s *FinderServer) knownFinder(ctx context.Context, id string) bool {
+	if ft, ok := s.finder.(FinderTest); ok {
+		if nodeID, err := ParseNodeID(id); err == nil && slices.Contains(ft.RoutingTable().Snapshot(), nodeID) {
+			return true
+		}
+	}
+	if s.discovery == nil {
+		return false
+	}
+	desc, ok := s.discovery.Get(ctx, id)
+	return ok && slices.Contains(desc.Protocols, FinderProtocol)
+}
+
 func (s *FinderServer) handlePeer(w http.ResponseWriter, r *http.Request) {
 	newFinderID := r.PathValue("id")
 	if newFinderID == "" {
@@ -115,8 +229,12 @@ func (s *FinderServer) pushBlocksToCloserFinder(newFinderID string) {
 		return // Discovery doesn't know about them, can't push
 	}
 
-	// Create a client to talk to the new finder
+	// Create a client to talk to the new finder, signing the pushed blocks
+	// with the key of this finder
 	remoteClient := NewClient(desc.Address, nil)
+	if s.key != nil {
+		remoteClient.WithSigningKey(s.key)
+	}
 
 	// Parse IDs for distance calculation
 	localNodeID, err := ParseNodeID(s.finder.ID())
@@ -133,13 +251,13 @@ func (s *FinderServer) pushBlocksToCloserFinder(newFinderID string) {
 	if !ok {
 		return
 	}
-	knownBlocks := ft.SnapshotBlocks()
+	knownBlocks := ft.SnapshotProtocols()
 
-	// Batch blocks by storage ID
-	// storageID -> list of addresses
-	pushMap := make(map[string][]string)
+	// Batch blocks by storage ID and the protocol it serves them with
+	type holder struct{ id, protocol string }
+	pushMap := make(map[holder][]string)
 
-	for blockAddr, storageIDs := range knownBlocks {
+	for blockAddr, storages := range knownBlocks {
 		blockNodeID, err := ParseNodeID(blockAddr)
 		if err != nil {
 			continue
@@ -147,14 +265,19 @@ func (s *FinderServer) pushBlocksToCloserFinder(newFinderID string) {
 
 		// Kademlia: if remote is closer to the block than we are, tell them
 		if remoteNodeID.Less(localNodeID, blockNodeID) {
-			for _, sID := range storageIDs {
-				pushMap[sID] = append(pushMap[sID], blockAddr)
+			for sID, protocol := range storages {
+				h := holder{sID, protocol}
+				pushMap[h] = append(pushMap[h], blockAddr)
 			}
 		}
 	}
 
 	// Send batches to the new finder
-	for sID, addrs := range pushMap {
-		remoteClient.Notify(context.Background(), sID, addrs)
+	for h, addrs := range pushMap {
+		if err := remoteClient.NotifyProtocol(context.Background(), h.id, h.protocol, addrs); err != nil {
+			log.Printf("finder: failed to push %d blocks of %s to finder %s: %v", len(addrs), h.id, newFinderID, err)
+			continue
+		}
+		s.pushed.Add(uint64(len(addrs)))
 	}
 }
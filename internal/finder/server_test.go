@@ -1,10 +1,14 @@
 package finder
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"invariant/internal/discovery"
+	"invariant/internal/identity"
 	"invariant/internal/notify"
+	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"testing"
@@ -96,6 +100,58 @@ func TestFinderHasAndFindBlock(t *testing.T) {
 	}
 }
 
+func TestFinderFindProtocols(t *testing.T) {
+	f, _ := NewMemoryFinder("1111111111111111111111111111111111111111111111111111111111111111")
+	ts := httptest.NewServer(NewFinderServer(f, newMockDiscovery()).Handler())
+	defer ts.Close()
+	client := NewClient(ts.URL, nil)
+	ctx := context.Background()
+
+	blockAddr := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	client.Notify(ctx, "storage-1", []string{blockAddr})
+	if err := notify.NewClient(ts.URL, nil).WithProtocol(CacheProtocol).Notify("cache-1", []string{blockAddr}); err != nil {
+		t.Fatalf("Failed to notify: %v", err)
+	}
+
+	// Without protocols every holder is returned
+	res, err := client.Find(ctx, blockAddr)
+	if err != nil {
+		t.Fatalf("Failed to find: %v", err)
+	}
+	expected := []FindResponse{{ID: "cache-1", Protocol: CacheProtocol}, {ID: "storage-1", Protocol: StorageProtocol}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expected %v, got %v", expected, res)
+	}
+
+	// The holders are returned in the order of the protocols asked for
+	res, err = client.FindProtocols(ctx, blockAddr, []string{StorageProtocol, CacheProtocol})
+	if err != nil {
+		t.Fatalf("Failed to find: %v", err)
+	}
+	expected = []FindResponse{{ID: "storage-1", Protocol: StorageProtocol}, {ID: "cache-1", Protocol: CacheProtocol}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expected %v, got %v", expected, res)
+	}
+
+	res, err = client.FindProtocols(ctx, blockAddr, []string{CacheProtocol})
+	if err != nil {
+		t.Fatalf("Failed to find: %v", err)
+	}
+	if len(res) != 1 || res[0].ID != "cache-1" {
+		t.Errorf("Expected only the cache, got %v", res)
+	}
+
+	// A block no service of the protocols has is looked up on other finders
+	f.Peer(ctx, "2222222222222222222222222222222222222222222222222222222222222222")
+	res, err = client.FindProtocols(ctx, blockAddr, []string{"mirror-v1"})
+	if err != nil {
+		t.Fatalf("Failed to find: %v", err)
+	}
+	if len(res) != 1 || res[0].Protocol != FinderProtocol {
+		t.Errorf("Expected a finder, got %v", res)
+	}
+}
+
 func TestFinderPeerAndPushBlocks(t *testing.T) {
 	disc := newMockDiscovery()
 
@@ -202,3 +258,139 @@ func TestFinderReturnsFinders(t *testing.T) {
 		}
 	}
 }
+
+func TestFinderStatsAndRouting(t *testing.T) {
+	idA := "0000000000000000000000000000000000000000000000000000000000000001"
+	fA, _ := NewMemoryFinder(idA)
+	tsA := httptest.NewServer(NewFinderServer(fA, nil).Handler())
+	defer tsA.Close()
+	clientA := NewClient(tsA.URL, nil)
+	ctx := context.Background()
+
+	idB := "0000000000000000000000000000000000000000000000000000000000000002"
+	idC := "0000000000000000000000000000000000000000000000000000000000000003"
+	clientA.Peer(ctx, idB)
+	clientA.Peer(ctx, idC)
+	clientA.Notify(ctx, "storage-1", []string{
+		"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+		"cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
+	})
+	clientA.Find(ctx, "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+
+	stats, err := clientA.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	if stats.KnownBlocks != 2 || stats.Peers != 2 || stats.Finds != 1 || stats.Notified != 2 || stats.Pushed != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	// Both peers differ from A in the second to last bit
+	expectedBuckets := []BucketOccupancy{{Bucket: 254, Peers: 2}}
+	if !reflect.DeepEqual(stats.Buckets, expectedBuckets) {
+		t.Errorf("Expected buckets %v, got %v", expectedBuckets, stats.Buckets)
+	}
+
+	peers, err := clientA.Routing(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get routing table: %v", err)
+	}
+	if len(peers) != 2 || peers[0].ID != idB || peers[1].ID != idC {
+		t.Fatalf("Unexpected peers: %v", peers)
+	}
+	if peers[0].LastSeen.IsZero() || peers[1].LastSeen.Before(peers[0].LastSeen) {
+		t.Errorf("Unexpected last seen times: %v", peers)
+	}
+}
+
+func TestFinderSignedNotify(t *testing.T) {
+	f, _ := NewMemoryFinder("1111111111111111111111111111111111111111111111111111111111111111")
+	ts := httptest.NewServer(NewFinderServer(f, nil).WithRequireSigned(true).Handler())
+	defer ts.Close()
+
+	key, _ := identity.GenerateKeyPair()
+	storageID := key.ID()
+	otherKey, _ := identity.GenerateKeyPair()
+	blockAddr := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	ctx := context.Background()
+
+	// Unsigned and forged notifications are rejected
+	if err := notify.NewClient(ts.URL, nil).Notify(storageID, []string{blockAddr}); err == nil {
+		t.Errorf("Expected unsigned notification to be rejected")
+	}
+	if err := notify.NewClient(ts.URL, nil).WithSigningKey(otherKey).Notify(storageID, []string{blockAddr}); err == nil {
+		t.Errorf("Expected notification signed by another key to be rejected")
+	}
+	if res, _ := NewClient(ts.URL, nil).Find(ctx, blockAddr); len(res) != 0 {
+		t.Fatalf("Expected rejected notifications to be ignored, got %v", res)
+	}
+
+	if err := notify.NewClient(ts.URL, nil).WithSigningKey(key).Notify(storageID, []string{blockAddr}); err != nil {
+		t.Fatalf("Failed to notify: %v", err)
+	}
+	res, err := NewClient(ts.URL, nil).Find(ctx, blockAddr)
+	if err != nil {
+		t.Fatalf("Failed to find: %v", err)
+	}
+	if len(res) != 1 || res[0].ID != storageID {
+		t.Errorf("Expected %s to have the block, got %v", storageID, res)
+	}
+}
+
+func TestFinderSignedPush(t *testing.T) {
+	disc := newMockDiscovery()
+	ctx := context.Background()
+
+	keyA, _ := identity.GenerateKeyPair()
+	fA, _ := NewMemoryFinder(keyA.ID())
+	tsA := httptest.NewServer(NewFinderServer(fA, disc).WithKeyPair(keyA).Handler())
+	defer tsA.Close()
+
+	// B only accepts signed notifications, and is closest to the block
+	keyB, _ := identity.GenerateKeyPair()
+	fB, _ := NewMemoryFinder(keyB.ID())
+	tsB := httptest.NewServer(NewFinderServer(fB, disc).WithRequireSigned(true).Handler())
+	defer tsB.Close()
+	blockAddr := keyB.ID()
+
+	disc.Register(ctx, discovery.ServiceRegistration{ID: keyA.ID(), Address: tsA.URL, Protocols: []string{"finder-v1"}})
+	disc.Register(ctx, discovery.ServiceRegistration{ID: keyB.ID(), Address: tsB.URL, Protocols: []string{"finder-v1"}})
+
+	// Blocks relayed by a finder B does not know are rejected
+	stranger, _ := identity.GenerateKeyPair()
+	if err := NewClient(tsB.URL, nil).WithSigningKey(stranger).Notify(ctx, "storage-1", []string{blockAddr}); err == nil {
+		t.Errorf("Expected blocks relayed by an unknown finder to be rejected")
+	}
+
+	// A signs the blocks it pushes to B
+	NewClient(tsA.URL, nil).Notify(ctx, "storage-1", []string{blockAddr})
+	if err := NewClient(tsA.URL, nil).Peer(ctx, keyB.ID()); err != nil {
+		t.Fatalf("Failed to peer: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		res, err := NewClient(tsB.URL, nil).Find(ctx, blockAddr)
+		if err != nil {
+			t.Fatalf("Failed to find on B: %v", err)
+		}
+		if len(res) == 1 && res[0].ID == "storage-1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected B to accept the signed push, got %v", res)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A body signed by A for storage-1 cannot be replayed for another service
+	data, _ := json.Marshal(notify.NotifyRequest{Addresses: []string{blockAddr}, Relay: keyA.ID()})
+	req, _ := http.NewRequest(http.MethodPut, tsB.URL+"/notify/storage-2", bytes.NewReader(data))
+	req.Header.Set("Authorization", notify.Sign(keyA, "storage-1", "", data))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to notify: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the replayed notification to be rejected, got %d", resp.StatusCode)
+	}
+}
@@ -1,7 +1,10 @@
+//go:build linux || darwin
+
 package fuse
 
 import (
 	"context"
+	"errors"
 	"io"
 	"os"
 	"strconv"
@@ -296,6 +299,9 @@ func (fh *fileHandle) Flush(ctx context.Context) syscall.Errno {
 	if fh.f != nil && fh.dirty {
 		fh.f.Seek(0, io.SeekStart)
 		err := fh.node.filesrv.WriteFile(ctx, fh.node.nodeID, 0, false, fh.f)
+		if errors.Is(err, files.ErrQuotaExceeded) {
+			return syscall.ENOSPC
+		}
 		if err != nil {
 			return syscall.EIO
 		}
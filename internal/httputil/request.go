@@ -0,0 +1,87 @@
+package httputil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// RequestError is the JSON body of a response rejecting a malformed request.
+type RequestError struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// WriteRequestError responds with status and a RequestError describing why
+// the request was rejected.
+func WriteRequestError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(RequestError{Status: status, Error: message})
+}
+
+// CheckContentType reports whether the request body is of the media type
+// mediaType, responding 415 Unsupported Media Type if it is not. A request
+// without a Content-Type is taken to be of mediaType.
+func CheckContentType(w http.ResponseWriter, r *http.Request, mediaType string) bool {
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return true
+	}
+	if parsed, _, err := mime.ParseMediaType(header); err != nil || parsed != mediaType {
+		WriteRequestError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Unsupported Media Type: %s expected", mediaType))
+		return false
+	}
+	return true
+}
+
+// LimitBody limits the request body to maxBytes. Reading beyond it fails
+// with an *http.MaxBytesError.
+func LimitBody(w http.ResponseWriter, r *http.Request, maxBytes int64) io.Reader {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	return r.Body
+}
+
+// DecodeJSON strictly decodes the JSON request body, of at most maxBytes,
+// into v. The body must be a single JSON value of type application/json
+// without fields v does not have. A request that is not is rejected with
+// 415 Unsupported Media Type, 413 Request Entity Too Large or 400 Bad
+// Request, and DecodeJSON returns false.
+func DecodeJSON(w http.ResponseWriter, r *http.Request, maxBytes int64, v any) bool {
+	defer r.Body.Close()
+	if !CheckContentType(w, r, "application/json") {
+		return false
+	}
+	dec := json.NewDecoder(LimitBody(w, r, maxBytes))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		var rest json.RawMessage
+		if err = dec.Decode(&rest); err == io.EOF {
+			err = nil
+		} else if err == nil {
+			err = errors.New("unexpected data after the JSON value")
+		}
+	}
+	if err != nil {
+		WriteBodyError(w, err)
+		return false
+	}
+	return true
+}
+
+// WriteBodyError responds to a request whose body could not be read or
+// parsed with 413 Request Entity Too Large if it exceeded its limit, or 400
+// Bad Request otherwise.
+func WriteBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		WriteRequestError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request Entity Too Large: the body is limited to %d bytes", tooLarge.Limit))
+		return
+	}
+	WriteRequestError(w, http.StatusBadRequest, "Bad Request: "+err.Error())
+}
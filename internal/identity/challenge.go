@@ -0,0 +1,61 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// challengeContext prefixes the signed nonce so that a challenge cannot be
+// used to obtain the signature of other data, such as a notification.
+const challengeContext = "invariant-identity-challenge:"
+
+// ChallengeResponse proves that a service holds the private key of its ID by
+// signing a nonce chosen by the caller.
+type ChallengeResponse struct {
+	ID        string `json:"id"`
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+}
+
+// Respond signs nonce, answering a challenge to prove the identity of k.
+func (k *KeyPair) Respond(nonce string) ChallengeResponse {
+	return ChallengeResponse{
+		ID:        k.id,
+		PublicKey: hex.EncodeToString(k.PublicKey()),
+		Signature: hex.EncodeToString(k.Sign([]byte(challengeContext + nonce))),
+	}
+}
+
+// Verify checks that the response is a valid answer to the challenge nonce.
+func (r ChallengeResponse) Verify(nonce string) error {
+	public, err := hex.DecodeString(r.PublicKey)
+	if err != nil {
+		return ErrIDMismatch
+	}
+	signature, err := hex.DecodeString(r.Signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	return Verify(r.ID, ed25519.PublicKey(public), []byte(challengeContext+nonce), signature)
+}
+
+// ServeID handles GET /id for a service with id. With a nonce query
+// parameter and a key pair it responds with a ChallengeResponse, otherwise
+// with the ID as plain text.
+func ServeID(w http.ResponseWriter, r *http.Request, id string, key *KeyPair) {
+	nonce := r.URL.Query().Get("nonce")
+	if nonce == "" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(id))
+		return
+	}
+	if key == nil {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key.Respond(nonce))
+}
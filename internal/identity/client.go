@@ -1,6 +1,10 @@
 package identity
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"invariant/internal/httputil"
 	"io"
@@ -55,5 +59,47 @@ func (c *Client) ID() string {
 	return string(body)
 }
 
+// VerifiedID challenges the remote service to prove it holds the private key
+// of its ID, returning the ID once the signed response is verified.
+func (c *Client) VerifiedID() (string, error) {
+	u, err := url.Parse(c.baseURL)
+	if err != nil {
+		return "", err
+	}
+	return ChallengeID(context.Background(), c.httpClient, fmt.Sprintf("%s://%s/id", u.Scheme, u.Host))
+}
+
+// ChallengeID challenges the service serving GET /id at idURL, as ServeID
+// does, to prove it holds the private key of its ID with a random nonce, and
+// returns the ID once the signed response is verified.
+func ChallengeID(ctx context.Context, httpClient *http.Client, idURL string) (string, error) {
+	nonceBytes := make([]byte, 16)
+	rand.Read(nonceBytes)
+	nonce := hex.EncodeToString(nonceBytes)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, idURL+"?nonce="+nonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var challenge ChallengeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil {
+		return "", err
+	}
+	if err := challenge.Verify(nonce); err != nil {
+		return "", err
+	}
+	return challenge.ID, nil
+}
+
 // Assert that Client implements Identity
 var _ Identity = (*Client)(nil)
@@ -0,0 +1,106 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// ErrInvalidSignature is returned when a signature does not verify.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrIDMismatch is returned when a public key does not match an ID.
+	ErrIDMismatch = errors.New("public key does not match id")
+)
+
+// KeyPair is an Ed25519 key pair identifying a service. The ID of the
+// service is the hex encoded sha256 hash of the public key.
+type KeyPair struct {
+	private ed25519.PrivateKey
+	id      string
+}
+
+// Assert that KeyPair implements Identity
+var _ Identity = (*KeyPair)(nil)
+
+// NewKeyPair returns the key pair of the private key.
+func NewKeyPair(private ed25519.PrivateKey) *KeyPair {
+	return &KeyPair{
+		private: private,
+		id:      IDFromPublicKey(private.Public().(ed25519.PublicKey)),
+	}
+}
+
+// GenerateKeyPair returns a new random key pair.
+func GenerateKeyPair() (*KeyPair, error) {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyPair(private), nil
+}
+
+// LoadOrCreateKeyPair reads the private key stored at path, generating and
+// saving a new key pair, readable only by the owner, if the file does not
+// exist.
+func LoadOrCreateKeyPair(path string) (*KeyPair, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if len(data) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("%s is not an Ed25519 private key", path)
+		}
+		return NewKeyPair(ed25519.PrivateKey(data)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, kp.private, 0600); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// ID returns the hex encoded sha256 hash of the public key.
+func (k *KeyPair) ID() string {
+	return k.id
+}
+
+// PublicKey returns the public key of the pair.
+func (k *KeyPair) PublicKey() ed25519.PublicKey {
+	return k.private.Public().(ed25519.PublicKey)
+}
+
+// Sign returns the signature of data by the private key.
+func (k *KeyPair) Sign(data []byte) []byte {
+	return ed25519.Sign(k.private, data)
+}
+
+// IDFromPublicKey returns the ID of the service with the public key.
+func IDFromPublicKey(public ed25519.PublicKey) string {
+	hash := sha256.Sum256(public)
+	return hex.EncodeToString(hash[:])
+}
+
+// Verify checks that signature is the signature of data by the public key,
+// and that the public key is the key of the service with id.
+func Verify(id string, public ed25519.PublicKey, data, signature []byte) error {
+	if len(public) != ed25519.PublicKeySize || IDFromPublicKey(public) != id {
+		return ErrIDMismatch
+	}
+	if !ed25519.Verify(public, data, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
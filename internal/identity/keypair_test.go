@@ -0,0 +1,75 @@
+package identity_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"invariant/internal/identity"
+)
+
+func TestKeyPair_LoadOrCreate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "service.key")
+	created, err := identity.LoadOrCreateKeyPair(path)
+	if err != nil {
+		t.Fatalf("failed to create key pair: %v", err)
+	}
+	loaded, err := identity.LoadOrCreateKeyPair(path)
+	if err != nil {
+		t.Fatalf("failed to load key pair: %v", err)
+	}
+	if loaded.ID() != created.ID() || len(created.ID()) != 64 {
+		t.Fatalf("expected id %s, got %s", created.ID(), loaded.ID())
+	}
+	if created.ID() != identity.IDFromPublicKey(created.PublicKey()) {
+		t.Fatalf("id is not the hash of the public key")
+	}
+
+	data := []byte("data")
+	signature := created.Sign(data)
+	if err := identity.Verify(created.ID(), created.PublicKey(), data, signature); err != nil {
+		t.Fatalf("expected signature to verify: %v", err)
+	}
+	if err := identity.Verify(created.ID(), created.PublicKey(), []byte("other"), signature); err != identity.ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature, got %v", err)
+	}
+	other, _ := identity.GenerateKeyPair()
+	if err := identity.Verify(created.ID(), other.PublicKey(), data, other.Sign(data)); err != identity.ErrIDMismatch {
+		t.Fatalf("expected ErrIDMismatch, got %v", err)
+	}
+}
+
+func TestClient_VerifiedID(t *testing.T) {
+	key, _ := identity.GenerateKeyPair()
+	impostor, _ := identity.GenerateKeyPair()
+	serve := func(id string, key *identity.KeyPair) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity.ServeID(w, r, id, key)
+		}))
+	}
+
+	ts := serve(key.ID(), key)
+	defer ts.Close()
+	client := identity.NewClient(ts.URL, nil)
+	if id := client.ID(); id != key.ID() {
+		t.Fatalf("expected id %s, got %s", key.ID(), id)
+	}
+	if id, err := client.VerifiedID(); err != nil || id != key.ID() {
+		t.Fatalf("expected verified id %s, got %s, %v", key.ID(), id, err)
+	}
+
+	// A service claiming an ID without its key can only prove its own
+	impostorServer := serve(key.ID(), impostor)
+	defer impostorServer.Close()
+	if id, err := identity.NewClient(impostorServer.URL, nil).VerifiedID(); err == nil && id == key.ID() {
+		t.Fatalf("expected the impostor not to prove id %s", key.ID())
+	}
+
+	// A service without a key pair cannot answer challenges
+	keyless := serve(key.ID(), nil)
+	defer keyless.Close()
+	if _, err := identity.NewClient(keyless.URL, nil).VerifiedID(); err == nil {
+		t.Fatalf("expected a service without a key pair to fail the challenge")
+	}
+}
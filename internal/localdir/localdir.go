@@ -0,0 +1,306 @@
+// Package localdir keeps a directory on disk in step with the file tree of a
+// files service, so the tree can be edited with ordinary tools where FUSE is
+// not available. The directory is populated from the tree once and, from
+// then on, local changes are applied to the tree.
+package localdir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"invariant/internal/files"
+	"invariant/internal/filetree"
+)
+
+// Mirror copies the tree below a directory node of a files service into a
+// local directory and applies the changes made to the local directory to
+// the tree. A Mirror is not safe for concurrent use.
+type Mirror struct {
+	fsrv files.Files
+	root uint64
+	dir  string
+
+	// known records the size and modification time of each local file when
+	// it last matched the tree, by its slash separated path relative to dir.
+	known map[string]fileState
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// New returns a mirror of the directory node root of fsrv in dir.
+func New(fsrv files.Files, root uint64, dir string) *Mirror {
+	return &Mirror{
+		fsrv:  fsrv,
+		root:  root,
+		dir:   dir,
+		known: make(map[string]fileState),
+	}
+}
+
+// Populate writes the files, directories and symbolic links of the tree to
+// the local directory, replacing local entries of the same name. Local
+// entries missing from the tree are left alone.
+func (m *Mirror) Populate(ctx context.Context) error {
+	return m.populate(ctx, m.root, "")
+}
+
+func (m *Mirror) populate(ctx context.Context, nodeID uint64, rel string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	dir, err := m.fsrv.ReadDirectory(ctx, nodeID, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to read /%s: %w", rel, err)
+	}
+	if err := os.MkdirAll(m.localPath(rel), 0755); err != nil {
+		return err
+	}
+	for _, entry := range dir {
+		childRel := path.Join(rel, entry.GetName())
+		info, err := m.fsrv.Lookup(ctx, nodeID, entry.GetName())
+		if err != nil {
+			return err
+		}
+		switch e := entry.(type) {
+		case *filetree.DirectoryEntry:
+			if err := m.populate(ctx, info.Node, childRel); err != nil {
+				return err
+			}
+		case *filetree.SymbolicLinkEntry:
+			local := m.localPath(childRel)
+			if err := os.RemoveAll(local); err != nil {
+				return err
+			}
+			if err := os.Symlink(e.Target, local); err != nil {
+				return err
+			}
+		case *filetree.FileEntry:
+			if err := m.writeLocal(ctx, info.Node, childRel, e); err != nil {
+				return fmt.Errorf("failed to write /%s: %w", childRel, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Mirror) writeLocal(ctx context.Context, nodeID uint64, rel string, entry *filetree.FileEntry) error {
+	rc, err := m.fsrv.ReadFile(ctx, nodeID, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	local := m.localPath(rel)
+	if info, err := os.Lstat(local); err == nil && !info.Mode().IsRegular() {
+		if err := os.RemoveAll(local); err != nil {
+			return err
+		}
+	}
+	perm := os.FileMode(0644)
+	if entry.Mode != nil {
+		if mode, err := strconv.ParseUint(*entry.Mode, 8, 32); err == nil {
+			perm = os.FileMode(mode) & os.ModePerm
+		}
+	}
+	f, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if entry.ModifyTime != nil {
+		modTime := time.Unix(int64(*entry.ModifyTime), 0)
+		if err := os.Chtimes(local, modTime, modTime); err != nil {
+			return err
+		}
+	}
+	return m.remember(rel)
+}
+
+// Apply makes the entry at rel, a slash separated path relative to the
+// local directory, in the tree match the local directory: a missing entry
+// is removed, a changed file or symbolic link is replaced, and a directory
+// is reconciled with its local contents.
+func (m *Mirror) Apply(ctx context.Context, rel string) error {
+	rel = path.Clean(strings.TrimPrefix(filepath.ToSlash(rel), "/"))
+	if rel == "." {
+		return m.applyDirectory(ctx, m.root, rel)
+	}
+	parentRel, name := path.Split(rel)
+	parentID, err := m.directory(ctx, path.Clean(parentRel))
+	if err != nil {
+		return err
+	}
+
+	existing, lookupErr := m.fsrv.Lookup(ctx, parentID, name)
+	exists := lookupErr == nil
+	info, err := os.Lstat(m.localPath(rel))
+	if errors.Is(err, os.ErrNotExist) {
+		m.forget(rel)
+		if exists {
+			return m.fsrv.Remove(ctx, parentID, name)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDir():
+		if exists && existing.Kind != string(filetree.DirectoryKind) {
+			if err := m.fsrv.Remove(ctx, parentID, name); err != nil {
+				return err
+			}
+			exists = false
+		}
+		if !exists {
+			if err := m.fsrv.CreateEntry(ctx, parentID, name, filetree.DirectoryKind, "", nil, nil); err != nil {
+				return err
+			}
+			if existing, err = m.fsrv.Lookup(ctx, parentID, name); err != nil {
+				return err
+			}
+		}
+		return m.applyDirectory(ctx, existing.Node, rel)
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(m.localPath(rel))
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := m.fsrv.Remove(ctx, parentID, name); err != nil {
+				return err
+			}
+		}
+		return m.fsrv.CreateEntry(ctx, parentID, name, filetree.SymbolicLinkKind, target, nil, nil)
+	case info.Mode().IsRegular():
+		if state, ok := m.known[rel]; ok && exists && state.size == info.Size() && state.modTime.Equal(info.ModTime()) {
+			return nil
+		}
+		return m.applyFile(ctx, parentID, name, rel, exists, info)
+	}
+	return nil
+}
+
+// applyDirectory applies each entry of the local directory at rel to the
+// directory node nodeID and removes the entries of the node missing locally.
+func (m *Mirror) applyDirectory(ctx context.Context, nodeID uint64, rel string) error {
+	entries, err := os.ReadDir(m.localPath(rel))
+	if err != nil {
+		return err
+	}
+	local := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		local[entry.Name()] = true
+		if err := m.Apply(ctx, path.Join(rel, entry.Name())); err != nil {
+			return err
+		}
+	}
+	dir, err := m.fsrv.ReadDirectory(ctx, nodeID, 0, 0)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dir {
+		if !local[entry.GetName()] {
+			m.forget(path.Join(rel, entry.GetName()))
+			if err := m.fsrv.Remove(ctx, nodeID, entry.GetName()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Mirror) applyFile(ctx context.Context, parentID uint64, name, rel string, exists bool, info os.FileInfo) error {
+	f, err := os.Open(m.localPath(rel))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if exists {
+		if err := m.fsrv.Remove(ctx, parentID, name); err != nil {
+			return err
+		}
+	}
+	if err := m.fsrv.CreateEntry(ctx, parentID, name, filetree.FileKind, "", nil, f); err != nil {
+		return err
+	}
+	created, err := m.fsrv.Lookup(ctx, parentID, name)
+	if err != nil {
+		return err
+	}
+	modTime := uint64(info.ModTime().Unix())
+	mode := strconv.FormatUint(uint64(info.Mode().Perm()), 8)
+	if _, err := m.fsrv.SetAttributes(ctx, created.Node, files.EntryAttributes{ModifyTime: &modTime, Mode: &mode}); err != nil {
+		return err
+	}
+	m.known[rel] = fileState{size: info.Size(), modTime: info.ModTime()}
+	return nil
+}
+
+// directory returns the node of the directory at rel, creating the
+// directories of the path missing from the tree.
+func (m *Mirror) directory(ctx context.Context, rel string) (uint64, error) {
+	nodeID := m.root
+	if rel == "." {
+		return nodeID, nil
+	}
+	for name := range strings.SplitSeq(rel, "/") {
+		info, err := m.fsrv.Lookup(ctx, nodeID, name)
+		if err != nil {
+			if err := m.fsrv.CreateEntry(ctx, nodeID, name, filetree.DirectoryKind, "", nil, nil); err != nil {
+				return 0, err
+			}
+			if info, err = m.fsrv.Lookup(ctx, nodeID, name); err != nil {
+				return 0, err
+			}
+		}
+		if info.Kind != string(filetree.DirectoryKind) {
+			return 0, fmt.Errorf("/%s: %s is not a directory", rel, name)
+		}
+		nodeID = info.Node
+	}
+	return nodeID, nil
+}
+
+func (m *Mirror) remember(rel string) error {
+	info, err := os.Lstat(m.localPath(rel))
+	if err != nil {
+		return err
+	}
+	m.known[rel] = fileState{size: info.Size(), modTime: info.ModTime()}
+	return nil
+}
+
+// forget drops the recorded state of rel and of the entries below it.
+func (m *Mirror) forget(rel string) {
+	delete(m.known, rel)
+	prefix := rel + "/"
+	for known := range m.known {
+		if strings.HasPrefix(known, prefix) {
+			delete(m.known, known)
+		}
+	}
+}
+
+func (m *Mirror) localPath(rel string) string {
+	return filepath.Join(m.dir, filepath.FromSlash(rel))
+}
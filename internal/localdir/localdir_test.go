@@ -0,0 +1,209 @@
+package localdir
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"invariant/internal/content"
+	"invariant/internal/files"
+	"invariant/internal/filetree"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+func setupTestFiles(t *testing.T) *files.InMemoryFiles {
+	store := storage.NewInMemoryStorage()
+	slotService := slots.NewMemorySlots("test")
+	data, err := filetree.Directory{}.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %v", err)
+	}
+	link, err := content.Write(bytes.NewReader(data), store, content.WriterOptions{})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := slotService.Create(context.Background(), "root", link.Address, ""); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	fsrv, err := files.NewInMemoryFiles(files.Options{
+		Storage:  store,
+		Slots:    slotService,
+		RootLink: content.ContentLink{Address: "root", Slot: true},
+	})
+	if err != nil {
+		t.Fatalf("NewInMemoryFiles failed: %v", err)
+	}
+	t.Cleanup(fsrv.Close)
+	return fsrv
+}
+
+// readTree returns the content of the file at p in fsrv, or false if it is
+// missing.
+func readTree(t *testing.T, fsrv files.Files, p string) (string, bool) {
+	ctx := context.Background()
+	info, err := fsrv.Resolve(ctx, 1, p, false)
+	if err != nil {
+		return "", false
+	}
+	rc, err := fsrv.ReadFile(ctx, info.Node, 0, 0)
+	if err != nil {
+		t.Fatalf("ReadFile(%s) failed: %v", p, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadFile(%s) failed: %v", p, err)
+	}
+	return string(data), true
+}
+
+func TestMirror(t *testing.T) {
+	ctx := context.Background()
+	fsrv := setupTestFiles(t)
+	if err := fsrv.CreateEntry(ctx, 1, "docs", filetree.DirectoryKind, "", nil, nil); err != nil {
+		t.Fatalf("CreateEntry failed: %v", err)
+	}
+	docs, _ := fsrv.Lookup(ctx, 1, "docs")
+	if err := fsrv.CreateEntry(ctx, docs.Node, "a.txt", filetree.FileKind, "", nil, strings.NewReader("hello")); err != nil {
+		t.Fatalf("CreateEntry failed: %v", err)
+	}
+	if err := fsrv.CreateEntry(ctx, 1, "link", filetree.SymbolicLinkKind, "docs/a.txt", nil, nil); err != nil {
+		t.Fatalf("CreateEntry failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	m := New(fsrv, 1, dir)
+	if err := m.Populate(ctx); err != nil {
+		t.Fatalf("Populate failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "docs", "a.txt")); err != nil || string(data) != "hello" {
+		t.Errorf("populated docs/a.txt = %q, %v", data, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "link")); err != nil || target != "docs/a.txt" {
+		t.Errorf("populated link = %q, %v", target, err)
+	}
+
+	// An unchanged file is not rewritten
+	before, _ := fsrv.Lookup(ctx, docs.Node, "a.txt")
+	if err := m.Apply(ctx, "docs/a.txt"); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if after, _ := fsrv.Lookup(ctx, docs.Node, "a.txt"); after.Node != before.Node {
+		t.Errorf("Apply of an unchanged file replaced it")
+	}
+
+	os.WriteFile(filepath.Join(dir, "docs", "a.txt"), []byte("changed"), 0644)
+	os.MkdirAll(filepath.Join(dir, "new", "deep"), 0755)
+	os.WriteFile(filepath.Join(dir, "new", "deep", "b.txt"), []byte("b"), 0644)
+	os.Remove(filepath.Join(dir, "link"))
+	for _, p := range []string{"docs/a.txt", "new", "link"} {
+		if err := m.Apply(ctx, p); err != nil {
+			t.Fatalf("Apply(%s) failed: %v", p, err)
+		}
+	}
+	if data, _ := readTree(t, fsrv, "docs/a.txt"); data != "changed" {
+		t.Errorf("docs/a.txt = %q, want changed", data)
+	}
+	if data, _ := readTree(t, fsrv, "new/deep/b.txt"); data != "b" {
+		t.Errorf("new/deep/b.txt = %q, want b", data)
+	}
+	if _, err := fsrv.Lookup(ctx, 1, "link"); err == nil {
+		t.Errorf("link was not removed")
+	}
+
+	// Applying the root reconciles the whole tree
+	os.RemoveAll(filepath.Join(dir, "new"))
+	if err := m.Apply(ctx, "."); err != nil {
+		t.Fatalf("Apply(.) failed: %v", err)
+	}
+	if _, ok := readTree(t, fsrv, "new/deep/b.txt"); ok {
+		t.Errorf("new/deep/b.txt was not removed")
+	}
+}
+
+func TestMirrorWatch(t *testing.T) {
+	fsrv := setupTestFiles(t)
+	dir := t.TempDir()
+	m := New(fsrv, 1, dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := m.Populate(ctx); err != nil {
+		t.Fatalf("Populate failed: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- m.Watch(ctx, 20*time.Millisecond) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Watch returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	time.Sleep(50 * time.Millisecond)
+	os.WriteFile(filepath.Join(dir, "sub", "c.txt"), []byte("watched"), 0644)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, _ := readTree(t, fsrv, "sub/c.txt"); data == "watched" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sub/c.txt was not applied to the tree")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Watch failed: %v", err)
+	}
+}
+
+func TestMirrorPoll(t *testing.T) {
+	fsrv := setupTestFiles(t)
+	dir := t.TempDir()
+	m := New(fsrv, 1, dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	os.MkdirAll(filepath.Join(dir, "old"), 0755)
+	os.WriteFile(filepath.Join(dir, "old", "a.txt"), []byte("old"), 0644)
+	if err := m.Apply(ctx, "."); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- m.Poll(ctx, 10*time.Millisecond, 30*time.Millisecond) }()
+	time.Sleep(50 * time.Millisecond)
+
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "sub", "c.txt"), []byte("polled"), 0644)
+	os.RemoveAll(filepath.Join(dir, "old"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := readTree(t, fsrv, "sub/c.txt")
+		_, stale := readTree(t, fsrv, "old/a.txt")
+		if data == "polled" && !stale {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("changes were not applied to the tree: sub/c.txt %q, old/a.txt present %v", data, stale)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := fsrv.Resolve(ctx, 1, "old", false); err == nil {
+		t.Errorf("old was not removed")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Poll failed: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package localdir
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// entryState is what a poll compares to find the entries of the local
+// directory that changed. The modification time of a directory is left out
+// as it changes with its entries, which are compared themselves.
+type entryState struct {
+	size    int64
+	mode    fs.FileMode
+	modTime int64
+}
+
+// Poll applies the changes made to the local directory to the tree until ctx
+// is done, by walking the directory every interval and comparing each entry
+// with the previous walk. It works where the directory cannot be watched,
+// such as on platforms without inotify or on network file systems. Changes
+// are applied once no further change was seen for settle. Failures to apply
+// a change are logged.
+func (m *Mirror) Poll(ctx context.Context, interval, settle time.Duration) error {
+	prev, err := m.scan()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	pending := make(map[string]bool)
+	var lastChange time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			cur, err := m.scan()
+			if err != nil {
+				log.Printf("Failed to scan %s: %v", m.dir, err)
+				continue
+			}
+			changed := false
+			for rel, state := range cur {
+				if old, ok := prev[rel]; !ok || old != state {
+					pending[rel] = true
+					changed = true
+				}
+			}
+			for rel := range prev {
+				if _, ok := cur[rel]; !ok {
+					pending[rel] = true
+					changed = true
+				}
+			}
+			prev = cur
+			if changed {
+				lastChange = now
+			}
+			if len(pending) == 0 || now.Sub(lastChange) < settle {
+				continue
+			}
+
+			paths := make([]string, 0, len(pending))
+			for rel := range pending {
+				paths = append(paths, rel)
+			}
+			clear(pending)
+			for _, rel := range outermost(paths) {
+				if err := m.Apply(ctx, rel); err != nil {
+					log.Printf("Failed to apply change to /%s: %v", rel, err)
+				}
+			}
+		}
+	}
+}
+
+// scan returns the state of each entry below the local directory by its
+// slash separated path relative to it. Entries removed during the walk are
+// left out.
+func (m *Mirror) scan() (map[string]entryState, error) {
+	states := make(map[string]entryState)
+	err := filepath.WalkDir(m.dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if p == m.dir {
+				return err
+			}
+			return nil
+		}
+		if p == m.dir {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(m.dir, p)
+		if err != nil {
+			return nil
+		}
+		state := entryState{mode: info.Mode()}
+		if !info.IsDir() {
+			state.size = info.Size()
+			state.modTime = info.ModTime().UnixNano()
+		}
+		states[filepath.ToSlash(rel)] = state
+		return nil
+	})
+	return states, err
+}
+
+// outermost sorts paths and drops those below another of them, as applying
+// a directory reconciles everything below it.
+func outermost(paths []string) []string {
+	slices.Sort(paths)
+	result := paths[:0]
+	for _, rel := range paths {
+		if n := len(result); n > 0 && strings.HasPrefix(rel, result[n-1]+"/") {
+			continue
+		}
+		result = append(result, rel)
+	}
+	return result
+}
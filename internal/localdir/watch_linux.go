@@ -0,0 +1,125 @@
+//go:build linux
+
+package localdir
+
+import (
+	"context"
+	"encoding/binary"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// Watch applies the changes made to the local directory to the tree, using
+// inotify, until ctx is done. Changes are applied once no further change was
+// seen for settle, so a file is not uploaded in the middle of being written.
+// Failures to apply a change are logged.
+func (m *Mirror) Watch(ctx context.Context, settle time.Duration) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	// A non-blocking descriptor is read through the runtime poller, so
+	// closing it ends a pending read
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer f.Close()
+
+	watches := make(map[int32]string)
+	watchTree := func(rel string) {
+		filepath.WalkDir(m.localPath(rel), func(p string, entry fs.DirEntry, err error) error {
+			if err != nil || !entry.IsDir() {
+				return nil
+			}
+			wd, err := syscall.InotifyAddWatch(fd, p, watchMask)
+			if err != nil {
+				log.Printf("Failed to watch %s: %v", p, err)
+				return nil
+			}
+			sub, _ := filepath.Rel(m.dir, p)
+			watches[int32(wd)] = filepath.ToSlash(sub)
+			return nil
+		})
+	}
+	watchTree(".")
+
+	events := make(chan []byte)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			buf := make([]byte, 64*1024)
+			n, err := f.Read(buf)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case events <- buf[:n]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	pending := make(map[string]bool)
+	timer := time.NewTimer(settle)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-readErr:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		case buf := <-events:
+			for len(buf) >= syscall.SizeofInotifyEvent {
+				wd := int32(binary.NativeEndian.Uint32(buf[0:]))
+				mask := binary.NativeEndian.Uint32(buf[4:])
+				nameLen := int(binary.NativeEndian.Uint32(buf[12:]))
+				name := strings.TrimRight(string(buf[syscall.SizeofInotifyEvent:syscall.SizeofInotifyEvent+nameLen]), "\x00")
+				buf = buf[syscall.SizeofInotifyEvent+nameLen:]
+
+				dir, ok := watches[wd]
+				if mask&syscall.IN_IGNORED != 0 {
+					delete(watches, wd)
+					continue
+				}
+				if !ok || name == "" {
+					continue
+				}
+				rel := path.Join(dir, name)
+				if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					watchTree(rel)
+				}
+				pending[rel] = true
+			}
+			timer.Reset(settle)
+		case <-timer.C:
+			paths := make([]string, 0, len(pending))
+			for rel := range pending {
+				paths = append(paths, rel)
+			}
+			clear(pending)
+			slices.Sort(paths)
+			for _, rel := range paths {
+				if err := m.Apply(ctx, rel); err != nil {
+					log.Printf("Failed to apply change to /%s: %v", rel, err)
+				}
+			}
+		}
+	}
+}
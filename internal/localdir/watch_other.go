@@ -0,0 +1,18 @@
+//go:build !linux
+
+package localdir
+
+import (
+	"context"
+	"time"
+)
+
+// pollInterval is how often Watch walks the local directory for changes.
+const pollInterval = time.Second
+
+// Watch applies the changes made to the local directory to the tree until
+// ctx is done. Without inotify the directory is polled every second; see
+// Poll.
+func (m *Mirror) Watch(ctx context.Context, settle time.Duration) error {
+	return m.Poll(ctx, pollInterval, settle)
+}
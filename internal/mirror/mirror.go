@@ -0,0 +1,131 @@
+// Package mirror keeps a local copy of every block of a file tree as the root
+// held by a slot evolves.
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+// Stats reports the progress of a mirror.
+type Stats struct {
+	Root    string `json:"root"`    // address of the root last mirrored completely
+	Blocks  int    `json:"blocks"`  // blocks referenced by the root
+	Fetched int    `json:"fetched"` // blocks copied while mirroring the root
+}
+
+// Mirror copies the blocks of the tree at a root link into local storage.
+// If the link is a slot link, each new root the slot holds is mirrored.
+// Blocks of earlier roots are kept.
+type Mirror struct {
+	root        content.ContentLink
+	source      storage.Storage
+	local       storage.Storage
+	slotService slots.Slots
+
+	mu    sync.Mutex
+	stats Stats
+}
+
+// New returns a mirror of the tree at root, read from source, into local.
+func New(root content.ContentLink, source, local storage.Storage, slotService slots.Slots) *Mirror {
+	return &Mirror{
+		root:        root,
+		source:      source,
+		local:       local,
+		slotService: slotService,
+	}
+}
+
+// Stats returns the progress of the mirror.
+func (m *Mirror) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// Sync copies the blocks of the current root that are not already in local
+// storage. It does nothing if the root was already mirrored.
+func (m *Mirror) Sync(ctx context.Context) (Stats, error) {
+	root := m.root
+	if root.Slot {
+		address, err := m.slotService.Get(ctx, root.Address)
+		if err != nil {
+			return m.Stats(), fmt.Errorf("failed to read slot %s: %w", root.Address, err)
+		}
+		root.Address = address
+		root.Slot = false
+	}
+	if current := m.Stats(); current.Root == root.Address {
+		return current, nil
+	}
+
+	// Directories and block lists are read from local storage once copied
+	stats := Stats{Root: root.Address}
+	seen := make(map[string]bool)
+	err := filetree.WalkBlocks(ctx, root, m.local, nil, func(address string) error {
+		if seen[address] {
+			return nil
+		}
+		seen[address] = true
+		stats.Blocks++
+		if m.local.Has(ctx, address) {
+			return nil
+		}
+		rc, ok := m.source.Get(ctx, address)
+		if !ok {
+			return fmt.Errorf("%w: %s", content.ErrBlockNotFound, address)
+		}
+		defer rc.Close()
+		if _, err := m.local.StoreAt(ctx, address, rc); err != nil {
+			return fmt.Errorf("failed to store %s: %w", address, err)
+		}
+		stats.Fetched++
+		return nil
+	})
+	if err != nil {
+		return m.Stats(), err
+	}
+	if syncer, ok := m.local.(storage.SyncStorage); ok {
+		if err := syncer.Sync(ctx); err != nil {
+			return m.Stats(), err
+		}
+	}
+
+	m.mu.Lock()
+	m.stats = stats
+	m.mu.Unlock()
+	return stats, nil
+}
+
+// Run syncs the mirror every interval until ctx is done, logging each new
+// root mirrored and each failure. A failed sync is retried at the next
+// interval. Blocks are fetched with background priority.
+func (m *Mirror) Run(ctx context.Context, interval time.Duration) {
+	ctx = storage.WithPriority(ctx, storage.PriorityBackground)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		previous := m.Stats().Root
+		stats, err := m.Sync(ctx)
+		switch {
+		case err != nil:
+			log.Printf("Failed to mirror %s: %v", m.root.Address, err)
+		case stats.Root != previous:
+			log.Printf("Mirrored root %s: %d blocks, %d fetched", stats.Root, stats.Blocks, stats.Fetched)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
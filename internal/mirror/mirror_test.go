@@ -0,0 +1,93 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+	"invariant/internal/slots"
+	"invariant/internal/storage"
+)
+
+func TestMirrorFollowsSlot(t *testing.T) {
+	ctx := context.Background()
+	source := storage.NewInMemoryStorage()
+	local := storage.NewInMemoryStorage()
+	memSlots := slots.NewMemorySlots("test-slots")
+
+	// A file large enough to be split into a block list
+	large := make([]byte, 5*1024*1024)
+	rand.Read(large)
+	fileLink, err := content.Write(bytes.NewReader(large), source, content.WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fileLink.Transforms) == 0 {
+		t.Fatalf("expected a block list link, got %+v", fileLink)
+	}
+	file := &filetree.FileEntry{BaseEntry: filetree.BaseEntry{Kind: filetree.FileKind, Name: "large.bin"}, Content: fileLink, Size: uint64(len(large))}
+	root, err := filetree.Put(ctx, content.ContentLink{}, "dir/large.bin", file, source, nil, content.WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memSlots.Create(ctx, "root", root.Address, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(content.ContentLink{Address: "root", Slot: true}, source, local, memSlots)
+	stats, err := m.Sync(ctx)
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if stats.Root != root.Address || stats.Fetched != stats.Blocks || stats.Blocks < 4 {
+		t.Errorf("stats = %+v, want every block of %s fetched", stats, root.Address)
+	}
+
+	// The file reads back from the local copy alone
+	rc, err := content.Read(fileLink, local, nil)
+	if err != nil {
+		t.Fatalf("Read from mirror failed: %v", err)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(data, large) {
+		t.Fatalf("mirrored file differs: %v", err)
+	}
+
+	// A new root only fetches the blocks it adds
+	small, _ := content.Write(bytes.NewReader([]byte("small")), source, content.WriterOptions{})
+	next, err := filetree.Put(ctx, root, "small.txt", &filetree.FileEntry{BaseEntry: filetree.BaseEntry{Kind: filetree.FileKind, Name: "small.txt"}, Content: small, Size: 5}, source, nil, content.WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memSlots.Update(ctx, "root", next.Address, root.Address, nil); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = m.Sync(ctx)
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if stats.Root != next.Address || stats.Fetched != 2 {
+		t.Errorf("stats = %+v, want the new root and small.txt fetched", stats)
+	}
+	var dir filetree.Directory
+	rc, err = content.Read(next, local, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(rc).Decode(&dir)
+	rc.Close()
+	if err != nil || len(dir) != 2 {
+		t.Errorf("mirrored root = %v, %v", dir, err)
+	}
+
+	// An unchanged root is not walked again
+	if stats, _ := m.Sync(ctx); stats.Fetched != 2 {
+		t.Errorf("unchanged root stats = %+v", stats)
+	}
+}
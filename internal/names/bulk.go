@@ -0,0 +1,148 @@
+package names
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrInvalidEntry is returned when a bulk load contains an entry without a
+// name or value, or a line that is not a JSON entry.
+var ErrInvalidEntry = errors.New("invalid name entry")
+
+// NamedEntry is a name and its entry, as exported and bulk loaded one per
+// line of an NDJSON stream.
+type NamedEntry struct {
+	Name string `json:"name"`
+	NameEntry
+}
+
+// Exporter is implemented by names services that can enumerate their entries.
+type Exporter interface {
+	// Export calls emit with every entry in name order, stopping at the first
+	// error emit returns.
+	Export(ctx context.Context, emit func(NamedEntry) error) error
+}
+
+// BulkLoadResult summarizes the changes made, or that would be made by a dry
+// run, by a bulk load.
+type BulkLoadResult struct {
+	Added     int  `json:"added"`
+	Updated   int  `json:"updated"`
+	Unchanged int  `json:"unchanged"`
+	DryRun    bool `json:"dryRun,omitempty"`
+}
+
+// ReadEntries reads an NDJSON stream of entries, skipping blank lines. Every
+// entry must have a name that is not reserved and, unless it is a tombstone,
+// a value, and no other fields than those of NamedEntry.
+func ReadEntries(r io.Reader) ([]NamedEntry, error) {
+	var entries []NamedEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var entry NamedEntry
+		dec := json.NewDecoder(strings.NewReader(text))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&entry)
+		if err == nil && dec.InputOffset() < int64(len(text)) {
+			err = errors.New("unexpected data after the entry")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidEntry, line, err)
+		}
+		if entry.Name == "" || (entry.Value == "" && !entry.Deleted) {
+			return nil, fmt.Errorf("%w: line %d: name and value are required", ErrInvalidEntry, line)
+		}
+		if IsReserved(entry.Name) {
+			return nil, fmt.Errorf("%w: line %d: %s is a reserved name", ErrInvalidEntry, line, entry.Name)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// BulkLoad puts entries into n, reporting how many were added, changed, or
+// already present. Tombstones are skipped. A dry run only reports what would
+// change.
+func BulkLoad(ctx context.Context, n Names, entries []NamedEntry, dryRun bool) (BulkLoadResult, error) {
+	result := BulkLoadResult{DryRun: dryRun}
+	for _, entry := range entries {
+		if entry.Deleted {
+			// Tombstones are only merged
+			continue
+		}
+		existing, err := n.Get(ctx, entry.Name)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			result.Added++
+		case err != nil:
+			return result, err
+		case existing.Value == entry.Value && slices.Equal(existing.Tokens, entry.Tokens):
+			result.Unchanged++
+			continue
+		default:
+			result.Updated++
+		}
+		if dryRun {
+			continue
+		}
+		if err := n.Put(ctx, entry.Name, entry.Value, entry.Tokens); err != nil {
+			return result, fmt.Errorf("failed to put %q: %w", entry.Name, err)
+		}
+	}
+	return result, nil
+}
+
+// sortedEntries returns a copy of the entries of store in name order,
+// without the tombstones older than ttl.
+func sortedEntries(store map[string]NameEntry, ttl time.Duration) []NamedEntry {
+	now := time.Now()
+	entries := make([]NamedEntry, 0, len(store))
+	for _, name := range slices.Sorted(maps.Keys(store)) {
+		if entry := store[name]; !entry.expired(ttl, now) {
+			entries = append(entries, NamedEntry{Name: name, NameEntry: entry.clone()})
+		}
+	}
+	return entries
+}
+
+// expiredTombstones returns the names of store whose tombstones are older
+// than ttl.
+func expiredTombstones(store map[string]NameEntry, ttl time.Duration) []string {
+	now := time.Now()
+	var names []string
+	for name, entry := range store {
+		if entry.expired(ttl, now) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// emitEntries calls emit with each of entries, stopping at the first error.
+func emitEntries(ctx context.Context, entries []NamedEntry, emit func(NamedEntry) error) error {
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := emit(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,10 +1,12 @@
 package names
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"invariant/internal/httputil"
+	"invariant/internal/identity"
 	"net/http"
 	"net/url"
 	"strings"
@@ -28,9 +30,26 @@ func NewClient(baseURL string, httpClient *http.Client) *Client {
 	}
 }
 
+// VerifiedID challenges the remote names service to prove it holds the
+// private key of its ID, returning the ID once the signed response is
+// verified.
+func (c *Client) VerifiedID() (string, error) {
+	return identity.ChallengeID(context.Background(), c.httpClient, fmt.Sprintf("%s/id", c.baseURL))
+}
+
 // Get retrieves the name entry for a given name.
 func (c *Client) Get(ctx context.Context, name string) (NameEntry, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s", c.baseURL, name), nil)
+	return c.GetWithToken(ctx, name, "")
+}
+
+// GetWithToken retrieves the name entry for a given name if it has token, for
+// example slots-v1. ErrNotFound is returned if the entry does not have token.
+func (c *Client) GetWithToken(ctx context.Context, name string, token string) (NameEntry, error) {
+	u := fmt.Sprintf("%s/%s", c.baseURL, name)
+	if token != "" {
+		u += "?token=" + url.QueryEscape(token)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
 		return NameEntry{}, err
 	}
@@ -56,8 +75,45 @@ func (c *Client) Get(ctx context.Context, name string) (NameEntry, error) {
 	return entry, nil
 }
 
-// Put updates or creates a name entry.
+// GetMany retrieves the entries of several names in a single request. Only the
+// entries that have token are returned, or all of them if token is empty.
+// Names that are not found are omitted from the result.
+func (c *Client) GetMany(ctx context.Context, names []string, token string) (map[string]NameEntry, error) {
+	body, err := json.Marshal(GetRequest{Names: names, Token: token})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/", c.baseURL), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	entries := make(map[string]NameEntry)
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Put updates or creates a name entry. It returns ErrReservedName for a
+// reserved name.
 func (c *Client) Put(ctx context.Context, name string, value string, tokens []string) error {
+	if IsReserved(name) {
+		return ErrReservedName
+	}
 	u, err := url.Parse(fmt.Sprintf("%s/%s", c.baseURL, name))
 	if err != nil {
 		return err
@@ -89,6 +145,51 @@ func (c *Client) Put(ctx context.Context, name string, value string, tokens []st
 	return nil
 }
 
+// PutIf updates or creates a name entry if the name satisfies cond. It
+// returns ErrPreconditionFailed if it does not, ErrNotSupported if the
+// remote service does not support conditional updates, and ErrReservedName
+// for a reserved name.
+func (c *Client) PutIf(ctx context.Context, name string, value string, tokens []string, cond Condition) error {
+	if IsReserved(name) {
+		return ErrReservedName
+	}
+	u, err := url.Parse(fmt.Sprintf("%s/%s", c.baseURL, name))
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("value", value)
+	q.Set("tokens", strings.Join(tokens, ","))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if cond.Match != "" {
+		req.Header.Set("If-Match", cond.Match)
+	}
+	if cond.NoneMatch != "" {
+		req.Header.Set("If-None-Match", cond.NoneMatch)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed:
+		return ErrPreconditionFailed
+	case http.StatusNotImplemented:
+		return ErrNotSupported
+	}
+	return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+}
+
 // Delete removes a name entry.
 func (c *Client) Delete(ctx context.Context, name string, expectedValue string) error {
 	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fmt.Sprintf("%s/%s", c.baseURL, name), nil)
@@ -144,5 +245,129 @@ func (c *Client) Lookup(ctx context.Context, id string) ([]string, error) {
 	return names, nil
 }
 
+// Export streams every entry of the remote service, calling emit with each
+// in name order.
+func (c *Client) Export(ctx context.Context, emit func(NamedEntry) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/export", c.baseURL), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotImplemented {
+		return ErrNotSupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for decoder.More() {
+		var entry NamedEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return err
+		}
+		if err := emit(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BulkLoad puts entries into the remote service in a single request. With
+// dryRun the service only reports what would change.
+func (c *Client) BulkLoad(ctx context.Context, entries []NamedEntry, dryRun bool) (BulkLoadResult, error) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return BulkLoadResult{}, err
+		}
+	}
+
+	u := fmt.Sprintf("%s/bulk", c.baseURL)
+	if dryRun {
+		u += "?dry-run=true"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, &body)
+	if err != nil {
+		return BulkLoadResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return BulkLoadResult{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusBadRequest {
+		return BulkLoadResult{}, ErrInvalidEntry
+	}
+	if resp.StatusCode != http.StatusOK {
+		return BulkLoadResult{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var result BulkLoadResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return BulkLoadResult{}, err
+	}
+	return result, nil
+}
+
+// Merge merges entries exported by another replica into the remote service
+// in a single request.
+func (c *Client) Merge(ctx context.Context, entries []NamedEntry) (MergeResult, error) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return MergeResult{}, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/merge", c.baseURL), &body)
+	if err != nil {
+		return MergeResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return MergeResult{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest:
+		return MergeResult{}, ErrInvalidEntry
+	case http.StatusNotImplemented:
+		return MergeResult{}, ErrNotSupported
+	default:
+		return MergeResult{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var result MergeResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return MergeResult{}, err
+	}
+	return result, nil
+}
+
 // Assert that Client implements the Names interface
 var _ Names = (*Client)(nil)
+
+// Assert that Client implements the Exporter interface
+var _ Exporter = (*Client)(nil)
+
+// Assert that Client implements the Merger interface
+var _ Merger = (*Client)(nil)
+
+// Assert that Client implements the ConditionalPutter interface
+var _ ConditionalPutter = (*Client)(nil)
@@ -62,3 +62,122 @@ func TestClient(t *testing.T) {
 		t.Fatalf("expected ErrNotFound, got %v", err)
 	}
 }
+
+func TestClient_TokensAndGetMany(t *testing.T) {
+	server := names.NewNamesServer(names.NewInMemoryNames())
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	ctx := context.Background()
+	client := names.NewClient(ts.URL, ts.Client())
+
+	slotsID := "1111111111111111111111111111111111111111111111111111111111111111"
+	storageID := "2222222222222222222222222222222222222222222222222222222222222222"
+	if err := client.Put(ctx, "slots", slotsID, []string{"slots-v1"}); err != nil {
+		t.Fatalf("Put error: %v", err)
+	}
+	if err := client.Put(ctx, "storage", storageID, []string{"storage-v1", "has-v1"}); err != nil {
+		t.Fatalf("Put error: %v", err)
+	}
+
+	entry, err := client.GetWithToken(ctx, "slots", "slots-v1")
+	if err != nil || entry.Value != slotsID {
+		t.Fatalf("expected %s, got %v, %v", slotsID, entry, err)
+	}
+	if _, err := client.GetWithToken(ctx, "storage", "slots-v1"); err != names.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	all, err := client.GetMany(ctx, []string{"slots", "storage", "missing"}, "")
+	if err != nil {
+		t.Fatalf("GetMany error: %v", err)
+	}
+	if len(all) != 2 || all["slots"].Value != slotsID || all["storage"].Value != storageID {
+		t.Fatalf("unexpected entries: %v", all)
+	}
+
+	filtered, err := client.GetMany(ctx, []string{"slots", "storage"}, "storage-v1")
+	if err != nil {
+		t.Fatalf("GetMany error: %v", err)
+	}
+	if len(filtered) != 1 || filtered["storage"].Value != storageID {
+		t.Fatalf("unexpected entries: %v", filtered)
+	}
+}
+
+func TestClient_ExportAndBulkLoad(t *testing.T) {
+	source := names.NewInMemoryNames()
+	sourceServer := httptest.NewServer(names.NewNamesServer(source).Handler())
+	defer sourceServer.Close()
+	target := names.NewInMemoryNames()
+	targetServer := httptest.NewServer(names.NewNamesServer(target).Handler())
+	defer targetServer.Close()
+
+	ctx := context.Background()
+	source.Put(ctx, "storage", "storage-id", []string{"storage-v1"})
+	source.Put(ctx, "slots", "slots-id", []string{"slots-v1"})
+	source.Put(ctx, "finder", "finder-id", nil)
+	target.Put(ctx, "slots", "old-slots-id", []string{"slots-v1"})
+	target.Put(ctx, "finder", "finder-id", nil)
+
+	var exported []names.NamedEntry
+	err := names.NewClient(sourceServer.URL, sourceServer.Client()).Export(ctx, func(entry names.NamedEntry) error {
+		exported = append(exported, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Export error: %v", err)
+	}
+	if len(exported) != 3 || exported[0].Name != "finder" || exported[2].Name != "storage" || exported[2].Value != "storage-id" {
+		t.Fatalf("unexpected export: %v", exported)
+	}
+
+	client := names.NewClient(targetServer.URL, targetServer.Client())
+	want := names.BulkLoadResult{Added: 1, Updated: 1, Unchanged: 1, DryRun: true}
+	if result, err := client.BulkLoad(ctx, exported, true); err != nil || result != want {
+		t.Fatalf("expected %+v, got %+v, %v", want, result, err)
+	}
+	if entry, _ := target.Get(ctx, "slots"); entry.Value != "old-slots-id" {
+		t.Fatalf("dry run changed slots to %q", entry.Value)
+	}
+
+	want.DryRun = false
+	if result, err := client.BulkLoad(ctx, exported, false); err != nil || result != want {
+		t.Fatalf("expected %+v, got %+v, %v", want, result, err)
+	}
+	for _, entry := range exported {
+		got, err := target.Get(ctx, entry.Name)
+		if err != nil || got.Value != entry.Value {
+			t.Fatalf("expected %s to be %s, got %v, %v", entry.Name, entry.Value, got, err)
+		}
+	}
+
+	if _, err := client.BulkLoad(ctx, []names.NamedEntry{{Name: "empty"}}, false); err != names.ErrInvalidEntry {
+		t.Fatalf("expected ErrInvalidEntry, got %v", err)
+	}
+}
+
+func TestClient_PutIf(t *testing.T) {
+	ctx := context.Background()
+	server := names.NewNamesServer(names.NewInMemoryNames())
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+	client := names.NewClient(ts.URL, ts.Client())
+
+	create := names.Condition{NoneMatch: names.AnyValue}
+	if err := client.PutIf(ctx, "name", "v1", nil, create); err != nil {
+		t.Fatalf("PutIf error: %v", err)
+	}
+	if err := client.PutIf(ctx, "name", "v2", nil, create); err != names.ErrPreconditionFailed {
+		t.Fatalf("expected ErrPreconditionFailed creating an existing name, got %v", err)
+	}
+	if err := client.PutIf(ctx, "name", "v2", nil, names.Condition{Match: "v0"}); err != names.ErrPreconditionFailed {
+		t.Fatalf("expected ErrPreconditionFailed for a stale value, got %v", err)
+	}
+	if err := client.PutIf(ctx, "name", "v2", nil, names.Condition{Match: "v1"}); err != nil {
+		t.Fatalf("PutIf error: %v", err)
+	}
+	if entry, err := client.Get(ctx, "name"); err != nil || entry.Value != "v2" {
+		t.Fatalf("expected v2, got %v (err: %v)", entry.Value, err)
+	}
+}
@@ -3,22 +3,62 @@ package names
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	ErrNotSupported = errors.New("operation not supported")
+	ErrNotSecure    = errors.New("DNS response is not DNSSEC validated")
 )
 
+// DefaultDNSCacheTTL is how long records are cached when the resolver does not
+// report their TTL.
+const DefaultDNSCacheTTL = time.Minute
+
 // Resolver defines the interface for DNS TXT record lookups
 type Resolver interface {
 	LookupTXT(ctx context.Context, name string) ([]string, error)
 }
 
+// TXTRecords are the TXT records of a name along with how long they may be
+// cached and whether they were DNSSEC validated.
+type TXTRecords struct {
+	Texts         []string
+	TTL           time.Duration
+	Authenticated bool
+}
+
+// RecordResolver is implemented by resolvers that report the TTL and DNSSEC
+// status of TXT records, such as DNSResolver.
+type RecordResolver interface {
+	LookupTXTRecords(ctx context.Context, name string) (TXTRecords, error)
+}
+
+// SRVResolver is implemented by resolvers that can look up SRV records, such
+// as net.Resolver.
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
 // DNSClient implements the Names interface using DNS TXT records
 type DNSClient struct {
-	resolver Resolver
+	resolver      Resolver
+	requireSecure bool
+	defaultTTL    time.Duration
+	now           func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	entry   NameEntry
+	expires time.Time
 }
 
 // NewDNSClient creates a new DNSClient with an optional custom resolver.
@@ -28,13 +68,77 @@ func NewDNSClient(resolver Resolver) *DNSClient {
 		resolver = net.DefaultResolver
 	}
 	return &DNSClient{
-		resolver: resolver,
+		resolver:   resolver,
+		defaultTTL: DefaultDNSCacheTTL,
+		now:        time.Now,
+		cache:      make(map[string]dnsCacheEntry),
 	}
 }
 
+// WithRequireSecure requires the invariant: records to be DNSSEC validated.
+// The resolver must implement RecordResolver; unvalidated records are rejected
+// with ErrNotSecure.
+func (c *DNSClient) WithRequireSecure(requireSecure bool) *DNSClient {
+	c.requireSecure = requireSecure
+	return c
+}
+
+// WithDefaultTTL sets how long records are cached when the resolver does not
+// report their TTL. Zero disables caching of such records.
+func (c *DNSClient) WithDefaultTTL(ttl time.Duration) *DNSClient {
+	c.defaultTTL = ttl
+	return c
+}
+
 // Get retrieves the NameEntry for a given name using DNS TXT records.
-// It looks for a TXT record with the prefix "invariant:"
+// It looks for a TXT record with the prefix "invariant:". Entries are cached
+// for the TTL of their records.
 func (c *DNSClient) Get(ctx context.Context, name string) (NameEntry, error) {
+	c.mu.Lock()
+	cached, ok := c.cache[name]
+	if ok && c.now().Before(cached.expires) {
+		c.mu.Unlock()
+		return cached.entry, nil
+	}
+	delete(c.cache, name)
+	c.mu.Unlock()
+
+	records, err := c.lookupTXT(ctx, name)
+	if err != nil {
+		return NameEntry{}, err
+	}
+
+	entry, err := parseTXT(records.Texts)
+	if err != nil {
+		return NameEntry{}, err
+	}
+	if c.requireSecure && !records.Authenticated {
+		return NameEntry{}, ErrNotSecure
+	}
+
+	if records.TTL > 0 {
+		c.mu.Lock()
+		c.cache[name] = dnsCacheEntry{entry: entry, expires: c.now().Add(records.TTL)}
+		c.mu.Unlock()
+	}
+	return entry, nil
+}
+
+// lookupTXT retrieves the TXT records of name, using the TTL and DNSSEC status
+// reported by the resolver if it can report them.
+func (c *DNSClient) lookupTXT(ctx context.Context, name string) (TXTRecords, error) {
+	if rr, ok := c.resolver.(RecordResolver); ok {
+		records, err := rr.LookupTXTRecords(ctx, name)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return TXTRecords{}, ErrNotFound
+		}
+		return records, err
+	}
+	if c.requireSecure {
+		return TXTRecords{}, ErrNotSecure
+	}
+
 	txts, err := c.resolver.LookupTXT(ctx, name)
 	if err != nil {
 		// Differentiate between generic lookup errors and not found if possible.
@@ -42,12 +146,16 @@ func (c *DNSClient) Get(ctx context.Context, name string) (NameEntry, error) {
 		// if no valid records are found after filtering.
 		var dnsErr *net.DNSError
 		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
-			return NameEntry{}, ErrNotFound
+			return TXTRecords{}, ErrNotFound
 		}
 		// If it's another error, we could return it or still treat it as not found for our purposes
 		// but let's see if we get any TXT records at all.
 	}
+	return TXTRecords{Texts: txts, TTL: c.defaultTTL}, nil
+}
 
+// parseTXT returns the entry of the first invariant: record in txts.
+func parseTXT(txts []string) (NameEntry, error) {
 	for _, txt := range txts {
 		if after, ok := strings.CutPrefix(txt, "invariant:"); ok {
 			content := after
@@ -75,6 +183,33 @@ func (c *DNSClient) Get(ctx context.Context, name string) (NameEntry, error) {
 	return NameEntry{}, ErrNotFound
 }
 
+// LookupAddress resolves name directly to the address of a service supporting
+// protocol, without consulting discovery, using the SRV records of
+// _<protocol>._tcp.<name>. The target with the lowest priority is returned as
+// an http:// URL.
+func (c *DNSClient) LookupAddress(ctx context.Context, name string, protocol string) (string, error) {
+	var sr SRVResolver = net.DefaultResolver
+	if r, ok := c.resolver.(SRVResolver); ok {
+		sr = r
+	}
+	_, addrs, err := sr.LookupSRV(ctx, protocol, "tcp", name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	addrs = slices.DeleteFunc(addrs, func(a *net.SRV) bool { return a.Target == "." || a.Target == "" })
+	if len(addrs) == 0 {
+		return "", ErrNotFound
+	}
+	// net.Resolver orders the records by priority and randomizes them by weight
+	best := slices.MinFunc(addrs, func(a, b *net.SRV) int { return int(a.Priority) - int(b.Priority) })
+	host := strings.TrimSuffix(best.Target, ".")
+	return fmt.Sprintf("http://%s", net.JoinHostPort(host, fmt.Sprint(best.Port))), nil
+}
+
 // Put is not supported by the DNS client
 func (c *DNSClient) Put(ctx context.Context, name string, value string, tokens []string) error {
 	return ErrNotSupported
@@ -2,9 +2,11 @@ package names
 
 import (
 	"context"
+	"encoding/binary"
 	"net"
 	"reflect"
 	"testing"
+	"time"
 )
 
 type mockResolver struct {
@@ -134,3 +136,138 @@ func TestDNSClientUnsupportedMethods(t *testing.T) {
 		t.Errorf("expected Delete to return ErrNotSupported, got: %v", err)
 	}
 }
+
+type mockRecordResolver struct {
+	records TXTRecords
+	srvs    []*net.SRV
+	lookups int
+}
+
+func (m *mockRecordResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return m.records.Texts, nil
+}
+
+func (m *mockRecordResolver) LookupTXTRecords(ctx context.Context, name string) (TXTRecords, error) {
+	m.lookups++
+	return m.records, nil
+}
+
+func (m *mockRecordResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if len(m.srvs) == 0 {
+		return "", nil, &net.DNSError{IsNotFound: true, Name: name}
+	}
+	return "", m.srvs, nil
+}
+
+func TestDNSClientCacheAndSecure(t *testing.T) {
+	ctx := context.Background()
+	resolver := &mockRecordResolver{
+		records: TXTRecords{Texts: []string{"invariant:value;names-v1"}, TTL: time.Minute},
+	}
+	now := time.Now()
+	client := NewDNSClient(resolver)
+	client.now = func() time.Time { return now }
+
+	for range 2 {
+		if entry, err := client.Get(ctx, "test.example.com"); err != nil || entry.Value != "value" {
+			t.Fatalf("unexpected entry %v, %v", entry, err)
+		}
+	}
+	if resolver.lookups != 1 {
+		t.Errorf("expected the second Get to be cached, got %d lookups", resolver.lookups)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := client.Get(ctx, "test.example.com"); err != nil {
+		t.Fatalf("Get error: %v", err)
+	}
+	if resolver.lookups != 2 {
+		t.Errorf("expected the expired entry to be looked up again, got %d lookups", resolver.lookups)
+	}
+
+	secure := NewDNSClient(resolver).WithRequireSecure(true)
+	if _, err := secure.Get(ctx, "test.example.com"); err != ErrNotSecure {
+		t.Errorf("expected ErrNotSecure, got %v", err)
+	}
+	resolver.records.Authenticated = true
+	if _, err := secure.Get(ctx, "test.example.com"); err != nil {
+		t.Errorf("expected authenticated records to be accepted, got %v", err)
+	}
+
+	// Resolvers that cannot report the DNSSEC status are rejected
+	insecure := NewDNSClient(&mockResolver{}).WithRequireSecure(true)
+	if _, err := insecure.Get(ctx, "test.example.com"); err != ErrNotSecure {
+		t.Errorf("expected ErrNotSecure, got %v", err)
+	}
+}
+
+func TestDNSClientLookupAddress(t *testing.T) {
+	ctx := context.Background()
+	resolver := &mockRecordResolver{
+		srvs: []*net.SRV{
+			{Target: "backup.example.com.", Port: 8081, Priority: 20},
+			{Target: "storage.example.com.", Port: 8080, Priority: 10},
+		},
+	}
+	client := NewDNSClient(resolver)
+
+	addr, err := client.LookupAddress(ctx, "example.com", "storage-v1")
+	if err != nil {
+		t.Fatalf("LookupAddress error: %v", err)
+	}
+	if addr != "http://storage.example.com:8080" {
+		t.Errorf("expected http://storage.example.com:8080, got %s", addr)
+	}
+
+	resolver.srvs = nil
+	if _, err := client.LookupAddress(ctx, "example.com", "storage-v1"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestDNSResolver(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket error: %v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := buf[:n]
+		questionEnd, _ := skipName(query, 12)
+		questionEnd += 4
+
+		resp := binary.BigEndian.AppendUint16(nil, binary.BigEndian.Uint16(query))
+		resp = binary.BigEndian.AppendUint16(resp, 1<<15|dnsFlagRD|dnsFlagAD)
+		resp = binary.BigEndian.AppendUint16(resp, 1)
+		resp = binary.BigEndian.AppendUint16(resp, 1)
+		resp = binary.BigEndian.AppendUint16(resp, 0)
+		resp = binary.BigEndian.AppendUint16(resp, 0)
+		resp = append(resp, query[12:questionEnd]...)
+
+		text := "invariant:value;names-v1"
+		resp = append(resp, 0xc0, 12)
+		resp = binary.BigEndian.AppendUint16(resp, dnsTypeTXT)
+		resp = binary.BigEndian.AppendUint16(resp, dnsClassINET)
+		resp = binary.BigEndian.AppendUint32(resp, 300)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(text)+1))
+		resp = append(resp, byte(len(text)))
+		resp = append(resp, text...)
+		conn.WriteTo(resp, addr)
+	}()
+
+	resolver := NewDNSResolver(conn.LocalAddr().String())
+	records, err := resolver.LookupTXTRecords(context.Background(), "test.example.com")
+	if err != nil {
+		t.Fatalf("LookupTXTRecords error: %v", err)
+	}
+	expected := TXTRecords{Texts: []string{"invariant:value;names-v1"}, TTL: 300 * time.Second, Authenticated: true}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("expected %+v, got %+v", expected, records)
+	}
+}
@@ -0,0 +1,267 @@
+package names
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeTXT   = 16
+	dnsTypeOPT   = 41
+	dnsClassINET = 1
+
+	dnsFlagRD = 1 << 8
+	dnsFlagAD = 1 << 5
+	dnsFlagTC = 1 << 9
+
+	dnsRcodeNXDomain = 3
+
+	// dnsUDPSize is the UDP payload size advertised with EDNS(0).
+	dnsUDPSize = 1232
+)
+
+var errInvalidDNSMessage = errors.New("invalid DNS message")
+
+// DNSResolver queries DNS servers directly for TXT records, reporting their
+// TTL and whether the server validated them with DNSSEC. The server must be a
+// trusted, validating resolver for the DNSSEC status to be meaningful.
+type DNSResolver struct {
+	servers []string
+	timeout time.Duration
+}
+
+var (
+	_ Resolver       = (*DNSResolver)(nil)
+	_ RecordResolver = (*DNSResolver)(nil)
+)
+
+// NewDNSResolver creates a resolver that queries servers, given as host or
+// host:port. If no servers are given, the nameservers of /etc/resolv.conf are
+// used.
+func NewDNSResolver(servers ...string) *DNSResolver {
+	if len(servers) == 0 {
+		servers = systemNameservers()
+	}
+	var addrs []string
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		addrs = append(addrs, server)
+	}
+	return &DNSResolver{servers: addrs, timeout: 5 * time.Second}
+}
+
+// LookupTXT returns the TXT records of name.
+func (r *DNSResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, err := r.LookupTXTRecords(ctx, name)
+	return records.Texts, err
+}
+
+// LookupTXTRecords returns the TXT records of name with the smallest TTL of
+// the records and whether the server reported them as DNSSEC validated.
+func (r *DNSResolver) LookupTXTRecords(ctx context.Context, name string) (TXTRecords, error) {
+	if len(r.servers) == 0 {
+		return TXTRecords{}, errors.New("no DNS servers configured")
+	}
+	var lastErr error
+	for _, server := range r.servers {
+		records, err := r.query(ctx, server, name)
+		if err == nil {
+			return records, nil
+		}
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return TXTRecords{}, err
+		}
+		lastErr = err
+	}
+	return TXTRecords{}, lastErr
+}
+
+func (r *DNSResolver) query(ctx context.Context, server string, name string) (TXTRecords, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	id := uint16(rand.Uint32())
+	msg := buildTXTQuery(id, name)
+
+	resp, err := exchange(ctx, "udp", server, msg)
+	if err != nil {
+		return TXTRecords{}, err
+	}
+	if len(resp) >= 4 && binary.BigEndian.Uint16(resp[2:])&dnsFlagTC != 0 {
+		if resp, err = exchange(ctx, "tcp", server, msg); err != nil {
+			return TXTRecords{}, err
+		}
+	}
+	return parseTXTResponse(id, name, server, resp)
+}
+
+// exchange sends msg to server and returns the response.
+func exchange(ctx context.Context, network string, server string, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+		if _, err := conn.Write(append(framed, msg...)); err != nil {
+			return nil, err
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, dnsUDPSize)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp[:n], nil
+}
+
+// buildTXTQuery builds a recursive query for the TXT records of name. The AD
+// bit is set and EDNS(0) is used with the DO bit so a validating server
+// reports whether the answer is authenticated.
+func buildTXTQuery(id uint16, name string) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, dnsFlagRD|dnsFlagAD)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // questions
+	msg = binary.BigEndian.AppendUint16(msg, 0) // answers
+	msg = binary.BigEndian.AppendUint16(msg, 0) // authorities
+	msg = binary.BigEndian.AppendUint16(msg, 1) // additional
+
+	for label := range strings.SplitSeq(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeTXT)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassINET)
+
+	// OPT pseudo-record with the DO bit
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeOPT)
+	msg = binary.BigEndian.AppendUint16(msg, dnsUDPSize)
+	msg = binary.BigEndian.AppendUint32(msg, 1<<15)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	return msg
+}
+
+// parseTXTResponse extracts the TXT records from the response to the query id.
+func parseTXTResponse(id uint16, name string, server string, msg []byte) (TXTRecords, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id {
+		return TXTRecords{}, errInvalidDNSMessage
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	switch rcode := flags & 0xf; rcode {
+	case 0:
+	case dnsRcodeNXDomain:
+		return TXTRecords{}, &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+	default:
+		return TXTRecords{}, &net.DNSError{Err: "server misbehaving", Name: name, Server: server}
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for range questions {
+		var ok bool
+		if off, ok = skipName(msg, off); !ok || off+4 > len(msg) {
+			return TXTRecords{}, errInvalidDNSMessage
+		}
+		off += 4
+	}
+
+	records := TXTRecords{Authenticated: flags&dnsFlagAD != 0}
+	for range answers {
+		var ok bool
+		if off, ok = skipName(msg, off); !ok || off+10 > len(msg) {
+			return TXTRecords{}, errInvalidDNSMessage
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		ttl := time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return TXTRecords{}, errInvalidDNSMessage
+		}
+		data := msg[off : off+length]
+		off += length
+
+		if rtype != dnsTypeTXT {
+			continue
+		}
+		// A TXT record is a sequence of character strings that form one text
+		var text strings.Builder
+		for len(data) > 0 {
+			n := int(data[0])
+			if 1+n > len(data) {
+				return TXTRecords{}, errInvalidDNSMessage
+			}
+			text.Write(data[1 : 1+n])
+			data = data[1+n:]
+		}
+		records.Texts = append(records.Texts, text.String())
+		if records.TTL == 0 || ttl < records.TTL {
+			records.TTL = ttl
+		}
+	}
+	return records, nil
+}
+
+// skipName returns the offset following the possibly compressed name at off.
+func skipName(msg []byte, off int) (int, bool) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, true
+		case n&0xc0 == 0xc0:
+			return off + 2, off+2 <= len(msg)
+		default:
+			off += 1 + n
+		}
+	}
+	return 0, false
+}
+
+// systemNameservers returns the nameservers configured in /etc/resolv.conf.
+func systemNameservers() []string {
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	var servers []string
+	for line := range strings.Lines(string(data)) {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"invariant/internal/identity"
@@ -15,12 +16,29 @@ import (
 // Assert that FileSystemNames implements the Names interface
 var _ Names = (*FileSystemNames)(nil)
 
+// Assert that FileSystemNames implements the Exporter interface
+var _ Exporter = (*FileSystemNames)(nil)
+
+// Assert that FileSystemNames implements the Merger interface
+var _ Merger = (*FileSystemNames)(nil)
+
 // Assert that FileSystemNames implements the identity.Provider interface
 var _ identity.Identity = (*FileSystemNames)(nil)
 
 type FileSystemNames struct {
 	id    string
 	store *journal.Store[string, NameEntry]
+
+	// mu serializes changes so the index is updated in the order the store
+	// is, and guards the index.
+	mu    sync.RWMutex
+	index valueIndex
+
+	// Tombstones of deleted names are kept for tombstoneTTL and removed when
+	// a name is deleted or merged after tombstonePurgeInterval. lastPurge is
+	// guarded by mu.
+	tombstoneTTL time.Duration
+	lastPurge    time.Time
 }
 
 func NewFileSystemNames(baseDir string, snapshotInterval time.Duration) (*FileSystemNames, error) {
@@ -44,10 +62,19 @@ func NewFileSystemNames(baseDir string, snapshotInterval time.Duration) (*FileSy
 		return nil, err
 	}
 
-	return &FileSystemNames{
-		id:    id,
-		store: store,
-	}, nil
+	s := &FileSystemNames{id: id, store: store, tombstoneTTL: DefaultTombstoneTTL}
+	store.Read(func(store map[string]NameEntry) {
+		s.index = newValueIndex(store)
+	})
+	return s, nil
+}
+
+// WithTombstoneTTL keeps the tombstones of deleted names for ttl rather than
+// DefaultTombstoneTTL. A name deleted on a replica that has not merged its
+// tombstone within ttl may reappear when the replica is merged.
+func (s *FileSystemNames) WithTombstoneTTL(ttl time.Duration) *FileSystemNames {
+	s.tombstoneTTL = ttl
+	return s
 }
 
 func (s *FileSystemNames) ID() string {
@@ -60,51 +87,110 @@ func (s *FileSystemNames) Close() error {
 
 func (s *FileSystemNames) Get(ctx context.Context, name string) (NameEntry, error) {
 	entry, ok := s.store.Get(name)
-	if !ok {
+	if !ok || entry.Deleted {
 		return NameEntry{}, ErrNotFound
 	}
-
-	tokensCopy := make([]string, len(entry.Tokens))
-	copy(tokensCopy, entry.Tokens)
-	return NameEntry{
-		Value:  entry.Value,
-		Tokens: tokensCopy,
-	}, nil
+	return entry.clone(), nil
 }
 
 func (s *FileSystemNames) Put(ctx context.Context, name string, value string, tokens []string) error {
+	return s.PutIf(ctx, name, value, tokens, Condition{})
+}
+
+// PutIf updates or creates a name entry if the name satisfies cond.
+func (s *FileSystemNames) PutIf(ctx context.Context, name string, value string, tokens []string, cond Condition) error {
 	tokensCopy := make([]string, len(tokens))
 	copy(tokensCopy, tokens)
 
-	return s.store.Put(name, NameEntry{Value: value, Tokens: tokensCopy}, nil)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Changes are serialized by mu, so the entry cannot change before it is
+	// replaced
+	old, existed := s.store.Get(name)
+	if err := cond.Check(old, existed && !old.Deleted); err != nil {
+		return err
+	}
+	entry := NameEntry{Value: value, Tokens: tokensCopy, Version: nextVersion(old.Version, s.id)}
+	if err := s.store.Put(name, entry, nil); err != nil {
+		return err
+	}
+	s.index.set(name, entry, old, existed)
+	return nil
 }
 
+// Delete replaces the entry of name with a tombstone, which is journaled.
 func (s *FileSystemNames) Delete(ctx context.Context, name string, expectedValue string) error {
-	return s.store.Delete(name, func(store map[string]NameEntry) error {
-		existing, ok := store[name]
-		if !ok {
-			return ErrNotFound
-		}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		if expectedValue != "" && existing.Value != expectedValue {
-			// ETag mismatch
-			return ErrPreconditionFailed
-		}
+	existing, ok := s.store.Get(name)
+	if !ok || existing.Deleted {
+		return ErrNotFound
+	}
+	if expectedValue != "" && existing.Value != expectedValue {
+		// ETag mismatch
+		return ErrPreconditionFailed
+	}
+	if err := s.store.Put(name, tombstone(existing, s.id), nil); err != nil {
+		return err
+	}
+	s.index.remove(name, existing.Value)
+	return s.purgeLocked()
+}
+
+// purgeLocked removes the expired tombstones, at most once every
+// tombstonePurgeInterval. s.mu must be held.
+func (s *FileSystemNames) purgeLocked() error {
+	if time.Since(s.lastPurge) < tombstonePurgeInterval {
 		return nil
+	}
+	s.lastPurge = time.Now()
+	var expired []string
+	s.store.Read(func(store map[string]NameEntry) {
+		expired = expiredTombstones(store, s.tombstoneTTL)
 	})
+	for _, name := range expired {
+		if err := s.store.Delete(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// Merge merges the entries of another replica, resolving concurrent writes
+// by their versions. Each changed entry is journaled.
+func (s *FileSystemNames) Merge(ctx context.Context, entries []NamedEntry) (MergeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result MergeResult
+	for _, entry := range entries {
+		old, existed := s.store.Get(entry.Name)
+		merged, changed := mergeEntry(old, existed, entry.NameEntry, s.tombstoneTTL, &result)
+		if !changed {
+			continue
+		}
+		if err := s.store.Put(entry.Name, merged, nil); err != nil {
+			return result, err
+		}
+		s.index.set(entry.Name, merged, old, existed)
+	}
+	return result, s.purgeLocked()
+}
+
+// Lookup returns the names holding the value id, in order.
 func (s *FileSystemNames) Lookup(ctx context.Context, id string) ([]string, error) {
-	var results []string
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.index.names(id), nil
+}
+
+func (s *FileSystemNames) Export(ctx context.Context, emit func(NamedEntry) error) error {
+	var entries []NamedEntry
 	s.store.Read(func(store map[string]NameEntry) {
-		for k, v := range store {
-			if v.Value == id {
-				results = append(results, k)
-			}
-		}
+		entries = sortedEntries(store, s.tombstoneTTL)
 	})
-	if results == nil {
-		results = []string{}
-	}
-	return results, nil
+	return emitEntries(ctx, entries, emit)
 }
@@ -166,3 +166,46 @@ func TestFileSystemNames_SnapshotAndRotation(t *testing.T) {
 		t.Errorf("Expected 5678 for service-b")
 	}
 }
+
+func TestFileSystemNames_Lookup(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fsn, err := NewFileSystemNames(dir, 0)
+	if err != nil {
+		t.Fatalf("Failed to create FileSystemNames: %v", err)
+	}
+
+	fsn.Put(ctx, "b", "id-1", nil)
+	fsn.Put(ctx, "a", "id-1", nil)
+	fsn.Put(ctx, "c", "id-1", nil)
+	fsn.Put(ctx, "c", "id-2", nil)
+	fsn.PutIf(ctx, "d", "id-2", nil, Condition{NoneMatch: AnyValue})
+	fsn.Delete(ctx, "d", "")
+	if err := fsn.PutIf(ctx, "a", "id-2", nil, Condition{Match: "id-3"}); err != ErrPreconditionFailed {
+		t.Fatalf("Expected ErrPreconditionFailed, got %v", err)
+	}
+
+	expect := func(n Names, id, want string) {
+		t.Helper()
+		got, err := n.Lookup(ctx, id)
+		if err != nil {
+			t.Fatalf("Lookup failed: %v", err)
+		}
+		if strings.Join(got, ",") != want {
+			t.Errorf("Lookup(%q) = %v, want [%s]", id, got, want)
+		}
+	}
+	expect(fsn, "id-1", "a,b")
+	expect(fsn, "id-2", "c")
+	expect(fsn, "id-3", "")
+
+	// The index is rebuilt from the journal
+	fsn.Close()
+	reopened, err := NewFileSystemNames(dir, 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen FileSystemNames: %v", err)
+	}
+	defer reopened.Close()
+	expect(reopened, "id-1", "a,b")
+	expect(reopened, "id-2", "c")
+}
@@ -0,0 +1,58 @@
+package names
+
+import (
+	"maps"
+	"slices"
+)
+
+// valueIndex maps each value to the names holding it, so the names of a
+// value are found without scanning every entry.
+type valueIndex map[string]map[string]bool
+
+// newValueIndex indexes the entries of store.
+func newValueIndex(store map[string]NameEntry) valueIndex {
+	ix := make(valueIndex)
+	for name, entry := range store {
+		if !entry.Deleted {
+			ix.add(name, entry.Value)
+		}
+	}
+	return ix
+}
+
+func (ix valueIndex) add(name, value string) {
+	set, ok := ix[value]
+	if !ok {
+		set = make(map[string]bool)
+		ix[value] = set
+	}
+	set[name] = true
+}
+
+func (ix valueIndex) remove(name, value string) {
+	set := ix[value]
+	delete(set, name)
+	if len(set) == 0 {
+		delete(ix, value)
+	}
+}
+
+// set records that name now holds entry in place of the entry old, if it
+// existed. Tombstones are not indexed.
+func (ix valueIndex) set(name string, entry, old NameEntry, existed bool) {
+	if existed && !old.Deleted {
+		ix.remove(name, old.Value)
+	}
+	if !entry.Deleted {
+		ix.add(name, entry.Value)
+	}
+}
+
+// names returns the names holding value in order, never nil.
+func (ix valueIndex) names(value string) []string {
+	names := slices.Sorted(maps.Keys(ix[value]))
+	if names == nil {
+		names = []string{}
+	}
+	return names
+}
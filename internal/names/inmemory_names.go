@@ -4,13 +4,24 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
-	"invariant/internal/identity"
 	"sync"
+	"time"
+
+	"invariant/internal/identity"
 )
 
 // Assert that InMemoryNames implements the Names interface
 var _ Names = (*InMemoryNames)(nil)
 
+// Assert that InMemoryNames implements the ConditionalPutter interface
+var _ ConditionalPutter = (*InMemoryNames)(nil)
+
+// Assert that InMemoryNames implements the Exporter interface
+var _ Exporter = (*InMemoryNames)(nil)
+
+// Assert that InMemoryNames implements the Merger interface
+var _ Merger = (*InMemoryNames)(nil)
+
 // Assert that InMemoryNames implements the identity.Provider interface
 var _ identity.Identity = (*InMemoryNames)(nil)
 
@@ -18,6 +29,12 @@ type InMemoryNames struct {
 	id    string
 	mu    sync.RWMutex
 	store map[string]NameEntry
+	index valueIndex
+
+	// Tombstones of deleted names are kept for tombstoneTTL and removed when
+	// a name is deleted or merged after tombstonePurgeInterval.
+	tombstoneTTL time.Duration
+	lastPurge    time.Time
 }
 
 func NewInMemoryNames() *InMemoryNames {
@@ -26,11 +43,22 @@ func NewInMemoryNames() *InMemoryNames {
 	id := hex.EncodeToString(idBytes)
 
 	return &InMemoryNames{
-		id:    id,
-		store: make(map[string]NameEntry),
+		id:           id,
+		store:        make(map[string]NameEntry),
+		index:        make(valueIndex),
+		tombstoneTTL: DefaultTombstoneTTL,
+		lastPurge:    time.Now(),
 	}
 }
 
+// WithTombstoneTTL keeps the tombstones of deleted names for ttl rather than
+// DefaultTombstoneTTL. A name deleted on a replica that has not merged its
+// tombstone within ttl may reappear when the replica is merged.
+func (s *InMemoryNames) WithTombstoneTTL(ttl time.Duration) *InMemoryNames {
+	s.tombstoneTTL = ttl
+	return s
+}
+
 func (s *InMemoryNames) ID() string {
 	return s.id
 }
@@ -40,16 +68,11 @@ func (s *InMemoryNames) Get(ctx context.Context, name string) (NameEntry, error)
 	defer s.mu.RUnlock()
 
 	entry, ok := s.store[name]
-	if !ok {
+	if !ok || entry.Deleted {
 		return NameEntry{}, ErrNotFound
 	}
-	// Return a copy of tokens to prevent modification
-	tokensCopy := make([]string, len(entry.Tokens))
-	copy(tokensCopy, entry.Tokens)
-	return NameEntry{
-		Value:  entry.Value,
-		Tokens: tokensCopy,
-	}, nil
+	// Return a copy to prevent modification
+	return entry.clone(), nil
 }
 
 func (s *InMemoryNames) Put(ctx context.Context, name string, value string, tokens []string) error {
@@ -59,19 +82,66 @@ func (s *InMemoryNames) Put(ctx context.Context, name string, value string, toke
 	tokensCopy := make([]string, len(tokens))
 	copy(tokensCopy, tokens)
 
-	s.store[name] = NameEntry{
-		Value:  value,
-		Tokens: tokensCopy,
+	old, existed := s.store[name]
+	entry := NameEntry{
+		Value:   value,
+		Tokens:  tokensCopy,
+		Version: nextVersion(old.Version, s.id),
 	}
+	s.index.set(name, entry, old, existed)
+	s.store[name] = entry
 	return nil
 }
 
+// PutIf updates or creates a name entry if the name satisfies cond.
+func (s *InMemoryNames) PutIf(ctx context.Context, name string, value string, tokens []string, cond Condition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.store[name]
+	if err := cond.Check(old, ok && !old.Deleted); err != nil {
+		return err
+	}
+
+	tokensCopy := make([]string, len(tokens))
+	copy(tokensCopy, tokens)
+
+	entry := NameEntry{
+		Value:   value,
+		Tokens:  tokensCopy,
+		Version: nextVersion(old.Version, s.id),
+	}
+	s.index.set(name, entry, old, ok)
+	s.store[name] = entry
+	return nil
+}
+
+// Merge merges the entries of another replica, resolving concurrent writes
+// by their versions.
+func (s *InMemoryNames) Merge(ctx context.Context, entries []NamedEntry) (MergeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result MergeResult
+	for _, entry := range entries {
+		old, existed := s.store[entry.Name]
+		merged, changed := mergeEntry(old, existed, entry.NameEntry, s.tombstoneTTL, &result)
+		if changed {
+			s.index.set(entry.Name, merged, old, existed)
+			s.store[entry.Name] = merged
+		}
+	}
+	s.purgeLocked()
+	return result, nil
+}
+
+// Delete replaces the entry of name with a tombstone.
 func (s *InMemoryNames) Delete(ctx context.Context, name string, expectedValue string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	entry, ok := s.store[name]
-	if !ok {
+	if !ok || entry.Deleted {
 		return ErrNotFound
 	}
 
@@ -80,22 +150,36 @@ func (s *InMemoryNames) Delete(ctx context.Context, name string, expectedValue s
 		return ErrPreconditionFailed
 	}
 
-	delete(s.store, name)
+	s.index.remove(name, entry.Value)
+	s.store[name] = tombstone(entry, s.id)
+	s.purgeLocked()
 	return nil
 }
 
+// purgeLocked removes the expired tombstones, at most once every
+// tombstonePurgeInterval. s.mu must be held.
+func (s *InMemoryNames) purgeLocked() {
+	if time.Since(s.lastPurge) < tombstonePurgeInterval {
+		return
+	}
+	s.lastPurge = time.Now()
+	for _, name := range expiredTombstones(s.store, s.tombstoneTTL) {
+		delete(s.store, name)
+	}
+}
+
+// Lookup returns the names holding the value id, in order.
 func (s *InMemoryNames) Lookup(ctx context.Context, id string) ([]string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	var results []string
-	for k, v := range s.store {
-		if v.Value == id {
-			results = append(results, k)
-		}
-	}
-	if results == nil {
-		results = []string{} // return empty list instead of null natively
-	}
-	return results, nil
+	return s.index.names(id), nil
+}
+
+func (s *InMemoryNames) Export(ctx context.Context, emit func(NamedEntry) error) error {
+	s.mu.RLock()
+	entries := sortedEntries(s.store, s.tombstoneTTL)
+	s.mu.RUnlock()
+
+	return emitEntries(ctx, entries, emit)
 }
@@ -107,3 +107,23 @@ func TestInMemoryNames_DataRaceAndTokensCopy(t *testing.T) {
 		t.Errorf("Tokens array in store was mutated by modifying Get result! Expected 'a', got '%s'", entry2.Tokens[0])
 	}
 }
+
+func TestInMemoryNames_Lookup(t *testing.T) {
+	ctx := context.Background()
+	n := names.NewInMemoryNames()
+	n.Put(ctx, "b", "id-1", nil)
+	n.Put(ctx, "a", "id-1", nil)
+	n.Put(ctx, "c", "id-1", nil)
+	n.PutIf(ctx, "c", "id-2", nil, names.Condition{Match: "id-1"})
+	n.Delete(ctx, "b", "id-1")
+
+	if got, _ := n.Lookup(ctx, "id-1"); len(got) != 1 || got[0] != "a" {
+		t.Errorf("Lookup(id-1) = %v, want [a]", got)
+	}
+	if got, _ := n.Lookup(ctx, "id-2"); len(got) != 1 || got[0] != "c" {
+		t.Errorf("Lookup(id-2) = %v, want [c]", got)
+	}
+	if got, _ := n.Lookup(ctx, "id-3"); got == nil || len(got) != 0 {
+		t.Errorf("Lookup(id-3) = %#v, want an empty list", got)
+	}
+}
@@ -0,0 +1,186 @@
+package names
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Version orders the writes of a name across the replicas of a names
+// service. Clock counts the writes of the name made on each replica, by the
+// ID of the replica, so a write that saw another is known to follow it.
+// Writes that did not see each other are concurrent, and the one with the
+// latest Time, then the greatest Writer ID, wins.
+type Version struct {
+	Clock  map[string]uint64 `json:"clock"`
+	Time   int64             `json:"time"`   // Unix time of the write, in nanoseconds
+	Writer string            `json:"writer"` // ID of the replica that made the write
+}
+
+// DefaultTombstoneTTL is how long the tombstone of a deleted name is kept
+// for replicas to merge.
+const DefaultTombstoneTTL = 7 * 24 * time.Hour
+
+// tombstonePurgeInterval is how often expired tombstones are removed.
+const tombstonePurgeInterval = time.Hour
+
+// MergeResult summarizes a merge of the entries of another replica.
+type MergeResult struct {
+	Added     int `json:"added"`
+	Updated   int `json:"updated"`   // entries replaced by writes that followed them
+	Deleted   int `json:"deleted"`   // entries replaced by tombstones that followed them
+	Unchanged int `json:"unchanged"` // entries already as recent as those merged
+	Conflicts int `json:"conflicts"` // concurrent writes resolved by their version
+}
+
+// Merger is implemented by Names services whose entries can be replicated.
+type Merger interface {
+	// Merge merges entries, as exported by another replica, into the
+	// service. An entry that follows the one held replaces it. Concurrent
+	// entries are resolved to the latest write, which is marked Merged, on
+	// every replica alike, so replicas that merge each other's entries
+	// converge. Deleted names are merged as tombstones, which are
+	// versioned as writes are, until they expire.
+	Merge(ctx context.Context, entries []NamedEntry) (MergeResult, error)
+}
+
+// clone returns a copy of e that shares nothing with it.
+func (e NameEntry) clone() NameEntry {
+	e.Tokens = slices.Clone(e.Tokens)
+	if e.Version != nil {
+		v := *e.Version
+		v.Clock = maps.Clone(v.Clock)
+		e.Version = &v
+	}
+	return e
+}
+
+// nextVersion returns the version of a write made by the replica writer
+// over old, which is nil if the name did not exist.
+func nextVersion(old *Version, writer string) *Version {
+	v := &Version{Clock: make(map[string]uint64), Time: time.Now().UnixNano(), Writer: writer}
+	if old != nil {
+		maps.Copy(v.Clock, old.Clock)
+		// Keep later writes later even if the clock of the replica is behind
+		v.Time = max(v.Time, old.Time+1)
+	}
+	v.Clock[writer]++
+	return v
+}
+
+// tombstone returns the entry recording the deletion, by the replica writer,
+// of a name holding old.
+func tombstone(old NameEntry, writer string) NameEntry {
+	return NameEntry{Deleted: true, Version: nextVersion(old.Version, writer)}
+}
+
+// expired reports whether e is a tombstone older than ttl. A tombstone
+// without a version cannot be ordered and is always expired.
+func (e NameEntry) expired(ttl time.Duration, now time.Time) bool {
+	return e.Deleted && (e.Version == nil || now.Sub(time.Unix(0, e.Version.Time)) > ttl)
+}
+
+// follows reports whether every write counted by the clock of b is counted
+// by the clock of a.
+func follows(a, b *Version) bool {
+	if b == nil {
+		return true
+	}
+	if a == nil {
+		return len(b.Clock) == 0
+	}
+	for writer, count := range b.Clock {
+		if a.Clock[writer] < count {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeEntry merges the entry remote of another replica into local, which
+// exists if the name is held or has a tombstone, returning the entry the
+// name should hold and whether it changed. Tombstones older than ttl are
+// ignored.
+func mergeEntry(local NameEntry, exists bool, remote NameEntry, ttl time.Duration, result *MergeResult) (NameEntry, bool) {
+	now := time.Now()
+	if remote.expired(ttl, now) {
+		result.Unchanged++
+		return local, false
+	}
+	if !exists || local.expired(ttl, now) {
+		if remote.Deleted {
+			// The name stays deleted, but the tombstone is kept to be
+			// merged by other replicas
+			result.Unchanged++
+		} else {
+			result.Added++
+		}
+		return remote.clone(), true
+	}
+	localFollows, remoteFollows := follows(local.Version, remote.Version), follows(remote.Version, local.Version)
+	switch {
+	case localFollows && remoteFollows && local.Value == remote.Value && local.Deleted == remote.Deleted:
+		result.Unchanged++
+		return local, false
+	case localFollows && !remoteFollows:
+		result.Unchanged++
+		return local, false
+	case remoteFollows && !localFollows:
+		if remote.Deleted && !local.Deleted {
+			result.Deleted++
+		} else {
+			result.Updated++
+		}
+		return remote.clone(), true
+	}
+
+	// The writes are concurrent; the latest wins, with the clocks of both
+	result.Conflicts++
+	winner := local
+	if compareWrites(remote, local) > 0 {
+		winner = remote
+	}
+	merged := winner.clone()
+	merged.Merged = !winner.Deleted
+	merged.Version = &Version{Clock: make(map[string]uint64)}
+	for _, v := range []*Version{local.Version, remote.Version} {
+		if v == nil {
+			continue
+		}
+		for writer, count := range v.Clock {
+			merged.Version.Clock[writer] = max(merged.Version.Clock[writer], count)
+		}
+	}
+	if winner.Version != nil {
+		merged.Version.Time = winner.Version.Time
+		merged.Version.Writer = winner.Version.Writer
+	}
+	return merged, true
+}
+
+// compareWrites orders concurrent entries by the time and writer of their
+// versions, then by value, so every replica picks the same one.
+func compareWrites(a, b NameEntry) int {
+	var at, bt int64
+	var aw, bw string
+	if a.Version != nil {
+		at, aw = a.Version.Time, a.Version.Writer
+	}
+	if b.Version != nil {
+		bt, bw = b.Version.Time, b.Version.Writer
+	}
+	return cmp.Or(cmp.Compare(at, bt), cmp.Compare(aw, bw), cmp.Compare(a.Value, b.Value), compareBool(a.Deleted, b.Deleted))
+}
+
+// compareBool orders false before true.
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
@@ -0,0 +1,187 @@
+package names_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"invariant/internal/names"
+)
+
+func export(t *testing.T, e names.Exporter) []names.NamedEntry {
+	t.Helper()
+	var entries []names.NamedEntry
+	if err := e.Export(context.Background(), func(entry names.NamedEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	return entries
+}
+
+func TestMerge_Replicas(t *testing.T) {
+	ctx := context.Background()
+	a := names.NewInMemoryNames()
+	b := names.NewInMemoryNames()
+
+	a.Put(ctx, "site", "v1", nil)
+	result, err := b.Merge(ctx, export(t, a))
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if result != (names.MergeResult{Added: 1}) {
+		t.Errorf("expected the name to be added, got %+v", result)
+	}
+
+	// A write that saw the replicated entry follows it
+	b.Put(ctx, "site", "v2", nil)
+	if result, _ := a.Merge(ctx, export(t, b)); result != (names.MergeResult{Updated: 1}) {
+		t.Errorf("expected the name to be updated, got %+v", result)
+	}
+	if result, _ := b.Merge(ctx, export(t, a)); result != (names.MergeResult{Unchanged: 1}) {
+		t.Errorf("expected the name to be unchanged, got %+v", result)
+	}
+
+	// Concurrent writes are resolved to the latest on both replicas
+	a.Put(ctx, "site", "from-a", nil)
+	time.Sleep(time.Millisecond)
+	b.Put(ctx, "site", "from-b", nil)
+	fromA, fromB := export(t, a), export(t, b)
+	if result, _ := a.Merge(ctx, fromB); result != (names.MergeResult{Conflicts: 1}) {
+		t.Errorf("expected a conflict, got %+v", result)
+	}
+	if result, _ := b.Merge(ctx, fromA); result != (names.MergeResult{Conflicts: 1}) {
+		t.Errorf("expected a conflict, got %+v", result)
+	}
+	entryA, _ := a.Get(ctx, "site")
+	entryB, _ := b.Get(ctx, "site")
+	if entryA.Value != "from-b" || !entryA.Merged {
+		t.Errorf("expected the latest write to win and be marked merged, got %+v", entryA)
+	}
+	if !reflect.DeepEqual(entryA, entryB) {
+		t.Errorf("expected the replicas to converge, got %+v and %+v", entryA, entryB)
+	}
+	if entryA.Version.Clock[a.ID()] != 2 || entryA.Version.Clock[b.ID()] != 2 {
+		t.Errorf("expected the merged clock to count the writes of both replicas, got %v", entryA.Version.Clock)
+	}
+	if held, _ := a.Lookup(ctx, "from-a"); len(held) != 0 {
+		t.Errorf("expected the discarded value to be unindexed, got %v", held)
+	}
+
+	// A later write clears the mark
+	a.Put(ctx, "site", "v3", nil)
+	if entry, _ := a.Get(ctx, "site"); entry.Merged {
+		t.Errorf("expected a new write to not be marked merged")
+	}
+}
+
+func TestMerge_Tombstones(t *testing.T) {
+	ctx := context.Background()
+	a := names.NewInMemoryNames()
+	b := names.NewInMemoryNames()
+
+	a.Put(ctx, "site", "v1", nil)
+	b.Merge(ctx, export(t, a))
+	stale := export(t, b)
+
+	// A deletion replicates as a tombstone
+	if err := a.Delete(ctx, "site", ""); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := a.Get(ctx, "site"); err != names.ErrNotFound {
+		t.Errorf("expected a deleted name to not be found, got %v", err)
+	}
+	if result, _ := b.Merge(ctx, export(t, a)); result != (names.MergeResult{Deleted: 1}) {
+		t.Errorf("expected the name to be deleted, got %+v", result)
+	}
+	if _, err := b.Get(ctx, "site"); err != names.ErrNotFound {
+		t.Errorf("expected the merged deletion to remove the name, got %v", err)
+	}
+	if held, _ := b.Lookup(ctx, "v1"); len(held) != 0 {
+		t.Errorf("expected the deleted value to be unindexed, got %v", held)
+	}
+
+	// The entry of a replica that did not see the deletion does not bring
+	// the name back
+	if result, _ := a.Merge(ctx, stale); result != (names.MergeResult{Unchanged: 1}) {
+		t.Errorf("expected the tombstone to be kept, got %+v", result)
+	}
+
+	// A write after the deletion follows it
+	b.Put(ctx, "site", "v2", nil)
+	if result, _ := a.Merge(ctx, export(t, b)); result != (names.MergeResult{Updated: 1}) {
+		t.Errorf("expected the name to be written again, got %+v", result)
+	}
+
+	// Expired tombstones are neither exported nor merged
+	d := names.NewInMemoryNames().WithTombstoneTTL(0)
+	d.Put(ctx, "gone", "v1", nil)
+	before := export(t, d)
+	d.Delete(ctx, "gone", "")
+	if entries := export(t, d); len(entries) != 0 {
+		t.Errorf("expected the expired tombstone to not be exported, got %+v", entries)
+	}
+	if result, _ := d.Merge(ctx, before); result != (names.MergeResult{Added: 1}) {
+		t.Errorf("expected an entry to be merged over an expired tombstone, got %+v", result)
+	}
+}
+
+func TestMerge_Server(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := names.NewFileSystemNames(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileSystemNames failed: %v", err)
+	}
+	ts := httptest.NewServer(names.NewNamesServer(store))
+	defer ts.Close()
+	client := names.NewClient(ts.URL, nil)
+
+	other := names.NewInMemoryNames()
+	other.Put(ctx, "site", "remote", []string{"slots-v1"})
+	store.Put(ctx, "local", "value", nil)
+
+	result, err := client.Merge(ctx, export(t, other))
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if result != (names.MergeResult{Added: 1}) {
+		t.Errorf("expected the name to be added, got %+v", result)
+	}
+
+	// The version is part of the entry returned to clients
+	entry, err := client.Get(ctx, "site")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if entry.Value != "remote" || entry.Version == nil || entry.Version.Writer != other.ID() {
+		t.Errorf("expected the replicated entry with its version, got %+v", entry)
+	}
+
+	// Merged entries are journaled
+	store.Close()
+	reopened, err := names.NewFileSystemNames(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileSystemNames failed: %v", err)
+	}
+	if entry, _ := reopened.Get(ctx, "site"); entry.Version == nil || entry.Version.Clock[other.ID()] != 1 {
+		t.Errorf("expected the merged entry to be persisted, got %+v", entry)
+	}
+
+	// Tombstones are journaled
+	if err := reopened.Delete(ctx, "site", ""); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	reopened.Close()
+	again, err := names.NewFileSystemNames(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileSystemNames failed: %v", err)
+	}
+	defer again.Close()
+	if result, _ := again.Merge(ctx, export(t, other)); result != (names.MergeResult{Unchanged: 1}) {
+		t.Errorf("expected the persisted tombstone to be kept, got %+v", result)
+	}
+}
@@ -3,17 +3,110 @@ package names
 import (
 	"context"
 	"errors"
+	"slices"
 )
 
 var (
 	ErrNotFound           = errors.New("name not found")
 	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrReservedName       = errors.New("reserved name")
 )
 
+// reservedNames are the names GET /:name cannot serve, as their paths are
+// taken by other requests of the protocol.
+var reservedNames = map[string]bool{"id": true, "export": true}
+
+// IsReserved reports whether name is reserved by the protocol, so it cannot
+// be stored.
+func IsReserved(name string) bool {
+	return reservedNames[name]
+}
+
 // NameEntry represents the data stored for a name
 type NameEntry struct {
 	Value  string   `json:"value"`
 	Tokens []string `json:"tokens"`
+
+	// Version is the version of the write that set the entry, used to merge
+	// the entries of replicas. Services that do not version their entries
+	// leave it nil.
+	Version *Version `json:"version,omitempty"`
+
+	// Merged reports that the entry won over a concurrent write made on
+	// another replica, whose value was discarded.
+	Merged bool `json:"merged,omitempty"`
+
+	// Deleted marks a tombstone, which records the deletion of a name with
+	// its version so that the deletion is merged by other replicas. A name
+	// with a tombstone is not found, and the tombstone is exported, without
+	// a value, until it expires.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// HasToken reports whether the entry has token. Every entry has the empty token.
+func (e NameEntry) HasToken(token string) bool {
+	return token == "" || slices.Contains(e.Tokens, token)
+}
+
+// GetRequest is the request to retrieve several names at once.
+type GetRequest struct {
+	Names []string `json:"names"`
+	Token string   `json:"token,omitempty"`
+}
+
+// GetMany retrieves the entries of names that have token from n, one name at
+// a time. Names that are not found, or do not have token, are omitted from the
+// result.
+func GetMany(ctx context.Context, n Names, names []string, token string) (map[string]NameEntry, error) {
+	result := make(map[string]NameEntry)
+	for _, name := range names {
+		entry, err := n.Get(ctx, name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.HasToken(token) {
+			result[name] = entry
+		}
+	}
+	return result, nil
+}
+
+// Condition is the precondition of a conditional Put, mirroring the If-Match
+// and If-None-Match headers of PUT /:name.
+type Condition struct {
+	// Match, if set, is the value the name must hold. AnyValue matches any
+	// value, requiring the name to exist.
+	Match string
+
+	// NoneMatch, if set, is a value the name must not hold. AnyValue
+	// requires the name to not exist.
+	NoneMatch string
+}
+
+// AnyValue is the value of a Condition that matches any value of a name.
+const AnyValue = "*"
+
+// Check returns ErrPreconditionFailed unless a name holding entry, if exists
+// is true, satisfies c.
+func (c Condition) Check(entry NameEntry, exists bool) error {
+	if c.Match != "" && (!exists || (c.Match != AnyValue && entry.Value != c.Match)) {
+		return ErrPreconditionFailed
+	}
+	if c.NoneMatch != "" && exists && (c.NoneMatch == AnyValue || entry.Value == c.NoneMatch) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// ConditionalPutter is implemented by Names services that can update a name
+// only if its current value satisfies a Condition.
+type ConditionalPutter interface {
+	// PutIf updates or creates a name entry, returning ErrPreconditionFailed
+	// without changing it if the name does not satisfy cond.
+	PutIf(ctx context.Context, name string, value string, tokens []string, cond Condition) error
 }
 
 // Names defines the interface for the names service
@@ -21,5 +114,6 @@ type Names interface {
 	Get(ctx context.Context, name string) (NameEntry, error)
 	Put(ctx context.Context, name string, value string, tokens []string) error
 	Delete(ctx context.Context, name string, expectedValue string) error
+	// Lookup returns the names whose value is id, the reverse of Get.
 	Lookup(ctx context.Context, id string) ([]string, error)
 }
@@ -2,14 +2,25 @@ package names
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"strings"
 
+	"invariant/internal/httputil"
 	"invariant/internal/identity"
 )
 
+// The largest request bodies the server accepts, in bytes. Larger requests
+// are rejected with 413 Request Entity Too Large.
+const (
+	MaxRequestSize = 1 << 20
+	MaxBulkSize    = 64 << 20
+)
+
 type NamesServer struct {
 	names Names
+	key   *identity.KeyPair
 }
 
 func NewNamesServer(names Names) *NamesServer {
@@ -18,12 +29,23 @@ func NewNamesServer(names Names) *NamesServer {
 	}
 }
 
+// WithKeyPair identifies the server by the ID of key, which it proves by
+// answering challenges to GET /id.
+func (s *NamesServer) WithKeyPair(key *identity.KeyPair) *NamesServer {
+	s.key = key
+	return s
+}
+
 func (s *NamesServer) Handler() http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("GET /id", s.handleGetID)
 	mux.HandleFunc("GET /lookup/{id}", s.handleLookup)
+	mux.HandleFunc("GET /export", s.handleExport)
+	mux.HandleFunc("POST /bulk", s.handleBulkLoad)
+	mux.HandleFunc("POST /merge", s.handleMerge)
 	mux.HandleFunc("GET /{name}", s.handleGet)
+	mux.HandleFunc("POST /{$}", s.handleGetMany)
 	mux.HandleFunc("PUT /{name}", s.handlePut)
 	mux.HandleFunc("DELETE /{name}", s.handleDelete)
 
@@ -35,9 +57,12 @@ func (s *NamesServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *NamesServer) handleGetID(w http.ResponseWriter, r *http.Request) {
+	if s.key != nil {
+		identity.ServeID(w, r, s.key.ID(), s.key)
+		return
+	}
 	if identityProvider, ok := s.names.(identity.Identity); ok {
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(identityProvider.ID()))
+		identity.ServeID(w, r, identityProvider.ID(), nil)
 		return
 	}
 	http.Error(w, "Not Implemented", http.StatusNotImplemented)
@@ -47,7 +72,7 @@ func (s *NamesServer) handleGet(w http.ResponseWriter, r *http.Request) {
 	name := r.PathValue("name")
 
 	entry, err := s.names.Get(r.Context(), name)
-	if err == ErrNotFound {
+	if err == ErrNotFound || (err == nil && !entry.HasToken(r.URL.Query().Get("token"))) {
 		http.Error(w, "Not Found", http.StatusNotFound)
 		return
 	} else if err != nil {
@@ -63,6 +88,25 @@ func (s *NamesServer) handleGet(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *NamesServer) handleGetMany(w http.ResponseWriter, r *http.Request) {
+	var req GetRequest
+	if !httputil.DecodeJSON(w, r, MaxRequestSize, &req) {
+		return
+	}
+
+	entries, err := GetMany(r.Context(), s.names, req.Names, req.Token)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
+
 func (s *NamesServer) handlePut(w http.ResponseWriter, r *http.Request) {
 	name := r.PathValue("name")
 
@@ -73,15 +117,36 @@ func (s *NamesServer) handlePut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad Request: missing value", http.StatusBadRequest)
 		return
 	}
+	if IsReserved(name) {
+		http.Error(w, "Bad Request: "+name+" is a reserved name", http.StatusBadRequest)
+		return
+	}
 
 	var tokens []string
 	if tokensStr != "" {
 		tokens = strings.Split(tokensStr, ",")
 	}
-	// Proceed with normal Put, ETag precondition is only specified for DELETE in the protocol.
 
-	err := s.names.Put(r.Context(), name, value, tokens)
-	if err != nil {
+	cond := Condition{
+		Match:     etagValue(r.Header.Get("If-Match")),
+		NoneMatch: etagValue(r.Header.Get("If-None-Match")),
+	}
+
+	var err error
+	if cond == (Condition{}) {
+		err = s.names.Put(r.Context(), name, value, tokens)
+	} else if putter, ok := s.names.(ConditionalPutter); ok {
+		err = putter.PutIf(r.Context(), name, value, tokens, cond)
+	} else {
+		err = ErrNotSupported
+	}
+	if errors.Is(err, ErrPreconditionFailed) {
+		http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+		return
+	} else if errors.Is(err, ErrNotSupported) {
+		http.Error(w, "Not Implemented: conditional updates are not supported", http.StatusNotImplemented)
+		return
+	} else if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
@@ -93,7 +158,11 @@ func (s *NamesServer) handlePut(w http.ResponseWriter, r *http.Request) {
 func (s *NamesServer) handleDelete(w http.ResponseWriter, r *http.Request) {
 	name := r.PathValue("name")
 
-	expectedValue := r.Header.Get("If-Match")
+	expectedValue := etagValue(r.Header.Get("If-Match"))
+	if expectedValue == AnyValue {
+		// Any existing value matches, which is an unconditional delete
+		expectedValue = ""
+	}
 
 	err := s.names.Delete(r.Context(), name, expectedValue)
 	if err == ErrNotFound {
@@ -130,3 +199,98 @@ func (s *NamesServer) handleLookup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func (s *NamesServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	exporter, ok := s.names.(Exporter)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	wrote := false
+	err := exporter.Export(r.Context(), func(entry NamedEntry) error {
+		wrote = true
+		return encoder.Encode(entry)
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotSupported) {
+			http.Error(w, "Not Implemented", http.StatusNotImplemented)
+			return
+		}
+		if !wrote {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		// The status has been sent; the truncated stream signals the failure
+		log.Printf("Failed to export names: %v", err)
+	}
+}
+
+func (s *NamesServer) handleBulkLoad(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if !httputil.CheckContentType(w, r, "application/x-ndjson") {
+		return
+	}
+	entries, err := ReadEntries(httputil.LimitBody(w, r, MaxBulkSize))
+	if err != nil {
+		httputil.WriteBodyError(w, err)
+		return
+	}
+
+	result, err := BulkLoad(r.Context(), s.names, entries, r.URL.Query().Get("dry-run") == "true")
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *NamesServer) handleMerge(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	merger, ok := s.names.(Merger)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+	if !httputil.CheckContentType(w, r, "application/x-ndjson") {
+		return
+	}
+	entries, err := ReadEntries(httputil.LimitBody(w, r, MaxBulkSize))
+	if err != nil {
+		httputil.WriteBodyError(w, err)
+		return
+	}
+
+	result, err := merger.Merge(r.Context(), entries)
+	if errors.Is(err, ErrNotSupported) {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// etagValue returns the value of the entity tag in an If-Match or
+// If-None-Match header. The ETag of a name is its value, which clients may
+// send quoted or bare.
+func etagValue(header string) string {
+	tag := strings.TrimPrefix(strings.TrimSpace(header), "W/")
+	if len(tag) >= 2 && strings.HasPrefix(tag, `"`) && strings.HasSuffix(tag, `"`) {
+		tag = tag[1 : len(tag)-1]
+	}
+	return tag
+}
@@ -3,9 +3,13 @@ package names_test
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"invariant/internal/httputil"
+	"invariant/internal/identity"
 	"invariant/internal/names"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -55,6 +59,26 @@ func TestNamesServer_PutAndGet(t *testing.T) {
 	}
 }
 
+func TestNamesServer_KeyPair(t *testing.T) {
+	key, err := identity.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(names.NewNamesServer(names.NewInMemoryNames()).WithKeyPair(key).Handler())
+	defer ts.Close()
+
+	if id, err := names.NewClient(ts.URL, nil).VerifiedID(); err != nil || id != key.ID() {
+		t.Errorf("Expected verified ID %s, got %s (err: %v)", key.ID(), id, err)
+	}
+
+	// Without a key pair the ID cannot be proven
+	keyless := httptest.NewServer(names.NewNamesServer(names.NewInMemoryNames()).Handler())
+	defer keyless.Close()
+	if _, err := names.NewClient(keyless.URL, nil).VerifiedID(); err == nil {
+		t.Error("Expected a server without a key pair to fail the challenge")
+	}
+}
+
 func TestNamesServer_Delete(t *testing.T) {
 	store := names.NewInMemoryNames()
 	server := names.NewNamesServer(store)
@@ -101,3 +125,107 @@ func TestNamesServer_Delete(t *testing.T) {
 	}
 	resp.Body.Close()
 }
+
+func TestNamesServer_ConditionalPut(t *testing.T) {
+	store := names.NewInMemoryNames()
+	server := names.NewNamesServer(store)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	put := func(value string, headers map[string]string) int {
+		req, _ := http.NewRequest(http.MethodPut, ts.URL+"/my-name?value="+value, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := put("abc", map[string]string{"If-Match": "*"}); code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 updating a missing name with If-Match: *, got %v", code)
+	}
+	if code := put("abc", map[string]string{"If-None-Match": "*"}); code != http.StatusOK {
+		t.Errorf("expected 200 creating a name with If-None-Match: *, got %v", code)
+	}
+	if code := put("def", map[string]string{"If-None-Match": "*"}); code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 overwriting a name with If-None-Match: *, got %v", code)
+	}
+	if code := put("def", map[string]string{"If-Match": `"xyz"`}); code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 for a stale If-Match, got %v", code)
+	}
+	if code := put("def", map[string]string{"If-Match": `"abc"`}); code != http.StatusOK {
+		t.Errorf("expected 200 for a quoted matching If-Match, got %v", code)
+	}
+
+	entry, err := store.Get(context.Background(), "my-name")
+	if err != nil || entry.Value != "def" {
+		t.Errorf("expected my-name to be def, got %v (err: %v)", entry.Value, err)
+	}
+}
+
+func TestNamesServer_MalformedRequests(t *testing.T) {
+	store := names.NewInMemoryNames()
+	ts := httptest.NewServer(names.NewNamesServer(store).Handler())
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		name        string
+		path        string
+		body        string
+		contentType string
+		status      int
+	}{
+		{"get many", "/", `{"names":["a"]}`, "application/json", http.StatusOK},
+		{"unknown field", "/", `{"names":["a"],"tokens":["t"]}`, "application/json", http.StatusBadRequest},
+		{"content type", "/", `{"names":["a"]}`, "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"too large", "/", `{"names":["` + strings.Repeat("a", names.MaxRequestSize) + `"]}`, "application/json", http.StatusRequestEntityTooLarge},
+		{"bulk unknown field", "/bulk", `{"name":"a","value":"b","owner":"c"}`, "application/x-ndjson", http.StatusBadRequest},
+		{"bulk content type", "/bulk", `{"name":"a","value":"b"}`, "application/json", http.StatusUnsupportedMediaType},
+		{"bulk reserved name", "/bulk", `{"name":"export","value":"b"}`, "application/x-ndjson", http.StatusBadRequest},
+		{"bulk", "/bulk", `{"name":"a","value":"b"}`, "application/x-ndjson", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+tc.path, strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", tc.name, err)
+		}
+		var body httputil.RequestError
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, resp.StatusCode)
+		}
+		if tc.status != http.StatusOK && body.Status != tc.status {
+			t.Errorf("%s: expected a structured error, got %+v", tc.name, body)
+		}
+	}
+
+	if _, err := store.Get(context.Background(), "a"); err != nil {
+		t.Errorf("expected the bulk load to put the name, got %v", err)
+	}
+
+	// Names whose GET is taken by another request cannot be stored
+	for _, name := range []string{"id", "export"} {
+		req, _ := http.NewRequest(http.MethodPut, ts.URL+"/"+name+"?value=v", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("put %s: request failed: %v", name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("put %s: expected status %d, got %d", name, http.StatusBadRequest, resp.StatusCode)
+		}
+		if _, err := store.Get(context.Background(), name); err == nil {
+			t.Errorf("expected the reserved name %s not to be stored", name)
+		}
+	}
+	client := names.NewClient(ts.URL, nil)
+	if err := client.Put(context.Background(), "export", "v", nil); !errors.Is(err, names.ErrReservedName) {
+		t.Errorf("expected ErrReservedName, got %v", err)
+	}
+}
@@ -7,6 +7,15 @@ import (
 // Assert that UpstreamNames implements the Names interface.
 var _ Names = (*UpstreamNames)(nil)
 
+// Assert that UpstreamNames implements the ConditionalPutter interface.
+var _ ConditionalPutter = (*UpstreamNames)(nil)
+
+// Assert that UpstreamNames implements the Exporter interface.
+var _ Exporter = (*UpstreamNames)(nil)
+
+// Assert that UpstreamNames implements the Merger interface.
+var _ Merger = (*UpstreamNames)(nil)
+
 // UpstreamNames delegates queries to a parent names service
 // if they are not found in the local cache/registry.
 type UpstreamNames struct {
@@ -50,6 +59,16 @@ func (u *UpstreamNames) Put(ctx context.Context, name string, value string, toke
 	return u.local.Put(ctx, name, value, tokens)
 }
 
+// PutIf registers the name only to the local registry if the local entry
+// satisfies cond.
+func (u *UpstreamNames) PutIf(ctx context.Context, name string, value string, tokens []string, cond Condition) error {
+	putter, ok := u.local.(ConditionalPutter)
+	if !ok {
+		return ErrNotSupported
+	}
+	return putter.PutIf(ctx, name, value, tokens, cond)
+}
+
 // Delete removes the name only from the local registry.
 func (u *UpstreamNames) Delete(ctx context.Context, name string, expectedValue string) error {
 	return u.local.Delete(ctx, name, expectedValue)
@@ -85,3 +104,22 @@ func (u *UpstreamNames) Lookup(ctx context.Context, id string) ([]string, error)
 
 	return combined, nil
 }
+
+// Export exports only the local registry, which holds the names put to this
+// service and those cached from the parent.
+func (u *UpstreamNames) Export(ctx context.Context, emit func(NamedEntry) error) error {
+	exporter, ok := u.local.(Exporter)
+	if !ok {
+		return ErrNotSupported
+	}
+	return exporter.Export(ctx, emit)
+}
+
+// Merge merges the entries of another replica into the local registry.
+func (u *UpstreamNames) Merge(ctx context.Context, entries []NamedEntry) (MergeResult, error) {
+	merger, ok := u.local.(Merger)
+	if !ok {
+		return MergeResult{}, ErrNotSupported
+	}
+	return merger.Merge(ctx, entries)
+}
@@ -37,20 +37,9 @@ func (f *FS) resolve(ctx context.Context, path string) (files.ContentInformation
 		return f.fsrv.GetInfo(ctx, f.root)
 	}
 
-	parts := strings.Split(path, "/")
-	currentID := f.root
-	var info files.ContentInformationCommon
-	var err error
-
-	for _, part := range parts {
-		if part == "" || part == "." {
-			continue
-		}
-		info, err = f.fsrv.Lookup(ctx, currentID, part)
-		if err != nil {
-			return info, os.ErrNotExist
-		}
-		currentID = info.Node
+	info, err := f.fsrv.Resolve(ctx, f.root, path, false)
+	if err != nil {
+		return info, os.ErrNotExist
 	}
 	return info, nil
 }
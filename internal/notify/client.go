@@ -5,18 +5,30 @@ import (
 	"encoding/json"
 	"fmt"
 	"invariant/internal/httputil"
+	"invariant/internal/identity"
 	"net/http"
 )
 
 // NotifyRequest is the payload for notifying a service about known blocks.
 type NotifyRequest struct {
 	Addresses []string `json:"addresses"`
+
+	// Protocol is the protocol the notifying service serves the blocks with,
+	// such as cache-v1. Empty is storage-v1.
+	Protocol string `json:"protocol,omitempty"`
+	// Relay is the ID of the service passing on the notification of another,
+	// such as a finder pushing blocks to a closer finder, which signs it in
+	// place of the service holding the blocks.
+	Relay string `json:"relay,omitempty"`
 }
 
 // Client implements a client for sending has requests to a has-v1 service.
 type Client struct {
 	baseURL    string
 	httpClient *http.Client
+	signingKey *identity.KeyPair
+	protocol   string
+	relay      string
 }
 
 // NewClient creates a new HTTP has client.
@@ -32,10 +44,33 @@ func NewClient(baseURL string, httpClient *http.Client) *Client {
 	}
 }
 
+// WithSigningKey signs the notifications sent by the client with key so they
+// can be verified by the receiving service. The storage ID notified for must
+// be the ID of key, unless the client relays notifications, see WithRelay.
+func (c *Client) WithSigningKey(key *identity.KeyPair) *Client {
+	c.signingKey = key
+	return c
+}
+
+// WithRelay passes on the notifications of other services as the service
+// relay, whose key, set with WithSigningKey, signs them.
+func (c *Client) WithRelay(relay string) *Client {
+	c.relay = relay
+	return c
+}
+
+// WithProtocol tags the notifications sent by the client with the protocol
+// the notifying service serves the blocks with, for services that are not
+// storage-v1 services, such as caches.
+func (c *Client) WithProtocol(protocol string) *Client {
+	c.protocol = protocol
+	return c
+}
+
 // Has notifies the service that a storage node holds the given blocks.
 // The `storageID` is the ID of the storage node that has the blocks.
 func (c *Client) Notify(storageID string, addresses []string) error {
-	reqBody := NotifyRequest{Addresses: addresses}
+	reqBody := NotifyRequest{Addresses: addresses, Protocol: c.protocol, Relay: c.relay}
 	data, err := json.Marshal(reqBody)
 	if err != nil {
 		return err
@@ -46,6 +81,9 @@ func (c *Client) Notify(storageID string, addresses []string) error {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if c.signingKey != nil {
+		req.Header.Set("Authorization", Sign(c.signingKey, storageID, c.protocol, data))
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -0,0 +1,71 @@
+package notify
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"invariant/internal/identity"
+)
+
+var (
+	// ErrUnsigned is returned when verifying a notification without a signature.
+	ErrUnsigned = errors.New("notification is not signed")
+	// ErrInvalidSignature is returned when a notification signature is not
+	// valid for the notifying ID.
+	ErrInvalidSignature = errors.New("invalid notification signature")
+)
+
+// signatureDomain separates the signatures of notifications from the other
+// signatures made with the same key.
+const signatureDomain = "invariant-notify-v1"
+
+// signedMessage is the message signed for a notification of the blocks of
+// the service storageID, served with protocol, sent with the request body
+// data. Naming the storage ID and protocol keeps a signed body from being
+// replayed as the notification of another service or protocol.
+func signedMessage(storageID, protocol string, data []byte) []byte {
+	message := make([]byte, 0, len(signatureDomain)+len(storageID)+len(protocol)+len(data)+3)
+	message = append(message, signatureDomain...)
+	message = append(message, 0)
+	message = append(message, storageID...)
+	message = append(message, 0)
+	message = append(message, protocol...)
+	message = append(message, 0)
+	return append(message, data...)
+}
+
+// Sign returns the Authorization header value signing the notification of the
+// blocks of storageID, served with protocol, with the request body data. The
+// key must be the key of storageID, or of the relay named in the body.
+func Sign(key *identity.KeyPair, storageID, protocol string, data []byte) string {
+	signature := key.Sign(signedMessage(storageID, protocol, data))
+	return hex.EncodeToString(key.PublicKey()) + ":" + hex.EncodeToString(signature)
+}
+
+// Verify checks that authorization, an Authorization header value created by
+// Sign, signs the notification of the blocks of storageID, served with
+// protocol, with the request body data with the key of the service signer.
+func Verify(signer, storageID, protocol string, data []byte, authorization string) error {
+	if authorization == "" {
+		return ErrUnsigned
+	}
+	publicHex, signatureHex, ok := strings.Cut(authorization, ":")
+	if !ok {
+		return ErrInvalidSignature
+	}
+	public, err := hex.DecodeString(publicHex)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	signature, err := hex.DecodeString(signatureHex)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	message := signedMessage(storageID, protocol, data)
+	if err := identity.Verify(signer, ed25519.PublicKey(public), message, signature); err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
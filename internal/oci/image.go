@@ -0,0 +1,274 @@
+// Package oci ingests the layers of OCI container images into invariant
+// storage as a file tree of the merged root file system, so images can be
+// distributed and mounted like any other file tree.
+package oci
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// Media types of the manifests and indexes of an image layout. Docker
+// manifests are read the same as their OCI counterparts.
+const (
+	MediaTypeIndex          = "application/vnd.oci.image.index.v1+json"
+	MediaTypeManifest       = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// Annotations naming the image of a manifest in index.json.
+const (
+	AnnotationRefName        = "org.opencontainers.image.ref.name"
+	AnnotationContainerdName = "io.containerd.image.name"
+)
+
+// ErrDigestMismatch is returned when a blob does not match its digest.
+var ErrDigestMismatch = errors.New("blob does not match its digest")
+
+var digestRegex = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// Platform is the platform an image of a multi-platform index is built for.
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// String formats the platform as os/architecture[/variant].
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// Descriptor refers to a blob of an image layout.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// Index lists the manifests of an image layout, or of a multi-platform image.
+type Index struct {
+	MediaType string       `json:"mediaType,omitempty"`
+	Manifests []Descriptor `json:"manifests"`
+}
+
+// Manifest lists the configuration and layers of an image, lowest first.
+type Manifest struct {
+	MediaType string       `json:"mediaType,omitempty"`
+	Config    Descriptor   `json:"config"`
+	Layers    []Descriptor `json:"layers"`
+}
+
+// Image is an OCI image layout read from a directory or from a tar file such
+// as the one written by docker save.
+type Image struct {
+	open   func(name string) (io.ReadCloser, error)
+	closer io.Closer
+}
+
+// Open opens the image layout at path, which is either a directory or a tar
+// file of one.
+func Open(path string) (*Image, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &Image{open: func(name string) (io.ReadCloser, error) {
+			return os.Open(filepath.Join(path, filepath.FromSlash(name)))
+		}}, nil
+	}
+	return openTar(path)
+}
+
+// openTar indexes the regular files of the tar file at name so that blobs
+// can be read from it in any order.
+func openTar(name string) (*Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	type section struct{ offset, size int64 }
+	sections := make(map[string]section)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		// The reader seeks to the content of each entry, so the current
+		// offset of the file is where it starts
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		sections[path.Clean(hdr.Name)] = section{offset, hdr.Size}
+	}
+	return &Image{
+		open: func(name string) (io.ReadCloser, error) {
+			s, ok := sections[name]
+			if !ok {
+				return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+			}
+			return io.NopCloser(io.NewSectionReader(f, s.offset, s.size)), nil
+		},
+		closer: f,
+	}, nil
+}
+
+// Close releases the files of the image.
+func (im *Image) Close() error {
+	if im.closer != nil {
+		return im.closer.Close()
+	}
+	return nil
+}
+
+// Manifest finds the manifest of the image named ref built for platform. An
+// empty ref selects the only image of the layout and an empty platform is the
+// platform of this process, such as linux/amd64. ref matches either the
+// ref.name annotation of the image, such as "latest", or its full name, such
+// as "docker.io/library/alpine:latest".
+func (im *Image) Manifest(ref, platform string) (Manifest, error) {
+	if platform == "" {
+		platform = "linux/" + runtime.GOARCH
+	}
+	var index Index
+	if err := im.readJSON("index.json", "", &index); err != nil {
+		return Manifest{}, err
+	}
+
+	var candidates []Descriptor
+	for _, d := range index.Manifests {
+		if ref == "" || d.Annotations[AnnotationRefName] == ref || d.Annotations[AnnotationContainerdName] == ref {
+			candidates = append(candidates, d)
+		}
+	}
+	if len(candidates) == 0 {
+		return Manifest{}, fmt.Errorf("image %q not found", ref)
+	}
+	if len(candidates) > 1 {
+		return Manifest{}, fmt.Errorf("the layout has %d images, select one by name", len(candidates))
+	}
+	return im.resolve(candidates[0], platform)
+}
+
+// resolve reads the manifest of d, selecting the one for platform if d is a
+// multi-platform index.
+func (im *Image) resolve(d Descriptor, platform string) (Manifest, error) {
+	switch d.MediaType {
+	case MediaTypeManifest, MediaTypeDockerManifest:
+		var m Manifest
+		err := im.readJSON(blobName(d.Digest), d.Digest, &m)
+		return m, err
+	case MediaTypeIndex, MediaTypeDockerList:
+		var index Index
+		if err := im.readJSON(blobName(d.Digest), d.Digest, &index); err != nil {
+			return Manifest{}, err
+		}
+		for _, m := range index.Manifests {
+			if m.Platform != nil && matchPlatform(*m.Platform, platform) {
+				return im.resolve(m, platform)
+			}
+		}
+		return Manifest{}, fmt.Errorf("no image for platform %s", platform)
+	}
+	return Manifest{}, fmt.Errorf("unsupported manifest media type %q", d.MediaType)
+}
+
+// matchPlatform reports whether p is platform, given as os/architecture with
+// an optional variant.
+func matchPlatform(p Platform, platform string) bool {
+	if strings.Count(platform, "/") < 2 {
+		return p.OS+"/"+p.Architecture == platform
+	}
+	return p.String() == platform
+}
+
+// blob opens the blob with digest. The returned reader reports
+// ErrDigestMismatch at the end of a blob that does not match its digest.
+func (im *Image) blob(digest string) (io.ReadCloser, error) {
+	if !digestRegex.MatchString(digest) {
+		return nil, fmt.Errorf("unsupported digest %q", digest)
+	}
+	r, err := im.open(blobName(digest))
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{r: r, hash: sha256.New(), expected: strings.TrimPrefix(digest, "sha256:")}, nil
+}
+
+func (im *Image) readJSON(name, digest string, v any) error {
+	var r io.ReadCloser
+	var err error
+	if digest != "" {
+		r, err = im.blob(digest)
+	} else {
+		r, err = im.open(name)
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return nil
+}
+
+func blobName(digest string) string {
+	algorithm, encoded, _ := strings.Cut(digest, ":")
+	return "blobs/" + algorithm + "/" + encoded
+}
+
+// verifyingReader hashes what is read from r and checks it against expected
+// at the end of r.
+type verifyingReader struct {
+	r        io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.hash.Sum(nil)) != v.expected {
+		return n, fmt.Errorf("sha256:%s: %w", v.expected, ErrDigestMismatch)
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.r.Close()
+}
@@ -0,0 +1,259 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+	"invariant/internal/storage"
+)
+
+type testEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+func makeLayer(t *testing.T, entries []testEntry, compress bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0644, Linkname: e.linkname}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if e.typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.typeflag == tar.TypeReg {
+			tw.Write([]byte(e.body))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.Bytes()
+}
+
+// writeBlob writes data to the layout at dir and returns its descriptor.
+func writeBlob(t *testing.T, dir, mediaType string, data []byte) Descriptor {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	encoded := hex.EncodeToString(sum[:])
+	blobs := filepath.Join(dir, "blobs", "sha256")
+	os.MkdirAll(blobs, 0755)
+	if err := os.WriteFile(filepath.Join(blobs, encoded), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Descriptor{MediaType: mediaType, Digest: "sha256:" + encoded, Size: int64(len(data))}
+}
+
+func writeJSONBlob(t *testing.T, dir, mediaType string, v any) Descriptor {
+	t.Helper()
+	data, _ := json.Marshal(v)
+	return writeBlob(t, dir, mediaType, data)
+}
+
+// makeLayout writes a multi-platform image of two layers to a layout in dir.
+func makeLayout(t *testing.T, dir string) {
+	t.Helper()
+	base := makeLayer(t, []testEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/passwd", typeflag: tar.TypeReg, body: "root:x:0:0"},
+		{name: "etc/shadow", typeflag: tar.TypeReg, body: "root:*"},
+		{name: "bin/sh", typeflag: tar.TypeReg, body: "#!shell v1"},
+		{name: "bin/bash", typeflag: tar.TypeLink, linkname: "bin/sh"},
+		{name: "usr/lib/a.so", typeflag: tar.TypeReg, body: "a"},
+		{name: "usr/lib/b.so", typeflag: tar.TypeReg, body: "b"},
+		{name: "lib", typeflag: tar.TypeSymlink, linkname: "usr/lib"},
+		{name: "dev/null", typeflag: tar.TypeChar},
+	}, true)
+	top := makeLayer(t, []testEntry{
+		{name: "etc/.wh..wh..opq", typeflag: tar.TypeReg},
+		{name: "etc/hosts", typeflag: tar.TypeReg, body: "127.0.0.1 localhost"},
+		{name: "usr/lib/.wh.a.so", typeflag: tar.TypeReg},
+		{name: "bin/sh", typeflag: tar.TypeReg, body: "#!shell v2"},
+		{name: "missing/.wh.x", typeflag: tar.TypeReg},
+	}, false)
+
+	config := writeJSONBlob(t, dir, "application/vnd.oci.image.config.v1+json", map[string]any{})
+	manifest := writeJSONBlob(t, dir, MediaTypeManifest, Manifest{
+		MediaType: MediaTypeManifest,
+		Config:    config,
+		Layers: []Descriptor{
+			writeBlob(t, dir, "application/vnd.oci.image.layer.v1.tar+gzip", base),
+			writeBlob(t, dir, "application/vnd.oci.image.layer.v1.tar", top),
+		},
+	})
+	manifest.Platform = &Platform{OS: "linux", Architecture: "arm64"}
+	attestation := writeJSONBlob(t, dir, MediaTypeManifest, Manifest{Config: config})
+	attestation.Platform = &Platform{OS: "unknown", Architecture: "unknown"}
+	index := writeJSONBlob(t, dir, MediaTypeIndex, Index{
+		MediaType: MediaTypeIndex,
+		Manifests: []Descriptor{attestation, manifest},
+	})
+	index.Annotations = map[string]string{
+		AnnotationRefName:        "latest",
+		AnnotationContainerdName: "docker.io/library/test:latest",
+	}
+
+	data, _ := json.Marshal(Index{Manifests: []Descriptor{index}})
+	os.WriteFile(filepath.Join(dir, "index.json"), data, 0644)
+	os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+}
+
+// tarDirectory writes the files of dir to a tar file.
+func tarDirectory(t *testing.T, dir, name string) {
+	t.Helper()
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	if err := tw.AddFS(os.DirFS(dir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, root content.ContentLink, p string, store storage.Storage) string {
+	t.Helper()
+	entry, err := filetree.Lookup(context.Background(), root, p, store, nil)
+	if err != nil {
+		t.Fatalf("%s: %v", p, err)
+	}
+	file, ok := entry.(*filetree.FileEntry)
+	if !ok {
+		t.Fatalf("%s: expected a file, got %#v", p, entry)
+	}
+	r, err := content.Read(file.Content, store, nil)
+	if err != nil {
+		t.Fatalf("%s: %v", p, err)
+	}
+	defer r.Close()
+	data, _ := io.ReadAll(r)
+	return string(data)
+}
+
+func TestIngest(t *testing.T) {
+	layout := t.TempDir()
+	makeLayout(t, layout)
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	tarDirectory(t, layout, archive)
+
+	var roots []content.ContentLink
+	for _, path := range []string{layout, archive} {
+		im, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer im.Close()
+
+		if _, err := im.Manifest("other", "linux/arm64"); err == nil {
+			t.Errorf("expected an unknown image to fail")
+		}
+		if _, err := im.Manifest("latest", "linux/s390x"); err == nil {
+			t.Errorf("expected a missing platform to fail")
+		}
+		m, err := im.Manifest("docker.io/library/test:latest", "linux/arm64")
+		if err != nil {
+			t.Fatalf("Manifest failed: %v", err)
+		}
+		if len(m.Layers) != 2 {
+			t.Fatalf("expected 2 layers, got %d", len(m.Layers))
+		}
+
+		store := storage.NewInMemoryStorage()
+		root, stats, err := im.Ingest(context.Background(), m, store, content.WriterOptions{})
+		if err != nil {
+			t.Fatalf("Ingest failed: %v", err)
+		}
+		if stats.Layers != 2 || stats.Whiteouts != 3 || stats.Skipped != 1 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+		roots = append(roots, root)
+
+		if got := readFile(t, root, "etc/hosts", store); got != "127.0.0.1 localhost" {
+			t.Errorf("etc/hosts: got %q", got)
+		}
+		if got := readFile(t, root, "bin/sh", store); got != "#!shell v2" {
+			t.Errorf("bin/sh: got %q", got)
+		}
+		if got := readFile(t, root, "bin/bash", store); got != "#!shell v1" {
+			t.Errorf("bin/bash: got %q", got)
+		}
+		if got := readFile(t, root, "usr/lib/b.so", store); got != "b" {
+			t.Errorf("usr/lib/b.so: got %q", got)
+		}
+		for _, p := range []string{"etc/passwd", "etc/shadow", "usr/lib/a.so", "dev/null", "missing"} {
+			if entry, err := filetree.Lookup(context.Background(), root, p, store, nil); err != nil || entry != nil {
+				t.Errorf("%s: expected no entry, got %v %v", p, entry, err)
+			}
+		}
+		entry, _ := filetree.Lookup(context.Background(), root, "lib", store, nil)
+		if link, ok := entry.(*filetree.SymbolicLinkEntry); !ok || link.Target != "usr/lib" {
+			t.Errorf("lib: expected a link to usr/lib, got %#v", entry)
+		}
+
+		// Ingesting the image again stores nothing new
+		_, again, err := im.Ingest(context.Background(), m, store, content.WriterOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.Blocks != 0 || again.Existing == 0 {
+			t.Errorf("expected every block to exist, got %+v", again)
+		}
+	}
+	if roots[0].Address != roots[1].Address {
+		t.Errorf("the layout and its archive have different roots")
+	}
+}
+
+func TestIngest_DigestMismatch(t *testing.T) {
+	layout := t.TempDir()
+	makeLayout(t, layout)
+	im, err := Open(layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := im.Manifest("", "linux/arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := filepath.Join(layout, filepath.FromSlash(blobName(m.Layers[1].Digest)))
+	data, _ := os.ReadFile(layer)
+	os.WriteFile(layer, append(data, 0), 0644)
+
+	_, _, err = im.Ingest(context.Background(), m, storage.NewInMemoryStorage(), content.WriterOptions{})
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("expected ErrDigestMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,329 @@
+package oci
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+	"invariant/internal/storage"
+)
+
+// Whiteout files of a layer remove a path of the lower layers. The opaque
+// whiteout removes every entry of its directory from the lower layers.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Stats counts the work of an ingestion.
+type Stats struct {
+	Layers    int    // layers applied
+	Files     int    // regular files and hard links in the root file system
+	Bytes     uint64 // bytes of the regular files written
+	Whiteouts int    // whiteout entries applied
+	Skipped   int    // devices, pipes and hard links to missing files
+	Blocks    int    // blocks stored
+	Existing  int    // blocks the storage already had
+}
+
+// node is a path of the merged root file system.
+type node struct {
+	entry    filetree.Entry   // *FileEntry, *SymbolicLinkEntry or *DirectoryEntry
+	children map[string]*node // the entries of a directory
+	layer    int              // the layer that last wrote the node
+}
+
+// Ingest applies the layers of m in order and writes the merged root file
+// system to store as a file tree, returning the link to its root directory.
+// File content is chunked by content.Write with opts, and blocks the storage
+// already has, such as those of a shared base image, are not stored again.
+func (im *Image) Ingest(ctx context.Context, m Manifest, store storage.Storage, opts content.WriterOptions) (content.ContentLink, Stats, error) {
+	var stats Stats
+	dedup := &dedupStorage{Storage: store, stats: &stats}
+	root := newDirectory("", nil, 0)
+	for i, layer := range m.Layers {
+		if err := ctx.Err(); err != nil {
+			return content.ContentLink{}, stats, err
+		}
+		if err := im.applyLayer(ctx, root, layer, i+1, dedup, opts, &stats); err != nil {
+			return content.ContentLink{}, stats, fmt.Errorf("layer %s: %w", layer.Digest, err)
+		}
+		stats.Layers++
+	}
+
+	opts.InlineMax = 0
+	entry, err := writeDirectory(root, dedup, opts)
+	if err != nil {
+		return content.ContentLink{}, stats, err
+	}
+	return entry.Content, stats, nil
+}
+
+// applyLayer reads the changeset of layer, gzip compressed or not, into root.
+func (im *Image) applyLayer(ctx context.Context, root *node, layer Descriptor, index int, store storage.Storage, opts content.WriterOptions, stats *Stats) error {
+	blob, err := im.blob(layer.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	br := bufio.NewReader(blob)
+	var r io.Reader = br
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return fmt.Errorf("zstd compressed layers are not supported")
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := apply(root, hdr, tr, index, store, opts, stats); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+
+	// Read to the end of the blob to verify its digest
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, br)
+	return err
+}
+
+// apply applies a single entry of a layer to root.
+func apply(root *node, hdr *tar.Header, r io.Reader, layer int, store storage.Storage, opts content.WriterOptions, stats *Stats) error {
+	p := path.Clean("/" + hdr.Name)
+	if p == "/" {
+		if hdr.Typeflag == tar.TypeDir {
+			root.entry = newDirectory("", hdr, layer).entry
+		}
+		return nil
+	}
+	dir, name := path.Split(p)
+	if strings.HasPrefix(name, whiteoutPrefix) {
+		stats.Whiteouts++
+		parent := lookup(root, dir)
+		if parent == nil || parent.children == nil {
+			return nil
+		}
+		if name == whiteoutOpaque {
+			for childName, child := range parent.children {
+				if child.layer < layer {
+					delete(parent.children, childName)
+				}
+			}
+		} else {
+			delete(parent.children, strings.TrimPrefix(name, whiteoutPrefix))
+		}
+		return nil
+	}
+	parent := ensureDirectory(root, dir, layer)
+
+	base := filetree.BaseEntry{
+		Name:       name,
+		Mode:       mode(hdr),
+		CreateTime: unixTime(hdr),
+		ModifyTime: unixTime(hdr),
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if existing, ok := parent.children[name]; ok && existing.children != nil {
+			// Only the attributes change, the entries of lower layers remain
+			existing.entry = newDirectory(name, hdr, layer).entry
+			existing.layer = layer
+			return nil
+		}
+		parent.children[name] = newDirectory(name, hdr, layer)
+	case tar.TypeReg:
+		fileOpts := opts
+		fileOpts.Filename = name
+		link, err := content.Write(r, store, fileOpts)
+		if err != nil {
+			return err
+		}
+		base.Kind = filetree.FileKind
+		parent.children[name] = &node{
+			entry: &filetree.FileEntry{BaseEntry: base, Content: link, Size: uint64(hdr.Size)},
+			layer: layer,
+		}
+		stats.Files++
+		stats.Bytes += uint64(hdr.Size)
+	case tar.TypeSymlink:
+		base.Kind = filetree.SymbolicLinkKind
+		parent.children[name] = &node{
+			entry: &filetree.SymbolicLinkEntry{BaseEntry: base, Target: hdr.Linkname},
+			layer: layer,
+		}
+	case tar.TypeLink:
+		// A hard link shares the content of its target, which may be in a
+		// lower layer
+		var file *filetree.FileEntry
+		if target := lookup(root, path.Clean("/"+hdr.Linkname)); target != nil {
+			file, _ = target.entry.(*filetree.FileEntry)
+		}
+		if file == nil {
+			stats.Skipped++
+			return nil
+		}
+		linked := *file
+		linked.Name = name
+		parent.children[name] = &node{entry: &linked, layer: layer}
+		stats.Files++
+	default:
+		stats.Skipped++
+	}
+	return nil
+}
+
+// ensureDirectory returns the directory at dir, creating it and its parents,
+// or replacing files in their way, as a tar extraction would.
+func ensureDirectory(root *node, dir string, layer int) *node {
+	current := root
+	for _, name := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		child, ok := current.children[name]
+		if !ok || child.children == nil {
+			child = newDirectory(name, nil, layer)
+			current.children[name] = child
+		}
+		current = child
+	}
+	return current
+}
+
+// lookup returns the node at p, or nil if there is none.
+func lookup(root *node, p string) *node {
+	current := root
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		child, ok := current.children[name]
+		if !ok {
+			return nil
+		}
+		current = child
+	}
+	return current
+}
+
+// newDirectory creates a directory node with the attributes of hdr, or the
+// defaults of an implicit directory if hdr is nil.
+func newDirectory(name string, hdr *tar.Header, layer int) *node {
+	defaultMode := "0755"
+	base := filetree.BaseEntry{Kind: filetree.DirectoryKind, Name: name, Mode: &defaultMode}
+	if hdr != nil {
+		base.Mode = mode(hdr)
+		base.CreateTime = unixTime(hdr)
+		base.ModifyTime = unixTime(hdr)
+	}
+	return &node{
+		entry:    &filetree.DirectoryEntry{BaseEntry: base},
+		children: make(map[string]*node),
+		layer:    layer,
+	}
+}
+
+// writeDirectory writes the directories below n, and then n, to store.
+func writeDirectory(n *node, store storage.Storage, opts content.WriterOptions) (*filetree.DirectoryEntry, error) {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	dir := make(filetree.Directory, 0, len(names))
+	for _, name := range names {
+		child := n.children[name]
+		if child.children != nil {
+			entry, err := writeDirectory(child, store, opts)
+			if err != nil {
+				return nil, err
+			}
+			dir = append(dir, entry)
+		} else {
+			dir = append(dir, child.entry)
+		}
+	}
+
+	data, err := json.Marshal(dir)
+	if err != nil {
+		return nil, err
+	}
+	link, err := content.Write(bytes.NewReader(data), store, opts)
+	if err != nil {
+		return nil, err
+	}
+	totalSize, totalEntries := dir.Totals()
+	entry := *n.entry.(*filetree.DirectoryEntry)
+	entry.Content = link
+	entry.Size = uint64(len(data))
+	entry.TotalSize = totalSize
+	entry.TotalEntries = totalEntries
+	return &entry, nil
+}
+
+func mode(hdr *tar.Header) *string {
+	mode := fmt.Sprintf("%04o", hdr.FileInfo().Mode().Perm())
+	return &mode
+}
+
+func unixTime(hdr *tar.Header) *uint64 {
+	if hdr.ModTime.IsZero() || hdr.ModTime.Unix() < 0 {
+		return nil
+	}
+	t := uint64(hdr.ModTime.Unix())
+	return &t
+}
+
+// dedupStorage stores only the blocks its storage does not already have.
+type dedupStorage struct {
+	storage.Storage
+	stats *Stats
+}
+
+func (s *dedupStorage) Store(ctx context.Context, r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	address := hex.EncodeToString(sum[:])
+	if s.Storage.Has(ctx, address) {
+		s.stats.Existing++
+		return address, nil
+	}
+	s.stats.Blocks++
+	return s.Storage.Store(ctx, bytes.NewReader(data))
+}
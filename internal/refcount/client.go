@@ -0,0 +1,209 @@
+// Package refcount provides the HTTP client for the reference counting service.
+package refcount
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"invariant/internal/httputil"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Client implements the RefCount interface by forwarding requests to a remote HTTP server.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewClient creates a new HTTP reference counting client.
+func NewClient(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	httpClient = httputil.NewDiagnosticClient(httpClient)
+	return &Client{
+		baseURL:    baseURL,
+		httpClient: httpClient,
+	}
+}
+
+// ID fetched from the remote reference counting service endpoint.
+func (c *Client) ID() string {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/id", c.baseURL), nil)
+	if err != nil {
+		return ""
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ""
+	}
+
+	return string(body)
+}
+
+// Get fetches the reference count of the block.
+func (c *Client) Get(ctx context.Context, address string) (int64, error) {
+	return c.doCount(ctx, http.MethodGet, fmt.Sprintf("%s/%s", c.baseURL, address))
+}
+
+// Pin adds an explicit reference to the block.
+func (c *Client) Pin(ctx context.Context, address string) (int64, error) {
+	return c.doCount(ctx, http.MethodPut, fmt.Sprintf("%s/pin/%s", c.baseURL, address))
+}
+
+// Unpin removes an explicit reference to the block.
+func (c *Client) Unpin(ctx context.Context, address string) (int64, error) {
+	return c.doCount(ctx, http.MethodPut, fmt.Sprintf("%s/unpin/%s", c.baseURL, address))
+}
+
+// SetReferences records the blocks referenced by address.
+func (c *Client) SetReferences(ctx context.Context, address string, references []string) error {
+	if references == nil {
+		references = []string{}
+	}
+	body, err := json.Marshal(references)
+	if err != nil {
+		return err
+	}
+	return c.doPut(ctx, fmt.Sprintf("%s/references/%s", c.baseURL, address), body)
+}
+
+// PublishRoot records that the slot now points at address.
+func (c *Client) PublishRoot(ctx context.Context, slot string, address string, previousAddress string) error {
+	body, err := json.Marshal(RootUpdate{Address: address, PreviousAddress: previousAddress})
+	if err != nil {
+		return err
+	}
+	return c.doPut(ctx, fmt.Sprintf("%s/root/%s", c.baseURL, slot), body)
+}
+
+// Collectable fetches the unreferenced blocks known to the remote service.
+func (c *Client) Collectable(ctx context.Context, chunkSize int) <-chan []string {
+	if chunkSize <= 0 {
+		chunkSize = 10000
+	}
+	ch := make(chan []string)
+
+	go func() {
+		defer close(ch)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/collectable", c.baseURL), nil)
+		if err != nil {
+			return
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return
+		}
+
+		var addresses []string
+		if err := json.NewDecoder(resp.Body).Decode(&addresses); err != nil {
+			return
+		}
+
+		for start := 0; start < len(addresses); start += chunkSize {
+			end := min(start+chunkSize, len(addresses))
+			select {
+			case ch <- addresses[start:end]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// Forget removes an unreferenced block from the remote service.
+func (c *Client) Forget(ctx context.Context, address string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fmt.Sprintf("%s/%s", c.baseURL, address), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return ErrReferenced
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *Client) doCount(ctx context.Context, method string, url string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, ErrNotPinned
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+}
+
+func (c *Client) doPut(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return ErrConflict
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Assert that Client implements the RefCount interface
+var _ RefCount = (*Client)(nil)
@@ -0,0 +1,73 @@
+package refcount
+
+import (
+	"path/filepath"
+	"time"
+
+	"invariant/internal/journal"
+)
+
+// Assert that FileSystemRefCount implements the RefCount interface
+var _ RefCount = (*FileSystemRefCount)(nil)
+
+// FileSystemRefCount is a MemoryRefCount whose entries and slot roots are
+// journaled to a directory, so the counts survive a restart.
+type FileSystemRefCount struct {
+	*MemoryRefCount
+	entries *journal.Store[string, Entry]
+	roots   *journal.Store[string, string]
+}
+
+// NewFileSystemRefCount creates a FileSystemRefCount with the ID id, loading
+// the state journaled in baseDir. The journals are snapshotted every
+// snapshotInterval.
+func NewFileSystemRefCount(id, baseDir string, snapshotInterval time.Duration) (*FileSystemRefCount, error) {
+	entries, err := journal.NewStore[string, Entry](filepath.Join(baseDir, "entries"), snapshotInterval)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := journal.NewStore[string, string](filepath.Join(baseDir, "roots"), snapshotInterval)
+	if err != nil {
+		entries.Close()
+		return nil, err
+	}
+
+	f := &FileSystemRefCount{MemoryRefCount: NewMemoryRefCount(id), entries: entries, roots: roots}
+	entries.Read(func(m map[string]Entry) {
+		for address, e := range m {
+			f.MemoryRefCount.entries[address] = &e
+		}
+	})
+	roots.Read(func(m map[string]string) {
+		for slot, address := range m {
+			f.MemoryRefCount.roots[slot] = address
+		}
+	})
+	f.MemoryRefCount.store = f
+	return f, nil
+}
+
+// Close closes the journals.
+func (f *FileSystemRefCount) Close() error {
+	err := f.entries.Close()
+	if rootsErr := f.roots.Close(); err == nil {
+		err = rootsErr
+	}
+	return err
+}
+
+func (f *FileSystemRefCount) putEntry(address string, e Entry) error {
+	return f.entries.Put(address, e, nil)
+}
+
+func (f *FileSystemRefCount) deleteEntry(address string) error {
+	return f.entries.Delete(address, nil)
+}
+
+func (f *FileSystemRefCount) putRoot(slot, address string) error {
+	return f.roots.Put(slot, address, nil)
+}
+
+func (f *FileSystemRefCount) deleteRoot(slot string) error {
+	return f.roots.Delete(slot, nil)
+}
@@ -0,0 +1,287 @@
+// Package refcount provides the in-memory implementation for the reference counting service.
+package refcount
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// Assert that MemoryRefCount implements the RefCount interface
+var _ RefCount = (*MemoryRefCount)(nil)
+
+// MemoryRefCount provides an in-memory implementation of the RefCount interface.
+type MemoryRefCount struct {
+	id      string
+	mu      sync.Mutex
+	entries map[string]*Entry
+	roots   map[string]string
+
+	// store, if set, saves the entries and roots changed by each operation,
+	// which are recorded in changed and changedRoots until they are saved.
+	store        refStore
+	changed      map[string]bool
+	changedRoots map[string]bool
+}
+
+// refStore saves the state of a MemoryRefCount, see FileSystemRefCount.
+type refStore interface {
+	putEntry(address string, e Entry) error
+	deleteEntry(address string) error
+	putRoot(slot, address string) error
+	deleteRoot(slot string) error
+}
+
+// NewMemoryRefCount creates a new MemoryRefCount instance.
+func NewMemoryRefCount(id string) *MemoryRefCount {
+	return &MemoryRefCount{
+		id:      id,
+		entries: make(map[string]*Entry),
+		roots:   make(map[string]string),
+	}
+}
+
+// saveLocked saves the entries and roots changed since it was last called.
+// m.mu must be held.
+func (m *MemoryRefCount) saveLocked() error {
+	changed, changedRoots := m.changed, m.changedRoots
+	m.changed, m.changedRoots = nil, nil
+	if m.store == nil {
+		return nil
+	}
+	for address := range changed {
+		var err error
+		if e, ok := m.entries[address]; ok {
+			saved := *e
+			saved.References = slices.Clone(e.References)
+			err = m.store.putEntry(address, saved)
+		} else {
+			err = m.store.deleteEntry(address)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for slot := range changedRoots {
+		var err error
+		if address, ok := m.roots[slot]; ok {
+			err = m.store.putRoot(slot, address)
+		} else {
+			err = m.store.deleteRoot(slot)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// touch records that the entry of address changed.
+func (m *MemoryRefCount) touch(address string) {
+	if m.store == nil {
+		return
+	}
+	if m.changed == nil {
+		m.changed = make(map[string]bool)
+	}
+	m.changed[address] = true
+}
+
+// touchRoot records that the root of slot changed.
+func (m *MemoryRefCount) touchRoot(slot string) {
+	if m.store == nil {
+		return
+	}
+	if m.changedRoots == nil {
+		m.changedRoots = make(map[string]bool)
+	}
+	m.changedRoots[slot] = true
+}
+
+// ID returns the service ID.
+func (m *MemoryRefCount) ID() string {
+	return m.id
+}
+
+// Get returns the current reference count of the block.
+func (m *MemoryRefCount) Get(ctx context.Context, address string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entries[address]; ok {
+		return e.Count, nil
+	}
+	return 0, nil
+}
+
+// Pin adds an explicit reference to the block.
+func (m *MemoryRefCount) Pin(ctx context.Context, address string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.acquire(address)
+	e := m.entries[address]
+	e.Pins++
+	return e.Count, m.saveLocked()
+}
+
+// Unpin removes an explicit reference to the block.
+func (m *MemoryRefCount) Unpin(ctx context.Context, address string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[address]
+	if !ok || e.Pins == 0 {
+		return 0, ErrNotPinned
+	}
+
+	e.Pins--
+	m.touch(address)
+	m.release(address)
+	return e.Count, m.saveLocked()
+}
+
+// SetReferences records the blocks referenced by address.
+func (m *MemoryRefCount) SetReferences(ctx context.Context, address string, references []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.entry(address)
+	previous := e.References
+	e.References = append([]string(nil), references...)
+	m.touch(address)
+
+	// Only live blocks hold their children alive, so the children's counts
+	// only need to be adjusted when the parent is referenced. The children of
+	// an unreferenced parent are not recorded until it is, so they are not
+	// reported as collectable while the parent is still being written.
+	if e.Count > 0 {
+		for _, child := range e.References {
+			m.acquire(child)
+		}
+		for _, child := range previous {
+			m.release(child)
+		}
+	}
+	return m.saveLocked()
+}
+
+// PublishRoot records that the slot now points at address.
+func (m *MemoryRefCount) PublishRoot(ctx context.Context, slot string, address string, previousAddress string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current := m.roots[slot]
+	if current != previousAddress {
+		return ErrConflict
+	}
+	if current == address {
+		return nil
+	}
+
+	if address != "" {
+		m.acquire(address)
+		m.roots[slot] = address
+	} else {
+		delete(m.roots, slot)
+	}
+	m.touchRoot(slot)
+	if current != "" {
+		m.release(current)
+	}
+	return m.saveLocked()
+}
+
+// Collectable yields chunks of blocks that are no longer referenced.
+func (m *MemoryRefCount) Collectable(ctx context.Context, chunkSize int) <-chan []string {
+	if chunkSize <= 0 {
+		chunkSize = 10000
+	}
+	ch := make(chan []string)
+
+	m.mu.Lock()
+	var collectable []string
+	for addr, e := range m.entries {
+		if e.Count == 0 {
+			collectable = append(collectable, addr)
+		}
+	}
+	m.mu.Unlock()
+
+	go func() {
+		defer close(ch)
+		for start := 0; start < len(collectable); start += chunkSize {
+			end := min(start+chunkSize, len(collectable))
+			select {
+			case ch <- collectable[start:end]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// Forget removes an unreferenced block from the service.
+func (m *MemoryRefCount) Forget(ctx context.Context, address string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[address]
+	if !ok {
+		return nil
+	}
+	if e.Count > 0 {
+		return ErrReferenced
+	}
+	delete(m.entries, address)
+	m.touch(address)
+	return m.saveLocked()
+}
+
+func (m *MemoryRefCount) entry(address string) *Entry {
+	e, ok := m.entries[address]
+	if !ok {
+		e = &Entry{}
+		m.entries[address] = e
+	}
+	return e
+}
+
+// acquire increments the count of address. When the block becomes live its
+// references are acquired as well.
+func (m *MemoryRefCount) acquire(address string) {
+	pending := []string{address}
+	for len(pending) > 0 {
+		addr := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		e := m.entry(addr)
+		e.Count++
+		m.touch(addr)
+		if e.Count == 1 {
+			pending = append(pending, e.References...)
+		}
+	}
+}
+
+// release decrements the count of address. When the block is no longer
+// referenced its references are released as well.
+func (m *MemoryRefCount) release(address string) {
+	pending := []string{address}
+	for len(pending) > 0 {
+		addr := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		e, ok := m.entries[addr]
+		if !ok || e.Count == 0 {
+			continue
+		}
+		e.Count--
+		m.touch(addr)
+		if e.Count == 0 {
+			pending = append(pending, e.References...)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Package refcount provides the core interface for the reference counting service.
+//
+// The reference counting service tracks how many live references exist to each
+// block. References come from explicit pins, from published slot roots, and from
+// the edges between a block and the blocks it references (for example a block
+// list or a directory). When the count of a block drops to zero it becomes
+// collectable, and the blocks it references are released in turn. This allows
+// garbage to be identified incrementally while the system stays online.
+package refcount
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotPinned is returned when unpinning a block that has no pins.
+var ErrNotPinned = errors.New("block is not pinned")
+
+// ErrReferenced is returned when attempting to forget a block that is still referenced.
+var ErrReferenced = errors.New("block is still referenced")
+
+// ErrConflict is returned when a root update does not match the current root of the slot.
+var ErrConflict = errors.New("conflict: previous address does not match")
+
+// Entry holds the reference count and the outgoing references of a single block.
+type Entry struct {
+	Count      int64    `json:"count"`
+	Pins       int64    `json:"pins,omitempty"` // explicit references, counted by Count
+	References []string `json:"references,omitempty"`
+}
+
+// RootUpdate represents the publication of a new root address for a slot.
+type RootUpdate struct {
+	Address         string `json:"address"`
+	PreviousAddress string `json:"previousAddress"`
+}
+
+// RefCount defines the interface for a reference counting service.
+type RefCount interface {
+	// ID returns the ID of the reference counting service itself.
+	ID() string
+
+	// Get returns the current reference count of the block. Unknown blocks have a count of zero.
+	Get(ctx context.Context, address string) (int64, error)
+
+	// Pin adds an explicit reference to the block and returns the new count.
+	Pin(ctx context.Context, address string) (int64, error)
+
+	// Unpin removes an explicit reference to the block and returns the new
+	// count. It returns ErrNotPinned if the block has no explicit references,
+	// so references held by roots and other blocks cannot be unpinned.
+	Unpin(ctx context.Context, address string) (int64, error)
+
+	// SetReferences records the blocks referenced by address, replacing any
+	// previously recorded references. The references only hold the children
+	// alive while the block itself is referenced.
+	SetReferences(ctx context.Context, address string, references []string) error
+
+	// PublishRoot records that the slot now points at address. The new root is
+	// referenced and the previous root is released. previousAddress must match
+	// the root last published for the slot.
+	PublishRoot(ctx context.Context, slot string, address string, previousAddress string) error
+
+	// Collectable returns a channel that yields chunks of blocks that are known
+	// to the service but are no longer referenced.
+	Collectable(ctx context.Context, chunkSize int) <-chan []string
+
+	// Forget removes an unreferenced block from the service once it has been
+	// collected.
+	Forget(ctx context.Context, address string) error
+}
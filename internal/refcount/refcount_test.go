@@ -0,0 +1,214 @@
+// Package refcount_test provides tests for the reference counting service.
+package refcount_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+	"invariant/internal/refcount"
+	"invariant/internal/storage"
+)
+
+func collectable(t *testing.T, refs refcount.RefCount) []string {
+	var result []string
+	for chunk := range refs.Collectable(context.Background(), 2) {
+		result = append(result, chunk...)
+	}
+	slices.Sort(result)
+	return result
+}
+
+func expectCount(t *testing.T, refs refcount.RefCount, address string, expected int64) {
+	t.Helper()
+	count, err := refs.Get(context.Background(), address)
+	if err != nil {
+		t.Fatalf("failed to get count of %s: %v", address, err)
+	}
+	if count != expected {
+		t.Fatalf("expected count of %s to be %d, got %d", address, expected, count)
+	}
+}
+
+func runRefCountTest(t *testing.T, refs refcount.RefCount) {
+	ctx := context.Background()
+
+	// root -> a, b; a -> c; b -> c
+	if err := refs.SetReferences(ctx, "root", []string{"a", "b"}); err != nil {
+		t.Fatalf("failed to set references: %v", err)
+	}
+	if err := refs.SetReferences(ctx, "a", []string{"c"}); err != nil {
+		t.Fatalf("failed to set references: %v", err)
+	}
+	if err := refs.SetReferences(ctx, "b", []string{"c"}); err != nil {
+		t.Fatalf("failed to set references: %v", err)
+	}
+
+	// Nothing is referenced yet so the recorded blocks are collectable, but
+	// not c, which is only known as a child of unreferenced blocks
+	if got := collectable(t, refs); !slices.Equal(got, []string{"a", "b", "root"}) {
+		t.Fatalf("unexpected collectable set: %v", got)
+	}
+
+	// Publishing the root makes the whole tree live
+	if err := refs.PublishRoot(ctx, "slot", "root", ""); err != nil {
+		t.Fatalf("failed to publish root: %v", err)
+	}
+	expectCount(t, refs, "root", 1)
+	expectCount(t, refs, "a", 1)
+	expectCount(t, refs, "c", 2)
+	if got := collectable(t, refs); len(got) != 0 {
+		t.Fatalf("expected nothing to be collectable, got %v", got)
+	}
+
+	// A stale previous address is rejected
+	if err := refs.PublishRoot(ctx, "slot", "other", "stale"); err != refcount.ErrConflict {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+
+	// References held by roots and other blocks cannot be unpinned
+	if _, err := refs.Unpin(ctx, "c"); err != refcount.ErrNotPinned {
+		t.Fatalf("expected ErrNotPinned for an unpinned block, got %v", err)
+	}
+	expectCount(t, refs, "c", 2)
+
+	// Pin c so it survives the root being replaced
+	if count, err := refs.Pin(ctx, "c"); err != nil || count != 3 {
+		t.Fatalf("expected pin to return 3, got %d (err: %v)", count, err)
+	}
+
+	if err := refs.SetReferences(ctx, "root2", []string{"b"}); err != nil {
+		t.Fatalf("failed to set references: %v", err)
+	}
+	if err := refs.PublishRoot(ctx, "slot", "root2", "root"); err != nil {
+		t.Fatalf("failed to publish root: %v", err)
+	}
+	expectCount(t, refs, "root", 0)
+	expectCount(t, refs, "a", 0)
+	expectCount(t, refs, "b", 1)
+	expectCount(t, refs, "c", 2)
+
+	if got := collectable(t, refs); !slices.Equal(got, []string{"a", "root"}) {
+		t.Fatalf("unexpected collectable set: %v", got)
+	}
+
+	// Referenced blocks cannot be forgotten
+	if err := refs.Forget(ctx, "b"); err != refcount.ErrReferenced {
+		t.Fatalf("expected ErrReferenced, got %v", err)
+	}
+	if err := refs.Forget(ctx, "a"); err != nil {
+		t.Fatalf("failed to forget a: %v", err)
+	}
+	if got := collectable(t, refs); !slices.Equal(got, []string{"root"}) {
+		t.Fatalf("unexpected collectable set: %v", got)
+	}
+
+	// Unpin drops c back to the reference held by b
+	if count, err := refs.Unpin(ctx, "c"); err != nil || count != 1 {
+		t.Fatalf("expected unpin to return 1, got %d (err: %v)", count, err)
+	}
+	if _, err := refs.Unpin(ctx, "c"); err != refcount.ErrNotPinned {
+		t.Fatalf("expected ErrNotPinned once the pin is removed, got %v", err)
+	}
+	expectCount(t, refs, "c", 1)
+	if _, err := refs.Unpin(ctx, "missing"); err != refcount.ErrNotPinned {
+		t.Fatalf("expected ErrNotPinned, got %v", err)
+	}
+}
+
+func TestMemoryRefCount(t *testing.T) {
+	runRefCountTest(t, refcount.NewMemoryRefCount("test-id"))
+}
+
+func TestRefCountClient(t *testing.T) {
+	service := refcount.NewMemoryRefCount("test-id")
+	ts := httptest.NewServer(refcount.NewServer(service))
+	defer ts.Close()
+
+	client := refcount.NewClient(ts.URL, ts.Client())
+	if id := client.ID(); id != "test-id" {
+		t.Fatalf("expected id %q, got %q", "test-id", id)
+	}
+
+	runRefCountTest(t, client)
+}
+
+func TestFileSystemRefCount(t *testing.T) {
+	dir := t.TempDir()
+	refs, err := refcount.NewFileSystemRefCount("test-id", dir, 0)
+	if err != nil {
+		t.Fatalf("failed to create refcount: %v", err)
+	}
+	runRefCountTest(t, refs)
+	if err := refs.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// The counts and roots survive a restart
+	refs, err = refcount.NewFileSystemRefCount("test-id", dir, 0)
+	if err != nil {
+		t.Fatalf("failed to reopen refcount: %v", err)
+	}
+	defer refs.Close()
+	expectCount(t, refs, "root2", 1)
+	expectCount(t, refs, "b", 1)
+	expectCount(t, refs, "c", 1)
+	if got := collectable(t, refs); !slices.Equal(got, []string{"root"}) {
+		t.Fatalf("unexpected collectable set after restart: %v", got)
+	}
+	if err := refs.PublishRoot(context.Background(), "slot", "", "root2"); err != nil {
+		t.Fatalf("failed to clear the root: %v", err)
+	}
+	expectCount(t, refs, "c", 0)
+}
+
+func TestTreePublisher(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewInMemoryStorage()
+	refs := refcount.NewMemoryRefCount("test-id")
+	publisher := refcount.NewTreePublisher(refs, store)
+
+	write := func(data []byte) content.ContentLink {
+		link, err := content.Write(bytes.NewReader(data), store, content.WriterOptions{})
+		if err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		return link
+	}
+	file := func(name, data string) *filetree.FileEntry {
+		return &filetree.FileEntry{BaseEntry: filetree.BaseEntry{Kind: filetree.FileKind, Name: name}, Content: write([]byte(data)), Size: uint64(len(data))}
+	}
+	directory := func(name string, entries ...filetree.Entry) *filetree.DirectoryEntry {
+		data, _ := json.Marshal(filetree.Directory(entries))
+		return &filetree.DirectoryEntry{BaseEntry: filetree.BaseEntry{Kind: filetree.DirectoryKind, Name: name}, Content: write(data)}
+	}
+
+	a := file("a.txt", "a")
+	b := file("b.txt", "b")
+	sub := directory("sub", b)
+	root := directory("", a, sub)
+	if err := publisher.PublishRoot(ctx, "slot", root.Content.Address, ""); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	expectCount(t, refs, root.Content.Address, 1)
+	expectCount(t, refs, a.Content.Address, 1)
+	expectCount(t, refs, sub.Content.Address, 1)
+	expectCount(t, refs, b.Content.Address, 1)
+
+	// Replacing the root releases the blocks only the old tree held
+	root2 := directory("", a)
+	if err := publisher.PublishRoot(ctx, "slot", root2.Content.Address, root.Content.Address); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	expectCount(t, refs, a.Content.Address, 1)
+	want := []string{root.Content.Address, sub.Content.Address, b.Content.Address}
+	slices.Sort(want)
+	if got := collectable(t, refs); !slices.Equal(got, want) {
+		t.Fatalf("unexpected collectable set: %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,140 @@
+// Package refcount provides the HTTP server for the reference counting service.
+package refcount
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Server wraps a RefCount implementation and provides HTTP endpoints.
+type Server struct {
+	refs RefCount
+}
+
+// NewServer creates a new RefCount HTTP server.
+func NewServer(refs RefCount) *Server {
+	return &Server{refs: refs}
+}
+
+// Handler returns the http.Handler for the reference counting service endpoints.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /id", s.handleGetID)
+	mux.HandleFunc("GET /collectable", s.handleCollectable)
+	mux.HandleFunc("PUT /pin/{address}", s.handlePin)
+	mux.HandleFunc("PUT /unpin/{address}", s.handleUnpin)
+	mux.HandleFunc("PUT /references/{address}", s.handleSetReferences)
+	mux.HandleFunc("PUT /root/{slot}", s.handlePublishRoot)
+	mux.HandleFunc("GET /{address}", s.handleGet)
+	mux.HandleFunc("DELETE /{address}", s.handleForget)
+
+	return mux
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Handler().ServeHTTP(w, r)
+}
+
+func (s *Server) handleGetID(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(s.refs.ID()))
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	count, err := s.refs.Get(r.Context(), r.PathValue("address"))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeCount(w, count)
+}
+
+func (s *Server) handlePin(w http.ResponseWriter, r *http.Request) {
+	count, err := s.refs.Pin(r.Context(), r.PathValue("address"))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeCount(w, count)
+}
+
+func (s *Server) handleUnpin(w http.ResponseWriter, r *http.Request) {
+	count, err := s.refs.Unpin(r.Context(), r.PathValue("address"))
+	if err != nil {
+		if err == ErrNotPinned {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeCount(w, count)
+}
+
+func (s *Server) handleSetReferences(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var references []string
+	if err := json.NewDecoder(r.Body).Decode(&references); err != nil {
+		http.Error(w, "Bad Request: valid JSON expected", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.refs.SetReferences(r.Context(), r.PathValue("address"), references); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handlePublishRoot(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var reqBody RootUpdate
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		http.Error(w, "Bad Request: valid JSON expected", http.StatusBadRequest)
+		return
+	}
+
+	err := s.refs.PublishRoot(r.Context(), r.PathValue("slot"), reqBody.Address, reqBody.PreviousAddress)
+	if err != nil {
+		if err == ErrConflict {
+			http.Error(w, "Conflict", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleCollectable(w http.ResponseWriter, r *http.Request) {
+	addresses := []string{}
+	for chunk := range s.refs.Collectable(r.Context(), 0) {
+		addresses = append(addresses, chunk...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addresses)
+}
+
+func (s *Server) handleForget(w http.ResponseWriter, r *http.Request) {
+	err := s.refs.Forget(r.Context(), r.PathValue("address"))
+	if err != nil {
+		if err == ErrReferenced {
+			http.Error(w, "Precondition Failed: block is still referenced", http.StatusPreconditionFailed)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeCount(w http.ResponseWriter, count int64) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(strconv.FormatInt(count, 10)))
+}
@@ -0,0 +1,87 @@
+package refcount
+
+import (
+	"context"
+	"log"
+
+	"invariant/internal/content"
+	"invariant/internal/filetree"
+	"invariant/internal/storage"
+)
+
+// TreePublisher publishes the roots of slots to a RefCount, first recording
+// the references of the blocks of the file tree each root is the directory
+// of, so the whole tree is kept alive rather than only its root block. It
+// implements the slots.RootPublisher interface.
+type TreePublisher struct {
+	refs  RefCount
+	store storage.Storage
+}
+
+// NewTreePublisher creates a TreePublisher reading the trees from store.
+func NewTreePublisher(refs RefCount, store storage.Storage) *TreePublisher {
+	return &TreePublisher{refs: refs, store: store}
+}
+
+// PublishRoot records the references of the tree at address and publishes it
+// as the root of slot. A root that cannot be read as a directory, such as a
+// slot holding a single block, is published without references.
+func (p *TreePublisher) PublishRoot(ctx context.Context, slot string, address string, previousAddress string) error {
+	if address != "" {
+		if err := p.recordTree(ctx, content.ContentLink{Address: address}); err != nil {
+			log.Printf("Publishing root %s of slot %s without the references of its tree: %v", address, slot, err)
+		}
+	}
+	return p.refs.PublishRoot(ctx, slot, address, previousAddress)
+}
+
+// recordTree records the references of the directory at link: the other
+// blocks of its content, the blocks of its files and the directories it
+// holds, whose references are recorded in turn. Directories already
+// referenced had their references recorded when they became live, so they
+// are not read again.
+func (p *TreePublisher) recordTree(ctx context.Context, link content.ContentLink) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if count, err := p.refs.Get(ctx, link.Address); err != nil {
+		return err
+	} else if count > 0 {
+		return nil
+	}
+
+	var references []string
+	add := func(address string) error {
+		if address != link.Address {
+			references = append(references, address)
+		}
+		return nil
+	}
+	if err := content.Blocks(link, p.store, nil, add); err != nil {
+		return err
+	}
+	dir, err := filetree.ReadDirectory(link, p.store, nil)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dir {
+		switch e := entry.(type) {
+		case *filetree.FileEntry:
+			if e.Content.Slot {
+				continue
+			}
+			if err := content.Blocks(e.Content, p.store, nil, add); err != nil {
+				return err
+			}
+		case *filetree.DirectoryEntry:
+			if e.Content.Slot || e.Content.Address == "" {
+				continue
+			}
+			if err := p.recordTree(ctx, e.Content); err != nil {
+				return err
+			}
+			references = append(references, e.Content.Address)
+		}
+	}
+	return p.refs.SetReferences(ctx, link.Address, references)
+}
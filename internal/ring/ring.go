@@ -0,0 +1,178 @@
+// Package ring places keys, such as block addresses, on a set of nodes. It
+// provides the XOR distance between 32-byte IDs used by the Kademlia style
+// services, and weighted rendezvous hashing over arbitrary node IDs, which
+// moves only the keys of a node that joins or leaves.
+package ring
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"math/bits"
+	"slices"
+)
+
+// IDLength is the length in bytes of the IDs compared by XOR distance.
+const IDLength = 32
+
+// Distance calculates the Kademlia distance between two IDs represented as
+// byte slices: the XOR of the two IDs. A shorter distance means the IDs are
+// closer. It returns nil if the IDs have different lengths.
+func Distance(a, b []byte) []byte {
+	if len(a) != len(b) {
+		return nil
+	}
+	dist := make([]byte, len(a))
+	for i := range a {
+		dist[i] = a[i] ^ b[i]
+	}
+	return dist
+}
+
+// Compare compares two distances as big-endian numbers. It returns -1 if
+// d1 < d2, 0 if d1 == d2, and 1 if d1 > d2. Distances of different lengths
+// compare equal.
+func Compare(d1, d2 []byte) int {
+	if len(d1) != len(d2) {
+		return 0
+	}
+	for i := range d1 {
+		if d1[i] < d2[i] {
+			return -1
+		} else if d1[i] > d2[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// PrefixLen returns the length in bits of the common prefix of two IDs
+// whose distance is distance: the number of its leading zero bits.
+func PrefixLen(distance []byte) int {
+	for i, b := range distance {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return len(distance) * 8
+}
+
+// Closest orders the hex encoded IDs by their XOR distance from key, closest
+// first, dropping the IDs that are not valid. It reports false if key is not
+// a valid ID.
+func Closest(key string, ids []string) ([]string, bool) {
+	keyBytes, err := hex.DecodeString(key)
+	if err != nil || len(keyBytes) != IDLength {
+		return nil, false
+	}
+	type nodeDist struct {
+		id   string
+		dist []byte
+	}
+	nodes := make([]nodeDist, 0, len(ids))
+	for _, id := range ids {
+		idBytes, err := hex.DecodeString(id)
+		if err != nil || len(idBytes) != IDLength {
+			continue
+		}
+		nodes = append(nodes, nodeDist{id: id, dist: Distance(keyBytes, idBytes)})
+	}
+	slices.SortStableFunc(nodes, func(a, b nodeDist) int {
+		return Compare(a.dist, b.dist)
+	})
+	closest := make([]string, len(nodes))
+	for i, node := range nodes {
+		closest[i] = node.id
+	}
+	return closest, true
+}
+
+// Node is a member of a Ring.
+type Node struct {
+	ID string `json:"id"`
+
+	// Weight is the share of the keys placed on the node relative to the
+	// other nodes; 0 or less is 1.
+	Weight float64 `json:"weight,omitempty"`
+}
+
+// Ring places keys on nodes by weighted rendezvous hashing: each key ranks
+// the nodes by a hash of the key and the node ID, scaled by the weight of
+// the node. A Ring is immutable and safe for concurrent use.
+type Ring struct {
+	nodes []Node
+}
+
+// New returns a ring of nodes. Nodes with the same ID are merged, the last
+// one winning.
+func New(nodes ...Node) *Ring {
+	byID := make(map[string]int, len(nodes))
+	r := &Ring{}
+	for _, node := range nodes {
+		if node.Weight <= 0 {
+			node.Weight = 1
+		}
+		if i, ok := byID[node.ID]; ok {
+			r.nodes[i] = node
+			continue
+		}
+		byID[node.ID] = len(r.nodes)
+		r.nodes = append(r.nodes, node)
+	}
+	return r
+}
+
+// Nodes returns the nodes of the ring.
+func (r *Ring) Nodes() []Node {
+	return slices.Clone(r.nodes)
+}
+
+// Len returns the number of nodes of the ring.
+func (r *Ring) Len() int {
+	return len(r.nodes)
+}
+
+// Rank returns the IDs of all the nodes in the order key prefers them.
+func (r *Ring) Rank(key string) []string {
+	return r.Pick(key, len(r.nodes))
+}
+
+// Pick returns the IDs of the n nodes key prefers, most preferred first, or
+// of all the nodes if there are fewer than n.
+func (r *Ring) Pick(key string, n int) []string {
+	type nodeScore struct {
+		id    string
+		score float64
+	}
+	scores := make([]nodeScore, len(r.nodes))
+	for i, node := range r.nodes {
+		scores[i] = nodeScore{id: node.ID, score: score(key, node)}
+	}
+	slices.SortFunc(scores, func(a, b nodeScore) int {
+		if c := cmp.Compare(b.score, a.score); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.id, b.id)
+	})
+	n = min(max(n, 0), len(scores))
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = scores[i].id
+	}
+	return ids
+}
+
+// score returns the preference of key for node. The hash of the key and the
+// node is uniform in (0, 1), so -weight/ln(hash) picks each node with a
+// probability proportional to its weight.
+func score(key string, node Node) float64 {
+	h := sha256.New()
+	h.Write([]byte(node.ID))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	sum := h.Sum(nil)
+	u := (float64(binary.BigEndian.Uint64(sum)>>11) + 0.5) / (1 << 53)
+	return -node.Weight / math.Log(u)
+}
@@ -0,0 +1,146 @@
+package ring
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"testing"
+	"testing/quick"
+)
+
+func TestDistance(t *testing.T) {
+	a, _ := hex.DecodeString("0000000000000000000000000000000000000000000000000000000000000001")
+	b, _ := hex.DecodeString("0000000000000000000000000000000000000000000000000000000000000002")
+	expected, _ := hex.DecodeString("0000000000000000000000000000000000000000000000000000000000000003")
+
+	dist := Distance(a, b)
+	if !bytes.Equal(dist, expected) {
+		t.Errorf("expected %x, got %x", expected, dist)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	d1, _ := hex.DecodeString("0000000000000000000000000000000000000000000000000000000000000001")
+	d2, _ := hex.DecodeString("0000000000000000000000000000000000000000000000000000000000000002")
+
+	if Compare(d1, d2) != -1 {
+		t.Errorf("expected d1 < d2")
+	}
+	if Compare(d2, d1) != 1 {
+		t.Errorf("expected d2 > d1")
+	}
+	if Compare(d1, d1) != 0 {
+		t.Errorf("expected d1 == d1")
+	}
+}
+
+func TestDistanceProperties(t *testing.T) {
+	// XOR distance is a metric: zero only to itself, symmetric, and unique
+	// for a given ID and distance
+	f := func(a, b [IDLength]byte) bool {
+		ab := Distance(a[:], b[:])
+		if !bytes.Equal(ab, Distance(b[:], a[:])) {
+			return false
+		}
+		if (PrefixLen(ab) == IDLength*8) != (a == b) {
+			return false
+		}
+		return bytes.Equal(Distance(a[:], ab), b[:])
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClosest(t *testing.T) {
+	key := "0000000000000000000000000000000000000000000000000000000000000001"
+	ids := []string{
+		"ff00000000000000000000000000000000000000000000000000000000000000",
+		"0000000000000000000000000000000000000000000000000000000000000003",
+		"not-an-id",
+		"0000000000000000000000000000000000000000000000000000000000000000",
+	}
+	closest, ok := Closest(key, ids)
+	if !ok {
+		t.Fatalf("expected %s to be a valid key", key)
+	}
+	want := []string{ids[3], ids[1], ids[0]}
+	if !slices.Equal(closest, want) {
+		t.Errorf("Closest = %v, want %v", closest, want)
+	}
+	if _, ok := Closest("abc", ids); ok {
+		t.Errorf("expected an invalid key to be rejected")
+	}
+}
+
+func testNodes(n int) []Node {
+	nodes := make([]Node, n)
+	for i := range nodes {
+		nodes[i] = Node{ID: fmt.Sprintf("node-%d", i)}
+	}
+	return nodes
+}
+
+func TestPickProperties(t *testing.T) {
+	r := New(testNodes(8)...)
+	f := func(key string, n uint8) bool {
+		picked := r.Pick(key, int(n%10))
+		if len(picked) != min(int(n%10), r.Len()) {
+			return false
+		}
+		// Picks are distinct, stable and a prefix of the full ranking
+		seen := make(map[string]bool)
+		for _, id := range picked {
+			if seen[id] {
+				return false
+			}
+			seen[id] = true
+		}
+		return slices.Equal(picked, r.Pick(key, int(n%10))) &&
+			slices.Equal(picked, r.Rank(key)[:len(picked)])
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRemoveMovesOnlyItsKeys(t *testing.T) {
+	nodes := testNodes(10)
+	before := New(nodes...)
+	after := New(nodes[1:]...)
+	f := func(key string) bool {
+		owner := before.Pick(key, 1)[0]
+		if owner == nodes[0].ID {
+			// The key moves to its second choice
+			return after.Pick(key, 1)[0] == before.Pick(key, 2)[1]
+		}
+		return after.Pick(key, 1)[0] == owner
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWeights(t *testing.T) {
+	r := New(Node{ID: "light", Weight: 1}, Node{ID: "heavy", Weight: 3})
+	counts := make(map[string]int)
+	const keys = 20000
+	for i := range keys {
+		counts[r.Pick(strconv.Itoa(i), 1)[0]]++
+	}
+	share := float64(counts["heavy"]) / keys
+	if math.Abs(share-0.75) > 0.02 {
+		t.Errorf("expected the heavy node to own 75%% of the keys, got %.1f%%", share*100)
+	}
+}
+
+func TestNewMergesNodes(t *testing.T) {
+	r := New(Node{ID: "a"}, Node{ID: "b", Weight: 2}, Node{ID: "a", Weight: 5})
+	want := []Node{{ID: "a", Weight: 5}, {ID: "b", Weight: 2}}
+	if !slices.Equal(r.Nodes(), want) {
+		t.Errorf("Nodes = %v, want %v", r.Nodes(), want)
+	}
+}
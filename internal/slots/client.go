@@ -9,14 +9,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"invariant/internal/httputil"
+	"invariant/internal/identity"
 	"io"
 	"net/http"
+	"net/url"
+	"sync/atomic"
 )
 
 // Client implements the Slots interface by forwarding requests to a remote HTTP server.
 type Client struct {
-	baseURL    string
-	httpClient *http.Client
+	baseURL        string
+	httpClient     *http.Client
+	updateAttempts int
+
+	conflicts atomic.Uint64 // updates rejected with ErrConflict
+	retries   atomic.Uint64 // Modify updates retried after a conflict
+	exhausted atomic.Uint64 // Modify calls that ran out of attempts
 }
 
 // NewClient creates a new HTTP slots client.
@@ -26,8 +34,9 @@ func NewClient(baseURL string, httpClient *http.Client) *Client {
 	}
 	httpClient = httputil.NewDiagnosticClient(httpClient)
 	return &Client{
-		baseURL:    baseURL,
-		httpClient: httpClient,
+		baseURL:        baseURL,
+		httpClient:     httpClient,
+		updateAttempts: DefaultUpdateAttempts,
 	}
 }
 
@@ -56,6 +65,13 @@ func (c *Client) ID() string {
 	return string(body)
 }
 
+// VerifiedID challenges the remote slots service to prove it holds the
+// private key of its ID, returning the ID once the signed response is
+// verified.
+func (c *Client) VerifiedID() (string, error) {
+	return identity.ChallengeID(context.Background(), c.httpClient, fmt.Sprintf("%s/id", c.baseURL))
+}
+
 // Get fetches the address for the given slot ID from the remote slots service.
 func (c *Client) Get(ctx context.Context, id string) (string, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s", c.baseURL, id), nil)
@@ -120,8 +136,12 @@ func (c *Client) Update(ctx context.Context, id string, address string, previous
 		return ErrUnauthorized
 	}
 	if resp.StatusCode == http.StatusConflict {
+		c.conflicts.Add(1)
 		return ErrConflict
 	}
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		return ErrInvalidRoot
+	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
@@ -159,6 +179,9 @@ func (c *Client) Create(ctx context.Context, id string, address string, policy s
 	if resp.StatusCode == http.StatusConflict {
 		return ErrSlotExists
 	}
+	if resp.StatusCode == http.StatusBadRequest {
+		return ErrInvalidID
+	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
@@ -166,6 +189,39 @@ func (c *Client) Create(ctx context.Context, id string, address string, policy s
 	return nil
 }
 
+// Retained returns the addresses slot held until recently, or those of every
+// slot if slot is empty. It returns ErrNotRetained if the server does not
+// retain previous addresses.
+func (c *Client) Retained(ctx context.Context, slot string) ([]RetainedAddress, error) {
+	u := fmt.Sprintf("%s/retained", c.baseURL)
+	if slot != "" {
+		u += "?slot=" + url.QueryEscape(slot)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotImplemented {
+		return nil, ErrNotRetained
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var retained []RetainedAddress
+	if err := json.NewDecoder(resp.Body).Decode(&retained); err != nil {
+		return nil, err
+	}
+	return retained, nil
+}
+
 // List is not supported on the client side at this time.
 func (c *Client) List(ctx context.Context, chunkSize int) <-chan []string {
 	ch := make(chan []string)
@@ -17,12 +17,16 @@ import (
 
 var _ Slots = (*FileSystemSlots)(nil)
 
+// Assert that FileSystemSlots implements the RetentionStore interface
+var _ RetentionStore = (*FileSystemSlots)(nil)
+
 // FileSystemSlots provides a file system-backed implementation of the Slots interface.
 type FileSystemSlots struct {
 	id          string
 	subMu       sync.RWMutex
 	subscribers []chan string
 	store       *journal.Store[string, SlotRecord]
+	baseDir     string
 }
 
 // NewFileSystemSlots creates a new FileSystemSlots instance.
@@ -48,11 +52,51 @@ func NewFileSystemSlots(baseDir string, snapshotInterval time.Duration) (*FileSy
 	}
 
 	return &FileSystemSlots{
-		id:    id,
-		store: store,
+		id:      id,
+		store:   store,
+		baseDir: baseDir,
 	}, nil
 }
 
+// retainedFile is the file, in the base directory, holding the retained
+// addresses of the slots.
+const retainedFile = "retained.json"
+
+// LoadRetained returns the retained addresses last saved, if any.
+func (s *FileSystemSlots) LoadRetained() ([]RetainedAddress, error) {
+	data, err := os.ReadFile(filepath.Join(s.baseDir, retainedFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var retained []RetainedAddress
+	if err := json.Unmarshal(data, &retained); err != nil {
+		return nil, err
+	}
+	return retained, nil
+}
+
+// SaveRetained replaces the retained addresses saved, writing them to a
+// temporary file renamed over the last so a crash leaves one or the other.
+func (s *FileSystemSlots) SaveRetained(retained []RetainedAddress) error {
+	data, err := json.Marshal(retained)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.baseDir, retainedFile)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
 // ID returns the service ID.
 func (s *FileSystemSlots) ID() string {
 	return s.id
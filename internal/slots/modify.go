@@ -0,0 +1,96 @@
+package slots
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// DefaultUpdateAttempts is the number of times Modify attempts an update
+// before giving up.
+const DefaultUpdateAttempts = 5
+
+// ConflictMetrics counts the conflicting updates seen by a client.
+type ConflictMetrics struct {
+	// Conflicts is the number of updates rejected with ErrConflict.
+	Conflicts uint64 `json:"conflicts"`
+	// Retries is the number of updates Modify retried after a conflict.
+	Retries uint64 `json:"retries"`
+	// Exhausted is the number of Modify calls that failed after conflicting
+	// on every attempt.
+	Exhausted uint64 `json:"exhausted"`
+}
+
+// WithUpdateAttempts sets the number of times Modify attempts an update.
+// Values less than one are treated as one.
+func (c *Client) WithUpdateAttempts(attempts int) *Client {
+	c.updateAttempts = max(attempts, 1)
+	return c
+}
+
+// Modify updates the slot id to the address returned by modify for its
+// current address. If another update wins the race, the slot is read again
+// and modify is called with the new address, up to the configured number of
+// attempts. When modify returns the current address the slot is left
+// unchanged. Modify returns the address the slot was updated to.
+func (c *Client) Modify(ctx context.Context, id string, auth []byte, modify func(current string) (string, error)) (string, error) {
+	for attempt := 1; ; attempt++ {
+		current, err := c.Get(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		next, err := modify(current)
+		if err != nil {
+			return "", err
+		}
+		if next == current {
+			return current, nil
+		}
+
+		err = c.Update(ctx, id, next, current, auth)
+		if err == nil {
+			return next, nil
+		}
+		if err != ErrConflict {
+			return "", err
+		}
+		if attempt >= c.updateAttempts {
+			c.exhausted.Add(1)
+			return "", fmt.Errorf("%w after %d attempts", ErrConflict, attempt)
+		}
+		c.retries.Add(1)
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// Metrics returns the conflicts seen by the client since it was created.
+func (c *Client) Metrics() ConflictMetrics {
+	return ConflictMetrics{
+		Conflicts: c.conflicts.Load(),
+		Retries:   c.retries.Load(),
+		Exhausted: c.exhausted.Load(),
+	}
+}
+
+// WriteMetrics writes the conflict counters of the client to w in the
+// Prometheus text exposition format.
+func (c *Client) WriteMetrics(w io.Writer) error {
+	m := c.Metrics()
+	counters := []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"slots_client_conflicts_total", "Slot updates rejected because the previous address did not match.", m.Conflicts},
+		{"slots_client_update_retries_total", "Slot updates retried after a conflict.", m.Retries},
+		{"slots_client_update_exhausted_total", "Slot modifications abandoned after conflicting on every attempt.", m.Exhausted},
+	}
+	for _, counter := range counters {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", counter.name, counter.help, counter.name, counter.name, counter.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
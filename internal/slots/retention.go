@@ -0,0 +1,106 @@
+package slots
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotRetained is returned by Client.Retained when the server does not
+// retain the previous addresses of slots.
+var ErrNotRetained = errors.New("previous addresses are not retained")
+
+// DefaultRetention is how long the slots server retains the previous
+// addresses of a slot by default.
+const DefaultRetention = 10 * time.Minute
+
+// RetainedAddress is an address a slot held until it was updated. Its blocks
+// may still be read by readers that resolved the slot before the update, so
+// a garbage collector should treat it as a root until Until.
+type RetainedAddress struct {
+	Slot    string    `json:"slot"`
+	Address string    `json:"address"`
+	Until   time.Time `json:"until"`
+}
+
+// RetentionStore is implemented by Slots services that persist the
+// addresses retained by a Retention, so that the previous roots of slots
+// updated just before a restart are still reported after it.
+type RetentionStore interface {
+	// LoadRetained returns the retained addresses last saved.
+	LoadRetained() ([]RetainedAddress, error)
+	// SaveRetained replaces the retained addresses saved.
+	SaveRetained(retained []RetainedAddress) error
+}
+
+// Retention records the previous addresses of slots for a window after they
+// are replaced.
+type Retention struct {
+	mu      sync.Mutex
+	window  time.Duration
+	now     func() time.Time
+	entries []RetainedAddress // in the order they expire
+	store   RetentionStore
+}
+
+// NewRetention creates a Retention retaining addresses for window.
+func NewRetention(window time.Duration) *Retention {
+	return &Retention{window: window, now: time.Now}
+}
+
+// NewStoredRetention creates a Retention retaining addresses for window that
+// saves them to store as they are recorded, starting with those store holds.
+func NewStoredRetention(window time.Duration, store RetentionStore) (*Retention, error) {
+	entries, err := store.LoadRetained()
+	if err != nil {
+		return nil, err
+	}
+	r := &Retention{window: window, now: time.Now, entries: entries, store: store}
+	r.pruneLocked()
+	return r, nil
+}
+
+// Record retains address, which slot held until now, returning an error if
+// it could not be saved.
+func (r *Retention) Record(slot, address string) error {
+	if address == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pruneLocked()
+	r.entries = append(r.entries, RetainedAddress{
+		Slot:    slot,
+		Address: address,
+		Until:   r.now().Add(r.window),
+	})
+	if r.store == nil {
+		return nil
+	}
+	return r.store.SaveRetained(r.entries)
+}
+
+// Retained returns the retained addresses of slot, or of every slot if slot
+// is empty, oldest first.
+func (r *Retention) Retained(slot string) []RetainedAddress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pruneLocked()
+	result := []RetainedAddress{}
+	for _, e := range r.entries {
+		if slot == "" || e.Slot == slot {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// pruneLocked drops the entries whose window has passed.
+func (r *Retention) pruneLocked() {
+	now := r.now()
+	expired := 0
+	for expired < len(r.entries) && !now.Before(r.entries[expired].Until) {
+		expired++
+	}
+	r.entries = r.entries[expired:]
+}
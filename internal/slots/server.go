@@ -5,21 +5,98 @@ import (
 	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"time"
+
+	"invariant/internal/httputil"
+	"invariant/internal/identity"
 )
 
+// MaxRequestSize is the largest request body, in bytes, the server accepts.
+// Larger requests are rejected with 413 Request Entity Too Large.
+const MaxRequestSize = 64 << 10
+
 // Server wraps a Slots implementation and provides HTTP endpoints.
 type Server struct {
-	id    string
-	slots Slots
+	id        string
+	key       *identity.KeyPair
+	slots     Slots
+	idFormat  IDFormat
+	retention *Retention
+	validator RootValidator
+	publisher RootPublisher
 }
 
-// NewServer creates a new Slots HTTP server.
+// NewServer creates a new Slots HTTP server. It accepts any slot ID unless
+// configured with WithIDFormat.
 func NewServer(slots Slots) *Server {
 	return &Server{
-		id:    slots.ID(),
-		slots: slots,
+		id:       slots.ID(),
+		slots:    slots,
+		idFormat: IDFormatAny,
+	}
+}
+
+// WithKeyPair identifies the server by the ID of key, which it proves by
+// answering challenges to GET /id.
+func (s *Server) WithKeyPair(key *identity.KeyPair) *Server {
+	s.id = key.ID()
+	s.key = key
+	return s
+}
+
+// WithIDFormat sets the format required of the IDs of new slots.
+func (s *Server) WithIDFormat(format IDFormat) *Server {
+	s.idFormat = format
+	return s
+}
+
+// WithRetention retains the previous address of each updated slot for
+// window, reporting them from GET /retained. A window of zero retains none.
+// The addresses are saved with the slots if they are a RetentionStore.
+func (s *Server) WithRetention(window time.Duration) *Server {
+	s.retention = nil
+	if window <= 0 {
+		return s
+	}
+	if store, ok := s.slots.(RetentionStore); ok {
+		retention, err := NewStoredRetention(window, store)
+		if err == nil {
+			s.retention = retention
+			return s
+		}
+		log.Printf("Failed to load the retained addresses of slots: %v", err)
+	}
+	s.retention = NewRetention(window)
+	return s
+}
+
+// WithRootValidator checks the address of each update with validator,
+// rejecting those it finds invalid with 422 Unprocessable Entity so that a
+// garbage root cannot replace a root readers depend on.
+func (s *Server) WithRootValidator(validator RootValidator) *Server {
+	s.validator = validator
+	return s
+}
+
+// WithRootPublisher tells publisher of the address of each slot created or
+// updated, after the change is made. A failure to publish is logged, as the
+// slot has already changed.
+func (s *Server) WithRootPublisher(publisher RootPublisher) *Server {
+	s.publisher = publisher
+	return s
+}
+
+// publishRoot tells the root publisher, if any, that slot id holds address
+// in place of previousAddress.
+func (s *Server) publishRoot(ctx context.Context, id, address, previousAddress string) {
+	if s.publisher == nil || address == previousAddress {
+		return
+	}
+	if err := s.publisher.PublishRoot(context.WithoutCancel(ctx), id, address, previousAddress); err != nil {
+		log.Printf("Failed to publish the root %s of slot %s: %v", address, id, err)
 	}
 }
 
@@ -88,6 +165,7 @@ func (s *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("GET /id", s.handleGetID)
+	mux.HandleFunc("GET /retained", s.handleGetRetained)
 	mux.HandleFunc("GET /{id}", s.handleGetSlot)
 	mux.HandleFunc("PUT /{id}", s.handleUpdateSlot)
 	mux.HandleFunc("POST /{id}", s.handleCreateSlot)
@@ -101,8 +179,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleGetID(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(s.slots.ID()))
+	identity.ServeID(w, r, s.id, s.key)
 }
 
 func (s *Server) handleGetSlot(w http.ResponseWriter, r *http.Request) {
@@ -134,11 +211,9 @@ func (s *Server) handleUpdateSlot(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var reqBody SlotUpdate
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Bad Request: valid JSON expected", http.StatusBadRequest)
+	if !httputil.DecodeJSON(w, r, MaxRequestSize, &reqBody) {
 		return
 	}
-	defer r.Body.Close()
 
 	var auth []byte
 	if authHex := r.Header.Get("Authorization"); authHex != "" {
@@ -147,6 +222,17 @@ func (s *Server) handleUpdateSlot(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if s.validator != nil {
+		if err := s.validator.ValidateRoot(r.Context(), id, reqBody.Address); err != nil {
+			if errors.Is(err, ErrInvalidRoot) {
+				http.Error(w, "Unprocessable Entity: "+err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			http.Error(w, "Bad Gateway: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
 	if err := s.slots.Update(r.Context(), id, reqBody.Address, reqBody.PreviousAddress, auth); err != nil {
 		if err == ErrSlotNotFound {
 			http.Error(w, "Not Found", http.StatusNotFound)
@@ -164,9 +250,25 @@ func (s *Server) handleUpdateSlot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.retention != nil && reqBody.PreviousAddress != reqBody.Address {
+		if err := s.retention.Record(id, reqBody.PreviousAddress); err != nil {
+			log.Printf("Failed to save the retained address of slot %s: %v", id, err)
+		}
+	}
+	s.publishRoot(r.Context(), id, reqBody.Address, reqBody.PreviousAddress)
 	w.WriteHeader(http.StatusOK)
 }
 
+func (s *Server) handleGetRetained(w http.ResponseWriter, r *http.Request) {
+	if s.retention == nil {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.retention.Retained(r.URL.Query().Get("slot")))
+}
+
 func (s *Server) handleCreateSlot(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	if id == "" {
@@ -175,13 +277,15 @@ func (s *Server) handleCreateSlot(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var reqBody SlotRegistration
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Bad Request: valid JSON expected", http.StatusBadRequest)
+	if !httputil.DecodeJSON(w, r, MaxRequestSize, &reqBody) {
 		return
 	}
-	defer r.Body.Close()
 
 	policy := r.URL.Query().Get("protected")
+	if err := s.idFormat.ValidateID(id, policy); err != nil {
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	if err := s.slots.Create(r.Context(), id, reqBody.Address, policy); err != nil {
 		if err == ErrSlotExists {
@@ -192,5 +296,6 @@ func (s *Server) handleCreateSlot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.publishRoot(r.Context(), id, reqBody.Address, "")
 	w.WriteHeader(http.StatusOK)
 }
@@ -3,7 +3,10 @@ package slots
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/hex"
 	"errors"
+	"fmt"
 )
 
 // ErrSlotNotFound is returned when a slot doesn't exist.
@@ -18,6 +21,90 @@ var ErrSlotExists = errors.New("slot already exists")
 // ErrUnauthorized is returned when an authorization signature is missing or invalid.
 var ErrUnauthorized = errors.New("unauthorized")
 
+// ErrInvalidID is returned when creating a slot with an ID that does not
+// match the ID format of the service or the policy of the slot.
+var ErrInvalidID = errors.New("invalid slot id")
+
+// IDFormat is a policy for the IDs a slots service accepts for new slots.
+type IDFormat string
+
+const (
+	// IDFormatAny accepts any non-empty ID.
+	IDFormatAny IDFormat = "any"
+	// IDFormatHex accepts only 32-byte lower case hex encoded IDs.
+	IDFormatHex IDFormat = "hex"
+)
+
+// ParseIDFormat returns the IDFormat named by s.
+func ParseIDFormat(s string) (IDFormat, error) {
+	switch format := IDFormat(s); format {
+	case IDFormatAny, IDFormatHex:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown slot id format %q", s)
+}
+
+// ValidateID checks that id is acceptable for a new slot with policy. The ID
+// of an "ecc" slot is the hex encoded public key that verifies its updates
+// so it must be one regardless of the format.
+func (f IDFormat) ValidateID(id string, policy string) error {
+	if id == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidID)
+	}
+	if policy == "ecc" || f == IDFormatHex {
+		decoded, err := hex.DecodeString(id)
+		if err != nil || len(decoded) != ed25519.PublicKeySize || hex.EncodeToString(decoded) != id {
+			return fmt.Errorf("%w: %q is not a 32-byte lower case hex value", ErrInvalidID, id)
+		}
+	}
+	return nil
+}
+
+// ErrInvalidRoot is returned when a slot is updated to an address rejected
+// by the root validation of the service.
+var ErrInvalidRoot = errors.New("invalid root")
+
+// RootValidation is a policy for the addresses a slots service accepts in
+// updates.
+type RootValidation string
+
+const (
+	// RootValidationNone accepts any address.
+	RootValidationNone RootValidation = "none"
+	// RootValidationExists accepts only addresses of blocks in storage, or
+	// an empty address clearing the slot.
+	RootValidationExists RootValidation = "exists"
+	// RootValidationDirectory accepts only addresses of blocks in storage
+	// holding an unencrypted file tree directory, or an empty address
+	// clearing the slot.
+	RootValidationDirectory RootValidation = "directory"
+)
+
+// ParseRootValidation returns the RootValidation named by s.
+func ParseRootValidation(s string) (RootValidation, error) {
+	switch v := RootValidation(s); v {
+	case RootValidationNone, RootValidationExists, RootValidationDirectory:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown root validation %q", s)
+}
+
+// RootValidator checks the address a slot is about to be updated to.
+type RootValidator interface {
+	// ValidateRoot returns an error wrapping ErrInvalidRoot if slot id must
+	// not hold address, or another error if address could not be checked.
+	ValidateRoot(ctx context.Context, id, address string) error
+}
+
+// RootPublisher is told of each address a slot is created with or updated
+// to, such as a reference counting service keeping the blocks of published
+// roots from being collected.
+type RootPublisher interface {
+	// PublishRoot records that slot now holds address in place of
+	// previousAddress, which is empty for a new slot.
+	PublishRoot(ctx context.Context, slot string, address string, previousAddress string) error
+}
+
 // SlotRecord holds the storage values for a single slot.
 type SlotRecord struct {
 	Address string `json:"address"`
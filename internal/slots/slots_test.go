@@ -3,12 +3,21 @@ package slots_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"invariant/internal/httputil"
+	"invariant/internal/identity"
 	"invariant/internal/slots"
 )
 
@@ -206,3 +215,291 @@ func TestSlots_FileSystemSnapshots(t *testing.T) {
 		t.Fatalf("expected %q, got %q", "val-1", val)
 	}
 }
+
+func TestClient_Modify(t *testing.T) {
+	service := slots.NewMemorySlots("test-modify-slots-id")
+	ts := httptest.NewServer(slots.NewServer(service))
+	defer ts.Close()
+	ctx := context.Background()
+
+	slotID := "counter"
+	if err := service.Create(ctx, slotID, "0", ""); err != nil {
+		t.Fatalf("failed to create slot: %v", err)
+	}
+
+	// Concurrent increments all land despite conflicting
+	const workers, increments = 4, 10
+	client := slots.NewClient(ts.URL, ts.Client()).WithUpdateAttempts(workers * increments)
+	increment := func(current string) (string, error) {
+		n, err := strconv.Atoi(current)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(n + 1), nil
+	}
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for range increments {
+				if _, err := client.Modify(ctx, slotID, nil, increment); err != nil {
+					t.Errorf("failed to modify slot: %v", err)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	addr, err := client.Get(ctx, slotID)
+	if err != nil {
+		t.Fatalf("failed to get slot: %v", err)
+	}
+	if want := strconv.Itoa(workers * increments); addr != want {
+		t.Fatalf("expected address %q, got %q", want, addr)
+	}
+	if m := client.Metrics(); m.Retries != m.Conflicts || m.Exhausted != 0 {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+
+	// A slot that changes on every attempt exhausts the attempts
+	client = slots.NewClient(ts.URL, ts.Client()).WithUpdateAttempts(3)
+	_, err = client.Modify(ctx, slotID, nil, func(current string) (string, error) {
+		if err := service.Update(ctx, slotID, current+"x", current, nil); err != nil {
+			return "", err
+		}
+		return current + "y", nil
+	})
+	if !errors.Is(err, slots.ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if m := client.Metrics(); m != (slots.ConflictMetrics{Conflicts: 3, Retries: 2, Exhausted: 1}) {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+
+	var sb strings.Builder
+	if err := client.WriteMetrics(&sb); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	for _, line := range []string{
+		"# TYPE slots_client_conflicts_total counter",
+		"slots_client_conflicts_total 3",
+		"slots_client_update_retries_total 2",
+		"slots_client_update_exhausted_total 1",
+	} {
+		if !strings.Contains(sb.String(), line) {
+			t.Errorf("metrics missing %q:\n%s", line, sb.String())
+		}
+	}
+
+	// Returning the current address leaves the slot unchanged
+	before, _ := client.Get(ctx, slotID)
+	addr, err = client.Modify(ctx, slotID, nil, func(current string) (string, error) { return current, nil })
+	if err != nil || addr != before {
+		t.Fatalf("expected unchanged %q, got %q, %v", before, addr, err)
+	}
+}
+
+func TestServer_IDFormat(t *testing.T) {
+	service := slots.NewMemorySlots("test-id-format-slots-id")
+	ts := httptest.NewServer(slots.NewServer(service).WithIDFormat(slots.IDFormatHex))
+	defer ts.Close()
+	client := slots.NewClient(ts.URL, ts.Client())
+	ctx := context.Background()
+
+	valid := strings.Repeat("ab", 32)
+	for _, tc := range []struct {
+		id     string
+		policy string
+		err    error
+	}{
+		{valid, "", nil},
+		{"slot-123", "", slots.ErrInvalidID},
+		{strings.Repeat("ab", 16), "", slots.ErrInvalidID},
+		{strings.Repeat("AB", 32), "", slots.ErrInvalidID},
+		{strings.Repeat("cd", 32), "ecc", nil},
+	} {
+		if err := client.Create(ctx, tc.id, "hash-1", tc.policy); err != tc.err {
+			t.Errorf("Create(%q, %q): expected %v, got %v", tc.id, tc.policy, tc.err, err)
+		}
+	}
+
+	// Protected slots must be keyed by a public key with any format
+	if err := slots.IDFormatAny.ValidateID("slot-123", "ecc"); !errors.Is(err, slots.ErrInvalidID) {
+		t.Errorf("expected ErrInvalidID, got %v", err)
+	}
+	if err := slots.IDFormatAny.ValidateID("slot-123", ""); err != nil {
+		t.Errorf("expected any id to be valid, got %v", err)
+	}
+	if _, err := slots.ParseIDFormat("base64"); err == nil {
+		t.Errorf("expected unknown format to be rejected")
+	}
+}
+
+func TestServer_KeyPair(t *testing.T) {
+	key, err := identity.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(slots.NewServer(slots.NewMemorySlots("slots-id")).WithKeyPair(key))
+	defer ts.Close()
+
+	client := slots.NewClient(ts.URL, nil)
+	if id := client.ID(); id != key.ID() {
+		t.Errorf("Expected the ID of the key pair %s, got %s", key.ID(), id)
+	}
+	if id, err := client.VerifiedID(); err != nil || id != key.ID() {
+		t.Errorf("Expected verified ID %s, got %s (err: %v)", key.ID(), id, err)
+	}
+
+	// Without a key pair the ID cannot be proven
+	keyless := httptest.NewServer(slots.NewServer(slots.NewMemorySlots("slots-id")))
+	defer keyless.Close()
+	if _, err := slots.NewClient(keyless.URL, nil).VerifiedID(); err == nil {
+		t.Error("Expected a server without a key pair to fail the challenge")
+	}
+}
+
+func TestServer_MalformedRequests(t *testing.T) {
+	service := slots.NewMemorySlots("test-malformed-slots-id")
+	ts := httptest.NewServer(slots.NewServer(service))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		name        string
+		method      string
+		body        string
+		contentType string
+		status      int
+	}{
+		{"create", http.MethodPost, `{"address":"hash-1"}`, "application/json", http.StatusOK},
+		{"unknown field", http.MethodPut, `{"address":"hash-2","previous":"hash-1"}`, "application/json", http.StatusBadRequest},
+		{"trailing data", http.MethodPut, `{"address":"hash-2","previousAddress":"hash-1"} {}`, "application/json", http.StatusBadRequest},
+		{"content type", http.MethodPut, `{"address":"hash-2","previousAddress":"hash-1"}`, "text/plain", http.StatusUnsupportedMediaType},
+		{"too large", http.MethodPut, `{"address":"` + strings.Repeat("a", slots.MaxRequestSize) + `"}`, "application/json", http.StatusRequestEntityTooLarge},
+		{"update", http.MethodPut, `{"address":"hash-2","previousAddress":"hash-1"}`, "application/json; charset=utf-8", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(tc.method, ts.URL+"/slot-1", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", tc.name, err)
+		}
+		var body httputil.RequestError
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, resp.StatusCode)
+		}
+		if tc.status != http.StatusOK && body.Status != tc.status {
+			t.Errorf("%s: expected a structured error, got %+v", tc.name, body)
+		}
+	}
+
+	if addr, _ := service.Get(context.Background(), "slot-1"); addr != "hash-2" {
+		t.Errorf("expected the slot to be updated once, got %q", addr)
+	}
+}
+
+func TestServer_Retention(t *testing.T) {
+	service := slots.NewMemorySlots("test-retention-slots-id")
+	ts := httptest.NewServer(slots.NewServer(service).WithRetention(100 * time.Millisecond))
+	defer ts.Close()
+	client := slots.NewClient(ts.URL, ts.Client())
+	ctx := context.Background()
+
+	client.Create(ctx, "slot-a", "hash-1", "")
+	client.Create(ctx, "slot-b", "hash-1", "")
+	if err := client.Update(ctx, "slot-a", "hash-2", "hash-1", nil); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	client.Update(ctx, "slot-a", "hash-3", "hash-2", nil)
+	client.Update(ctx, "slot-b", "hash-4", "hash-1", nil)
+
+	retained, err := client.Retained(ctx, "slot-a")
+	if err != nil {
+		t.Fatalf("Retained failed: %v", err)
+	}
+	if len(retained) != 2 || retained[0].Address != "hash-1" || retained[1].Address != "hash-2" {
+		t.Fatalf("unexpected retained addresses of slot-a: %+v", retained)
+	}
+	if all, _ := client.Retained(ctx, ""); len(all) != 3 {
+		t.Errorf("expected 3 retained addresses, got %+v", all)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if retained, _ := client.Retained(ctx, ""); len(retained) != 0 {
+		t.Errorf("expected the retained addresses to expire, got %+v", retained)
+	}
+
+	// Servers without retention report that they don't retain addresses
+	plain := httptest.NewServer(slots.NewServer(service))
+	defer plain.Close()
+	if _, err := slots.NewClient(plain.URL, plain.Client()).Retained(ctx, ""); !errors.Is(err, slots.ErrNotRetained) {
+		t.Errorf("expected ErrNotRetained, got %v", err)
+	}
+}
+
+func TestServer_RetentionPersisted(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	service, err := slots.NewFileSystemSlots(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileSystemSlots failed: %v", err)
+	}
+	ts := httptest.NewServer(slots.NewServer(service).WithRetention(time.Hour))
+	client := slots.NewClient(ts.URL, ts.Client())
+	client.Create(ctx, "slot-a", "hash-1", "")
+	if err := client.Update(ctx, "slot-a", "hash-2", "hash-1", nil); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	ts.Close()
+	service.Close()
+
+	// The retained addresses are still reported after a restart
+	reopened, err := slots.NewFileSystemSlots(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileSystemSlots failed: %v", err)
+	}
+	defer reopened.Close()
+	ts = httptest.NewServer(slots.NewServer(reopened).WithRetention(time.Hour))
+	defer ts.Close()
+	retained, err := slots.NewClient(ts.URL, ts.Client()).Retained(ctx, "")
+	if err != nil {
+		t.Fatalf("Retained failed: %v", err)
+	}
+	if len(retained) != 1 || retained[0].Address != "hash-1" {
+		t.Errorf("expected the retained address to be persisted, got %+v", retained)
+	}
+}
+
+// recordingPublisher records the roots published to it.
+type recordingPublisher struct {
+	mu        sync.Mutex
+	published []string
+}
+
+func (p *recordingPublisher) PublishRoot(ctx context.Context, slot, address, previousAddress string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published = append(p.published, slot+":"+previousAddress+"->"+address)
+	return nil
+}
+
+func TestServer_RootPublisher(t *testing.T) {
+	publisher := &recordingPublisher{}
+	service := slots.NewMemorySlots("test-publisher-slots-id")
+	ts := httptest.NewServer(slots.NewServer(service).WithRootPublisher(publisher))
+	defer ts.Close()
+	client := slots.NewClient(ts.URL, ts.Client())
+	ctx := context.Background()
+
+	client.Create(ctx, "slot-a", "hash-1", "")
+	client.Update(ctx, "slot-a", "hash-2", "hash-1", nil)
+	client.Update(ctx, "slot-a", "hash-2", "hash-2", nil)
+	if err := client.Update(ctx, "slot-a", "hash-3", "stale", nil); err == nil {
+		t.Fatal("expected a stale update to fail")
+	}
+
+	want := []string{"slot-a:->hash-1", "slot-a:hash-1->hash-2"}
+	if !slices.Equal(publisher.published, want) {
+		t.Errorf("published %v, want %v", publisher.published, want)
+	}
+}
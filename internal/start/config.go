@@ -1,10 +1,15 @@
 package start
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -44,6 +49,41 @@ type ServiceConfig struct {
 	Use         StringArray       `yaml:"use,omitempty"`
 	Args        map[string]string `yaml:"args"`
 	Environment map[string]string `yaml:"environment,omitempty"`
+
+	// Replicas is the number of instances of the service to start. In the
+	// args and environment of each instance, {replica} is replaced by the
+	// instance number, starting at 1, and {replica+N} by the instance number
+	// plus N, such as a base port.
+	Replicas int `yaml:"replicas,omitempty"`
+
+	// Replica is the instance number of a replicated service, 0 if Replicas
+	// is not set.
+	Replica int `yaml:"-"`
+
+	// Run, if set, runs the service in process instead of the executable
+	// named by Command, which then only names the service. It is called
+	// with the args of the service, as they would be passed to the
+	// executable, and writers receiving its output, and should return when
+	// ctx is done. Run is restarted, with back-off, when it returns.
+	Run func(ctx context.Context, args []string, stdout, stderr io.Writer) error `yaml:"-"`
+}
+
+// CommandArgs returns the args of the service as command line flags, in
+// the order of their names.
+func (sc ServiceConfig) CommandArgs() []string {
+	args := make([]string, 0, len(sc.Args))
+	for _, k := range slices.Sorted(maps.Keys(sc.Args)) {
+		args = append(args, fmt.Sprintf("--%s=%s", k, sc.Args[k]))
+	}
+	return args
+}
+
+// Name identifies the service, and its instance if it is replicated, in logs.
+func (sc ServiceConfig) Name() string {
+	if sc.Replica == 0 {
+		return sc.Command
+	}
+	return fmt.Sprintf("%s-%d", sc.Command, sc.Replica)
 }
 
 // LoadConfig reads and parses a YAML configuration file.
@@ -60,8 +100,18 @@ func LoadConfig(path string, keysDirOverride string) (*Config, error) {
 
 	var validServices []ServiceConfig
 	for _, svc := range config.Services {
-		if strings.TrimSpace(svc.Command) != "" {
+		if strings.TrimSpace(svc.Command) == "" {
+			continue
+		}
+		if svc.Replicas < 0 {
+			return nil, fmt.Errorf("service '%s' has a negative number of replicas", svc.Command)
+		}
+		if svc.Replicas == 0 {
 			validServices = append(validServices, svc)
+			continue
+		}
+		for replica := 1; replica <= svc.Replicas; replica++ {
+			validServices = append(validServices, svc.instance(replica))
 		}
 	}
 	config.Services = validServices
@@ -125,6 +175,41 @@ func LoadConfig(path string, keysDirOverride string) (*Config, error) {
 	return &config, nil
 }
 
+// replicaRegex matches the {replica} and {replica+N} templates of the args
+// and environment of a replicated service.
+var replicaRegex = regexp.MustCompile(`\{replica(?:\+(\d+))?\}`)
+
+// instance returns the configuration of one instance of a replicated
+// service, with its templates expanded.
+func (sc ServiceConfig) instance(replica int) ServiceConfig {
+	expand := func(in string) string {
+		return replicaRegex.ReplaceAllStringFunc(in, func(match string) string {
+			offset := 0
+			if m := replicaRegex.FindStringSubmatch(match); m[1] != "" {
+				offset, _ = strconv.Atoi(m[1])
+			}
+			return strconv.Itoa(replica + offset)
+		})
+	}
+	expandAll := func(in map[string]string) map[string]string {
+		if in == nil {
+			return nil
+		}
+		out := maps.Clone(in)
+		for k, v := range out {
+			out[k] = expand(v)
+		}
+		return out
+	}
+
+	inst := sc
+	inst.Use = append(StringArray(nil), sc.Use...)
+	inst.Args = expandAll(sc.Args)
+	inst.Environment = expandAll(sc.Environment)
+	inst.Replica = replica
+	return inst
+}
+
 // varRegex matches environment variables ($VAR_NAME), tilde (~), asterisk (*), and escaped characters (\$, \~, \*, \\).
 // It uses named capture groups for clarity:
 // - `escaped`: Matches '\$', '\~', '\*' or '\\'
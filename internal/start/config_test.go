@@ -1,6 +1,7 @@
 package start
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -95,6 +96,67 @@ services:
 	}
 }
 
+func TestLoadConfigReplicas(t *testing.T) {
+	tempDir := t.TempDir()
+	configPath := filepath.Join(tempDir, "services.yaml")
+	yamlContent := `
+common:
+  discovery:
+    discovery: "http://localhost:3003"
+services:
+  - command: storage
+    use: discovery
+    replicas: 3
+    args:
+      port: "{replica+3100}"
+      dir: "*/storage-{replica}"
+    environment:
+      INSTANCE: "{replica}"
+  - command: discovery
+    args:
+      port: "3003"
+`
+	if err := os.WriteFile(configPath, []byte(yamlContent), 0644); err != nil {
+		t.Fatalf("failed to write temp config file: %v", err)
+	}
+
+	cfg, err := LoadConfig(configPath, tempDir)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if len(cfg.Services) != 4 {
+		t.Fatalf("expected 4 services, got %d", len(cfg.Services))
+	}
+	for i, svc := range cfg.Services[:3] {
+		replica := i + 1
+		if svc.Replica != replica || svc.Name() != fmt.Sprintf("storage-%d", replica) {
+			t.Errorf("service %d is replica %d named %s", i, svc.Replica, svc.Name())
+		}
+		if want := fmt.Sprint(3100 + replica); svc.Args["port"] != want {
+			t.Errorf("replica %d port = %s, want %s", replica, svc.Args["port"], want)
+		}
+		if want := filepath.Join(tempDir, fmt.Sprintf("storage-%d", replica)); filepath.Clean(svc.Args["dir"]) != want {
+			t.Errorf("replica %d dir = %s, want %s", replica, svc.Args["dir"], want)
+		}
+		if svc.Args["discovery"] != "http://localhost:3003" {
+			t.Errorf("replica %d did not use the common discovery args", replica)
+		}
+		if svc.Environment["INSTANCE"] != fmt.Sprint(replica) {
+			t.Errorf("replica %d INSTANCE = %s", replica, svc.Environment["INSTANCE"])
+		}
+	}
+	if svc := cfg.Services[3]; svc.Replica != 0 || svc.Name() != "discovery" {
+		t.Errorf("unreplicated service is replica %d named %s", svc.Replica, svc.Name())
+	}
+
+	if err := os.WriteFile(configPath, []byte("services:\n  - command: storage\n    replicas: -1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(configPath, tempDir); err == nil {
+		t.Errorf("LoadConfig accepted negative replicas")
+	}
+}
+
 func TestSubstituteString(t *testing.T) {
 	os.Setenv("TESTVAR", "hello")
 	os.Setenv("EMPTYVAR", "")
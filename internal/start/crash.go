@@ -0,0 +1,131 @@
+package start
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCrashLines is the number of lines of output kept for a crash report
+// when RunnerConfig.CrashLines is not set.
+const DefaultCrashLines = 100
+
+// Crash reports the abnormal exit of a service.
+type Crash struct {
+	Service  string    `json:"service"`
+	Command  string    `json:"command"`
+	Args     []string  `json:"args"`
+	PID      int       `json:"pid"`
+	Time     time.Time `json:"time"`
+	Uptime   string    `json:"uptime"`
+	Status   string    `json:"status"`   // how the process exited, such as "exit status 1"
+	ExitCode int       `json:"exitCode"` // -1 if the process was killed by a signal, did not start or runs in process
+	Output   []string  `json:"output"`   // the last lines printed, stdout and stderr interleaved
+}
+
+// ServiceStatus is the state of a service reported by GET /status.
+type ServiceStatus struct {
+	Name      string    `json:"name"`
+	Command   string    `json:"command"`
+	Running   bool      `json:"running"`
+	PID       int       `json:"pid,omitempty"`
+	Started   time.Time `json:"started,omitzero"`
+	Restarts  int       `json:"restarts"`
+	Crashes   int       `json:"crashes"`
+	LastCrash *Crash    `json:"lastCrash,omitempty"`
+}
+
+// outputTail keeps the last lines written by a service.
+type outputTail struct {
+	mu    sync.Mutex
+	size  int
+	lines []string
+}
+
+func newOutputTail(size int) *outputTail {
+	return &outputTail{size: size}
+}
+
+func (t *outputTail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.size {
+		t.lines = t.lines[len(t.lines)-t.size:]
+	}
+}
+
+func (t *outputTail) snapshot() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.lines...)
+}
+
+// newCrash describes the exit of sc, started at started as process pid, with
+// err.
+func newCrash(sc ServiceConfig, pid int, started time.Time, err error, tail *outputTail) *Crash {
+	crash := &Crash{
+		Service:  sc.Name(),
+		Command:  sc.Command,
+		Args:     sc.CommandArgs(),
+		PID:      pid,
+		Time:     time.Now(),
+		Uptime:   time.Since(started).Round(time.Millisecond).String(),
+		Status:   err.Error(),
+		ExitCode: -1,
+		Output:   tail.snapshot(),
+	}
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		crash.ExitCode = exitErr.ExitCode()
+	}
+	return crash
+}
+
+// writeCrash writes crash to a file of dir named after the service and the
+// time of the crash, and returns its path.
+func writeCrash(dir string, crash *Crash) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := strings.ReplaceAll(crash.Service, string(filepath.Separator), "-")
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.json", name, crash.Time.UTC().Format("20060102T150405.000Z")))
+	data, err := json.MarshalIndent(crash, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, data, 0644)
+}
+
+// Status returns the state of each service, in the order of the
+// configuration.
+func (r *Runner) Status() []ServiceStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := make([]ServiceStatus, len(r.statuses))
+	copy(statuses, r.statuses)
+	return statuses
+}
+
+func (r *Runner) updateStatus(i int, update func(*ServiceStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	update(&r.statuses[i])
+}
+
+// Handler serves the state of the services, including the last crash of
+// each, at GET /status.
+func (r *Runner) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Status())
+	})
+	return mux
+}
@@ -0,0 +1,6 @@
+//go:build !windows
+
+package start
+
+// defaultExecutableSuffix is empty as executables have no extension.
+const defaultExecutableSuffix = ""
@@ -0,0 +1,4 @@
+package start
+
+// defaultExecutableSuffix is the extension of executables on Windows.
+const defaultExecutableSuffix = ".exe"
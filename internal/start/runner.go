@@ -8,6 +8,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"sync"
 	"time"
 )
 
@@ -15,9 +17,50 @@ import (
 type RunnerConfig struct {
 	MaxBackoffDuration time.Duration // time before giving up with exponential backoff and using RetryInterval
 	RetryInterval      time.Duration // interval to wait once MaxBackoffDuration is reached
+	Backoff            time.Duration // first delay before restarting a service, InitialBackoff if zero
 	Config             *Config
+
+	// ExecutableSuffix is appended to the commands of services without an
+	// extension, such as ".exe" on Windows. Empty uses the suffix of the
+	// platform the runner was built for.
+	ExecutableSuffix string
+
+	Log LogOptions
+
+	// CrashLines is the number of lines of output kept for the report of a
+	// service exiting abnormally, DefaultCrashLines if zero. CrashDir, if
+	// set, is the directory each report is written to.
+	CrashLines int
+	CrashDir   string
+}
+
+// LogOptions configures how the output of the services is printed. Each
+// line is prefixed by the name of the service and its process ID.
+type LogOptions struct {
+	Timestamps bool     // prefix each line with the time it was printed
+	Color      bool     // print the prefix of each service in its own color
+	Quiet      bool     // discard the output of every service
+	Only       []string // if set, only print the output of these services, by name or command
+
+	// Stdout and Stderr receive the output of the services, os.Stdout and
+	// os.Stderr if nil.
+	Stdout io.Writer
+	Stderr io.Writer
 }
 
+// shows reports whether the output of sc is printed.
+func (o LogOptions) shows(sc ServiceConfig) bool {
+	if o.Quiet {
+		return false
+	}
+	return len(o.Only) == 0 || slices.Contains(o.Only, sc.Name()) || slices.Contains(o.Only, sc.Command)
+}
+
+// serviceColors are the ANSI colors the prefixes of services cycle through.
+var serviceColors = []string{"\x1b[36m", "\x1b[32m", "\x1b[33m", "\x1b[35m", "\x1b[34m", "\x1b[31m"}
+
+const colorReset = "\x1b[0m"
+
 // Default backoff configurations
 const (
 	InitialBackoff = 1 * time.Second
@@ -28,6 +71,9 @@ const (
 type Runner struct {
 	rc      RunnerConfig
 	baseDir string
+
+	mu       sync.Mutex
+	statuses []ServiceStatus
 }
 
 // NewRunner creates a new Runner based on the provided configuration.
@@ -37,22 +83,48 @@ func NewRunner(rc RunnerConfig) (*Runner, error) {
 		return nil, fmt.Errorf("failed to get executable path: %w", err)
 	}
 	baseDir := filepath.Dir(exePath)
+	if rc.ExecutableSuffix == "" {
+		rc.ExecutableSuffix = defaultExecutableSuffix
+	}
+	if rc.Log.Stdout == nil {
+		rc.Log.Stdout = os.Stdout
+	}
+	if rc.Log.Stderr == nil {
+		rc.Log.Stderr = os.Stderr
+	}
+	if rc.Backoff <= 0 {
+		rc.Backoff = InitialBackoff
+	}
+	if rc.CrashLines <= 0 {
+		rc.CrashLines = DefaultCrashLines
+	}
+	statuses := make([]ServiceStatus, len(rc.Config.Services))
+	for i, sc := range rc.Config.Services {
+		statuses[i] = ServiceStatus{Name: sc.Name(), Command: sc.Command}
+	}
 	return &Runner{
-		rc:      rc,
-		baseDir: baseDir,
+		rc:       rc,
+		baseDir:  baseDir,
+		statuses: statuses,
 	}, nil
 }
 
-// Start launches all configured services and blocks until the context is canceled.
+// Start launches all configured services and blocks until the context is
+// canceled and every service has stopped.
 func (r *Runner) Start(ctx context.Context) {
+	var wg sync.WaitGroup
 	for i := range r.rc.Config.Services {
 		sc := r.rc.Config.Services[i]
-		go r.runService(ctx, sc)
+		var color string
+		if r.rc.Log.Color {
+			color = serviceColors[i%len(serviceColors)]
+		}
+		wg.Go(func() { r.runService(ctx, i, sc, color) })
 	}
-	<-ctx.Done()
+	wg.Wait()
 }
 
-func (r *Runner) runService(ctx context.Context, sc ServiceConfig) {
+func (r *Runner) runService(ctx context.Context, index int, sc ServiceConfig, color string) {
 	var backoff time.Duration
 	var firstCrashTime time.Time
 
@@ -66,38 +138,25 @@ func (r *Runner) runService(ctx context.Context, sc ServiceConfig) {
 			}
 		}
 
-		args := make([]string, 0, len(sc.Args)*2)
-		for k, v := range sc.Args {
-			args = append(args, fmt.Sprintf("--%s=%s", k, v))
-		}
-
-		cmdPath := filepath.Join(r.baseDir, filepath.Base(sc.Command))
-		cmd := exec.CommandContext(ctx, cmdPath, args...)
-		cmd.Dir = r.baseDir
-		cmd.Env = os.Environ()
-		for k, v := range sc.Environment {
-			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
-		}
-		cmd.Stdout = &prefixWriter{cmd: cmd, name: sc.Command, out: os.Stdout}
-		cmd.Stderr = &prefixWriter{cmd: cmd, name: sc.Command, out: os.Stderr}
-
-		log.Printf("Starting service [%s] command: %s %v", sc.Command, cmdPath, args)
-		startTime := time.Now()
-
-		err := cmd.Run()
-
+		// The output is kept for a crash report even when it is not shown
+		tail := newOutputTail(r.rc.CrashLines)
+		startTime, pid, err := r.runOnce(ctx, index, sc, color, tail)
 		if ctx.Err() != nil {
 			return // Context canceled, shutting down
 		}
 
 		uptime := time.Since(startTime)
-		log.Printf("Service [%s] exited strongly after %v: %v", sc.Command, uptime, err)
+		log.Printf("Service [%s] exited strongly after %v: %v", sc.Name(), uptime, err)
+		if err != nil {
+			r.recordCrash(index, newCrash(sc, pid, startTime, err, tail))
+		}
+		r.updateStatus(index, func(s *ServiceStatus) { s.Restarts++ })
 
 		if uptime > 30*time.Second {
 			// Process lived for a while, reset backoff
 			backoff = 0
 			firstCrashTime = time.Time{}
-			log.Printf("Service [%s] lived for %v, resetting backoff", sc.Command, uptime)
+			log.Printf("Service [%s] lived for %v, resetting backoff", sc.Name(), uptime)
 		}
 
 		if firstCrashTime.IsZero() {
@@ -106,7 +165,7 @@ func (r *Runner) runService(ctx context.Context, sc ServiceConfig) {
 
 		// Calculate backoff
 		if backoff == 0 {
-			backoff = InitialBackoff
+			backoff = r.rc.Backoff
 		} else {
 			backoff *= 2
 			if backoff > MaxBackoffStep {
@@ -115,35 +174,159 @@ func (r *Runner) runService(ctx context.Context, sc ServiceConfig) {
 		}
 
 		if time.Since(firstCrashTime) > r.rc.MaxBackoffDuration {
-			log.Printf("Service [%s] has been failing for over %v.", sc.Command, r.rc.MaxBackoffDuration)
-			log.Printf("Waiting %v interval before attempting to restart [%s] again", r.rc.RetryInterval, sc.Command)
+			log.Printf("Service [%s] has been failing for over %v.", sc.Name(), r.rc.MaxBackoffDuration)
+			log.Printf("Waiting %v interval before attempting to restart [%s] again", r.rc.RetryInterval, sc.Name())
 			backoff = r.rc.RetryInterval
 			firstCrashTime = time.Time{} // Reset the crash time counter so it can exponential backoff again after the long wait, or just stay on long wait?
 			// To match requirements, we'll try again after the interval, back to exponential backoff
 		} else {
-			log.Printf("Restarting service [%s] in %v (exponential back-off)", sc.Command, backoff)
+			log.Printf("Restarting service [%s] in %v (exponential back-off)", sc.Name(), backoff)
 		}
 	}
 }
 
+// runOnce runs sc until it exits, returning when it started, its process ID
+// and the error it exited with.
+func (r *Runner) runOnce(ctx context.Context, index int, sc ServiceConfig, color string, tail *outputTail) (time.Time, int, error) {
+	pid := -1
+	stdoutOut, stderrOut := io.Discard, io.Discard
+	if r.rc.Log.shows(sc) {
+		stdoutOut, stderrOut = r.rc.Log.Stdout, r.rc.Log.Stderr
+	}
+	stdout := r.newPrefixWriter(sc, color, stdoutOut)
+	stderr := r.newPrefixWriter(sc, color, stderrOut)
+	stdout.tail, stderr.tail = tail, tail
+	defer stdout.Flush()
+	defer stderr.Flush()
+
+	started := func(startTime time.Time, processID int) {
+		pid = processID
+		stdout.setPID(pid)
+		stderr.setPID(pid)
+		r.updateStatus(index, func(s *ServiceStatus) {
+			s.Running = true
+			s.PID = pid
+			s.Started = startTime
+		})
+	}
+	defer r.updateStatus(index, func(s *ServiceStatus) {
+		s.Running = false
+		s.PID = 0
+	})
+
+	args := sc.CommandArgs()
+	startTime := time.Now()
+	if sc.Run != nil {
+		log.Printf("Starting service [%s] in process: %v", sc.Name(), args)
+		started(startTime, os.Getpid())
+		return startTime, pid, sc.Run(ctx, args, stdout, stderr)
+	}
+
+	cmdPath := r.commandPath(sc.Command)
+	cmd := exec.CommandContext(ctx, cmdPath, args...)
+	cmd.Dir = r.baseDir
+	cmd.Env = os.Environ()
+	for k, v := range sc.Environment {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	log.Printf("Starting service [%s] command: %s %v", sc.Name(), cmdPath, args)
+	if err := cmd.Start(); err != nil {
+		return startTime, pid, err
+	}
+	started(startTime, cmd.Process.Pid)
+	return startTime, pid, cmd.Wait()
+}
+
+// recordCrash keeps crash as the last crash of a service and writes it to
+// the crash directory.
+func (r *Runner) recordCrash(index int, crash *Crash) {
+	r.updateStatus(index, func(s *ServiceStatus) {
+		s.Crashes++
+		s.LastCrash = crash
+	})
+	if r.rc.CrashDir == "" {
+		return
+	}
+	path, err := writeCrash(r.rc.CrashDir, crash)
+	if err != nil {
+		log.Printf("Failed to write crash report of [%s]: %v", crash.Service, err)
+		return
+	}
+	log.Printf("Wrote crash report of [%s] to %s", crash.Service, path)
+}
+
+// commandPath returns the path of the executable of command, which is
+// looked for next to the runner's own executable.
+func (r *Runner) commandPath(command string) string {
+	name := filepath.Base(filepath.FromSlash(command))
+	if filepath.Ext(name) == "" {
+		name += r.rc.ExecutableSuffix
+	}
+	return filepath.Join(r.baseDir, name)
+}
+
+// prefixWriter prefixes each line written to it before writing it to out.
 type prefixWriter struct {
-	cmd  *exec.Cmd
-	name string
-	out  io.Writer
+	name       string
+	color      string
+	timestamps bool
+	out        io.Writer
+	tail       *outputTail // if set, receives each line without its prefix
+
+	mu   sync.Mutex
+	pid  int
 	line []byte
 }
 
+func (r *Runner) newPrefixWriter(sc ServiceConfig, color string, out io.Writer) *prefixWriter {
+	return &prefixWriter{name: sc.Name(), color: color, timestamps: r.rc.Log.Timestamps, out: out, pid: -1}
+}
+
+// setPID sets the process ID printed in the prefix, -1 until the service
+// started.
+func (w *prefixWriter) setPID(pid int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pid = pid
+}
+
 func (w *prefixWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	for _, b := range p {
 		w.line = append(w.line, b)
 		if b == '\n' {
-			pid := -1
-			if w.cmd != nil && w.cmd.Process != nil {
-				pid = w.cmd.Process.Pid
-			}
-			fmt.Fprintf(w.out, "[%s:%d] %s", w.name, pid, string(w.line))
-			w.line = w.line[:0]
+			w.writeLine()
 		}
 	}
 	return len(p), nil
 }
+
+// Flush writes the last line if the process exited without ending it.
+func (w *prefixWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.line) > 0 {
+		w.line = append(w.line, '\n')
+		w.writeLine()
+	}
+}
+
+func (w *prefixWriter) writeLine() {
+	if w.tail != nil {
+		w.tail.add(string(w.line[:len(w.line)-1]))
+	}
+	var stamp string
+	if w.timestamps {
+		stamp = time.Now().Format("15:04:05.000 ")
+	}
+	if w.color != "" {
+		fmt.Fprintf(w.out, "%s%s[%s:%d]%s %s", stamp, w.color, w.name, w.pid, colorReset, w.line)
+	} else {
+		fmt.Fprintf(w.out, "%s[%s:%d] %s", stamp, w.name, w.pid, w.line)
+	}
+	w.line = w.line[:0]
+}
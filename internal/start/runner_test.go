@@ -0,0 +1,225 @@
+package start
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunnerCommandPath(t *testing.T) {
+	baseDir := t.TempDir()
+	r := &Runner{rc: RunnerConfig{ExecutableSuffix: ".exe"}, baseDir: baseDir}
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"storage", "storage.exe"},
+		{"bin/storage", "storage.exe"},
+		{"storage.exe", "storage.exe"},
+	}
+	for _, tt := range tests {
+		if got := r.commandPath(tt.command); got != filepath.Join(baseDir, tt.want) {
+			t.Errorf("commandPath(%q) = %q, want %q", tt.command, got, filepath.Join(baseDir, tt.want))
+		}
+	}
+
+	r.rc.ExecutableSuffix = ""
+	if got := r.commandPath("storage"); got != filepath.Join(baseDir, "storage") {
+		t.Errorf("commandPath without a suffix = %q", got)
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	r := &Runner{rc: RunnerConfig{Log: LogOptions{Timestamps: true}}}
+	w := r.newPrefixWriter(ServiceConfig{Command: "storage", Replica: 2}, serviceColors[0], &out)
+
+	fmt.Fprint(w, "first line\nsecond ")
+	fmt.Fprint(w, "line\nunterminated")
+	w.Flush()
+	w.Flush()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	want := []string{"first line", "second line", "unterminated"}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines %q, want %d", len(lines), lines, len(want))
+	}
+	stamp := regexp.MustCompile(`^\d\d:\d\d:\d\d\.\d\d\d `)
+	for i, line := range lines {
+		if !stamp.MatchString(line) {
+			t.Errorf("line %q has no timestamp", line)
+		}
+		prefix := serviceColors[0] + "[storage-2:-1]" + colorReset + " "
+		if !strings.HasSuffix(line, prefix+want[i]) {
+			t.Errorf("line %q, want suffix %q", line, prefix+want[i])
+		}
+	}
+}
+
+func TestLogOptionsShows(t *testing.T) {
+	storage1 := ServiceConfig{Command: "storage", Replica: 1}
+	storage2 := ServiceConfig{Command: "storage", Replica: 2}
+	discovery := ServiceConfig{Command: "discovery"}
+	tests := []struct {
+		opts LogOptions
+		want []bool
+	}{
+		{LogOptions{}, []bool{true, true, true}},
+		{LogOptions{Quiet: true}, []bool{false, false, false}},
+		{LogOptions{Only: []string{"storage"}}, []bool{true, true, false}},
+		{LogOptions{Only: []string{"storage-2", "discovery"}}, []bool{false, true, true}},
+	}
+	for _, tt := range tests {
+		for i, sc := range []ServiceConfig{storage1, storage2, discovery} {
+			if got := tt.opts.shows(sc); got != tt.want[i] {
+				t.Errorf("%+v shows %s = %v, want %v", tt.opts, sc.Name(), got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestRunnerCrashReport(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the service")
+	}
+	baseDir := t.TempDir()
+	script := "#!/bin/sh\nfor i in 1 2 3 4 5; do echo line $i; done\necho failing\nexit 3\n"
+	if err := os.WriteFile(filepath.Join(baseDir, "crasher"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	crashDir := filepath.Join(baseDir, "crashes")
+	r := &Runner{
+		rc: RunnerConfig{
+			Config:             &Config{Services: []ServiceConfig{{Command: "crasher"}}},
+			Log:                LogOptions{Quiet: true},
+			CrashLines:         3,
+			CrashDir:           crashDir,
+			MaxBackoffDuration: time.Minute,
+		},
+		baseDir:  baseDir,
+		statuses: []ServiceStatus{{Name: "crasher", Command: "crasher"}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Start(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	var status ServiceStatus
+	for {
+		status = r.Status()[0]
+		if status.LastCrash != nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	crash := status.LastCrash
+	if crash == nil {
+		t.Fatal("no crash was recorded")
+	}
+	if crash.ExitCode != 3 || crash.Status != "exit status 3" {
+		t.Errorf("crash exit = %d %q, want 3", crash.ExitCode, crash.Status)
+	}
+	if want := []string{"line 4", "line 5", "failing"}; !slices.Equal(crash.Output, want) {
+		t.Errorf("crash output = %q, want %q", crash.Output, want)
+	}
+
+	files, _ := os.ReadDir(crashDir)
+	if len(files) == 0 {
+		t.Fatal("no crash file was written")
+	}
+	data, err := os.ReadFile(filepath.Join(crashDir, files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written Crash
+	if err := json.Unmarshal(data, &written); err != nil || written.ExitCode != 3 {
+		t.Errorf("crash file = %s, %v", data, err)
+	}
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	var statuses []ServiceStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &statuses); err != nil || len(statuses) != 1 || statuses[0].Crashes == 0 {
+		t.Errorf("GET /status = %s, %v", rec.Body, err)
+	}
+}
+
+func TestRunnerInProcess(t *testing.T) {
+	var mu sync.Mutex
+	var calls [][]string
+	service := func(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+		mu.Lock()
+		calls = append(calls, args)
+		n := len(calls)
+		mu.Unlock()
+		if n < 3 {
+			fmt.Fprintf(stderr, "attempt %d failing\n", n)
+			return fmt.Errorf("attempt %d failed", n)
+		}
+		fmt.Fprintln(stdout, "running")
+		<-ctx.Done()
+		return nil
+	}
+
+	var out bytes.Buffer
+	r, err := NewRunner(RunnerConfig{
+		Backoff:            time.Millisecond,
+		MaxBackoffDuration: time.Minute,
+		Config: &Config{Services: []ServiceConfig{
+			{Command: "inproc", Args: map[string]string{"port": "1", "dir": "d"}, Run: service},
+		}},
+		Log: LogOptions{Stdout: &out, Stderr: &out},
+	})
+	if err != nil {
+		t.Fatalf("NewRunner failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Start(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !r.Status()[0].Running || r.Status()[0].Restarts < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("service did not restart: %+v", r.Status()[0])
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return once the service stopped")
+	}
+
+	status := r.Status()[0]
+	if status.Crashes != 2 || status.LastCrash == nil || status.LastCrash.Status != "attempt 2 failed" {
+		t.Errorf("status = %+v", status)
+	}
+	if want := []string{"attempt 2 failing"}; !slices.Equal(status.LastCrash.Output, want) {
+		t.Errorf("crash output = %q, want %q", status.LastCrash.Output, want)
+	}
+	if want := []string{"--dir=d", "--port=1"}; !slices.Equal(calls[0], want) {
+		t.Errorf("args = %q, want %q", calls[0], want)
+	}
+	if !strings.Contains(out.String(), fmt.Sprintf("[inproc:%d] running", os.Getpid())) {
+		t.Errorf("output = %q", out.String())
+	}
+}
@@ -1,47 +1,144 @@
 package storage
 
 import (
+	"bytes"
 	"container/list"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"invariant/internal/discovery"
 	"invariant/internal/finder"
 )
 
+// DefaultMissingTTL is how long an AggregateClient remembers that a block
+// was found on no server.
+const DefaultMissingTTL = time.Second
+
+// AggregateConfig configures an AggregateClient.
+type AggregateConfig struct {
+	// StoreServers is the number of storage servers found through discovery
+	// to write to when no server is live.
+	StoreServers int
+
+	// MaxBlocks bounds the number of block locations cached; 0 or less is
+	// unlimited.
+	MaxBlocks int
+
+	// Replicas is the number of servers each written block is stored on; 0
+	// is 1. A write succeeds if at least one server stores the block.
+	Replicas int
+
+	// Timeout bounds each request to a server, including reading its
+	// response; 0 is no limit.
+	Timeout time.Duration
+
+	// Hedge is the delay after which a read still unanswered is also sent
+	// to the next server, the first answer winning; 0 disables hedging.
+	Hedge time.Duration
+
+	// MissingTTL is how long a block found on no server is reported missing
+	// without asking the servers again; 0 disables the cache.
+	MissingTTL time.Duration
+
+	// ReadRepair writes a block read from one server back, in the
+	// background, to the servers expected to have it by the cached locations
+	// or the finder that answered without it, so hot blocks heal as they are
+	// read.
+	ReadRepair bool
+
+	// DiscoverOnMiss adds every storage server found through discovery to
+	// the live servers before they are asked for a block the finder did not
+	// find, so blocks not yet announced to the finder are found by clients
+	// that have not written to the servers themselves.
+	DiscoverOnMiss bool
+
+	// IgnoreCaches reads only from storage servers, never from the cache-v1
+	// servers known to the finder, for clients that are caches themselves.
+	IgnoreCaches bool
+}
+
+// DefaultAggregateConfig returns the configuration used by the commands.
+func DefaultAggregateConfig() AggregateConfig {
+	return AggregateConfig{
+		StoreServers: 3,
+		MaxBlocks:    1000,
+		Replicas:     1,
+		MissingTTL:   DefaultMissingTTL,
+	}
+}
+
+// AggregateStats counts the requests of an AggregateClient.
+type AggregateStats struct {
+	Reads           int64          `json:"reads"`
+	CacheHits       int64          `json:"cacheHits"`   // reads answered by a cached block location or size
+	MissingHits     int64          `json:"missingHits"` // reads answered by the cache of missing blocks
+	HitRate         float64        `json:"hitRate"`
+	FinderFallbacks int64          `json:"finderFallbacks"` // reads that asked the finder
+	LiveFallbacks   int64          `json:"liveFallbacks"`   // reads that asked every live server
+	Hedged          int64          `json:"hedged"`          // requests sent to another server before an answer
+	Writes          int64          `json:"writes"`
+	UnderReplicated int64          `json:"underReplicated"` // writes stored on fewer servers than Replicas
+	Repaired        int64          `json:"repaired"`        // blocks written back to servers missing them
+	Servers         []ServerHealth `json:"servers"`
+}
+
+// StatsReporter is implemented by storage clients that count their requests.
+type StatsReporter interface {
+	Stats() AggregateStats
+}
+
+type aggregateCounters struct {
+	reads, cacheHits, missingHits  atomic.Int64
+	finderFallbacks, liveFallbacks atomic.Int64
+	hedged                         atomic.Int64
+	writes, underReplicated        atomic.Int64
+	repaired                       atomic.Int64
+}
+
 var (
 	ErrNoLiveServers = errors.New("no live storage servers available")
 	ErrBlockNotFound = errors.New("block not found in any storage")
 )
 
+// maxRepairs is the number of read repairs an AggregateClient runs at a time.
+// Repairs beyond it are dropped, to be tried again by a later read.
+const maxRepairs = 4
+
+// blockLocation records the servers known to have a block. As blocks are
+// immutable, the entry also answers Has and Size while a known server is live.
 type blockLocation struct {
 	address string
 	servers []string
+	size    int64 // -1 until known
 }
 
-// errorTrackingTransport intercepts network errors to report dead servers.
+// errorTrackingTransport measures the requests to a server to track its
+// health and reports dead servers.
 type errorTrackingTransport struct {
 	base     http.RoundTripper
 	serverID string
+	onResult func(serverID string, latency time.Duration, failed bool)
 	onError  func(serverID string)
 }
 
 func (t *errorTrackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
 	resp, err := t.base.RoundTrip(req)
-	if err != nil {
-		if t.onError != nil {
-			t.onError(t.serverID)
-		}
-	} else if resp != nil && (resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout) {
-		// Server might be down or not responding properly
-		if t.onError != nil {
-			t.onError(t.serverID)
-		}
+	failed := err != nil || (resp != nil && (resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout))
+	if t.onResult != nil {
+		t.onResult(t.serverID, time.Since(start), failed)
+	}
+	if err != nil && t.onError != nil {
+		// The server could not be reached at all
+		t.onError(t.serverID)
 	}
 	return resp, err
 }
@@ -51,12 +148,25 @@ type AggregateClient struct {
 	finder          finder.Finder
 	discovery       discovery.Discovery
 	numStoreServers int
+	replicas        int
+	timeout         time.Duration
+	hedge           time.Duration
+	counters        aggregateCounters
 
 	// Live servers cache
 	liveMu      sync.RWMutex
 	liveServers map[string]Storage // Server ID -> Storage client
-	liveIDs     []string           // For round-robin access
-	liveCounter uint64
+	liveIDs     []string           // In the order the servers were added
+
+	// Caches found through the finder, which are read from before the
+	// storage servers but never written to
+	caches       map[string]Storage // Server ID -> Storage client
+	ignoreCaches bool
+
+	discoverOnMiss bool
+
+	// Health of the servers, which weights the choice between them
+	health *healthTracker
 
 	// LRU Cache for block locations
 	maxBlocks int
@@ -66,33 +176,79 @@ type AggregateClient struct {
 
 	writtenMu      sync.Mutex
 	writtenServers map[string]struct{}
+
+	// Negative cache of blocks found on no server, address -> expiry
+	missingTTL time.Duration
+	missingMu  sync.Mutex
+	missing    map[string]time.Time
+
+	// Read repairs in flight
+	readRepair  bool
+	repairSlots chan struct{}
+	repairs     sync.WaitGroup
 }
 
 // NewAggregateClient creates a new Storage client that aggregates multiple services.
-func NewAggregateClient(f finder.Finder, d discovery.Discovery, numStoreServers, maxBlocks int) *AggregateClient {
+func NewAggregateClient(f finder.Finder, d discovery.Discovery, cfg AggregateConfig) *AggregateClient {
+	maxBlocks := cfg.MaxBlocks
 	if maxBlocks <= 0 {
 		maxBlocks = -1 // No limit
 	}
 	return &AggregateClient{
 		finder:          f,
 		discovery:       d,
-		numStoreServers: numStoreServers,
+		numStoreServers: cfg.StoreServers,
+		replicas:        max(cfg.Replicas, 1),
+		timeout:         cfg.Timeout,
+		hedge:           cfg.Hedge,
 		liveServers:     make(map[string]Storage),
+		caches:          make(map[string]Storage),
+		ignoreCaches:    cfg.IgnoreCaches,
+		discoverOnMiss:  cfg.DiscoverOnMiss,
+		health:          newHealthTracker(),
 		maxBlocks:       maxBlocks,
 		lruList:         list.New(),
 		lruMap:          make(map[string]*list.Element),
 		writtenServers:  make(map[string]struct{}),
+		missingTTL:      cfg.MissingTTL,
+		missing:         make(map[string]time.Time),
+		readRepair:      cfg.ReadRepair,
+		repairSlots:     make(chan struct{}, maxRepairs),
 	}
 }
 
-// removeLiveServer removes a server from the live list and LRU.
+// Stats reports the requests made by the client and the health of its live
+// servers.
+func (c *AggregateClient) Stats() AggregateStats {
+	stats := AggregateStats{
+		Reads:           c.counters.reads.Load(),
+		CacheHits:       c.counters.cacheHits.Load(),
+		MissingHits:     c.counters.missingHits.Load(),
+		FinderFallbacks: c.counters.finderFallbacks.Load(),
+		LiveFallbacks:   c.counters.liveFallbacks.Load(),
+		Hedged:          c.counters.hedged.Load(),
+		Writes:          c.counters.writes.Load(),
+		UnderReplicated: c.counters.underReplicated.Load(),
+		Repaired:        c.counters.repaired.Load(),
+		Servers:         c.Health(),
+	}
+	if stats.Reads > 0 {
+		stats.HitRate = float64(stats.CacheHits+stats.MissingHits) / float64(stats.Reads)
+	}
+	return stats
+}
+
+// removeLiveServer removes a server or cache from the live list and LRU.
 func (c *AggregateClient) removeLiveServer(serverID string) {
 	c.liveMu.Lock()
-	if _, ok := c.liveServers[serverID]; !ok {
+	_, live := c.liveServers[serverID]
+	_, cache := c.caches[serverID]
+	if !live && !cache {
 		c.liveMu.Unlock()
 		return
 	}
 	delete(c.liveServers, serverID)
+	delete(c.caches, serverID)
 	// Update liveIDs
 	var newIDs []string
 	for _, id := range c.liveIDs {
@@ -102,6 +258,7 @@ func (c *AggregateClient) removeLiveServer(serverID string) {
 	}
 	c.liveIDs = newIDs
 	c.liveMu.Unlock()
+	c.health.forget(serverID)
 
 	// Also remove from LRU
 	c.lruMu.Lock()
@@ -126,6 +283,31 @@ func (c *AggregateClient) addLiveServer(serverID string) Storage {
 		return client
 	}
 
+	client := c.newServerClient(serverID)
+	if client != nil {
+		c.liveServers[serverID] = client
+		c.liveIDs = append(c.liveIDs, serverID)
+	}
+	return client
+}
+
+// addCache adds a cache server, which is only read from.
+func (c *AggregateClient) addCache(serverID string) Storage {
+	c.liveMu.Lock()
+	defer c.liveMu.Unlock()
+	if client, ok := c.caches[serverID]; ok {
+		return client
+	}
+	client := c.newServerClient(serverID)
+	if client != nil {
+		c.caches[serverID] = client
+	}
+	return client
+}
+
+// newServerClient creates a client of the server found in discovery whose
+// failures are tracked in the health of the server.
+func (c *AggregateClient) newServerClient(serverID string) Storage {
 	if c.discovery == nil {
 		return nil
 	}
@@ -140,18 +322,34 @@ func (c *AggregateClient) addLiveServer(serverID string) Storage {
 	transport := &errorTrackingTransport{
 		base:     http.DefaultTransport,
 		serverID: serverID,
+		onResult: c.observe,
 		onError:  c.removeLiveServer, // This will be called asynchronously upon failure
 	}
 
 	httpClient := &http.Client{
 		Transport: transport,
+		Timeout:   c.timeout,
 	}
 
 	// Assuming svc.Address is the base URL
-	client := NewClient(svc.Address, httpClient)
-	c.liveServers[serverID] = client
-	c.liveIDs = append(c.liveIDs, serverID)
-	return client
+	return NewClient(svc.Address, httpClient)
+}
+
+// observe records the outcome of a request to a server in its health and
+// drops the server once most of its requests fail.
+func (c *AggregateClient) observe(serverID string, latency time.Duration, failed bool) {
+	if c.health.observe(serverID, latency, failed) >= unhealthyErrorRate {
+		c.removeLiveServer(serverID)
+	}
+}
+
+// Health reports the measured health of the live servers, in the order they
+// were added.
+func (c *AggregateClient) Health() []ServerHealth {
+	c.liveMu.RLock()
+	ids := append([]string(nil), c.liveIDs...)
+	c.liveMu.RUnlock()
+	return c.health.health(ids)
 }
 
 // markBlockUsed updates the LRU for the given address indicating which servers have it.
@@ -185,6 +383,7 @@ func (c *AggregateClient) markBlockUsed(address string, servers []string) {
 	loc := &blockLocation{
 		address: address,
 		servers: append([]string(nil), servers...), // Copy the slice
+		size:    -1,
 	}
 	elem := c.lruList.PushFront(loc)
 	c.lruMap[address] = elem
@@ -199,6 +398,80 @@ func (c *AggregateClient) markBlockUsed(address string, servers []string) {
 	}
 }
 
+// knownBlock reports whether a live server is known to have address,
+// returning its size if that is known too.
+func (c *AggregateClient) knownBlock(address string) (size int64, ok bool) {
+	c.lruMu.Lock()
+	defer c.lruMu.Unlock()
+	elem, found := c.lruMap[address]
+	if !found {
+		return -1, false
+	}
+	loc := elem.Value.(*blockLocation)
+	if len(loc.servers) == 0 {
+		return -1, false
+	}
+	c.lruList.MoveToFront(elem)
+	return loc.size, true
+}
+
+// setBlockSize records the size of a block in its LRU entry.
+func (c *AggregateClient) setBlockSize(address string, size int64) {
+	c.lruMu.Lock()
+	defer c.lruMu.Unlock()
+	if elem, ok := c.lruMap[address]; ok {
+		elem.Value.(*blockLocation).size = size
+	}
+}
+
+// isMissing reports whether address was recently found on no server.
+func (c *AggregateClient) isMissing(address string) bool {
+	c.missingMu.Lock()
+	defer c.missingMu.Unlock()
+	expiry, ok := c.missing[address]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(c.missing, address)
+		return false
+	}
+	return true
+}
+
+// markMissing remembers that address was found on no server. The cache holds
+// at most as many addresses as the LRU of block locations.
+func (c *AggregateClient) markMissing(address string) {
+	if c.missingTTL <= 0 {
+		return
+	}
+	now := time.Now()
+	c.missingMu.Lock()
+	defer c.missingMu.Unlock()
+	if c.maxBlocks > 0 && len(c.missing) >= c.maxBlocks {
+		for addr, expiry := range c.missing {
+			if now.After(expiry) {
+				delete(c.missing, addr)
+			}
+		}
+		// Still full of live entries: drop an arbitrary one
+		for addr := range c.missing {
+			if len(c.missing) < c.maxBlocks {
+				break
+			}
+			delete(c.missing, addr)
+		}
+	}
+	c.missing[address] = now.Add(c.missingTTL)
+}
+
+// clearMissing forgets that address was missing, once it was written.
+func (c *AggregateClient) clearMissing(address string) {
+	c.missingMu.Lock()
+	defer c.missingMu.Unlock()
+	delete(c.missing, address)
+}
+
 // getServersForBlock returns the know servers for a given block from LRU.
 func (c *AggregateClient) getServersForBlock(address string) []string {
 	c.lruMu.Lock()
@@ -211,80 +484,197 @@ func (c *AggregateClient) getServersForBlock(address string) []string {
 	return nil
 }
 
-// readOperation maps over LRU, then finder, then live servers (as fallback).
+// readOperation maps over LRU, then finder, then live servers (as fallback),
+// trying the servers of each in an order weighted by their health.
 // We don't remove servers on false here, because the transport onError does it on connection issues.
+// A block found nowhere is remembered as missing for a short time, so
+// repeated lookups of it do not reach the servers.
 func (c *AggregateClient) readOperation(ctx context.Context, address string,
 	doOp func(client Storage) (any, bool)) (any, bool) {
+	val, _, ok := c.readExpected(ctx, address, doOp)
+	return val, ok
+}
 
-	// 1. Check LRU
-	cachedServerIDs := c.getServersForBlock(address)
-	for _, id := range cachedServerIDs {
-		c.liveMu.RLock()
-		client, ok := c.liveServers[id]
-		c.liveMu.RUnlock()
+// readExpected is readOperation that also returns the servers expected to
+// have the block, by the LRU or the finder, that answered without it.
+func (c *AggregateClient) readExpected(ctx context.Context, address string,
+	doOp func(client Storage) (any, bool)) (any, []string, bool) {
+	if c.isMissing(address) {
+		c.counters.missingHits.Add(1)
+		return nil, nil, false
+	}
 
-		if ok {
-			val, okOp := doOp(client)
-			if okOp {
-				c.markBlockUsed(address, []string{id})
-				return val, true
-			}
-		}
+	// 1. Check LRU
+	id, val, missed, ok := c.tryServers(c.getServersForBlock(address), doOp)
+	if ok {
+		c.counters.cacheHits.Add(1)
+		c.markBlockUsed(address, []string{id})
+		return val, missed, true
 	}
 
 	// 2. Try Finder (naturally cuts out 404 cache misses across invariant print directory scans)
 	if c.finder != nil {
-		responses, err := c.finder.Find(ctx, address)
+		c.counters.finderFallbacks.Add(1)
+		responses, err := c.find(ctx, address)
 		if err == nil {
-			var successfulIDs []string
-			var finalVal any
-			var success bool
-
+			var caches, ids []string
 			for _, resp := range responses {
-				if resp.Protocol != "storage-v1" {
-					continue
-				}
-				client := c.addLiveServer(resp.ID)
-				if client != nil && !success {
-					val, okOp := doOp(client)
-					if okOp {
-						successfulIDs = append(successfulIDs, resp.ID)
-						finalVal = val
-						success = true
+				switch resp.Protocol {
+				case finder.CacheProtocol:
+					if c.ignoreCaches {
+						continue
+					}
+					if client := c.addCache(resp.ID); client != nil {
+						caches = append(caches, resp.ID)
+					}
+				case finder.StorageProtocol:
+					if client := c.addLiveServer(resp.ID); client != nil {
+						ids = append(ids, resp.ID)
 					}
 				}
 			}
-			if success {
-				c.markBlockUsed(address, successfulIDs)
-				return finalVal, true
+			// Caches are preferred but may have evicted the block, so they
+			// are not repaired when they miss it
+			if id, val, _, ok := c.tryServers(caches, doOp); ok {
+				c.markBlockUsed(address, []string{id})
+				return val, missed, true
+			}
+			id, val, finderMissed, ok := c.tryServers(ids, doOp)
+			missed = append(missed, finderMissed...)
+			if ok {
+				c.markBlockUsed(address, []string{id})
+				return val, missed, true
 			}
 		}
 	}
 
 	// 3. Try all live services as a fallback
+	c.counters.liveFallbacks.Add(1)
+	if c.discoverOnMiss && c.discovery != nil {
+		if services, err := c.discovery.Find(ctx, "storage-v1", 0); err == nil {
+			for _, svc := range services {
+				c.addLiveServer(svc.ID)
+			}
+		}
+	}
 	c.liveMu.RLock()
 	liveIDsCopy := append([]string(nil), c.liveIDs...)
 	c.liveMu.RUnlock()
 
-	for _, id := range liveIDsCopy {
-		c.liveMu.RLock()
-		client, ok := c.liveServers[id]
-		c.liveMu.RUnlock()
+	if id, val, _, ok := c.tryServers(liveIDsCopy, doOp); ok {
+		c.markBlockUsed(address, []string{id})
+		return val, missed, true
+	}
 
-		if ok {
-			val, okOp := doOp(client)
-			if okOp {
-				c.markBlockUsed(address, []string{id})
-				return val, true
-			}
+	c.markMissing(address)
+	return nil, nil, false
+}
+
+// find asks the finder for the caches and storage servers that have address,
+// the caches first, when the finder knows the protocols of the servers.
+func (c *AggregateClient) find(ctx context.Context, address string) ([]finder.FindResponse, error) {
+	if pf, ok := c.finder.(finder.ProtocolFinder); ok {
+		protocols := []string{finder.CacheProtocol, finder.StorageProtocol}
+		if c.ignoreCaches {
+			protocols = protocols[1:]
 		}
+		return pf.FindProtocols(ctx, address, protocols)
 	}
+	return c.finder.Find(ctx, address)
+}
 
-	return nil, false
+// tryServers runs doOp on the live servers of ids, in an order weighted by
+// their health, until it succeeds on one, whose ID it returns with the IDs
+// of the servers that failed before it. With hedging, the next server is
+// also tried when a server has not answered within the hedge delay, and the
+// first success wins.
+func (c *AggregateClient) tryServers(ids []string, doOp func(client Storage) (any, bool)) (string, any, []string, bool) {
+	type attempt struct {
+		id     string
+		client Storage
+	}
+	var attempts []attempt
+	c.liveMu.RLock()
+	for _, id := range c.health.rank(ids) {
+		if client, ok := c.liveServers[id]; ok {
+			attempts = append(attempts, attempt{id, client})
+		} else if client, ok := c.caches[id]; ok {
+			attempts = append(attempts, attempt{id, client})
+		}
+	}
+	c.liveMu.RUnlock()
+
+	var missed []string
+	if c.hedge <= 0 || len(attempts) <= 1 {
+		for _, a := range attempts {
+			if val, ok := doOp(a.client); ok {
+				return a.id, val, missed, true
+			}
+			missed = append(missed, a.id)
+		}
+		return "", nil, missed, false
+	}
+
+	type result struct {
+		id  string
+		val any
+		ok  bool
+	}
+	results := make(chan result, len(attempts))
+	next, pending := 0, 0
+	start := func() {
+		a := attempts[next]
+		next++
+		pending++
+		go func() {
+			val, ok := doOp(a.client)
+			results <- result{a.id, val, ok}
+		}()
+	}
+	start()
+	timer := time.NewTimer(c.hedge)
+	defer timer.Stop()
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.ok {
+				// Release the answers of the servers still pending
+				go func(pending int) {
+					for range pending {
+						if late := <-results; late.ok {
+							if closer, ok := late.val.(io.Closer); ok {
+								closer.Close()
+							}
+						}
+					}
+				}(pending)
+				return r.id, r.val, missed, true
+			}
+			missed = append(missed, r.id)
+			if next < len(attempts) {
+				start()
+				timer.Reset(c.hedge)
+			}
+		case <-timer.C:
+			if next < len(attempts) {
+				c.counters.hedged.Add(1)
+				start()
+				timer.Reset(c.hedge)
+			}
+		}
+	}
+	return "", nil, missed, false
 }
 
-// Has checks if any storage service contains the given address.
+// Has checks if any storage service contains the given address. A block
+// recently read from a live server is known to be there without asking again.
 func (c *AggregateClient) Has(ctx context.Context, address string) bool {
+	c.counters.reads.Add(1)
+	if _, ok := c.knownBlock(address); ok {
+		c.counters.cacheHits.Add(1)
+		return true
+	}
 	res, ok := c.readOperation(ctx, address, func(client Storage) (any, bool) {
 		success := client.Has(ctx, address)
 		if success {
@@ -299,8 +689,11 @@ func (c *AggregateClient) Has(ctx context.Context, address string) bool {
 }
 
 // Get checks if any storage service contains the given address and returns it.
+// With ReadRepair, a block missing from servers expected to have it is read
+// into memory and written back to them.
 func (c *AggregateClient) Get(ctx context.Context, address string) (io.ReadCloser, bool) {
-	res, ok := c.readOperation(ctx, address, func(client Storage) (any, bool) {
+	c.counters.reads.Add(1)
+	res, missed, ok := c.readExpected(ctx, address, func(client Storage) (any, bool) {
 		rc, success := client.Get(ctx, address)
 		if success {
 			return rc, true
@@ -310,11 +703,65 @@ func (c *AggregateClient) Get(ctx context.Context, address string) (io.ReadClose
 	if res == nil {
 		return nil, false
 	}
-	return res.(io.ReadCloser), ok
+	rc := res.(io.ReadCloser)
+	if !c.readRepair || len(missed) == 0 {
+		return rc, ok
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, false
+	}
+	c.repair(address, data, missed)
+	return io.NopCloser(bytes.NewReader(data)), true
+}
+
+// repair writes data, the block at address, in the background to the live
+// servers of missed. Blocks that do not match their address are not spread.
+func (c *AggregateClient) repair(address string, data []byte, missed []string) {
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != address {
+		return
+	}
+	select {
+	case c.repairSlots <- struct{}{}:
+	default:
+		return
+	}
+	c.repairs.Add(1)
+	go func() {
+		defer func() {
+			<-c.repairSlots
+			c.repairs.Done()
+		}()
+		ctx := WithPriority(context.Background(), PriorityBackground)
+		var repaired []string
+		for _, id := range missed {
+			c.liveMu.RLock()
+			client, ok := c.liveServers[id]
+			c.liveMu.RUnlock()
+			if !ok {
+				continue
+			}
+			if ok, err := client.StoreAt(ctx, address, bytes.NewReader(data)); err == nil && ok {
+				repaired = append(repaired, id)
+			}
+		}
+		if len(repaired) > 0 {
+			c.counters.repaired.Add(1)
+			c.markBlockUsed(address, repaired)
+		}
+	}()
 }
 
 // Size checks if any storage service contains the given address and returns its size.
+// The size of a block is remembered with its location.
 func (c *AggregateClient) Size(ctx context.Context, address string) (int64, bool) {
+	c.counters.reads.Add(1)
+	if size, ok := c.knownBlock(address); ok && size >= 0 {
+		c.counters.cacheHits.Add(1)
+		return size, true
+	}
 	res, ok := c.readOperation(ctx, address, func(client Storage) (any, bool) {
 		size, success := client.Size(ctx, address)
 		if success {
@@ -325,6 +772,7 @@ func (c *AggregateClient) Size(ctx context.Context, address string) (int64, bool
 	if res == nil {
 		return 0, false
 	}
+	c.setBlockSize(address, res.(int64))
 	return res.(int64), ok
 }
 
@@ -366,24 +814,23 @@ func (c *AggregateClient) ensureLiveServers() error {
 	return nil
 }
 
-// writeOperation selects a set of live servers and executes a write operation.
+// writeOperation tries the live servers, in an order weighted by their
+// health, until Replicas of them executed a write operation, returning the
+// result of the first.
 func (c *AggregateClient) writeOperation(ctx context.Context, doOp func(client Storage) (any, error)) (any, error) {
 	err := c.ensureLiveServers()
 	if err != nil {
 		return nil, err
 	}
+	c.counters.writes.Add(1)
 
 	c.liveMu.RLock()
 	ids := append([]string(nil), c.liveIDs...)
 	c.liveMu.RUnlock()
 
-	// Round robin through them until one succeeds
-	startIdx := atomic.AddUint64(&c.liveCounter, 1)
-
-	for i := range ids {
-		idx := (startIdx + uint64(i)) % uint64(len(ids))
-		id := ids[idx]
-
+	var first any
+	written := 0
+	for _, id := range c.health.rank(ids) {
 		c.liveMu.RLock()
 		client, ok := c.liveServers[id]
 		c.liveMu.RUnlock()
@@ -394,7 +841,13 @@ func (c *AggregateClient) writeOperation(ctx context.Context, doOp func(client S
 				c.writtenMu.Lock()
 				c.writtenServers[id] = struct{}{}
 				c.writtenMu.Unlock()
-				return res, nil
+				if written == 0 {
+					first = res
+				}
+				written++
+				if written == c.replicas {
+					return first, nil
+				}
 			} else {
 				// Immediate removal on write error since we know it's a real failure.
 				// (The client interface for Store/StoreAt returns explicitly returned errors)
@@ -403,29 +856,55 @@ func (c *AggregateClient) writeOperation(ctx context.Context, doOp func(client S
 		}
 	}
 
+	if written > 0 {
+		c.counters.underReplicated.Add(1)
+		return first, nil
+	}
 	return nil, fmt.Errorf("all attempted write operations failed")
 }
 
-// Store saves data and returns its content-based address to one round-robined live server.
+// replayable returns a function returning the data of r for each write of
+// it. A block written to more than one server is read into memory first.
+func (c *AggregateClient) replayable(r io.Reader) (func() io.Reader, error) {
+	if c.replicas <= 1 {
+		return func() io.Reader { return r }, nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return func() io.Reader { return bytes.NewReader(data) }, nil
+}
+
+// Store saves data and returns its content-based address to Replicas live servers.
 func (c *AggregateClient) Store(ctx context.Context, r io.Reader) (string, error) {
 	// Need to handle streaming readers by keeping them readable?
 	// If the first write fails partway, the reader is consumed!
 	// Typically, we only retry if it fails *before* writing or we copy it.
 	// But `io.Reader` can't be rewound generically.
 	// We'll just try to execute the operation. If it fails, the reader might be consumed.
+	data, err := c.replayable(r)
+	if err != nil {
+		return "", err
+	}
 	res, err := c.writeOperation(ctx, func(client Storage) (any, error) {
-		return client.Store(ctx, r)
+		return client.Store(ctx, data())
 	})
 	if err != nil {
 		return "", err
 	}
+	c.clearMissing(res.(string))
 	return res.(string), nil
 }
 
-// StoreAt saves data at the specified address using round-robined live servers.
+// StoreAt saves data at the specified address on Replicas live servers.
 func (c *AggregateClient) StoreAt(ctx context.Context, address string, r io.Reader) (bool, error) {
+	data, err := c.replayable(r)
+	if err != nil {
+		return false, err
+	}
 	res, err := c.writeOperation(ctx, func(client Storage) (any, error) {
-		return client.StoreAt(ctx, address, r)
+		return client.StoreAt(ctx, address, data())
 	})
 	if err != nil {
 		return false, err
@@ -435,6 +914,7 @@ func (c *AggregateClient) StoreAt(ctx context.Context, address string, r io.Read
 		// Update LRU we successfully wrote it, but to WHICH server?
 		// We'd have to rewrite `writeOperation` to return the successful server ID to mark it.
 		// Let's not prematurely optimize. This behaves correctly by ensuring the next Read works.
+		c.clearMissing(address)
 	}
 	return success, nil
 }
@@ -472,3 +952,4 @@ func (c *AggregateClient) Sync(ctx context.Context) error {
 // Assert that AggregateClient implements the Storage interface
 var _ Storage = (*AggregateClient)(nil)
 var _ SyncStorage = (*AggregateClient)(nil)
+var _ StatsReporter = (*AggregateClient)(nil)
@@ -3,9 +3,13 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -32,9 +36,9 @@ func TestAggregateClient_StoreAndRead(t *testing.T) {
 	d.Register(context.Background(), discovery.ServiceRegistration{ID: "node1", Address: ts1.URL, Protocols: []string{"storage-v1"}})
 	d.Register(context.Background(), discovery.ServiceRegistration{ID: "node2", Address: ts2.URL, Protocols: []string{"storage-v1"}})
 
-	c := NewAggregateClient(nil, d, 2, 10)
+	c := NewAggregateClient(nil, d, AggregateConfig{StoreServers: 2, MaxBlocks: 10})
 
-	// Write operation (round-robin)
+	// Write operation (weighted by health)
 	content := []byte("hello cluster")
 	addr, err := c.Store(context.Background(), bytes.NewReader(content))
 	if err != nil {
@@ -44,7 +48,7 @@ func TestAggregateClient_StoreAndRead(t *testing.T) {
 		t.Fatalf("expected non-empty address")
 	}
 
-	// Because of round robin we don't know which got it, but one did.
+	// The choice of server is random, so we don't know which got it, but one did.
 	// Since readOperation will check live servers (which now has node1 & node2 populated by ensureLiveServers),
 	// read should succeed!
 	has := c.Has(context.Background(), addr)
@@ -74,7 +78,7 @@ func TestAggregateClient_LiveServerFailure(t *testing.T) {
 
 	d.Register(context.Background(), discovery.ServiceRegistration{ID: "node1", Address: ts1.URL, Protocols: []string{"storage-v1"}})
 
-	c := NewAggregateClient(nil, d, 2, 10)
+	c := NewAggregateClient(nil, d, AggregateConfig{StoreServers: 2, MaxBlocks: 10})
 
 	content := []byte("hello failover")
 	addr, err := c.Store(context.Background(), bytes.NewReader(content))
@@ -140,7 +144,7 @@ func TestAggregateClient_FinderFallback(t *testing.T) {
 	// Finder knows about it
 	f.Notify(context.Background(), "node-remote", []string{addr})
 
-	c := NewAggregateClient(f, d, 2, 10)
+	c := NewAggregateClient(f, d, AggregateConfig{StoreServers: 2, MaxBlocks: 10})
 
 	// Read should consult finder, then discovery to resolve it, then fetch it!
 	has := c.Has(context.Background(), addr)
@@ -164,8 +168,55 @@ func TestAggregateClient_FinderFallback(t *testing.T) {
 	}
 }
 
+func TestAggregateClient_PrefersCaches(t *testing.T) {
+	ctx := context.Background()
+	d := discovery.NewInMemoryDiscovery()
+	f, err := finder.NewMemoryFinder("0000000000000000000000000000000000000000000000000000000000000000")
+	if err != nil {
+		t.Fatalf("failed to create memory finder: %v", err)
+	}
+
+	storageTS, storageStore := setupTestServer()
+	defer storageTS.Close()
+	cacheStore := NewInMemoryStorage()
+	var cacheReads atomic.Int64
+	cacheServer := NewStorageServer(cacheStore).Handler()
+	cacheTS := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cacheReads.Add(1)
+		cacheServer.ServeHTTP(w, r)
+	}))
+	defer cacheTS.Close()
+
+	d.Register(ctx, discovery.ServiceRegistration{ID: "node-storage", Address: storageTS.URL, Protocols: []string{"storage-v1"}})
+	d.Register(ctx, discovery.ServiceRegistration{ID: "node-cache", Address: cacheTS.URL, Protocols: []string{"cache-v1"}})
+
+	addr, _ := storageStore.Store(ctx, bytes.NewReader([]byte("cached block")))
+	cacheStore.StoreAt(ctx, addr, bytes.NewReader([]byte("cached block")))
+	f.Notify(ctx, "node-storage", []string{addr})
+	f.NotifyProtocol(ctx, "node-cache", finder.CacheProtocol, []string{addr})
+
+	c := NewAggregateClient(f, d, AggregateConfig{StoreServers: 2, MaxBlocks: 10})
+	rc, ok := c.Get(ctx, addr)
+	if !ok {
+		t.Fatalf("expected the block to be found")
+	}
+	rc.Close()
+	if cacheReads.Load() != 1 {
+		t.Errorf("expected the block to be read from the cache, got %d cache requests", cacheReads.Load())
+	}
+
+	// Writes only go to storage servers
+	written, err := c.Store(ctx, bytes.NewReader([]byte("new block")))
+	if err != nil {
+		t.Fatalf("Store error: %v", err)
+	}
+	if cacheStore.Has(ctx, written) || !storageStore.Has(ctx, written) {
+		t.Errorf("expected the block to be written to the storage server only")
+	}
+}
+
 func TestAggregateClient_LRUEviction(t *testing.T) {
-	c := NewAggregateClient(nil, nil, 0, 2)
+	c := NewAggregateClient(nil, nil, AggregateConfig{MaxBlocks: 2})
 
 	c.markBlockUsed("addr1", []string{"node1"})
 	c.markBlockUsed("addr2", []string{"node2"})
@@ -198,7 +249,7 @@ func TestAggregateClient_BadTransportHandling(t *testing.T) {
 	d := discovery.NewInMemoryDiscovery()
 	d.Register(context.Background(), discovery.ServiceRegistration{ID: "bad-node", Address: ts.URL, Protocols: []string{"storage-v1"}})
 
-	c := NewAggregateClient(nil, d, 1, 10)
+	c := NewAggregateClient(nil, d, AggregateConfig{StoreServers: 1, MaxBlocks: 10})
 
 	// Populate live list
 	c.Store(context.Background(), bytes.NewReader([]byte("stuff"))) // will fail, removing node immediately!
@@ -223,7 +274,7 @@ func (m *mockSyncStorage) Sync(ctx context.Context) error {
 }
 
 func TestAggregateClient_Sync(t *testing.T) {
-	c := NewAggregateClient(nil, nil, 0, 10)
+	c := NewAggregateClient(nil, nil, AggregateConfig{MaxBlocks: 10})
 
 	mock := &mockSyncStorage{InMemoryStorage: NewInMemoryStorage()}
 
@@ -257,3 +308,323 @@ func TestAggregateClient_Sync(t *testing.T) {
 		t.Errorf("expected still 1 sync, got %d", mock.syncCount)
 	}
 }
+
+func TestAggregateClient_HealthWeighting(t *testing.T) {
+	d := discovery.NewInMemoryDiscovery()
+	var fastWrites, slowWrites atomic.Int32
+	fastHandler := NewStorageServer(NewInMemoryStorage()).Handler()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastWrites.Add(1)
+		fastHandler.ServeHTTP(w, r)
+	}))
+	defer fast.Close()
+	slowHandler := NewStorageServer(NewInMemoryStorage()).Handler()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowWrites.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		slowHandler.ServeHTTP(w, r)
+	}))
+	defer slow.Close()
+
+	d.Register(context.Background(), discovery.ServiceRegistration{ID: "fast", Address: fast.URL, Protocols: []string{"storage-v1"}})
+	d.Register(context.Background(), discovery.ServiceRegistration{ID: "slow", Address: slow.URL, Protocols: []string{"storage-v1"}})
+
+	c := NewAggregateClient(nil, d, AggregateConfig{StoreServers: 2, MaxBlocks: 10})
+	for i := range 60 {
+		if _, err := c.Store(context.Background(), bytes.NewReader([]byte{byte(i)})); err != nil {
+			t.Fatalf("Store error: %v", err)
+		}
+	}
+
+	if fastWrites.Load() <= slowWrites.Load() {
+		t.Errorf("expected the fast server to receive most writes, got fast %d, slow %d", fastWrites.Load(), slowWrites.Load())
+	}
+	health := c.Health()
+	if len(health) != 2 {
+		t.Fatalf("expected the health of 2 servers, got %+v", health)
+	}
+	scores := map[string]float64{}
+	for _, h := range health {
+		scores[h.ID] = h.Score
+	}
+	if scores["fast"] <= scores["slow"] {
+		t.Errorf("expected the fast server to score highest, got %+v", health)
+	}
+}
+
+func TestAggregateClient_UnhealthyServerDropped(t *testing.T) {
+	d := discovery.NewInMemoryDiscovery()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	d.Register(context.Background(), discovery.ServiceRegistration{ID: "failing", Address: failing.URL, Protocols: []string{"storage-v1"}})
+
+	c := NewAggregateClient(nil, d, AggregateConfig{StoreServers: 1, MaxBlocks: 10})
+	if err := c.ensureLiveServers(); err != nil {
+		t.Fatalf("ensureLiveServers error: %v", err)
+	}
+
+	// A single overloaded response only lowers the score of the server
+	c.Has(context.Background(), "missing")
+	if len(c.Health()) != 1 {
+		t.Fatalf("expected the server to stay live after one failure")
+	}
+	for range 10 {
+		c.Has(context.Background(), "missing")
+	}
+	if health := c.Health(); len(health) != 0 {
+		t.Errorf("expected the failing server to be dropped, got %+v", health)
+	}
+}
+
+func TestAggregateClient_DiscoverOnMiss(t *testing.T) {
+	d := discovery.NewInMemoryDiscovery()
+	f, err := finder.NewMemoryFinder("0000000000000000000000000000000000000000000000000000000000000000")
+	if err != nil {
+		t.Fatalf("failed to create memory finder: %v", err)
+	}
+
+	// The block is on a server the finder has not been told about
+	ts1, store1 := setupTestServer()
+	defer ts1.Close()
+	d.Register(context.Background(), discovery.ServiceRegistration{ID: "node1", Address: ts1.URL, Protocols: []string{"storage-v1"}})
+	addr, _ := store1.Store(context.Background(), bytes.NewReader([]byte("unannounced block")))
+
+	c := NewAggregateClient(f, d, AggregateConfig{MaxBlocks: 10})
+	if c.Has(context.Background(), addr) {
+		t.Fatalf("expected the block to be missed without DiscoverOnMiss")
+	}
+
+	c = NewAggregateClient(f, d, AggregateConfig{MaxBlocks: 10, DiscoverOnMiss: true})
+	if !c.Has(context.Background(), addr) {
+		t.Fatalf("expected the block to be found on the servers in discovery")
+	}
+}
+
+func TestAggregateClient_MissingCache(t *testing.T) {
+	d := discovery.NewInMemoryDiscovery()
+	var requests atomic.Int32
+	handler := NewStorageServer(NewInMemoryStorage()).Handler()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	d.Register(context.Background(), discovery.ServiceRegistration{ID: "node1", Address: ts.URL, Protocols: []string{"storage-v1"}})
+
+	c := NewAggregateClient(nil, d, AggregateConfig{StoreServers: 1, MaxBlocks: 10, MissingTTL: 50 * time.Millisecond})
+	if err := c.ensureLiveServers(); err != nil {
+		t.Fatalf("ensureLiveServers error: %v", err)
+	}
+
+	content := []byte("late block")
+	hash := sha256.Sum256(content)
+	addr := hex.EncodeToString(hash[:])
+	for range 5 {
+		if c.Has(context.Background(), addr) {
+			t.Fatalf("expected %s to be missing", addr)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected repeated lookups of a missing block to be cached, got %d requests", n)
+	}
+
+	// Writing the block through the client clears the cache
+	if ok, err := c.StoreAt(context.Background(), addr, bytes.NewReader(content)); err != nil || !ok {
+		t.Fatalf("StoreAt failed: %v, %v", ok, err)
+	}
+	if !c.Has(context.Background(), addr) {
+		t.Errorf("expected a written block to be found")
+	}
+
+	// Entries expire after the ttl
+	hash = sha256.Sum256([]byte("other"))
+	other := hex.EncodeToString(hash[:])
+	c.Has(context.Background(), other)
+	before := requests.Load()
+	time.Sleep(60 * time.Millisecond)
+	c.Has(context.Background(), other)
+	if requests.Load() == before {
+		t.Errorf("expected the missing entry to expire")
+	}
+}
+
+func TestAggregateClient_MetadataCache(t *testing.T) {
+	d := discovery.NewInMemoryDiscovery()
+	var heads atomic.Int32
+	store := NewInMemoryStorage()
+	handler := NewStorageServer(store).Handler()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	d.Register(context.Background(), discovery.ServiceRegistration{ID: "node1", Address: ts.URL, Protocols: []string{"storage-v1"}})
+
+	content := []byte("immutable block")
+	addr, _ := store.Store(context.Background(), bytes.NewReader(content))
+
+	c := NewAggregateClient(nil, d, AggregateConfig{StoreServers: 1, MaxBlocks: 10})
+	if err := c.ensureLiveServers(); err != nil {
+		t.Fatalf("ensureLiveServers error: %v", err)
+	}
+	for range 3 {
+		if size, ok := c.Size(context.Background(), addr); !ok || size != int64(len(content)) {
+			t.Fatalf("expected size %d, got %d, %v", len(content), size, ok)
+		}
+		if !c.Has(context.Background(), addr) {
+			t.Fatalf("expected to have block %s", addr)
+		}
+	}
+	if n := heads.Load(); n != 1 {
+		t.Errorf("expected one HEAD request, got %d", n)
+	}
+
+	// Once the server holding the block is gone, the answer is not trusted
+	c.removeLiveServer("node1")
+	if _, ok := c.knownBlock(addr); ok {
+		t.Errorf("expected the block to be unknown without a live server")
+	}
+}
+
+func TestAggregateClient_Replicas(t *testing.T) {
+	d := discovery.NewInMemoryDiscovery()
+	var stores []Storage
+	for _, id := range []string{"node1", "node2", "node3"} {
+		ts, store := setupTestServer()
+		defer ts.Close()
+		stores = append(stores, store)
+		d.Register(context.Background(), discovery.ServiceRegistration{ID: id, Address: ts.URL, Protocols: []string{"storage-v1"}})
+	}
+
+	c := NewAggregateClient(nil, d, AggregateConfig{StoreServers: 3, MaxBlocks: 10, Replicas: 2})
+	addr, err := c.Store(context.Background(), bytes.NewReader([]byte("replicated")))
+	if err != nil {
+		t.Fatalf("Store error: %v", err)
+	}
+	copies := 0
+	for _, store := range stores {
+		if store.Has(context.Background(), addr) {
+			copies++
+		}
+	}
+	if copies != 2 {
+		t.Errorf("expected the block on 2 servers, got %d", copies)
+	}
+	if stats := c.Stats(); stats.Writes != 1 || stats.UnderReplicated != 0 {
+		t.Errorf("unexpected write stats %+v", stats)
+	}
+}
+
+func TestAggregateClient_HedgeAndStats(t *testing.T) {
+	d := discovery.NewInMemoryDiscovery()
+	content := []byte("hedged block")
+	var addr string
+	for _, delay := range []time.Duration{0, 500 * time.Millisecond} {
+		store := NewInMemoryStorage()
+		addr, _ = store.Store(context.Background(), bytes.NewReader(content))
+		handler := NewStorageServer(store).Handler()
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+			handler.ServeHTTP(w, r)
+		}))
+		defer ts.Close()
+		d.Register(context.Background(), discovery.ServiceRegistration{ID: fmt.Sprintf("node-%v", delay), Address: ts.URL, Protocols: []string{"storage-v1"}})
+	}
+
+	c := NewAggregateClient(nil, d, AggregateConfig{StoreServers: 2, MaxBlocks: 10, Hedge: 20 * time.Millisecond})
+	if err := c.ensureLiveServers(); err != nil {
+		t.Fatalf("ensureLiveServers error: %v", err)
+	}
+	// Whichever server is tried first, the fast one answers well before the slow one
+	for range 5 {
+		start := time.Now()
+		rc, ok := c.Get(context.Background(), addr)
+		if !ok {
+			t.Fatalf("expected GET to succeed")
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(data) != string(content) {
+			t.Errorf("expected content %s, got %s", content, data)
+		}
+		if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+			t.Errorf("expected the hedged read to be answered by the fast server, took %v", elapsed)
+		}
+	}
+	c.Has(context.Background(), addr)
+
+	stats := c.Stats()
+	if stats.Reads != 6 || stats.LiveFallbacks != 1 || stats.CacheHits != 5 {
+		t.Errorf("unexpected read stats %+v", stats)
+	}
+	if stats.HitRate <= 0.8 {
+		t.Errorf("expected a hit rate above 0.8, got %v", stats.HitRate)
+	}
+	if len(stats.Servers) != 2 {
+		t.Errorf("expected the health of 2 servers, got %+v", stats.Servers)
+	}
+}
+
+func TestAggregateClient_ReadRepair(t *testing.T) {
+	ctx := context.Background()
+	d := discovery.NewInMemoryDiscovery()
+	f, err := finder.NewMemoryFinder("0000000000000000000000000000000000000000000000000000000000000000")
+	if err != nil {
+		t.Fatalf("failed to create memory finder: %v", err)
+	}
+	var stores []Storage
+	for _, id := range []string{"node1", "node2"} {
+		ts, store := setupTestServer()
+		defer ts.Close()
+		stores = append(stores, store)
+		d.Register(ctx, discovery.ServiceRegistration{ID: id, Address: ts.URL, Protocols: []string{"storage-v1"}})
+	}
+
+	// The finder expects both servers to have the block, but node1 lost it
+	addr, _ := stores[1].Store(ctx, bytes.NewReader([]byte("healing block")))
+	f.Notify(ctx, "node1", []string{addr})
+	f.Notify(ctx, "node2", []string{addr})
+
+	// The servers are tried in a random order, so read with new clients
+	// until node1 is tried first and misses the block
+	var c *AggregateClient
+	for range 64 {
+		c = NewAggregateClient(f, d, AggregateConfig{StoreServers: 2, MaxBlocks: 10, ReadRepair: true})
+		rc, ok := c.Get(ctx, addr)
+		if !ok {
+			t.Fatalf("expected GET to succeed")
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(data) != "healing block" {
+			t.Fatalf("unexpected content %q", data)
+		}
+		c.repairs.Wait()
+		if stores[0].Has(ctx, addr) {
+			break
+		}
+	}
+	if !stores[0].Has(ctx, addr) {
+		t.Fatalf("expected the block to be written back to node1")
+	}
+	if stats := c.Stats(); stats.Repaired != 1 {
+		t.Errorf("expected 1 repair, got %d", stats.Repaired)
+	}
+
+	// Without read repair nothing is written back
+	lost, _ := stores[1].Store(ctx, bytes.NewReader([]byte("lost block")))
+	f.Notify(ctx, "node1", []string{lost})
+	for range 8 {
+		plain := NewAggregateClient(f, d, AggregateConfig{StoreServers: 2, MaxBlocks: 10})
+		if rc, ok := plain.Get(ctx, lost); ok {
+			rc.Close()
+		}
+	}
+	if stores[0].Has(ctx, lost) {
+		t.Errorf("expected no repair without ReadRepair")
+	}
+}
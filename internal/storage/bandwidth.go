@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"invariant/internal/cap"
+)
+
+// peerIdleTTL is how long the accounting of a peer without requests is kept.
+// Peers are keyed by address, so without expiry a server reached from many
+// addresses would keep an entry for each of them.
+const peerIdleTTL = 10 * time.Minute
+
+// PeerStats counts the bytes exchanged with a peer of a storage server.
+type PeerStats struct {
+	Peer          string `json:"peer"`
+	Requests      int64  `json:"requests"`
+	BytesServed   int64  `json:"bytesServed"`
+	BytesReceived int64  `json:"bytesReceived"`
+}
+
+// BandwidthStats is the response of GET /stats.
+type BandwidthStats struct {
+	BytesServed   int64       `json:"bytesServed"`
+	BytesReceived int64       `json:"bytesReceived"`
+	Peers         []PeerStats `json:"peers"`
+}
+
+// bandwidth accounts for the bytes exchanged with each peer and, if a limit
+// is set, throttles each peer to it.
+type bandwidth struct {
+	mu    sync.Mutex
+	limit int64 // bytes per second per peer, 0 for unlimited
+	peers map[string]*peerBandwidth
+
+	// The totals include the peers evicted since
+	served    int64
+	received  int64
+	lastEvict time.Time
+}
+
+type peerBandwidth struct {
+	stats  PeerStats
+	bucket *tokenBucket
+	active int       // requests being served
+	last   time.Time // when the last request ended
+}
+
+func newBandwidth(limit int64) *bandwidth {
+	return &bandwidth{limit: limit, peers: make(map[string]*peerBandwidth), lastEvict: time.Now()}
+}
+
+// peerOf identifies the peer making r: by the ID of its capability token if
+// the request was authenticated, as a token cannot be forged, or else by its
+// IP address.
+func peerOf(r *http.Request) string {
+	if id, ok := cap.TokenID(r.Context()); ok {
+		return "token:" + id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// begin returns the accounting of the peer name for a new request, which must
+// be ended with end.
+func (b *bandwidth) begin(name string) *peerBandwidth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if now.Sub(b.lastEvict) >= peerIdleTTL {
+		b.evictLocked(now)
+	}
+	p, ok := b.peers[name]
+	if !ok {
+		p = &peerBandwidth{stats: PeerStats{Peer: name}}
+		if b.limit > 0 {
+			p.bucket = newTokenBucket(b.limit)
+		}
+		b.peers[name] = p
+	}
+	p.stats.Requests++
+	p.active++
+	return p
+}
+
+func (b *bandwidth) end(p *peerBandwidth) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p.active--
+	p.last = time.Now()
+}
+
+// evictLocked drops the peers without a request since peerIdleTTL before now.
+func (b *bandwidth) evictLocked(now time.Time) {
+	b.lastEvict = now
+	for name, p := range b.peers {
+		if p.active == 0 && now.Sub(p.last) >= peerIdleTTL {
+			delete(b.peers, name)
+		}
+	}
+}
+
+func (b *bandwidth) add(p *peerBandwidth, served, received int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p.stats.BytesServed += served
+	p.stats.BytesReceived += received
+	b.served += served
+	b.received += received
+}
+
+func (b *bandwidth) stats() BandwidthStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := BandwidthStats{
+		BytesServed:   b.served,
+		BytesReceived: b.received,
+		Peers:         make([]PeerStats, 0, len(b.peers)),
+	}
+	for _, p := range b.peers {
+		stats.Peers = append(stats.Peers, p.stats)
+	}
+	sort.Slice(stats.Peers, func(i, j int) bool { return stats.Peers[i].Peer < stats.Peers[j].Peer })
+	return stats
+}
+
+// wrap accounts for and throttles the request and response bodies of next.
+func (b *bandwidth) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := b.begin(peerOf(r))
+		defer b.end(p)
+		if r.Body != nil {
+			r.Body = &peerBody{ReadCloser: r.Body, ctx: r.Context(), b: b, p: p}
+		}
+		next.ServeHTTP(&peerResponseWriter{ResponseWriter: w, ctx: r.Context(), b: b, p: p}, r)
+	})
+}
+
+type peerBody struct {
+	io.ReadCloser
+	ctx context.Context
+	b   *bandwidth
+	p   *peerBandwidth
+}
+
+func (r *peerBody) Read(buf []byte) (int, error) {
+	if r.p.bucket != nil {
+		buf = buf[:min(len(buf), r.p.bucket.burst)]
+	}
+	n, err := r.ReadCloser.Read(buf)
+	r.b.add(r.p, 0, int64(n))
+	if r.p.bucket != nil && n > 0 {
+		if werr := r.p.bucket.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+type peerResponseWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+	b   *bandwidth
+	p   *peerBandwidth
+}
+
+func (w *peerResponseWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		chunk := data
+		if w.p.bucket != nil {
+			chunk = data[:min(len(data), w.p.bucket.burst)]
+			if err := w.p.bucket.wait(w.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		w.b.add(w.p, int64(n), 0)
+		if err != nil {
+			return written, err
+		}
+		data = data[n:]
+	}
+	return written, nil
+}
+
+func (w *peerResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *peerResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// tokenBucket allows rate bytes per second, in bursts of up to a second's
+// worth.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), burst: max(int(rate), 1), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n tokens, at most burst, sleeping until they are available.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, float64(b.burst))
+	b.last = now
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+	if deficit <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -1,8 +1,11 @@
 package storage
 
 import (
+	"bytes"
 	"container/list"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io"
 	"log"
@@ -22,6 +25,7 @@ type CachingStorage struct {
 	maxSize       int64
 	desiredSize   int64
 	delegateOnMax bool
+	verify        bool
 
 	mu          sync.Mutex
 	lruList     *list.List
@@ -36,8 +40,8 @@ type CachingStorage struct {
 	destHas   map[string]struct{}
 }
 
-// Assert that CachingStorage implements the Storage interface
-var _ Storage = (*CachingStorage)(nil)
+// Assert that CachingStorage implements the ControlledStorage interface
+var _ ControlledStorage = (*CachingStorage)(nil)
 
 func NewCachingStorage(local ControlledStorage, destination Storage, maxSize, desiredSize int64, delegateOnMax bool) *CachingStorage {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -71,6 +75,16 @@ func (s *CachingStorage) SetOverflow(overflow ControlledStorage) {
 	}
 }
 
+// SetVerify sets whether blocks read from local storage are checked against
+// their address. A cached block that does not hash to its address is removed
+// and fetched again from the overflow or destination, so a corrupt cache never
+// needs more than the block itself invalidated.
+func (s *CachingStorage) SetVerify(verify bool) {
+	s.mu.Lock()
+	s.verify = verify
+	s.mu.Unlock()
+}
+
 func (s *CachingStorage) init() {
 	// 1. Load existing blocks from local storage into LRU
 	for batch := range s.local.List(context.Background(), 1000) {
@@ -187,16 +201,20 @@ func (s *CachingStorage) Has(ctx context.Context, address string) bool {
 }
 
 func (s *CachingStorage) Get(ctx context.Context, address string) (io.ReadCloser, bool) {
+	s.mu.Lock()
+	overflow := s.overflow
+	verify := s.verify
+	s.mu.Unlock()
+
 	rc, ok := s.local.Get(ctx, address)
+	if ok && verify {
+		rc, ok = s.verifyLocal(ctx, address, rc)
+	}
 	if ok {
 		s.markUsed(address)
 		return rc, true
 	}
 
-	s.mu.Lock()
-	overflow := s.overflow
-	s.mu.Unlock()
-
 	fetchAndPromote := func(src Storage, saveDestHas bool) (io.ReadCloser, bool) {
 		rcSrc, okSrc := src.Get(ctx, address)
 		if okSrc {
@@ -249,6 +267,33 @@ func (s *CachingStorage) Get(ctx context.Context, address string) (io.ReadCloser
 	return nil, false
 }
 
+// verifyLocal reads the cached block rc, returning its content if it hashes
+// to address. Otherwise the block is dropped from the cache.
+func (s *CachingStorage) verifyLocal(ctx context.Context, address string, rc io.ReadCloser) (io.ReadCloser, bool) {
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	sum := sha256.Sum256(data)
+	if err == nil && hex.EncodeToString(sum[:]) == address {
+		return io.NopCloser(bytes.NewReader(data)), true
+	}
+
+	log.Printf("caching storage: dropping corrupt cached block %s", address)
+	size, hasSize := s.local.Size(ctx, address)
+	if _, err := s.local.Remove(ctx, address); err != nil {
+		log.Printf("caching storage: failed to remove corrupt block %s: %v", address, err)
+	}
+	s.mu.Lock()
+	if elem, ok := s.lruMap[address]; ok {
+		s.lruList.Remove(elem)
+		delete(s.lruMap, address)
+		if hasSize {
+			s.currentSize -= size
+		}
+	}
+	s.mu.Unlock()
+	return nil, false
+}
+
 func (s *CachingStorage) Size(ctx context.Context, address string) (int64, bool) {
 	size, ok := s.local.Size(ctx, address)
 	if ok {
@@ -549,6 +594,46 @@ func (s *CachingStorage) doEvict() {
 	}
 }
 
+// StoredAt returns when a block was stored in local storage, if it records
+// it.
+func (s *CachingStorage) StoredAt(ctx context.Context, address string) (time.Time, bool) {
+	if timed, ok := s.local.(TimedStorage); ok {
+		return timed.StoredAt(ctx, address)
+	}
+	return time.Time{}, false
+}
+
+// List lists the blocks held in local storage.
+func (s *CachingStorage) List(ctx context.Context, chunkSize int) <-chan []string {
+	return s.local.List(ctx, chunkSize)
+}
+
+// Subscribe reports the blocks added to local storage, including those
+// fetched from the overflow or destination as they are read.
+func (s *CachingStorage) Subscribe(ctx context.Context) <-chan string {
+	return s.local.Subscribe(ctx)
+}
+
+// Remove drops a block from local storage. Copies in the overflow or
+// destination are kept.
+func (s *CachingStorage) Remove(ctx context.Context, address string) (bool, error) {
+	size, hasSize := s.local.Size(ctx, address)
+	ok, err := s.local.Remove(ctx, address)
+	if err != nil || !ok {
+		return ok, err
+	}
+	s.mu.Lock()
+	if elem, found := s.lruMap[address]; found {
+		s.lruList.Remove(elem)
+		delete(s.lruMap, address)
+		if hasSize {
+			s.currentSize -= size
+		}
+	}
+	s.mu.Unlock()
+	return true, nil
+}
+
 // Sync ensures that all blocks in the local storage have been propagated to the destination.
 func (s *CachingStorage) Sync(ctx context.Context) error {
 	if s.destination == nil {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -148,6 +149,45 @@ func TestCachingStorageTeeGet(t *testing.T) {
 	}
 }
 
+func TestCachingStorageRemove(t *testing.T) {
+	ctx := context.Background()
+	local := NewInMemoryStorage()
+	remote := NewInMemoryStorage()
+	cs := NewCachingStorage(local, remote, 100, 50, false)
+	defer cs.Close()
+
+	data := []byte("read through")
+	addr, _ := remote.Store(ctx, bytes.NewReader(data))
+	rc, ok := cs.Get(ctx, addr)
+	if !ok {
+		t.Fatalf("Expected block to be retrievable from destination")
+	}
+	io.ReadAll(rc)
+	rc.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	var listed []string
+	for batch := range cs.List(ctx, 10) {
+		listed = append(listed, batch...)
+	}
+	if len(listed) != 1 || listed[0] != addr {
+		t.Errorf("Expected the read block to be listed, got %v", listed)
+	}
+
+	if ok, err := cs.Remove(ctx, addr); !ok || err != nil {
+		t.Fatalf("Remove failed: %v, %v", ok, err)
+	}
+	if local.Has(ctx, addr) || !remote.Has(ctx, addr) {
+		t.Errorf("Expected the block to be removed from the cache only")
+	}
+	cs.mu.Lock()
+	size := cs.currentSize
+	cs.mu.Unlock()
+	if size != 0 {
+		t.Errorf("Expected the cache to be empty, got size %d", size)
+	}
+}
+
 func TestCachingStorageDelegateOnMax(t *testing.T) {
 	local := NewInMemoryStorage()
 	remote := NewInMemoryStorage()
@@ -207,3 +247,46 @@ func TestCachingStorageSync(t *testing.T) {
 		t.Errorf("Sync failed to mark blocks as present in destHas")
 	}
 }
+
+func TestCachingStorageVerify(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	local := NewFileSystemStorage(dir)
+	remote := NewInMemoryStorage()
+	cs := NewCachingStorage(local, remote, 1000, 800, false)
+	defer cs.Close()
+	cs.SetVerify(true)
+
+	data := []byte("cached block")
+	addr, _ := remote.Store(ctx, bytes.NewReader(data))
+	if _, err := local.StoreAt(ctx, addr, bytes.NewReader(data)); err != nil {
+		t.Fatalf("StoreAt failed: %v", err)
+	}
+
+	// Corrupt the cached copy on disk
+	if err := os.WriteFile(local.addressToPath(addr), []byte("corrupt block"), 0644); err != nil {
+		t.Fatalf("Failed to corrupt block: %v", err)
+	}
+
+	rc, ok := cs.Get(ctx, addr)
+	if !ok {
+		t.Fatalf("Expected block to be fetched from destination")
+	}
+	readData, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(readData) != string(data) {
+		t.Fatalf("Get = %q, %v, want %q", readData, err, data)
+	}
+
+	// The block is cached again from the destination
+	time.Sleep(100 * time.Millisecond)
+	rc, ok = local.Get(ctx, addr)
+	if !ok {
+		t.Fatalf("Expected block to be cached again")
+	}
+	readData, _ = io.ReadAll(rc)
+	rc.Close()
+	if string(readData) != string(data) {
+		t.Errorf("cached block = %q, want %q", readData, data)
+	}
+}
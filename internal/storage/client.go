@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -9,26 +10,70 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
 // Client implements the Storage interface by forwarding requests to a remote HTTP server.
 type Client struct {
 	baseURL    string
 	httpClient *http.Client
+	compress   bool
+	// gzipUploads is set once the server advertises that it accepts gzip
+	// compressed uploads
+	gzipUploads atomic.Bool
 }
 
-// NewClient creates a new HTTP storage client.
+// NewClient creates a new HTTP storage client. Requests are sent with the
+// priority of their context, see WithPriority.
 func NewClient(baseURL string, httpClient *http.Client) *Client {
 	if httpClient == nil {
 		httpClient = http.DefaultClient
 	}
 	httpClient = httputil.NewDiagnosticClient(httpClient)
+	httpClient.Transport = &priorityTransport{transport: httpClient.Transport}
 	return &Client{
 		baseURL:    baseURL,
 		httpClient: httpClient,
+		compress:   true,
 	}
 }
 
+// WithCompression sets whether blocks are compressed in transit when the
+// server supports it, which is the default. Compression is negotiated per
+// request and only used for blocks whose start compresses well; disabling it
+// saves the sampling when all blocks are encrypted.
+func (c *Client) WithCompression(compress bool) *Client {
+	c.compress = compress
+	return c
+}
+
+// do sends req, noting whether the server accepts compressed uploads.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err == nil && acceptsGzip(resp.Header.Get("Accept-Encoding")) {
+		c.gzipUploads.Store(true)
+	}
+	return resp, err
+}
+
+// uploadBody sets the body of req to r, compressed if the server accepts it
+// and the block is worth compressing.
+func (c *Client) uploadBody(req *http.Request, r io.Reader) {
+	if !c.compress || !c.gzipUploads.Load() {
+		return
+	}
+	r, worthwhile := sampleBlock(r)
+	req.GetBody = nil
+	if !worthwhile {
+		req.Body = io.NopCloser(r)
+		return
+	}
+	req.Body = gzipReader(r)
+	req.ContentLength = -1
+	req.Header.Set("Content-Encoding", "gzip")
+}
+
 // Has checks if the storage contains the given address.
 func (c *Client) Has(ctx context.Context, address string) bool {
 	req, err := http.NewRequestWithContext(ctx, http.MethodHead, fmt.Sprintf("%s/%s", c.baseURL, address), nil)
@@ -36,7 +81,7 @@ func (c *Client) Has(ctx context.Context, address string) bool {
 		return false
 	}
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return false
 	}
@@ -51,8 +96,12 @@ func (c *Client) Get(ctx context.Context, address string) (io.ReadCloser, bool)
 	if err != nil {
 		return nil, false
 	}
+	if !c.compress {
+		// Setting the header also stops the transport asking for gzip
+		req.Header.Set("Accept-Encoding", "identity")
+	}
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil || resp.StatusCode != http.StatusOK {
 		if resp != nil {
 			resp.Body.Close()
@@ -60,6 +109,7 @@ func (c *Client) Get(ctx context.Context, address string) (io.ReadCloser, bool)
 		return nil, false
 	}
 
+	reportServer(ctx, c.baseURL)
 	return resp.Body, true
 }
 
@@ -69,8 +119,9 @@ func (c *Client) Store(ctx context.Context, r io.Reader) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	c.uploadBody(req, r)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return "", err
 	}
@@ -94,8 +145,11 @@ func (c *Client) StoreAt(ctx context.Context, address string, r io.Reader) (bool
 	if err != nil {
 		return false, err
 	}
+	c.uploadBody(req, r)
+	// Let the server reject the body when it already has the block
+	req.Header.Set("Expect", "100-continue")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return false, err
 	}
@@ -115,7 +169,7 @@ func (c *Client) Size(ctx context.Context, address string) (int64, bool) {
 		return 0, false
 	}
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil || resp.StatusCode != http.StatusOK {
 		if resp != nil {
 			resp.Body.Close()
@@ -154,7 +208,7 @@ func (c *Client) Fetch(ctx context.Context, address, container string, fallbackA
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 
 	if err == nil && resp.StatusCode == http.StatusOK {
 		resp.Body.Close()
@@ -187,6 +241,147 @@ func (c *Client) Fetch(ctx context.Context, address, container string, fallbackA
 	return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 }
 
+// FetchBatch instructs the remote server to fetch the blocks at addresses,
+// at most MaxFetchBatch of them, from another container in a single request.
+// It returns the addresses the server could not fetch.
+func (c *Client) FetchBatch(ctx context.Context, addresses []string, container string) ([]string, error) {
+	data, err := json.Marshal(StorageFetchRequest{Addresses: addresses, Container: container})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/fetch", c.baseURL), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var result StorageFetchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid fetch response: %w", err)
+	}
+	return result.Failed, nil
+}
+
+// FetchClosure instructs the remote server to fetch every block of the file
+// tree at root, a JSON content link, that it does not already have from
+// another container. The server walks the tree itself, so only the missing
+// blocks are transferred. ErrClosureNotSupported is returned if the server
+// cannot walk file trees.
+func (c *Client) FetchClosure(ctx context.Context, root json.RawMessage, container string) (StorageFetchResponse, error) {
+	data, err := json.Marshal(StorageFetchRequest{Root: root, Container: container})
+	if err != nil {
+		return StorageFetchResponse{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/fetch", c.baseURL), bytes.NewReader(data))
+	if err != nil {
+		return StorageFetchResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return StorageFetchResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotImplemented {
+		return StorageFetchResponse{}, ErrClosureNotSupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		return StorageFetchResponse{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var result StorageFetchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return StorageFetchResponse{}, fmt.Errorf("invalid fetch response: %w", err)
+	}
+	return result, nil
+}
+
+// Want adds addresses to the want list of the remote server, asking its peers
+// to push it those blocks.
+func (c *Client) Want(ctx context.Context, addresses []string) error {
+	data, err := json.Marshal(addresses)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/wants", c.baseURL), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Wants returns the want list of the remote server.
+func (c *Client) Wants(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/wants", c.baseURL), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var addresses []string
+	if err := json.NewDecoder(resp.Body).Decode(&addresses); err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+// Remove deletes the block at address from the remote storage, reporting
+// whether it was present.
+func (c *Client) Remove(ctx context.Context, address string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fmt.Sprintf("%s/%s", c.baseURL, address), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+}
+
 // List returns all addresses stored in the remote storage. Not currently supported via HTTP.
 func (c *Client) List(ctx context.Context, chunkSize int) <-chan []string {
 	ch := make(chan []string)
@@ -194,10 +389,52 @@ func (c *Client) List(ctx context.Context, chunkSize int) <-chan []string {
 	return ch
 }
 
-// Subscribe provides a channel for live updates. Not currently supported via HTTP.
+// Subscribe provides a channel for live updates by connecting to the server's
+// server-sent events stream. The channel is closed when the context is canceled
+// or the connection to the server is lost.
 func (c *Client) Subscribe(ctx context.Context) <-chan string {
 	ch := make(chan string)
-	close(ch)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/subscribe", c.baseURL), nil)
+	if err != nil {
+		close(ch)
+		return ch
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.do(req)
+	if err != nil {
+		close(ch)
+		return ch
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		close(ch)
+		return ch
+	}
+
+	go func() {
+		defer close(ch)
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			addr, ok := strings.CutPrefix(scanner.Text(), "data:")
+			if !ok {
+				continue
+			}
+			addr = strings.TrimSpace(addr)
+			if addr == "" {
+				continue
+			}
+			select {
+			case ch <- addr:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
 	return ch
 }
 
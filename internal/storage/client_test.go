@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestClient(t *testing.T) {
@@ -100,4 +101,72 @@ func TestClient(t *testing.T) {
 	if ok {
 		t.Fatal("Expected Get to return false for non-existent data")
 	}
+
+	// 7. Remove
+	if removed, err := client.Remove(context.Background(), expectedAddress); err != nil || !removed {
+		t.Fatalf("Expected Remove to delete the block, got %t (err: %v)", removed, err)
+	}
+	if client.Has(context.Background(), expectedAddress) {
+		t.Fatal("Expected Has to return false for removed data")
+	}
+	if removed, err := client.Remove(context.Background(), badAddress); err != nil || removed {
+		t.Fatalf("Expected Remove of non-existent data to report false, got %t (err: %v)", removed, err)
+	}
+}
+
+func TestClient_Subscribe(t *testing.T) {
+	store := NewInMemoryStorage()
+	server := NewStorageServer(store)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	client := NewClient(ts.URL, ts.Client())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub := client.Subscribe(ctx)
+
+	content := []byte("subscribe over sse")
+	address, err := client.Store(context.Background(), bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Store error: %v", err)
+	}
+
+	select {
+	case addr, ok := <-sub:
+		if !ok {
+			t.Fatal("Expected subscription channel to be open")
+		}
+		if addr != address {
+			t.Fatalf("Expected address %s, got %s", address, addr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for subscription event")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-sub:
+		if ok {
+			t.Fatal("Expected subscription channel to be closed after cancel")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for subscription channel to close")
+	}
+
+	// The server drops the subscription of the disconnected client
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		store.subscribers.mu.Lock()
+		remaining := len(store.subscribers.channels)
+		store.subscribers.mu.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the server to drop the subscription, %d remain", remaining)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
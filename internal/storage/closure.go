@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// ErrClosureNotSupported is returned by Client.FetchClosure when the server
+// cannot walk file trees.
+var ErrClosureNotSupported = errors.New("closure fetches are not supported")
+
+// ClosureWalker calls fn with the address of every block of the file tree at
+// root, a JSON content link, reading the directories and block lists it
+// needs from store. It is supplied by the caller as the storage package
+// cannot read file trees itself.
+type ClosureWalker func(ctx context.Context, root json.RawMessage, store Storage, fn func(address string) error) error
+
+// WithClosureWalker enables fetching the closure of a file tree, every block
+// reachable from its root, with POST /fetch.
+func (s *StorageServer) WithClosureWalker(walk ClosureWalker) *StorageServer {
+	s.closure = walk
+	return s
+}
+
+// fetchClosure stores every block of the tree at req.Root that the server
+// does not already have. The tree is walked against local storage, so only
+// the directories and block lists missing locally are read from the
+// container while walking. The missing file blocks are then fetched in a
+// single session. The response counts the blocks and lists those that could
+// not be fetched.
+func (s *StorageServer) fetchClosure(w http.ResponseWriter, r *http.Request, req StorageFetchRequest) {
+	if s.closure == nil {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+	desc, ok := s.discovery.Get(r.Context(), req.Container)
+	if !ok {
+		http.Error(w, "Bad Gateway: container not found in discovery", http.StatusBadGateway)
+		return
+	}
+	remote := &readThroughStorage{Storage: s.storage, remote: NewClient(desc.Address, nil), fetched: make(map[string]bool)}
+
+	resp := StorageFetchResponse{}
+	seen := make(map[string]bool)
+	var missing []string
+	err := s.closure(r.Context(), req.Root, remote, func(address string) error {
+		if seen[address] {
+			return nil
+		}
+		seen[address] = true
+		resp.Blocks++
+		if !s.storage.Has(r.Context(), address) {
+			missing = append(missing, address)
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad Gateway: failed to walk the closure: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	// The blocks read while walking were already fetched
+	var rest []string
+	for _, address := range missing {
+		if !remote.wasFetched(address) {
+			rest = append(rest, address)
+		}
+	}
+	resp.Failed = s.fetchFrom(r.Context(), remote.remote, rest)
+	resp.Present = resp.Blocks - len(missing)
+	resp.Fetched = len(missing) - len(resp.Failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// readThroughStorage reads the blocks missing from its storage from remote,
+// storing them as they are read.
+type readThroughStorage struct {
+	Storage
+	remote *Client
+
+	mu      sync.Mutex
+	fetched map[string]bool
+}
+
+func (s *readThroughStorage) Get(ctx context.Context, address string) (io.ReadCloser, bool) {
+	if rc, ok := s.Storage.Get(ctx, address); ok {
+		return rc, true
+	}
+	rc, ok := s.remote.Get(ctx, address)
+	if !ok {
+		return nil, false
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, false
+	}
+	if ok, err := s.Storage.StoreAt(ctx, address, bytes.NewReader(data)); err != nil || !ok {
+		return nil, false
+	}
+	s.mu.Lock()
+	s.fetched[address] = true
+	s.mu.Unlock()
+	return io.NopCloser(bytes.NewReader(data)), true
+}
+
+func (s *readThroughStorage) wasFetched(address string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetched[address]
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"invariant/internal/httputil"
+)
+
+// ErrCollectNotSupported is returned by Client.Collect when the server cannot
+// remove blocks or walk file trees.
+var ErrCollectNotSupported = errors.New("garbage collection is not supported")
+
+// DefaultCollectGrace is how recently a block must have been stored for a
+// storage server to keep it during a collection even if no root reaches it.
+const DefaultCollectGrace = time.Hour
+
+// StorageCollectRequest asks a storage service to remove every block not
+// reachable from Roots, the JSON content links of root directories, or, if
+// Unreferenced is set, the blocks of Unreferenced not reachable from them.
+type StorageCollectRequest struct {
+	Roots        []json.RawMessage `json:"roots"`
+	Retained     []json.RawMessage `json:"retained,omitempty"`     // roots retained by slots servers, see CollectOptions
+	Unreferenced []string          `json:"unreferenced,omitempty"` // blocks a refcount service reports as collectable, see CollectOptions
+	DryRun       bool              `json:"dryRun,omitempty"`       // count the blocks without removing them
+}
+
+// StorageCollectResponse counts the blocks of a collection.
+type StorageCollectResponse struct {
+	Blocks    int   `json:"blocks"`    // blocks stored when the collection started
+	Reachable int   `json:"reachable"` // blocks reachable from the roots
+	Recent    int   `json:"recent"`    // unreachable blocks kept as they were stored within the grace period
+	Removed   int   `json:"removed"`   // unreachable blocks removed, or that would be with DryRun
+	Bytes     int64 `json:"bytes"`     // size of the blocks removed
+
+	// Kept lists the candidates of the collection that are stored but were
+	// kept as reachable or recent. It is only reported for a collection of
+	// candidates, see CollectOptions.
+	Kept []string `json:"kept,omitempty"`
+}
+
+// RetainedRoots returns roots whose blocks a collection must keep although
+// they were not given to it, such as the previous roots that slots servers
+// retain for readers that resolved a slot before it was updated.
+type RetainedRoots func(ctx context.Context) ([]json.RawMessage, error)
+
+// CollectOptions controls a collection.
+type CollectOptions struct {
+	// DryRun counts the blocks that would be removed without removing them.
+	DryRun bool
+	// Grace keeps unreachable blocks stored within it of the start of the
+	// collection, such as the blocks of a tree whose root is not yet
+	// published. The store must be a TimedStorage unless it is zero.
+	Grace time.Duration
+	// Retained are roots whose blocks are kept as far as they can be walked,
+	// such as the previous roots slots servers retain, which may have been
+	// partly collected already or not be directories at all. Unlike the
+	// roots of the collection, a retained root that cannot be walked keeps
+	// the blocks reached before the walk failed rather than failing the
+	// collection.
+	Retained []json.RawMessage
+	// Candidates, if not nil, are the only blocks considered for removal,
+	// rather than every block of the store, such as the blocks a reference
+	// counting service reports as no longer referenced. Candidates that are
+	// not stored are ignored, and those kept are reported in Kept.
+	Candidates []string
+}
+
+// Collect removes the blocks of store that are not reachable from roots,
+// walking each root with walk. The blocks stored are listed before the roots
+// are walked, so blocks stored during the collection are kept, as are those
+// stored within the grace period before it. If a root cannot be walked, such
+// as when one of its directories is missing, nothing is removed.
+func Collect(ctx context.Context, store ControlledStorage, roots []json.RawMessage, walk ClosureWalker, opts CollectOptions) (StorageCollectResponse, error) {
+	var resp StorageCollectResponse
+	timed, isTimed := store.(TimedStorage)
+	if opts.Grace > 0 && !isTimed {
+		return resp, fmt.Errorf("%w: the storage does not record when its blocks were stored", ErrCollectNotSupported)
+	}
+	cutoff := time.Now().Add(-opts.Grace)
+
+	var candidates []string
+	if opts.Candidates != nil {
+		for _, address := range opts.Candidates {
+			if store.Has(ctx, address) {
+				candidates = append(candidates, address)
+			}
+		}
+	} else {
+		for chunk := range store.List(ctx, 1000) {
+			candidates = append(candidates, chunk...)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return resp, err
+	}
+	resp.Blocks = len(candidates)
+	keep := func(address string) {
+		if opts.Candidates != nil {
+			resp.Kept = append(resp.Kept, address)
+		}
+	}
+
+	reachable := make(map[string]bool)
+	for _, root := range roots {
+		err := walk(ctx, root, store, func(address string) error {
+			reachable[address] = true
+			return nil
+		})
+		if err != nil {
+			return resp, fmt.Errorf("failed to walk root %s: %w", root, err)
+		}
+	}
+	for _, root := range opts.Retained {
+		walk(ctx, root, store, func(address string) error {
+			reachable[address] = true
+			return nil
+		})
+		if err := ctx.Err(); err != nil {
+			return resp, err
+		}
+	}
+
+	for _, address := range candidates {
+		if reachable[address] {
+			resp.Reachable++
+			keep(address)
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return resp, err
+		}
+		if opts.Grace > 0 {
+			// Blocks whose age is unknown, such as those removed since the
+			// listing, are kept
+			if at, ok := timed.StoredAt(ctx, address); !ok || at.After(cutoff) {
+				resp.Recent++
+				keep(address)
+				continue
+			}
+		}
+		size, _ := store.Size(ctx, address)
+		if !opts.DryRun {
+			removed, err := store.Remove(ctx, address)
+			if err != nil {
+				return resp, err
+			}
+			if !removed {
+				continue
+			}
+		}
+		resp.Removed++
+		resp.Bytes += size
+	}
+	return resp, nil
+}
+
+// MaxCollectRequestSize is the largest POST /collect body, in bytes, the
+// server accepts.
+const MaxCollectRequestSize = 32 << 20
+
+// WithCollect enables POST /collect. Collection removes every block the
+// request does not keep, so it is disabled by default and should be enabled
+// only behind capability tokens.
+func (s *StorageServer) WithCollect(enabled bool) *StorageServer {
+	s.collect = enabled
+	return s
+}
+
+// WithCollectGrace sets how recently a block must have been stored for
+// POST /collect to keep it although no root reaches it. Zero removes every
+// unreachable block, including those of trees whose roots are not yet
+// published.
+func (s *StorageServer) WithCollectGrace(grace time.Duration) *StorageServer {
+	s.collectGrace = grace
+	return s
+}
+
+// WithRetainedRoots makes POST /collect also keep the blocks of the roots
+// retained returns, such as the previous roots retained by slots servers, as
+// it keeps those of the retained roots of the request. A collection fails
+// with 502 Bad Gateway if retained does.
+func (s *StorageServer) WithRetainedRoots(retained RetainedRoots) *StorageServer {
+	s.retainedRoots = retained
+	return s
+}
+
+// handleCollect removes the blocks not reachable from the roots of the
+// request. It requires collection to be enabled, storage that can remove
+// blocks and a closure walker, and, with a grace period, that records when
+// its blocks were stored.
+func (s *StorageServer) handleCollect(w http.ResponseWriter, r *http.Request) {
+	if !s.collect {
+		http.Error(w, "Forbidden: collection is disabled", http.StatusForbidden)
+		return
+	}
+	store, ok := s.storage.(ControlledStorage)
+	if _, timed := s.storage.(TimedStorage); s.collectGrace > 0 && !timed {
+		ok = false
+	}
+	if !ok || s.closure == nil {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+	var req StorageCollectRequest
+	if !httputil.DecodeJSON(w, r, MaxCollectRequestSize, &req) {
+		return
+	}
+	if len(req.Roots) == 0 && len(req.Unreferenced) == 0 {
+		http.Error(w, "Bad Request: missing roots", http.StatusBadRequest)
+		return
+	}
+
+	retained := req.Retained
+	if s.retainedRoots != nil {
+		more, err := s.retainedRoots(r.Context())
+		if err != nil {
+			http.Error(w, "Bad Gateway: failed to read the retained roots: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		retained = append(retained, more...)
+	}
+
+	resp, err := Collect(r.Context(), store, req.Roots, s.closure, CollectOptions{DryRun: req.DryRun, Grace: s.collectGrace, Retained: retained, Candidates: req.Unreferenced})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unprocessable Entity: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Collect asks the remote server to remove every block not reachable from
+// roots, the JSON content links of root directories, or, as far as they can
+// be walked, from retained. ErrCollectNotSupported
+// is returned if the server cannot remove blocks or walk file trees.
+func (c *Client) Collect(ctx context.Context, roots, retained []json.RawMessage, dryRun bool) (StorageCollectResponse, error) {
+	return c.CollectRequest(ctx, StorageCollectRequest{Roots: roots, Retained: retained, DryRun: dryRun})
+}
+
+// CollectRequest asks the remote server for the collection req, such as the
+// removal of the blocks a reference counting service reports as unreferenced.
+func (c *Client) CollectRequest(ctx context.Context, collect StorageCollectRequest) (StorageCollectResponse, error) {
+	data, err := json.Marshal(collect)
+	if err != nil {
+		return StorageCollectResponse{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/collect", c.baseURL), bytes.NewReader(data))
+	if err != nil {
+		return StorageCollectResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return StorageCollectResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotImplemented {
+		return StorageCollectResponse{}, ErrCollectNotSupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Surface the reason, such as a server with collection disabled
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return StorageCollectResponse{}, fmt.Errorf("unexpected status code: %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+
+	var result StorageCollectResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return StorageCollectResponse{}, fmt.Errorf("invalid collect response: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package storage
+
+// syncDirectory flushes the entries of the directory at path.
+func syncDirectory(path string) error {
+	return syncPath(path)
+}
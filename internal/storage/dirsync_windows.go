@@ -0,0 +1,7 @@
+package storage
+
+// syncDirectory does nothing as Windows cannot flush a directory, whose
+// entries are instead kept by the journal of the file system.
+func syncDirectory(path string) error {
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package storage
+
+// diskCapacity returns the size in bytes of the file system holding path,
+// which is not known on this platform.
+func diskCapacity(path string) (int64, bool) {
+	return 0, false
+}
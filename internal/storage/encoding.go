@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// errUnsupportedEncoding is returned for a request body with a content
+// encoding other than gzip.
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// errBlockTooLarge is returned reading a request body that decodes to more
+// bytes than a block may hold.
+var errBlockTooLarge = errors.New("block too large")
+
+const (
+	// encodingSample is how much of a block is compressed to decide whether
+	// compressing it in transit is worthwhile.
+	encodingSample = 4096
+	// minEncodedSize is the size below which blocks are sent as is.
+	minEncodedSize = 512
+)
+
+// compressible reports whether sample shrinks enough when compressed to be
+// worth compressing the block it starts. Encrypted or already compressed
+// blocks do not.
+func compressible(sample []byte) bool {
+	if len(sample) < minEncodedSize {
+		return false
+	}
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	zw.Write(sample)
+	zw.Close()
+	return buf.Len() < len(sample)*9/10
+}
+
+// sampleBlock returns a reader of r and whether the block it reads is worth
+// compressing in transit.
+func sampleBlock(r io.Reader) (io.Reader, bool) {
+	br := bufio.NewReaderSize(r, encodingSample)
+	sample, _ := br.Peek(encodingSample)
+	return br, compressible(sample)
+}
+
+// acceptsGzip reports whether an Accept-Encoding header value allows gzip.
+func acceptsGzip(header string) bool {
+	for coding := range strings.SplitSeq(header, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.TrimSpace(name)
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok && strings.Trim(q, "0.") == "" {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// gzipReader compresses r as it is read.
+func gzipReader(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// requestBody returns the decoded body of r, which fails with
+// errBlockTooLarge once more than limit bytes are read from it. A negative
+// limit does not limit the body.
+func requestBody(r *http.Request, limit int64) (io.Reader, error) {
+	var body io.Reader
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+		body = r.Body
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = zr
+	default:
+		return nil, errUnsupportedEncoding
+	}
+	if limit < 0 {
+		return body, nil
+	}
+	return &limitedBlock{r: io.LimitReader(body, limit+1), limit: limit}, nil
+}
+
+// limitedBlock reads a block of at most limit bytes from r, which is limited
+// to one byte more so a larger block is detected without reading all of it.
+type limitedBlock struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (b *limitedBlock) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		return n, errBlockTooLarge
+	}
+	return n, err
+}
@@ -1,10 +1,12 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"invariant/internal/identity"
 	"io"
 	"log"
@@ -12,19 +14,60 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 // FileSystemStorage implements the Storage interface by saving blobs to disk.
 type FileSystemStorage struct {
-	baseDir     string
-	id          string
-	mu          sync.RWMutex
-	subscribers []chan string
+	baseDir             string
+	id                  string
+	smallBlockThreshold int64
+	durability          Durability
+	compress            bool
+	subscribers         subscriberList
+
+	locksMu sync.Mutex
+	locks   map[string]*addressLock
 }
 
+type addressLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Durability controls how much of a stored block is flushed to stable storage
+// before its address is returned.
+type Durability string
+
+const (
+	// DurabilityNone leaves flushing to the operating system.
+	DurabilityNone Durability = "none"
+	// DurabilityData flushes the block's data before it is acknowledged.
+	DurabilityData Durability = "data"
+	// DurabilityFull also flushes the directories containing the block so the
+	// new directory entries survive a power loss.
+	DurabilityFull Durability = "full"
+)
+
+// ParseDurability converts the name of a durability mode into a Durability.
+func ParseDurability(name string) (Durability, error) {
+	switch Durability(name) {
+	case DurabilityNone, DurabilityData, DurabilityFull:
+		return Durability(name), nil
+	}
+	return "", fmt.Errorf("unsupported durability '%s'", name)
+}
+
+// DefaultSmallBlockThreshold is the size of the largest block that is buffered
+// in memory and written directly to its final path.
+const DefaultSmallBlockThreshold = 64 * 1024
+
 // Assert that FileSystemStorage implements the Storage interface
 var _ Storage = (*FileSystemStorage)(nil)
 
+// Assert that FileSystemStorage records when its blocks were stored
+var _ TimedStorage = (*FileSystemStorage)(nil)
+
 // Assert that FileSystemStorage implements the identity.Provider interface
 var _ identity.Identity = (*FileSystemStorage)(nil)
 
@@ -46,11 +89,38 @@ func NewFileSystemStorage(baseDir string) *FileSystemStorage {
 	}
 
 	return &FileSystemStorage{
-		baseDir: baseDir,
-		id:      id,
+		baseDir:             baseDir,
+		id:                  id,
+		smallBlockThreshold: DefaultSmallBlockThreshold,
+		durability:          DurabilityNone,
+		locks:               make(map[string]*addressLock),
 	}
 }
 
+// WithDurability sets how much of a stored block is flushed to stable storage
+// before Store and StoreAt return.
+func (s *FileSystemStorage) WithDurability(durability Durability) *FileSystemStorage {
+	s.durability = durability
+	return s
+}
+
+// WithSmallBlockThreshold sets the size of the largest block that is buffered
+// in memory and written directly to its final path, instead of streamed
+// through a temporary file. Zero streams every block through a temporary
+// file.
+func (s *FileSystemStorage) WithSmallBlockThreshold(threshold int64) *FileSystemStorage {
+	s.smallBlockThreshold = threshold
+	return s
+}
+
+// WithCompression stores newly written blocks gzip compressed at rest when it
+// makes them smaller. Addresses, Get and Size are unaffected and blocks written
+// without compression remain readable.
+func (s *FileSystemStorage) WithCompression(compress bool) *FileSystemStorage {
+	s.compress = compress
+	return s
+}
+
 func (s *FileSystemStorage) ID() string {
 	return s.id
 }
@@ -69,113 +139,342 @@ func (s *FileSystemStorage) addressToPath(address string) string {
 	return filepath.Join(s.baseDir, dir1, dir2, filename)
 }
 
+// pathSafe reports whether address can be turned into a path below the base
+// directory. Addresses holding separators, on any platform, or volume
+// names could otherwise name files elsewhere.
+func pathSafe(address string) bool {
+	return address != "" && !strings.ContainsAny(address, `/\:`) && !strings.Contains(address, "..")
+}
+
 func (s *FileSystemStorage) Has(ctx context.Context, address string) bool {
+	if !pathSafe(address) {
+		return false
+	}
 	path := s.addressToPath(address)
-	_, err := os.Stat(path)
+	if _, err := os.Stat(path); err == nil {
+		return true
+	}
+	_, err := os.Stat(path + compressedSuffix)
 	return err == nil
 }
 
 func (s *FileSystemStorage) Get(ctx context.Context, address string) (io.ReadCloser, bool) {
+	if !pathSafe(address) {
+		return nil, false
+	}
 	path := s.addressToPath(address)
 	file, err := os.Open(path)
+	if err == nil {
+		return file, true
+	}
+	reader, err := openCompressed(path + compressedSuffix)
 	if err != nil {
 		return nil, false
 	}
-	return file, true
+	return reader, true
 }
 
 func (s *FileSystemStorage) Store(ctx context.Context, r io.Reader) (string, error) {
-	// 1. Create a temporary file to read the stream and calculate the hash
+	address, _, err := s.store(r, "")
+	return address, err
+}
+
+// StoreAt stores the stream at address. If the block is already present the
+// stream is not read.
+func (s *FileSystemStorage) StoreAt(ctx context.Context, address string, r io.Reader) (bool, error) {
+	if !pathSafe(address) {
+		return false, nil
+	}
+	unlock := s.lockAddress(address)
+	exists := s.Has(ctx, address)
+	if exists {
+		s.touch(address)
+	}
+	unlock()
+	if exists {
+		return true, nil
+	}
+
+	_, ok, err := s.store(r, address)
+	return ok, err
+}
+
+// lockAddress serializes the final write of a block so concurrent writers of
+// the same address do not observe or replace each other's partial files.
+func (s *FileSystemStorage) lockAddress(address string) func() {
+	s.locksMu.Lock()
+	lock, ok := s.locks[address]
+	if !ok {
+		lock = &addressLock{}
+		s.locks[address] = lock
+	}
+	lock.refs++
+	s.locksMu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+
+		s.locksMu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(s.locks, address)
+		}
+		s.locksMu.Unlock()
+	}
+}
+
+// store saves the stream under its sha256 address. If expected is not empty
+// the block is only saved if its address matches expected.
+func (s *FileSystemStorage) store(r io.Reader, expected string) (string, bool, error) {
+	// 1. Buffer small blocks in memory, they are written directly to their
+	// final path which avoids the temporary file and rename.
+	var head bytes.Buffer
+	if _, err := head.ReadFrom(io.LimitReader(r, s.smallBlockThreshold+1)); err != nil {
+		return "", false, err
+	}
+	if int64(head.Len()) <= s.smallBlockThreshold {
+		hashBytes := sha256.Sum256(head.Bytes())
+		address := hex.EncodeToString(hashBytes[:])
+		if expected != "" && address != expected {
+			return "", false, nil
+		}
+		unlock := s.lockAddress(address)
+		err := s.writeBlock(address, head.Bytes())
+		unlock()
+		if err != nil {
+			return "", false, err
+		}
+		s.notifySubscribers(address)
+		return address, true, nil
+	}
+
+	// 2. Larger blocks are streamed to a temporary file while calculating the hash
 	tmpFile, err := os.CreateTemp(s.baseDir, "upload-*")
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 	defer os.Remove(tmpFile.Name()) // Clean up the temp file if something fails
 
 	hasher := sha256.New()
 
 	// TeeReader writes to the hasher while reading from the stream
-	teeReader := io.TeeReader(r, hasher)
+	teeReader := io.TeeReader(io.MultiReader(&head, r), hasher)
 
 	// Copy the stream to the temp file
 	if _, err := io.Copy(tmpFile, teeReader); err != nil {
 		tmpFile.Close()
-		return "", err
+		return "", false, err
+	}
+	// A compressed copy is flushed instead when compressing at rest
+	if s.durability != DurabilityNone && !s.compress {
+		if err := tmpFile.Sync(); err != nil {
+			tmpFile.Close()
+			return "", false, err
+		}
 	}
 	tmpFile.Close() // Close so we can move it
 
-	// 2. Get the hash and the final address
+	// 3. Get the hash and verify it matches the requested address
 	hashBytes := hasher.Sum(nil)
 	address := hex.EncodeToString(hashBytes)
+	if expected != "" && address != expected {
+		return "", false, nil
+	}
+
+	// 4. Move the temporary file to its final destination, unless another
+	// writer already stored the block
+	unlock := s.lockAddress(address)
+	defer unlock()
+
+	if s.Has(context.Background(), address) {
+		s.touch(address)
+		return address, true, nil
+	}
 
-	// 3. Move the temporary file to its final destination
 	finalPath := s.addressToPath(address)
+	tmpPath := tmpFile.Name()
+	if s.compress {
+		compressedPath, smaller, err := compressFile(s.baseDir, tmpPath)
+		if err != nil {
+			return "", false, err
+		}
+		if smaller {
+			defer os.Remove(compressedPath)
+			if err := s.syncFile(compressedPath); err != nil {
+				return "", false, err
+			}
+			tmpPath = compressedPath
+			finalPath += compressedSuffix
+		}
+	}
 
 	// Ensure the destination directories exist (e.g., dir/aa/bb/)
-	if err := os.MkdirAll(filepath.Dir(finalPath), 0755); err != nil {
-		return "", err
+	if err := s.ensureDir(filepath.Dir(finalPath)); err != nil {
+		return "", false, err
 	}
 
-	// Attempt to rename the file. Note: if the file already exists, os.Rename overwrites it,
-	// which is acceptable since the contents are identical (content-addressable).
-	if err := os.Rename(tmpFile.Name(), finalPath); err != nil {
-		// If os.Rename fails (e.g., across mount points), fallback to copy/delete isn't strictly
-		// necessary here since temp file is created in the same baseDir.
-		return "", err
+	// Attempt to rename the file. Concurrent writers of the same address hold
+	// the address lock so an existing file is never replaced by this process.
+	// Another process sharing the directory can still have written it, which
+	// fails the rename on Windows if the block is open, but the block it
+	// wrote is identical.
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		if _, statErr := os.Stat(finalPath); statErr != nil {
+			return "", false, err
+		}
+	}
+	if err := s.syncDir(filepath.Dir(finalPath)); err != nil {
+		return "", false, err
 	}
 
 	s.notifySubscribers(address)
 
-	return address, nil
+	return address, true, nil
 }
 
-func (s *FileSystemStorage) StoreAt(ctx context.Context, address string, r io.Reader) (bool, error) {
-	// 1. Create a temporary file to read the stream and calculate the hash
-	tmpFile, err := os.CreateTemp(s.baseDir, "upload-*")
-	if err != nil {
-		return false, err
+// writeBlock writes a buffered block directly to its final path, avoiding the
+// temporary file and rename of streamed blocks. The file is created
+// exclusively and removed if the write fails, so a failed write leaves no
+// partial block; only a crash during the write can. An existing block is left
+// untouched since its contents are identical.
+func (s *FileSystemStorage) writeBlock(address string, data []byte) error {
+	if s.Has(context.Background(), address) {
+		s.touch(address)
+		return nil
 	}
-	defer os.Remove(tmpFile.Name())
 
-	hasher := sha256.New()
-	teeReader := io.TeeReader(r, hasher)
-
-	if _, err := io.Copy(tmpFile, teeReader); err != nil {
-		tmpFile.Close()
-		return false, err
+	finalPath := s.addressToPath(address)
+	if s.compress {
+		if compressed, ok := compressBlock(data); ok {
+			data = compressed
+			finalPath += compressedSuffix
+		}
+	}
+	if err := s.ensureDir(filepath.Dir(finalPath)); err != nil {
+		return err
 	}
-	tmpFile.Close()
 
-	hashBytes := hasher.Sum(nil)
-	calculatedAddress := hex.EncodeToString(hashBytes)
+	// The address lock is held, so a block created since it was looked for
+	// was written by another process sharing the directory, and is identical
+	file, err := os.OpenFile(finalPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(finalPath)
+		return err
+	}
+	if s.durability != DurabilityNone {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			os.Remove(finalPath)
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(finalPath)
+		return err
+	}
+	return s.syncDir(filepath.Dir(finalPath))
+}
 
-	// 2. Verify the hash matches the requested address
-	if address != calculatedAddress {
-		return false, nil
+// syncFile flushes the file at path unless durability is disabled.
+func (s *FileSystemStorage) syncFile(path string) error {
+	if s.durability == DurabilityNone {
+		return nil
 	}
+	return syncPath(path)
+}
 
-	// 3. Move the file
-	finalPath := s.addressToPath(address)
-	if err := os.MkdirAll(filepath.Dir(finalPath), 0755); err != nil {
-		return false, err
+// ensureDir creates dir and any missing parents. With full durability the
+// parents of newly created directories are flushed so the new entries persist.
+func (s *FileSystemStorage) ensureDir(dir string) error {
+	if s.durability != DurabilityFull {
+		return os.MkdirAll(dir, 0755)
 	}
 
-	if err := os.Rename(tmpFile.Name(), finalPath); err != nil {
-		return false, err
+	var created []string
+	base := filepath.Clean(s.baseDir)
+	for current := dir; current != base && current != filepath.Dir(current); current = filepath.Dir(current) {
+		if _, err := os.Stat(current); err == nil {
+			break
+		}
+		created = append(created, current)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, current := range created {
+		if err := syncDirectory(filepath.Dir(current)); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	s.notifySubscribers(address)
+// syncDir flushes the entries of dir when full durability is requested.
+func (s *FileSystemStorage) syncDir(dir string) error {
+	if s.durability != DurabilityFull {
+		return nil
+	}
+	return syncDirectory(dir)
+}
 
-	return true, nil
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
 }
 
 func (s *FileSystemStorage) Size(ctx context.Context, address string) (int64, bool) {
+	if !pathSafe(address) {
+		return 0, false
+	}
 	path := s.addressToPath(address)
 	stat, err := os.Stat(path)
+	if err == nil {
+		return stat.Size(), true
+	}
+	size, err := compressedSize(path + compressedSuffix)
 	if err != nil {
 		return 0, false
 	}
-	return stat.Size(), true
+	return size, true
+}
+
+// StoredAt returns the modification time of the block, which is refreshed
+// when a store finds the block already present.
+func (s *FileSystemStorage) StoredAt(ctx context.Context, address string) (time.Time, bool) {
+	if !pathSafe(address) {
+		return time.Time{}, false
+	}
+	path := s.addressToPath(address)
+	for _, candidate := range []string{path, path + compressedSuffix} {
+		if stat, err := os.Stat(candidate); err == nil {
+			return stat.ModTime(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// touch refreshes the modification time of a block a store found already
+// present, so garbage collection treats it as recently stored.
+func (s *FileSystemStorage) touch(address string) {
+	now := time.Now()
+	path := s.addressToPath(address)
+	for _, candidate := range []string{path, path + compressedSuffix} {
+		if os.Chtimes(candidate, now, now) == nil {
+			return
+		}
+	}
 }
 
 func (s *FileSystemStorage) List(ctx context.Context, chunkSize int) <-chan []string {
@@ -215,7 +514,7 @@ func (s *FileSystemStorage) List(ctx context.Context, chunkSize int) <-chan []st
 			if err != nil {
 				return nil
 			}
-			address := strings.ReplaceAll(relPath, string(filepath.Separator), "")
+			address := strings.ReplaceAll(strings.TrimSuffix(relPath, compressedSuffix), string(filepath.Separator), "")
 
 			chunk = append(chunk, address)
 			if len(chunk) >= chunkSize {
@@ -234,33 +533,28 @@ func (s *FileSystemStorage) List(ctx context.Context, chunkSize int) <-chan []st
 }
 
 func (s *FileSystemStorage) Subscribe(ctx context.Context) <-chan string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	ch := make(chan string, 100)
-	s.subscribers = append(s.subscribers, ch)
-	return ch
+	return s.subscribers.subscribe(ctx)
 }
 
 func (s *FileSystemStorage) notifySubscribers(address string) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	for _, ch := range s.subscribers {
-		select {
-		case ch <- address:
-		default:
-			// Subscriber is full or blocked, drop the notification
-		}
-	}
+	s.subscribers.notify(address)
 }
 
 func (s *FileSystemStorage) Remove(ctx context.Context, address string) (bool, error) {
+	if !pathSafe(address) {
+		return false, nil
+	}
 	path := s.addressToPath(address)
-	err := os.Remove(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
+	removed := false
+	for _, candidate := range []string{path, path + compressedSuffix} {
+		err := os.Remove(candidate)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, err
 		}
-		return false, err
+		removed = true
 	}
-	return true, nil
+	return removed, nil
 }
@@ -3,12 +3,18 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestFileSystemStorage(t *testing.T) {
@@ -113,3 +119,253 @@ func TestFileSystemStorage(t *testing.T) {
 		t.Fatalf("Expected List to contain both %s and %s, but got %v", expectedAddress, newExpectedHash, list)
 	}
 }
+
+func TestFileSystemStorage_SmallBlockThreshold(t *testing.T) {
+	tmpDir := t.TempDir()
+	fs := NewFileSystemStorage(tmpDir).WithSmallBlockThreshold(16)
+	ctx := context.Background()
+
+	for _, content := range [][]byte{
+		[]byte("small"),
+		[]byte("exactly 16 bytes"),
+		bytes.Repeat([]byte("large"), 100),
+	} {
+		hash := sha256.Sum256(content)
+		expectedAddress := hex.EncodeToString(hash[:])
+
+		address, err := fs.Store(ctx, bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("Store error: %v", err)
+		}
+		if address != expectedAddress {
+			t.Fatalf("expected address %s, got %s", expectedAddress, address)
+		}
+
+		// Storing the same block again is a no-op
+		if _, err := fs.Store(ctx, bytes.NewReader(content)); err != nil {
+			t.Fatalf("Store error: %v", err)
+		}
+
+		r, ok := fs.Get(ctx, address)
+		if !ok {
+			t.Fatalf("Expected Get to find %s", address)
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(data, content) {
+			t.Fatalf("Expected content %q, got %q", content, data)
+		}
+
+		// StoreAt rejects content that does not match the address
+		mismatched := append(content, '!')
+		missingHash := sha256.Sum256(append(mismatched, '!'))
+		ok, err = fs.StoreAt(ctx, hex.EncodeToString(missingHash[:]), bytes.NewReader(mismatched))
+		if err != nil || ok {
+			t.Fatalf("Expected StoreAt to reject mismatched content, got %v (err: %v)", ok, err)
+		}
+	}
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("ReadDir error: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "upload-") {
+			t.Fatalf("Expected temporary files to be removed, found %s", entry.Name())
+		}
+	}
+}
+
+func TestFileSystemStorage_Durability(t *testing.T) {
+	if _, err := ParseDurability("sometimes"); err == nil {
+		t.Fatal("Expected an unknown durability to be rejected")
+	}
+
+	for _, name := range []string{"none", "data", "full"} {
+		durability, err := ParseDurability(name)
+		if err != nil {
+			t.Fatalf("ParseDurability(%q) error: %v", name, err)
+		}
+		fs := NewFileSystemStorage(t.TempDir()).WithDurability(durability).WithSmallBlockThreshold(8)
+
+		for _, content := range [][]byte{[]byte("small"), []byte("larger than the threshold")} {
+			address, err := fs.Store(context.Background(), bytes.NewReader(content))
+			if err != nil {
+				t.Fatalf("Store error with %s durability: %v", name, err)
+			}
+			if size, ok := fs.Size(context.Background(), address); !ok || size != int64(len(content)) {
+				t.Fatalf("Expected size %d with %s durability, got %d (ok: %t)", len(content), name, size, ok)
+			}
+		}
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestFileSystemStorage_StoreAtExisting(t *testing.T) {
+	fs := NewFileSystemStorage(t.TempDir())
+	ctx := context.Background()
+
+	content := bytes.Repeat([]byte("block"), DefaultSmallBlockThreshold)
+	address, err := fs.Store(ctx, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Store error: %v", err)
+	}
+
+	// The body of an existing block is never read, but it counts as stored
+	// again for garbage collection
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(fs.addressToPath(address), old, old)
+	ok, err := fs.StoreAt(ctx, address, failingReader{})
+	if err != nil || !ok {
+		t.Fatalf("Expected StoreAt to succeed for an existing block, got %v (err: %v)", ok, err)
+	}
+	if at, ok := fs.StoredAt(ctx, address); !ok || !at.After(old) {
+		t.Errorf("Expected StoreAt to refresh when the block was stored, got %v", at)
+	}
+
+	// Concurrent writers of the same address all succeed and leave the block intact
+	other := bytes.Repeat([]byte("other"), DefaultSmallBlockThreshold)
+	hash := sha256.Sum256(other)
+	otherAddress := hex.EncodeToString(hash[:])
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 8 {
+		wg.Go(func() {
+			ok, err := fs.StoreAt(ctx, otherAddress, bytes.NewReader(other))
+			if err == nil && !ok {
+				err = fmt.Errorf("StoreAt rejected %s", otherAddress)
+			}
+			errs <- err
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("StoreAt error: %v", err)
+		}
+	}
+
+	r, ok := fs.Get(ctx, otherAddress)
+	if !ok {
+		t.Fatalf("Expected Get to find %s", otherAddress)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(data, other) {
+		t.Fatal("Expected the concurrently stored block to be intact")
+	}
+}
+
+func TestFileSystemStorage_PathAddresses(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewFileSystemStorage(filepath.Join(dir, "blocks"))
+	ctx := context.Background()
+
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range []string{"../secret", `..\secret`, "C:secret", ""} {
+		if fs.Has(ctx, address) {
+			t.Errorf("Has(%q) = true", address)
+		}
+		if _, ok := fs.Get(ctx, address); ok {
+			t.Errorf("Get(%q) found a block", address)
+		}
+		if ok, err := fs.StoreAt(ctx, address, strings.NewReader("secret")); ok || err != nil {
+			t.Errorf("StoreAt(%q) = %v, %v", address, ok, err)
+		}
+		if removed, _ := fs.Remove(ctx, address); removed {
+			t.Errorf("Remove(%q) removed a file", address)
+		}
+	}
+	if _, err := os.Stat(secret); err != nil {
+		t.Errorf("file outside the storage was touched: %v", err)
+	}
+}
+
+func TestFileSystemStorage_Compression(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	// A block stored before compression was enabled stays readable
+	plain, err := NewFileSystemStorage(tmpDir).Store(ctx, bytes.NewReader(bytes.Repeat([]byte("plain "), 100)))
+	if err != nil {
+		t.Fatalf("Store error: %v", err)
+	}
+
+	fs := NewFileSystemStorage(tmpDir).WithCompression(true).WithSmallBlockThreshold(1024)
+	compressible := bytes.Repeat([]byte("compressible "), 1000)
+	random := make([]byte, 512)
+	rand.Read(random)
+	largeRandom := make([]byte, 4096)
+	rand.Read(largeRandom)
+
+	var addresses []string
+	for _, content := range [][]byte{[]byte("tiny"), random, compressible[:1000], compressible, largeRandom} {
+		address, err := fs.Store(ctx, bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("Store error: %v", err)
+		}
+		hash := sha256.Sum256(content)
+		if address != hex.EncodeToString(hash[:]) {
+			t.Fatalf("Expected the address to be the hash of the original content")
+		}
+		addresses = append(addresses, address)
+
+		if size, ok := fs.Size(ctx, address); !ok || size != int64(len(content)) {
+			t.Fatalf("Expected size %d, got %d (ok: %t)", len(content), size, ok)
+		}
+		r, ok := fs.Get(ctx, address)
+		if !ok {
+			t.Fatalf("Expected Get to find %s", address)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(data, content) {
+			t.Fatalf("Expected the original content back (err: %v)", err)
+		}
+	}
+
+	// Compressible blocks are smaller on disk, incompressible ones are kept as is
+	path := fs.addressToPath(addresses[3]) + compressedSuffix
+	if info, err := os.Stat(path); err != nil || info.Size() >= int64(len(compressible)) {
+		t.Fatalf("Expected %s to be stored compressed (err: %v)", addresses[3], err)
+	}
+	if _, err := os.Stat(fs.addressToPath(addresses[1])); err != nil {
+		t.Fatalf("Expected the incompressible block to be stored uncompressed: %v", err)
+	}
+	// Including those above the small block threshold, written through a
+	// temporary file
+	if _, err := os.Stat(fs.addressToPath(addresses[4])); err != nil {
+		t.Fatalf("Expected the large incompressible block to be stored uncompressed: %v", err)
+	}
+	if _, err := os.Stat(fs.addressToPath(addresses[4]) + compressedSuffix); !os.IsNotExist(err) {
+		t.Fatalf("Expected no compressed copy of the large incompressible block (err: %v)", err)
+	}
+
+	var list []string
+	for chunk := range fs.List(ctx, 10) {
+		list = append(list, chunk...)
+	}
+	slices.Sort(list)
+	expected := append([]string{plain}, addresses...)
+	slices.Sort(expected)
+	if !slices.Equal(list, expected) {
+		t.Fatalf("Expected List to return %v, got %v", expected, list)
+	}
+
+	if ok, err := fs.Remove(ctx, addresses[3]); err != nil || !ok {
+		t.Fatalf("Expected Remove to delete the compressed block, got %v (err: %v)", ok, err)
+	}
+	if fs.Has(ctx, addresses[3]) {
+		t.Fatal("Expected the compressed block to be removed")
+	}
+}
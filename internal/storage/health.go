@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// healthAlpha is the weight of the latest request in the moving
+	// averages of the latency and error rate of a server.
+	healthAlpha = 0.2
+
+	// defaultLatency is the latency assumed for a server before any request
+	// to it completed, when no other server was measured either.
+	defaultLatency = 50 * time.Millisecond
+
+	// minLatency bounds the weight given to very fast servers, so the
+	// timing noise of local servers does not decide the selection.
+	minLatency = time.Millisecond
+
+	// unhealthyErrorRate is the error rate at which a server is dropped from
+	// the live servers.
+	unhealthyErrorRate = 0.75
+)
+
+// ServerHealth is the health of a storage server measured by an
+// AggregateClient from the requests made to it.
+type ServerHealth struct {
+	ID        string        `json:"id"`
+	Latency   time.Duration `json:"latency"`   // moving average of the time to a response
+	ErrorRate float64       `json:"errorRate"` // moving average of failed requests, from 0 to 1
+	Requests  int64         `json:"requests"`
+	Score     float64       `json:"score"` // relative share of requests sent to the server
+}
+
+type serverHealth struct {
+	latency   float64 // seconds, 0 until measured
+	errorRate float64
+	requests  int64
+}
+
+// healthTracker keeps the health of each server a client sends requests to.
+type healthTracker struct {
+	mu      sync.Mutex
+	servers map[string]*serverHealth
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{servers: make(map[string]*serverHealth)}
+}
+
+// observe records a request to id that took latency and failed or not, and
+// returns the resulting error rate of the server. Only the latency of
+// successful requests is measured.
+func (t *healthTracker) observe(id string, latency time.Duration, failed bool) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.servers[id]
+	if !ok {
+		h = &serverHealth{}
+		t.servers[id] = h
+	}
+	h.requests++
+	failure := 0.0
+	if failed {
+		failure = 1
+	}
+	h.errorRate += healthAlpha * (failure - h.errorRate)
+	if !failed {
+		seconds := latency.Seconds()
+		if h.latency == 0 {
+			h.latency = seconds
+		} else {
+			h.latency += healthAlpha * (seconds - h.latency)
+		}
+	}
+	return h.errorRate
+}
+
+// forget drops the health of id, which is measured afresh if it is used
+// again.
+func (t *healthTracker) forget(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.servers, id)
+}
+
+// scoreLocked returns the weight of a server: the rate of successful
+// requests it can answer. Unmeasured servers are assumed to be as fast as
+// the average measured server, so they are tried.
+func (t *healthTracker) scoreLocked(h *serverHealth, assumed float64) float64 {
+	latency := assumed
+	errorRate := 0.0
+	if h != nil {
+		errorRate = h.errorRate
+		if h.latency > 0 {
+			latency = h.latency
+		}
+	}
+	// A failing server keeps a small share so it can recover
+	return max(1-errorRate, 0.01) / max(latency, minLatency.Seconds())
+}
+
+// assumedLatencyLocked returns the average latency of the measured servers.
+func (t *healthTracker) assumedLatencyLocked() float64 {
+	var total float64
+	var n int
+	for _, h := range t.servers {
+		if h.latency > 0 {
+			total += h.latency
+			n++
+		}
+	}
+	if n == 0 {
+		return defaultLatency.Seconds()
+	}
+	return total / float64(n)
+}
+
+// rank orders ids for trying a request, picking each next server at random
+// with a probability proportional to its score, so healthier servers
+// receive a larger share of the requests.
+func (t *healthTracker) rank(ids []string) []string {
+	if len(ids) <= 1 {
+		return ids
+	}
+	t.mu.Lock()
+	assumed := t.assumedLatencyLocked()
+	keys := make(map[string]float64, len(ids))
+	for _, id := range ids {
+		// Weighted sampling without replacement: the largest u^(1/w) first
+		score := t.scoreLocked(t.servers[id], assumed)
+		keys[id] = math.Log(rand.Float64()) / score
+	}
+	t.mu.Unlock()
+
+	ranked := slices.Clone(ids)
+	slices.SortStableFunc(ranked, func(a, b string) int {
+		return -compareFloat(keys[a], keys[b])
+	})
+	return ranked
+}
+
+// health reports the health of ids.
+func (t *healthTracker) health(ids []string) []ServerHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	assumed := t.assumedLatencyLocked()
+	var total float64
+	report := make([]ServerHealth, len(ids))
+	for i, id := range ids {
+		h := t.servers[id]
+		report[i] = ServerHealth{ID: id, Score: t.scoreLocked(h, assumed)}
+		if h != nil {
+			report[i].Latency = time.Duration(h.latency * float64(time.Second))
+			report[i].ErrorRate = h.errorRate
+			report[i].Requests = h.requests
+		}
+		total += report[i].Score
+	}
+	for i := range report {
+		report[i].Score /= total
+	}
+	return report
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -6,22 +6,38 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"invariant/internal/identity"
 	"io"
 	"sync"
+	"time"
 )
 
 // Assert that InMemoryStorage implements the Storage interface
 var _ Storage = (*InMemoryStorage)(nil)
 
+// Assert that InMemoryStorage records when its blocks were stored
+var _ TimedStorage = (*InMemoryStorage)(nil)
+
 // Assert that InMemoryStorage implements the identity.Provider interface
 var _ identity.Identity = (*InMemoryStorage)(nil)
 
+// ErrStorageFull is returned when a block does not fit within the memory limit
+// of an InMemoryStorage that has nowhere to spill it.
+var ErrStorageFull = errors.New("storage is full")
+
 type InMemoryStorage struct {
 	id          string
 	mu          sync.RWMutex
 	store       map[string][]byte
-	subscribers []chan string
+	stored      map[string]time.Time // when each block of store was last stored
+	subscribers subscriberList
+
+	// limit caps the bytes held in store. Blocks that do not fit are written
+	// to spill, or rejected if spill is nil.
+	limit int64
+	used  int64
+	spill ControlledStorage
 }
 
 func NewInMemoryStorage() *InMemoryStorage {
@@ -30,27 +46,43 @@ func NewInMemoryStorage() *InMemoryStorage {
 	id := hex.EncodeToString(idBytes)
 
 	return &InMemoryStorage{
-		id:    id,
-		store: make(map[string][]byte),
+		id:     id,
+		store:  make(map[string][]byte),
+		stored: make(map[string]time.Time),
 	}
 }
 
+// WithMemoryLimit caps the number of bytes held in memory at limit. Blocks that
+// would exceed it are stored in spill instead or, if spill is nil, rejected
+// with ErrStorageFull. A limit of zero removes the cap.
+func (s *InMemoryStorage) WithMemoryLimit(limit int64, spill ControlledStorage) *InMemoryStorage {
+	s.limit = limit
+	s.spill = spill
+	return s
+}
+
 func (s *InMemoryStorage) ID() string {
 	return s.id
 }
 
 func (s *InMemoryStorage) Has(ctx context.Context, address string) bool {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
 	_, ok := s.store[address]
+	s.mu.RUnlock()
+	if !ok && s.spill != nil {
+		return s.spill.Has(ctx, address)
+	}
 	return ok
 }
 
 func (s *InMemoryStorage) Get(ctx context.Context, address string) (io.ReadCloser, bool) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
 	data, ok := s.store[address]
+	s.mu.RUnlock()
 	if !ok {
+		if s.spill != nil {
+			return s.spill.Get(ctx, address)
+		}
 		return nil, false
 	}
 	return io.NopCloser(bytes.NewReader(data)), true
@@ -64,14 +96,25 @@ func (s *InMemoryStorage) Store(ctx context.Context, r io.Reader) (string, error
 	hash := sha256.Sum256(data)
 	address := hex.EncodeToString(hash[:])
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.store[address] = data
-	s.notifySubscribers(address)
+	if err := s.put(ctx, address, data); err != nil {
+		return "", err
+	}
 	return address, nil
 }
 
+// StoreAt stores the stream at address. If the block is already present the
+// stream is not read.
 func (s *InMemoryStorage) StoreAt(ctx context.Context, address string, r io.Reader) (bool, error) {
+	s.mu.Lock()
+	_, ok := s.store[address]
+	if ok {
+		s.stored[address] = time.Now()
+	}
+	s.mu.Unlock()
+	if ok || (s.spill != nil && s.spill.Has(ctx, address)) {
+		return true, nil
+	}
+
 	data, err := io.ReadAll(r)
 	if err != nil {
 		return false, err
@@ -83,23 +126,75 @@ func (s *InMemoryStorage) StoreAt(ctx context.Context, address string, r io.Read
 		return false, nil
 	}
 
+	if err := s.put(ctx, address, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// put keeps data in memory if it fits within the limit, otherwise it is
+// written to the spill storage. A block already held in either place is not
+// stored again, so a block is never held by both.
+func (s *InMemoryStorage) put(ctx context.Context, address string, data []byte) error {
+	if s.spill != nil && s.spill.Has(ctx, address) {
+		return nil
+	}
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.store[address] = data
+	if _, ok := s.store[address]; ok {
+		s.stored[address] = time.Now()
+		s.mu.Unlock()
+		return nil
+	}
+	fits := s.limit <= 0 || s.used+int64(len(data)) <= s.limit
+	if fits {
+		s.store[address] = data
+		s.stored[address] = time.Now()
+		s.used += int64(len(data))
+	}
+	s.mu.Unlock()
+
+	if !fits {
+		if s.spill == nil {
+			return ErrStorageFull
+		}
+		// Spill outside the lock so a slow spill storage does not block
+		// readers of the blocks held in memory.
+		if _, err := s.spill.StoreAt(ctx, address, bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
 	s.notifySubscribers(address)
-	return true, nil
+	return nil
 }
 
 func (s *InMemoryStorage) Size(ctx context.Context, address string) (int64, bool) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
 	data, ok := s.store[address]
+	s.mu.RUnlock()
 	if !ok {
+		if s.spill != nil {
+			return s.spill.Size(ctx, address)
+		}
 		return 0, false
 	}
 	return int64(len(data)), true
 }
 
+// StoredAt returns when the block was last stored, by the spill storage for
+// spilled blocks.
+func (s *InMemoryStorage) StoredAt(ctx context.Context, address string) (time.Time, bool) {
+	s.mu.RLock()
+	at, ok := s.stored[address]
+	s.mu.RUnlock()
+	if !ok {
+		if timed, isTimed := s.spill.(TimedStorage); isTimed {
+			return timed.StoredAt(ctx, address)
+		}
+	}
+	return at, ok
+}
+
 func (s *InMemoryStorage) List(ctx context.Context, chunkSize int) <-chan []string {
 	if chunkSize <= 0 {
 		chunkSize = 10000
@@ -108,9 +203,8 @@ func (s *InMemoryStorage) List(ctx context.Context, chunkSize int) <-chan []stri
 
 	go func() {
 		defer close(ch)
-		s.mu.RLock()
-		defer s.mu.RUnlock()
 
+		s.mu.RLock()
 		var chunk []string
 		for addr := range s.store {
 			chunk = append(chunk, addr)
@@ -119,39 +213,46 @@ func (s *InMemoryStorage) List(ctx context.Context, chunkSize int) <-chan []stri
 				chunk = nil
 			}
 		}
+		s.mu.RUnlock()
 		if len(chunk) > 0 {
 			ch <- chunk
 		}
+
+		if s.spill != nil {
+			for spilled := range s.spill.List(ctx, chunkSize) {
+				ch <- spilled
+			}
+		}
 	}()
 
 	return ch
 }
 
 func (s *InMemoryStorage) Subscribe(ctx context.Context) <-chan string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	ch := make(chan string, 100)
-	s.subscribers = append(s.subscribers, ch)
-	return ch
+	return s.subscribers.subscribe(ctx)
 }
 
 func (s *InMemoryStorage) notifySubscribers(address string) {
-	// Not acquiring lock here because we are already holding mu.Lock() in Store/StoreAt
-	for _, ch := range s.subscribers {
-		select {
-		case ch <- address:
-		default:
-			// Subscriber is full or blocked, drop the notification
-		}
-	}
+	s.subscribers.notify(address)
 }
 
+// Remove removes the block from memory and from the spill storage.
 func (s *InMemoryStorage) Remove(ctx context.Context, address string) (bool, error) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	if _, ok := s.store[address]; !ok {
-		return false, nil
+	data, removed := s.store[address]
+	if removed {
+		delete(s.store, address)
+		delete(s.stored, address)
+		s.used -= int64(len(data))
 	}
-	delete(s.store, address)
-	return true, nil
+	s.mu.Unlock()
+
+	if s.spill != nil {
+		spilled, err := s.spill.Remove(ctx, address)
+		if err != nil {
+			return removed, err
+		}
+		removed = removed || spilled
+	}
+	return removed, nil
 }
@@ -48,3 +48,79 @@ func TestInMemoryStorageList(t *testing.T) {
 		t.Fatalf("List missing expected addresses: %v", list)
 	}
 }
+
+func TestInMemoryStorage_MemoryLimit(t *testing.T) {
+	ctx := context.Background()
+
+	mem := NewInMemoryStorage().WithMemoryLimit(10, nil)
+	if _, err := mem.Store(ctx, bytes.NewReader([]byte("12345678"))); err != nil {
+		t.Fatalf("Store error: %v", err)
+	}
+	if _, err := mem.Store(ctx, bytes.NewReader([]byte("abcdef"))); err != ErrStorageFull {
+		t.Fatalf("Expected ErrStorageFull, got %v", err)
+	}
+
+	// Storing a block that is already held does not count against the limit
+	if _, err := mem.Store(ctx, bytes.NewReader([]byte("12345678"))); err != nil {
+		t.Fatalf("Store error: %v", err)
+	}
+
+	spill := NewFileSystemStorage(t.TempDir())
+	mem = NewInMemoryStorage().WithMemoryLimit(10, spill)
+	inMemory, err := mem.Store(ctx, bytes.NewReader([]byte("12345678")))
+	if err != nil {
+		t.Fatalf("Store error: %v", err)
+	}
+	spilled, err := mem.Store(ctx, bytes.NewReader([]byte("abcdef")))
+	if err != nil {
+		t.Fatalf("Store error: %v", err)
+	}
+	if !spill.Has(ctx, spilled) || spill.Has(ctx, inMemory) {
+		t.Fatal("Expected only the block exceeding the limit to be spilled")
+	}
+
+	for _, address := range []string{inMemory, spilled} {
+		if !mem.Has(ctx, address) {
+			t.Fatalf("Expected Has to find %s", address)
+		}
+		if _, ok := mem.Size(ctx, address); !ok {
+			t.Fatalf("Expected Size to find %s", address)
+		}
+		r, ok := mem.Get(ctx, address)
+		if !ok {
+			t.Fatalf("Expected Get to find %s", address)
+		}
+		r.Close()
+	}
+
+	var list []string
+	for chunk := range mem.List(ctx, 10) {
+		list = append(list, chunk...)
+	}
+	if len(list) != 2 {
+		t.Fatalf("Expected List to include spilled blocks, got %v", list)
+	}
+
+	// Once memory is freed, storing a spilled block again does not also keep
+	// it in memory
+	if _, err := mem.Remove(ctx, inMemory); err != nil {
+		t.Fatalf("Remove error: %v", err)
+	}
+	if _, err := mem.Store(ctx, bytes.NewReader([]byte("abcdef"))); err != nil {
+		t.Fatalf("Store error: %v", err)
+	}
+	list = nil
+	for chunk := range mem.List(ctx, 10) {
+		list = append(list, chunk...)
+	}
+	if len(list) != 1 || list[0] != spilled {
+		t.Fatalf("Expected List to return the spilled block once, got %v", list)
+	}
+
+	if ok, err := mem.Remove(ctx, spilled); err != nil || !ok {
+		t.Fatalf("Expected Remove to delete the spilled block, got %v (err: %v)", ok, err)
+	}
+	if mem.Has(ctx, spilled) {
+		t.Fatal("Expected the spilled block to be removed")
+	}
+}
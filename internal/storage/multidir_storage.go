@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// bufferedStoreLimit is the size of the largest block Store hashes in memory
+// before placing it. Larger blocks are spooled to a temporary file.
+const bufferedStoreLimit = 4 * 1024 * 1024
+
+// MultiDirectoryStorage spreads blocks over several directories, typically on
+// separate disks, without RAID. Each block is placed by rendezvous hashing of
+// its address weighted by the capacity of each directory, so adding a
+// directory only moves the blocks it takes over. A block goes to the next
+// directory in its order when a directory is full, and reads look in the same
+// order.
+type MultiDirectoryStorage struct {
+	dirs []*storageDirectory
+
+	subscribers subscriberList
+}
+
+// DirectoryUsage reports the capacity and use of a directory of a
+// MultiDirectoryStorage.
+type DirectoryUsage struct {
+	Path     string `json:"path"`
+	Capacity int64  `json:"capacity"` // 0 if unknown
+	Used     int64  `json:"used"`
+}
+
+type storageDirectory struct {
+	*FileSystemStorage
+	capacity int64 // bytes, 0 if unknown
+	weight   float64
+	used     atomic.Int64
+}
+
+// Assert that MultiDirectoryStorage implements the ControlledStorage interface
+var _ ControlledStorage = (*MultiDirectoryStorage)(nil)
+
+// Assert that MultiDirectoryStorage records when its blocks were stored
+var _ TimedStorage = (*MultiDirectoryStorage)(nil)
+
+// NewMultiDirectoryStorage spreads blocks over dirs. The capacity of each
+// directory is the corresponding entry of capacities or, when that is zero,
+// the size of the file system holding it. A directory of unknown capacity is
+// never full and is weighted as the average of the others. The space used in
+// each directory is measured in the background.
+func NewMultiDirectoryStorage(dirs []*FileSystemStorage, capacities []int64) *MultiDirectoryStorage {
+	s := &MultiDirectoryStorage{}
+	var known float64
+	var count int
+	for i, d := range dirs {
+		dir := &storageDirectory{FileSystemStorage: d}
+		if i < len(capacities) && capacities[i] > 0 {
+			dir.capacity = capacities[i]
+		} else if capacity, ok := diskCapacity(d.baseDir); ok {
+			dir.capacity = capacity
+		}
+		if dir.capacity > 0 {
+			known += float64(dir.capacity)
+			count++
+		}
+		s.dirs = append(s.dirs, dir)
+	}
+	for _, dir := range s.dirs {
+		switch {
+		case dir.capacity > 0:
+			dir.weight = float64(dir.capacity)
+		case count > 0:
+			dir.weight = known / float64(count)
+		default:
+			dir.weight = 1
+		}
+		go dir.measure()
+	}
+	return s
+}
+
+// measure adds the size of the files in the directory to its used space.
+func (d *storageDirectory) measure() {
+	filepath.WalkDir(d.baseDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			d.used.Add(info.Size())
+		}
+		return nil
+	})
+}
+
+func (d *storageDirectory) full() bool {
+	return d.capacity > 0 && d.used.Load() >= d.capacity
+}
+
+// ID returns the ID of the first directory.
+func (s *MultiDirectoryStorage) ID() string {
+	return s.dirs[0].ID()
+}
+
+// Capacity returns the total capacity of the directories in bytes, counting
+// those of unknown capacity by their weight.
+func (s *MultiDirectoryStorage) Capacity() int64 {
+	var total float64
+	for _, dir := range s.dirs {
+		total += dir.weight
+	}
+	return int64(total)
+}
+
+// Usage reports the capacity and use of each directory.
+func (s *MultiDirectoryStorage) Usage() []DirectoryUsage {
+	usage := make([]DirectoryUsage, len(s.dirs))
+	for i, dir := range s.dirs {
+		usage[i] = DirectoryUsage{Path: dir.baseDir, Capacity: dir.capacity, Used: dir.used.Load()}
+	}
+	return usage
+}
+
+// order returns the directories in the order a block at address is placed
+// in. The score of a directory is its weight over the log of a hash of the
+// address and the directory ID, which picks each directory in proportion to
+// its weight.
+func (s *MultiDirectoryStorage) order(address string) []*storageDirectory {
+	type scored struct {
+		dir   *storageDirectory
+		score float64
+	}
+	scores := make([]scored, len(s.dirs))
+	for i, dir := range s.dirs {
+		sum := sha256.Sum256([]byte(address + dir.ID()))
+		h := (float64(binary.BigEndian.Uint64(sum[:8])) + 0.5) / math.MaxUint64
+		scores[i] = scored{dir: dir, score: -dir.weight / math.Log(min(h, 1-1e-16))}
+	}
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].score > scores[j].score })
+	dirs := make([]*storageDirectory, len(scores))
+	for i, sc := range scores {
+		dirs[i] = sc.dir
+	}
+	return dirs
+}
+
+// locate returns the directory holding address.
+func (s *MultiDirectoryStorage) locate(ctx context.Context, address string) (*storageDirectory, bool) {
+	for _, dir := range s.order(address) {
+		if dir.Has(ctx, address) {
+			return dir, true
+		}
+	}
+	return nil, false
+}
+
+func (s *MultiDirectoryStorage) Has(ctx context.Context, address string) bool {
+	_, ok := s.locate(ctx, address)
+	return ok
+}
+
+func (s *MultiDirectoryStorage) Get(ctx context.Context, address string) (io.ReadCloser, bool) {
+	dir, ok := s.locate(ctx, address)
+	if !ok {
+		return nil, false
+	}
+	return dir.Get(ctx, address)
+}
+
+func (s *MultiDirectoryStorage) Size(ctx context.Context, address string) (int64, bool) {
+	dir, ok := s.locate(ctx, address)
+	if !ok {
+		return 0, false
+	}
+	return dir.Size(ctx, address)
+}
+
+func (s *MultiDirectoryStorage) StoredAt(ctx context.Context, address string) (time.Time, bool) {
+	dir, ok := s.locate(ctx, address)
+	if !ok {
+		return time.Time{}, false
+	}
+	return dir.StoredAt(ctx, address)
+}
+
+// Store hashes the block to place it, in memory or, for large blocks, through
+// a temporary file in the first directory.
+func (s *MultiDirectoryStorage) Store(ctx context.Context, r io.Reader) (string, error) {
+	var head bytes.Buffer
+	if _, err := head.ReadFrom(io.LimitReader(r, bufferedStoreLimit+1)); err != nil {
+		return "", err
+	}
+	if head.Len() <= bufferedStoreLimit {
+		sum := sha256.Sum256(head.Bytes())
+		address := hex.EncodeToString(sum[:])
+		if _, err := s.StoreAt(ctx, address, &head); err != nil {
+			return "", err
+		}
+		return address, nil
+	}
+
+	tmp, err := os.CreateTemp(s.dirs[0].baseDir, "upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), io.MultiReader(&head, r)); err != nil {
+		return "", err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	address := hex.EncodeToString(hasher.Sum(nil))
+	if _, err := s.StoreAt(ctx, address, tmp); err != nil {
+		return "", err
+	}
+	return address, nil
+}
+
+// StoreAt stores the block in the first directory in its order that is not
+// full. If the block is already present the stream is not read.
+func (s *MultiDirectoryStorage) StoreAt(ctx context.Context, address string, r io.Reader) (bool, error) {
+	order := s.order(address)
+	for _, dir := range order {
+		if dir.Has(ctx, address) {
+			// Refreshes when the block was stored without reading the stream
+			return dir.StoreAt(ctx, address, r)
+		}
+	}
+	for _, dir := range order {
+		if dir.full() {
+			continue
+		}
+		ok, err := dir.StoreAt(ctx, address, r)
+		if err != nil || !ok {
+			return ok, err
+		}
+		if size, ok := dir.Size(ctx, address); ok {
+			dir.used.Add(size)
+		}
+		s.notifySubscribers(address)
+		return true, nil
+	}
+	return false, ErrStorageFull
+}
+
+// Remove deletes the block from every directory holding it.
+func (s *MultiDirectoryStorage) Remove(ctx context.Context, address string) (bool, error) {
+	removed := false
+	for _, dir := range s.dirs {
+		size, _ := dir.Size(ctx, address)
+		ok, err := dir.Remove(ctx, address)
+		if ok {
+			dir.used.Add(-size)
+			removed = true
+		}
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// List lists the blocks of each directory in turn.
+func (s *MultiDirectoryStorage) List(ctx context.Context, chunkSize int) <-chan []string {
+	ch := make(chan []string)
+	go func() {
+		defer close(ch)
+		for _, dir := range s.dirs {
+			for chunk := range dir.List(ctx, chunkSize) {
+				select {
+				case ch <- chunk:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+func (s *MultiDirectoryStorage) Subscribe(ctx context.Context) <-chan string {
+	return s.subscribers.subscribe(ctx)
+}
+
+func (s *MultiDirectoryStorage) notifySubscribers(address string) {
+	s.subscribers.notify(address)
+}
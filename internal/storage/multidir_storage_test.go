@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMultiDirectoryStorage(t *testing.T) {
+	ctx := context.Background()
+	large := NewFileSystemStorage(t.TempDir())
+	small := NewFileSystemStorage(t.TempDir())
+	s := NewMultiDirectoryStorage([]*FileSystemStorage{large, small}, []int64{3 << 30, 1 << 30})
+
+	// Blocks are placed in proportion to capacity and read back from any
+	// directory
+	var addresses []string
+	for i := range 400 {
+		address, err := s.Store(ctx, strings.NewReader(fmt.Sprintf("block %d", i)))
+		if err != nil {
+			t.Fatalf("Store failed: %v", err)
+		}
+		addresses = append(addresses, address)
+	}
+	inLarge := 0
+	for _, address := range addresses {
+		if large.Has(ctx, address) {
+			inLarge++
+		} else if !small.Has(ctx, address) {
+			t.Fatalf("block %s is in neither directory", address)
+		}
+		if !s.Has(ctx, address) {
+			t.Errorf("Has(%s) = false", address)
+		}
+	}
+	if inLarge < 250 || inLarge > 350 {
+		t.Errorf("expected about 300 of 400 blocks in the larger directory, got %d", inLarge)
+	}
+
+	listed := 0
+	for chunk := range s.List(ctx, 100) {
+		listed += len(chunk)
+	}
+	if listed != len(addresses) {
+		t.Errorf("listed %d blocks, want %d", listed, len(addresses))
+	}
+
+	// A full directory is skipped
+	s.dirs[0].used.Store(s.dirs[0].capacity)
+	for i := range 20 {
+		address, err := s.Store(ctx, strings.NewReader(fmt.Sprintf("overflow %d", i)))
+		if err != nil {
+			t.Fatalf("Store failed: %v", err)
+		}
+		if large.Has(ctx, address) || !small.Has(ctx, address) {
+			t.Errorf("block %s was not stored in the directory with room", address)
+		}
+	}
+	s.dirs[1].used.Store(s.dirs[1].capacity)
+	if _, err := s.Store(ctx, strings.NewReader("no room")); err != ErrStorageFull {
+		t.Errorf("expected ErrStorageFull, got %v", err)
+	}
+
+	// Blocks larger than the in-memory limit are spooled while hashed
+	s.dirs[0].used.Store(0)
+	data := bytes.Repeat([]byte("x"), bufferedStoreLimit+1)
+	address, err := s.Store(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Store of a large block failed: %v", err)
+	}
+	rc, ok := s.Get(ctx, address)
+	if !ok {
+		t.Fatalf("large block not found")
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(got, data) {
+		t.Errorf("large block read back %d bytes, want %d", len(got), len(data))
+	}
+
+	if removed, err := s.Remove(ctx, address); err != nil || !removed {
+		t.Errorf("Remove = %v, %v", removed, err)
+	}
+	if s.Has(ctx, address) {
+		t.Errorf("removed block still present")
+	}
+}
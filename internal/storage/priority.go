@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// PriorityHeader is the request header a client sets to tell a storage server
+// how urgent a request is. Requests without it are interactive.
+const PriorityHeader = "Invariant-Priority"
+
+// Priority is the urgency of a storage request.
+type Priority string
+
+const (
+	// PriorityInteractive is the priority of requests someone is waiting on,
+	// such as the reads of a mounted file system.
+	PriorityInteractive Priority = "interactive"
+	// PriorityBackground is the priority of bulk transfers, such as the
+	// repairs of the distribute service, that can wait for interactive
+	// requests.
+	PriorityBackground Priority = "background"
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx whose storage requests have priority p.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityOf returns the priority of the storage requests made with ctx.
+func PriorityOf(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityInteractive
+}
+
+// priorityTransport sets PriorityHeader on the requests made with a context
+// that has a priority.
+type priorityTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *priorityTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if p, ok := req.Context().Value(priorityKey{}).(Priority); ok && req.Header.Get(PriorityHeader) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(PriorityHeader, string(p))
+	}
+	return t.transport.RoundTrip(req)
+}
+
+const (
+	// backgroundChunk is the most a background request transfers between
+	// checks for interactive requests.
+	backgroundChunk = 32 * 1024
+	// backgroundYield is how long a background request pauses for each chunk
+	// while interactive requests are active.
+	backgroundYield = 10 * time.Millisecond
+)
+
+// scheduler runs background requests behind interactive ones: only a limited
+// number of background requests run at a time and they slow down while any
+// interactive request is active.
+type scheduler struct {
+	interactive atomic.Int64
+	background  chan struct{} // nil for no limit
+}
+
+func newScheduler(backgroundLimit int) *scheduler {
+	s := &scheduler{}
+	if backgroundLimit > 0 {
+		s.background = make(chan struct{}, backgroundLimit)
+	}
+	return s
+}
+
+// wrap schedules the requests to next by their PriorityHeader. The priority
+// is kept in the request context so requests made on behalf of a request,
+// such as those of POST /fetch, inherit it.
+func (s *scheduler) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A subscription stays open indefinitely and transfers little
+		if r.URL.Path == "/subscribe" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if Priority(r.Header.Get(PriorityHeader)) != PriorityBackground {
+			s.interactive.Add(1)
+			defer s.interactive.Add(-1)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		if s.background != nil {
+			select {
+			case s.background <- struct{}{}:
+				defer func() { <-s.background }()
+			case <-ctx.Done():
+				return
+			}
+		}
+		r = r.WithContext(WithPriority(ctx, PriorityBackground))
+		if r.Body != nil {
+			r.Body = &backgroundBody{ReadCloser: r.Body, ctx: ctx, s: s}
+		}
+		next.ServeHTTP(&backgroundResponseWriter{ResponseWriter: w, ctx: ctx, s: s}, r)
+	})
+}
+
+// yield pauses a background transfer while interactive requests are active.
+func (s *scheduler) yield(ctx context.Context) error {
+	if s.interactive.Load() == 0 {
+		return nil
+	}
+	timer := time.NewTimer(backgroundYield)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type backgroundBody struct {
+	io.ReadCloser
+	ctx context.Context
+	s   *scheduler
+}
+
+func (r *backgroundBody) Read(buf []byte) (int, error) {
+	if err := r.s.yield(r.ctx); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(buf[:min(len(buf), backgroundChunk)])
+}
+
+type backgroundResponseWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+	s   *scheduler
+}
+
+func (w *backgroundResponseWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		if err := w.s.yield(w.ctx); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(data[:min(len(data), backgroundChunk)])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		data = data[n:]
+	}
+	return written, nil
+}
+
+func (w *backgroundResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *backgroundResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -12,7 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -25,14 +25,16 @@ type S3Storage struct {
 	bucket      string
 	prefix      string
 	id          string
-	mu          sync.RWMutex
-	subscribers []chan string
+	subscribers subscriberList
 }
 
 // Assert that S3Storage implements the ControlledStorage interface
 var _ ControlledStorage = (*S3Storage)(nil)
 var _ Storage = (*S3Storage)(nil)
 
+// Assert that S3Storage records when its blocks were stored
+var _ TimedStorage = (*S3Storage)(nil)
+
 // Assert that S3Storage implements the identity.Provider interface
 var _ identity.Identity = (*S3Storage)(nil)
 
@@ -222,6 +224,19 @@ func (s *S3Storage) Size(ctx context.Context, address string) (int64, bool) {
 	return 0, true
 }
 
+// StoredAt returns when the object of the block was last written. StoreAt
+// always writes the object, so it is refreshed when a block is stored again.
+func (s *S3Storage) StoredAt(ctx context.Context, address string) (time.Time, bool) {
+	resp, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.addressToKey(address)),
+	})
+	if err != nil || resp.LastModified == nil {
+		return time.Time{}, false
+	}
+	return *resp.LastModified, true
+}
+
 func (s *S3Storage) List(ctx context.Context, chunkSize int) <-chan []string {
 	if chunkSize <= 0 {
 		chunkSize = 1000
@@ -279,22 +294,11 @@ func (s *S3Storage) List(ctx context.Context, chunkSize int) <-chan []string {
 }
 
 func (s *S3Storage) Subscribe(ctx context.Context) <-chan string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	ch := make(chan string, 100)
-	s.subscribers = append(s.subscribers, ch)
-	return ch
+	return s.subscribers.subscribe(ctx)
 }
 
 func (s *S3Storage) notifySubscribers(address string) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	for _, ch := range s.subscribers {
-		select {
-		case ch <- address:
-		default:
-		}
-	}
+	s.subscribers.notify(address)
 }
 
 func (s *S3Storage) Remove(ctx context.Context, address string) (bool, error) {
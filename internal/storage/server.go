@@ -1,22 +1,46 @@
 package storage
 
 import (
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"invariant/internal/cap"
 	"invariant/internal/discovery"
 	"invariant/internal/identity"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// DefaultBackgroundLimit is the number of background requests a storage
+// server runs at a time unless configured otherwise.
+const DefaultBackgroundLimit = 4
+
+// DefaultMaxBlockSize is the size of the largest block a storage server
+// accepts unless configured otherwise.
+const DefaultMaxBlockSize = 64 * 1024 * 1024
+
 type StorageServer struct {
 	id        string
+	key       *identity.KeyPair
 	storage   Storage
 	discovery discovery.Discovery
+	bandwidth *bandwidth
+	scheduler *scheduler
+	compress  bool
+	wants     *wantList
+	closure   ClosureWalker
+
+	maxBlockSize  int64
+	collect       bool
+	collectGrace  time.Duration
+	retainedRoots RetainedRoots
 }
 
 func NewStorageServer(storage Storage) *StorageServer {
@@ -30,8 +54,15 @@ func NewStorageServer(storage Storage) *StorageServer {
 	}
 
 	return &StorageServer{
-		id:      id,
-		storage: storage,
+		id:        id,
+		storage:   storage,
+		bandwidth: newBandwidth(0),
+		scheduler: newScheduler(DefaultBackgroundLimit),
+		compress:  true,
+		wants:     newWantList(),
+
+		maxBlockSize: DefaultMaxBlockSize,
+		collectGrace: DefaultCollectGrace,
 	}
 }
 
@@ -40,6 +71,49 @@ type NotifyClient interface {
 	Notify(storageID string, addresses []string) error
 }
 
+// WithKeyPair identifies the server by the ID of key, which it proves by
+// answering challenges to GET /id.
+func (s *StorageServer) WithKeyPair(key *identity.KeyPair) *StorageServer {
+	s.id = key.ID()
+	s.key = key
+	return s
+}
+
+// WithBandwidthLimit limits the bytes served to and received from each peer
+// to a total of bytesPerSecond, so one aggressive consumer cannot starve the
+// others. Zero removes the limit. Peers are identified by the ID of their
+// capability token or, for requests without one, by their IP address.
+func (s *StorageServer) WithBandwidthLimit(bytesPerSecond int64) *StorageServer {
+	s.bandwidth = newBandwidth(bytesPerSecond)
+	return s
+}
+
+// WithBackgroundLimit limits the number of requests with background priority
+// served at a time to limit, queuing the others. Zero removes the limit.
+// Background requests slow down while interactive requests are active either
+// way.
+func (s *StorageServer) WithBackgroundLimit(limit int) *StorageServer {
+	s.scheduler = newScheduler(limit)
+	return s
+}
+
+// WithTransferCompression sets whether blocks are sent gzip compressed to
+// clients that accept it and whether compressed uploads are accepted. Only
+// blocks whose start compresses well are compressed; disabling compression
+// saves the sampling on servers holding only encrypted blocks.
+func (s *StorageServer) WithTransferCompression(compress bool) *StorageServer {
+	s.compress = compress
+	return s
+}
+
+// WithMaxBlockSize limits the blocks stored to size bytes once decoded, so a
+// small compressed upload cannot expand to an unbounded block. Zero removes
+// the limit.
+func (s *StorageServer) WithMaxBlockSize(size int64) *StorageServer {
+	s.maxBlockSize = size
+	return s
+}
+
 // WithDiscovery sets the discovery client used by the storage server
 // to locate other storage nodes for fetching operations.
 func (s *StorageServer) WithDiscovery(d discovery.Discovery) *StorageServer {
@@ -111,12 +185,19 @@ func (s *StorageServer) Handler() http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("GET /id", s.handleGetID)
+	mux.HandleFunc("GET /stats", s.handleStats)
+	mux.HandleFunc("GET /subscribe", s.handleSubscribe)
 
 	mux.HandleFunc("POST /{$}", s.handlePost)
 
 	mux.HandleFunc("POST /fetch", s.handleFetch)
 	mux.HandleFunc("HEAD /fetch", s.handleFetch)
 
+	mux.HandleFunc("POST /collect", s.handleCollect)
+
+	mux.HandleFunc("GET /wants", s.handleGetWants)
+	mux.HandleFunc("POST /wants", s.handlePostWants)
+
 	mux.HandleFunc("GET /{address}", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodHead {
 			s.handleHead(w, r)
@@ -125,8 +206,17 @@ func (s *StorageServer) Handler() http.Handler {
 		}
 	})
 	mux.HandleFunc("PUT /{address}", s.handlePut)
-
-	return mux
+	mux.HandleFunc("DELETE /{address}", s.handleDelete)
+
+	var handler http.Handler = mux
+	if s.compress {
+		// Tell clients they can upload compressed blocks
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Accept-Encoding", "gzip")
+			mux.ServeHTTP(w, r)
+		})
+	}
+	return s.bandwidth.wrap(s.scheduler.wrap(handler))
 }
 
 func (s *StorageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -134,8 +224,54 @@ func (s *StorageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *StorageServer) handleGetID(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(s.id))
+	identity.ServeID(w, r, s.id, s.key)
+}
+
+// handleStats reports the bytes served to and received from each peer.
+func (s *StorageServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.bandwidth.stats())
+}
+
+// handleSubscribe streams the addresses of newly stored blocks to the caller
+// as server-sent events. Each event carries a single address in its data field.
+func (s *StorageServer) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	cStorage, ok := s.storage.(ControlledStorage)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Internal Server Error: streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before writing the headers so that a client which has received
+	// the response is guaranteed to observe every block stored afterwards.
+	sub := cStorage.Subscribe(r.Context())
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case addr, ok := <-sub:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", addr); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
 }
 
 func (s *StorageServer) handleFetch(w http.ResponseWriter, r *http.Request) {
@@ -161,10 +297,18 @@ func (s *StorageServer) handleFetch(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	if reqBody.Address == "" || reqBody.Container == "" {
+	if (reqBody.Address == "" && len(reqBody.Addresses) == 0 && len(reqBody.Root) == 0) || reqBody.Container == "" {
 		http.Error(w, "Bad Request: missing address or container", http.StatusBadRequest)
 		return
 	}
+	if len(reqBody.Root) > 0 {
+		s.fetchClosure(w, r, reqBody)
+		return
+	}
+	if len(reqBody.Addresses) > 0 {
+		s.fetchBatch(w, r, reqBody)
+		return
+	}
 
 	// Local optimization: if we already have it, just return success
 	if s.storage.Has(r.Context(), reqBody.Address) {
@@ -199,15 +343,80 @@ func (s *StorageServer) handleFetch(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// fetchBatch stores the blocks of req it does not already have, read one
+// after another from the container over a persistent connection, and responds
+// with the addresses it could not fetch.
+func (s *StorageServer) fetchBatch(w http.ResponseWriter, r *http.Request, req StorageFetchRequest) {
+	if len(req.Addresses) > MaxFetchBatch {
+		http.Error(w, fmt.Sprintf("Bad Request: more than %d addresses", MaxFetchBatch), http.StatusBadRequest)
+		return
+	}
+	desc, ok := s.discovery.Get(r.Context(), req.Container)
+	if !ok {
+		http.Error(w, "Bad Gateway: container not found in discovery", http.StatusBadGateway)
+		return
+	}
+	resp := StorageFetchResponse{Failed: s.fetchFrom(r.Context(), NewClient(desc.Address, nil), req.Addresses)}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// fetchFrom stores the blocks at addresses it does not already have, read
+// one after another from remote over a persistent connection, and returns
+// the addresses it could not fetch.
+func (s *StorageServer) fetchFrom(ctx context.Context, remote *Client, addresses []string) []string {
+	failed := []string{}
+	for i, address := range addresses {
+		if ctx.Err() != nil {
+			failed = append(failed, addresses[i:]...)
+			break
+		}
+		if s.storage.Has(ctx, address) {
+			continue
+		}
+		data, ok := remote.Get(ctx, address)
+		if !ok {
+			failed = append(failed, address)
+			continue
+		}
+		success, err := s.storage.StoreAt(ctx, address, data)
+		// Drain the body so the connection is reused for the next block
+		io.Copy(io.Discard, data)
+		data.Close()
+		if err != nil || !success {
+			failed = append(failed, address)
+		}
+	}
+	return failed
+}
+
 func (s *StorageServer) handlePost(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	address, err := s.storage.Store(r.Context(), r.Body)
+	body, err := s.requestBody(r)
+	if errors.Is(err, errUnsupportedEncoding) {
+		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	address, err := s.storage.Store(r.Context(), body)
 	if err != nil {
+		if errors.Is(err, ErrStorageFull) {
+			http.Error(w, "Insufficient Storage", http.StatusInsufficientStorage)
+			return
+		}
+		if errors.Is(err, errBlockTooLarge) {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
 
+	s.wants.remove(address)
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(address))
@@ -217,19 +426,80 @@ func (s *StorageServer) handlePut(w http.ResponseWriter, r *http.Request) {
 	address := r.PathValue("address")
 	defer r.Body.Close()
 
-	success, err := s.storage.StoreAt(r.Context(), address, r.Body)
+	// Respond without reading the body when the block is already stored. A
+	// client that sent "Expect: 100-continue" then never sends the body.
+	if s.storage.Has(r.Context(), address) {
+		s.wants.remove(address)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(address))
+		return
+	}
+
+	body, err := s.requestBody(r)
+	if errors.Is(err, errUnsupportedEncoding) {
+		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	success, err := s.storage.StoreAt(r.Context(), address, body)
+	if errors.Is(err, ErrStorageFull) {
+		http.Error(w, "Insufficient Storage", http.StatusInsufficientStorage)
+		return
+	}
+	if errors.Is(err, errBlockTooLarge) {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil || !success {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
 
+	s.wants.remove(address)
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(address))
 }
 
+// blockCacheControl lets HTTP caches keep blocks for a year without
+// revalidating them, as the content of an address never changes.
+const blockCacheControl = "public, max-age=31536000, immutable"
+
+// notModified reports whether the If-None-Match header of r names address,
+// and so the block the client already has. Quoted and weak tags are
+// compared by their opaque value.
+func notModified(r *http.Request, address string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for candidate := range strings.SplitSeq(header, ",") {
+		candidate = strings.Trim(strings.TrimPrefix(strings.TrimSpace(candidate), "W/"), `"`)
+		if candidate == "*" || candidate == address {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotModified answers a conditional request for a block the server has
+// and the client already has with 304 Not Modified.
+func writeNotModified(w http.ResponseWriter, address string) {
+	w.Header().Set("Cache-Control", blockCacheControl)
+	w.Header().Set("ETag", address)
+	w.WriteHeader(http.StatusNotModified)
+}
+
 func (s *StorageServer) handleGet(w http.ResponseWriter, r *http.Request) {
 	address := r.PathValue("address")
+	if notModified(r, address) && s.storage.Has(r.Context(), address) {
+		writeNotModified(w, address)
+		return
+	}
 	data, ok := s.storage.Get(r.Context(), address)
 	if !ok {
 		http.Error(w, "Not Found", http.StatusNotFound)
@@ -238,16 +508,71 @@ func (s *StorageServer) handleGet(w http.ResponseWriter, r *http.Request) {
 	defer data.Close()
 
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Cache-Control", "immutable")
+	w.Header().Set("Cache-Control", blockCacheControl)
 	w.Header().Set("ETag", address)
 
+	var body io.Reader = data
+	if s.compress {
+		w.Header().Set("Vary", "Accept-Encoding")
+		if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			var worthwhile bool
+			body, worthwhile = sampleBlock(data)
+			if worthwhile {
+				w.Header().Set("Content-Encoding", "gzip")
+				w.WriteHeader(http.StatusOK)
+				zw := gzip.NewWriter(w)
+				io.Copy(zw, body)
+				zw.Close()
+				return
+			}
+		}
+	}
+
 	size, ok := s.storage.Size(r.Context(), address)
 	if ok {
 		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 	}
 
 	w.WriteHeader(http.StatusOK)
-	io.Copy(w, data)
+	io.Copy(w, body)
+}
+
+// requestBody returns the decoded body of r, rejecting compressed bodies
+// unless transfer compression is enabled. The decoded body is limited to the
+// largest block the server, and the capability token of the request,
+// allow.
+func (s *StorageServer) requestBody(r *http.Request) (io.Reader, error) {
+	if enc := r.Header.Get("Content-Encoding"); !s.compress && enc != "" && enc != "identity" {
+		return nil, errUnsupportedEncoding
+	}
+	limit := s.maxBlockSize
+	if limit == 0 {
+		limit = -1
+	}
+	if tokenLimit, ok := cap.StoreLimit(r.Context()); ok && (limit < 0 || tokenLimit < limit) {
+		limit = max(tokenLimit, 0)
+	}
+	return requestBody(r, limit)
+}
+
+func (s *StorageServer) handleDelete(w http.ResponseWriter, r *http.Request) {
+	cStorage, ok := s.storage.(ControlledStorage)
+	if !ok {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	removed, err := cStorage.Remove(r.Context(), r.PathValue("address"))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
 }
 
 func (s *StorageServer) handleHead(w http.ResponseWriter, r *http.Request) {
@@ -257,8 +582,13 @@ func (s *StorageServer) handleHead(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Not Found", http.StatusNotFound)
 		return
 	}
+	if notModified(r, address) {
+		writeNotModified(w, address)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", blockCacheControl)
 	w.Header().Set("ETag", address)
 	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 
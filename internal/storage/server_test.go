@@ -2,15 +2,22 @@ package storage
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"invariant/internal/cap"
 	"invariant/internal/discovery"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestStorageServer(t *testing.T) {
@@ -80,7 +87,9 @@ func TestStorageServer(t *testing.T) {
 
 	// 5. PUT /:address
 	newContent := []byte("new content")
-	req, _ = http.NewRequest(http.MethodPut, ts.URL+"/"+address, bytes.NewReader(newContent))
+	missingHash := sha256.Sum256([]byte("missing content"))
+	missingAddress := hex.EncodeToString(missingHash[:])
+	req, _ = http.NewRequest(http.MethodPut, ts.URL+"/"+missingAddress, bytes.NewReader(newContent))
 	res, err = client.Do(req)
 	if err != nil {
 		t.Fatal(err)
@@ -90,6 +99,17 @@ func TestStorageServer(t *testing.T) {
 		t.Errorf("expected 400 Bad Request, got %d", res.StatusCode)
 	}
 
+	// An existing block is acknowledged without reading the body
+	req, _ = http.NewRequest(http.MethodPut, ts.URL+"/"+address, bytes.NewReader(newContent))
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 OK for an existing block, got %d", res.StatusCode)
+	}
+
 	hash2 := sha256.Sum256(newContent)
 	newExpectedHash := hex.EncodeToString(hash2[:])
 	req, _ = http.NewRequest(http.MethodPut, ts.URL+"/"+newExpectedHash, bytes.NewReader(newContent))
@@ -127,7 +147,11 @@ type mockDiscovery struct {
 }
 
 func (m *mockDiscovery) Find(ctx context.Context, protocol string, count int) ([]discovery.ServiceDescription, error) {
-	return nil, nil // Not needed for this test
+	var result []discovery.ServiceDescription
+	for _, desc := range m.services {
+		result = append(result, desc)
+	}
+	return result, nil
 }
 
 func (m *mockDiscovery) Get(ctx context.Context, id string) (discovery.ServiceDescription, bool) {
@@ -139,6 +163,49 @@ func (m *mockDiscovery) Register(ctx context.Context, reg discovery.ServiceRegis
 	return nil
 }
 
+func TestStorageServerConditionalGet(t *testing.T) {
+	store := NewInMemoryStorage()
+	ts := httptest.NewServer(NewStorageServer(store))
+	defer ts.Close()
+
+	address, _ := store.Store(context.Background(), strings.NewReader("conditional"))
+	missing := strings.Repeat("0", 64)
+
+	get := func(method, address, ifNoneMatch string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+"/"+address, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return res
+	}
+
+	res := get(http.MethodGet, address, "")
+	if res.StatusCode != http.StatusOK || !strings.Contains(res.Header.Get("Cache-Control"), "max-age=") {
+		t.Errorf("expected 200 with a max-age, got %d %q", res.StatusCode, res.Header.Get("Cache-Control"))
+	}
+	for _, tag := range []string{address, `"` + address + `"`, `W/"other", "` + address + `"`, "*"} {
+		if res := get(http.MethodGet, address, tag); res.StatusCode != http.StatusNotModified || res.Header.Get("ETag") != address {
+			t.Errorf("If-None-Match %s: expected 304, got %d", tag, res.StatusCode)
+		}
+	}
+	if res := get(http.MethodHead, address, address); res.StatusCode != http.StatusNotModified {
+		t.Errorf("HEAD: expected 304, got %d", res.StatusCode)
+	}
+	if res := get(http.MethodGet, address, `"other"`); res.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 for another tag, got %d", res.StatusCode)
+	}
+	if res := get(http.MethodGet, missing, missing); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing block, got %d", res.StatusCode)
+	}
+}
+
 func TestStorageServer_Fetch(t *testing.T) {
 	// Source server (the remote node that has the data)
 	sourceStorage := NewInMemoryStorage()
@@ -208,3 +275,538 @@ func TestStorageServer_Fetch(t *testing.T) {
 		t.Errorf("expected 502 Bad Gateway for missing node, got %d", resBadFetch.StatusCode)
 	}
 }
+
+func TestStorageServer_FetchBatch(t *testing.T) {
+	ctx := context.Background()
+	sourceStorage := NewInMemoryStorage()
+	var addresses []string
+	for _, data := range []string{"first block", "second block"} {
+		address, _ := sourceStorage.Store(ctx, strings.NewReader(data))
+		addresses = append(addresses, address)
+	}
+	sourceTS := httptest.NewServer(NewStorageServer(sourceStorage))
+	defer sourceTS.Close()
+
+	sourceID := "remote-node-id-12345"
+	disc := &mockDiscovery{
+		services: map[string]discovery.ServiceDescription{
+			sourceID: {ID: sourceID, Address: sourceTS.URL},
+		},
+	}
+	destStorage := NewInMemoryStorage()
+	destTS := httptest.NewServer(NewStorageServer(destStorage).WithDiscovery(disc))
+	defer destTS.Close()
+
+	missing := "0101010101010101010101010101010101010101010101010101010101010101"
+	failed, err := NewClient(destTS.URL, nil).FetchBatch(ctx, append(addresses, missing), sourceID)
+	if err != nil {
+		t.Fatalf("FetchBatch failed: %v", err)
+	}
+	if len(failed) != 1 || failed[0] != missing {
+		t.Errorf("expected only %s to fail, got %v", missing, failed)
+	}
+	for _, address := range addresses {
+		if !destStorage.Has(ctx, address) {
+			t.Errorf("destination storage did not save %s", address)
+		}
+	}
+}
+
+func TestStorageServer_FetchClosure(t *testing.T) {
+	ctx := context.Background()
+	sourceStorage := NewInMemoryStorage()
+	var leaves []string
+	for _, data := range []string{"first block", "second block", "third block"} {
+		address, _ := sourceStorage.Store(ctx, strings.NewReader(data))
+		leaves = append(leaves, address)
+	}
+	missing := "0101010101010101010101010101010101010101010101010101010101010101"
+	index, _ := sourceStorage.Store(ctx, strings.NewReader(strings.Join(append(leaves, missing), "\n")))
+	sourceTS := httptest.NewServer(NewStorageServer(sourceStorage))
+	defer sourceTS.Close()
+
+	sourceID := "remote-node-id-12345"
+	disc := &mockDiscovery{
+		services: map[string]discovery.ServiceDescription{
+			sourceID: {ID: sourceID, Address: sourceTS.URL},
+		},
+	}
+
+	// The root is the address of a block listing the others
+	walk := func(ctx context.Context, root json.RawMessage, store Storage, fn func(string) error) error {
+		var address string
+		json.Unmarshal(root, &address)
+		fn(address)
+		rc, ok := store.Get(ctx, address)
+		if !ok {
+			return fmt.Errorf("missing %s", address)
+		}
+		defer rc.Close()
+		data, _ := io.ReadAll(rc)
+		for _, child := range strings.Split(string(data), "\n") {
+			fn(child)
+		}
+		return nil
+	}
+	destStorage := NewInMemoryStorage()
+	destStorage.Store(ctx, strings.NewReader("first block"))
+	destTS := httptest.NewServer(NewStorageServer(destStorage).WithDiscovery(disc).WithClosureWalker(walk))
+	defer destTS.Close()
+
+	root, _ := json.Marshal(index)
+	resp, err := NewClient(destTS.URL, nil).FetchClosure(ctx, root, sourceID)
+	if err != nil {
+		t.Fatalf("FetchClosure failed: %v", err)
+	}
+	if resp.Blocks != 5 || resp.Present != 1 || resp.Fetched != 3 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if len(resp.Failed) != 1 || resp.Failed[0] != missing {
+		t.Errorf("expected only %s to fail, got %v", missing, resp.Failed)
+	}
+	for _, address := range append(leaves, index) {
+		if !destStorage.Has(ctx, address) {
+			t.Errorf("destination storage did not save %s", address)
+		}
+	}
+
+	// Servers without a walker do not support closures
+	plainTS := httptest.NewServer(NewStorageServer(NewInMemoryStorage()).WithDiscovery(disc))
+	defer plainTS.Close()
+	if _, err := NewClient(plainTS.URL, nil).FetchClosure(ctx, root, sourceID); !errors.Is(err, ErrClosureNotSupported) {
+		t.Errorf("expected ErrClosureNotSupported, got %v", err)
+	}
+}
+
+func TestStorageServer_Collect(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStorage()
+	put := func(data string) string {
+		address, _ := store.Store(ctx, strings.NewReader(data))
+		return address
+	}
+	kept := []string{put("kept leaf"), put("shared leaf")}
+	garbage := []string{put("garbage leaf"), put("old index")}
+	index := put(strings.Join(kept, "\n"))
+
+	// The root is the address of a block listing the others
+	walk := func(ctx context.Context, root json.RawMessage, store Storage, fn func(string) error) error {
+		var address string
+		json.Unmarshal(root, &address)
+		rc, ok := store.Get(ctx, address)
+		if !ok {
+			return fmt.Errorf("missing %s", address)
+		}
+		defer rc.Close()
+		fn(address)
+		data, _ := io.ReadAll(rc)
+		for _, child := range strings.Split(string(data), "\n") {
+			fn(child)
+		}
+		return nil
+	}
+	ts := httptest.NewServer(NewStorageServer(store).WithClosureWalker(walk).WithCollect(true))
+	defer ts.Close()
+	client := NewClient(ts.URL, nil)
+	root, _ := json.Marshal(index)
+
+	// Collection is disabled unless enabled
+	disabledTS := httptest.NewServer(NewStorageServer(store).WithClosureWalker(walk))
+	defer disabledTS.Close()
+	if _, err := NewClient(disabledTS.URL, nil).Collect(ctx, []json.RawMessage{root}, nil, false); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected collection to be forbidden, got %v", err)
+	}
+
+	// Blocks stored within the grace period are kept, as their roots may not
+	// be published yet
+	resp, err := client.Collect(ctx, []json.RawMessage{root}, nil, false)
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	if resp.Recent != 2 || resp.Removed != 0 || !store.Has(ctx, garbage[0]) {
+		t.Errorf("expected the recent garbage to be kept, got %+v", resp)
+	}
+	for address := range store.stored {
+		store.stored[address] = time.Now().Add(-2 * DefaultCollectGrace)
+	}
+
+	resp, err = client.Collect(ctx, []json.RawMessage{root}, nil, true)
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	if resp.Blocks != 5 || resp.Reachable != 3 || resp.Removed != 2 || !store.Has(ctx, garbage[0]) {
+		t.Errorf("unexpected dry run %+v", resp)
+	}
+
+	// A root that cannot be walked removes nothing
+	missing, _ := json.Marshal(strings.Repeat("01", 32))
+	if _, err := client.Collect(ctx, []json.RawMessage{root, missing}, nil, false); err == nil {
+		t.Errorf("expected a missing root to fail")
+	}
+
+	// Retained roots are kept as far as they can be walked
+	oldIndex, _ := json.Marshal(garbage[1])
+	resp, err = client.Collect(ctx, []json.RawMessage{root}, []json.RawMessage{oldIndex, missing}, true)
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	if resp.Removed != 1 {
+		t.Errorf("expected the retained root to be kept, got %+v", resp)
+	}
+
+	// The roots retained by the server are kept, and a collection fails if
+	// they cannot be read
+	var retainedErr error
+	retainedTS := httptest.NewServer(NewStorageServer(store).WithClosureWalker(walk).WithCollect(true).WithRetainedRoots(func(ctx context.Context) ([]json.RawMessage, error) {
+		return []json.RawMessage{oldIndex}, retainedErr
+	}))
+	defer retainedTS.Close()
+	resp, err = NewClient(retainedTS.URL, nil).Collect(ctx, []json.RawMessage{root}, nil, true)
+	if err != nil || resp.Removed != 1 {
+		t.Errorf("expected the root retained by the server to be kept, got %+v, %v", resp, err)
+	}
+	retainedErr = errors.New("slots unavailable")
+	if _, err := NewClient(retainedTS.URL, nil).Collect(ctx, []json.RawMessage{root}, nil, true); err == nil {
+		t.Errorf("expected the collection to fail without the retained roots")
+	}
+
+	// Only the unreferenced blocks given are considered, and those stored
+	// but kept are reported
+	absent := strings.Repeat("02", 32)
+	resp, err = client.CollectRequest(ctx, StorageCollectRequest{Roots: []json.RawMessage{root}, Unreferenced: []string{garbage[0], kept[0], absent}, DryRun: true})
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	if resp.Blocks != 2 || resp.Removed != 1 || len(resp.Kept) != 1 || resp.Kept[0] != kept[0] {
+		t.Errorf("unexpected collection of unreferenced blocks %+v", resp)
+	}
+	resp, err = client.CollectRequest(ctx, StorageCollectRequest{Unreferenced: []string{garbage[0]}, DryRun: true})
+	if err != nil || resp.Removed != 1 {
+		t.Errorf("expected unreferenced blocks to be collected without roots, got %+v, %v", resp, err)
+	}
+
+	resp, err = client.Collect(ctx, []json.RawMessage{root}, nil, false)
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	if resp.Removed != 2 || resp.Bytes != int64(len("garbage leaf")+len("old index")) {
+		t.Errorf("unexpected collection %+v", resp)
+	}
+	for _, address := range garbage {
+		if store.Has(ctx, address) {
+			t.Errorf("expected %s to be removed", address)
+		}
+	}
+	for _, address := range append(kept, index) {
+		if !store.Has(ctx, address) {
+			t.Errorf("expected %s to be kept", address)
+		}
+	}
+
+	// Servers without a walker cannot collect
+	plainTS := httptest.NewServer(NewStorageServer(NewInMemoryStorage()).WithCollect(true))
+	defer plainTS.Close()
+	if _, err := NewClient(plainTS.URL, nil).Collect(ctx, []json.RawMessage{root}, nil, false); !errors.Is(err, ErrCollectNotSupported) {
+		t.Errorf("expected ErrCollectNotSupported, got %v", err)
+	}
+}
+
+func TestStorageServer_WantExchange(t *testing.T) {
+	ctx := context.Background()
+	sourceStorage := NewInMemoryStorage()
+	address, _ := sourceStorage.Store(ctx, strings.NewReader("wanted block"))
+	destStorage := NewInMemoryStorage()
+	destTS := httptest.NewServer(NewStorageServer(destStorage))
+	defer destTS.Close()
+
+	disc := &mockDiscovery{
+		services: map[string]discovery.ServiceDescription{
+			"dest": {ID: "dest", Address: destTS.URL},
+		},
+	}
+	source := NewStorageServer(sourceStorage).WithDiscovery(disc)
+
+	dest := NewClient(destTS.URL, nil)
+	missing := "0101010101010101010101010101010101010101010101010101010101010101"
+	if err := dest.Want(ctx, []string{address, missing}); err != nil {
+		t.Fatalf("Want failed: %v", err)
+	}
+	if wants, err := dest.Wants(ctx); err != nil || len(wants) != 2 {
+		t.Fatalf("expected 2 wants, got %v (err: %v)", wants, err)
+	}
+
+	source.exchange(ctx)
+	if !destStorage.Has(ctx, address) {
+		t.Fatalf("the wanted block was not pushed")
+	}
+	wants, err := dest.Wants(ctx)
+	if err != nil || len(wants) != 1 || wants[0] != missing {
+		t.Errorf("expected only %s to remain wanted, got %v (err: %v)", missing, wants, err)
+	}
+
+	// Wants expire
+	if got := source.wants.list(time.Now()); len(got) != 0 {
+		t.Errorf("source wants %v", got)
+	}
+	l := newWantList()
+	l.add([]string{missing}, time.Now().Add(-2*WantTTL))
+	if got := l.list(time.Now()); len(got) != 0 {
+		t.Errorf("expired wants listed: %v", got)
+	}
+}
+
+func TestStorageServerBandwidth(t *testing.T) {
+	server := NewStorageServer(NewInMemoryStorage()).WithBandwidthLimit(64 * 1024)
+	handler := server.Handler()
+	serve := func(method, target, remote string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, body)
+		req.RemoteAddr = remote
+		// A client cannot choose its peer with a header
+		req.Header.Set("Invariant-Client", "someone-else")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Random data is not compressed in transit
+	block := make([]byte, 96*1024)
+	rand.Read(block)
+	rec := serve(http.MethodPost, "/", "10.0.0.1:4000", bytes.NewReader(block))
+	address := rec.Body.String()
+
+	// The second peer gets its own allowance, and the reads beyond its burst
+	// are delayed
+	start := time.Now()
+	for port := range 2 {
+		serve(http.MethodGet, "/"+address, fmt.Sprintf("10.0.0.2:%d", 5000+port), nil)
+	}
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Errorf("reading %d bytes at 64KiB/s took %v", 2*len(block), elapsed)
+	}
+
+	var stats BandwidthStats
+	rec = serve(http.MethodGet, "/stats", "10.0.0.3:6000", nil)
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	byPeer := make(map[string]PeerStats)
+	for _, p := range stats.Peers {
+		byPeer[p.Peer] = p
+	}
+	if got := byPeer["10.0.0.1"].BytesReceived; got != int64(len(block)) {
+		t.Errorf("writer received %d bytes, want %d", got, len(block))
+	}
+	if got := byPeer["10.0.0.2"]; got.BytesServed != int64(2*len(block)) || got.Requests != 2 {
+		t.Errorf("reader stats = %+v, want %d bytes in 2 requests", got, 2*len(block))
+	}
+	if stats.BytesServed < int64(2*len(block)) {
+		t.Errorf("total served = %d", stats.BytesServed)
+	}
+
+	// Authenticated requests are accounted to their token wherever they come
+	// from
+	verifier := cap.NewVerifier([]byte("key"))
+	token := verifier.Issue()
+	authed := verifier.Require(handler, cap.StorageRequest)
+	for port := range 2 {
+		req := httptest.NewRequest(http.MethodHead, "/"+address, nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.1.%d:7000", port)
+		req.Header.Set(cap.Header, token.Encode())
+		authed.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	found := false
+	for _, p := range server.bandwidth.stats().Peers {
+		if p.Peer == "token:"+token.ID {
+			found = p.Requests == 2
+		}
+		if strings.HasPrefix(p.Peer, "10.0.1.") {
+			t.Errorf("authenticated request accounted to %s", p.Peer)
+		}
+	}
+	if !found {
+		t.Errorf("authenticated requests were not accounted to their token")
+	}
+
+	// Idle peers are evicted, keeping the totals
+	b := server.bandwidth
+	b.mu.Lock()
+	b.evictLocked(time.Now().Add(peerIdleTTL))
+	b.mu.Unlock()
+	after := b.stats()
+	if len(after.Peers) != 0 {
+		t.Errorf("idle peers kept: %+v", after.Peers)
+	}
+	if after.BytesServed < stats.BytesServed {
+		t.Errorf("total served dropped from %d to %d", stats.BytesServed, after.BytesServed)
+	}
+}
+
+func TestStorageServerPriority(t *testing.T) {
+	entered := make(chan Priority, 4)
+	release := make(chan struct{})
+	handler := newScheduler(1).wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- PriorityOf(r.Context())
+		if PriorityOf(r.Context()) == PriorityBackground {
+			<-release
+		}
+	}))
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	// The client sends the priority of its context
+	client := NewClient(ts.URL, nil)
+	ctx := WithPriority(context.Background(), PriorityBackground)
+	done := make(chan struct{})
+	for range 2 {
+		go func() {
+			client.Has(ctx, "block")
+			done <- struct{}{}
+		}()
+	}
+	if p := <-entered; p != PriorityBackground {
+		t.Fatalf("first request has priority %q", p)
+	}
+
+	// The second background request waits for the first while interactive
+	// requests are served
+	client.Has(context.Background(), "block")
+	if p := <-entered; p != PriorityInteractive {
+		t.Fatalf("interactive request has priority %q", p)
+	}
+	select {
+	case <-entered:
+		t.Fatalf("second background request ran alongside the first")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-done
+	if p := <-entered; p != PriorityBackground {
+		t.Fatalf("second request has priority %q", p)
+	}
+	<-done
+}
+
+func TestStorageServerTransferCompression(t *testing.T) {
+	ctx := context.Background()
+	ts := httptest.NewServer(NewStorageServer(NewInMemoryStorage()))
+	defer ts.Close()
+	client := NewClient(ts.URL, nil)
+
+	// The first upload learns that the server accepts compressed uploads
+	text := strings.Repeat("a compressible block of text ", 1024)
+	if _, err := client.Store(ctx, strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+	address, err := client.Store(ctx, strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(text))
+	if address != hex.EncodeToString(sum[:]) {
+		t.Fatalf("compressed upload stored at %s", address)
+	}
+
+	res, err := http.Get(ts.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats BandwidthStats
+	json.NewDecoder(res.Body).Decode(&stats)
+	res.Body.Close()
+	if stats.BytesReceived >= int64(len(text)) {
+		t.Errorf("received %d bytes for a %d byte block", stats.BytesReceived, len(text))
+	}
+
+	// Compressed downloads are negotiated and decoded transparently
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/"+address, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if enc := res.Header.Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", enc)
+	}
+	for _, c := range []*Client{client, NewClient(ts.URL, nil).WithCompression(false)} {
+		rc, ok := c.Get(ctx, address)
+		if !ok {
+			t.Fatalf("Get failed")
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(data) != text {
+			t.Errorf("Get returned %d bytes, want the %d byte block", len(data), len(text))
+		}
+	}
+
+	// Disabled compression sends blocks as is and rejects compressed uploads
+	plain := httptest.NewServer(NewStorageServer(NewInMemoryStorage()).WithTransferCompression(false))
+	defer plain.Close()
+	if _, err := NewClient(plain.URL, nil).Store(ctx, strings.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, plain.URL+"/"+address, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if enc := res.Header.Get("Content-Encoding"); enc != "" {
+		t.Errorf("Content-Encoding = %q without transfer compression", enc)
+	}
+	req, _ = http.NewRequest(http.MethodPost, plain.URL+"/", strings.NewReader("data"))
+	req.Header.Set("Content-Encoding", "gzip")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("compressed upload to a server without compression got %d", res.StatusCode)
+	}
+}
+
+func TestStorageServer_DecodedSizeLimit(t *testing.T) {
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write(make([]byte, 1<<20))
+	zw.Close()
+	upload := func(handler http.Handler, token *cap.Token, body []byte) int {
+		ts := httptest.NewServer(handler)
+		defer ts.Close()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", "gzip")
+		if token != nil {
+			req.Header.Set(cap.Header, token.Encode())
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// A small compressed body cannot expand past the block size limit
+	store := NewInMemoryStorage()
+	if status := upload(NewStorageServer(store).WithMaxBlockSize(64*1024), nil, bomb.Bytes()); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a decompression bomb, got %d", status)
+	}
+	if status := upload(NewStorageServer(store), nil, bomb.Bytes()); status != http.StatusOK {
+		t.Errorf("expected a block within the limit to be stored, got %d", status)
+	}
+
+	// The max-bytes caveat of a token limits the decoded block
+	verifier := cap.NewVerifier(make([]byte, cap.KeySize))
+	handler := verifier.Require(NewStorageServer(NewInMemoryStorage()), cap.StorageRequest)
+	limited := verifier.Issue(cap.MaxBytes(int64(bomb.Len())))
+	if status := upload(handler, limited, bomb.Bytes()); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a block beyond the max-bytes caveat, got %d", status)
+	}
+	if status := upload(handler, verifier.Issue(cap.MaxBytes(1<<20)), bomb.Bytes()); status != http.StatusOK {
+		t.Errorf("expected a block within the max-bytes caveat to be stored, got %d", status)
+	}
+}
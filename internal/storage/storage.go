@@ -2,7 +2,9 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"io"
+	"time"
 )
 
 // Storage dictates the necessary requirements for standard invariant byte chunk blocks mapping
@@ -28,8 +30,34 @@ type ControlledStorage interface {
 	Remove(ctx context.Context, address string) (bool, error)
 }
 
-// StorageFetchRequest represents a request to fetch a block from another service
+// TimedStorage is an optional interface of storage that records when its
+// blocks were stored, so garbage collection can spare recent blocks whose
+// roots are not yet published.
+type TimedStorage interface {
+	// StoredAt returns when the block at address was last stored, including
+	// by a store that found it already present.
+	StoredAt(ctx context.Context, address string) (time.Time, bool)
+}
+
+// StorageFetchRequest represents a request to fetch a block, with Addresses a
+// batch of blocks, or with Root every block of a file tree, from another
+// service
 type StorageFetchRequest struct {
-	Address   string `json:"address"`
-	Container string `json:"container"`
+	Address   string          `json:"address,omitempty"`
+	Addresses []string        `json:"addresses,omitempty"`
+	Root      json.RawMessage `json:"root,omitempty"` // content link of the root directory
+	Container string          `json:"container"`
 }
+
+// StorageFetchResponse is the response to a batch or closure fetch request,
+// listing the addresses that could not be fetched. The counts are only
+// reported for a closure.
+type StorageFetchResponse struct {
+	Failed  []string `json:"failed"`
+	Blocks  int      `json:"blocks,omitempty"`  // blocks of the closure
+	Present int      `json:"present,omitempty"` // blocks the service already had
+	Fetched int      `json:"fetched,omitempty"` // blocks fetched from the container
+}
+
+// MaxFetchBatch is the most addresses a batch fetch request can list.
+const MaxFetchBatch = 1000
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// subscriberList fans the addresses of newly stored blocks out to the
+// channels returned by Subscribe, dropping each channel once the context it
+// was subscribed with is done.
+type subscriberList struct {
+	mu       sync.Mutex
+	channels map[chan string]struct{}
+}
+
+// subscribe returns a channel receiving the addresses of stored blocks. It
+// is closed when ctx is done.
+func (l *subscriberList) subscribe(ctx context.Context) <-chan string {
+	ch := make(chan string, 100)
+	l.mu.Lock()
+	if l.channels == nil {
+		l.channels = make(map[chan string]struct{})
+	}
+	l.channels[ch] = struct{}{}
+	l.mu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.channels, ch)
+		close(ch)
+	})
+	return ch
+}
+
+// notify sends address to every subscriber with room for it. Subscribers
+// that are full or blocked miss the notification.
+func (l *subscriberList) notify(address string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ch := range l.channels {
+		select {
+		case ch <- address:
+		default:
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// BlockRead is a block read recorded by a Trace.
+type BlockRead struct {
+	Address string        `json:"address"`
+	Server  string        `json:"server,omitempty"` // URL of the storage service that had the block, empty if read locally
+	Latency time.Duration `json:"latency"`          // time until the block started arriving
+	Found   bool          `json:"found"`
+}
+
+// Trace records the blocks read on behalf of a single request, to diagnose
+// slow reads.
+type Trace struct {
+	mu    sync.Mutex
+	reads []BlockRead
+}
+
+// Add records reads.
+func (t *Trace) Add(reads ...BlockRead) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reads = append(t.reads, reads...)
+}
+
+// Reads returns the reads recorded, in the order they were made.
+func (t *Trace) Reads() []BlockRead {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]BlockRead(nil), t.reads...)
+}
+
+type traceKey struct{}
+
+// WithTrace returns a context that asks for the block reads made on its
+// behalf to be recorded by t.
+func WithTrace(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// TraceFrom returns the trace of ctx, or nil if its reads are not traced.
+func TraceFrom(ctx context.Context) *Trace {
+	t, _ := ctx.Value(traceKey{}).(*Trace)
+	return t
+}
+
+// serverSink receives the storage service that answered a traced read.
+type serverSink struct {
+	mu     sync.Mutex
+	server string
+}
+
+type serverSinkKey struct{}
+
+// reportServer records server as the source of the block read with ctx. The
+// first server reported wins, as hedged reads may succeed on several.
+func reportServer(ctx context.Context, server string) {
+	if sink, ok := ctx.Value(serverSinkKey{}).(*serverSink); ok {
+		sink.mu.Lock()
+		if sink.server == "" {
+			sink.server = server
+		}
+		sink.mu.Unlock()
+	}
+}
+
+// TracingStorage records the blocks read from its storage in a Trace.
+type TracingStorage struct {
+	Storage
+	trace *Trace
+}
+
+var _ Storage = (*TracingStorage)(nil)
+
+// NewTracingStorage creates a storage recording the blocks read from s in
+// trace.
+func NewTracingStorage(s Storage, trace *Trace) *TracingStorage {
+	return &TracingStorage{Storage: s, trace: trace}
+}
+
+func (s *TracingStorage) Get(ctx context.Context, address string) (io.ReadCloser, bool) {
+	sink := &serverSink{}
+	start := time.Now()
+	rc, ok := s.Storage.Get(context.WithValue(ctx, serverSinkKey{}, sink), address)
+	latency := time.Since(start)
+	sink.mu.Lock()
+	server := sink.server
+	sink.mu.Unlock()
+	s.trace.Add(BlockRead{Address: address, Server: server, Latency: latency, Found: ok})
+	return rc, ok
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// WantTTL is how long a block stays on a want list without being
+	// received.
+	WantTTL = 10 * time.Minute
+	// MaxWants is the most blocks a want list holds.
+	MaxWants = 100000
+	// exchangePeers is how many peers an exchange round visits. Discovery
+	// returns storage services round-robin, so successive rounds visit all of
+	// them.
+	exchangePeers = 8
+)
+
+// wantList holds the blocks a storage server wants pushed to it by its peers.
+type wantList struct {
+	mu    sync.Mutex
+	wants map[string]time.Time // address -> expiry
+}
+
+func newWantList() *wantList {
+	return &wantList{wants: make(map[string]time.Time)}
+}
+
+// add puts addresses on the list, or extends their expiry if already there,
+// as long as the list has room.
+func (l *wantList) add(addresses []string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, address := range addresses {
+		if _, ok := l.wants[address]; !ok && len(l.wants) >= MaxWants {
+			continue
+		}
+		l.wants[address] = now.Add(WantTTL)
+	}
+}
+
+func (l *wantList) remove(address string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.wants, address)
+}
+
+// list returns the addresses on the list, dropping those that expired.
+func (l *wantList) list(now time.Time) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	addresses := make([]string, 0, len(l.wants))
+	for address, expiry := range l.wants {
+		if now.After(expiry) {
+			delete(l.wants, address)
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+func (s *StorageServer) handleGetWants(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.wants.list(time.Now()))
+}
+
+func (s *StorageServer) handlePostWants(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var addresses []string
+	if err := json.NewDecoder(r.Body).Decode(&addresses); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	var wanted []string
+	for _, address := range addresses {
+		if !s.storage.Has(r.Context(), address) {
+			wanted = append(wanted, address)
+		}
+	}
+	s.wants.add(wanted, time.Now())
+	w.WriteHeader(http.StatusOK)
+}
+
+// StartExchange starts a background goroutine that, every interval, reads the
+// want lists of a few other storage services known to discovery and pushes
+// them the blocks they want that this server holds. The pushes have
+// background priority.
+func (s *StorageServer) StartExchange(ctx context.Context, interval time.Duration) {
+	if s.discovery == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.exchange(WithPriority(ctx, PriorityBackground))
+			}
+		}
+	}()
+}
+
+// exchange runs a single round of pushing wanted blocks to peers.
+func (s *StorageServer) exchange(ctx context.Context) {
+	peers, err := s.discovery.Find(ctx, "storage-v1", exchangePeers)
+	if err != nil {
+		log.Printf("Failed to find storage peers: %v", err)
+		return
+	}
+	for _, peer := range peers {
+		if peer.ID == s.id {
+			continue
+		}
+		client := NewClient(peer.Address, nil)
+		// Peers without want lists are skipped
+		wants, err := client.Wants(ctx)
+		if err != nil {
+			continue
+		}
+		pushed := 0
+		for _, address := range wants {
+			if ctx.Err() != nil {
+				return
+			}
+			data, ok := s.storage.Get(ctx, address)
+			if !ok {
+				continue
+			}
+			stored, err := client.StoreAt(ctx, address, data)
+			data.Close()
+			if err == nil && stored {
+				pushed++
+			}
+		}
+		if pushed > 0 {
+			log.Printf("Pushed %d wanted blocks to %s", pushed, peer.ID)
+		}
+	}
+}